@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/hub"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// adminTokenEnv holds the admin token when --token is not given
+const adminTokenEnv = "CLSP_ADMIN_TOKEN"
+
+// adminClient calls the admin API of a running hub
+type adminClient struct {
+	hubURL string
+	token  string
+	http   *http.Client
+}
+
+// send makes an admin request under the current protocol version and returns the
+// response of a successful one, whose body the caller must close
+func (c *adminClient) send(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimRight(c.hubURL, "/") + hub.APIPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, fmt.Errorf("hub rejected the admin token (create one with 'clsp-hub admin-token')")
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("hub returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// do sends an admin request and decodes a JSON response into out (if not nil)
+func (c *adminClient) do(ctx context.Context, method, path string, query url.Values, out interface{}) error {
+	resp, err := c.send(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from hub: %v", err)
+	}
+	return nil
+}
+
+// adminFlags registers the connection flags every admin command accepts
+func adminFlags(fs *flag.FlagSet, port int) (hubURL, token *string) {
+	defaultHub := os.Getenv("CLSP_HUB_URL")
+	if defaultHub == "" {
+		defaultHub = fmt.Sprintf("http://localhost:%d", port)
+	}
+	hubURL = fs.String("hub", defaultHub, "Hub URL (default $CLSP_HUB_URL or this host)")
+	token = fs.String("token", "", "Admin token (default $"+adminTokenEnv+")")
+	return hubURL, token
+}
+
+// parseAdminArgs parses args, which may start with one positional argument before
+// the flags, and returns that argument
+func parseAdminArgs(fs *flag.FlagSet, args []string) string {
+	var positional string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if positional == "" && fs.NArg() > 0 {
+		positional = fs.Arg(0)
+	}
+	return positional
+}
+
+// confirm asks a yes/no question on the terminal
+func confirm(prompt string) bool {
+	fmt.Printf("%s (y/N): ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	return answer == "y" || answer == "Y"
+}
+
+func doAdmin(port int, dbPath string, args []string) {
+	if len(args) == 0 {
+		printAdminUsage()
+		os.Exit(1)
+	}
+	command, args := args[0], args[1:]
+	if command == "issue-cert" {
+		// Issuing works on the CA files and needs no running hub
+		doIssueCert(dbPath, args)
+		return
+	}
+
+	fs := flag.NewFlagSet("admin "+command, flag.ExitOnError)
+	hubURL, token := adminFlags(fs, port)
+	all := false
+	var userFlag, olderThan, reason, ttl, note, revoke, since, action, actor, target, out string
+	var yes, reset, dryRun, create, jsonl bool
+	var uses, limit int
+	retention := make(map[string]*string)
+	quotas := make(map[string]*string)
+	inactivity := make(map[string]*string)
+	switch command {
+	case "list-users":
+		fs.BoolVar(&all, "all", false, "Include deactivated and banned accounts")
+	case "purge-messages":
+		fs.StringVar(&userFlag, "user", "", "Only messages sent or received by this user (ID or display name)")
+		fs.StringVar(&olderThan, "older-than", "", "Only messages stored longer ago than this duration (e.g. 72h)")
+		fs.BoolVar(&all, "all", false, "Purge every stored message")
+		fs.BoolVar(&yes, "yes", false, "Do not ask for confirmation")
+	case "delete-user":
+		fs.BoolVar(&yes, "yes", false, "Do not ask for confirmation")
+	case "ban":
+		fs.StringVar(&reason, "reason", "", "Reason recorded with the ban")
+	case "retention":
+		for _, name := range []string{"text-undelivered", "text-delivered", "text-read", "attachments-undelivered", "attachments-delivered", "attachments-read"} {
+			retention[name] = fs.String(name, "", "Retention for this kind and state of message (e.g. 168h, 0 clears it)")
+		}
+	case "quota":
+		for _, name := range []string{"hourly-messages", "daily-messages", "burst"} {
+			quotas[name] = fs.String(name, "", "Limit for this window (0 turns it off)")
+		}
+		for _, name := range []string{"hourly-mb", "daily-mb"} {
+			quotas[name] = fs.String(name, "", "Megabytes of messages and attachments for this window (0 turns it off)")
+		}
+		fs.BoolVar(&reset, "reset", false, "Return the user to the default quota")
+	case "gc":
+		fs.BoolVar(&dryRun, "dry-run", false, "Only report what a pass would delete or deactivate")
+		fs.BoolVar(&yes, "yes", false, "Do not ask for confirmation")
+		for _, name := range []string{"inactive-after", "inactive-notice"} {
+			inactivity[name] = fs.String(name, "", "Change the inactivity policy (e.g. 4320h, 0 clears it)")
+		}
+	case "invites":
+		fs.BoolVar(&create, "create", false, "Mint a new invite code")
+		fs.IntVar(&uses, "uses", 1, "Registrations the new code admits")
+		fs.StringVar(&ttl, "ttl", hub.DefaultInviteTTL.String(), "How long the new code is valid (0 for no expiry)")
+		fs.StringVar(&note, "note", "", "Who or what the new code is for")
+		fs.StringVar(&revoke, "revoke", "", "Revoke the invite code with this ID")
+		fs.BoolVar(&all, "all", false, "Include used up and expired codes")
+	case "audit":
+		fs.StringVar(&since, "since", "", "Only entries newer than this duration (e.g. 24h)")
+		fs.StringVar(&action, "action", "", "Only this action (e.g. user.ban) or category (e.g. user)")
+		fs.StringVar(&actor, "actor", "", "Only entries by this actor")
+		fs.StringVar(&target, "target", "", "Only entries about this target (e.g. a user ID)")
+		fs.IntVar(&limit, "limit", 100, "Show at most this many of the newest entries (0 for all; exports default to all)")
+		fs.BoolVar(&jsonl, "jsonl", false, "Export the entries as JSON Lines")
+		fs.StringVar(&out, "out", "", "Write the JSON Lines export to this file instead of standard output")
+	case "stats", "unban":
+	default:
+		fmt.Printf("Unknown admin command: %s\n", command)
+		printAdminUsage()
+		os.Exit(1)
+	}
+	user := parseAdminArgs(fs, args)
+
+	if *token == "" {
+		*token = os.Getenv(adminTokenEnv)
+	}
+	if *token == "" {
+		log.Fatalf("Admin token required: pass --token or set %s", adminTokenEnv)
+	}
+	client := &adminClient{hubURL: *hubURL, token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+	ctx := context.Background()
+
+	switch command {
+	case "list-users":
+		var users []hub.UserSummary
+		query := url.Values{}
+		if all {
+			query.Set("all", "true")
+		}
+		if err := client.do(ctx, http.MethodGet, "/admin/users", query, &users); err != nil {
+			log.Fatalf("Failed to list users: %v", err)
+		}
+		if len(users) == 0 {
+			fmt.Println("No users")
+			return
+		}
+		for _, u := range users {
+			state := "offline"
+			switch {
+			case u.BannedAt != nil:
+				state = "banned " + u.BannedAt.Format("2006-01-02")
+				if u.BanReason != "" {
+					state += " (" + u.BanReason + ")"
+				}
+			case u.DeactivatedAt != nil:
+				state = "deactivated " + u.DeactivatedAt.Format("2006-01-02")
+			case u.Online:
+				state = "online"
+			}
+			fmt.Printf("%-36s  %-20s  last seen %s  %5d messages  %10s  %s\n",
+				u.ID, u.DisplayName, u.LastSeen.Format("2006-01-02 15:04"), u.Messages, formatBytes(float64(u.StoredBytes)), state)
+		}
+		fmt.Printf("%d users\n", len(users))
+
+	case "delete-user":
+		if user == "" {
+			log.Fatalf("Usage: clsp-hub admin delete-user <id|name> [--yes]")
+		}
+		if !yes && !confirm(fmt.Sprintf("Permanently delete %s and every message they sent or received?", user)) {
+			fmt.Println("Cancelled")
+			return
+		}
+		var result hub.PurgeResult
+		if err := client.do(ctx, http.MethodDelete, "/admin/users", url.Values{"user": {user}}, &result); err != nil {
+			log.Fatalf("Failed to delete user: %v", err)
+		}
+		fmt.Printf("Deleted %s and %d messages\n", user, result.Messages)
+
+	case "purge-messages":
+		query := url.Values{}
+		var scope []string
+		if userFlag != "" {
+			query.Set("user", userFlag)
+			scope = append(scope, "to or from "+userFlag)
+		}
+		if olderThan != "" {
+			age, err := time.ParseDuration(olderThan)
+			if err != nil || age <= 0 {
+				log.Fatalf("Invalid --older-than duration: %s", olderThan)
+			}
+			query.Set("before", fmt.Sprintf("%d", time.Now().Add(-age).Unix()))
+			scope = append(scope, "older than "+olderThan)
+		}
+		if len(scope) == 0 {
+			if !all {
+				log.Fatalf("Usage: clsp-hub admin purge-messages [--user <id|name>] [--older-than <duration>] | --all")
+			}
+			query.Set("all", "true")
+			scope = append(scope, "stored on the hub")
+		}
+		description := "every message " + strings.Join(scope, " and ")
+		if !yes && !confirm("Purge "+description+"?") {
+			fmt.Println("Cancelled")
+			return
+		}
+		var result hub.PurgeResult
+		if err := client.do(ctx, http.MethodDelete, "/admin/messages", query, &result); err != nil {
+			log.Fatalf("Failed to purge messages: %v", err)
+		}
+		fmt.Printf("Purged %d messages\n", result.Messages)
+
+	case "ban":
+		if user == "" {
+			log.Fatalf("Usage: clsp-hub admin ban <id|name> [--reason <text>]")
+		}
+		if err := client.do(ctx, http.MethodPost, "/admin/bans", url.Values{"user": {user}, "reason": {reason}}, nil); err != nil {
+			log.Fatalf("Failed to ban user: %v", err)
+		}
+		fmt.Printf("User %s banned\n", user)
+
+	case "unban":
+		if user == "" {
+			log.Fatalf("Usage: clsp-hub admin unban <id|name>")
+		}
+		if err := client.do(ctx, http.MethodDelete, "/admin/bans", url.Values{"user": {user}}, nil); err != nil {
+			log.Fatalf("Failed to unban user: %v", err)
+		}
+		fmt.Printf("User %s unbanned and reactivated\n", user)
+
+	case "stats":
+		var stats hub.HubStats
+		if err := client.do(ctx, http.MethodGet, "/admin/stats", nil, &stats); err != nil {
+			log.Fatalf("Failed to get stats: %v", err)
+		}
+		printStats(*hubURL, stats)
+
+	case "retention":
+		query := url.Values{}
+		for name, value := range retention {
+			if *value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(*value); err != nil || d < 0 {
+				log.Fatalf("Invalid --%s duration: %s", name, *value)
+			}
+			query.Set(strings.ReplaceAll(name, "-", "_"), *value)
+		}
+		method := http.MethodGet
+		if len(query) > 0 {
+			method = http.MethodPut
+		}
+		var policy hub.RetentionPolicy
+		if err := client.do(ctx, method, "/admin/retention", query, &policy); err != nil {
+			log.Fatalf("Failed to update retention policy: %v", err)
+		}
+		fmt.Printf("Retention       %-14s %-14s %s\n", "Undelivered", "Delivered", "Read")
+		for _, kind := range []struct {
+			name string
+			rule hub.RetentionRule
+		}{{"Text", policy.Text}, {"Attachments", policy.Attachments}} {
+			fmt.Printf("  %-13s %-14s %-14s %s\n", kind.name, formatRetention(kind.rule.Undelivered), formatRetention(kind.rule.Delivered), formatRetention(kind.rule.Read))
+		}
+		fmt.Println("Messages are never kept past their own expiry.")
+
+	case "gc":
+		query := url.Values{}
+		for name, value := range inactivity {
+			if *value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(*value); err != nil || d < 0 {
+				log.Fatalf("Invalid --%s duration: %s", name, *value)
+			}
+			query.Set(strings.ReplaceAll(name, "-", "_"), *value)
+		}
+		var report hub.GCReport
+		if len(query) > 0 {
+			if err := client.do(ctx, http.MethodPut, "/admin/gc", query, &report); err != nil {
+				log.Fatalf("Failed to update inactivity policy: %v", err)
+			}
+		} else if err := client.do(ctx, http.MethodGet, "/admin/gc", nil, &report); err != nil {
+			log.Fatalf("Failed to plan garbage collection: %v", err)
+		}
+		printGCReport(report)
+		if dryRun || (len(report.Warned) == 0 && len(report.Deactivated) == 0 && report.Attachments == 0 && report.OrphanFiles == 0) {
+			return
+		}
+		if !yes && !confirm("Run this garbage collection pass now?") {
+			fmt.Println("Cancelled")
+			return
+		}
+		if err := client.do(ctx, http.MethodPost, "/admin/gc", nil, &report); err != nil {
+			log.Fatalf("Failed to collect garbage: %v", err)
+		}
+		fmt.Println()
+		printGCReport(report)
+
+	case "invites":
+		switch {
+		case create:
+			if d, err := time.ParseDuration(ttl); err != nil || d < 0 {
+				log.Fatalf("Invalid --ttl duration: %s", ttl)
+			}
+			if uses < 1 {
+				log.Fatalf("--uses must be at least 1")
+			}
+			query := url.Values{"uses": {strconv.Itoa(uses)}, "ttl": {ttl}, "note": {note}}
+			var invite hub.InviteCode
+			if err := client.do(ctx, http.MethodPost, "/admin/invites", query, &invite); err != nil {
+				log.Fatalf("Failed to create invite code: %v", err)
+			}
+			// Codes are stored hashed, so this is the only time it can be shown
+			fmt.Printf("Invite code: %s\n", invite.Code)
+			fmt.Printf("ID %s, %d use(s), %s\n", invite.ID, invite.MaxUses, formatInviteExpiry(invite.ExpiresAt))
+			fmt.Println("Each user joins with: clsp init --invite <code>")
+		case revoke != "":
+			if err := client.do(ctx, http.MethodDelete, "/admin/invites", url.Values{"id": {revoke}}, nil); err != nil {
+				log.Fatalf("Failed to revoke invite code: %v", err)
+			}
+			fmt.Printf("Invite code %s revoked\n", revoke)
+		default:
+			query := url.Values{}
+			if all {
+				query.Set("all", "true")
+			}
+			var codes []hub.InviteCode
+			if err := client.do(ctx, http.MethodGet, "/admin/invites", query, &codes); err != nil {
+				log.Fatalf("Failed to list invite codes: %v", err)
+			}
+			if len(codes) == 0 {
+				fmt.Println("No usable invite codes (mint one with --create)")
+				return
+			}
+			for _, c := range codes {
+				fmt.Printf("%-36s  %3d of %-3d used  created %s  %s  %s\n",
+					c.ID, c.Uses, c.MaxUses, c.CreatedAt.Format("2006-01-02"), formatInviteExpiry(c.ExpiresAt), c.Note)
+			}
+		}
+
+	case "quota":
+		query := url.Values{}
+		for name, value := range quotas {
+			if *value == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(*value, 10, 64)
+			if err != nil || n < 0 {
+				log.Fatalf("Invalid --%s: %s", name, *value)
+			}
+			param := strings.ReplaceAll(name, "-", "_")
+			if strings.HasSuffix(name, "-mb") {
+				param, n = strings.TrimSuffix(param, "_mb")+"_bytes", n<<20
+			}
+			query.Set(param, strconv.FormatInt(n, 10))
+		}
+		if user != "" {
+			query.Set("user", user)
+		}
+		method := http.MethodGet
+		switch {
+		case reset:
+			if user == "" || len(query) > 1 {
+				log.Fatalf("Usage: clsp-hub admin quota <user> --reset")
+			}
+			method = http.MethodDelete
+		case len(query) > 1 || (user == "" && len(query) > 0):
+			method = http.MethodPut
+		}
+		var settings hub.QuotaSettings
+		if err := client.do(ctx, method, "/admin/quotas", query, &settings); err != nil {
+			log.Fatalf("Failed to update send quota: %v", err)
+		}
+		if settings.Sender != nil {
+			q, u := settings.Sender.Quota, settings.Sender.Usage
+			source := "hub default"
+			if settings.Sender.Override {
+				source = "own quota"
+			}
+			fmt.Printf("%s (%s): %s\n", settings.Sender.DisplayName, settings.Sender.UserID, source)
+			fmt.Printf("  %-16s %-20s %s\n", "", "This hour", "Today")
+			fmt.Printf("  %-16s %-20s %s\n", "Messages", formatQuotaUse(u.HourlyMessages, q.HourlyMessages, false), formatQuotaUse(u.DailyMessages, q.DailyMessages, false))
+			fmt.Printf("  %-16s %-20s %s\n", "Volume", formatQuotaUse(u.HourlyBytes, q.HourlyBytes, true), formatQuotaUse(u.DailyBytes, q.DailyBytes, true))
+			fmt.Printf("  %-16s %s\n", "Burst", formatQuotaLimit(q.Burst, false))
+			return
+		}
+		fmt.Printf("Default quota   %-14s %s\n", "Hourly", "Daily")
+		fmt.Printf("  %-13s %-14s %s\n", "Messages", formatQuotaLimit(settings.Default.HourlyMessages, false), formatQuotaLimit(settings.Default.DailyMessages, false))
+		fmt.Printf("  %-13s %-14s %s\n", "Volume", formatQuotaLimit(settings.Default.HourlyBytes, true), formatQuotaLimit(settings.Default.DailyBytes, true))
+		fmt.Printf("  %-13s %s\n", "Burst", formatQuotaLimit(settings.Default.Burst, false))
+		if len(settings.Overrides) == 0 {
+			return
+		}
+		fmt.Println("\nOwn quotas      Messages (hour/day)  Volume (hour/day)       Burst")
+		for _, o := range settings.Overrides {
+			fmt.Printf("  %-13s %-20s %-23s %s\n", o.DisplayName,
+				formatQuotaLimit(o.Quota.HourlyMessages, false)+"/"+formatQuotaLimit(o.Quota.DailyMessages, false),
+				formatQuotaLimit(o.Quota.HourlyBytes, true)+"/"+formatQuotaLimit(o.Quota.DailyBytes, true),
+				formatQuotaLimit(o.Quota.Burst, false))
+		}
+	}
+}
+
+// printGCReport shows a garbage collection pass, or what one would do
+func printGCReport(report hub.GCReport) {
+	if report.Inactivity.After > 0 {
+		notice := report.Inactivity.Notice
+		if notice == 0 {
+			notice = hub.DefaultInactivityNotice
+		}
+		fmt.Printf("Accounts unused for %s are warned, and deactivated %s later if still unused\n", report.Inactivity.After, notice)
+	} else {
+		fmt.Println("Unused accounts are kept (set --inactive-after to retire them)")
+	}
+	warned, deactivated, action := "Warned", "Deactivated", "Deleted"
+	if report.DryRun {
+		warned, deactivated, action = "To warn", "To deactivate", "To delete"
+	}
+	if len(report.Warned) > 0 {
+		fmt.Printf("%s:\n", warned)
+		for _, u := range report.Warned {
+			fmt.Printf("  %-36s  %-20s  last seen %s  deactivated %s unless used\n",
+				u.ID, u.DisplayName, u.LastSeen.Format("2006-01-02"), u.DeactivateAt.Format("2006-01-02"))
+		}
+	}
+	if len(report.Deactivated) > 0 {
+		fmt.Printf("%s:\n", deactivated)
+		for _, u := range report.Deactivated {
+			fmt.Printf("  %-36s  %-20s  last seen %s\n", u.ID, u.DisplayName, u.LastSeen.Format("2006-01-02"))
+		}
+	}
+	fmt.Printf("%s: %d unreferenced attachments (%s), %d orphaned files (%s)\n", action,
+		report.Attachments, formatBytes(float64(report.AttachmentBytes)), report.OrphanFiles, formatBytes(float64(report.OrphanBytes)))
+}
+
+// formatQuotaLimit renders a send quota limit, zero meaning none
+func formatQuotaLimit(limit int64, bytes bool) string {
+	switch {
+	case limit == 0:
+		return "none"
+	case bytes:
+		return formatBytes(float64(limit))
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// formatQuotaUse renders the use of a send quota limit
+func formatQuotaUse(used, limit int64, bytes bool) string {
+	if bytes {
+		return formatBytes(float64(used)) + " of " + formatQuotaLimit(limit, true)
+	}
+	return strconv.FormatInt(used, 10) + " of " + formatQuotaLimit(limit, false)
+}
+
+// formatInviteExpiry renders when an invite code expires, zero meaning never
+func formatInviteExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "never expires"
+	}
+	return "expires " + t.Format("2006-01-02 15:04")
+}
+
+// formatRetention renders a retention rule duration, zero meaning the message expiry
+func formatRetention(d time.Duration) string {
+	if d == 0 {
+		return "expiry"
+	}
+	return d.String()
+}
+
+// formatAuditDetails renders the details of an audit entry as key=value pairs
+func formatAuditDetails(details map[string]interface{}) string {
+	keys := make([]string, 0, len(details))
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		value, _ := json.Marshal(details[k])
+		fmt.Fprintf(&b, "  %s=%s", k, value)
+	}
+	return b.String()
+}
+
+func printAdminUsage() {
+	fmt.Println("Usage: clsp-hub admin <command> [--hub <url>] [--token <admin token>]")
+	fmt.Println("Commands:")
+	fmt.Println("  list-users [--all]                 List accounts (--all includes deactivated and banned)")
+	fmt.Println("  delete-user <user> [--yes]         Delete an account and its messages immediately")
+	fmt.Println("  purge-messages [--user <user>] [--older-than <dur>] [--all] [--yes]")
+	fmt.Println("                                     Delete stored messages")
+	fmt.Println("  ban <user> [--reason <text>]       Ban an account (it cannot register again)")
+	fmt.Println("  unban <user>                       Lift a ban")
+	fmt.Println("  stats                              Accounts, storage, pending deliveries and uptime")
+	fmt.Println("  audit [--since <dur>] [--action <action>] [--actor <actor>] [--target <target>] [--limit <n>]")
+	fmt.Println("        [--jsonl] [--out <file>]     Show or export the audit log of admin and destructive actions")
+	fmt.Println("  retention [--text-undelivered <dur>] [--text-delivered <dur>] [--text-read <dur>]")
+	fmt.Println("            [--attachments-undelivered <dur>] [--attachments-delivered <dur>] [--attachments-read <dur>]")
+	fmt.Println("                                     Show or change how long messages are kept by state")
+	fmt.Println("  quota [<user>] [--hourly-messages <n>] [--daily-messages <n>] [--hourly-mb <MB>] [--daily-mb <MB>]")
+	fmt.Println("        [--burst <n>] [--reset]      Show or change the default outbound quota, or a user's own")
+	fmt.Println("  gc [--dry-run] [--yes] [--inactive-after <dur>] [--inactive-notice <dur>]")
+	fmt.Println("                                     Retire unused accounts and delete unreferenced attachments")
+	fmt.Println("  invites [--all] | --create [--uses <n>] [--ttl <dur>] [--note <text>] | --revoke <id>")
+	fmt.Println("                                     List, mint or revoke invite codes for registration")
+	fmt.Println("  issue-cert <name> [--ca-cert <file>] [--ca-key <file>] [--days <n>] [--out <dir>]")
+	fmt.Println("                                     Issue a client certificate for -client-ca (works offline)")
+	fmt.Printf("The token comes from 'clsp-hub admin-token' and can also be set in $%s.\n", adminTokenEnv)
+}
+
+// doIssueCert issues a client certificate for a hub run with -client-ca, creating the
+// client CA next to the database on first use
+func doIssueCert(dbPath string, args []string) {
+	if dbPath == "" {
+		dbPath = paths.HubDBPath
+	}
+	defaultCert, defaultKey := hub.ClientCAPaths(filepath.Dir(dbPath))
+	fs := flag.NewFlagSet("admin issue-cert", flag.ExitOnError)
+	caCert := fs.String("ca-cert", defaultCert, "Client CA certificate")
+	caKey := fs.String("ca-key", defaultKey, "Client CA private key")
+	days := fs.Int("days", int(hub.DefaultClientCertValidity/(24*time.Hour)), "Days the certificate is valid")
+	outDir := fs.String("out", ".", "Directory to write <name>.crt and <name>.key to")
+	name := parseAdminArgs(fs, args)
+	if name == "" {
+		log.Fatalf("Usage: clsp-hub admin issue-cert <name> [--ca-cert <file>] [--ca-key <file>] [--days <n>] [--out <dir>]")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		log.Fatalf("Invalid name %q: it names the certificate files", name)
+	}
+	if *days <= 0 {
+		log.Fatalf("Invalid --days value: %d", *days)
+	}
+
+	_, certErr := os.Stat(*caCert)
+	_, keyErr := os.Stat(*caKey)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := os.MkdirAll(filepath.Dir(*caCert), 0700); err != nil {
+			log.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := hub.CreateClientCA(*caCert, *caKey, "CLSP hub client CA"); err != nil {
+			log.Fatalf("Failed to create client CA: %v", err)
+		}
+		fmt.Printf("Created client CA %s (key %s)\n", *caCert, *caKey)
+		fmt.Printf("Start the hub with -client-ca %s to require client certificates\n", *caCert)
+	}
+
+	certPEM, keyPEM, err := hub.IssueClientCert(*caCert, *caKey, name, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		log.Fatalf("Failed to issue certificate: %v", err)
+	}
+	certPath := filepath.Join(*outDir, name+".crt")
+	keyPath := filepath.Join(*outDir, name+".key")
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		log.Fatalf("Failed to save key: %v", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		log.Fatalf("Failed to save certificate: %v", err)
+	}
+	fmt.Printf("Issued certificate for %s: %s (key %s)\n", name, certPath, keyPath)
+	fmt.Printf("Hand both to the user, who runs: clsp config --set-client-cert %s.crt --set-client-key %s.key\n", name, name)
+}
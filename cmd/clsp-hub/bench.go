@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/hub"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// benchOptions holds the settings of 'clsp-hub bench'
+type benchOptions struct {
+	hubURL        string
+	users         int
+	duration      time.Duration
+	sendRate      float64
+	fetchInterval time.Duration
+	size          int
+	jsonEnvelopes bool
+}
+
+// benchUser is one simulated user with its own client
+type benchUser struct {
+	name   string
+	client *clspclient.Client
+}
+
+// benchStats collects the latencies and errors of one kind of operation
+type benchStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	firstErr  error
+}
+
+func (s *benchStats) record(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		if s.firstErr == nil {
+			s.firstErr = err
+		}
+		return
+	}
+	s.latencies = append(s.latencies, d)
+}
+
+// benchPercentile returns the p-th percentile (0-100) of sorted durations
+func benchPercentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// printRow prints the throughput and latency percentiles of one operation
+func (s *benchStats) printRow(name string, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rate := float64(len(sorted)) / elapsed.Seconds()
+	fmt.Printf("%-10s %8d %7d %9.1f %9s %9s %9s %9s\n", name, len(sorted), s.errors, rate,
+		benchDuration(benchPercentile(sorted, 50)), benchDuration(benchPercentile(sorted, 95)),
+		benchDuration(benchPercentile(sorted, 99)), benchDuration(benchPercentile(sorted, 100)))
+}
+
+// benchDuration rounds a latency for display
+func benchDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
+
+// startBenchHub serves a hub with a throwaway database on a random local port and
+// returns its URL and a function that stops it and removes the database
+func startBenchHub() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "clsp-bench-")
+	if err != nil {
+		return "", nil, err
+	}
+	server, err := hub.NewServer(filepath.Join(dir, "hub.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.Shutdown()
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	httpServer := &http.Server{Handler: server.Handler()}
+	go httpServer.Serve(listener)
+	stop := func() {
+		httpServer.Close()
+		server.Shutdown()
+		os.RemoveAll(dir)
+	}
+	return "http://" + listener.Addr().String(), stop, nil
+}
+
+// registerBenchUsers creates n identities on the hub, generating keys in parallel, and
+// returns them with the display name prefix they share
+func registerBenchUsers(ctx context.Context, hubURL string, n int, jsonEnvelopes bool) ([]*benchUser, string, error) {
+	runID := make([]byte, 3)
+	rand.Read(runID)
+	prefix := "bench-" + hex.EncodeToString(runID)
+
+	// One health check serves every simulated user, as the CLI cache does for a person
+	health := clspclient.NewHealthCache()
+	users := make([]*benchUser, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var key *rsa.PrivateKey
+			key, _, errs[i] = clspclient.GenerateKey()
+			if errs[i] != nil {
+				return
+			}
+			client := clspclient.New(hubURL, uuid.New().String(), key)
+			client.HealthCache = health
+			client.JSONEnvelopes = jsonEnvelopes
+			name := fmt.Sprintf("%s-%d", prefix, i+1)
+			if errs[i] = client.Register(ctx, clspclient.RegisterRequest{DisplayName: name}); errs[i] != nil {
+				return
+			}
+			users[i] = &benchUser{name: name, client: client}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return users, prefix, nil
+}
+
+// runBench drives the simulated users until ctx ends and returns the elapsed time
+func runBench(ctx context.Context, users []*benchUser, opts benchOptions, send, fetch, delivery *benchStats) time.Duration {
+	content := make([]byte, opts.size)
+	for i := range content {
+		content[i] = 'a' + byte(i%26)
+	}
+	// Send times by message ID, for the store-to-fetch delivery latency
+	var sentAt sync.Map
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, u := range users {
+		wg.Add(2)
+		go func(i int, u *benchUser) {
+			defer wg.Done()
+			if opts.sendRate <= 0 {
+				return
+			}
+			rng := mrand.New(mrand.NewSource(int64(i) + start.UnixNano()))
+			interval := time.Duration(float64(time.Second) / opts.sendRate)
+			// Spread the first sends so users do not fire in lockstep
+			timer := time.NewTimer(time.Duration(rng.Int63n(int64(interval))))
+			defer timer.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+				next := rng.Intn(len(users) - 1)
+				if next >= i {
+					next++
+				}
+				began := time.Now()
+				result, err := u.client.SendMessage(ctx, users[next].client.UserID, content, clspclient.SendOptions{AllowDuplicate: true})
+				if ctx.Err() != nil {
+					return
+				}
+				send.record(time.Since(began), err)
+				if err == nil {
+					for _, id := range result.IDs {
+						sentAt.Store(id, began)
+					}
+				}
+				timer.Reset(interval)
+			}
+		}(i, u)
+		go func(u *benchUser) {
+			defer wg.Done()
+			ticker := time.NewTicker(opts.fetchInterval)
+			defer ticker.Stop()
+			var since time.Time
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				began := time.Now()
+				envelopes, hubNow, err := u.client.FetchEnvelopes(ctx, clspclient.MessageQuery{Since: since})
+				if ctx.Err() != nil {
+					return
+				}
+				fetched := time.Now()
+				fetch.record(fetched.Sub(began), err)
+				if err != nil {
+					continue
+				}
+				since = hubNow
+				for _, env := range envelopes {
+					if t, ok := sentAt.LoadAndDelete(env.ID); ok {
+						delivery.record(fetched.Sub(t.(time.Time)), nil)
+					}
+				}
+			}
+		}(u)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+// doBench simulates users sending and fetching messages against a hub and reports
+// throughput and latency percentiles
+func doBench(args []string) {
+	var opts benchOptions
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&opts.hubURL, "hub", "", "Hub URL to load (default: an embedded hub with a temporary database)")
+	fs.IntVar(&opts.users, "users", 10, "Number of simulated users")
+	fs.DurationVar(&opts.duration, "duration", 30*time.Second, "How long to run")
+	fs.Float64Var(&opts.sendRate, "send-rate", 0.5, "Messages each user sends per second")
+	fs.DurationVar(&opts.fetchInterval, "fetch-interval", 2*time.Second, "How often each user fetches new messages")
+	fs.IntVar(&opts.size, "size", 256, "Message size in bytes")
+	fs.BoolVar(&opts.jsonEnvelopes, "json-envelopes", false, "Send and fetch envelopes as JSON even if the hub accepts protobuf")
+	wire := fs.Bool("wire", false, "Compare the JSON and protobuf envelope encodings instead of loading a hub")
+	fs.Parse(args)
+
+	if *wire {
+		benchWire()
+		return
+	}
+
+	if opts.users < 2 {
+		log.Fatalf("--users must be at least 2")
+	}
+	if opts.duration <= 0 || opts.fetchInterval <= 0 {
+		log.Fatalf("--duration and --fetch-interval must be positive")
+	}
+	if opts.sendRate < 0 || opts.size < 1 {
+		log.Fatalf("--send-rate must not be negative and --size must be at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	target := opts.hubURL
+	if target == "" {
+		var stopHub func()
+		var err error
+		target, stopHub, err = startBenchHub()
+		if err != nil {
+			log.Fatalf("Failed to start embedded hub: %v", err)
+		}
+		defer stopHub()
+		fmt.Printf("Started embedded hub at %s\n", target)
+	}
+
+	fmt.Printf("Registering %d users...\n", opts.users)
+	users, prefix, err := registerBenchUsers(ctx, target, opts.users, opts.jsonEnvelopes)
+	if err != nil {
+		log.Fatalf("Failed to register bench users: %v", err)
+	}
+	fmt.Printf("Running for %s: %.2f sends/s and a fetch every %s per user, %d-byte messages\n",
+		opts.duration, opts.sendRate, opts.fetchInterval, opts.size)
+
+	runCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	var send, fetch, delivery benchStats
+	elapsed := runBench(runCtx, users, opts, &send, &fetch, &delivery)
+
+	fmt.Printf("\nResults over %s (%d users)\n", elapsed.Round(time.Millisecond), len(users))
+	fmt.Printf("%-10s %8s %7s %9s %9s %9s %9s %9s\n", "Operation", "Count", "Errors", "Per sec", "p50", "p95", "p99", "Max")
+	send.printRow("send", elapsed)
+	fetch.printRow("fetch", elapsed)
+	delivery.printRow("delivery", elapsed)
+	fmt.Println("(delivery is the time from starting a send to the recipient's fetch returning it)")
+	for _, s := range []struct {
+		name  string
+		stats *benchStats
+	}{{"send", &send}, {"fetch", &fetch}} {
+		if s.stats.firstErr != nil {
+			fmt.Printf("First %s error: %v\n", s.name, s.stats.firstErr)
+		}
+	}
+	if opts.hubURL != "" {
+		fmt.Printf("\nThe bench users (%s-*) remain on the hub; remove them with 'clsp-hub admin delete-user'.\n", prefix)
+	}
+}
+
+// benchWireSizes are the envelopes benchWire compares: a short text, and messages
+// carrying inline attachments of growing size
+var benchWireSizes = []struct {
+	name       string
+	content    int
+	attachment int
+}{
+	{"1 KiB text", 1 << 10, 0},
+	{"64 KiB file", 256, 64 << 10},
+	{"1 MiB file", 256, 1 << 20},
+	{"8 MiB file", 256, 8 << 20},
+}
+
+// benchWire encodes and decodes envelopes as JSON and as protobuf, reporting their
+// sizes and the time each takes
+func benchWire() {
+	fmt.Printf("%-12s %10s %10s %6s %10s %10s %10s %10s\n", "Envelope", "JSON", "Protobuf", "Saved", "JSON enc", "PB enc", "JSON dec", "PB dec")
+	for _, size := range benchWireSizes {
+		msg := benchEnvelope(size.content, size.attachment)
+		jsonData, jsonEncode, err := benchCodec(func() ([]byte, error) { return crypto.EncodeMessage(msg) })
+		if err != nil {
+			log.Fatalf("Failed to encode JSON envelope: %v", err)
+		}
+		protoData, protoEncode, err := benchCodec(func() ([]byte, error) { return crypto.EncodeMessageProto(msg) })
+		if err != nil {
+			log.Fatalf("Failed to encode protobuf envelope: %v", err)
+		}
+		_, jsonDecode, err := benchCodec(func() ([]byte, error) { _, err := crypto.DecodeMessage(jsonData); return nil, err })
+		if err != nil {
+			log.Fatalf("Failed to decode JSON envelope: %v", err)
+		}
+		_, protoDecode, err := benchCodec(func() ([]byte, error) { _, err := crypto.DecodeMessageProto(protoData); return nil, err })
+		if err != nil {
+			log.Fatalf("Failed to decode protobuf envelope: %v", err)
+		}
+		saved := 100 * (1 - float64(len(protoData))/float64(len(jsonData)))
+		fmt.Printf("%-12s %10s %10s %5.1f%% %10s %10s %10s %10s\n", size.name,
+			formatBytes(float64(len(jsonData))), formatBytes(float64(len(protoData))), saved,
+			benchDuration(jsonEncode), benchDuration(protoEncode), benchDuration(jsonDecode), benchDuration(protoDecode))
+	}
+	fmt.Println("(times are per envelope; decoding includes validation)")
+}
+
+// benchCodec runs f repeatedly for about a fifth of a second and returns its last
+// result and the mean time it took
+func benchCodec(f func() ([]byte, error)) ([]byte, time.Duration, error) {
+	var data []byte
+	var err error
+	runs := 0
+	start := time.Now()
+	for runs == 0 || time.Since(start) < 200*time.Millisecond {
+		if data, err = f(); err != nil {
+			return nil, 0, err
+		}
+		runs++
+	}
+	return data, time.Since(start) / time.Duration(runs), nil
+}
+
+// benchEnvelope returns a well-formed envelope with random ciphertext of the given
+// sizes, and an inline attachment if attachment is not zero
+func benchEnvelope(content, attachment int) *crypto.Message {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	msg := &crypto.Message{
+		Version:      crypto.MessageVersionGCM,
+		ID:           uuid.New().String(),
+		Sender:       uuid.New().String(),
+		Recipient:    uuid.New().String(),
+		Timestamp:    time.Now().Unix(),
+		EncryptedKey: random(256),
+		IV:           random(12),
+		Content:      random(content + crypto.GCMOverhead),
+		Signature:    random(256),
+	}
+	if attachment > 0 {
+		msg.Attachment = &crypto.Attachment{
+			Filename:    "bench.bin",
+			ContentType: "application/octet-stream",
+			Size:        int64(attachment),
+			Content:     random(attachment + crypto.GCMOverhead),
+			Nonce:       random(12),
+		}
+	}
+	return msg
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// doEscrow manages the organizational recovery key and recovers escrowed messages
+func doEscrow(dbPath, generate, setKey string, disable bool, recoverID, keyPath string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case generate != "" || setKey != "":
+		var pemKey []byte
+		if generate != "" {
+			if _, err := os.Stat(generate); err == nil {
+				log.Fatalf("%s already exists; refusing to overwrite a recovery key", generate)
+			}
+			key, publicPEM, err := crypto.GenerateKeyPair()
+			if err != nil {
+				log.Fatalf("Failed to generate recovery key: %v", err)
+			}
+			if err := crypto.SavePrivateKey(key, generate); err != nil {
+				log.Fatalf("Failed to save recovery key: %v", err)
+			}
+			pemKey = publicPEM
+			fmt.Printf("Recovery private key written to %s\n", generate)
+			fmt.Println("Move it off this host and keep it offline: it decrypts every escrowed message.")
+		} else {
+			if pemKey, err = os.ReadFile(setKey); err != nil {
+				log.Fatalf("Failed to read escrow key: %v", err)
+			}
+		}
+		key, err := crypto.LoadPublicKeyFromPEM(pemKey)
+		if err != nil {
+			log.Fatalf("Invalid escrow key: %v", err)
+		}
+		fingerprint, err := crypto.Fingerprint(key)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := server.SetEscrowKey(string(pemKey)); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := server.SaveConfig(ctx); err != nil {
+			log.Fatalf("Failed to save configuration: %v", err)
+		}
+		fmt.Printf("Escrow key published (fingerprint %s)\n", fingerprint)
+		fmt.Println("Users must still opt in with 'clsp config --escrow on'; restart the hub to apply.")
+	case disable:
+		if err := server.SetEscrowKey(""); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := server.SaveConfig(ctx); err != nil {
+			log.Fatalf("Failed to save configuration: %v", err)
+		}
+		fmt.Println("Escrow key removed; clients stop escrowing new messages")
+	case recoverID != "":
+		if keyPath == "" {
+			log.Fatalf("--key <recovery private key> is required with --recover")
+		}
+		key, err := crypto.LoadPrivateKey(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load recovery key: %v", err)
+		}
+		msg, err := server.EscrowedMessage(ctx, recoverID)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		content, err := crypto.RecoverMessage(key, msg)
+		if err != nil {
+			log.Fatalf("Failed to recover message: %v", err)
+		}
+		fmt.Printf("Message ID: %s\n", msg.ID)
+		fmt.Printf("From: %s\n", msg.Sender)
+		fmt.Printf("To: %s\n", msg.Recipient)
+		fmt.Printf("Time: %s\n", time.Unix(msg.Timestamp, 0).UTC().Format(time.RFC3339))
+		if msg.Part != nil {
+			fmt.Printf("Part: %d of %d (group %s)\n", msg.Part.Index+1, msg.Part.Total, msg.Part.Group)
+		}
+		if msg.Attachment != nil {
+			fmt.Printf("Attachment: %s (%d bytes, not extracted)\n", msg.Attachment.Filename, msg.Attachment.Size)
+		}
+		fmt.Printf("Message: %s\n", content)
+	default:
+		cfg := server.Config()
+		if cfg.EscrowKey == "" {
+			fmt.Println("Escrow: off (no recovery key published)")
+		} else if key, err := crypto.LoadPublicKeyFromPEM([]byte(cfg.EscrowKey)); err == nil {
+			fingerprint, _ := crypto.Fingerprint(key)
+			fmt.Printf("Escrow: on (recovery key fingerprint %s)\n", fingerprint)
+		}
+		fmt.Println("Usage: clsp-hub escrow --generate <private key file> | --set-key <public.pem> | --disable | --recover <message id> --key <private key file>")
+	}
+}
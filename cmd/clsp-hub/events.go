@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/mattd/clsp/internal/hub"
+)
+
+// doEvents prints the operational events a running hub kept, and with --follow keeps
+// printing new ones until interrupted
+func doEvents(port int, args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	hubURL, token := adminFlags(fs, port)
+	follow := fs.Bool("follow", false, "Keep streaming new events until interrupted")
+	kind := fs.String("kind", "", "Only these kinds, comma-separated: registration, ban, rate_limit, federation_failure")
+	since := fs.Int64("since", 0, "Only events after this event ID")
+	jsonOut := fs.Bool("json", false, "Print each event as a JSON line")
+	fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv(adminTokenEnv)
+	}
+	if *token == "" {
+		log.Fatalf("Admin token required: pass --token or set %s", adminTokenEnv)
+	}
+	// A followed stream stays open, so only the connection is bounded
+	client := &adminClient{hubURL: *hubURL, token: *token, http: &http.Client{}}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	query := url.Values{"follow": {strconv.FormatBool(*follow)}}
+	if *kind != "" {
+		query.Set("kind", *kind)
+	}
+	if *since > 0 {
+		query.Set("since", strconv.FormatInt(*since, 10))
+	}
+	resp, err := client.send(ctx, http.MethodGet, "/admin/events", query)
+	if err != nil {
+		log.Fatalf("Failed to read events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Server-sent events: "data:" lines carry the JSON event, a blank line ends one
+	seen := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e hub.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			log.Fatalf("Invalid event from hub: %v", err)
+		}
+		seen++
+		if *jsonOut {
+			fmt.Println(data)
+			continue
+		}
+		user := e.UserID
+		if user == "" {
+			user = "-"
+		}
+		fmt.Printf("%6d  %s  %-5s  %-18s  %-36s  %s\n",
+			e.ID, e.Time.Format("2006-01-02 15:04:05"), strings.ToUpper(e.Level), e.Kind, user, e.Message)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		log.Fatalf("Event stream interrupted: %v", err)
+	}
+	if seen == 0 && !*follow && !*jsonOut {
+		fmt.Println("No events since the hub started")
+	}
+}
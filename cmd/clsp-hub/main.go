@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +21,110 @@ import (
 	"github.com/mattd/clsp/internal/paths"
 )
 
+// database selects the hub's database: the SQLite file given by --db, or with
+// --db-driver postgres the database named by --dsn. With noMigrate, databases with
+// pending migrations are refused rather than upgraded.
+var database struct {
+	driver    string
+	dsn       string
+	noMigrate bool
+}
+
+// dsnEnv names the environment variable --dsn defaults to, so that a database
+// password need not appear in the process list
+const dsnEnv = "CLSP_HUB_DSN"
+
+// openStore opens the selected database and returns it with the hub's data
+// directory. With a database server the hub key and attachments are still kept in
+// the directory holding dbPath.
+func openStore(dbPath string) (hub.Store, string, error) {
+	if dbPath == "" {
+		dbPath = paths.HubDBPath
+	}
+	dataDir := filepath.Dir(dbPath)
+	dsn := database.dsn
+	if database.driver == hub.DriverSQLite {
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return nil, "", fmt.Errorf("failed to create database directory: %v", err)
+		}
+		dsn = dbPath
+	}
+	store, err := hub.OpenStore(database.driver, dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, dataDir, nil
+}
+
+// openServer opens the hub on the selected database, applying pending migrations
+// unless --no-migrate is given
+func openServer(dbPath string) (*hub.Server, error) {
+	store, dataDir, err := openStore(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if database.noMigrate {
+		if err := hub.CheckDatabaseVersion(context.Background(), store); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return hub.NewServerWithStore(store, dataDir)
+}
+
+// commandContext returns the context of a one-off command, under which the hub
+// records actions in its audit log as made by the local account running it
+func commandContext() context.Context {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return hub.WithAuditActor(context.Background(), "cli "+name)
+}
+
+// doMigrate applies the pending schema migrations, or with status only lists them
+func doMigrate(dbPath string, status bool) {
+	store, _, err := openStore(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if status {
+		list, err := hub.Migrations(ctx, store)
+		if err != nil {
+			log.Fatalf("Failed to read migrations: %v", err)
+		}
+		version, err := hub.DatabaseVersion(ctx, store)
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		fmt.Printf("Schema version %d (this hub: %d)\n", version, hub.LatestDatabaseVersion())
+		for _, m := range list {
+			state := "pending"
+			if !m.AppliedAt.IsZero() {
+				state = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("  %3d  %-50s  %s\n", m.Version, m.Description, state)
+		}
+		return
+	}
+
+	applied, err := hub.Migrate(ctx, store)
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(applied) == 0 {
+		fmt.Printf("Database is up to date (schema version %d)\n", hub.LatestDatabaseVersion())
+		return
+	}
+	fmt.Printf("Database is at schema version %d\n", hub.LatestDatabaseVersion())
+}
+
 func doInit(dbPath string) {
 	if dbPath == "" {
 		dbPath = paths.HubDBPath
@@ -23,20 +133,35 @@ func doInit(dbPath string) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		log.Fatalf("Failed to create directory %s: %v", dir, err)
 	}
-	server, err := hub.NewServer(dbPath)
+	server, err := openServer(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	server.Shutdown() // Close DB connection
+	if database.driver != hub.DriverSQLite {
+		fmt.Printf("Initialization successful! The %s database and directory '%s' are ready.\n", database.driver, dir)
+		return
+	}
 	fmt.Printf("Initialization successful! Directory '%s' and database '%s' are ready.\n", dir, dbPath)
 }
 
-func doConfig(dbPath string, timeout, expiry, rateLimit int) {
+// logFlags holds the file logging options of 'clsp-hub config'; negative numbers and an
+// empty string leave the current setting unchanged
+type logFlags struct {
+	file        string
+	maxSizeMB   int
+	maxAgeHours int
+	maxBackups  int
+	compress    string
+	format      string
+}
+
+func doConfig(dbPath string, timeout, expiry, rateLimit, purgeDelay, dedupeWindow, clockTolerance, unsendWindow int, oidcIssuer, oidcClientID string, disableOIDC bool, maxUsers, maxStorageMB, maxMessageKB, maxAttachmentMB int, userWebhooks, requireInvite string, logging logFlags) {
 	if dbPath == "" {
 		dbPath = paths.HubDBPath
 	}
 
-	server, err := hub.NewServer(dbPath)
+	server, err := openServer(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
@@ -52,56 +177,1099 @@ func doConfig(dbPath string, timeout, expiry, rateLimit int) {
 	if rateLimit > 0 {
 		server.SetRateLimit(rateLimit)
 	}
+	if purgeDelay > 0 {
+		server.SetUserPurgeDelay(time.Duration(purgeDelay) * time.Hour)
+	}
+	if dedupeWindow >= 0 {
+		server.SetDedupeWindow(time.Duration(dedupeWindow) * time.Second)
+	}
+	if clockTolerance >= 0 {
+		server.SetClockSkewTolerance(time.Duration(clockTolerance) * time.Second)
+	}
+	if unsendWindow >= 0 {
+		server.SetUnsendWindow(time.Duration(unsendWindow) * time.Second)
+	}
+
+	if maxUsers >= 0 || maxStorageMB >= 0 {
+		cfg := server.Config()
+		users, storage := cfg.MaxUsers, cfg.MaxStorageBytes
+		if maxUsers >= 0 {
+			users = maxUsers
+		}
+		if maxStorageMB >= 0 {
+			storage = int64(maxStorageMB) << 20
+		}
+		server.SetQuotas(users, storage)
+	}
+	if maxMessageKB >= 0 {
+		server.SetMaxMessageSize(maxMessageKB << 10)
+	}
+	if maxAttachmentMB >= 0 {
+		server.SetMaxAttachmentSize(int64(maxAttachmentMB) << 20)
+	}
+	switch userWebhooks {
+	case "":
+	case "on":
+		server.SetUserWebhooks(true)
+	case "off":
+		server.SetUserWebhooks(false)
+	default:
+		log.Fatalf("--user-webhooks must be on or off")
+	}
+	switch requireInvite {
+	case "":
+	case "on":
+		server.SetRequireInvite(true)
+	case "off":
+		server.SetRequireInvite(false)
+	default:
+		log.Fatalf("--require-invite must be on or off")
+	}
+
+	cfg := server.Config()
+	logFile, logSize, logAge, logBackups, logCompress := cfg.LogFile, cfg.LogMaxSizeMB, cfg.LogMaxAge, cfg.LogMaxBackups, cfg.LogCompress
+	switch logging.file {
+	case "":
+	case "off":
+		logFile = ""
+	default:
+		abs, err := filepath.Abs(logging.file)
+		if err != nil {
+			log.Fatalf("Invalid log file path: %v", err)
+		}
+		logFile = abs
+	}
+	if logging.maxSizeMB >= 0 {
+		logSize = logging.maxSizeMB
+	}
+	if logging.maxAgeHours >= 0 {
+		logAge = time.Duration(logging.maxAgeHours) * time.Hour
+	}
+	if logging.maxBackups >= 0 {
+		logBackups = logging.maxBackups
+	}
+	switch logging.compress {
+	case "":
+	case "on":
+		logCompress = true
+	case "off":
+		logCompress = false
+	default:
+		log.Fatalf("--log-compress must be on or off")
+	}
+	server.SetLogFile(logFile, logSize, logAge, logBackups, logCompress)
+	if logging.format != "" {
+		if err := server.SetLogFormat(logging.format); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if disableOIDC {
+		server.SetOIDC("", "")
+	} else if oidcIssuer != "" {
+		if oidcClientID == "" {
+			log.Fatalf("--oidc-client-id is required with --oidc-issuer")
+		}
+		server.SetOIDC(oidcIssuer, oidcClientID)
+	}
+
+	if err := server.SaveConfig(commandContext()); err != nil {
+		log.Fatalf("Failed to save configuration: %v", err)
+	}
 
 	fmt.Println("Hub configuration updated successfully!")
 }
 
+func doMotd(dbPath, post string, expires int, list bool, remove string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case post != "":
+		ann, err := server.PostAnnouncement(ctx, post, time.Duration(expires)*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to post announcement: %v", err)
+		}
+		fmt.Printf("Announcement %s posted (expires %s)\n", ann.ID, ann.ExpiresAt.Format(time.RFC3339))
+	case remove != "":
+		if err := server.RemoveAnnouncement(ctx, remove); err != nil {
+			log.Fatalf("Failed to remove announcement: %v", err)
+		}
+		fmt.Printf("Announcement %s removed\n", remove)
+	case list:
+		announcements, err := server.ListAnnouncements(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list announcements: %v", err)
+		}
+		if len(announcements) == 0 {
+			fmt.Println("No active announcements")
+			return
+		}
+		for _, ann := range announcements {
+			fmt.Printf("%s  (posted %s, expires %s)\n", ann.ID, ann.CreatedAt.Format(time.RFC3339), ann.ExpiresAt.Format(time.RFC3339))
+			fmt.Printf("  %s\n", ann.Body)
+		}
+	default:
+		fmt.Println("Usage: clsp-hub motd --post <text> [--expires <hours>] | --list | --remove <id>")
+	}
+}
+
+func doUsers(dbPath, deactivate, reactivate string, listDeactivated bool) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case deactivate != "":
+		if err := server.DeactivateUser(ctx, deactivate); err != nil {
+			log.Fatalf("Failed to deactivate user: %v", err)
+		}
+		fmt.Printf("User %s deactivated; it will be purged after %v unless reactivated\n", deactivate, server.Config().UserPurgeDelay)
+	case reactivate != "":
+		if err := server.ReactivateUser(ctx, reactivate); err != nil {
+			log.Fatalf("Failed to reactivate user: %v", err)
+		}
+		fmt.Printf("User %s reactivated\n", reactivate)
+	case listDeactivated:
+		users, err := server.ListDeactivatedUsers(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list deactivated users: %v", err)
+		}
+		if len(users) == 0 {
+			fmt.Println("No deactivated users")
+			return
+		}
+		for _, u := range users {
+			fmt.Printf("%s  %s  (deactivated %s, purge after %s)\n", u.ID, u.DisplayName, u.DeactivatedAt.Format(time.RFC3339), u.PurgeAt.Format(time.RFC3339))
+		}
+	default:
+		fmt.Println("Usage: clsp-hub users --deactivate <id|name> | --reactivate <id|name> | --deactivated")
+	}
+}
+
+func doTenants(rootDBPath, add, hosts, prefix string, list bool, remove string) {
+	root, err := hub.NewServer(rootDBPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer root.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case add != "":
+		t := hub.Tenant{Name: add, PathPrefix: prefix}
+		for _, h := range strings.Split(hosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				t.Hosts = append(t.Hosts, h)
+			}
+		}
+		if err := root.AddTenant(ctx, t); err != nil {
+			log.Fatalf("Failed to add tenant: %v", err)
+		}
+
+		tenant, err := hub.NewServer(hub.TenantDBPath(rootDBPath, add))
+		if err != nil {
+			log.Fatalf("Failed to open tenant database: %v", err)
+		}
+		token, err := tenant.RotateAdminToken(ctx)
+		tenant.Shutdown()
+		if err != nil {
+			log.Fatalf("Failed to create admin token: %v", err)
+		}
+
+		fmt.Printf("Tenant %s added (database %s)\n", add, hub.TenantDBPath(rootDBPath, add))
+		fmt.Printf("Admin token (shown only once): %s\n", token)
+		fmt.Printf("Configure it with: clsp-hub --tenant %s config ...\n", add)
+		fmt.Println("Restart the multi-tenant hub to start serving it")
+	case remove != "":
+		if err := root.RemoveTenant(ctx, remove); err != nil {
+			log.Fatalf("Failed to remove tenant: %v", err)
+		}
+		fmt.Printf("Tenant %s removed; its database was left at %s\n", remove, hub.TenantDBPath(rootDBPath, remove))
+	case list:
+		tenants, err := root.ListTenants(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list tenants: %v", err)
+		}
+		if len(tenants) == 0 {
+			fmt.Println("No tenants")
+			return
+		}
+		for _, t := range tenants {
+			fmt.Printf("%-20s  prefix=%-15s  hosts=%s\n", t.Name, t.PathPrefix, strings.Join(t.Hosts, ","))
+		}
+	default:
+		fmt.Println("Usage: clsp-hub tenants --add <name> [--host <h1,h2>] [--prefix <path>] | --remove <name> | --list")
+	}
+}
+
+func doAdminToken(dbPath string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	token, err := server.RotateAdminToken(commandContext())
+	if err != nil {
+		log.Fatalf("Failed to rotate admin token: %v", err)
+	}
+	fmt.Printf("New admin token (shown only once; the previous token no longer works):\n%s\n", token)
+}
+
+// ldapPasswordEnv names the environment variable holding the LDAP bind password,
+// so it never appears in the process list
+const ldapPasswordEnv = "CLSP_LDAP_PASSWORD"
+
+func doProvision(dbPath, csvPath string, ldapSrc hub.LDAPSource, ttlHours int, outPath string, list bool, revoke string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case list:
+		invites, err := server.ListInvites(ctx, false)
+		if err != nil {
+			log.Fatalf("Failed to list invites: %v", err)
+		}
+		if len(invites) == 0 {
+			fmt.Println("No unclaimed invites")
+			return
+		}
+		for _, inv := range invites {
+			state := "pending"
+			if time.Now().After(inv.ExpiresAt) {
+				state = "expired"
+			}
+			fmt.Printf("%s  %-20s  %-30s  %s (expires %s)\n", inv.UserID, inv.DisplayName, inv.Email, state, inv.ExpiresAt.Format(time.RFC3339))
+		}
+		return
+	case revoke != "":
+		if err := server.RevokeInvite(ctx, revoke); err != nil {
+			log.Fatalf("Failed to revoke invite: %v", err)
+		}
+		fmt.Printf("Invite for %s revoked\n", revoke)
+		return
+	}
+
+	var entries []hub.ProvisionEntry
+	switch {
+	case csvPath != "":
+		f, err := os.Open(csvPath)
+		if err != nil {
+			log.Fatalf("Failed to open CSV: %v", err)
+		}
+		entries, err = hub.ReadProvisionCSV(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	case ldapSrc.URL != "":
+		if ldapSrc.BaseDN == "" {
+			log.Fatalf("--ldap-base is required with --ldap-url")
+		}
+		ldapSrc.BindPassword = os.Getenv(ldapPasswordEnv)
+		entries, err = hub.ReadProvisionLDAP(ldapSrc)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	default:
+		fmt.Println("Usage: clsp-hub provision --csv <file> | --ldap-url <url> --ldap-base <dn> | --list | --revoke <user>")
+		return
+	}
+
+	result, err := server.ProvisionUsers(ctx, entries, time.Duration(ttlHours)*time.Hour)
+	if err != nil {
+		log.Fatalf("Failed to provision users: %v", err)
+	}
+
+	for name, reason := range result.Skipped {
+		fmt.Printf("Skipped %s: %s\n", name, reason)
+	}
+	if len(result.Created) == 0 {
+		fmt.Println("No new accounts provisioned")
+		return
+	}
+
+	// Invite codes are stored hashed, so this is the only time they can be shown
+	if outPath != "" {
+		f, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", outPath, err)
+		}
+		w := csv.NewWriter(f)
+		w.Write([]string{"display_name", "email", "user_id", "invite_code", "expires_at"})
+		for _, inv := range result.Created {
+			w.Write([]string{inv.DisplayName, inv.Email, inv.UserID, inv.Code, inv.ExpiresAt.Format(time.RFC3339)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatalf("Failed to write %s: %v", outPath, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Failed to write %s: %v", outPath, err)
+		}
+		fmt.Printf("Provisioned %d account(s); invite codes written to %s\n", len(result.Created), outPath)
+		return
+	}
+
+	fmt.Printf("Provisioned %d account(s). Invite codes are shown only once:\n", len(result.Created))
+	for _, inv := range result.Created {
+		fmt.Printf("  %-20s  %-30s  %s\n", inv.DisplayName, inv.Email, inv.Code)
+	}
+	fmt.Println("Each user joins with: clsp init --invite <code>")
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func doReport(dbPath string, days, top int) {
+	if days < 1 {
+		log.Fatalf("--days must be at least 1")
+	}
+
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	report, err := server.Report(context.Background(), days, top)
+	if err != nil {
+		log.Fatalf("Failed to build report: %v", err)
+	}
+
+	fmt.Printf("Capacity report since %s (%d days)\n", report.Since.Format("2006-01-02"), days)
+	fmt.Printf("\nStorage\n")
+	fmt.Printf("  Database size:    %s\n", formatBytes(float64(report.DatabaseBytes)))
+	fmt.Printf("  Stored messages:  %d (%s)\n", report.StoredMessages, formatBytes(float64(report.StoredBytes)))
+
+	fmt.Printf("\nDaily growth\n")
+	if len(report.Daily) == 0 {
+		fmt.Println("  No messages in this period")
+	}
+	for _, d := range report.Daily {
+		fmt.Printf("  %s  %6d messages  %10s\n", d.Day.Format("2006-01-02"), d.Messages, formatBytes(float64(d.Bytes)))
+	}
+
+	fmt.Printf("\nTop talkers\n")
+	if len(report.TopTalkers) == 0 {
+		fmt.Println("  None")
+	}
+	for _, t := range report.TopTalkers {
+		name := t.DisplayName
+		if name == "" {
+			name = "(purged)"
+		}
+		fmt.Printf("  %-36s  %-20s  %6d messages  %10s\n", t.UserID, name, t.Messages, formatBytes(float64(t.Bytes)))
+	}
+
+	fmt.Printf("\nMessage sizes\n")
+	for _, b := range report.Sizes {
+		fmt.Printf("  %-12s  %d\n", b.Label, b.Messages)
+	}
+
+	fmt.Printf("\nProjection\n")
+	fmt.Printf("  Ingest:      %s/day\n", formatBytes(report.IngestPerDay))
+	fmt.Printf("  Net growth:  %s/day (ingest minus expiring messages)\n", formatBytes(report.GrowthPerDay))
+	switch {
+	case report.DiskFreeBytes < 0:
+		fmt.Println("  Disk free:   unknown")
+	case report.DaysToFull == 0:
+		fmt.Printf("  Disk free:   %s (not growing)\n", formatBytes(float64(report.DiskFreeBytes)))
+	default:
+		fmt.Printf("  Disk free:   %s (full in ~%.0f days)\n", formatBytes(float64(report.DiskFreeBytes)), report.DaysToFull)
+	}
+}
+
+func doMetrics(dbPath string, days, top int) {
+	if days < 1 {
+		log.Fatalf("--days must be at least 1")
+	}
+
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	m, err := server.DeliveryMetrics(context.Background(), days, top)
+	if err != nil {
+		log.Fatalf("Failed to collect metrics: %v", err)
+	}
+
+	fmt.Printf("Delivery since %s (%d days)\n", m.Since.Format("2006-01-02"), days)
+	fmt.Printf("  Delivered:          %d\n", m.Delivered)
+	fmt.Printf("  Expired unfetched:  %d\n", m.ExpiredUnfetched)
+	fmt.Printf("  Latency avg/max:    %v / %v\n", m.LatencyAvg, m.LatencyMax)
+	fmt.Printf("  Latency p50/p90/p99: %v / %v / %v\n", m.LatencyP50, m.LatencyP90, m.LatencyP99)
+
+	fmt.Printf("\nBacklog (never-fetched messages)\n")
+	if len(m.Backlog) == 0 {
+		fmt.Println("  None")
+		return
+	}
+	for _, b := range m.Backlog {
+		fmt.Printf("  %-36s  %-20s  %5d pending  oldest %-10v  expires in %-10v  last seen %s\n",
+			b.UserID, b.DisplayName, b.Pending, b.OldestAge, b.NextExpiry, b.LastSeen.Format(time.RFC3339))
+	}
+}
+
+func doLogs(dbPath, level, since, user string, limit int) {
+	if level != "" && !hub.ValidLogLevel(level) {
+		log.Fatalf("Unknown level %q (use debug, info, warn or error)", level)
+	}
+
+	q := hub.LogQuery{MinLevel: level, UserID: user, Limit: limit}
+	if since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			q.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			q.Since = t
+		} else {
+			log.Fatalf("Invalid --since %q (use a duration such as 1h or an RFC 3339 time)", since)
+		}
+	}
+
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	entries, err := server.Logs(context.Background(), q)
+	if err != nil {
+		log.Fatalf("Failed to read logs: %v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Println("No matching log entries")
+		return
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf("%s  %-5s  %s", e.Time.Format(time.RFC3339), strings.ToUpper(e.Level), e.Message)
+		if e.UserID != "" {
+			line += "  user=" + e.UserID
+		}
+		fmt.Println(line)
+	}
+}
+
+func doDeadLetters(dbPath, retry, drop string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	switch {
+	case retry != "":
+		if err := server.RetryDeadLetter(ctx, retry); err != nil {
+			log.Fatalf("Failed to retry %s: %v", retry, err)
+		}
+		fmt.Printf("Delivery %s queued for another attempt\n", retry)
+	case drop != "":
+		if err := server.DropDeadLetter(ctx, drop); err != nil {
+			log.Fatalf("Failed to drop %s: %v", drop, err)
+		}
+		fmt.Printf("Dead letter %s dropped\n", drop)
+	default:
+		queue, err := server.DeliveryQueue(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read delivery queue: %v", err)
+		}
+		fmt.Printf("Pending deliveries: %d\n", queue.Pending)
+		if len(queue.DeadLetters) == 0 {
+			fmt.Println("No dead letters")
+			return
+		}
+		fmt.Println("Dead letters:")
+		for _, dl := range queue.DeadLetters {
+			fmt.Printf("  %s  %s %s  (%d bytes, %d attempts, failed %s)\n",
+				dl.ID, dl.Kind, dl.Target, dl.PayloadSize, dl.Attempts, dl.FailedAt.Format(time.RFC3339))
+			fmt.Printf("    %s\n", dl.LastError)
+		}
+	}
+}
+
+func doFederation(dbPath, name, insecure, allowPrivate, allow, disallow, forget string) {
+	server, err := openServer(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer server.Shutdown()
+
+	ctx := commandContext()
+	if forget != "" {
+		if err := server.ForgetPeer(ctx, forget); err != nil {
+			log.Fatalf("Failed to forget %s: %v", forget, err)
+		}
+		fmt.Printf("Key of %s forgotten; the key it presents next is pinned\n", forget)
+		return
+	}
+
+	if name != "" || insecure != "" || allowPrivate != "" || allow != "" || disallow != "" {
+		cfg := server.Config()
+		federationName, federationInsecure := cfg.FederationName, cfg.FederationInsecure
+		switch name {
+		case "":
+		case "off":
+			federationName = ""
+		default:
+			if strings.ContainsAny(name, "/@") {
+				log.Fatalf("--name is the host (and port) other hubs reach this one at, such as hub.example.com")
+			}
+			federationName = name
+		}
+		switch insecure {
+		case "":
+		case "on":
+			federationInsecure = true
+		case "off":
+			federationInsecure = false
+		default:
+			log.Fatalf("--insecure must be on or off")
+		}
+		server.SetFederation(federationName, federationInsecure)
+		switch allowPrivate {
+		case "":
+		case "on":
+			server.SetFederationAllowPrivate(true)
+		case "off":
+			server.SetFederationAllowPrivate(false)
+		default:
+			log.Fatalf("--allow-private must be on or off")
+		}
+		if allow != "" {
+			if err := server.AllowPeer(ctx, allow); err != nil {
+				log.Fatalf("Failed to allow %s: %v", allow, err)
+			}
+		}
+		if disallow != "" {
+			if err := server.DisallowPeer(ctx, disallow); err != nil {
+				log.Fatalf("Failed to disallow %s: %v", disallow, err)
+			}
+		}
+		if err := server.SaveConfig(ctx); err != nil {
+			log.Fatalf("Failed to save configuration: %v", err)
+		}
+	}
+
+	cfg := server.Config()
+	if cfg.FederationName == "" {
+		fmt.Println("Federation is off")
+	} else {
+		fmt.Printf("Federating as %s\n", cfg.FederationName)
+		if cfg.FederationInsecure {
+			fmt.Println("Peers are reached over plain HTTP (testing only)")
+		}
+		if cfg.FederationAllowPrivate {
+			fmt.Println("Peers may be IP addresses, local names and private addresses")
+		}
+		if len(cfg.FederationPeers) > 0 {
+			fmt.Printf("Allowed hubs: %s\n", strings.Join(cfg.FederationPeers, ", "))
+		}
+	}
+	peers, err := server.FederationPeers(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list federated hubs: %v", err)
+	}
+	if len(peers) == 0 {
+		fmt.Println("No federated hubs yet")
+		return
+	}
+	fmt.Println("Federated hubs:")
+	for _, peer := range peers {
+		fmt.Printf("  %s  %s  (first seen %s, last seen %s)\n",
+			peer.Name, peer.Fingerprint, peer.FirstSeen.Format(time.RFC3339), peer.LastSeen.Format(time.RFC3339))
+	}
+}
+
+// configureServer applies the run's preset and log level to a hub about to serve
+func configureServer(server *hub.Server, preset *hub.Preset, logLevel string) {
+	if preset != nil {
+		server.ApplyPreset(*preset)
+	}
+	if logLevel != "" {
+		if err := server.SetLogLevel(logLevel); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+}
+
+// openLogFile sets up the process log in the configured format (or format, when set
+// for this run), sending it to the configured file as well as stderr
+func openLogFile(cfg hub.HubConfig, format string) io.Closer {
+	if format == "" {
+		format = cfg.LogFormat
+	}
+	logFile, err := hub.OpenLogFile(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+	var out io.Writer = os.Stderr
+	if logFile != nil {
+		out = io.MultiWriter(os.Stderr, logFile)
+	}
+	slog.SetDefault(slog.New(hub.NewLogHandler(out, format)))
+	if logFile == nil {
+		return nil
+	}
+	return logFile
+}
+
+// torPasswordEnv names the environment variable --tor-password defaults to
+const torPasswordEnv = "CLSP_TOR_PASSWORD"
+
+// publishOnion publishes the hub listening on port as an onion service, announcing its
+// address; it exits if Tor cannot be reached
+func publishOnion(opts hub.OnionOptions, dataDir string, port int, useTLS bool) *hub.OnionService {
+	service, err := hub.PublishOnion(opts, dataDir, port, useTLS)
+	if err != nil {
+		log.Fatalf("Failed to publish onion service: %v", err)
+	}
+	fmt.Printf("Onion service published: %s\n", service.URL(useTLS))
+	slog.Info("onion service published", "address", service.Address, "port", service.Port)
+	return service
+}
+
+// Version information, set at build time by 'go run install.go' through -ldflags
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
+	grpcPort := flag.Int("grpc-port", 0, "Also serve the gRPC interface on this port (0 to disable)")
 	dbPath := flag.String("db", "", "Path to database file (default: global config location)")
+	flag.StringVar(&database.driver, "db-driver", hub.DriverSQLite, "Database driver: "+hub.DriverSQLite+" or "+hub.DriverPostgres)
+	flag.StringVar(&database.dsn, "dsn", os.Getenv(dsnEnv), "PostgreSQL connection string for --db-driver "+hub.DriverPostgres+" (default $"+dsnEnv+")")
+	flag.BoolVar(&database.noMigrate, "no-migrate", false, "Refuse a database with pending schema migrations instead of applying them (see 'clsp-hub migrate')")
+	multiTenant := flag.Bool("multi-tenant", false, "Serve the tenants registered in the database instead of a single hub")
+	tenant := flag.String("tenant", "", "Run the command against this tenant's database")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with this certificate file (PEM, with --tls-key)")
+	tlsKey := flag.String("tls-key", "", "Private key file for --tls-cert")
+	acmeDomain := flag.String("acme-domain", "", "Serve HTTPS with Let's Encrypt certificates for these comma-separated domains")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the ACME account")
+	acmeCache := flag.String("acme-cache", "", "Directory for ACME certificates (default: 'acme' next to the database)")
+	acmeHTTP := flag.String("acme-http", ":80", "Address for ACME HTTP challenges and HTTPS redirects (empty to disable)")
+	clientCA := flag.String("client-ca", "", "Require client certificates signed by a CA in this PEM bundle (see 'clsp-hub admin issue-cert')")
+	onion := flag.Bool("onion", false, "Also publish the hub as a Tor onion service through a local Tor daemon")
+	torControl := flag.String("tor-control", hub.DefaultTorControlAddr, "Control port of the Tor daemon for --onion")
+	torPassword := flag.String("tor-password", os.Getenv(torPasswordEnv), "Control port password for --onion (default $"+torPasswordEnv+"; cookie authentication needs none)")
+	onionKey := flag.String("onion-key", "", "File holding the onion service key (default: 'onion_key' next to the database)")
+	presetName := flag.String("preset", "", "Apply a bundle of settings for this run: "+strings.Join(hub.PresetNames(), " or "))
+	logLevel := flag.String("log-level", "", "Lowest log level recorded: debug, info, warn or error (default info)")
+	logFormat := flag.String("log-format", "", "Format of the hub log for this run: text or json (default: configured format)")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("clsp-hub %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+
+	var preset *hub.Preset
+	if *presetName != "" {
+		p, err := hub.LookupPreset(*presetName)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		preset = &p
+		if p.TempDB && *dbPath == "" {
+			*dbPath = p.TempDBPath()
+		}
+	}
+	if *logLevel != "" && !hub.ValidLogLevel(*logLevel) {
+		log.Fatalf("Unknown log level %q (use debug, info, warn or error)", *logLevel)
+	}
+	if !hub.ValidLogFormat(*logFormat) {
+		log.Fatalf("Unknown log format %q (use %s or %s)", *logFormat, hub.LogFormatText, hub.LogFormatJSON)
+	}
+
+	if database.driver != hub.DriverSQLite && database.driver != hub.DriverPostgres {
+		log.Fatalf("Unknown database driver %q (use %s or %s)", database.driver, hub.DriverSQLite, hub.DriverPostgres)
+	}
+	usesTenants := *multiTenant || *tenant != "" || (len(flag.Args()) > 0 && flag.Args()[0] == "tenants")
+	if database.driver != hub.DriverSQLite && usesTenants {
+		log.Fatalf("Tenants need --db-driver %s: each has a database file of its own", hub.DriverSQLite)
+	}
+
+	rootDBPath := *dbPath
+	if rootDBPath == "" {
+		rootDBPath = paths.HubDBPath
+	}
+	if *tenant != "" {
+		tenantDB := hub.TenantDBPath(rootDBPath, *tenant)
+		if _, err := os.Stat(tenantDB); err != nil {
+			log.Fatalf("Unknown tenant %s (no database at %s)", *tenant, tenantDB)
+		}
+		*dbPath = tenantDB
+	}
+
 	// Handle subcommands
 	if len(flag.Args()) > 0 {
 		switch flag.Args()[0] {
 		case "init":
 			doInit(*dbPath)
 			return
+		case "migrate":
+			migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+			status := migrateCmd.Bool("status", false, "List the migrations and which are applied, without applying any")
+			migrateCmd.Parse(flag.Args()[1:])
+			doMigrate(*dbPath, *status)
+			return
 		case "config":
 			configCmd := flag.NewFlagSet("config", flag.ExitOnError)
 			timeout := configCmd.Int("timeout", 0, "Set hub timeout in seconds")
 			expiry := configCmd.Int("expiry", 0, "Set message expiry in hours")
 			rateLimit := configCmd.Int("rate-limit", 0, "Set rate limit (messages per minute)")
+			purgeDelay := configCmd.Int("purge-delay", 0, "Set how long deactivated users are kept before purging, in hours")
+			dedupeWindow := configCmd.Int("dedupe-window", -1, "Suppress identical sends within this many seconds (0 disables)")
+			clockTolerance := configCmd.Int("clock-tolerance", -1, "Reject message timestamps further than this many seconds from hub time (0 disables)")
+			unsendWindow := configCmd.Int("unsend-window", -1, "Let senders delete messages already fetched for this many seconds after sending (0 allows only unfetched ones)")
+			oidcIssuer := configCmd.String("oidc-issuer", "", "Require registrations to present an ID token from this OIDC issuer")
+			oidcClientID := configCmd.String("oidc-client-id", "", "OIDC client ID (expected token audience)")
+			disableOIDC := configCmd.Bool("disable-oidc", false, "Allow registration without single sign-on")
+			maxUsers := configCmd.Int("max-users", -1, "Maximum number of active users (0 for unlimited)")
+			maxStorage := configCmd.Int("max-storage", -1, "Maximum stored message volume in MB (0 for unlimited)")
+			maxMessage := configCmd.Int("max-message-size", -1, "Largest message text in KB; longer messages are split by clients (0 for unlimited)")
+			maxAttachment := configCmd.Int("max-attachment-size", -1, "Largest uploaded attachment in MB (0 for unlimited)")
+			userWebhooks := configCmd.String("user-webhooks", "", "Let users register webhooks notified of new messages: on or off")
+			requireInvite := configCmd.String("require-invite", "", "Only register new accounts that give an invite code: on or off")
+			var logging logFlags
+			configCmd.StringVar(&logging.file, "log-file", "", "Also write the hub log to this file ('off' to stop)")
+			configCmd.IntVar(&logging.maxSizeMB, "log-max-size", -1, "Rotate the log file when it exceeds this many MB (0 for no size limit)")
+			configCmd.IntVar(&logging.maxAgeHours, "log-max-age", -1, "Rotate the log file after this many hours (0 for no age limit)")
+			configCmd.IntVar(&logging.maxBackups, "log-max-backups", -1, "Number of rotated log files to keep (0 keeps all)")
+			configCmd.StringVar(&logging.compress, "log-compress", "", "Gzip rotated log files: on or off")
+			configCmd.StringVar(&logging.format, "log-format", "", "Format of the hub log: text or json")
 			configCmd.Parse(flag.Args()[1:])
-			doConfig(*dbPath, *timeout, *expiry, *rateLimit)
+			doConfig(*dbPath, *timeout, *expiry, *rateLimit, *purgeDelay, *dedupeWindow, *clockTolerance, *unsendWindow, *oidcIssuer, *oidcClientID, *disableOIDC, *maxUsers, *maxStorage, *maxMessage, *maxAttachment, *userWebhooks, *requireInvite, logging)
+			return
+		case "users":
+			usersCmd := flag.NewFlagSet("users", flag.ExitOnError)
+			deactivate := usersCmd.String("deactivate", "", "Deactivate a user by ID or display name")
+			reactivate := usersCmd.String("reactivate", "", "Reactivate a deactivated user")
+			listDeactivated := usersCmd.Bool("deactivated", false, "List deactivated users awaiting purge")
+			usersCmd.Parse(flag.Args()[1:])
+			doUsers(*dbPath, *deactivate, *reactivate, *listDeactivated)
+			return
+		case "motd":
+			motdCmd := flag.NewFlagSet("motd", flag.ExitOnError)
+			post := motdCmd.String("post", "", "Post a new announcement")
+			expires := motdCmd.Int("expires", 72, "Hours until the announcement expires")
+			list := motdCmd.Bool("list", false, "List active announcements")
+			remove := motdCmd.String("remove", "", "Remove an announcement by ID")
+			motdCmd.Parse(flag.Args()[1:])
+			doMotd(*dbPath, *post, *expires, *list, *remove)
+			return
+		case "provision":
+			provCmd := flag.NewFlagSet("provision", flag.ExitOnError)
+			csvPath := provCmd.String("csv", "", "CSV file with display_name and optional email columns")
+			var ldapSrc hub.LDAPSource
+			provCmd.StringVar(&ldapSrc.URL, "ldap-url", "", "LDAP server URL to sync from (e.g. ldaps://ldap.example.com)")
+			provCmd.StringVar(&ldapSrc.BindDN, "ldap-bind", "", "Bind DN (password read from "+ldapPasswordEnv+")")
+			provCmd.StringVar(&ldapSrc.BaseDN, "ldap-base", "", "Search base DN")
+			provCmd.StringVar(&ldapSrc.Filter, "ldap-filter", "(objectClass=person)", "Search filter")
+			provCmd.StringVar(&ldapSrc.NameAttr, "ldap-name-attr", "cn", "Attribute used as display name")
+			provCmd.StringVar(&ldapSrc.EmailAttr, "ldap-email-attr", "mail", "Attribute used as email")
+			ttl := provCmd.Int("invite-ttl", int(hub.DefaultInviteTTL.Hours()), "Hours until invite codes expire")
+			out := provCmd.String("out", "", "Write invite codes to this CSV file instead of stdout")
+			list := provCmd.Bool("list", false, "List unclaimed invites")
+			revoke := provCmd.String("revoke", "", "Revoke an unclaimed invite by user ID or display name")
+			provCmd.Parse(flag.Args()[1:])
+			doProvision(*dbPath, *csvPath, ldapSrc, *ttl, *out, *list, *revoke)
+			return
+		case "tenants":
+			tenantsCmd := flag.NewFlagSet("tenants", flag.ExitOnError)
+			add := tenantsCmd.String("add", "", "Add a tenant with this name")
+			hosts := tenantsCmd.String("host", "", "Comma-separated hostnames that select the tenant")
+			prefix := tenantsCmd.String("prefix", "", "Path prefix that selects the tenant (default /<name> when no host is given)")
+			list := tenantsCmd.Bool("list", false, "List tenants")
+			remove := tenantsCmd.String("remove", "", "Remove a tenant (its database is kept)")
+			tenantsCmd.Parse(flag.Args()[1:])
+			doTenants(rootDBPath, *add, *hosts, *prefix, *list, *remove)
+			return
+		case "metrics":
+			metricsCmd := flag.NewFlagSet("metrics", flag.ExitOnError)
+			days := metricsCmd.Int("days", 7, "Number of days of delivery history")
+			top := metricsCmd.Int("top", 20, "Number of recipients with the deepest backlog to list")
+			metricsCmd.Parse(flag.Args()[1:])
+			doMetrics(*dbPath, *days, *top)
+			return
+		case "logs":
+			logsCmd := flag.NewFlagSet("logs", flag.ExitOnError)
+			level := logsCmd.String("level", "", "Show only entries at this level or above (debug, info, warn, error)")
+			since := logsCmd.String("since", "", "Show only entries newer than this duration (e.g. 1h) or RFC 3339 time")
+			user := logsCmd.String("user", "", "Show only entries about this user ID")
+			limit := logsCmd.Int("limit", 200, "Show at most this many of the newest entries (0 for all)")
+			logsCmd.Parse(flag.Args()[1:])
+			doLogs(*dbPath, *level, *since, *user, *limit)
+			return
+		case "deadletters":
+			deadCmd := flag.NewFlagSet("deadletters", flag.ExitOnError)
+			retry := deadCmd.String("retry", "", "Queue a dead-lettered delivery for another round of attempts")
+			drop := deadCmd.String("drop", "", "Discard a dead-lettered delivery")
+			deadCmd.Parse(flag.Args()[1:])
+			doDeadLetters(*dbPath, *retry, *drop)
+			return
+		case "federation":
+			fedCmd := flag.NewFlagSet("federation", flag.ExitOnError)
+			name := fedCmd.String("name", "", "Federate under this host (and port) other hubs reach this one at ('off' to stop)")
+			insecure := fedCmd.String("insecure", "", "Reach other hubs over plain HTTP, for testing: on or off")
+			allowPrivate := fedCmd.String("allow-private", "", "Accept IP addresses, local names and private addresses as hubs: on or off")
+			allow := fedCmd.String("allow", "", "Accept first contact from this hub though no user here wrote to it")
+			disallow := fedCmd.String("disallow", "", "Remove a hub added with --allow")
+			forget := fedCmd.String("forget", "", "Forget the pinned key of this hub, as after it replaced its key")
+			fedCmd.Parse(flag.Args()[1:])
+			doFederation(*dbPath, *name, *insecure, *allowPrivate, *allow, *disallow, *forget)
+			return
+		case "admin-token":
+			doAdminToken(*dbPath)
+			return
+		case "admin":
+			doAdmin(*port, *dbPath, flag.Args()[1:])
+			return
+		case "events":
+			doEvents(*port, flag.Args()[1:])
+			return
+		case "stats":
+			doStats(*port, flag.Args()[1:])
+			return
+		case "report":
+			reportCmd := flag.NewFlagSet("report", flag.ExitOnError)
+			days := reportCmd.Int("days", 30, "Number of days to report on")
+			top := reportCmd.Int("top", 10, "Number of top talkers to list")
+			reportCmd.Parse(flag.Args()[1:])
+			doReport(*dbPath, *days, *top)
+			return
+		case "escrow":
+			escrowCmd := flag.NewFlagSet("escrow", flag.ExitOnError)
+			generate := escrowCmd.String("generate", "", "Generate a recovery key pair, writing the private key to this file, and publish it")
+			setKey := escrowCmd.String("set-key", "", "Publish this PEM public key as the recovery key")
+			disable := escrowCmd.Bool("disable", false, "Stop publishing a recovery key")
+			recoverID := escrowCmd.String("recover", "", "Decrypt this escrowed message with the recovery key")
+			keyPath := escrowCmd.String("key", "", "Recovery private key file for --recover")
+			escrowCmd.Parse(flag.Args()[1:])
+			doEscrow(*dbPath, *generate, *setKey, *disable, *recoverID, *keyPath)
+			return
+		case "bench":
+			doBench(flag.Args()[1:])
 			return
 		default:
 			fmt.Printf("Unknown command: %s\n", flag.Args()[0])
 			fmt.Println("Available commands:")
 			fmt.Println("  init                    Initialize hub database")
+			fmt.Println("  migrate                 Apply pending database schema migrations")
+			fmt.Println("    --status              List migrations and whether each is applied")
 			fmt.Println("  config                  Configure hub settings")
 			fmt.Println("    --timeout <seconds>   Set hub timeout")
 			fmt.Println("    --expiry <hours>      Set message expiry")
 			fmt.Println("    --rate-limit <count>  Set rate limit")
+			fmt.Println("    --purge-delay <hours> Set grace period before deactivated users are purged")
+			fmt.Println("    --dedupe-window <sec> Suppress identical sends within this window (0 disables)")
+			fmt.Println("    --clock-tolerance <s> Allowed client clock skew for message timestamps")
+			fmt.Println("    --unsend-window <sec> How long senders may delete fetched messages (default 600)")
+			fmt.Println("    --oidc-issuer <url>   Require SSO (with --oidc-client-id) to register")
+			fmt.Println("    --disable-oidc        Turn SSO-gated registration off")
+			fmt.Println("    --max-users <n>       Cap active users (0 for unlimited)")
+			fmt.Println("    --max-storage <MB>    Cap stored message and attachment volume (0 for unlimited)")
+			fmt.Println("    --max-message-size <KB> Largest message text; clients split longer ones")
+			fmt.Println("    --max-attachment-size <MB> Largest uploaded attachment (0 for unlimited)")
+			fmt.Println("    --user-webhooks on|off Let users register new-message webhooks (default off)")
+			fmt.Println("    --require-invite on|off Only register new accounts with an invite code (default off)")
+			fmt.Println("    --log-file <path>     Also log to this file ('off' to stop)")
+			fmt.Println("    --log-max-size <MB>   Rotate the log file at this size (default 100)")
+			fmt.Println("    --log-max-age <hours> Rotate the log file at this age (default off)")
+			fmt.Println("    --log-max-backups <n> Rotated log files to keep (default 10)")
+			fmt.Println("    --log-compress on|off Gzip rotated log files (default on)")
+			fmt.Println("    --log-format text|json Format of the hub log (default text)")
+			fmt.Println("  users                   Manage user accounts")
+			fmt.Println("    --deactivate <user>   Soft-delete a user (hidden, kept until purge)")
+			fmt.Println("    --reactivate <user>   Restore a deactivated user")
+			fmt.Println("    --deactivated         List deactivated users")
+			fmt.Println("  motd                    Manage service announcements")
+			fmt.Println("    --post <text>         Post a signed announcement")
+			fmt.Println("    --expires <hours>     Announcement lifetime (default 72)")
+			fmt.Println("    --list                List active announcements")
+			fmt.Println("    --remove <id>         Remove an announcement")
+			fmt.Println("  provision               Pre-create accounts with invite codes")
+			fmt.Println("    --csv <file>          Import users from CSV (display_name, email)")
+			fmt.Println("    --ldap-url <url>      Sync users from LDAP (with --ldap-base, --ldap-bind)")
+			fmt.Println("    --out <file>          Write invite codes to a CSV file")
+			fmt.Println("    --list                List unclaimed invites")
+			fmt.Println("    --revoke <user>       Revoke an unclaimed invite")
+			fmt.Println("  tenants                 Manage tenants of a multi-tenant hub")
+			fmt.Println("    --add <name>          Add a tenant (with --host and/or --prefix)")
+			fmt.Println("    --remove <name>       Remove a tenant")
+			fmt.Println("    --list                List tenants")
+			fmt.Println("  admin-token             Generate a new admin token (use --tenant for a tenant)")
+			fmt.Println("  admin <command>         Manage a running hub over its admin API")
+			fmt.Println("    list-users, delete-user, purge-messages, ban, unban, stats, audit, retention, quota, gc, issue-cert (see 'clsp-hub admin')")
+			fmt.Println("  stats                   Show a running hub's users, storage, pending deliveries and uptime (--json)")
+			fmt.Println("  metrics                 Delivery latency and per-user backlog (--days, --top)")
+			fmt.Println("  logs                    Show recent hub log entries (--level, --since, --user, --limit)")
+			fmt.Println("  events                  Show a running hub's operational events (--follow, --kind, --json)")
+			fmt.Println("  deadletters             Show failed outbound deliveries (--retry <id>, --drop <id>)")
+			fmt.Println("  federation              Exchange messages with users of other hubs (shows peers)")
+			fmt.Println("    --name <host>|off     Federate under the host other hubs reach this one at")
+			fmt.Println("    --insecure on|off     Reach other hubs over plain HTTP (testing only)")
+			fmt.Println("    --allow-private on|off Accept IP addresses and private networks as hubs")
+			fmt.Println("    --allow <hub>         Accept first contact from a hub no user here wrote to")
+			fmt.Println("    --disallow <hub>      Remove a hub added with --allow")
+			fmt.Println("    --forget <hub>        Forget a hub's pinned key after it replaced it")
+			fmt.Println("  report                  Capacity planning report")
+			fmt.Println("    --days <n>            Reporting period (default 30)")
+			fmt.Println("    --top <n>             Number of top talkers (default 10)")
+			fmt.Println("  escrow                  Organizational key escrow (opt-in for users)")
+			fmt.Println("    --generate <file>     Create a recovery key pair and publish its public key")
+			fmt.Println("    --set-key <pem>       Publish an existing recovery public key")
+			fmt.Println("    --disable             Stop publishing the recovery key")
+			fmt.Println("    --recover <id>        Decrypt an escrowed message (with --key <file>)")
+			fmt.Println("  bench                   Load-test a hub with simulated users")
+			fmt.Println("    --hub <url>           Hub to load (default: an embedded hub with a temporary database)")
+			fmt.Println("    --users <n>           Simulated users (default 10)")
+			fmt.Println("    --send-rate <n>       Messages per second per user (default 0.5)")
+			fmt.Println("    --fetch-interval <d>  Time between fetches per user (default 2s)")
+			fmt.Println("    --duration <d>        How long to run (default 30s)")
+			fmt.Println("    --size <bytes>        Message size (default 256)")
+			fmt.Println("    --json-envelopes      Send and fetch envelopes as JSON instead of protobuf")
+			fmt.Println("    --wire                Compare JSON and protobuf envelope sizes and encoding times")
 			return
 		}
 	}
 
+	tlsOpts := hub.TLSOptions{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ACMEEmail:    *acmeEmail,
+		ACMECacheDir: *acmeCache,
+		ACMEHTTPAddr: *acmeHTTP,
+		ClientCAFile: *clientCA,
+	}
+	for _, d := range strings.Split(*acmeDomain, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			tlsOpts.ACMEDomains = append(tlsOpts.ACMEDomains, d)
+		}
+	}
+	scheme := "HTTP"
+	if tlsOpts.Enabled() {
+		scheme = "HTTPS"
+	}
+	onionOpts := hub.OnionOptions{
+		ControlAddr:     *torControl,
+		ControlPassword: *torPassword,
+		KeyFile:         *onionKey,
+	}
+	if preset != nil {
+		if err := preset.CheckTLS(tlsOpts); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("Preset %s: %s\n", preset.Name, preset.Description)
+		if preset.TempDB {
+			fmt.Printf("Using temporary database %s\n", rootDBPath)
+		}
+	}
+
+	if *multiTenant {
+		if *grpcPort != 0 {
+			log.Fatalf("--grpc-port serves a single hub; it cannot be combined with --multi-tenant")
+		}
+		router, err := hub.NewTenantRouter(rootDBPath)
+		if err != nil {
+			log.Fatalf("Failed to start multi-tenant hub: %v", err)
+		}
+		router.SetPort(*port)
+		if err := router.SetTLS(tlsOpts); err != nil {
+			log.Fatalf("Invalid TLS options: %v", err)
+		}
+		for _, srv := range router.Tenants() {
+			configureServer(srv, preset, *logLevel)
+		}
+		if logFile := openLogFile(router.Config(), *logFormat); logFile != nil {
+			defer logFile.Close()
+		}
+
+		if *onion {
+			service := publishOnion(onionOpts, filepath.Dir(rootDBPath), *port, tlsOpts.Enabled())
+			defer service.Close()
+			for _, srv := range router.Tenants() {
+				srv.SetOnionAddress(service.Address)
+			}
+		}
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+		go func() {
+			fmt.Printf("CLSP multi-tenant hub starting on port %d (%s)...\n", *port, scheme)
+			if err := router.Start(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Server error: %v", err)
+			}
+		}()
+
+		<-sigChan
+		fmt.Println("\nShutting down hub server...")
+		router.Shutdown()
+		return
+	}
+
 	// Create server with database path
-	server, err := hub.NewServer(*dbPath)
+	server, err := openServer(*dbPath)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
 
-	// Set the port
+	// Set the ports
 	server.SetPort(*port)
+	server.SetGRPCPort(*grpcPort)
+	if err := server.SetTLS(tlsOpts); err != nil {
+		log.Fatalf("Invalid TLS options: %v", err)
+	}
+	configureServer(server, preset, *logLevel)
+	if logFile := openLogFile(server.Config(), *logFormat); logFile != nil {
+		defer logFile.Close()
+	}
+
+	if *onion {
+		dataDir := filepath.Dir(rootDBPath)
+		if *dbPath != "" {
+			dataDir = filepath.Dir(*dbPath)
+		}
+		service := publishOnion(onionOpts, dataDir, *port, tlsOpts.Enabled())
+		defer service.Close()
+		server.SetOnionAddress(service.Address)
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		fmt.Printf("CLSP Hub server starting on port %d...\n", *port)
+		fmt.Printf("CLSP Hub server starting on port %d (%s)...\n", *port, scheme)
+		if *grpcPort != 0 {
+			fmt.Printf("gRPC interface on port %d\n", *grpcPort)
+		}
 		if err := server.Start(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mattd/clsp/internal/hub"
+)
+
+// doStats prints the aggregate statistics of a running hub
+func doStats(port int, args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	hubURL, token := adminFlags(fs, port)
+	jsonOut := fs.Bool("json", false, "Print the statistics as JSON")
+	fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv(adminTokenEnv)
+	}
+	if *token == "" {
+		log.Fatalf("Admin token required: pass --token or set %s", adminTokenEnv)
+	}
+	client := &adminClient{hubURL: *hubURL, token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+
+	var stats hub.HubStats
+	if err := client.do(context.Background(), http.MethodGet, "/admin/stats", nil, &stats); err != nil {
+		log.Fatalf("Failed to get stats: %v", err)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return
+	}
+	printStats(*hubURL, stats)
+}
+
+// printStats shows a hub's statistics grouped by accounts, storage and deliveries
+func printStats(hubURL string, stats hub.HubStats) {
+	fmt.Printf("Hub: %s\n", hubURL)
+	fmt.Printf("Up:  %s (since %s)\n", formatUptime(time.Duration(stats.UptimeSeconds)*time.Second), stats.StartedAt.Local().Format("2006-01-02 15:04"))
+
+	fmt.Printf("\nUsers\n")
+	fmt.Printf("  Total:        %d\n", stats.TotalUsers)
+	if stats.MaxUsers > 0 {
+		fmt.Printf("  Active:       %d of %d\n", stats.ActiveUsers, stats.MaxUsers)
+	} else {
+		fmt.Printf("  Active:       %d\n", stats.ActiveUsers)
+	}
+	fmt.Printf("  Online:       %d\n", stats.OnlineUsers)
+	fmt.Printf("  Deactivated:  %d\n", stats.DeactivatedUsers)
+	fmt.Printf("  Banned:       %d\n", stats.BannedUsers)
+
+	fmt.Printf("\nStorage\n")
+	fmt.Printf("  Messages:     %d (%d unread)\n", stats.StoredMessages, stats.UnreadMessages)
+	fmt.Printf("  Attachments:  %d\n", stats.Attachments)
+	if stats.MaxStorageBytes > 0 {
+		fmt.Printf("  Used:         %s of %s\n", formatBytes(float64(stats.StoredBytes)), formatBytes(float64(stats.MaxStorageBytes)))
+	} else {
+		fmt.Printf("  Used:         %s\n", formatBytes(float64(stats.StoredBytes)))
+	}
+	if stats.DatabaseBytes >= 0 {
+		fmt.Printf("  Database:     %s\n", formatBytes(float64(stats.DatabaseBytes)))
+	} else {
+		fmt.Printf("  Database:     unknown\n")
+	}
+
+	fmt.Printf("\nPending deliveries\n")
+	fmt.Printf("  Messages:     %d not yet fetched\n", stats.UndeliveredMessages)
+	fmt.Printf("  Outbound:     %d queued, %d dead letters\n", stats.QueuedDeliveries, stats.DeadLetters)
+}
+
+// formatUptime renders d in days, hours and minutes
+func formatUptime(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
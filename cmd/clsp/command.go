@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// Exit statuses of clsp
+const (
+	exitFailure     = 1   // the command ran and failed
+	exitUsage       = 2   // the command line was invalid
+	exitInterrupted = 130 // interrupted by Ctrl-C or SIGTERM
+)
+
+// command is a node of the clsp command tree. A command runs, groups subcommands, or
+// both: a group with run of its own (like 'daemon') runs when no subcommand is named.
+type command struct {
+	name string
+	// args is the synopsis of the positional arguments, e.g. "<recipient> <message>"
+	args string
+	// summary is the one line shown in command lists
+	summary string
+	// help, if set, follows the summary in 'clsp help <command>'
+	help string
+	// failure names what failed in error messages, as in "Error sending message: ..."
+	failure string
+	flags   *flag.FlagSet
+	run     func(ctx context.Context, args []string) error
+
+	subcommands []*command
+	parent      *command
+
+	// standalone commands run before 'clsp install' (and need no identity)
+	standalone bool
+	// announce shows new hub announcements before the command runs
+	announce bool
+	// interspersed accepts options after positional arguments too; commands whose
+	// arguments are free text leave it off, so the text may contain dashes
+	interspersed bool
+	// hidden commands are started by clsp itself and left out of command lists
+	hidden bool
+}
+
+// newCommand returns a command with an empty set of options
+func newCommand(name, args, summary string) *command {
+	c := &command{name: name, args: args, summary: summary}
+	c.flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	c.flags.SetOutput(io.Discard)
+	c.flags.Usage = func() {}
+	return c
+}
+
+// add attaches subcommands to c and returns c
+func (c *command) add(subcommands ...*command) *command {
+	for _, sub := range subcommands {
+		sub.parent = c
+		sub.standalone = sub.standalone || c.standalone
+		c.subcommands = append(c.subcommands, sub)
+	}
+	return c
+}
+
+// path returns the full name of c, e.g. "clsp hub info"
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.name
+	}
+	return c.parent.path() + " " + c.name
+}
+
+// find returns the subcommand called name, or nil
+func (c *command) find(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// synopsis returns the usage line of c
+func (c *command) synopsis() string {
+	parts := []string{c.path()}
+	if hasFlags(c.flags) {
+		parts = append(parts, "[options]")
+	}
+	switch {
+	case c.args != "":
+		parts = append(parts, c.args)
+	case len(c.subcommands) > 0 && c.run != nil:
+		parts = append(parts, "[<command>]")
+	case len(c.subcommands) > 0:
+		parts = append(parts, "<command>")
+	}
+	return strings.Join(parts, " ")
+}
+
+// usageError is an invalid command line. The command it belongs to is filled in as
+// the error passes up, so its usage can be shown.
+type usageError struct {
+	cmd *command
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+// usagef returns a usageError for the running command
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// runError is the failure of a command that ran
+type runError struct {
+	cmd *command
+	err error
+}
+
+func (e *runError) Error() string { return e.err.Error() }
+
+// execute parses args for c, or hands them to the subcommand they name, and runs it
+func (c *command) execute(ctx context.Context, args []string) error {
+	if len(c.subcommands) > 0 && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if sub := c.find(args[0]); sub != nil {
+			return sub.execute(ctx, args[1:])
+		}
+		if c.run == nil {
+			return &usageError{cmd: c, msg: fmt.Sprintf("unknown command '%s %s'", c.path(), args[0])}
+		}
+	}
+
+	positional, err := c.parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		c.printHelp(os.Stdout)
+		return nil
+	}
+	if err != nil {
+		return &usageError{cmd: c, msg: err.Error()}
+	}
+	if c.run == nil {
+		return &usageError{cmd: c, msg: fmt.Sprintf("'%s' needs a command", c.path())}
+	}
+
+	if !c.standalone && !cli.IsInstalled() {
+		return errors.New("CLSP is not installed. Please run 'clsp install' first to set up your configuration.\nThis will create the necessary configuration files in your home directory.")
+	}
+	if c.announce && !cli.JSONOutput {
+		cli.NotifyAnnouncements(ctx)
+	}
+
+	err = c.run(ctx, positional)
+	var usage *usageError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &usage):
+		if usage.cmd == nil {
+			usage.cmd = c
+		}
+		return err
+	default:
+		return &runError{cmd: c, err: err}
+	}
+}
+
+// parse parses the options in args and returns the positional arguments
+func (c *command) parse(args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := c.flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := c.flags.Args()
+		consumed := len(args) - len(rest)
+		if !c.interspersed || len(rest) == 0 || (consumed > 0 && args[consumed-1] == "--") {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// printHelp writes the help of c: its usage, description, options and subcommands
+func (c *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s\n\n", c.synopsis())
+	fmt.Fprintln(w, c.summary)
+	if c.help != "" {
+		fmt.Fprintf(w, "\n%s\n", strings.TrimSpace(c.help))
+	}
+	if hasFlags(c.flags) {
+		fmt.Fprintln(w, "\nOptions:")
+		printFlags(w, c.flags)
+	}
+	if len(c.subcommands) > 0 {
+		fmt.Fprintln(w, "\nCommands:")
+		printCommands(w, c.subcommands)
+	}
+	fmt.Fprintln(w, "\nGlobal options (anywhere on the command line):")
+	printFlags(w, globalFlags(&globalOptions{}))
+}
+
+// printCommands lists commands and their subcommands with their summaries
+func printCommands(w io.Writer, commands []*command) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var list func(commands []*command)
+	list = func(commands []*command) {
+		for _, c := range commands {
+			if c.hidden {
+				continue
+			}
+			if c.run != nil || len(c.subcommands) == 0 {
+				name := strings.TrimPrefix(c.path(), "clsp ")
+				if c.args != "" {
+					name += " " + c.args
+				}
+				fmt.Fprintf(tw, "  %s\t%s\n", name, c.summary)
+			}
+			list(c.subcommands)
+		}
+	}
+	list(commands)
+	tw.Flush()
+}
+
+// printFlags lists the options of fs with their value type, description and default
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fs.VisitAll(func(f *flag.Flag) {
+		valueName, usage := flag.UnquoteUsage(f)
+		name := "--" + f.Name
+		if valueName != "" {
+			name += " <" + valueName + ">"
+		}
+		if !isZeroDefault(f) {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", name, usage)
+	})
+	tw.Flush()
+}
+
+// isZeroDefault reports whether a flag's default is its type's zero value, which
+// goes without saying
+func isZeroDefault(f *flag.Flag) bool {
+	typ := reflect.TypeOf(f.Value)
+	var zero reflect.Value
+	if typ.Kind() == reflect.Pointer {
+		zero = reflect.New(typ.Elem())
+	} else {
+		zero = reflect.Zero(typ)
+	}
+	return f.DefValue == zero.Interface().(flag.Value).String() || f.DefValue == ""
+}
+
+// hasFlags reports whether fs defines any option
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// configCommand returns 'clsp config'
+func configCommand() *command {
+	cmd := newCommand("config", "", "Manage configuration")
+	cmd.help = "Without options nothing changes; --show prints the current configuration."
+	show := cmd.flags.Bool("show", false, "Show current configuration")
+	setHub := cmd.flags.String("set-hub", "", "Set hub `URL`")
+	setTLS := cmd.flags.Bool("set-tls", false, "Enable TLS")
+	setCert := cmd.flags.String("set-cert", "", "Trust the CA certificates in this PEM bundle `path` for the hub instead of the system's ('off' to stop)")
+	pinHubCert := cmd.flags.Bool("pin-hub-cert", false, "Fetch the hub's current TLS certificate and accept only its key from now on")
+	unpinHubCert := cmd.flags.Bool("unpin-hub-cert", false, "Forget the pinned hub certificate")
+	setClientCert := cmd.flags.String("set-client-cert", "", "Present this PEM client certificate `path` to hubs that require one, with --set-client-key ('off' to stop)")
+	setClientKey := cmd.flags.String("set-client-key", "", "Private key `path` for --set-client-cert")
+	setExpiry := cmd.flags.String("set-expiry", "", "Set message expiry `duration` (e.g., '24h', '7d')")
+	setANSI := cmd.flags.String("set-ansi", "", "How to show escape sequences in messages: 'strip' (default) or 'render' (colours only)")
+	setEmoji := cmd.flags.String("set-emoji", "", "How to show emoji in messages: 'show' (default) or 'strip'")
+	setPrivacy := cmd.flags.String("set-privacy", "", "What inbox summaries reveal: 'full' (default), 'counts' or 'none'")
+	setAutoLock := cmd.flags.String("set-autolock", "", "Lock the key after this idle period (e.g., '15m', or 'off')")
+	addAlias := cmd.flags.String("add-alias", "", "Add user alias (format: alias=userid)")
+	removeAlias := cmd.flags.String("remove-alias", "", "Remove user `alias`")
+	encrypt := cmd.flags.String("encrypt", "", "Encrypt the config and message archive at rest: 'on' or 'off'")
+	keySource := cmd.flags.String("key-source", cli.KeySourceIdentity, "Key for --encrypt on: 'identity' (passphrase) or 'keyring' (OS keyring)")
+	escrow := cmd.flags.String("escrow", "", "Escrow message keys to the hub's organizational recovery key: 'on' or 'off'")
+	readReceipts := cmd.flags.String("read-receipts", "", "Tell senders when you read their messages: 'on' (default) or 'off'")
+	setProxy := cmd.flags.String("set-proxy", "", "Proxy for hub requests: a `URL` (http, https, socks5 or socks5h), 'tor', 'off' or 'env' (default)")
+	cipherSuites := cmd.flags.String("cipher-suites", "", "Comma-separated cipher suites offered to senders, most preferred first, or 'default' for all supported")
+	compression := cmd.flags.String("compression", "", "Compress messages before encryption for recipients who support it: 'zstd', 'deflate' or 'off' (default)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected argument %q", args[0])
+		}
+
+		switch *encrypt {
+		case "":
+		case "on", "off":
+			return cli.SetLocalEncryption(ctx, *encrypt == "on", *keySource)
+		default:
+			return usagef("invalid --encrypt value. Use: on or off")
+		}
+
+		switch *escrow {
+		case "":
+		case "on", "off":
+			return cli.SetEscrow(ctx, *escrow == "on")
+		default:
+			return usagef("invalid --escrow value. Use: on or off")
+		}
+
+		config, err := cli.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("loading config: %v", err)
+		}
+
+		if *show && cli.JSONOutput {
+			return cli.ShowConfigJSON(config)
+		}
+		if *show {
+			printConfig(config)
+			return nil
+		}
+
+		modified := false
+
+		if *setHub != "" {
+			if err := config.UpdateHubURL(*setHub); err != nil {
+				return fmt.Errorf("updating hub URL: %v", err)
+			}
+			modified = true
+		}
+
+		if *setTLS {
+			config.UseTLS = true
+			modified = true
+		}
+
+		switch *setCert {
+		case "":
+		case "off":
+			config.TLSCertPath = ""
+			modified = true
+		default:
+			if err := cli.CheckCABundle(*setCert); err != nil {
+				return usagef("invalid --set-cert value: %v", err)
+			}
+			path, err := filepath.Abs(*setCert)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %v", *setCert, err)
+			}
+			config.TLSCertPath = path
+			modified = true
+		}
+
+		switch {
+		case *setClientCert == "" && *setClientKey == "":
+		case *setClientCert == "off":
+			config.TLSClientCert, config.TLSClientKey = "", ""
+			modified = true
+		case *setClientCert == "" || *setClientKey == "":
+			return usagef("--set-client-cert and --set-client-key must be given together")
+		default:
+			if _, err := cli.LoadClientCertificate(*setClientCert, *setClientKey); err != nil {
+				return usagef("invalid client certificate: %v", err)
+			}
+			certPath, err := filepath.Abs(*setClientCert)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %v", *setClientCert, err)
+			}
+			keyPath, err := filepath.Abs(*setClientKey)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %v", *setClientKey, err)
+			}
+			config.TLSClientCert, config.TLSClientKey = certPath, keyPath
+			modified = true
+		}
+
+		if *pinHubCert && *unpinHubCert {
+			return usagef("use either --pin-hub-cert or --unpin-hub-cert")
+		}
+		if *pinHubCert {
+			cert, err := cli.FetchHubCertificate(ctx, config.HubURL)
+			if err != nil {
+				return fmt.Errorf("fetching the hub certificate: %v", err)
+			}
+			config.HubCertPin = cli.CertificatePin(cert)
+			fmt.Printf("Hub certificate: %s\n", cert.Subject)
+			fmt.Printf("Issued by: %s\n", cert.Issuer)
+			fmt.Printf("Valid until: %s\n", cert.NotAfter.Format(time.RFC3339))
+			fmt.Printf("Pinned key: %s\n", config.HubCertPin)
+			fmt.Println("Compare the pin with the hub operator's before relying on it.")
+			modified = true
+		}
+		if *unpinHubCert {
+			config.HubCertPin = ""
+			modified = true
+		}
+
+		if *setExpiry != "" {
+			duration, err := time.ParseDuration(*setExpiry)
+			if err != nil {
+				return usagef("invalid duration format: %v", err)
+			}
+			config.MessageExpiry = duration
+			modified = true
+		}
+
+		switch *setANSI {
+		case "":
+		case "strip":
+			config.RenderANSI = false
+			modified = true
+		case "render":
+			config.RenderANSI = true
+			modified = true
+		default:
+			return usagef("invalid --set-ansi value. Use: strip or render")
+		}
+
+		switch *setEmoji {
+		case "":
+		case "show":
+			config.StripEmoji = false
+			modified = true
+		case "strip":
+			config.StripEmoji = true
+			modified = true
+		default:
+			return usagef("invalid --set-emoji value. Use: show or strip")
+		}
+
+		if *setPrivacy != "" {
+			if !cli.ValidPrivacyLevel(*setPrivacy) {
+				return usagef("invalid --set-privacy value. Use: full, counts or none")
+			}
+			config.PrivacyLevel = *setPrivacy
+			modified = true
+		}
+
+		switch *readReceipts {
+		case "":
+		case "on", "off":
+			config.NoReadReceipts = *readReceipts == "off"
+			modified = true
+		default:
+			return usagef("invalid --read-receipts value. Use: on or off")
+		}
+
+		if *setProxy != "" {
+			if _, err := cli.ParseProxy(*setProxy); err != nil {
+				return usagef("invalid --set-proxy value: %v", err)
+			}
+			config.Proxy = *setProxy
+			if strings.EqualFold(*setProxy, cli.ProxyEnvironment) {
+				config.Proxy = ""
+			}
+			modified = true
+		}
+
+		if *cipherSuites != "" {
+			suites, err := cli.ParseCipherSuites(*cipherSuites)
+			if err != nil {
+				return usagef("invalid --cipher-suites value: %v", err)
+			}
+			config.CipherSuites = suites
+			modified = true
+		}
+
+		if *compression != "" {
+			algorithm, err := cli.ParseCompression(*compression)
+			if err != nil {
+				return usagef("invalid --compression value: %v", err)
+			}
+			config.Compression = algorithm
+			modified = true
+		}
+
+		if *setAutoLock != "" {
+			if *setAutoLock == "off" {
+				config.AutoLockAfter = -1
+			} else {
+				duration, err := time.ParseDuration(*setAutoLock)
+				if err != nil || duration <= 0 {
+					return usagef("invalid auto-lock duration: %s", *setAutoLock)
+				}
+				config.AutoLockAfter = duration
+			}
+			modified = true
+		}
+
+		if *addAlias != "" {
+			parts := strings.Split(*addAlias, "=")
+			if len(parts) != 2 {
+				return usagef("invalid alias format. Use: alias=userid")
+			}
+			config.AddUserAlias(parts[0], parts[1])
+			modified = true
+		}
+
+		if *removeAlias != "" {
+			delete(config.UserAliases, *removeAlias)
+			modified = true
+		}
+
+		if !modified {
+			fmt.Println("No changes made to configuration")
+			return nil
+		}
+		if err := cli.SaveConfig(config); err != nil {
+			return fmt.Errorf("saving config: %v", err)
+		}
+		fmt.Println("Configuration updated successfully")
+		return nil
+	}
+	return cmd
+}
+
+// printConfig prints config for 'clsp config --show'
+func printConfig(config *cli.Config) {
+	fmt.Printf("Hub URL: %s\n", config.HubURL)
+	fmt.Printf("Use TLS: %v\n", config.UseTLS)
+	if config.TLSCertPath != "" {
+		fmt.Printf("Hub CA bundle: %s\n", config.TLSCertPath)
+	}
+	if config.HubCertPin != "" {
+		fmt.Printf("Pinned hub certificate: %s\n", config.HubCertPin)
+	}
+	if config.TLSClientCert != "" {
+		fmt.Printf("Client certificate: %s (key %s)\n", config.TLSClientCert, config.TLSClientKey)
+	}
+	fmt.Printf("Message Expiry: %v\n", config.MessageExpiry)
+	fmt.Printf("Render ANSI colours: %v\n", config.RenderANSI)
+	fmt.Printf("Strip emoji: %v\n", config.StripEmoji)
+	if config.PrivacyLevel == "" {
+		fmt.Printf("Privacy level: %s (default)\n", cli.PrivacyFull)
+	} else {
+		fmt.Printf("Privacy level: %s\n", config.PrivacyLevel)
+	}
+	switch {
+	case config.AutoLockAfter < 0:
+		fmt.Printf("Auto-lock: off\n")
+	case config.AutoLockAfter == 0:
+		fmt.Printf("Auto-lock: %v (default)\n", cli.DefaultAutoLockAfter)
+	default:
+		fmt.Printf("Auto-lock: %v\n", config.AutoLockAfter)
+	}
+	if source, err := cli.LocalEncryption(); err == nil && source != "" {
+		fmt.Printf("Encryption at rest: on (key source: %s)\n", source)
+	} else {
+		fmt.Printf("Encryption at rest: off\n")
+	}
+	if config.EscrowFingerprint != "" {
+		fmt.Printf("Key escrow: on (recovery key %s)\n", config.EscrowFingerprint)
+	} else {
+		fmt.Printf("Key escrow: off\n")
+	}
+	if config.NoReadReceipts {
+		fmt.Printf("Read receipts: off\n")
+	} else {
+		fmt.Printf("Read receipts: on\n")
+	}
+	if len(config.CipherSuites) == 0 {
+		fmt.Printf("Cipher suites: %s (default)\n", strings.Join(cli.OfferedCipherSuites(config), ", "))
+	} else {
+		fmt.Printf("Cipher suites: %s\n", strings.Join(config.CipherSuites, ", "))
+	}
+	if config.Compression == "" {
+		fmt.Printf("Compression: off\n")
+	} else {
+		fmt.Printf("Compression: %s\n", config.Compression)
+	}
+	fmt.Printf("Proxy: %s\n", cli.DescribeProxy(config))
+	fmt.Printf("User Aliases:\n")
+	for alias, id := range config.UserAliases {
+		fmt.Printf("  %s -> %s\n", alias, id)
+	}
+}
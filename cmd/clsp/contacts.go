@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// usersCommand returns 'clsp users'
+func usersCommand() *command {
+	cmd := newCommand("users", "", "List users")
+	cmd.failure = "listing users"
+	cmd.announce = true
+	cmd.help = `--verify-all audits every contact's key against the keys pinned locally; accept
+keys that changed on purpose with --repin.`
+	onlineOnly := cmd.flags.Bool("online", false, "Show only online users")
+	search := cmd.flags.String("search", "", "Search users by name")
+	verifyAll := cmd.flags.Bool("verify-all", false, "Audit every contact's key against the locally pinned keys")
+	repin := cmd.flags.String("repin", "", "With --verify-all, accept the new keys of these `users` (comma-separated)")
+	fingerprints := cmd.flags.Bool("fingerprint", false, "Show each user's key fingerprint and whether you verified it")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if !*verifyAll {
+			return cli.ListUsers(ctx, *onlineOnly, *search, *fingerprints)
+		}
+		var repinUsers []string
+		for _, u := range strings.Split(*repin, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				repinUsers = append(repinUsers, u)
+			}
+		}
+		return cli.VerifyAllKeys(ctx, repinUsers)
+	}
+	return cmd
+}
+
+// verifyCommand returns 'clsp verify'
+func verifyCommand() *command {
+	cmd := newCommand("verify", "<user>", "Compare a contact's fingerprint out-of-band and mark it verified")
+	cmd.failure = "verifying key"
+	cmd.interspersed = true
+	expected := cmd.flags.String("fingerprint", "", "Fingerprint the contact gave you (short or full), instead of comparing by eye")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one user required")
+		}
+		return cli.VerifyContact(ctx, args[0], *expected)
+	}
+	return cmd
+}
+
+// directoryCommand returns 'clsp directory'
+func directoryCommand() *command {
+	cmd := newCommand("directory", "", "Show (or download) the signed directory snapshot kept for offline use")
+	cmd.failure = "showing directory"
+	sync := cmd.flags.Bool("sync", false, "Download the hub's current directory snapshot first")
+	search := cmd.flags.String("search", "", "Show only users whose display name contains this text")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.ShowDirectory(ctx, *sync, *search)
+	}
+	return cmd
+}
+
+// screenedCommand returns 'clsp screened' and its subcommands
+func screenedCommand() *command {
+	cmd := newCommand("screened", "", "Review messages kept out of the inbox by screening rules")
+
+	list := newCommand("list", "", "List the screened messages")
+	list.run = func(ctx context.Context, args []string) error {
+		return cli.ScreenedMessages(ctx)
+	}
+
+	allow := newCommand("allow", "<user>", "Move a sender's screened messages to the inbox and stop screening them")
+	allow.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one user required")
+		}
+		return cli.AllowSender(ctx, args[0])
+	}
+
+	rules := newCommand("rules", "", "Show or change the screening rules")
+	var change cli.ScreenRuleChange
+	rules.flags.StringVar(&change.Sender, "sender", "", "Screen messages from this `user`")
+	rules.flags.StringVar(&change.Keyword, "keyword", "", "Screen messages containing this `text`, ignoring case")
+	rules.flags.StringVar(&change.LargerThan, "larger-than", "", "Screen messages larger than this `size`, e.g. 512K or 2M")
+	rules.flags.StringVar(&change.FirstTime, "first-time", "", "Screen senders you never exchanged messages with: 'on' or 'off'")
+	rules.flags.IntVar(&change.Remove, "remove", 0, "Remove the rule with this `number`, as listed")
+	rules.run = func(ctx context.Context, args []string) error {
+		return cli.ScreenRules(ctx, change)
+	}
+
+	return cmd.add(list, allow, rules)
+}
+
+// requestsCommand returns 'clsp requests' and its subcommands
+func requestsCommand() *command {
+	cmd := newCommand("requests", "", "Review messages from first-time senders held by the hub")
+	cmd.failure = "managing message requests"
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unknown command 'clsp requests %s'", args[0])
+		}
+		return cli.MessageRequests(ctx, "", "")
+	}
+
+	for _, sub := range []struct{ action, summary string }{
+		{"accept", "Accept a sender: deliver their held messages and any later ones"},
+		{"decline", "Decline a sender and delete their held messages"},
+	} {
+		action := sub.action
+		c := newCommand(action, "<user>", sub.summary)
+		c.failure = cmd.failure
+		c.run = func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return usagef("exactly one user required")
+			}
+			return cli.MessageRequests(ctx, action, args[0])
+		}
+		cmd.add(c)
+	}
+	for _, sub := range []struct{ action, summary string }{
+		{"on", "Hold messages from first-time senders as requests"},
+		{"off", "Deliver messages from first-time senders directly"},
+	} {
+		action := sub.action
+		c := newCommand(action, "", sub.summary)
+		c.failure = cmd.failure
+		c.run = func(ctx context.Context, args []string) error {
+			return cli.MessageRequests(ctx, action, "")
+		}
+		cmd.add(c)
+	}
+	return cmd
+}
+
+// receiptsCommand returns 'clsp receipts'
+func receiptsCommand() *command {
+	cmd := newCommand("receipts", "[everyone|contacts|none]", "Show or set who sees when you fetch and read messages")
+	cmd.failure = "updating receipts"
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 1 {
+			return usagef("at most one policy allowed")
+		}
+		policy := ""
+		if len(args) > 0 {
+			policy = args[0]
+		}
+		return cli.Receipts(ctx, policy)
+	}
+	return cmd
+}
+
+// notificationsCommand returns 'clsp notifications'
+func notificationsCommand() *command {
+	cmd := newCommand("notifications", "", "Show or set your webhook (--webhook) and quiet hours (--quiet)")
+	cmd.failure = "updating notifications"
+	webhook := cmd.flags.String("webhook", "", "`URL` the hub POSTs to when a message arrives for you ('off' to remove)")
+	quiet := cmd.flags.String("quiet", "", "Daily quiet `hours` without notifications, e.g. 22:00-07:00 ('off' to remove)")
+	timezone := cmd.flags.String("tz", "", "Time zone of the quiet hours (default: this machine's)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Notifications(ctx, *webhook, *quiet, *timezone)
+	}
+	return cmd
+}
+
+// motdCommand returns 'clsp motd'
+func motdCommand() *command {
+	cmd := newCommand("motd", "", "Show hub announcements")
+	cmd.failure = "fetching announcements"
+	all := cmd.flags.Bool("all", false, "Show all active announcements, including acknowledged ones")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.ShowAnnouncements(ctx, *all)
+	}
+	return cmd
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// hubCommand returns 'clsp hub' and its subcommands
+func hubCommand() *command {
+	cmd := newCommand("hub", "", "Inspect the hub")
+
+	info := newCommand("info", "", "Show the hub's status, configuration and API version")
+	infoHub := info.flags.String("hub", "", "Hub `URL` to query instead of the configured hub")
+	info.run = func(ctx context.Context, args []string) error {
+		return cli.ShowHubInfo(ctx, *infoHub)
+	}
+
+	latency := newCommand("latency", "", "Measure round-trip time and clock offset to the hub")
+	latencyHub := latency.flags.String("hub", "", "Hub `URL` to query instead of the configured hub")
+	count := latency.flags.Int("count", 5, "Number of round trips to measure")
+	latency.run = func(ctx context.Context, args []string) error {
+		return cli.MeasureHubLatency(ctx, *latencyHub, *count)
+	}
+
+	limits := newCommand("limits", "", "Show the hub's message, rate and storage limits")
+	limitsHub := limits.flags.String("hub", "", "Hub `URL` to query instead of the configured hub")
+	limits.run = func(ctx context.Context, args []string) error {
+		return cli.ShowHubLimits(ctx, *limitsHub)
+	}
+
+	for _, sub := range []*command{info, latency, limits} {
+		sub.failure = "querying hub"
+		cmd.add(sub)
+	}
+	return cmd
+}
+
+// archiveCommand returns 'clsp archive' and its subcommands
+func archiveCommand() *command {
+	cmd := newCommand("archive", "", "Manage the local message history")
+	verify := newCommand("verify", "", "Check local message history for changes made outside clsp")
+	reseal := verify.flags.Bool("reseal", false, "Accept the archive's current content and rebuild its integrity chain")
+	verify.run = func(ctx context.Context, args []string) error {
+		return cli.VerifyArchive(ctx, *reseal)
+	}
+	return cmd.add(verify)
+}
+
+// protocolCommand returns 'clsp protocol' and its subcommands, which need no identity
+func protocolCommand() *command {
+	cmd := newCommand("protocol", "", "Check the wire protocol implementation")
+	cmd.standalone = true
+
+	selftest := newCommand("selftest", "", "Check this build against the published protocol test vectors")
+	selftest.run = func(ctx context.Context, args []string) error {
+		return cli.ProtocolSelfTest()
+	}
+	vectors := newCommand("vectors", "", "Print the test vectors, to check another implementation against")
+	vectors.run = func(ctx context.Context, args []string) error {
+		return cli.ProtocolVectors()
+	}
+	return cmd.add(selftest, vectors)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// installCommand returns 'clsp install'
+func installCommand() *command {
+	cmd := newCommand("install", "", "Install and create initial configuration")
+	cmd.standalone = true
+	cmd.run = func(ctx context.Context, args []string) error {
+		if cli.IsInstalled() {
+			return errors.New("CLSP is already installed. Use 'clsp config' to modify your configuration.")
+		}
+		if err := cli.Install(); err != nil {
+			return fmt.Errorf("installation failed: %v", err)
+		}
+		fmt.Println("Installation completed successfully!")
+		fmt.Println("\nNext steps:")
+		fmt.Println("1. Configure your hub connection (if needed):")
+		fmt.Println("   clsp config --set-hub https://your-hub:8080")
+		fmt.Println("2. Initialize your identity:")
+		fmt.Println("   clsp init \"Your Name\"")
+		return nil
+	}
+	return cmd
+}
+
+// initCommand returns 'clsp init'
+func initCommand() *command {
+	cmd := newCommand("init", "", "Initialize user identity (the display name is prompted for)")
+	cmd.failure = "initializing user"
+	resume := cmd.flags.Bool("resume", false, "Retry hub registration for a saved but unregistered identity")
+	invite := cmd.flags.String("invite", "", "Invite `code` from the hub operator (claims the account provisioned for it, if any)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if *resume {
+			return cli.ResumeInit(ctx)
+		}
+		if len(args) > 0 {
+			fmt.Println("Note: Display name will be prompted interactively")
+			fmt.Println("Any additional arguments will be ignored")
+		}
+		return cli.InitUser(ctx, *invite)
+	}
+	return cmd
+}
+
+// whoamiCommand returns 'clsp whoami'
+func whoamiCommand() *command {
+	cmd := newCommand("whoami", "", "Show your identity, profile and registration status")
+	cmd.failure = "showing identity"
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Whoami(ctx)
+	}
+	return cmd
+}
+
+// keyCommand returns 'clsp key' and its subcommands
+func keyCommand() *command {
+	cmd := newCommand("key", "", "Manage your encryption key")
+	rotate := newCommand("rotate", "", "Replace your encryption key; contacts follow the signed rotation")
+	rotate.failure = "rotating key"
+	rotate.run = func(ctx context.Context, args []string) error {
+		return cli.RotateKey(ctx)
+	}
+	return cmd.add(rotate)
+}
+
+// backupCommand returns 'clsp backup'
+func backupCommand() *command {
+	cmd := newCommand("backup", "<file>", "Save your keys, configuration and aliases, encrypted with a passphrase")
+	cmd.failure = "backing up identity"
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one backup file required")
+		}
+		return cli.Backup(args[0])
+	}
+	return cmd
+}
+
+// restoreCommand returns 'clsp restore'
+func restoreCommand() *command {
+	cmd := newCommand("restore", "<file> | --mnemonic", "Set up your identity from a backup and announce it to the hub")
+	cmd.failure = "restoring identity"
+	cmd.standalone = true
+	cmd.interspersed = true
+	cmd.help = "With --mnemonic, the identity is recovered from its recovery phrase instead,\n" +
+		"using the recovery kit kept on the hub."
+	mnemonic := cmd.flags.Bool("mnemonic", false, "Recover the identity from its recovery phrase instead of a backup file")
+	hubURL := cmd.flags.String("hub", "", "`URL` of the hub holding the recovery kit (with --mnemonic)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		switch {
+		case *mnemonic && len(args) == 0:
+			return cli.RestoreMnemonic(ctx, *hubURL)
+		case !*mnemonic && len(args) == 1:
+			return cli.Restore(ctx, args[0])
+		}
+		return usagef("either a backup file or --mnemonic required")
+	}
+	return cmd
+}
+
+// recoveryCommand returns 'clsp recovery' and its subcommands
+func recoveryCommand() *command {
+	cmd := newCommand("recovery", "", "Manage the recovery phrase and the kit it unlocks on the hub")
+	cmd.failure = "managing recovery phrase"
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unknown command 'clsp recovery %s'", args[0])
+		}
+		return cli.Recovery(ctx, "")
+	}
+	for _, sub := range []struct{ action, summary string }{
+		{"setup", "Create a new recovery phrase, replacing any previous one"},
+		{"update", "Store the identity's current files in the recovery kit"},
+		{"disable", "Remove the recovery kit from the hub"},
+	} {
+		action := sub.action
+		c := newCommand(action, "", sub.summary)
+		c.failure = cmd.failure
+		c.run = func(ctx context.Context, args []string) error {
+			return cli.Recovery(ctx, action)
+		}
+		cmd.add(c)
+	}
+	return cmd
+}
+
+// accountCommand returns 'clsp account' and its subcommands
+func accountCommand() *command {
+	cmd := newCommand("account", "", "Export or delete what the hub holds about the identity")
+	export := newCommand("export", "", "Export everything the hub holds about the identity as JSON")
+	export.failure = "exporting account"
+	out := export.flags.String("out", "", "Write the export to this `file` instead of standard output")
+	export.run = func(ctx context.Context, args []string) error {
+		if *out != "" {
+			return cli.ExportAccountFile(ctx, *out)
+		}
+		return cli.ExportAccount(ctx, os.Stdout)
+	}
+
+	del := newCommand("delete", "", "Delete the account and everything the hub stores for it")
+	del.failure = "deleting account"
+	yes := del.flags.Bool("yes", false, "Delete without asking for confirmation")
+	del.run = func(ctx context.Context, args []string) error {
+		return cli.DeleteAccount(ctx, *yes)
+	}
+	return cmd.add(export, del)
+}
+
+// passphraseCommand returns 'clsp passphrase'
+func passphraseCommand() *command {
+	cmd := newCommand("passphrase", "", "Set, change or remove the key passphrase")
+	cmd.failure = "updating passphrase"
+	remove := cmd.flags.Bool("remove", false, "Remove passphrase protection from the private key")
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.SetPassphrase(*remove)
+	}
+	return cmd
+}
+
+// lockCommand returns 'clsp lock'
+func lockCommand() *command {
+	cmd := newCommand("lock", "", "Forget the unlocked key until the passphrase is entered again")
+	cmd.failure = "locking identity"
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Lock()
+	}
+	return cmd
+}
+
+// agentCommand returns 'clsp agent', the key agent 'clsp unlock' starts
+func agentCommand() *command {
+	cmd := newCommand("agent", "", "Hold the unlocked key in memory until locked or idle")
+	cmd.failure = "running key agent"
+	cmd.hidden = true
+	idle := cmd.flags.Duration("idle", cli.DefaultAutoLockAfter, "Exit after the key has not been used for this long (zero or negative: never)")
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.RunKeyAgent(ctx, *idle)
+	}
+	return cmd
+}
+
+// unlockCommand returns 'clsp unlock'
+func unlockCommand() *command {
+	cmd := newCommand("unlock", "", "Unlock your key for this session")
+	cmd.failure = "unlocking identity"
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Unlock()
+	}
+	return cmd
+}
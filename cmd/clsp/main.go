@@ -1,236 +1,249 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mattd/clsp/internal/cli"
+	"github.com/mattd/clsp/internal/paths"
 )
 
-func printUsage() {
-	fmt.Println("CLSP - Command Line Secure Protocol")
-	fmt.Println("\nFirst time setup:")
-	fmt.Println("  clsp install                    Install and create initial configuration")
-	fmt.Println("\nUsage:")
-	fmt.Println("  clsp init <display-name>        Initialize user identity")
-	fmt.Println("  clsp send <recipient> <message> Send a message")
-	fmt.Println("  clsp list                       List messages")
-	fmt.Println("  clsp status <message-id>        Check message status")
-	fmt.Println("  clsp users                      List users")
-	fmt.Println("  clsp config                     Manage configuration")
-	fmt.Println("\nConfiguration options:")
-	fmt.Println("  clsp config --show              Show current configuration")
-	fmt.Println("  clsp config --set-hub <url>     Set hub URL")
-	fmt.Println("  clsp config --set-tls           Enable TLS")
-	fmt.Println("  clsp config --set-cert <path>   Set TLS certificate path")
-	fmt.Println("  clsp config --set-expiry <dur>  Set message expiry duration")
-	fmt.Println("  clsp config --add-alias <a=id>  Add user alias")
-	fmt.Println("  clsp config --remove-alias <a>  Remove user alias")
-	fmt.Println("\nUse 'clsp <command> --help' for more information about a command")
-}
-
-func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
-	}
-
-	command := os.Args[1]
-	args := os.Args[2:]
-
-	// Check if installed for all commands except install
-	if command != "install" && !cli.IsInstalled() {
-		fmt.Println("CLSP is not installed. Please run 'clsp install' first to set up your configuration.")
-		fmt.Println("This will create the necessary configuration files in your home directory.")
-		os.Exit(1)
-	}
-
-	switch command {
-	case "install":
-		if cli.IsInstalled() {
-			fmt.Println("CLSP is already installed. Use 'clsp config' to modify your configuration.")
-			os.Exit(1)
-		}
-		if err := cli.Install(); err != nil {
-			fmt.Printf("Installation failed: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Println("Installation completed successfully!")
-		fmt.Println("\nNext steps:")
-		fmt.Println("1. Configure your hub connection (if needed):")
-		fmt.Println("   clsp config --set-hub https://your-hub:8080")
-		fmt.Println("2. Initialize your identity:")
-		fmt.Println("   clsp init \"Your Name\"")
-		return
-
-	case "init":
-		if len(args) > 0 {
-			fmt.Println("Note: Display name will be prompted interactively")
-			fmt.Println("Any additional arguments will be ignored")
-		}
-
-		if err := cli.InitUser(); err != nil {
-			fmt.Printf("Error initializing user: %v\n", err)
-			os.Exit(1)
-		}
+// Version information, set at build time by 'go run install.go' through -ldflags
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
 
-	case "send":
-		sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-		attachment := sendCmd.String("attachment", "", "Path to attachment file")
-		recipient := sendCmd.String("to", "", "Recipient display name or alias")
-		message := sendCmd.String("message", "", "Message content")
+// globalOptions are the options every command takes
+type globalOptions struct {
+	timeout time.Duration
+	json    bool
+	profile string
+	proxy   string
+	verbose bool
+	version bool
+}
 
-		sendCmd.Parse(args)
+// globalFlags returns the global options as a flag set writing into opts
+func globalFlags(opts *globalOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("clsp", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.DurationVar(&opts.timeout, "timeout", 0, "Abort the command after this `duration` (e.g., '30s')")
+	fs.BoolVar(&opts.json, "json", false, "Print list, users, status, export, config --show and other listings as JSON")
+	fs.StringVar(&opts.profile, "profile", os.Getenv("CLSP_PROFILE"), "Use this named `profile`, a separate identity, configuration and history (default $CLSP_PROFILE)")
+	fs.StringVar(&opts.proxy, "proxy", "", "Reach the hub through this proxy `URL` (http, https, socks5 or socks5h), 'tor' or 'off' instead of the configured one")
+	fs.BoolVar(&opts.verbose, "verbose", false, "Log every hub request with its status and duration to stderr")
+	fs.BoolVar(&opts.version, "version", false, "Print the version and exit")
+	return fs
+}
 
-		if *recipient == "" || *message == "" {
-			if len(sendCmd.Args()) >= 2 {
-				*recipient = sendCmd.Args()[0]
-				*message = strings.Join(sendCmd.Args()[1:], " ")
-			} else {
-				fmt.Println("Error: recipient and message required")
-				sendCmd.PrintDefaults()
-				os.Exit(1)
+// extractGlobals sets the global options found anywhere in args, up to a "--", and
+// returns the remaining arguments
+func extractGlobals(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rest = append(rest, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			rest = append(rest, arg)
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			if !hasValue {
+				value = "true"
 			}
+		} else if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("option --%s needs a value", name)
+			}
+			i++
+			value = args[i]
 		}
-
-		if err := cli.SendMessage(*recipient, *message, *attachment); err != nil {
-			fmt.Printf("Error sending message: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "list":
-		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
-		unreadOnly := listCmd.Bool("unread", false, "Show only unread messages")
-		limit := listCmd.Int("limit", 0, "Limit number of messages shown")
-		search := listCmd.String("search", "", "Search messages by content")
-
-		listCmd.Parse(args)
-
-		if err := cli.ListMessages(*unreadOnly, *limit, *search); err != nil {
-			fmt.Printf("Error listing messages: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "status":
-		if len(args) < 1 {
-			fmt.Println("Error: message ID required")
-			os.Exit(1)
-		}
-		if err := cli.MessageStatus(args[0]); err != nil {
-			fmt.Printf("Error checking message status: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "users":
-		usersCmd := flag.NewFlagSet("users", flag.ExitOnError)
-		onlineOnly := usersCmd.Bool("online", false, "Show only online users")
-		search := usersCmd.String("search", "", "Search users by name")
-
-		usersCmd.Parse(args)
-
-		if err := cli.ListUsers(*onlineOnly, *search); err != nil {
-			fmt.Printf("Error listing users: %v\n", err)
-			os.Exit(1)
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for --%s: %v", value, name, err)
 		}
+	}
+	return rest, nil
+}
 
-	case "config":
-		configCmd := flag.NewFlagSet("config", flag.ExitOnError)
-		show := configCmd.Bool("show", false, "Show current configuration")
-		setHub := configCmd.String("set-hub", "", "Set hub URL")
-		setTLS := configCmd.Bool("set-tls", false, "Enable/disable TLS")
-		setCert := configCmd.String("set-cert", "", "Set TLS certificate path")
-		setExpiry := configCmd.String("set-expiry", "", "Set message expiry duration (e.g., '24h', '7d')")
-		addAlias := configCmd.String("add-alias", "", "Add user alias (format: alias=userid)")
-		removeAlias := configCmd.String("remove-alias", "", "Remove user alias")
-
-		if err := configCmd.Parse(args); err != nil {
-			fmt.Printf("Error parsing config flags: %v\n", err)
-			os.Exit(1)
-		}
+// newRootCommand returns the clsp command tree
+func newRootCommand() *command {
+	root := newCommand("clsp", "", "CLSP - Command Line Secure Protocol")
+	root.help = "Run 'clsp install' and then 'clsp init' first. Options go before the arguments of a\n" +
+		"command; '--' ends the options, so text after it may start with a dash.\n\n" +
+		"Exit status: 0 on success, 1 when the command fails, 2 for an invalid command line\n" +
+		"and 130 when interrupted."
+	root.add(
+		installCommand(),
+		initCommand(),
+		sendCommand("send"),
+		sendCommand("compose"),
+		replyCommand(),
+		listCommand(),
+		conversationsCommand(),
+		exportCommand(),
+		inboxCommand(),
+		watchCommand(),
+		daemonCommand(),
+		statusCommand(),
+		unsendCommand(),
+		readCommand(),
+		saveCommand(),
+		usersCommand(),
+		verifyCommand(),
+		directoryCommand(),
+		outboxCommand(),
+		scheduledCommand(),
+		screenedCommand(),
+		requestsCommand(),
+		configCommand(),
+		motdCommand(),
+		whoamiCommand(),
+		notificationsCommand(),
+		receiptsCommand(),
+		hubCommand(),
+		archiveCommand(),
+		keyCommand(),
+		backupCommand(),
+		restoreCommand(),
+		recoveryCommand(),
+		accountCommand(),
+		passphraseCommand(),
+		lockCommand(),
+		unlockCommand(),
+		agentCommand(),
+		protocolCommand(),
+	)
+	root.add(helpCommand(root))
+	return root
+}
 
-		config, err := cli.LoadConfig()
-		if err != nil {
-			fmt.Printf("Error loading config: %v\n", err)
-			os.Exit(1)
+// helpCommand returns 'clsp help', which describes root or one of its commands
+func helpCommand(root *command) *command {
+	cmd := newCommand("help", "[<command>...]", "Show the help of clsp or of a command")
+	cmd.standalone = true
+	cmd.run = func(ctx context.Context, args []string) error {
+		target := root
+		for _, name := range args {
+			sub := target.find(name)
+			if sub == nil {
+				return usagef("unknown command '%s %s'", target.path(), name)
+			}
+			target = sub
 		}
+		target.printHelp(os.Stdout)
+		return nil
+	}
+	return cmd
+}
 
-		modified := false
+// commandContext returns a context that is cancelled on Ctrl-C/SIGTERM and, if
+// timeout is positive, once the timeout elapses.
+func commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
 
-		if *show {
-			fmt.Printf("Hub URL: %s\n", config.HubURL)
-			fmt.Printf("Use TLS: %v\n", config.UseTLS)
-			if config.UseTLS && config.TLSCertPath != "" {
-				fmt.Printf("TLS Certificate: %s\n", config.TLSCertPath)
-			}
-			fmt.Printf("Message Expiry: %v\n", config.MessageExpiry)
-			fmt.Printf("User Aliases:\n")
-			for alias, id := range config.UserAliases {
-				fmt.Printf("  %s -> %s\n", alias, id)
-			}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigChan:
+		case <-ctx.Done():
 			return
 		}
+		fmt.Fprintln(os.Stderr, "\nInterrupted, aborting...")
+		cancel()
 
-		if *setHub != "" {
-			if err := config.UpdateHubURL(*setHub); err != nil {
-				fmt.Printf("Error updating hub URL: %v\n", err)
-				os.Exit(1)
-			}
-			modified = true
-		}
-
-		if configCmd.Parsed() {
-			if *setTLS {
-				config.UseTLS = true
-				modified = true
-			}
-
-			if *setCert != "" {
-				config.TLSCertPath = *setCert
-				modified = true
-			}
-
-			if *setExpiry != "" {
-				duration, err := time.ParseDuration(*setExpiry)
-				if err != nil {
-					fmt.Printf("Invalid duration format: %v\n", err)
-					os.Exit(1)
-				}
-				config.MessageExpiry = duration
-				modified = true
-			}
+		// Commands blocked on terminal input never observe the cancellation,
+		// so give in-flight requests a moment to clean up and then exit.
+		time.Sleep(2 * time.Second)
+		os.Exit(exitInterrupted)
+	}()
 
-			if *addAlias != "" {
-				parts := strings.Split(*addAlias, "=")
-				if len(parts) != 2 {
-					fmt.Println("Invalid alias format. Use: alias=userid")
-					os.Exit(1)
-				}
-				config.AddUserAlias(parts[0], parts[1])
-				modified = true
-			}
-
-			if *removeAlias != "" {
-				delete(config.UserAliases, *removeAlias)
-				modified = true
-			}
-		}
-
-		if modified {
-			if err := cli.SaveConfig(config); err != nil {
-				fmt.Printf("Error saving config: %v\n", err)
-				os.Exit(1)
-			}
-			fmt.Println("Configuration updated successfully")
-		} else if !*show {
-			fmt.Println("No changes made to configuration")
-		}
+	return ctx, cancel
+}
 
+// exitStatus reports err on stderr and returns the exit status for it
+func exitStatus(err error) int {
+	var usage *usageError
+	var failed *runError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usage):
+		fmt.Fprintf(os.Stderr, "Error: %s\n", usage.msg)
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", usage.cmd.synopsis())
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for details\n", usage.cmd.path())
+		return exitUsage
+	case errors.As(err, &failed) && failed.cmd.failure != "":
+		fmt.Fprintf(os.Stderr, "Error %s: %v\n", failed.cmd.failure, failed.err)
 	default:
-		fmt.Printf("Unknown command: %s\n", command)
-		printUsage()
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	if hint := cli.SizeLimitHint(err); hint != "" {
+		fmt.Fprintln(os.Stderr, hint)
+	}
+	return exitFailure
+}
+
+func main() {
+	var globals globalOptions
+	root := newRootCommand()
+	args, err := extractGlobals(globalFlags(&globals), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Run 'clsp help' for usage")
+		os.Exit(exitUsage)
 	}
+	if globals.version {
+		fmt.Printf("clsp %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+	if err := paths.UseProfile(globals.profile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if err := cli.UseProxy(globals.proxy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if err := cli.UseHubTLS(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFailure)
+	}
+	cli.JSONOutput = globals.json
+	if globals.verbose {
+		cli.EnableVerbose()
+	}
+	if len(args) == 0 {
+		root.printHelp(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	ctx, cancel := commandContext(globals.timeout)
+	err = root.execute(ctx, args)
+	cancel()
+	os.Exit(exitStatus(err))
 }
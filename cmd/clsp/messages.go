@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/cli"
+)
+
+// sendCommand returns 'clsp send', or 'clsp compose', which opens the editor by default
+func sendCommand(name string) *command {
+	cmd := newCommand(name, "<recipient> [<message>...]", "Send a message")
+	if name == "compose" {
+		cmd.args = "<recipient> [<draft>...]"
+		cmd.summary = "Write a message in $EDITOR, then send it (same as send --edit)"
+	}
+	cmd.failure = "sending message"
+	cmd.announce = true
+	cmd.help = `The recipient is a display name, alias or user ID; name@hub reaches a user of
+another federated hub. A message of '-' is read from stdin, e.g. piped from another
+command, and --edit opens $VISUAL or $EDITOR (also accepted right after the
+recipient, as in 'clsp send bob --edit'). With --at or --in the message is kept
+locally and sent by 'clsp watch' or 'clsp daemon' once due.
+
+Examples:
+  clsp send bob "Lunch at noon?"
+  git log -1 | clsp send bob -
+  clsp send --in 2h bob "Reminder: standup"`
+
+	attachment := cmd.flags.String("attachment", "", "Path to attachment `file`")
+	recipient := cmd.flags.String("to", "", "Recipient display name or alias")
+	message := cmd.flags.String("message", "", "Message content ('-' to read it from stdin)")
+	edit := cmd.flags.Bool("edit", name == "compose", "Write the message in $VISUAL or $EDITOR (starting from any message given)")
+	allowDuplicate := cmd.flags.Bool("allow-duplicate", false, "Send even if an identical message was just delivered")
+	dryRun := cmd.flags.Bool("dry-run", false, "Have the hub validate the message without storing it")
+	expire := cmd.flags.Duration("expire", 0, "Delete the message from the hub and both devices after this long (e.g., '1h')")
+	at := cmd.flags.String("at", "", "Send the message at this `time` instead of now (e.g., '2024-06-01T09:00' or '09:00')")
+	in := cmd.flags.Duration("in", 0, "Send the message after this delay instead of now (e.g., '2h')")
+
+	cmd.run = func(ctx context.Context, rest []string) error {
+		if *recipient == "" && len(rest) > 0 {
+			*recipient, rest = rest[0], rest[1:]
+		}
+		// Accept --edit after the recipient too, as in 'clsp send bob --edit', and "--"
+		// before text starting with a dash, as in 'clsp send bob -- -1 for me'
+		if len(rest) > 0 && (rest[0] == "--edit" || rest[0] == "-edit") {
+			*edit, rest = true, rest[1:]
+		}
+		if len(rest) > 0 && rest[0] == "--" {
+			rest = rest[1:]
+		}
+		if *message == "" {
+			*message = strings.Join(rest, " ")
+		}
+		if *recipient == "" {
+			return usagef("recipient required")
+		}
+
+		var err error
+		switch {
+		case *message == "-":
+			*message, err = cli.ReadMessageBody()
+		case *edit:
+			*message, err = cli.ComposeMessage(ctx, *recipient, *message)
+		case *message == "":
+			return usagef("recipient and message required ('-' reads the message from stdin, --edit opens your editor)")
+		}
+		if err != nil {
+			return err
+		}
+
+		opts := cli.SendOptions{
+			AttachmentPath: *attachment,
+			AllowDuplicate: *allowDuplicate,
+			DryRun:         *dryRun,
+			Expiry:         *expire,
+		}
+		if *at != "" || *in != 0 {
+			if *at != "" && *in != 0 {
+				return usagef("use either --at or --in")
+			}
+			due := time.Now().Add(*in)
+			if *at != "" {
+				if due, err = cli.ParseScheduleTime(*at, time.Now()); err != nil {
+					return usagef("%v", err)
+				}
+			}
+			return cli.ScheduleMessage(ctx, *recipient, *message, due, opts)
+		}
+		return cli.SendMessage(ctx, *recipient, *message, opts)
+	}
+	return cmd
+}
+
+// replyCommand returns 'clsp reply'
+func replyCommand() *command {
+	cmd := newCommand("reply", "<message-id> <text>...", "Reply to a received message")
+	cmd.failure = "sending reply"
+	cmd.announce = true
+	allowDuplicate := cmd.flags.Bool("allow-duplicate", false, "Send even if an identical message was just delivered")
+	dryRun := cmd.flags.Bool("dry-run", false, "Have the hub validate the reply without storing it")
+	expire := cmd.flags.Duration("expire", 0, "Delete the reply from the hub and both devices after this long (e.g., '1h')")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) < 2 {
+			return usagef("message ID and reply text required")
+		}
+		return cli.ReplyMessage(ctx, args[0], strings.Join(args[1:], " "), cli.SendOptions{
+			AllowDuplicate: *allowDuplicate,
+			DryRun:         *dryRun,
+			Expiry:         *expire,
+		})
+	}
+	return cmd
+}
+
+// listCommand returns 'clsp list'
+func listCommand() *command {
+	cmd := newCommand("list", "", "List messages (hub and local history by default; never sends read receipts)")
+	cmd.failure = "listing messages"
+	cmd.announce = true
+	cmd.help = `--thread shows a conversation with replies indented under what they answer, --with
+the messages exchanged with a user, yours included, and --sent the messages you sent
+with their delivery state.`
+	unreadOnly := cmd.flags.Bool("unread", false, "Show only unread messages")
+	limit := cmd.flags.Int("limit", 0, "Limit number of messages shown")
+	search := cmd.flags.String("search", "", "Show only messages with words starting with each of these `words`")
+	local := cmd.flags.Bool("local", false, "Show only locally stored history, without contacting the hub")
+	remote := cmd.flags.Bool("remote", false, "Show only messages currently held by the hub")
+	thread := cmd.flags.String("thread", "", "Show the conversation this `message-id` belongs to, replies indented")
+	sent := cmd.flags.Bool("sent", false, "Show the messages you sent and their delivery state")
+	with := cmd.flags.String("with", "", "Show the messages exchanged with this `user` (alias, name or ID), yours included")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected argument %q", args[0])
+		}
+		source := cli.ListMerged
+		switch {
+		case *local && *remote:
+			return usagef("--local and --remote cannot be combined")
+		case *local:
+			source = cli.ListLocal
+		case *remote:
+			source = cli.ListRemote
+		}
+
+		switch {
+		case *sent:
+			if *remote || *unreadOnly || *thread != "" || *with != "" {
+				return usagef("--sent cannot be combined with --remote, --unread, --thread or --with")
+			}
+			return cli.ListSent(ctx, *limit, *search, source)
+		case *thread != "" && *with != "":
+			return usagef("--thread and --with cannot be combined")
+		case *with != "":
+			if *remote {
+				return usagef("--with works on the local history and cannot be combined with --remote")
+			}
+			return cli.ListConversation(ctx, *with, source)
+		case *thread != "":
+			if *remote {
+				return usagef("--thread works on the local history and cannot be combined with --remote")
+			}
+			return cli.ListThread(ctx, *thread, source)
+		}
+		return cli.ListMessages(ctx, *unreadOnly, *limit, *search, source)
+	}
+	return cmd
+}
+
+// conversationsCommand returns 'clsp conversations'
+func conversationsCommand() *command {
+	cmd := newCommand("conversations", "", "List the people you have exchanged messages with and unread counts")
+	cmd.failure = "listing conversations"
+	cmd.announce = true
+	local := cmd.flags.Bool("local", false, "Use only the local history, without contacting the hub")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		source := cli.ListMerged
+		if *local {
+			source = cli.ListLocal
+		}
+		return cli.ListConversations(ctx, source)
+	}
+	return cmd
+}
+
+// exportCommand returns 'clsp export'
+func exportCommand() *command {
+	cmd := newCommand("export", "<user>", "Export a conversation as a transcript with signature checks and key fingerprints")
+	cmd.failure = "exporting conversation"
+	cmd.interspersed = true
+	local := cmd.flags.Bool("local", false, "Use only the local history, without contacting the hub")
+	out := cmd.flags.String("out", "", "Write the transcript to this `file` instead of standard output")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one user required")
+		}
+		source := cli.ListMerged
+		if *local {
+			source = cli.ListLocal
+		}
+		if *out != "" {
+			return cli.ExportConversationFile(ctx, args[0], source, *out)
+		}
+		return cli.ExportConversation(ctx, args[0], source, os.Stdout)
+	}
+	return cmd
+}
+
+// inboxCommand returns 'clsp inbox'
+func inboxCommand() *command {
+	cmd := newCommand("inbox", "", "Summarize unread messages (honours the privacy level)")
+	cmd.failure = "summarizing inbox"
+	badge := cmd.flags.Bool("badge", false, "Print only the unread count (for status bars)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.InboxSummary(ctx, *badge)
+	}
+	return cmd
+}
+
+// watchCommand returns 'clsp watch'
+func watchCommand() *command {
+	cmd := newCommand("watch", "", "Follow new messages and presence, reconnecting if the hub drops")
+	cmd.failure = "watching for messages"
+	cmd.announce = true
+	interval := cmd.flags.Duration("interval", cli.DefaultWatchInterval, "How often to poll the hub")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Watch(ctx, *interval)
+	}
+	return cmd
+}
+
+// daemonCommand returns 'clsp daemon' and its subcommands
+func daemonCommand() *command {
+	cmd := newCommand("daemon", "", "Run in the background: poll the hub, send the outbox, notify, serve a local socket")
+	cmd.failure = "running daemon"
+	interval := cmd.flags.Duration("interval", cli.DefaultWatchInterval, "How often to poll the hub")
+	noNotify := cmd.flags.Bool("no-notify", false, "Do not show desktop notifications for new messages")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unknown command 'clsp daemon %s'", args[0])
+		}
+		return cli.RunDaemon(ctx, *interval, !*noNotify)
+	}
+
+	status := newCommand("status", "", "Show the running daemon's state")
+	status.run = func(ctx context.Context, args []string) error {
+		return cli.DaemonControl(ctx, "status")
+	}
+	stop := newCommand("stop", "", "Stop the running daemon")
+	stop.run = func(ctx context.Context, args []string) error {
+		return cli.DaemonControl(ctx, "stop")
+	}
+	return cmd.add(status, stop)
+}
+
+// statusCommand returns 'clsp status'
+func statusCommand() *command {
+	cmd := newCommand("status", "<message-id>", "Show delivery and read times of a message you sent")
+	cmd.failure = "checking message status"
+	cmd.announce = true
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) < 1 {
+			return usagef("message ID required")
+		}
+		return cli.MessageStatus(ctx, args[0])
+	}
+	return cmd
+}
+
+// unsendCommand returns 'clsp unsend'
+func unsendCommand() *command {
+	cmd := newCommand("unsend", "<message-id>", "Delete a message you sent before it is fetched (or within the hub's unsend window)")
+	cmd.failure = "unsending message"
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) < 1 {
+			return usagef("message ID required")
+		}
+		return cli.Unsend(ctx, args[0])
+	}
+	return cmd
+}
+
+// readCommand returns 'clsp read'
+func readCommand() *command {
+	cmd := newCommand("read", "<message-id>...", "Mark received messages read (sends a read receipt)")
+	cmd.failure = "marking messages read"
+	cmd.interspersed = true
+	all := cmd.flags.Bool("all", false, "Mark every unread message read")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) == 0 && !*all {
+			return usagef("message ID or --all required")
+		}
+		return cli.ReadMessages(ctx, args, *all)
+	}
+	return cmd
+}
+
+// saveCommand returns 'clsp save'
+func saveCommand() *command {
+	cmd := newCommand("save", "<message-id>", "Save a received attachment")
+	cmd.failure = "saving attachment"
+	cmd.interspersed = true
+	out := cmd.flags.String("out", "", "`path` to write the attachment to (default: its file name in the current directory)")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one message ID required")
+		}
+		return cli.SaveAttachment(ctx, args[0], *out)
+	}
+	return cmd
+}
+
+// outboxCommand returns 'clsp outbox'
+func outboxCommand() *command {
+	cmd := newCommand("outbox", "", "Show (or send) messages queued while the hub was unreachable")
+	flush := cmd.flags.Bool("flush", false, "Send the queued messages now")
+
+	cmd.run = func(ctx context.Context, args []string) error {
+		return cli.Outbox(ctx, *flush)
+	}
+	return cmd
+}
+
+// scheduledCommand returns 'clsp scheduled' and its subcommands
+func scheduledCommand() *command {
+	cmd := newCommand("scheduled", "", "Show or cancel messages scheduled to be sent later")
+	list := newCommand("list", "", "List the scheduled messages (the default)")
+	list.run = func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected argument %q", args[0])
+		}
+		return cli.ScheduledMessages(ctx)
+	}
+	cmd.run = list.run
+
+	cancel := newCommand("cancel", "<id>", "Cancel a scheduled message")
+	cancel.run = func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return usagef("exactly one scheduled message ID required")
+		}
+		return cli.CancelScheduled(ctx, args[0])
+	}
+	return cmd.add(list, cancel)
+}
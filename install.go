@@ -1,16 +1,31 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
 )
 
-func getInstallDir() (string, error) {
+// getInstallDir returns the directory to install to, creating it if needed. With
+// user set, Unix-like systems install to ~/.local/bin, which needs no root; Windows
+// always installs per user.
+func getInstallDir(user bool) (string, error) {
 	switch runtime.GOOS {
 	case "windows":
 		// Use LOCALAPPDATA\Programs\clsp as the installation directory
@@ -24,11 +39,22 @@ func getInstallDir() (string, error) {
 		}
 		return installDir, nil
 	case "darwin", "linux":
+		if user {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("failed to find your home directory: %v", err)
+			}
+			installDir := filepath.Join(home, ".local", "bin")
+			if err := os.MkdirAll(installDir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create %s: %v", installDir, err)
+			}
+			return installDir, nil
+		}
 		// Use /usr/local/bin for Unix-like systems
 		installDir := "/usr/local/bin"
 		// Check if we have write permissions
 		if err := os.MkdirAll(installDir, 0755); err != nil {
-			return "", fmt.Errorf("failed to access %s: %v\nPlease run with sudo for system-wide installation", installDir, err)
+			return "", fmt.Errorf("failed to access %s: %v\nPlease run with sudo for system-wide installation, or use --user to install to ~/.local/bin", installDir, err)
 		}
 		return installDir, nil
 	default:
@@ -82,13 +108,77 @@ func updatePath(installDir string) error {
 		if err := os.MkdirAll(installDir, 0755); err != nil {
 			return fmt.Errorf("failed to access %s: %v\nPlease run with sudo for system-wide installation", installDir, err)
 		}
-		return nil
+		for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+			if filepath.Clean(dir) == installDir {
+				return nil
+			}
+		}
+		// A per-user directory such as ~/.local/bin often is not, so the shell's rc
+		// file gets an entry once the user agrees
+		return addToShellPath(installDir)
 
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
+// shellRCFile returns the startup file of the user's login shell and the line that
+// puts dir on its PATH
+func shellRCFile(dir string) (string, string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find your home directory: %v", err)
+	}
+	switch filepath.Base(os.Getenv("SHELL")) {
+	case "zsh":
+		return filepath.Join(home, ".zshrc"), fmt.Sprintf("export PATH=\"$PATH:%s\"", dir), nil
+	case "bash":
+		// macOS terminals start login shells, which read .bash_profile
+		if runtime.GOOS == "darwin" {
+			return filepath.Join(home, ".bash_profile"), fmt.Sprintf("export PATH=\"$PATH:%s\"", dir), nil
+		}
+		return filepath.Join(home, ".bashrc"), fmt.Sprintf("export PATH=\"$PATH:%s\"", dir), nil
+	case "fish":
+		return filepath.Join(home, ".config", "fish", "config.fish"), fmt.Sprintf("fish_add_path %s", dir), nil
+	default:
+		return filepath.Join(home, ".profile"), fmt.Sprintf("export PATH=\"$PATH:%s\"", dir), nil
+	}
+}
+
+// addToShellPath asks before appending dir to the PATH in the shell's rc file, doing
+// nothing if the file already mentions it. Declining returns an error so the caller
+// prints the manual instructions.
+func addToShellPath(dir string) error {
+	rcFile, line, err := shellRCFile(dir)
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(rcFile); err == nil && strings.Contains(string(data), dir) {
+		fmt.Printf("\n%s already adds %s to PATH; open a new terminal to pick it up.\n", rcFile, dir)
+		return nil
+	}
+
+	fmt.Printf("\n%s is not on your PATH. Add it in %s? [y/N]: ", dir, rcFile)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("%s was left unchanged", rcFile)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rcFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(rcFile), err)
+	}
+	f, err := os.OpenFile(rcFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", rcFile, err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "\n# Added by the CLSP installer\n%s\n", line); err != nil {
+		return fmt.Errorf("failed to update %s: %v", rcFile, err)
+	}
+	return nil
+}
+
 func verifyInstallation(installDir string) bool {
 	binaryName := "clsp"
 	if runtime.GOOS == "windows" {
@@ -114,29 +204,32 @@ func main() {
 	// Define flags
 	installClsp := flag.Bool("clsp", false, "Build and install only clsp (if --hub is not provided, both are installed)")
 	installHub := flag.Bool("hub", false, "Build and install only clsp-hub (if --clsp is not provided, both are installed)")
+	fromDir := flag.String("from", "", "Install pre-built binaries from this release directory instead of building; its SHA256SUMS must match")
+	userInstall := flag.Bool("user", false, "Install to ~/.local/bin without root (Unix-like systems; Windows always installs per user)")
+	signingKey := flag.String("signing-key", "", "PEM public key that must have signed the release's SHA256SUMS (checked against SHA256SUMS.sig; used with --from)")
+	release := flag.Bool("release", false, "Cross-compile release archives for every target into dist/ instead of installing")
+	targets := flag.String("targets", strings.Join(releaseTargets, ","), "Comma-separated GOOS/GOARCH targets for --release")
+	version := flag.String("version", "", "Version to embed in the binaries (default: git describe)")
 	flag.Parse()
 
-	// If neither flag is provided, install both (default behavior)
-	installBoth := !(*installClsp || *installHub)
-
-	// Determine install directory
-	installDir, err := getInstallDir()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error determining install directory: %v\n", err)
-		os.Exit(1)
+	if *version == "" {
+		*version = gitVersion()
+	}
+	if *release {
+		if err := buildRelease(*version, strings.Split(*targets, ",")); err != nil {
+			fmt.Fprintf(os.Stderr, "Release build failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	fmt.Printf("Installing to: %s\n", installDir)
-
-	// Build binaries in a temporary directory first
-	tempDir, err := os.MkdirTemp("", "clsp-install-*")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create temporary directory: %v\n", err)
+	if *signingKey != "" && *fromDir == "" {
+		fmt.Fprintln(os.Stderr, "--signing-key only applies to pre-built binaries installed with --from")
 		os.Exit(1)
 	}
-	defer os.RemoveAll(tempDir)
 
-	fmt.Println("Building CLSP binaries...")
+	// If neither flag is provided, install both (default behavior)
+	installBoth := !(*installClsp || *installHub)
 
 	// Helper function to get binary name with extension
 	getBinaryName := func(name string) string {
@@ -145,63 +238,77 @@ func main() {
 		}
 		return name
 	}
-
-	// Build clsp
+	var binaries []string
 	if *installClsp || installBoth {
-		outputPath := filepath.Join(tempDir, getBinaryName("clsp"))
-		cmd := exec.Command("go", "build", "-o", outputPath, "./cmd/clsp")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to build clsp: %v\n", err)
-			os.Exit(1)
-		}
+		binaries = append(binaries, getBinaryName("clsp"))
 	}
-
-	// Build clsp-hub
 	if *installHub || installBoth {
-		outputPath := filepath.Join(tempDir, getBinaryName("clsp-hub"))
-		cmd := exec.Command("go", "build", "-o", outputPath, "./cmd/clsp-hub")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to build clsp-hub: %v\n", err)
-			os.Exit(1)
-		}
+		binaries = append(binaries, getBinaryName("clsp-hub"))
 	}
 
-	// Remove old binaries if they exist
-	if *installClsp || installBoth {
-		os.RemoveAll(filepath.Join(installDir, getBinaryName("clsp")))
-	}
-	if *installHub || installBoth {
-		os.RemoveAll(filepath.Join(installDir, getBinaryName("clsp-hub")))
+	// Determine install directory
+	installDir, err := getInstallDir(*userInstall)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error determining install directory: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Copy the built binaries to the install directory
-	if *installClsp || installBoth {
-		srcPath := filepath.Join(tempDir, getBinaryName("clsp"))
-		if err := copyFile(srcPath, filepath.Join(installDir, getBinaryName("clsp"))); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to install clsp: %v\n", err)
+	fmt.Printf("Installing to: %s\n", installDir)
+
+	// Checksums of the binaries to install, verified again once they are in place
+	var sums map[string]string
+	srcDir := *fromDir
+	if srcDir != "" {
+		fmt.Printf("Verifying release binaries in %s...\n", srcDir)
+		if sums, err = verifyRelease(srcDir, *signingKey, binaries); err != nil {
+			fmt.Fprintf(os.Stderr, "Release verification failed: %v\n", err)
 			os.Exit(1)
 		}
-	}
-	if *installHub || installBoth {
-		srcPath := filepath.Join(tempDir, getBinaryName("clsp-hub"))
-		if err := copyFile(srcPath, filepath.Join(installDir, getBinaryName("clsp-hub"))); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to install clsp-hub: %v\n", err)
+		if *signingKey == "" {
+			fmt.Println("Warning: no --signing-key given; checksums catch damaged files but not a tampered release")
+		}
+	} else {
+		// Build binaries in a temporary directory first
+		tempDir, err := os.MkdirTemp("", "clsp-install-*")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create temporary directory: %v\n", err)
 			os.Exit(1)
 		}
+		defer os.RemoveAll(tempDir)
+		srcDir = tempDir
+
+		fmt.Println("Building CLSP binaries...")
+		sums = make(map[string]string)
+		for _, name := range binaries {
+			outputPath := filepath.Join(tempDir, name)
+			pkg := "./cmd/" + strings.TrimSuffix(name, ".exe")
+			cmd := exec.Command("go", "build", "-tags", buildTags, "-ldflags", versionFlags(*version), "-o", outputPath, pkg)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to build %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			if sums[name], err = fileChecksum(outputPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to checksum %s: %v\n", name, err)
+				os.Exit(1)
+			}
+		}
 	}
 
-	// Set executable permissions (on Unix-like systems)
-	if runtime.GOOS != "windows" {
-		if *installClsp || installBoth {
-			os.Chmod(filepath.Join(installDir, "clsp"), 0755)
-		}
-		if *installHub || installBoth {
-			os.Chmod(filepath.Join(installDir, "clsp-hub"), 0755)
+	// Copy the binaries to the install directory. Each is written under a temporary
+	// name and only replaces the old binary once its checksum matches.
+	for _, name := range binaries {
+		if err := installBinary(filepath.Join(srcDir, name), filepath.Join(installDir, name), sums[name]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to install %s: %v\n", name, err)
+			os.Exit(1)
 		}
+		fmt.Printf("  %s  %s\n", sums[name], name)
+	}
+	if err := recordChecksums(installDir, sums); err != nil {
+		fmt.Printf("Warning: failed to record checksums: %v\n", err)
+	} else {
+		fmt.Printf("Checksums recorded in %s\n", filepath.Join(installDir, checksumsFile))
 	}
 
 	fmt.Printf("\nCLSP binaries installed successfully to %s\n", installDir)
@@ -252,18 +359,380 @@ func main() {
 	}
 }
 
-// copyFile copies a file from src to dst
+// releaseTargets are the GOOS/GOARCH pairs --release builds by default
+var releaseTargets = []string{"linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64", "windows/amd64"}
+
+// distDir is where --release writes its archives
+const distDir = "dist"
+
+// gitVersion describes the checked-out commit for embedding as the version, or
+// returns "dev" outside a git checkout
+func gitVersion() string {
+	out, err := exec.Command("git", "describe", "--tags", "--always", "--dirty").Output()
+	if err != nil {
+		return "dev"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitCommit returns the hash of the checked-out commit, or "unknown"
+func gitCommit() string {
+	out, err := exec.Command("git", "rev-parse", "--short=12", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// buildTags enables SQLite's FTS5, which the hub's name search and the client's
+// message search use
+const buildTags = "sqlite_fts5"
+
+// versionFlags returns the linker flags that embed version information in the
+// binaries, which report it with 'clsp --version' and 'clsp-hub -version'
+func versionFlags(version string) string {
+	return fmt.Sprintf("-s -w -X main.version=%s -X main.commit=%s -X main.buildDate=%s",
+		version, gitCommit(), time.Now().UTC().Format(time.RFC3339))
+}
+
+// buildRelease cross-compiles clsp and clsp-hub for each GOOS/GOARCH target and packs
+// each target into dist/clsp_<version>_<os>_<arch> (.tar.gz, or .zip for Windows) with
+// the README, the license and a SHA256SUMS of the binaries, so an unpacked archive can
+// be installed with --from. dist/SHA256SUMS lists the archives. Both binaries use
+// SQLite through cgo, so targets other than the host need a C cross-compiler named in
+// CC_<os>_<arch> (for example CC_linux_arm64=aarch64-linux-gnu-gcc); targets without
+// one are skipped with a warning.
+func buildRelease(version string, targets []string) error {
+	if err := os.RemoveAll(distDir); err != nil {
+		return fmt.Errorf("failed to clear %s: %v", distDir, err)
+	}
+	if err := os.MkdirAll(distDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", distDir, err)
+	}
+	tempDir, err := os.MkdirTemp("", "clsp-release-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ldflags := versionFlags(version)
+	archiveSums := make(map[string]string)
+	var skipped []string
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		goos, goarch, ok := strings.Cut(target, "/")
+		if !ok || goos == "" || goarch == "" {
+			return fmt.Errorf("invalid target %q; use GOOS/GOARCH such as linux/amd64", target)
+		}
+
+		env := append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=1")
+		if goos != runtime.GOOS || goarch != runtime.GOARCH {
+			cc := os.Getenv("CC_" + goos + "_" + goarch)
+			if cc == "" {
+				fmt.Printf("Skipping %s: set CC_%s_%s to a C cross-compiler for SQLite\n", target, goos, goarch)
+				skipped = append(skipped, target)
+				continue
+			}
+			env = append(env, "CC="+cc)
+		}
+
+		fmt.Printf("Building %s...\n", target)
+		name := fmt.Sprintf("clsp_%s_%s_%s", version, goos, goarch)
+		stage := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(stage, 0755); err != nil {
+			return fmt.Errorf("failed to create staging directory: %v", err)
+		}
+		var files []string
+		binarySums := make(map[string]string)
+		for _, binary := range []string{"clsp", "clsp-hub"} {
+			if goos == "windows" {
+				binary += ".exe"
+			}
+			cmd := exec.Command("go", "build", "-trimpath", "-tags", buildTags, "-ldflags", ldflags, "-o", filepath.Join(stage, binary), "./cmd/"+strings.TrimSuffix(binary, ".exe"))
+			cmd.Env = env
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("failed to build %s for %s: %v", binary, target, err)
+			}
+			if binarySums[binary], err = fileChecksum(filepath.Join(stage, binary)); err != nil {
+				return fmt.Errorf("failed to checksum %s: %v", binary, err)
+			}
+			files = append(files, binary)
+		}
+		if err := writeChecksums(filepath.Join(stage, "SHA256SUMS"), binarySums); err != nil {
+			return err
+		}
+		files = append(files, "SHA256SUMS")
+		for _, doc := range []string{"README.md", "LICENSE"} {
+			if err := copyFile(doc, filepath.Join(stage, doc)); err != nil {
+				return fmt.Errorf("failed to stage %s: %v", doc, err)
+			}
+			files = append(files, doc)
+		}
+
+		archive := name + ".tar.gz"
+		if goos == "windows" {
+			archive = name + ".zip"
+		}
+		if err := writeArchive(filepath.Join(distDir, archive), name, stage, files); err != nil {
+			return fmt.Errorf("failed to pack %s: %v", archive, err)
+		}
+		if archiveSums[archive], err = fileChecksum(filepath.Join(distDir, archive)); err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", archive, err)
+		}
+	}
+
+	if len(archiveSums) == 0 {
+		return fmt.Errorf("no target could be built")
+	}
+	if err := writeChecksums(filepath.Join(distDir, "SHA256SUMS"), archiveSums); err != nil {
+		return err
+	}
+	fmt.Printf("\nRelease %s: %d archive(s) and SHA256SUMS written to %s\n", version, len(archiveSums), distDir)
+	if len(skipped) > 0 {
+		fmt.Printf("Skipped for lack of a cross-compiler: %s\n", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// writeArchive packs files from dir into a .tar.gz or .zip archive (chosen by the
+// name of path) under the top-level directory prefix
+func writeArchive(path, prefix, dir string, files []string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(out)
+		for _, name := range files {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = prefix + "/" + name
+			header.Method = zip.Deflate
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := appendFile(w, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = prefix + "/" + name
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := appendFile(tw, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// appendFile copies the file at path to w
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// checksumsFile records the SHA-256 checksums of the installed binaries in the install
+// directory, in the format 'sha256sum -c' reads
+const checksumsFile = "clsp.sha256"
+
+// fileChecksum returns the hex SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// parseChecksums reads a checksum list in 'sha256sum' format into a map from file
+// name to hex checksum
+func parseChecksums(data []byte) map[string]string {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// A leading '*' marks binary mode
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums
+}
+
+// verifyRelease checks pre-built binaries against the release's SHA256SUMS and, with
+// a signing key, the list itself against the detached signature in SHA256SUMS.sig
+// (base64 or raw RSA PKCS#1 v1.5 over SHA-256). It returns the checksums of binaries.
+func verifyRelease(dir, signingKey string, binaries []string) (map[string]string, error) {
+	list, err := os.ReadFile(filepath.Join(dir, "SHA256SUMS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksum list: %v", err)
+	}
+	if signingKey != "" {
+		keyPEM, err := os.ReadFile(signingKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %v", err)
+		}
+		publicKey, err := crypto.LoadPublicKeyFromPEM(keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := os.ReadFile(filepath.Join(dir, "SHA256SUMS.sig"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature: %v", err)
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+			signature = decoded
+		}
+		if err := crypto.VerifyData(publicKey, list, signature); err != nil {
+			return nil, fmt.Errorf("SHA256SUMS is not signed by %s: %v", signingKey, err)
+		}
+		fmt.Println("Release signature verified")
+	}
+
+	listed := parseChecksums(list)
+	sums := make(map[string]string)
+	for _, name := range binaries {
+		want, ok := listed[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not listed in SHA256SUMS", name)
+		}
+		got, err := fileChecksum(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum %s: %v", name, err)
+		}
+		if got != want {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, want, got)
+		}
+		sums[name] = got
+	}
+	return sums, nil
+}
+
+// installBinary copies src to dst through a temporary file next to dst, checking the
+// copy against checksum before it replaces dst, so an interrupted or corrupted copy
+// never leaves a broken binary installed
+func installBinary(src, dst, checksum string) error {
+	tmp := dst + ".new"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	got, err := fileChecksum(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to checksum the copy: %v", err)
+	}
+	if got != checksum {
+		os.Remove(tmp)
+		return fmt.Errorf("checksum mismatch after copy: expected %s, got %s", checksum, got)
+	}
+	// Windows cannot rename over an existing file
+	if runtime.GOOS == "windows" {
+		os.Remove(dst)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move binary into place: %v", err)
+	}
+	return nil
+}
+
+// recordChecksums updates the checksum record in the install directory, keeping the
+// entries of binaries not reinstalled this time
+func recordChecksums(installDir string, sums map[string]string) error {
+	path := filepath.Join(installDir, checksumsFile)
+	recorded := make(map[string]string)
+	if data, err := os.ReadFile(path); err == nil {
+		recorded = parseChecksums(data)
+	}
+	for name, sum := range sums {
+		recorded[name] = sum
+	}
+	return writeChecksums(path, recorded)
+}
+
+// writeChecksums writes sums in 'sha256sum' format, sorted by file name
+func writeChecksums(path string, sums map[string]string) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// copyFile copies a file from src to dst, flushing it to disk
 func copyFile(src, dst string) error {
-	// Read the source file
-	srcData, err := os.ReadFile(src)
+	in, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to read source file: %v", err)
 	}
+	defer in.Close()
 
-	// Write to the destination file
-	if err := os.WriteFile(dst, srcData, 0755); err != nil {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
 		return fmt.Errorf("failed to write destination file: %v", err)
 	}
-
-	return nil
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write destination file: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write destination file: %v", err)
+	}
+	return out.Close()
 }
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DeleteAccount deletes the identity's account from the hub, with everything the hub
+// stores for it, after confirmation unless yes is set. The local keys and history stay.
+func DeleteAccount(ctx context.Context, yes bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.UserID == "" {
+		return fmt.Errorf("no identity initialized; run 'clsp init' first")
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	if !yes {
+		fmt.Printf("This deletes the account of %s (%s) on %s, with its stored messages,\n", config.DisplayName, config.UserID, config.HubURL)
+		fmt.Println("attachments, contacts and usage. Nothing the hub holds can be recovered.")
+		fmt.Print("Delete the account? (y/N): ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			return fmt.Errorf("account not deleted")
+		}
+	}
+
+	deletion, err := hubClient(config, privateKey).DeleteAccount(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Account deleted: %d stored messages and %d attachments removed from the hub\n", deletion.Messages, deletion.Attachments)
+	if deletion.Deliveries > 0 || deletion.DeadLetters > 0 {
+		fmt.Printf("Also removed: %d queued deliveries and %d failed deliveries\n", deletion.Deliveries, deletion.DeadLetters)
+	}
+
+	// The identity is no longer known to the hub, so it waits to register again
+	config.RegistrationPending = true
+	if err := SaveConfig(config); err != nil {
+		return fmt.Errorf("account deleted but failed to save config: %v", err)
+	}
+	fmt.Println("Your keys and local history are still on this device; 'clsp init --resume' registers the identity again.")
+	return nil
+}
+
+// ExportAccount writes everything the hub holds about the identity to out, as JSON
+func ExportAccount(ctx context.Context, out io.Writer) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.UserID == "" {
+		return fmt.Errorf("no identity initialized; run 'clsp init' first")
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	return hubClient(config, privateKey).ExportAccount(ctx, out)
+}
+
+// ExportAccountFile writes the account export to path, readable only by the user
+func ExportAccountFile(ctx context.Context, path string) error {
+	var b bytes.Buffer
+	if err := ExportAccount(ctx, &b); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write account export: %v", err)
+	}
+	fmt.Fprintf(notices(), "Account export written to %s\n", path)
+	return nil
+}
@@ -0,0 +1,207 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// agentSocketFile is the name of the key agent's socket in the runtime directory
+const agentSocketFile = "agent.sock"
+
+// legacySessionFile is where clients before the key agent cached the unlocked key
+const legacySessionFile = "session.json"
+
+// agentKeyResponse is the response of GET /key on the agent socket
+type agentKeyResponse struct {
+	PrivateKey []byte `json:"private_key"`
+}
+
+// agentSocketPath returns the path of the key agent's socket
+func agentSocketPath() (string, error) {
+	return paths.GetRuntimePath(agentSocketFile)
+}
+
+// agentClient returns an HTTP client that talks to the key agent's socket
+func agentClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// RunKeyAgent holds the unlocked private key, read from stdin as PKCS #1, in memory
+// and hands it to clsp commands over a Unix socket in the runtime directory. It exits
+// once the key has not been asked for during idle (never when idle is not positive),
+// when 'clsp lock' asks it to, or when ctx is cancelled, locking a running daemon as
+// it goes. 'clsp unlock' starts it; the key never reaches the disk.
+func RunKeyAgent(ctx context.Context, idle time.Duration) error {
+	der, err := io.ReadAll(io.LimitReader(os.Stdin, 64<<10))
+	if err != nil {
+		return fmt.Errorf("failed to read key: %v", err)
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	// A socket left behind by an agent that died is in the way
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict access to %s: %v", socketPath, err)
+	}
+
+	// The agent outlives the terminal that started it; only the idle timer and
+	// 'clsp lock' end it
+	signal.Ignore(syscall.SIGHUP)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.AfterFunc(idle, cancel)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/key", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Each use restarts the idle period
+		if timer != nil && !timer.Reset(idle) {
+			http.Error(w, "Locked", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agentKeyResponse{PrivateKey: x509.MarshalPKCS1PrivateKey(privateKey)})
+	})
+	mux.HandleFunc("/lock", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		cancel()
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	// Tell the parent the socket is ready; stdout goes nowhere once it has exited
+	fmt.Println("ready")
+	os.Stdout.Close()
+
+	<-ctx.Done()
+	server.Close()
+	// A daemon holds the key too; it goes when the agent does
+	lockDaemon()
+	return nil
+}
+
+// agentKey returns the key held by a running key agent, or nil when none runs
+func agentKey() *rsa.PrivateKey {
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return nil
+	}
+	resp, err := agentClient(socketPath).Get("http://clsp-agent/key")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var key agentKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return nil
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil
+	}
+	return privateKey
+}
+
+// stopKeyAgent asks a running key agent to exit and reports whether one did. Any
+// unlocked key left on disk by earlier clients is removed too.
+func stopKeyAgent() bool {
+	if path, err := paths.GetRuntimePath(legacySessionFile); err == nil {
+		os.Remove(path)
+	}
+	socketPath, err := agentSocketPath()
+	if err != nil {
+		return false
+	}
+	resp, err := agentClient(socketPath).Post("http://clsp-agent/lock", "", nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusAccepted
+}
+
+// startKeyAgent starts a key agent holding privateKey, in place of any running one
+func startKeyAgent(privateKey *rsa.PrivateKey, idle time.Duration) error {
+	stopKeyAgent()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate clsp: %v", err)
+	}
+	var args []string
+	if paths.Profile != "" {
+		args = append(args, "--profile", paths.Profile)
+	}
+	args = append(args, "agent", "--idle", idle.String())
+	cmd := exec.Command(exe, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start key agent: %v", err)
+	}
+	stdin.Write(x509.MarshalPKCS1PrivateKey(privateKey))
+	stdin.Close()
+
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if strings.TrimSpace(line) != "ready" {
+		cmd.Wait()
+		return fmt.Errorf("key agent did not start")
+	}
+	return cmd.Process.Release()
+}
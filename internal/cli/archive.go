@@ -0,0 +1,429 @@
+package cli
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// The local archive keeps an HMAC chain over its messages in the order they were
+// stored: each link authenticates one message's digest together with the previous
+// link, and a head record authenticates the last link. The key is derived from the
+// identity key, so a process that cannot read the identity cannot alter, remove or
+// insert messages, or cut off the end of the history, without 'clsp archive verify'
+// noticing. Read state is not covered, since it changes as messages are shown.
+const (
+	archiveLinkLabel    = "clsp-archive-link-v1"
+	archiveHeadLabel    = "clsp-archive-head-v1"
+	archiveExpiredLabel = "clsp-archive-expired-v1"
+)
+
+// createArchiveChain creates the tables of the integrity chain
+func createArchiveChain(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS archive_chain (
+			seq INTEGER PRIMARY KEY,
+			message_id TEXT NOT NULL UNIQUE,
+			digest BLOB NOT NULL,
+			mac BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create archive integrity chain: %v", err)
+	}
+	// Chains created before sender expiry lack the column marking purged messages
+	if _, err := db.Exec("ALTER TABLE archive_chain ADD COLUMN expired_mac BLOB"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("failed to upgrade archive integrity chain: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS archive_head (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			seq INTEGER NOT NULL,
+			mac BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create archive integrity chain: %v", err)
+	}
+	return nil
+}
+
+// archiveDigest hashes the parts of a stored message that must not change
+func archiveDigest(msg *crypto.Message) ([]byte, error) {
+	stable := *msg
+	stable.Status = ""
+	data, err := json.Marshal(&stable)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// linkMAC authenticates link seq, which records messageID with digest, after prev
+func linkMAC(key, prev []byte, seq int64, messageID string, digest []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(archiveLinkLabel))
+	mac.Write(prev)
+	binary.Write(mac, binary.BigEndian, seq)
+	mac.Write([]byte(messageID))
+	mac.Write([]byte{0})
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+// headMAC authenticates the last link of the chain
+func headMAC(key []byte, seq int64, last []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(archiveHeadLabel))
+	binary.Write(mac, binary.BigEndian, seq)
+	mac.Write(last)
+	return mac.Sum(nil)
+}
+
+// expiredMAC marks the link of messageID as belonging to a message deleted at its
+// sender's expiry rather than removed outside clsp
+func expiredMAC(key []byte, messageID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(archiveExpiredLabel))
+	mac.Write([]byte(messageID))
+	return mac.Sum(nil)
+}
+
+// archiveChain appends links within a store transaction
+type archiveChain struct {
+	key []byte
+	seq int64
+	mac []byte
+}
+
+// openArchiveChain returns the chain to append to. A new chain first takes in the
+// messages already stored. If the head is missing or was not written with this key
+// while links exist, nothing is appended, leaving the damage for verify to report.
+func openArchiveChain(ctx context.Context, tx *sql.Tx, key []byte) (*archiveChain, error) {
+	chain := &archiveChain{key: key}
+	var headSeq int64
+	var headMac []byte
+	err := tx.QueryRowContext(ctx, "SELECT seq, mac FROM archive_head WHERE id = 1").Scan(&headSeq, &headMac)
+	if err == nil {
+		var lastMac []byte
+		err = tx.QueryRowContext(ctx, "SELECT mac FROM archive_chain WHERE seq = ?", headSeq).Scan(&lastMac)
+		if headSeq == 0 && err == sql.ErrNoRows {
+			err, lastMac = nil, nil
+		}
+		if err != nil || !hmac.Equal(headMac, headMAC(key, headSeq, lastMac)) {
+			return nil, nil
+		}
+		chain.seq, chain.mac = headSeq, lastMac
+		return chain, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+	}
+
+	var links int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM archive_chain").Scan(&links); err != nil {
+		return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+	}
+	if links > 0 {
+		return nil, nil
+	}
+	if err := chain.enroll(ctx, tx); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// enroll appends every stored message not in the chain, oldest first
+func (c *archiveChain) enroll(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT envelope FROM messages
+		WHERE id NOT IN (SELECT message_id FROM archive_chain)
+		ORDER BY stored_at, id`)
+	if err != nil {
+		return fmt.Errorf("failed to read local messages: %v", err)
+	}
+	var messages []*crypto.Message
+	for rows.Next() {
+		var envelope []byte
+		if err := rows.Scan(&envelope); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read local messages: %v", err)
+		}
+		msg, err := openEnvelope(envelope)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read local messages: %v", err)
+	}
+	for _, msg := range messages {
+		if err := c.append(ctx, tx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append adds a link for msg unless it already has one
+func (c *archiveChain) append(ctx context.Context, tx *sql.Tx, msg *crypto.Message) error {
+	var linked bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM archive_chain WHERE message_id = ?)", msg.ID).Scan(&linked); err != nil {
+		return fmt.Errorf("failed to read archive integrity chain: %v", err)
+	}
+	if linked {
+		return nil
+	}
+	digest, err := archiveDigest(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %s: %v", msg.ID, err)
+	}
+	seq := c.seq + 1
+	mac := linkMAC(c.key, c.mac, seq, msg.ID, digest)
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO archive_chain (seq, message_id, digest, mac) VALUES (?, ?, ?, ?)",
+		seq, msg.ID, digest, mac,
+	); err != nil {
+		return fmt.Errorf("failed to extend archive integrity chain: %v", err)
+	}
+	c.seq, c.mac = seq, mac
+	return nil
+}
+
+// saveHead records the chain's last link
+func (c *archiveChain) saveHead(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO archive_head (id, seq, mac) VALUES (1, ?, ?) ON CONFLICT(id) DO UPDATE SET seq = excluded.seq, mac = excluded.mac",
+		c.seq, headMAC(c.key, c.seq, c.mac),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update archive integrity chain: %v", err)
+	}
+	return nil
+}
+
+// ArchiveIntegrity is the result of checking the local archive against its chain
+type ArchiveIntegrity struct {
+	// Intact counts messages whose content matches the chain
+	Intact int `json:"intact"`
+	// Modified lists messages whose stored content no longer matches the chain
+	Modified []string `json:"modified,omitempty"`
+	// Deleted lists messages recorded in the chain that are gone from the archive
+	Deleted []string `json:"deleted,omitempty"`
+	// Expired counts messages deleted by clsp once their sender's expiry passed
+	Expired int `json:"expired"`
+	// Unrecorded lists messages in the archive that the chain does not know
+	Unrecorded []string `json:"unrecorded,omitempty"`
+	// ChainBroken is set when links were altered, removed or reordered
+	ChainBroken bool `json:"chain_broken"`
+	// Truncated is set when the head does not match the end of the chain, as after
+	// the newest messages and their links were removed
+	Truncated bool `json:"truncated"`
+}
+
+// OK reports whether the archive is exactly as clsp stored it
+func (r *ArchiveIntegrity) OK() bool {
+	return len(r.Modified) == 0 && len(r.Deleted) == 0 && len(r.Unrecorded) == 0 && !r.ChainBroken && !r.Truncated
+}
+
+// verifyIntegrity checks every message and link of the archive with key
+func (st *localStore) verifyIntegrity(ctx context.Context, key []byte) (*ArchiveIntegrity, error) {
+	report := &ArchiveIntegrity{}
+
+	// Current digests of the stored messages
+	current := make(map[string][]byte)
+	rows, err := st.db.QueryContext(ctx, "SELECT id, envelope FROM messages")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local messages: %v", err)
+	}
+	for rows.Next() {
+		var id string
+		var envelope []byte
+		if err := rows.Scan(&id, &envelope); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+		current[id] = nil
+		if msg, err := openEnvelope(envelope); err == nil && msg.ID == id {
+			current[id], _ = archiveDigest(msg)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read local messages: %v", err)
+	}
+
+	rows, err = st.db.QueryContext(ctx, "SELECT seq, message_id, digest, mac, expired_mac FROM archive_chain ORDER BY seq")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+	}
+	defer rows.Close()
+	var seq int64
+	var prev []byte
+	linked := make(map[string]bool)
+	for rows.Next() {
+		var linkSeq int64
+		var id string
+		var digest, mac, expired []byte
+		if err := rows.Scan(&linkSeq, &id, &digest, &mac, &expired); err != nil {
+			return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+		}
+		if linkSeq != seq+1 || !hmac.Equal(mac, linkMAC(key, prev, linkSeq, id, digest)) {
+			report.ChainBroken = true
+		}
+		seq, prev = linkSeq, mac
+		linked[id] = true
+
+		got, stored := current[id]
+		switch {
+		case !stored && expired != nil && hmac.Equal(expired, expiredMAC(key, id)):
+			report.Expired++
+		case !stored:
+			report.Deleted = append(report.Deleted, id)
+		case got == nil || !hmac.Equal(got, digest):
+			report.Modified = append(report.Modified, id)
+		default:
+			report.Intact++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+	}
+
+	var headSeq int64
+	var headMac []byte
+	err = st.db.QueryRowContext(ctx, "SELECT seq, mac FROM archive_head WHERE id = 1").Scan(&headSeq, &headMac)
+	switch {
+	case err == sql.ErrNoRows:
+		report.Truncated = seq > 0 || len(current) > 0
+	case err != nil:
+		return nil, fmt.Errorf("failed to read archive integrity chain: %v", err)
+	default:
+		report.Truncated = headSeq != seq || !hmac.Equal(headMac, headMAC(key, headSeq, prev))
+	}
+
+	for id := range current {
+		if !linked[id] {
+			report.Unrecorded = append(report.Unrecorded, id)
+		}
+	}
+	return report, nil
+}
+
+// reseal rebuilds the chain from the archive as it is now
+func (st *localStore) reseal(ctx context.Context, key []byte) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reseal archive: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM archive_chain"); err != nil {
+		return fmt.Errorf("failed to reseal archive: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM archive_head"); err != nil {
+		return fmt.Errorf("failed to reseal archive: %v", err)
+	}
+	chain := &archiveChain{key: key}
+	if err := chain.enroll(ctx, tx); err != nil {
+		return err
+	}
+	if err := chain.saveHead(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyArchive checks the local archive against its integrity chain and reports
+// messages that were modified, deleted or added outside clsp. With reseal, the
+// archive's current content is accepted as genuine after confirmation and the chain
+// is rebuilt from it.
+func VerifyArchive(ctx context.Context, reseal bool) error {
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	key := crypto.LocalMACKey(privateKey)
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.verifyIntegrity(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if reseal {
+		if report.OK() {
+			fmt.Println("Archive integrity: OK; nothing to reseal")
+			return nil
+		}
+		fmt.Println("Resealing accepts every message now in the archive as genuine, including any")
+		fmt.Println("that were altered or added by another program, and forgets deleted ones.")
+		fmt.Print("Reseal the archive? (y/N): ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			return fmt.Errorf("archive not resealed")
+		}
+		if err := store.reseal(ctx, key); err != nil {
+			return err
+		}
+		fmt.Println("Archive resealed")
+		return nil
+	}
+
+	if JSONOutput {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printIntegrity(report)
+	}
+	if !report.OK() {
+		return fmt.Errorf("the local archive was changed outside clsp")
+	}
+	return nil
+}
+
+// printIntegrity prints an integrity report
+func printIntegrity(r *ArchiveIntegrity) {
+	if r.OK() {
+		if r.Expired > 0 {
+			fmt.Printf("Archive integrity: OK (%d messages, %d more deleted at their sender's expiry)\n", r.Intact, r.Expired)
+			return
+		}
+		fmt.Printf("Archive integrity: OK (%d messages)\n", r.Intact)
+		return
+	}
+	fmt.Printf("Archive integrity: FAILED (%d of %d recorded messages intact)\n", r.Intact, r.Intact+len(r.Modified)+len(r.Deleted))
+	for _, id := range r.Modified {
+		fmt.Printf("  modified:   %s\n", id)
+	}
+	for _, id := range r.Deleted {
+		fmt.Printf("  deleted:    %s\n", id)
+	}
+	for _, id := range r.Unrecorded {
+		fmt.Printf("  unrecorded: %s (added outside clsp)\n", id)
+	}
+	if r.ChainBroken {
+		fmt.Println("  the integrity chain itself was altered")
+	}
+	if r.Truncated {
+		fmt.Println("  the newest part of the history is missing, or the chain head was altered")
+	}
+	fmt.Println("Restore the archive from a backup, or accept its current state with 'clsp archive verify --reseal'.")
+}
@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errCorruptFile marks a local file that exists but cannot be parsed or authenticated
+var errCorruptFile = errors.New("file is corrupt")
+
+// backupSuffix names the last good copy kept next to a file
+const backupSuffix = ".bak"
+
+// writeFileAtomic replaces path with data. The data is written to a temporary file
+// in the same directory, synced and renamed over path, so a crash leaves either the
+// old or the new contents, never a mix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// quarantineFile moves a corrupt file aside so it can be inspected, returning its new name
+func quarantineFile(path string) (string, error) {
+	aside := fmt.Sprintf("%s.corrupt-%d", path, os.Getpid())
+	if err := os.Rename(path, aside); err != nil {
+		return "", err
+	}
+	return aside, nil
+}
+
+// lockTimeout is how long a command waits for another clsp process to finish
+// updating a file
+const lockTimeout = 10 * time.Second
+
+// lockLocalFile takes the advisory lock that serializes updates of path between clsp
+// processes, waiting up to lockTimeout, and returns a function that releases it. The
+// lock lives in a separate file because path itself is replaced on every write.
+func lockLocalFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock for %s: %v", filepath.Base(path), err)
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", filepath.Base(path), err)
+		}
+		if locked {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s is being updated by another clsp process; try again", filepath.Base(path))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,389 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// Key sources for encrypting local files at rest
+const (
+	// KeySourceIdentity wraps the storage key with a key derived from the identity
+	// key, so local files open only once the identity is unlocked with its passphrase
+	KeySourceIdentity = "identity"
+	// KeySourceKeyring keeps the storage key in the operating system keyring
+	KeySourceKeyring = "keyring"
+)
+
+// storageMetaFile records whether local files are encrypted; it is never encrypted itself
+const storageMetaFile = "storage.json"
+
+// sealedMagic prefixes every file and archive entry encrypted at rest
+var sealedMagic = []byte("CLSP-SEALED-1\n")
+
+// storageMeta describes how local files are encrypted at rest
+type storageMeta struct {
+	KeySource string `json:"key_source"`
+	// WrappedKey is the storage key sealed under the identity (identity source only)
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	// AutoLockAfter mirrors Config.AutoLockAfter, which is needed to unlock the
+	// identity before the config itself can be read
+	AutoLockAfter time.Duration `json:"auto_lock_after,omitempty"`
+}
+
+// storageKey caches the unwrapped storage key for the life of the process
+var storageKey []byte
+
+// loadStorageMeta returns the at-rest settings, or nil when local files are plaintext
+func loadStorageMeta() (*storageMeta, error) {
+	data, err := os.ReadFile(paths.GetConfigPath(storageMetaFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", storageMetaFile, err)
+	}
+	var meta storageMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", storageMetaFile, err)
+	}
+	return &meta, nil
+}
+
+// saveStorageMeta writes the at-rest settings
+func saveStorageMeta(meta *storageMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", storageMetaFile, err)
+	}
+	if err := writeFileAtomic(paths.GetConfigPath(storageMetaFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", storageMetaFile, err)
+	}
+	return nil
+}
+
+// localStorageKey returns the key local files are encrypted with, or nil when
+// encryption at rest is off. It may prompt for the identity passphrase.
+func localStorageKey() ([]byte, error) {
+	if storageKey != nil {
+		return storageKey, nil
+	}
+	meta, err := loadStorageMeta()
+	if err != nil || meta == nil {
+		return nil, err
+	}
+
+	var key []byte
+	switch meta.KeySource {
+	case KeySourceIdentity:
+		identity, err := loadIdentityKey()
+		if err != nil {
+			return nil, fmt.Errorf("local files are encrypted with your identity: %v", err)
+		}
+		if key, err = crypto.OpenLocal(identity, meta.WrappedKey); err != nil {
+			return nil, fmt.Errorf("failed to unwrap storage key: %v", err)
+		}
+	case KeySourceKeyring:
+		if key, err = keyringGet(); err != nil {
+			return nil, fmt.Errorf("failed to read storage key from the OS keyring: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown key source %q in %s", meta.KeySource, storageMetaFile)
+	}
+	storageKey = key
+	return key, nil
+}
+
+// isSealed reports whether data was written by sealLocalData
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// sealLocalData encrypts data with the storage key, or returns it unchanged when
+// encryption at rest is off
+func sealLocalData(data []byte) ([]byte, error) {
+	key, err := localStorageKey()
+	if err != nil || key == nil {
+		return data, err
+	}
+	sealed, err := crypto.Seal(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, sealedMagic...), sealed...), nil
+}
+
+// openLocalData decrypts data written by sealLocalData; plaintext passes through,
+// so files written before encryption was turned on stay readable
+func openLocalData(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	key, err := localStorageKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("file is encrypted but %s is missing", storageMetaFile)
+	}
+	plain, err := crypto.Open(key, data[len(sealedMagic):])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptFile, err)
+	}
+	return plain, nil
+}
+
+// readLocalFile reads a file in the config directory, decrypting it if needed
+func readLocalFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openLocalData(data)
+}
+
+// writeLocalFile atomically replaces a file in the config directory, encrypting it
+// when encryption at rest is on
+func writeLocalFile(path string, data []byte) error {
+	data, err := sealLocalData(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// sessionAutoLock returns the idle lock period without reading the config, which
+// may itself need the unlocked identity
+func sessionAutoLock() (*Config, error) {
+	meta, err := loadStorageMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return &Config{AutoLockAfter: meta.AutoLockAfter}, nil
+	}
+	return LoadConfig()
+}
+
+// LocalEncryption returns the key source local files are encrypted with, or "" when
+// they are stored in plaintext
+func LocalEncryption() (string, error) {
+	meta, err := loadStorageMeta()
+	if err != nil || meta == nil {
+		return "", err
+	}
+	return meta.KeySource, nil
+}
+
+// SetLocalEncryption turns encryption at rest of the config, known keys and message
+// archive on (with the given key source) or off, rewriting the existing files
+func SetLocalEncryption(ctx context.Context, enable bool, source string) error {
+	current, err := loadStorageMeta()
+	if err != nil {
+		return err
+	}
+	if !enable && current == nil {
+		fmt.Println("Local files are not encrypted")
+		return nil
+	}
+	if enable && current != nil && current.KeySource == source {
+		fmt.Printf("Local files are already encrypted (key source: %s)\n", source)
+		return nil
+	}
+
+	// Read everything with the current settings before switching
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// Queued messages are sealed under the current settings and not rewritten
+	if queue, err := store.queued(ctx); err != nil {
+		return err
+	} else if len(queue) > 0 {
+		return fmt.Errorf("%d message(s) are waiting in the outbox; send them with 'clsp outbox --flush' first", len(queue))
+	}
+	rows, err := store.envelopes(ctx)
+	if err != nil {
+		return err
+	}
+	sent, err := store.allSentMessages(ctx)
+	if err != nil {
+		return err
+	}
+	scheduled, err := store.scheduledMessages(ctx, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	var meta *storageMeta
+	var key []byte
+	if enable {
+		if meta, key, err = newStorageKey(source); err != nil {
+			return err
+		}
+		meta.AutoLockAfter = config.AutoLockAfter
+		if err := saveStorageMeta(meta); err != nil {
+			return err
+		}
+	} else if err := os.Remove(paths.GetConfigPath(storageMetaFile)); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", storageMetaFile, err)
+	}
+	storageKey = key
+
+	// A backup in the old format would defeat the switch
+	os.Remove(paths.GetConfigPath(configFile) + backupSuffix)
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	if _, err := os.Stat(knownKeysPath()); err == nil {
+		if err := SaveKnownKeys(known); err != nil {
+			return err
+		}
+	}
+	if err := store.rewriteSent(ctx, sent); err != nil {
+		return err
+	}
+	if err := store.rewriteEnvelopes(ctx, rows); err != nil {
+		return err
+	}
+	if err := store.rewriteScheduled(ctx, scheduled); err != nil {
+		return err
+	}
+	if current != nil && current.KeySource == KeySourceKeyring && source != KeySourceKeyring {
+		if err := keyringDelete(); err != nil {
+			fmt.Printf("Warning: failed to remove the old storage key from the OS keyring: %v\n", err)
+		}
+	}
+
+	if enable {
+		fmt.Printf("Local configuration and message archive are now encrypted (key source: %s)\n", source)
+	} else {
+		fmt.Println("Local configuration and message archive are now stored unencrypted")
+	}
+	return nil
+}
+
+// newStorageKey generates a storage key and stores it with the given source
+func newStorageKey(source string) (*storageMeta, []byte, error) {
+	key := make([]byte, crypto.AESKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate storage key: %v", err)
+	}
+
+	meta := &storageMeta{KeySource: source}
+	switch source {
+	case KeySourceIdentity:
+		encrypted, err := crypto.IsPrivateKeyEncrypted(paths.GetKeyPath("private.key"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load private key: %v", err)
+		}
+		if !encrypted {
+			return nil, nil, fmt.Errorf("your private key has no passphrase, so it cannot protect local files; set one with 'clsp passphrase' or use --key-source keyring")
+		}
+		identity, err := loadIdentityKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		if meta.WrappedKey, err = crypto.SealLocal(identity, key); err != nil {
+			return nil, nil, err
+		}
+	case KeySourceKeyring:
+		if err := keyringSet(key); err != nil {
+			return nil, nil, fmt.Errorf("failed to store storage key in the OS keyring: %v", err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown key source %q (use identity or keyring)", source)
+	}
+	return meta, key, nil
+}
+
+// keyringAccount names the storage key in the OS keyring; the config directory keeps
+// several installations (such as different $HOMEs) apart
+func keyringAccount() string {
+	return paths.GetConfigPath("")
+}
+
+// keyringSet stores the storage key in the OS keyring
+func keyringSet(key []byte) error {
+	secret := hex.EncodeToString(key)
+	switch runtime.GOOS {
+	case "darwin":
+		// Passed on stdin so the key never shows up in the process list
+		command := fmt.Sprintf("add-generic-password -U -s clsp -a %q -w %s\n", keyringAccount(), secret)
+		return runKeyringTool(strings.NewReader(command), "security", "-i")
+	case "linux", "freebsd", "openbsd":
+		return runKeyringTool(strings.NewReader(secret), "secret-tool", "store", "--label=clsp storage key", "service", "clsp", "account", keyringAccount())
+	default:
+		return fmt.Errorf("the OS keyring is not supported on %s", runtime.GOOS)
+	}
+}
+
+// keyringGet reads the storage key from the OS keyring
+func keyringGet() ([]byte, error) {
+	var out []byte
+	var err error
+	switch runtime.GOOS {
+	case "darwin":
+		out, err = exec.Command("security", "find-generic-password", "-s", "clsp", "-a", keyringAccount(), "-w").Output()
+	case "linux", "freebsd", "openbsd":
+		out, err = exec.Command("secret-tool", "lookup", "service", "clsp", "account", keyringAccount()).Output()
+	default:
+		return nil, fmt.Errorf("the OS keyring is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage key not found: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil || len(key) != crypto.AESKeySize {
+		return nil, fmt.Errorf("storage key in the OS keyring is malformed")
+	}
+	return key, nil
+}
+
+// keyringDelete removes the storage key from the OS keyring
+func keyringDelete() error {
+	switch runtime.GOOS {
+	case "darwin":
+		return runKeyringTool(nil, "security", "delete-generic-password", "-s", "clsp", "-a", keyringAccount())
+	case "linux", "freebsd", "openbsd":
+		return runKeyringTool(nil, "secret-tool", "clear", "service", "clsp", "account", keyringAccount())
+	default:
+		return fmt.Errorf("the OS keyring is not supported on %s", runtime.GOOS)
+	}
+}
+
+// runKeyringTool runs a keyring helper, folding its error output into the error
+func runKeyringTool(stdin io.Reader, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %v (%s)", name, err, msg)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
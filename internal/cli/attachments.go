@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+	"golang.org/x/term"
+)
+
+// attachFile prepares a file for sending. It is encrypted and uploaded to the hub in
+// chunks, so its size is not limited by memory; hubs that predate uploads get it
+// inline in the message instead.
+func attachFile(ctx context.Context, client *clspclient.Client, path string) (*crypto.Attachment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("attachment %s is not a regular file", path)
+	}
+
+	filename := filepath.Base(path)
+	client.Progress = progressPrinter("Uploading " + filename)
+	attachment, err := client.UploadAttachment(ctx, f, info.Size(), filename, "")
+	client.Progress = nil
+	if errors.Is(err, clspclient.ErrAttachmentsUnsupported) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment: %v", err)
+		}
+		// The content type and digest are filled in when the message is sent
+		return &crypto.Attachment{
+			Filename: filename,
+			Size:     int64(len(content)),
+			Content:  content,
+			ModTime:  info.ModTime().Unix(),
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload attachment: %w", err)
+	}
+	attachment.ModTime = info.ModTime().Unix()
+	return attachment, nil
+}
+
+// checkAttachment checks a file to attach against the hub's attachment size limit
+// without uploading it, for dry runs
+func checkAttachment(ctx context.Context, client *clspclient.Client, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read attachment: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("attachment %s is not a regular file", path)
+	}
+	health, err := client.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	encryptedSize := crypto.EncryptedAttachmentSize(info.Size(), crypto.AttachmentChunkSize)
+	if limit := health.Config.MaxAttachmentSize; limit > 0 && encryptedSize > limit {
+		return fmt.Errorf("attachment exceeds the hub limit of %d bytes", limit)
+	}
+	return nil
+}
+
+// progressPrinter returns a transfer progress callback that redraws one line on a
+// terminal, and nil (no output) otherwise
+func progressPrinter(label string) func(done, total int64) {
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	return func(done, total int64) {
+		percent := int64(100)
+		if total > 0 {
+			percent = done * 100 / total
+		}
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%% (%s of %s)", label, percent, formatSize(done), formatSize(total))
+		if done >= total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// SaveAttachment decrypts the attachment of a received message and writes it to
+// outPath, or to a file named after the attachment in the current directory. Uploaded
+// attachments are streamed from the hub and written only once complete and verified
+// against the sender's SHA-256 digest. The file gets the modification time the
+// sender's copy had.
+func SaveAttachment(ctx context.Context, messageID, outPath string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	msg, err := store.Message(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		// Not listed yet; pick up new messages from the hub
+		if err := syncMessages(ctx, config, store, keys, false); err != nil {
+			return fmt.Errorf("message %s not found locally and sync failed: %v", messageID, err)
+		}
+		if msg, err = store.Message(ctx, messageID); err != nil {
+			return err
+		}
+		if msg == nil {
+			return fmt.Errorf("message %s not found", messageID)
+		}
+	}
+	if err := store.LoadSavedKeys(ctx, keys); err != nil {
+		return err
+	}
+	signatures, err := newSignatureChecker(ctx, config, keys.Identity, true)
+	if err != nil {
+		return err
+	}
+	signature := signatures.check(msg)
+	signatures.save()
+	if signature == SignatureInvalid {
+		return fmt.Errorf("message %s does not carry a valid signature of its sender; not saving its attachment", messageID)
+	}
+	if _, err := crypto.DecryptMessage(keys, msg); err != nil {
+		return fmt.Errorf("failed to decrypt message %s: %v", messageID, err)
+	}
+	attachment := msg.Attachment
+	if attachment == nil {
+		return fmt.Errorf("message %s has no attachment", messageID)
+	}
+
+	// The file name comes from the sender, so never let it choose the directory
+	if outPath == "" {
+		outPath = filepath.Base(filepath.Clean("/" + attachment.Filename))
+		if outPath == "/" || outPath == "." {
+			outPath = "attachment"
+		}
+	}
+	if _, err := os.Stat(outPath); err == nil {
+		return fmt.Errorf("%s already exists; choose another name with --out", outPath)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), ".clsp-download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", outPath, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	client := hubClient(config, privateKey)
+	client.Progress = progressPrinter("Downloading " + safeLine(attachment.Filename, renderOptionsFromConfig(config)))
+	if err := client.DownloadAttachment(ctx, attachment, tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download attachment: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", outPath, err)
+	}
+	if attachment.ModTime != 0 {
+		modTime := time.Unix(attachment.ModTime, 0)
+		if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+			fmt.Fprintf(notices(), "Warning: could not set the modification time of %s: %v\n", outPath, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), outPath); err != nil {
+		return fmt.Errorf("failed to write %s: %v", outPath, err)
+	}
+
+	if len(attachment.SHA256) > 0 {
+		fmt.Printf("Saved %s (%d bytes, SHA-256 %x verified)\n", outPath, attachment.Size, attachment.SHA256)
+		return nil
+	}
+	fmt.Printf("Saved %s (%d bytes)\n", outPath, attachment.Size)
+	return nil
+}
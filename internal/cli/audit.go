@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// fetchDirectory downloads every active user from the hub
+func fetchDirectory(ctx context.Context, config *Config) ([]User, error) {
+	return hubClient(config, nil).Users(ctx, clspclient.UserQuery{})
+}
+
+// keyFingerprint returns the fingerprint of a PEM public key
+func keyFingerprint(publicKeyPEM string) (string, error) {
+	publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM))
+	if err != nil {
+		return "", err
+	}
+	return crypto.Fingerprint(publicKey)
+}
+
+// VerifyAllKeys audits every contact in the hub directory against the locally pinned
+// keys and reports new contacts, key changes and contacts that left the directory.
+// Keys for new contacts are pinned; changed keys keep their old pin unless the user
+// is listed in repin.
+func VerifyAllKeys(ctx context.Context, repin []string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return err
+	}
+	users, err := fetchDirectory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	repinIDs := make(map[string]bool)
+	for _, r := range repin {
+		if id, ok := config.UserAliases[r]; ok {
+			r = id
+		}
+		repinIDs[r] = true
+		for _, u := range users {
+			if u.DisplayName == r {
+				repinIDs[u.ID] = true
+			}
+		}
+	}
+
+	opts := renderOptionsFromConfig(config)
+	now := time.Now()
+	var added, changed, rotated, repinned, unchanged, removed, malformed []string
+	seen := make(map[string]bool)
+
+	for _, u := range users {
+		if u.ID == config.UserID {
+			continue
+		}
+		seen[u.ID] = true
+		label := fmt.Sprintf("%s (%s)", safeLine(u.DisplayName, opts), safeLine(u.ID, opts))
+
+		fingerprint, err := keyFingerprint(u.PublicKey)
+		if err != nil {
+			malformed = append(malformed, label)
+			continue
+		}
+
+		pin, ok := known.Keys[u.ID]
+		switch {
+		case !ok:
+			known.Keys[u.ID] = KnownKey{
+				DisplayName: u.DisplayName,
+				Fingerprint: fingerprint,
+				PublicKey:   u.PublicKey,
+				FirstSeen:   now,
+				LastChecked: now,
+			}
+			added = append(added, fmt.Sprintf("%s\n      %s", label, fingerprint))
+			continue
+		case pin.Fingerprint != fingerprint && known.followRotation(&u, fingerprint):
+			rotated = append(rotated, fmt.Sprintf("%s\n      was %s\n      now %s", label, pin.Fingerprint, fingerprint))
+			pin = known.Keys[u.ID]
+		case pin.Fingerprint != fingerprint && repinIDs[u.ID]:
+			repinned = append(repinned, fmt.Sprintf("%s\n      was %s\n      now %s", label, pin.Fingerprint, fingerprint))
+			pin.Fingerprint = fingerprint
+			pin.PublicKey = u.PublicKey
+			pin.SigningKey = ""
+			pin.PreviousKeys = nil
+			pin.ChangedAt = nil
+			pin.VerifiedAt = nil
+		case pin.Fingerprint != fingerprint:
+			since := "first detected now"
+			if pin.ChangedAt != nil {
+				since = "first detected " + pin.ChangedAt.Format(time.RFC3339)
+			} else {
+				pin.ChangedAt = &now
+			}
+			changed = append(changed, fmt.Sprintf("%s (%s)\n      pinned  %s\n      offered %s", label, since, pin.Fingerprint, fingerprint))
+		default:
+			pin.ChangedAt = nil
+			unchanged = append(unchanged, label)
+		}
+		if pin.RemovedAt != nil {
+			pin.RemovedAt = nil
+		}
+		pin.DisplayName = u.DisplayName
+		pin.LastChecked = now
+		known.Keys[u.ID] = pin
+	}
+
+	// Pinned contacts missing from the directory were deactivated or removed by the hub
+	for id, pin := range known.Keys {
+		if seen[id] {
+			continue
+		}
+		if pin.RemovedAt == nil {
+			pin.RemovedAt = &now
+			known.Keys[id] = pin
+		}
+		removed = append(removed, fmt.Sprintf("%s (%s), missing since %s", safeLine(pin.DisplayName, opts), id, pin.RemovedAt.Format(time.RFC3339)))
+	}
+
+	if known.LastAudit.IsZero() {
+		fmt.Println("Key audit (first audit; all contacts are pinned now)")
+	} else {
+		fmt.Printf("Key audit (previous audit %s)\n", known.LastAudit.Format(time.RFC3339))
+	}
+	printAuditSection("KEY CHANGED (not trusted; compare fingerprints out-of-band, then use --repin)", changed)
+	printAuditSection("Key rotated (signed by the pinned key; re-pinned)", rotated)
+	printAuditSection("Re-pinned", repinned)
+	printAuditSection("Removed from directory (deactivated or deleted)", removed)
+	printAuditSection("Invalid keys offered by the hub", malformed)
+	printAuditSection("New contacts pinned", added)
+	fmt.Printf("\n%d unchanged, %d new, %d changed, %d rotated, %d removed\n", len(unchanged), len(added), len(changed), len(rotated), len(removed))
+
+	known.LastAudit = now
+	if err := SaveKnownKeys(known); err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("%d contact key(s) changed since they were pinned", len(changed))
+	}
+	return nil
+}
+
+// printAuditSection prints a titled list of audit findings, skipping empty sections
+func printAuditSection(title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	sort.Strings(items)
+	fmt.Printf("\n%s:\n", title)
+	for _, item := range items {
+		fmt.Printf("  %s\n", item)
+	}
+}
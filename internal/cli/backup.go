@@ -0,0 +1,230 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// backupPEMType marks an identity backup sealed with its own passphrase
+const backupPEMType = "CLSP IDENTITY BACKUP"
+
+// backupVersion is the format of identityBackup
+const backupVersion = 1
+
+// backupKeyFiles are the key files copied as they are: each is protected by the
+// identity key or its passphrase, not by this device
+var backupKeyFiles = []string{"private.key", "public.pem", signingKeyFile, signingPublicKeyFile, retiredKeysFile, "prekeys", recoveryKeyFile}
+
+// backupConfigFiles are the config files copied in plaintext, since encryption at
+// rest may use a key that stays on this device
+var backupConfigFiles = []string{configFile, "known_keys.json"}
+
+// identityBackup is the content of a backup file: everything needed to use the
+// identity on another device, apart from the message history
+type identityBackup struct {
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	HubURL      string    `json:"hub_url"`
+	// Keys and Config map file names in the keys and config directories to contents
+	Keys   map[string][]byte `json:"keys"`
+	Config map[string][]byte `json:"config"`
+}
+
+// readBackupPassphrase asks for a backup passphrase, twice when choosing one
+func readBackupPassphrase(confirm bool) ([]byte, error) {
+	passphrase, err := readPassphrase("Backup passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the backup passphrase cannot be empty")
+	}
+	if confirm {
+		again, err := readPassphrase("Confirm backup passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(passphrase) != string(again) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// collectBackup gathers the identity's key and config files
+func collectBackup(config *Config) (*identityBackup, error) {
+	backup := &identityBackup{
+		Version:     backupVersion,
+		CreatedAt:   time.Now(),
+		UserID:      config.UserID,
+		DisplayName: config.DisplayName,
+		HubURL:      config.HubURL,
+		Keys:        make(map[string][]byte),
+		Config:      make(map[string][]byte),
+	}
+	for _, file := range backupKeyFiles {
+		data, err := os.ReadFile(paths.GetKeyPath(file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		backup.Keys[file] = data
+	}
+	if backup.Keys["private.key"] == nil {
+		return nil, fmt.Errorf("your private key is missing; there is no identity to back up")
+	}
+	for _, file := range backupConfigFiles {
+		data, err := readLocalFile(paths.GetConfigPath(file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		backup.Config[file] = data
+	}
+	return backup, nil
+}
+
+// Backup writes the identity's keys, configuration, aliases and pinned contact keys
+// to path, encrypted with a passphrase chosen for the backup
+func Backup(path string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.UserID == "" {
+		return fmt.Errorf("no identity to back up; run 'clsp init' first")
+	}
+
+	backup, err := collectBackup(config)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup: %v", err)
+	}
+	fmt.Println("The backup is encrypted with its own passphrase, needed to restore it.")
+	passphrase, err := readBackupPassphrase(true)
+	if err != nil {
+		return err
+	}
+	sealed, err := crypto.SealWithPassphrase(backupPEMType, data, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	fmt.Printf("Identity %s backed up to %s\n", config.DisplayName, path)
+	if encrypted, err := crypto.IsPrivateKeyEncrypted(paths.GetKeyPath("private.key")); err == nil && encrypted {
+		fmt.Println("Your private key stays protected by its own passphrase inside the backup.")
+	}
+	fmt.Println("Message history is not included. Restore on another device with 'clsp restore'.")
+	return nil
+}
+
+// parseBackup reads an identityBackup once its encryption is removed
+func parseBackup(data []byte) (*identityBackup, error) {
+	var backup identityBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to parse backup: %v", err)
+	}
+	if backup.Version > backupVersion {
+		return nil, fmt.Errorf("the backup was made by a newer clsp (format %d); upgrade to restore it", backup.Version)
+	}
+	if backup.Keys["private.key"] == nil || backup.Config[configFile] == nil {
+		return nil, fmt.Errorf("the backup has no identity")
+	}
+	return &backup, nil
+}
+
+// Restore installs the identity from a backup written by Backup and announces it to
+// the hub again, replacing any identity on this device after confirmation
+func Restore(ctx context.Context, path string) error {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %v", err)
+	}
+	passphrase, err := readBackupPassphrase(false)
+	if err != nil {
+		return err
+	}
+	data, err := crypto.OpenWithPassphrase(backupPEMType, sealed, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %v", err)
+	}
+	backup, err := parseBackup(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backup of %s (%s), made %s\n", backup.DisplayName, backup.UserID, backup.CreatedAt.Local().Format("2006-01-02 15:04"))
+	return installBackup(ctx, backup)
+}
+
+// installBackup writes the files of a backup, replacing any identity on this device
+// after confirmation, and announces the identity to the hub again
+func installBackup(ctx context.Context, backup *identityBackup) error {
+	if IsInstalled() {
+		if config, err := LoadConfig(); err == nil && config.UserID != "" {
+			if config.UserID == backup.UserID {
+				fmt.Print("This identity is already set up here. Replace its keys and configuration with the backup? (y/N): ")
+			} else {
+				fmt.Printf("Another identity (%s) is set up here. Replace it with the backup? (y/N): ", config.DisplayName)
+			}
+			var response string
+			fmt.Scanln(&response)
+			if response != "y" && response != "Y" {
+				return fmt.Errorf("restore cancelled")
+			}
+			if err := cleanupOldConfig(ctx); err != nil {
+				return fmt.Errorf("failed to clean up old configuration: %v", err)
+			}
+		}
+	}
+
+	if err := paths.EnsureConfigDir(); err != nil {
+		return err
+	}
+	// Keys go first so a config never references a missing key
+	for file, content := range backup.Keys {
+		if err := os.WriteFile(paths.GetKeyPath(filepath.Base(file)), content, 0600); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", file, err)
+		}
+	}
+	for file, content := range backup.Config {
+		if file == configFile {
+			continue
+		}
+		if err := writeLocalFile(paths.GetConfigPath(filepath.Base(file)), content); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", file, err)
+		}
+	}
+	if err := writeLocalFile(paths.GetConfigPath(configFile), backup.Config[configFile]); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", configFile, err)
+	}
+	fmt.Println("Identity restored")
+
+	// Announcing the identity again checks the key against the hub and publishes a
+	// prekey held by this device
+	if err := ResumeInit(ctx); err != nil {
+		fmt.Println("Run 'clsp init --resume' to announce the identity to the hub once it is reachable.")
+		return err
+	}
+	fmt.Println("\nLocal encryption at rest is not part of the backup; turn it on again with")
+	fmt.Println("'clsp config --encrypt on' if you used it.")
+	return nil
+}
@@ -1,19 +1,20 @@
 package cli
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/mattd/clsp/internal/crypto"
 	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
 )
 
 const (
@@ -22,80 +23,51 @@ const (
 )
 
 // User represents a CLSP user
-type User struct {
-	ID          string `json:"id"`
-	DisplayName string `json:"display_name"`
-	PublicKey   string `json:"public_key"`
-}
+type User = clspclient.User
+
+// ClockSkewWarnThreshold is the clock difference to the hub above which a warning is shown
+const ClockSkewWarnThreshold = 30 * time.Second
 
 // HubInfo represents the hub's configuration and status
-type HubInfo struct {
-	Status string
-	Config struct {
-		MessageExpiry time.Duration `json:"message_expiry"`
-		UseTLS        bool          `json:"use_tls"`
-		TLSCertPath   string        `json:"tls_cert_path,omitempty"`
-		RateLimit     int           `json:"rate_limit"`
-		HubTimeout    time.Duration `json:"hub_timeout"`
-		HubRetryCount int           `json:"hub_retry_count"`
-		HubRetryDelay time.Duration `json:"hub_retry_delay"`
-	}
-}
+type HubInfo = clspclient.HubInfo
 
-// CheckHubHealth checks if the hub is available and returns its configuration
-func CheckHubHealth(hubURL string) (*HubInfo, error) {
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
+// CheckHubHealth checks if the hub is available and returns its configuration,
+// warning when the local clock differs noticeably from the hub's. A check made by a
+// recent command is reused; see clspclient.Client.CachedHealth.
+func CheckHubHealth(ctx context.Context, hubURL string) (*HubInfo, error) {
+	return warnClockSkew(newClient(hubURL, "", nil).CachedHealth(ctx))
+}
 
-	resp, err := client.Get(hubURL + "/health")
+// warnClockSkew passes on the result of a health check, warning when the local
+// clock differs noticeably from the hub's
+func warnClockSkew(info *HubInfo, err error) (*HubInfo, error) {
 	if err != nil {
-		return nil, fmt.Errorf("hub not reachable: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("hub returned status %d", resp.StatusCode)
-	}
-
-	var info HubInfo
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return nil, fmt.Errorf("failed to parse hub response: %v", err)
+	if info.ClockSkew > ClockSkewWarnThreshold || info.ClockSkew < -ClockSkewWarnThreshold {
+		fmt.Fprintf(os.Stderr, "Warning: your clock differs from the hub's by %v; timestamps and expiries may be wrong\n", info.ClockSkew.Round(time.Second))
 	}
-
-	return &info, nil
+	return info, nil
 }
 
 // CheckUsername checks if a username is available on the hub
-func CheckUsername(hubURL, username string) (bool, error) {
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	resp, err := client.Get(fmt.Sprintf("%s/check-username?username=%s", hubURL, url.QueryEscape(username)))
-	if err != nil {
-		return false, fmt.Errorf("failed to check username: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("hub returned status %d", resp.StatusCode)
-	}
-
-	var result struct {
-		Available bool `json:"available"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return false, fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	return result.Available, nil
+func CheckUsername(ctx context.Context, hubURL, username string) (bool, error) {
+	return clspclient.New(hubURL, "", nil).CheckUsername(ctx, username)
 }
 
-// InitUser initializes a new user identity interactively
-func InitUser() error {
+// InitUser initializes a new user identity interactively. With an invite code the
+// identity provisioned for it by the hub operator is claimed instead of choosing a name.
+func InitUser(ctx context.Context, inviteCode string) error {
 	// Check if user is already initialized
 	config, err := LoadConfig()
+	if err == nil && config.UserID != "" && config.RegistrationPending {
+		fmt.Print("A previous initialization did not finish registering. Resume it? (Y/n): ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "n" && response != "N" {
+			return ResumeInit(ctx)
+		}
+	}
 	if err == nil && config.UserID != "" {
 		fmt.Print("A user is already initialized. Do you want to reinitialize? (y/N): ")
 		var response string
@@ -106,7 +78,7 @@ func InitUser() error {
 
 		// Clean up old configuration
 		fmt.Println("Cleaning up old configuration...")
-		if err := cleanupOldConfig(); err != nil {
+		if err := cleanupOldConfig(ctx); err != nil {
 			return fmt.Errorf("failed to clean up old configuration: %v", err)
 		}
 	}
@@ -127,37 +99,49 @@ func InitUser() error {
 
 	// Check hub health
 	fmt.Println("Checking hub connection...")
-	hubInfo, err := CheckHubHealth(hubURL)
+	hubInfo, err := CheckHubHealth(ctx, hubURL)
 	if err != nil {
 		return fmt.Errorf("hub not available: %v", err)
 	}
 	fmt.Println("Hub connection successful!")
 
-	// Show hub configuration
-	fmt.Printf("\nHub Configuration:\n")
-	fmt.Printf("Message Expiry: %v\n", hubInfo.Config.MessageExpiry)
-	fmt.Printf("Rate Limit: %d messages/minute\n", hubInfo.Config.RateLimit)
-	if hubInfo.Config.UseTLS {
-		fmt.Println("TLS: Enabled")
-		if hubInfo.Config.TLSCertPath != "" {
-			fmt.Printf("TLS Certificate: %s\n", hubInfo.Config.TLSCertPath)
-		}
-	} else {
-		fmt.Println("TLS: Disabled")
+	fmt.Println()
+	printHubConfig(hubInfo)
+	fmt.Println("(Run 'clsp hub info' and 'clsp hub limits' for details)")
+
+	if inviteCode == "" && hubInfo.Config.RequireInvite {
+		return fmt.Errorf("this hub only registers invited users; ask its operator for a code and run 'clsp init --invite <code>'")
 	}
 
-	// Get display name
+	// Get display name, or take the one reserved for the invite
 	var displayName string
-	for {
+	var invite *Invite
+	if inviteCode != "" {
+		invite, err = lookupInvite(ctx, hubURL, inviteCode, hubInfo.Config.HubTimeout)
+		if err != nil {
+			return err
+		}
+		if invite.UserID == "" {
+			// The code admits a new account without reserving an identity
+			fmt.Println("\nInvite accepted")
+			invite = nil
+		} else {
+			displayName = invite.DisplayName
+			fmt.Printf("\nInvite accepted for display name: %s\n", displayName)
+		}
+	}
+	for invite == nil {
 		fmt.Print("\nChoose a display name: ")
-		fmt.Scanln(&displayName)
+		if _, err := fmt.Scanln(&displayName); err == io.EOF {
+			return fmt.Errorf("no display name provided")
+		}
 		if displayName == "" {
 			fmt.Println("Display name cannot be empty")
 			continue
 		}
 
 		// Check if username is available
-		available, err := CheckUsername(hubURL, displayName)
+		available, err := CheckUsername(ctx, hubURL, displayName)
 		if err != nil {
 			return fmt.Errorf("failed to check username: %v", err)
 		}
@@ -177,68 +161,88 @@ func InitUser() error {
 
 	// Create user ID
 	userID := uuid.New().String()
-
-	// Save local configuration
-	config = &Config{
-		HubURL:       hubURL,
-		UserID:       userID,
-		DisplayName:  displayName,
-		UserAliases:  make(map[string]string),
-		LastSyncTime: time.Now(),
+	if invite != nil {
+		userID = invite.UserID
 	}
 
-	if err := SaveConfig(config); err != nil {
-		return fmt.Errorf("failed to save config: %v", err)
+	// Optionally protect the private key with a passphrase
+	passphrase, err := readPassphrase("Passphrase to protect your private key (leave empty for none): ")
+	if err != nil {
+		passphrase = nil
 	}
 
-	// Save private key
-	if err := crypto.SavePrivateKey(privateKey, paths.GetKeyPath("private.key")); err != nil {
+	// Save keys first so a config never references a missing key
+	if len(passphrase) > 0 {
+		err = crypto.SaveEncryptedPrivateKey(privateKey, paths.GetKeyPath("private.key"), passphrase)
+	} else {
+		err = crypto.SavePrivateKey(privateKey, paths.GetKeyPath("private.key"))
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save private key: %v", err)
 	}
-
-	// Register with hub
-	fmt.Println("Registering with hub...")
-	user := &User{
-		ID:          userID,
-		DisplayName: displayName,
-		PublicKey:   string(publicKeyPEM),
+	if err := crypto.SavePublicKey(&privateKey.PublicKey, paths.GetKeyPath("public.pem")); err != nil {
+		return fmt.Errorf("failed to save public key: %v", err)
 	}
-	reqBody, err := json.Marshal(user)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %v", err)
+	if _, err := createSigningKey(privateKey); err != nil {
+		return err
 	}
 
-	client := &http.Client{
-		Timeout: hubInfo.Config.HubTimeout,
+	// Save local configuration, marked pending until the hub accepts the registration
+	config = &Config{
+		HubURL:              hubURL,
+		UserID:              userID,
+		DisplayName:         displayName,
+		UserAliases:         make(map[string]string),
+		LastSyncTime:        time.Now(),
+		RegistrationPending: true,
+		InviteCode:          inviteCode,
 	}
-	resp, err := client.Post(hubURL+"/register", "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to register with hub: %v", err)
+
+	if err := SaveConfig(config); err != nil {
+		os.Remove(paths.GetKeyPath("private.key"))
+		return fmt.Errorf("failed to save config: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("hub returned status %d: %s", resp.StatusCode, string(body))
+	// Register with hub
+	fmt.Println("Registering with hub...")
+	if err := completeRegistration(ctx, config, privateKey, publicKeyPEM, hubInfo); err != nil {
+		fmt.Println("Your identity was saved locally but is not yet registered with the hub.")
+		fmt.Println("Run 'clsp init --resume' to retry registration with the same identity.")
+		return err
 	}
 
+	ensurePrekeys(ctx, config, privateKey)
+
 	fmt.Println("Registration successful!")
 	fmt.Printf("\nYour user ID: %s\n", userID)
 	fmt.Printf("Display name: %s\n", displayName)
+
+	offerRecovery(ctx, config, privateKey)
 	fmt.Println("\nYou can now start sending messages!")
 
 	return nil
 }
 
 // cleanupOldConfig removes old configuration files and keys
-func cleanupOldConfig() error {
-	// Remove old private key
-	if err := os.Remove(paths.GetKeyPath("private.key")); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove old private key: %v", err)
+func cleanupOldConfig(ctx context.Context) error {
+	// Files encrypted at rest would be unreadable once the old identity is gone, so
+	// decrypt them while it is still here; the new identity can encrypt them again
+	if source, err := LocalEncryption(); err == nil && source != "" {
+		if err := SetLocalEncryption(ctx, false, ""); err != nil {
+			return fmt.Errorf("failed to decrypt local files: %v", err)
+		}
+	}
+
+	// Remove old keys and any unlocked session
+	for _, file := range []string{"private.key", "public.pem", signingKeyFile, signingPublicKeyFile, retiredKeysFile, "prekeys", recoveryKeyFile} {
+		if err := os.Remove(paths.GetKeyPath(file)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old %s: %v", file, err)
+		}
 	}
+	stopKeyAgent()
 
 	// Remove old config files
-	configFiles := []string{"config.json", "user.json"}
+	configFiles := []string{configFile, configFile + backupSuffix, "user.json"}
 	for _, file := range configFiles {
 		if err := os.Remove(paths.GetConfigPath(file)); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("failed to remove old %s: %v", file, err)
@@ -248,242 +252,544 @@ func cleanupOldConfig() error {
 	return nil
 }
 
+// SendOptions holds optional settings for SendMessage
+type SendOptions struct {
+	// AttachmentPath is the path of a file to attach
+	AttachmentPath string
+	// AllowDuplicate skips hub-side duplicate suppression for intentional repeats
+	AllowDuplicate bool
+	// InReplyTo is the ID of the message this one answers (see ReplyMessage)
+	InReplyTo string
+	// DryRun has the hub validate the message without storing it; an attachment is
+	// only checked against the hub's size limit, not uploaded
+	DryRun bool
+	// Expiry, if set, has the hub and the recipient's client delete the message this
+	// long after it is sent, sooner than the hub's message expiry
+	Expiry time.Duration
+}
+
 // SendMessage sends an encrypted message to a recipient
-func SendMessage(recipient, message, attachmentPath string) error {
+func SendMessage(ctx context.Context, recipient, message string, opts SendOptions) error {
 	// Load config
 	config, err := LoadConfig()
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	// Get hub configuration to get timeout
-	hubInfo, err := CheckHubHealth(config.HubURL)
-	if err != nil {
-		return fmt.Errorf("failed to get hub configuration: %v", err)
+	// A running daemon sends plain messages with its unlocked key and open connection
+	if opts.AttachmentPath == "" && !opts.DryRun {
+		result, err := sendViaDaemon(ctx, recipient, message, opts)
+		if err == nil {
+			printSent(recipient, result)
+			return nil
+		}
+		if !errors.Is(err, errNoDaemon) {
+			return err
+		}
 	}
 
 	// Load private key
-	privateKey, err := crypto.LoadPrivateKey(paths.GetKeyPath("private.key"))
+	privateKey, err := loadIdentityKey()
 	if err != nil {
 		return fmt.Errorf("failed to load private key: %v", err)
 	}
 
-	// Get recipient's public key
-	client := &http.Client{
-		Timeout: hubInfo.Config.HubTimeout,
-	}
-	resp, err := client.Get(config.HubURL + "/users")
+	client := hubClient(config, privateKey)
+	sendOpts, err := prepareSend(ctx, config, client, opts)
 	if err != nil {
-		return fmt.Errorf("failed to get users: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	var users []User
-	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
-		return fmt.Errorf("failed to decode users: %v", err)
+	result, err := client.SendMessage(ctx, recipient, []byte(message), sendOpts)
+	if err != nil && opts.DryRun {
+		return fmt.Errorf("the hub would not accept the message: %v", err)
 	}
-
-	var recipientUser *User
-	for _, u := range users {
-		if u.DisplayName == recipient {
-			recipientUser = &u
-			break
+	if err != nil {
+		// Without the hub, a plain message goes to the outbox, addressed from the
+		// cached directory snapshot
+		if opts.AttachmentPath == "" && opts.InReplyTo == "" && opts.Expiry == 0 {
+			if _, healthErr := client.Health(ctx); healthErr != nil {
+				return queueOffline(ctx, config, client, recipient, message, opts.AllowDuplicate)
+			}
 		}
+		return err
 	}
-
-	if recipientUser == nil {
-		return fmt.Errorf("recipient not found: %s", recipient)
+	if opts.DryRun {
+		printDryRun(recipient, result, opts.AttachmentPath)
+		return nil
 	}
+	if store, err := openLocalStore(); err == nil {
+		sendQueued(ctx, config, privateKey, store)
+		sendScheduled(ctx, config, privateKey, store)
+		store.Close()
+	}
+	if !result.AlreadyDelivered() {
+		keepSent(ctx, config, privateKey, result.RecipientID, result.IDs, message, opts.InReplyTo, result.ExpiresAt)
+	}
+	printSent(recipient, result)
+	return nil
+}
 
-	// Load recipient's public key
-	recipientPublicKey, err := crypto.LoadPublicKeyFromPEM([]byte(recipientUser.PublicKey))
-	if err != nil {
-		return fmt.Errorf("failed to load recipient's public key: %v", err)
+// printSent reports a message sent to recipient
+func printSent(recipient string, result *clspclient.SendResult) {
+	ids := result.IDs
+	if result.AlreadyDelivered() {
+		fmt.Printf("Message already delivered to %s as %s; not sent again\n", recipient, ids[0])
+		fmt.Println("Use --allow-duplicate to send it anyway")
+		return
+	}
+	if result.Relayed {
+		fmt.Printf("Message queued for %s's hub\n", recipient)
+		fmt.Printf("Message ID: %s (delivery to users of other hubs is not tracked)\n", ids[0])
+	} else if len(ids) > 1 {
+		fmt.Printf("Message sent successfully to %s in %d parts\n", recipient, len(ids))
+		fmt.Printf("Message ID: %s (first part; check delivery with 'clsp status %s')\n", ids[0], ids[0])
+	} else {
+		fmt.Printf("Message sent successfully to %s\n", recipient)
+		fmt.Printf("Message ID: %s (check delivery with 'clsp status %s')\n", ids[0], ids[0])
 	}
+	if result.Escrowed {
+		fmt.Println("Escrowed: your organization's recovery key can also decrypt this message")
+	}
+	if result.ReceiptsDisabled {
+		fmt.Println("Receipts: disabled by the recipient; you will not see when it is delivered or read")
+	}
+	if result.Request {
+		fmt.Printf("Sent as a message request: %s reads it once they accept you\n", recipient)
+	}
+	if !result.ExpiresAt.IsZero() {
+		fmt.Printf("Expires: %s (then deleted from the hub and both devices)\n", result.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	}
+}
 
-	// Handle attachment if provided
-	var attachment *crypto.Attachment
-	if attachmentPath != "" {
-		content, err := os.ReadFile(attachmentPath)
-		if err != nil {
-			return fmt.Errorf("failed to read attachment: %v", err)
+// prepareSend turns opts into the options of client.SendMessage, checking the
+// recipient's key against the pinned one and uploading any attachment (or, for a dry
+// run, only checking its size)
+func prepareSend(ctx context.Context, config *Config, client *clspclient.Client, opts SendOptions) (clspclient.SendOptions, error) {
+	sendOpts := clspclient.SendOptions{
+		AllowDuplicate: opts.AllowDuplicate,
+		InReplyTo:      opts.InReplyTo,
+		DryRun:         opts.DryRun,
+		Expiry:         opts.Expiry,
+		CheckKey: func(recipient *User) error {
+			return checkPinnedKey(config, recipient)
+		},
+	}
+	var err error
+	if sendOpts.EscrowFingerprint, err = escrowFingerprint(ctx, config, client); err != nil {
+		return sendOpts, err
+	}
+	if opts.AttachmentPath != "" && opts.DryRun {
+		if err := checkAttachment(ctx, client, opts.AttachmentPath); err != nil {
+			return sendOpts, err
 		}
-
-		attachment = &crypto.Attachment{
-			Filename:    filepath.Base(attachmentPath),
-			ContentType: "application/octet-stream", // TODO: detect content type
-			Size:        int64(len(content)),
-			Content:     content,
+	} else if opts.AttachmentPath != "" {
+		if sendOpts.Attachment, err = attachFile(ctx, client, opts.AttachmentPath); err != nil {
+			return sendOpts, err
 		}
 	}
+	return sendOpts, nil
+}
 
-	// Encrypt message
-	msg, err := crypto.EncryptMessage(privateKey, recipientPublicKey, []byte(message), attachment)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt message: %v", err)
+// printDryRun reports what the hub said of a message sent with --dry-run
+func printDryRun(recipient string, result *clspclient.SendResult, attachmentPath string) {
+	if result.AlreadyDelivered() {
+		fmt.Printf("Dry run: an identical message was already delivered to %s as %s; it would not be sent again\n", recipient, result.IDs[0])
+		fmt.Println("Use --allow-duplicate to send it anyway")
+		return
 	}
+	if len(result.IDs) > 1 {
+		fmt.Printf("Dry run: the hub would accept the message to %s in %d parts; nothing was sent\n", recipient, len(result.IDs))
+	} else {
+		fmt.Printf("Dry run: the hub would accept the message to %s; nothing was sent\n", recipient)
+	}
+	if attachmentPath != "" {
+		fmt.Println("The attachment is within the hub's size limit (it was not uploaded)")
+	}
+	if result.ReceiptsDisabled {
+		fmt.Println("The recipient does not share receipts with you; you would not see when it is delivered or read")
+	}
+	if result.Request {
+		fmt.Println("It would arrive as a message request, read only once the recipient accepts you")
+	}
+	if q := result.Quota; q != nil && q.Limited() {
+		var left []string
+		for _, limit := range []struct {
+			remaining int64
+			text      string
+		}{
+			{q.HourlyMessages, "%d messages this hour"},
+			{q.DailyMessages, "%d messages today"},
+			{q.Burst, "%d messages at once"},
+		} {
+			if limit.remaining >= 0 {
+				left = append(left, fmt.Sprintf(limit.text, limit.remaining))
+			}
+		}
+		if q.HourlyBytes >= 0 {
+			left = append(left, formatSize(q.HourlyBytes)+" this hour")
+		}
+		if q.DailyBytes >= 0 {
+			left = append(left, formatSize(q.DailyBytes)+" today")
+		}
+		fmt.Printf("Your outbound quota allows %s\n", strings.Join(left, ", "))
+	}
+}
 
-	// Set message metadata
-	msg.ID = uuid.New().String()
-	msg.Sender = config.UserID
-	msg.Recipient = recipientUser.ID
-	msg.Timestamp = time.Now().Unix()
-	msg.Status = "sent"
+// fetchMessages retrieves received messages from the hub, newest first, paging
+// through the results until limit messages (zero for all) were collected. Only
+// messages stored at or after since are returned when it is set. Fetching never
+// marks messages read on the hub; see ReadMessages. The hub's clock at the start of
+// the fetch is returned for use as the next incremental sync point. The fetch is
+// signed with privateKey, since only the recipient may fetch.
+func fetchMessages(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, unreadOnly bool, limit int, since time.Time) ([]crypto.Message, time.Time, error) {
+	return hubClient(config, privateKey).FetchEnvelopes(ctx, clspclient.MessageQuery{
+		UnreadOnly: unreadOnly,
+		Limit:      limit,
+		Since:      since,
+	})
+}
 
-	// Send message to hub
-	reqBody, err := json.Marshal(msg)
+// syncMessages copies messages stored on the hub since the last sync into the local
+// store. Only a full sync advances LastSyncTime: an unread-only sync skips messages
+// already read elsewhere, which a later full sync must still pick up.
+func syncMessages(ctx context.Context, config *Config, store *localStore, keys *crypto.Keyring, unreadOnly bool) error {
+	fetched, syncedAt, err := fetchMessages(ctx, config, keys.Identity, unreadOnly, 0, config.LastSyncTime)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %v", err)
+		return err
 	}
-
-	resp, err = client.Post(config.HubURL+"/message", "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+	if err := store.Save(ctx, fetched, keys); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to send message: %s", string(body))
+	maybeAnnounceDevice(ctx, config, keys.Identity)
+	if unreadOnly {
+		return nil
 	}
-
-	fmt.Printf("Message sent successfully to %s\n", recipient)
-	return nil
+	config.LastSyncTime = syncedAt.Truncate(time.Second)
+	return SaveConfig(config)
 }
 
-// ListMessages lists received messages with optional filtering
-func ListMessages(unreadOnly bool, limit int, search string) error {
+// ListMessages lists received messages with optional filtering. By default new
+// messages are synced from the hub into the local store and the whole local
+// history is listed; ListLocal works offline and ListRemote shows only the hub.
+func ListMessages(ctx context.Context, unreadOnly bool, limit int, search string, source ListSource) error {
 	// Load config
 	config, err := LoadConfig()
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	// Get hub configuration to get timeout
-	hubInfo, err := CheckHubHealth(config.HubURL)
+	store, err := openLocalStore()
 	if err != nil {
-		return fmt.Errorf("failed to get hub configuration: %v", err)
+		return err
 	}
+	defer store.Close()
 
-	// Build query parameters
-	params := url.Values{}
-	params.Set("user_id", config.UserID)
-	if unreadOnly {
-		params.Set("unread", "true")
+	// Load private key and prekeys
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
 	}
-	if limit > 0 {
-		params.Set("limit", fmt.Sprintf("%d", limit))
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
 	}
-	if search != "" {
-		params.Set("search", search)
+	// Messages past the expiry their sender set are deleted before anything is shown
+	if err := store.purgeExpired(ctx, crypto.LocalMACKey(privateKey)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
 
-	// Get messages from hub
-	client := &http.Client{
-		Timeout: hubInfo.Config.HubTimeout,
+	var messages []crypto.Message
+	switch source {
+	case ListRemote:
+		// The hub cannot search content, so a search looks through everything it holds
+		fetchLimit := limit
+		if search != "" {
+			fetchLimit = 0
+		}
+		messages, _, err = fetchMessages(ctx, config, privateKey, unreadOnly, fetchLimit, time.Time{})
+		if err != nil {
+			return err
+		}
+		if err := store.Save(ctx, messages, keys); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	default:
+		if source == ListMerged {
+			if err := syncMessages(ctx, config, store, keys, unreadOnly); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not sync with the hub (%v); showing local history\n", err)
+			} else {
+				sendQueued(ctx, config, privateKey, store)
+				sendScheduled(ctx, config, privateKey, store)
+				sendPendingReads(ctx, config, privateKey, store)
+				refreshDirectory(ctx, config)
+				reportRequests(ctx, config, privateKey)
+			}
+		}
+		messages, err = store.Messages(ctx, unreadOnly)
+		if err != nil {
+			return err
+		}
+		if err := store.LoadSavedKeys(ctx, keys); err != nil {
+			return err
+		}
+	}
+	if source != ListLocal {
+		ensurePrekeys(ctx, config, privateKey)
 	}
 
-	resp, err := client.Get(fmt.Sprintf("%s/messages?%s", config.HubURL, params.Encode()))
+	// Check who signed each message, decrypt it, then put split messages back together
+	received, err := openReceived(ctx, config, keys, messages, source != ListLocal)
 	if err != nil {
-		return fmt.Errorf("failed to get messages: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
+	opts := renderOptionsFromConfig(config)
 
-	var messages []crypto.Message
-	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
-		return fmt.Errorf("failed to decode messages: %v", err)
+	// Messages are searched and limited here, since only the client can read the content
+	shown, screened, err := screenReceived(ctx, config, store, joinParts(received))
+	if err != nil {
+		return err
+	}
+	reportScreened(screened)
+	if search != "" {
+		if shown, err = searchContent(ctx, shown, search); err != nil {
+			return err
+		}
+	}
+	if limit > 0 && len(shown) > limit {
+		shown = shown[:limit]
 	}
 
-	// Load private key
-	privateKey, err := crypto.LoadPrivateKey(paths.GetKeyPath("private.key"))
-	if err != nil {
-		return fmt.Errorf("failed to load private key: %v", err)
+	var shownIDs []string
+	if JSONOutput {
+		out := make([]MessageJSON, 0, len(shown))
+		for _, r := range shown {
+			out = append(out, messageJSON(r))
+			shownIDs = append(shownIDs, r.msg.ID)
+			shownIDs = append(shownIDs, r.ids...)
+		}
+		if err := printJSON(out); err != nil {
+			return err
+		}
+		shown = nil
 	}
 
-	// Decrypt and display messages
+	// Display messages; everything from the hub or sender is untrusted terminal input
+	for _, r := range shown {
+		shownIDs = append(shownIDs, r.msg.ID)
+		shownIDs = append(shownIDs, r.ids...)
+		printReceived(r, opts)
+	}
+
+	// A full listing marks what it showed as read locally; the hub, and with it the
+	// sender, only learns of reads through 'clsp read'
+	if !unreadOnly {
+		if err := store.MarkRead(ctx, shownIDs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openReceived checks who signed each message and decrypts it; online allows looking
+// up senders' keys on the hub. Messages that fail to decrypt are reported and skipped.
+func openReceived(ctx context.Context, config *Config, keys *crypto.Keyring, messages []crypto.Message, online bool) ([]receivedMessage, error) {
+	signatures, err := newSignatureChecker(ctx, config, keys.Identity, online)
+	if err != nil {
+		return nil, err
+	}
+	var received []receivedMessage
+	opts := renderOptionsFromConfig(config)
 	for _, msg := range messages {
-		content, err := crypto.DecryptMessage(privateKey, &msg)
+		signature := signatures.check(&msg)
+		content, err := crypto.DecryptMessage(keys, &msg)
 		if err != nil {
-			fmt.Printf("Failed to decrypt message %s: %v\n", msg.ID, err)
+			fmt.Fprintf(notices(), "Failed to decrypt message %s: %v\n", safeLine(msg.ID, opts), err)
 			continue
 		}
+		received = append(received, receivedMessage{msg: msg, content: content, signature: signature, escrowed: len(msg.EscrowedKey) > 0})
+	}
+	signatures.save()
+	return received, nil
+}
 
-		// Format message display
-		fmt.Printf("\nMessage ID: %s\n", msg.ID)
-		fmt.Printf("From: %s\n", msg.Sender)
-		fmt.Printf("Time: %s\n", time.Unix(msg.Timestamp, 0).Format(time.RFC3339))
-		fmt.Printf("Status: %s\n", msg.Status)
-		fmt.Printf("Message: %s\n", string(content))
-
-		if msg.Attachment != nil {
-			fmt.Printf("Attachment: %s (%d bytes)\n", msg.Attachment.Filename, msg.Attachment.Size)
-		}
+// printReceived displays a received message
+func printReceived(r receivedMessage, opts renderOptions) {
+	msg := r.msg
+	fmt.Printf("\nMessage ID: %s\n", safeLine(msg.ID, opts))
+	fmt.Printf("From: %s\n", safeLine(msg.Sender, opts))
+	fmt.Printf("Time: %s\n", time.Unix(msg.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("Status: %s\n", safeLine(msg.Status, opts))
+	fmt.Printf("Signature: %s\n", signatureBadge(r.signature))
+	if r.escrowed {
+		fmt.Println("Escrow: yes (the sender's organization can also decrypt this message)")
+	}
+	if msg.InReplyTo != "" {
+		fmt.Printf("In reply to: %s\n", safeLine(msg.InReplyTo, opts))
+	}
+	if msg.ExpiresAt != 0 {
+		fmt.Printf("Expires: %s (the sender asked for it to be deleted then)\n", time.Unix(msg.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	switch {
+	case r.parts > 1:
+		fmt.Printf("Parts: %d (other part IDs: %s)\n", r.parts, safeLine(strings.Join(r.ids[1:], ", "), opts))
+	case r.missing:
+		fmt.Printf("Part: %d of %d (remaining parts not received yet)\n", msg.Part.Index+1, msg.Part.Total)
+	}
+	// Content that fails its signature check may be forged, so it is not shown
+	if r.signature == SignatureInvalid {
+		fmt.Println("Message: [withheld: the signature does not match the sender's key; the message was altered or forged]")
 		fmt.Println("---")
+		return
 	}
+	indent := strings.Repeat(" ", len("Message: "))
+	fmt.Printf("Message: %s\n", strings.TrimPrefix(renderBody(string(r.content), opts, indent), indent))
 
-	return nil
+	if msg.Attachment != nil {
+		fmt.Printf("Attachment: %s (%s, %d bytes; save with 'clsp save %s')\n", safeLine(msg.Attachment.Filename, opts), safeLine(msg.Attachment.ContentType, opts), msg.Attachment.Size, safeLine(msg.ID, opts))
+	}
+	fmt.Println("---")
 }
 
 // MessageStatus checks the delivery status of a message
-func MessageStatus(messageID string) error {
-	// TODO: Implement message status check
-	fmt.Println("Message status check not implemented yet")
-	return nil
-}
-
-// ListUsers lists known users with optional filtering
-func ListUsers(onlineOnly bool, search string) error {
-	// Load config
+func MessageStatus(ctx context.Context, messageID string) error {
 	config, err := LoadConfig()
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	// Get hub configuration to get timeout
-	hubInfo, err := CheckHubHealth(config.HubURL)
+	// Only the sender may see a message's status, proven by signing the query
+	privateKey, err := loadIdentityKey()
 	if err != nil {
-		return fmt.Errorf("failed to get hub configuration: %v", err)
+		return fmt.Errorf("failed to load private key: %v", err)
 	}
 
-	// Build query parameters
-	params := url.Values{}
-	if onlineOnly {
-		params.Set("online", "true")
+	status, err := hubClient(config, privateKey).MessageStatus(ctx, messageID)
+	if errors.Is(err, clspclient.ErrMessageNotFound) {
+		return fmt.Errorf("message %s not found (it may have expired, or was not sent by you)", messageID)
 	}
-	if search != "" {
-		params.Set("search", search)
+	if err != nil {
+		return err
 	}
 
-	// Get users from hub
-	client := &http.Client{
-		Timeout: hubInfo.Config.HubTimeout,
+	if JSONOutput {
+		return printJSON(status)
 	}
 
-	resp, err := client.Get(fmt.Sprintf("%s/users?%s", config.HubURL, params.Encode()))
+	opts := renderOptionsFromConfig(config)
+	recipient := status.RecipientID
+	if status.RecipientName != "" {
+		recipient = fmt.Sprintf("%s (%s)", status.RecipientName, status.RecipientID)
+	}
+	fmt.Printf("Message ID: %s\n", safeLine(status.ID, opts))
+	fmt.Printf("To: %s\n", safeLine(recipient, opts))
+	state := status.State
+	if status.QuietHours {
+		state += " (quiet hours)"
+	}
+	fmt.Printf("Status: %s\n", safeLine(state, opts))
+	fmt.Printf("Sent: %s\n", status.CreatedAt.Format(time.RFC3339))
+	if status.State == clspclient.DeliveryRequest {
+		fmt.Println("Delivered: not yet (waiting for the recipient to accept your message request)")
+	} else if status.State == clspclient.DeliveryNoReceipts {
+		fmt.Println("Delivered: unknown (the recipient does not share receipts with you)")
+	} else if status.DeliveredAt != nil {
+		fmt.Printf("Delivered: %s\n", status.DeliveredAt.Format(time.RFC3339))
+	} else {
+		fmt.Println("Delivered: not yet fetched by the recipient")
+	}
+	if status.ReadAt != nil {
+		fmt.Printf("Read: %s\n", status.ReadAt.Format(time.RFC3339))
+	}
+	if status.InReplyTo != "" {
+		fmt.Printf("In reply to: %s\n", safeLine(status.InReplyTo, opts))
+	}
+	if status.Replies > 0 {
+		fmt.Printf("Replies: %d (see 'clsp list --thread %s')\n", status.Replies, safeLine(status.ID, opts))
+	}
+	fmt.Printf("Expires: %s\n", status.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// ListUsers lists known users with optional filtering. With fingerprints set each
+// user's short key fingerprint is shown with its local verification state.
+func ListUsers(ctx context.Context, onlineOnly bool, search string, fingerprints bool) error {
+	// Load config
+	config, err := LoadConfig()
 	if err != nil {
-		return fmt.Errorf("failed to get users: %v", err)
+		return fmt.Errorf("failed to load config: %v", err)
 	}
-	defer resp.Body.Close()
 
-	var users []User
-	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
-		return fmt.Errorf("failed to decode users: %v", err)
+	// Get users from hub
+	users, err := hubClient(config, nil).Users(ctx, clspclient.UserQuery{Online: onlineOnly, Search: search})
+	if err != nil {
+		return err
+	}
+
+	var known *KnownKeys
+	if fingerprints {
+		if known, err = LoadKnownKeys(); err != nil {
+			return err
+		}
+	}
+	// keyInfo returns a user's short fingerprint and verification state, if requested
+	keyInfo := func(u User) (string, string) {
+		if known == nil {
+			return "", ""
+		}
+		publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(u.PublicKey))
+		if err != nil {
+			return "invalid key", ""
+		}
+		full, err := crypto.Fingerprint(publicKey)
+		if err != nil {
+			return "invalid key", ""
+		}
+		short, _ := crypto.ShortFingerprint(publicKey)
+		if u.ID == config.UserID {
+			return short, "you"
+		}
+		return short, known.keyState(u.ID, full)
+	}
+
+	if JSONOutput {
+		out := make([]UserJSON, 0, len(users))
+		for _, u := range users {
+			entry := UserJSON{ID: u.ID, DisplayName: u.DisplayName}
+			for alias, id := range config.UserAliases {
+				if id == u.ID {
+					entry.Alias = alias
+					break
+				}
+			}
+			entry.Fingerprint, entry.KeyState = keyInfo(u)
+			out = append(out, entry)
+		}
+		return printJSON(out)
 	}
 
 	// Display users
+	opts := renderOptionsFromConfig(config)
 	fmt.Println("\nKnown Users:")
 	fmt.Println("------------")
 	for _, u := range users {
-		fmt.Printf("ID: %s\n", u.ID)
-		fmt.Printf("Name: %s\n", u.DisplayName)
+		fmt.Printf("ID: %s\n", safeLine(u.ID, opts))
+		fmt.Printf("Name: %s\n", safeLine(u.DisplayName, opts))
 
 		// Show alias if exists
 		for alias, id := range config.UserAliases {
 			if id == u.ID {
-				fmt.Printf("Alias: %s\n", alias)
+				fmt.Printf("Alias: %s\n", safeLine(alias, opts))
 				break
 			}
 		}
+		if fingerprint, state := keyInfo(u); fingerprint != "" {
+			if state == KeyChanged {
+				state = "KEY CHANGED since it was pinned"
+			}
+			fmt.Printf("Fingerprint: %s (%s)\n", fingerprint, state)
+		}
 		fmt.Println("---")
 	}
 
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// maxComposedSize caps a message read from stdin or the editor; anything larger is
+// better sent as an attachment
+const maxComposedSize = 16 << 20
+
+// composeHelp returns the lines appended to a draft opened in the editor, which are
+// removed again afterwards. Only these exact lines are dropped, so messages may
+// contain lines of their own starting with '#'.
+func composeHelp(recipient string) []string {
+	return []string{
+		fmt.Sprintf("# Write your message to %s above these lines. These help lines are", recipient),
+		"# removed; save and quit to send, or leave the message empty to cancel.",
+	}
+}
+
+// ReadMessageBody reads a message from stdin, for `clsp send <recipient> -`. Trailing
+// newlines are dropped. On a terminal, typing ends with Ctrl-D (Ctrl-Z on Windows).
+func ReadMessageBody() (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		eof := "Ctrl-D"
+		if runtime.GOOS == "windows" {
+			eof = "Ctrl-Z, Enter"
+		}
+		fmt.Fprintf(notices(), "Type the message, then press %s on an empty line:\n", eof)
+	}
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, maxComposedSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read message from stdin: %v", err)
+	}
+	if len(data) > maxComposedSize {
+		return "", fmt.Errorf("message on stdin exceeds %d MiB; send it as an attachment instead", maxComposedSize>>20)
+	}
+	message := strings.TrimRight(string(data), "\r\n")
+	if strings.TrimSpace(message) == "" {
+		return "", fmt.Errorf("no message on stdin")
+	}
+	return message, nil
+}
+
+// ComposeMessage opens a draft to recipient, starting with draft, in the user's editor
+// ($VISUAL, then $EDITOR, else vi or Notepad) and returns what was saved without the
+// help lines. The draft is kept in the runtime directory and deleted afterwards; an
+// empty message cancels.
+func ComposeMessage(ctx context.Context, recipient, draft string) (string, error) {
+	editor := strings.TrimSpace(os.Getenv("VISUAL"))
+	if editor == "" {
+		editor = strings.TrimSpace(os.Getenv("EDITOR"))
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	if err := os.MkdirAll(paths.RuntimeDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %v", err)
+	}
+	f, err := os.CreateTemp(paths.RuntimeDir, "draft-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("failed to create draft: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	help := composeHelp(recipient)
+	if draft != "" {
+		draft += "\n"
+	}
+	if _, err := fmt.Fprintf(f, "%s\n%s\n", draft, strings.Join(help, "\n")); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write draft: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write draft: %v", err)
+	}
+
+	// The editor may carry arguments, as in EDITOR="code --wait"
+	fields := strings.Fields(editor)
+	cmd := exec.CommandContext(ctx, fields[0], append(fields[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %q failed, message not sent: %v", editor, err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read draft: %v", err)
+	}
+	if len(data) > maxComposedSize {
+		return "", fmt.Errorf("message exceeds %d MiB; send it as an attachment instead", maxComposedSize>>20)
+	}
+	isHelp := make(map[string]bool)
+	for _, line := range help {
+		isHelp[line] = true
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if !isHelp[strings.TrimRight(line, " \t")] {
+			lines = append(lines, line)
+		}
+	}
+	message := strings.Trim(strings.Join(lines, "\n"), "\n")
+	if strings.TrimSpace(message) == "" {
+		return "", fmt.Errorf("empty message, nothing sent")
+	}
+	return message, nil
+}
@@ -2,9 +2,12 @@ package cli
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/mattd/clsp/internal/paths"
@@ -22,6 +25,55 @@ type Config struct {
 	DisplayName   string            `json:"display_name"`
 	UserAliases   map[string]string `json:"user_aliases"`
 	LastSyncTime  time.Time         `json:"last_sync_time"`
+
+	// RegistrationPending is set while the identity is saved locally but not yet accepted by the hub
+	RegistrationPending bool `json:"registration_pending,omitempty"`
+	// InviteCode is kept while a registration that needs an invite code is pending
+	InviteCode string `json:"invite_code,omitempty"`
+	// AutoLockAfter is the idle period after which an unlocked identity locks again
+	// (zero uses DefaultAutoLockAfter, negative disables auto-lock)
+	AutoLockAfter time.Duration `json:"auto_lock_after,omitempty"`
+	// RenderANSI lets colour/style escape sequences in messages through to the terminal
+	RenderANSI bool `json:"render_ansi,omitempty"`
+	// StripEmoji replaces emoji in messages with a placeholder
+	StripEmoji bool `json:"strip_emoji,omitempty"`
+	// PrivacyLevel controls how much inbox summaries and badges reveal: full, counts or none
+	// (empty means full)
+	PrivacyLevel string `json:"privacy_level,omitempty"`
+	// HubPublicKey is the hub signing key pinned on first contact
+	HubPublicKey string `json:"hub_public_key,omitempty"`
+	// AckedAnnouncements holds the IDs of hub announcements already shown
+	AckedAnnouncements []string `json:"acked_announcements,omitempty"`
+	// EscrowFingerprint is the fingerprint of the hub escrow key the user agreed to
+	// have message keys wrapped to (empty when escrow is off)
+	EscrowFingerprint string `json:"escrow_fingerprint,omitempty"`
+	// NoReadReceipts keeps the hub from learning when messages are read, so senders
+	// only ever see them delivered
+	NoReadReceipts bool `json:"no_read_receipts,omitempty"`
+	// CipherSuites are the cipher suites offered to senders with this user's prekey,
+	// most preferred first (empty offers every suite this build supports)
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	// Compression is the algorithm message content and inline attachments are
+	// compressed with before encryption, for recipients who read it (empty for none)
+	Compression string `json:"compression,omitempty"`
+	// ScreenRules route matching incoming messages to the screened folder instead of
+	// the inbox; ScreenAllowed are sender IDs never screened
+	ScreenRules   []ScreenRule `json:"screen_rules,omitempty"`
+	ScreenAllowed []string     `json:"screen_allowed,omitempty"`
+	// Proxy is the proxy hub requests go through: a URL (http, https, socks5 or
+	// socks5h), "tor", "off", or empty to follow HTTP_PROXY and related variables
+	Proxy string `json:"proxy,omitempty"`
+	// HubCertPin is the pin ("sha256/" and the base64 hash of the public key) the
+	// hub's TLS certificate must match; it replaces CA validation (see CertificatePin)
+	HubCertPin string `json:"hub_cert_pin,omitempty"`
+	// TLSClientCert and TLSClientKey are the certificate and key presented to hubs
+	// that require client certificates
+	TLSClientCert string `json:"tls_client_cert,omitempty"`
+	TLSClientKey  string `json:"tls_client_key,omitempty"`
+
+	// loaded is the JSON this value was read from; SaveConfig uses it to tell this
+	// process's changes from those another clsp process saved in the meantime
+	loaded []byte
 }
 
 // DefaultConfig returns the default configuration
@@ -39,9 +91,24 @@ func DefaultConfig() *Config {
 	}
 }
 
-// LoadConfig loads the configuration from file
+// configFile is the client configuration in the config directory
+const configFile = "config.json"
+
+// LoadConfig loads the configuration from file, decrypting it when encryption at
+// rest is on. A corrupt file is replaced by its last good backup. Hub requests go
+// through the proxy it names, and trust the hub certificate it names, from then on.
 func LoadConfig() (*Config, error) {
-	configPath := paths.GetConfigPath("config.json")
+	config, err := loadConfig()
+	if err == nil {
+		configuredProxy.Store(config.Proxy)
+		storeHubTLS(config)
+	}
+	return config, err
+}
+
+// loadConfig reads the configuration, creating or repairing it as needed
+func loadConfig() (*Config, error) {
+	configPath := paths.GetConfigPath(configFile)
 
 	// Create default config if it doesn't exist
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -52,20 +119,74 @@ func LoadConfig() (*Config, error) {
 		return config, nil
 	}
 
-	data, err := os.ReadFile(configPath)
+	config, err := readConfigFile(configPath)
+	if errors.Is(err, errCorruptFile) {
+		return recoverConfig(configPath, err)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %v", err)
+		return nil, err
 	}
+	return config, nil
+}
 
+// readConfigFile reads and parses one copy of the configuration
+func readConfigFile(path string) (*Config, error) {
+	data, err := readLocalFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
 	var config Config
 	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %v", err)
+		return nil, fmt.Errorf("failed to parse config: %w: %v", errCorruptFile, err)
 	}
-
+	config.loaded = data
 	return &config, nil
 }
 
-// SaveConfig saves the configuration to file
+// recoverConfig restores a corrupt configuration from its backup, keeping the
+// damaged file for inspection
+func recoverConfig(configPath string, cause error) (*Config, error) {
+	unlock, err := lockLocalFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Another process may have repaired it while we waited for the lock
+	if config, err := readConfigFile(configPath); err == nil {
+		return config, nil
+	}
+
+	backupPath := configPath + backupSuffix
+	config, err := readConfigFile(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("%v\n%s is damaged and there is no usable backup (%s); repair it, or remove it to start over with a default configuration", cause, configPath, backupPath)
+	}
+
+	aside, err := quarantineFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("%v (failed to move the damaged file aside: %v)", cause, err)
+	}
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config backup: %v", err)
+	}
+	if err := writeFileAtomic(configPath, backup, 0600); err != nil {
+		return nil, fmt.Errorf("failed to restore config from backup: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s was damaged (%v)\n", configPath, cause)
+	fmt.Fprintf(os.Stderr, "Restored the last good copy from %s; the damaged file was kept as %s\n", backupPath, aside)
+	return config, nil
+}
+
+// SaveConfig saves the configuration to file, encrypting it when encryption at
+// rest is on. The file is replaced atomically, and the copy it replaces is kept as
+// a backup if it was intact.
+//
+// Saving is a read-modify-write under a lock shared by all clsp processes: if the
+// file changed since config was loaded, only the settings this process changed are
+// written over it, so concurrent commands (such as a cron job during an interactive
+// session) do not undo each other's updates. config is updated to the merged result.
 func SaveConfig(config *Config) error {
 	if err := paths.EnsureConfigDir(); err != nil {
 		return fmt.Errorf("failed to create config directory: %v", err)
@@ -76,20 +197,101 @@ func SaveConfig(config *Config) error {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	configPath := paths.GetConfigPath("config.json")
-	if err := os.WriteFile(configPath, data, 0600); err != nil {
+	configPath := paths.GetConfigPath(configFile)
+	unlock, err := lockLocalFile(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if raw, err := os.ReadFile(configPath); err == nil {
+		if current, err := readConfigFile(configPath); err == nil {
+			if err := writeFileAtomic(configPath+backupSuffix, raw, 0600); err != nil {
+				return fmt.Errorf("failed to back up config: %v", err)
+			}
+			if config.loaded != nil && string(current.loaded) != string(config.loaded) {
+				if data, err = mergeConfigJSON(config.loaded, data, current.loaded); err != nil {
+					return fmt.Errorf("failed to merge config: %v", err)
+				}
+				var merged Config
+				if err := json.Unmarshal(data, &merged); err != nil {
+					return fmt.Errorf("failed to merge config: %v", err)
+				}
+				*config = merged
+			}
+		}
+	}
+	if err := writeLocalFile(configPath, data); err != nil {
 		return fmt.Errorf("failed to write config: %v", err)
 	}
+	config.loaded = data
+
+	// The auto-lock period is needed before an encrypted config can be read
+	if meta, err := loadStorageMeta(); err == nil && meta != nil && meta.AutoLockAfter != config.AutoLockAfter {
+		meta.AutoLockAfter = config.AutoLockAfter
+		if err := saveStorageMeta(meta); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// mergeConfigJSON applies the changes made between base and mine on top of theirs, a
+// version saved by another process since base was read. Settings are compared one by
+// one, and nested objects (such as the alias map) key by key.
+func mergeConfigJSON(base, mine, theirs []byte) ([]byte, error) {
+	var b, m, t map[string]interface{}
+	for _, v := range []struct {
+		data []byte
+		out  *map[string]interface{}
+	}{{base, &b}, {mine, &m}, {theirs, &t}} {
+		if err := json.Unmarshal(v.data, v.out); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(mergeObjects(b, m, t), "", "  ")
+}
+
+// mergeObjects is the three-way merge of one JSON object for mergeConfigJSON
+func mergeObjects(base, mine, theirs map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(theirs))
+	for k, v := range theirs {
+		out[k] = v
+	}
+	for k, mv := range mine {
+		bv, inBase := base[k]
+		if inBase && reflect.DeepEqual(mv, bv) {
+			continue // unchanged here, so their value stands
+		}
+		mo, mineIsObject := mv.(map[string]interface{})
+		bo, baseIsObject := bv.(map[string]interface{})
+		to, theirsIsObject := theirs[k].(map[string]interface{})
+		if mineIsObject && baseIsObject && theirsIsObject {
+			out[k] = mergeObjects(bo, mo, to)
+			continue
+		}
+		out[k] = mv
+	}
+	for k := range base {
+		if _, kept := mine[k]; !kept {
+			delete(out, k) // removed here
+		}
+	}
+	return out
+}
+
 // UpdateHubURL updates the hub URL in the configuration
 func (c *Config) UpdateHubURL(urlStr string) error {
 	// Validate URL format
-	if _, err := url.Parse(urlStr); err != nil {
+	u, err := url.Parse(urlStr)
+	if err != nil {
 		return fmt.Errorf("invalid hub URL: %v", err)
 	}
+	// A pinned certificate belongs to the previous hub
+	if old, err := url.Parse(c.HubURL); err == nil && !strings.EqualFold(old.Host, u.Host) {
+		c.HubCertPin = ""
+	}
 	c.HubURL = urlStr
 	return nil
 }
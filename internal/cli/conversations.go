@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// ConversationJSON is one entry of `clsp conversations --json` output
+type ConversationJSON struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	Alias       string `json:"alias,omitempty"`
+	Messages    int    `json:"messages"`
+	Unread      int    `json:"unread"`
+	// LastTime, LastFromYou and Preview describe the latest message either way
+	LastTime    time.Time `json:"last_time"`
+	LastFromYou bool      `json:"last_from_you"`
+	Preview     string    `json:"preview"`
+}
+
+// conversationHistory is the local history decrypted for the conversation views:
+// received messages with split ones joined, and your copies of the messages you sent
+type conversationHistory struct {
+	config   *Config
+	store    *localStore
+	received []receivedMessage
+	sent     []receivedMessage
+}
+
+// loadConversations opens the local store and decrypts both directions of the
+// history, syncing from the hub first unless source is ListLocal. The caller closes
+// the returned store.
+func loadConversations(ctx context.Context, source ListSource) (*conversationHistory, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := readConversations(ctx, config, store, privateKey, keys, source)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// readConversations does the work of loadConversations once the store is open
+func readConversations(ctx context.Context, config *Config, store *localStore, privateKey *rsa.PrivateKey, keys *crypto.Keyring, source ListSource) (*conversationHistory, error) {
+	online := source != ListLocal
+	if online {
+		if err := syncMessages(ctx, config, store, keys, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not sync with the hub (%v); showing local history\n", err)
+			online = false
+		} else {
+			sendQueued(ctx, config, privateKey, store)
+			sendScheduled(ctx, config, privateKey, store)
+			sendPendingReads(ctx, config, privateKey, store)
+			refreshDirectory(ctx, config)
+		}
+	}
+	messages, err := store.Messages(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.LoadSavedKeys(ctx, keys); err != nil {
+		return nil, err
+	}
+	received, err := openReceived(ctx, config, keys, messages, online)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := store.sentMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conversationHistory{
+		config:   config,
+		store:    store,
+		received: joinParts(received),
+		sent:     openSent(config, keys, privateKey, sent),
+	}, nil
+}
+
+// contactNames maps user IDs to the names to show for them: your alias for a user,
+// otherwise their display name in the cached directory snapshot
+func contactNames(config *Config) (aliases, names map[string]string) {
+	aliases = make(map[string]string, len(config.UserAliases))
+	for alias, id := range config.UserAliases {
+		aliases[id] = alias
+	}
+	names = make(map[string]string)
+	if snapshot, err := loadDirectorySnapshot(); err == nil && snapshot != nil {
+		for _, u := range snapshot.Users {
+			names[u.ID] = u.DisplayName
+		}
+	}
+	return aliases, names
+}
+
+// contactLabel returns how a counterpart is shown: alias, display name or bare ID
+func contactLabel(id string, aliases, names map[string]string) string {
+	if alias, ok := aliases[id]; ok {
+		return alias
+	}
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return id
+}
+
+// ListConversations lists everyone you have exchanged messages with, newest
+// conversation first, with the message and unread counts and the latest message of
+// each. Messages are synced from the hub first unless source is ListLocal.
+func ListConversations(ctx context.Context, source ListSource) error {
+	h, err := loadConversations(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer h.store.Close()
+
+	type conversation struct {
+		ConversationJSON
+		last receivedMessage
+	}
+	byUser := make(map[string]*conversation)
+	add := func(r receivedMessage, counterpart string, fromYou bool) {
+		c, ok := byUser[counterpart]
+		if !ok {
+			c = &conversation{ConversationJSON: ConversationJSON{UserID: counterpart}}
+			byUser[counterpart] = c
+		}
+		c.Messages++
+		if !fromYou && r.msg.Status == "unread" {
+			c.Unread++
+		}
+		if t := time.Unix(r.msg.Timestamp, 0); t.After(c.LastTime) {
+			c.LastTime = t
+			c.LastFromYou = fromYou
+			c.last = r
+		}
+	}
+	for _, r := range h.received {
+		add(r, r.msg.Sender, false)
+	}
+	for _, r := range h.sent {
+		add(r, r.msg.Recipient, true)
+	}
+
+	conversations := make([]*conversation, 0, len(byUser))
+	aliases, names := contactNames(h.config)
+	opts := renderOptionsFromConfig(h.config)
+	for _, c := range byUser {
+		c.Alias = aliases[c.UserID]
+		c.DisplayName = names[c.UserID]
+		switch {
+		case c.last.signature == SignatureInvalid:
+			c.Preview = "(invalid signature; see 'clsp list')"
+		case c.last.missing:
+			c.Preview = "(part of a split message; remaining parts not received yet)"
+		default:
+			c.Preview = previewText(string(c.last.content), opts)
+		}
+		conversations = append(conversations, c)
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].LastTime.After(conversations[j].LastTime)
+	})
+
+	if JSONOutput {
+		out := make([]ConversationJSON, 0, len(conversations))
+		for _, c := range conversations {
+			c.LastTime = c.LastTime.UTC()
+			out = append(out, c.ConversationJSON)
+		}
+		return printJSON(out)
+	}
+	if len(conversations) == 0 {
+		fmt.Println("No conversations yet")
+		return nil
+	}
+	for _, c := range conversations {
+		label := safeLine(contactLabel(c.UserID, aliases, names), opts)
+		unread := ""
+		if c.Unread > 0 {
+			unread = fmt.Sprintf(", %d unread", c.Unread)
+		}
+		fmt.Printf("\n%s (%s)  %d message(s)%s\n", label, safeLine(c.UserID, opts), c.Messages, unread)
+		from := label
+		if c.LastFromYou {
+			from = "you"
+		}
+		fmt.Printf("  %s  %s: %s\n", c.LastTime.Format(time.RFC3339), from, c.Preview)
+	}
+	return nil
+}
+
+// ListConversation shows the messages exchanged with one user, oldest first, your
+// own messages included, and marks the received ones read locally. user is an alias,
+// display name or user ID; messages are synced from the hub first unless source is
+// ListLocal.
+func ListConversation(ctx context.Context, user string, source ListSource) error {
+	h, err := loadConversations(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer h.store.Close()
+
+	counterpart := resolveContact(ctx, h.config, user, source != ListLocal)
+	var shown []receivedMessage
+	for _, r := range h.received {
+		if r.msg.Sender == counterpart {
+			shown = append(shown, r)
+		}
+	}
+	for _, r := range h.sent {
+		if r.msg.Recipient == counterpart {
+			shown = append(shown, r)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool { return shown[i].msg.Timestamp < shown[j].msg.Timestamp })
+
+	var shownIDs []string
+	for _, r := range shown {
+		if r.msg.Sender != h.config.UserID {
+			shownIDs = append(shownIDs, r.msg.ID)
+			shownIDs = append(shownIDs, r.ids...)
+		}
+	}
+	if JSONOutput {
+		out := make([]MessageJSON, 0, len(shown))
+		for _, r := range shown {
+			m := messageJSON(r)
+			if r.msg.Sender == h.config.UserID {
+				m.RecipientID = r.msg.Recipient
+			}
+			out = append(out, m)
+		}
+		if err := printJSON(out); err != nil {
+			return err
+		}
+		return h.store.MarkRead(ctx, shownIDs)
+	}
+
+	aliases, names := contactNames(h.config)
+	opts := renderOptionsFromConfig(h.config)
+	label := contactLabel(counterpart, aliases, names)
+	if len(shown) == 0 {
+		fmt.Printf("No messages with %s in your history\n", safeLine(label, opts))
+		return nil
+	}
+	fmt.Printf("Conversation with %s (%s)\n", safeLine(label, opts), safeLine(counterpart, opts))
+	for _, r := range shown {
+		from := label
+		if r.msg.Sender == h.config.UserID {
+			from = "you"
+		}
+		printThreadEntry(r, from, "", opts)
+	}
+	return h.store.MarkRead(ctx, shownIDs)
+}
+
+// resolveContact turns an alias, display name or user ID into a user ID, using the
+// cached directory snapshot and then, when online, the hub. Anything unknown is
+// taken as a user ID, so conversations with users who left the directory still show.
+func resolveContact(ctx context.Context, config *Config, user string, online bool) string {
+	if id, ok := config.UserAliases[user]; ok {
+		return id
+	}
+	if snapshot, err := loadDirectorySnapshot(); err == nil && snapshot != nil {
+		if u, ok := snapshot.Find(user); ok {
+			return u.ID
+		}
+	}
+	if online {
+		if client, err := lookupClient(config, user); err == nil {
+			if u, err := client.FindUser(ctx, user); err == nil {
+				return u.ID
+			}
+		}
+	}
+	return strings.TrimSpace(user)
+}
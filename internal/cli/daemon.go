@@ -0,0 +1,559 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// daemonSocketFile is the name of the daemon's socket in the runtime directory
+const daemonSocketFile = "clspd.sock"
+
+// notifyDelay gathers messages arriving together into one desktop notification
+const notifyDelay = 2 * time.Second
+
+// errNoDaemon is returned by daemon requests when no daemon is listening, or it
+// cannot reach the hub either; the caller then does the work itself
+var errNoDaemon = errors.New("no daemon running")
+
+// DaemonStatus is the response of GET /status on the daemon socket
+type DaemonStatus struct {
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	HubURL    string    `json:"hub_url"`
+	UserID    string    `json:"user_id"`
+	// Connected is set when the last poll of the hub succeeded, at LastPoll
+	Connected bool      `json:"connected"`
+	LastPoll  time.Time `json:"last_poll,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	// Outbox and Scheduled count the messages waiting to be sent
+	Outbox    int `json:"outbox"`
+	Scheduled int `json:"scheduled"`
+	// Locked is set while the identity is locked and the daemon neither polls nor sends
+	Locked bool `json:"locked,omitempty"`
+}
+
+// DaemonSendRequest is the body of POST /send on the daemon socket
+type DaemonSendRequest struct {
+	Recipient      string `json:"recipient"`
+	Message        string `json:"message"`
+	AllowDuplicate bool   `json:"allow_duplicate,omitempty"`
+	InReplyTo      string `json:"in_reply_to,omitempty"`
+	// Expiry is in seconds, as with the hub's settings
+	Expiry int64 `json:"expiry,omitempty"`
+}
+
+// DaemonSendResult is the response of POST /send on the daemon socket
+type DaemonSendResult struct {
+	IDs              []string   `json:"ids"`
+	RecipientID      string     `json:"recipient_id"`
+	AlreadyDelivered bool       `json:"already_delivered,omitempty"`
+	Escrowed         bool       `json:"escrowed,omitempty"`
+	ReceiptsDisabled bool       `json:"receipts_disabled,omitempty"`
+	Relayed          bool       `json:"relayed,omitempty"`
+	Request          bool       `json:"request,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+}
+
+// daemon serves the local socket API while a watcher keeps up with the hub
+type daemon struct {
+	config    *Config
+	watcher   *watcher
+	startedAt time.Time
+	notify    bool
+	stop      context.CancelFunc
+
+	mu sync.Mutex
+	// subscribers receive every watch event, for GET /events
+	subscribers map[chan WatchEventJSON]bool
+	// pending holds new messages for the next desktop notification
+	pending     []inboxEntry
+	notifyTimer *time.Timer
+}
+
+// daemonSocketPath returns the path of the daemon's socket
+func daemonSocketPath() (string, error) {
+	return paths.GetRuntimePath(daemonSocketFile)
+}
+
+// RunDaemon runs clspd in the foreground until ctx is cancelled or a client asks it
+// to stop. It polls the hub every interval like 'clsp watch', sending the outbox and
+// scheduled messages and, when notify is set, showing new messages as desktop
+// notifications at the configured privacy level. Meanwhile it serves a JSON API on a
+// Unix socket in the runtime directory, which 'clsp send' uses to send with the
+// already unlocked key and open hub connection. 'clsp lock' and the key agent's idle
+// auto-lock make the daemon drop the key: it then skips polls and refuses sends,
+// which 'clsp send' makes itself, until it can take the key from the agent again.
+func RunDaemon(ctx context.Context, interval time.Duration, notify bool) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	socketPath, err := daemonSocketPath()
+	if err != nil {
+		return err
+	}
+	if _, err := daemonRequest(ctx, http.MethodGet, "/status", nil, nil); err == nil {
+		return fmt.Errorf("a daemon is already running (stop it with 'clsp daemon stop')")
+	}
+	// A socket left behind by a daemon that died is in the way
+	os.Remove(socketPath)
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	w, err := newWatcher(ctx, store, privateKey, keys)
+	if err != nil {
+		return err
+	}
+	// Once locked, the key comes back only from the agent
+	noPassphrasePrompt = true
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict access to %s: %v", socketPath, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := &daemon{
+		config:      config,
+		watcher:     w,
+		startedAt:   time.Now(),
+		notify:      notify,
+		stop:        cancel,
+		subscribers: make(map[chan WatchEventJSON]bool),
+	}
+	w.sink = d.event
+	w.wake = make(chan struct{}, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/events", d.handleEvents)
+	mux.HandleFunc("/send", d.handleSend)
+	mux.HandleFunc("/sync", d.handleSync)
+	mux.HandleFunc("/lock", d.handleLock)
+	mux.HandleFunc("/stop", d.handleStop)
+	server := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return ctx }}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Printf("clspd watching %s every %s; listening on %s\n", config.HubURL, interval, socketPath)
+	err = w.run(ctx, interval)
+	fmt.Println("clspd stopped")
+	return err
+}
+
+// event passes a watch event to the subscribers and collects new messages for a
+// desktop notification. Subscribers that fall behind miss events rather than hold up
+// the watcher.
+func (d *daemon) event(e WatchEventJSON) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	switch e.Type {
+	case "disconnected":
+		fmt.Printf("[%s] Lost connection to the hub: %s\n", e.Time.Local().Format("15:04:05"), e.Error)
+	case "reconnected":
+		fmt.Printf("[%s] Reconnected to the hub\n", e.Time.Local().Format("15:04:05"))
+	case "message":
+		if !d.notify || e.Message == nil {
+			return
+		}
+		d.pending = append(d.pending, d.inboxEntry(e.Message))
+		if d.notifyTimer == nil {
+			d.notifyTimer = time.AfterFunc(notifyDelay, d.flushNotifications)
+		}
+	}
+}
+
+// inboxEntry describes a new message for a notification, as 'clsp inbox' would
+func (d *daemon) inboxEntry(m *MessageJSON) inboxEntry {
+	config, err := LoadConfig()
+	if err != nil {
+		config = d.config
+	}
+	opts := renderOptionsFromConfig(config)
+	sender := m.SenderID
+	for alias, id := range config.UserAliases {
+		if id == m.SenderID {
+			sender = alias
+		}
+	}
+	entry := inboxEntry{Sender: safeLine(sender, opts), Preview: previewText(m.Content, opts)}
+	if m.Signature == SignatureInvalid {
+		entry.Preview = "(invalid signature; see 'clsp list')"
+	}
+	return entry
+}
+
+// flushNotifications shows the collected messages as one desktop notification
+func (d *daemon) flushNotifications() {
+	d.mu.Lock()
+	entries := d.pending
+	d.pending, d.notifyTimer = nil, nil
+	d.mu.Unlock()
+
+	level := d.config.privacyLevel()
+	if config, err := LoadConfig(); err == nil {
+		level = config.privacyLevel()
+	}
+	summary := formatInboxSummary(level, entries)
+	if summary == "" || len(entries) == 0 {
+		return
+	}
+	title, body, _ := strings.Cut(summary, "\n")
+	if err := desktopNotify("clsp: "+title, strings.TrimSpace(body)); err != nil {
+		fmt.Printf("Desktop notification failed (%v); turning notifications off\n", err)
+		d.mu.Lock()
+		d.notify = false
+		d.mu.Unlock()
+	}
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := DaemonStatus{
+		PID:       os.Getpid(),
+		StartedAt: d.startedAt,
+		HubURL:    d.config.HubURL,
+		UserID:    d.config.UserID,
+		Locked:    d.watcher.isLocked(),
+	}
+	var lastErr error
+	status.LastPoll, lastErr = d.watcher.status()
+	status.Connected = !status.LastPoll.IsZero() && lastErr == nil
+	if lastErr != nil {
+		status.LastError = lastErr.Error()
+	}
+	if queue, err := d.watcher.store.queued(r.Context()); err == nil {
+		status.Outbox = len(queue)
+	}
+	if scheduled, err := d.watcher.store.scheduledMessages(r.Context(), time.Time{}); err == nil {
+		status.Scheduled = len(scheduled)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleEvents streams watch events as JSON lines until the client goes away
+func (d *daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan WatchEventJSON, 64)
+	d.mu.Lock()
+	d.subscribers[ch] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleSend sends a message with the daemon's key. A hub that cannot be reached is
+// reported as 503, leaving the client to queue the message itself, and a locked
+// identity as 423, leaving the client to unlock it.
+func (d *daemon) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req DaemonSendRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxComposedSize+4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Recipient == "" || req.Message == "" || req.Expiry < 0 {
+		http.Error(w, "Recipient and message required", http.StatusBadRequest)
+		return
+	}
+
+	// Sends wait for a poll in progress, so the outbox is never flushed twice at once
+	d.watcher.busy.Lock()
+	defer d.watcher.busy.Unlock()
+	if err := d.watcher.unlock(); err != nil {
+		if errors.Is(err, errIdentityLocked) {
+			http.Error(w, "Identity is locked", http.StatusLocked)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := r.Context()
+	config, err := LoadConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	client := hubClient(config, d.watcher.privateKey)
+	opts := SendOptions{
+		AllowDuplicate: req.AllowDuplicate,
+		InReplyTo:      req.InReplyTo,
+		Expiry:         time.Duration(req.Expiry) * time.Second,
+	}
+	sendOpts, err := prepareSend(ctx, config, client, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	result, err := client.SendMessage(ctx, req.Recipient, []byte(req.Message), sendOpts)
+	if err != nil {
+		if _, healthErr := client.Health(ctx); healthErr != nil {
+			http.Error(w, fmt.Sprintf("Hub unreachable: %v", healthErr), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	sendQueued(ctx, config, d.watcher.privateKey, d.watcher.store)
+	if !result.AlreadyDelivered() {
+		keepSent(ctx, config, d.watcher.privateKey, result.RecipientID, result.IDs, req.Message, req.InReplyTo, result.ExpiresAt)
+	}
+
+	out := DaemonSendResult{
+		IDs:              result.IDs,
+		RecipientID:      result.RecipientID,
+		AlreadyDelivered: result.AlreadyDelivered(),
+		Escrowed:         result.Escrowed,
+		ReceiptsDisabled: result.ReceiptsDisabled,
+		Relayed:          result.Relayed,
+		Request:          result.Request,
+	}
+	if !result.ExpiresAt.IsZero() {
+		out.ExpiresAt = &result.ExpiresAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleSync starts a poll of the hub now rather than at the next interval
+func (d *daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case d.watcher.wake <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleLock drops the daemon's keys once the identity is locked
+func (d *daemon) handleLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d.watcher.busy.Lock()
+	d.watcher.lock()
+	d.watcher.busy.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *daemon) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	d.stop()
+}
+
+// daemonRequest makes a request to the daemon's socket, decoding a JSON response into
+// out when it is not nil. It returns errNoDaemon when nothing listens on the socket,
+// the daemon cannot reach the hub or it is locked, and the daemon's error text for
+// other failures.
+func daemonRequest(ctx context.Context, method, path string, body, out interface{}) (*http.Response, error) {
+	socketPath, err := daemonSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://clspd"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errNoDaemon
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusLocked:
+		return resp, errNoDaemon
+	case resp.StatusCode >= 300:
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp, errors.New(strings.TrimSpace(string(text)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("invalid response from the daemon: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// lockDaemon tells a running daemon that the identity was locked
+func lockDaemon() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	daemonRequest(ctx, http.MethodPost, "/lock", nil, nil)
+}
+
+// sendViaDaemon sends a message through a running daemon, returning errNoDaemon when
+// there is none, it cannot reach the hub or it is locked
+func sendViaDaemon(ctx context.Context, recipient, message string, opts SendOptions) (*clspclient.SendResult, error) {
+	var out DaemonSendResult
+	_, err := daemonRequest(ctx, http.MethodPost, "/send", DaemonSendRequest{
+		Recipient:      recipient,
+		Message:        message,
+		AllowDuplicate: opts.AllowDuplicate,
+		InReplyTo:      opts.InReplyTo,
+		Expiry:         int64(opts.Expiry / time.Second),
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.IDs) == 0 {
+		return nil, fmt.Errorf("invalid response from the daemon: no message ID")
+	}
+	result := &clspclient.SendResult{
+		IDs:              out.IDs,
+		RecipientID:      out.RecipientID,
+		Escrowed:         out.Escrowed,
+		ReceiptsDisabled: out.ReceiptsDisabled,
+		Relayed:          out.Relayed,
+		Request:          out.Request,
+	}
+	if out.AlreadyDelivered {
+		result.Duplicates = len(out.IDs)
+	}
+	if out.ExpiresAt != nil {
+		result.ExpiresAt = *out.ExpiresAt
+	}
+	return result, nil
+}
+
+// DaemonControl runs 'clsp daemon status' or 'clsp daemon stop'
+func DaemonControl(ctx context.Context, action string) error {
+	switch action {
+	case "status":
+		var status DaemonStatus
+		if _, err := daemonRequest(ctx, http.MethodGet, "/status", nil, &status); err != nil {
+			if errors.Is(err, errNoDaemon) {
+				return fmt.Errorf("no daemon is running (start one with 'clsp daemon')")
+			}
+			return err
+		}
+		if JSONOutput {
+			return printJSON(status)
+		}
+		fmt.Printf("Daemon running (pid %d) since %s\n", status.PID, status.StartedAt.Local().Format("2006-01-02 15:04:05"))
+		fmt.Printf("Hub: %s as %s\n", status.HubURL, status.UserID)
+		switch {
+		case status.Locked:
+			fmt.Println("Identity locked; polling resumes after 'clsp unlock'")
+		case status.Connected:
+			fmt.Printf("Connected; last poll %s\n", status.LastPoll.Local().Format("15:04:05"))
+		case status.LastError != "":
+			fmt.Printf("Disconnected: %s\n", status.LastError)
+		default:
+			fmt.Println("Connecting")
+		}
+		fmt.Printf("Outbox: %d message(s), scheduled: %d\n", status.Outbox, status.Scheduled)
+		return nil
+	case "stop":
+		if _, err := daemonRequest(ctx, http.MethodPost, "/stop", nil, nil); err != nil {
+			if errors.Is(err, errNoDaemon) {
+				return fmt.Errorf("no daemon is running")
+			}
+			return err
+		}
+		fmt.Println("Daemon stopped")
+		return nil
+	}
+	return fmt.Errorf("unknown daemon command %q", action)
+}
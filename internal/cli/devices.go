@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// deviceFile holds this device's ID. It is left out of backups, so an identity
+// restored elsewhere announces itself as a new device.
+const deviceFile = "device.json"
+
+// deviceAnnounceInterval is how often a sync tells the hub this device is in use
+const deviceAnnounceInterval = 24 * time.Hour
+
+// localDevice is this device as it announces itself to the hub
+type localDevice struct {
+	ID          string    `json:"id"`
+	AnnouncedAt time.Time `json:"announced_at,omitempty"`
+}
+
+// loadLocalDevice reads this device's ID, choosing one the first time
+func loadLocalDevice() (*localDevice, error) {
+	device := &localDevice{}
+	data, err := os.ReadFile(paths.GetConfigPath(deviceFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read device: %v", err)
+	default:
+		if err := json.Unmarshal(data, device); err != nil {
+			return nil, fmt.Errorf("failed to parse device: %v", err)
+		}
+	}
+	if device.ID == "" {
+		device.ID = uuid.New().String()
+		if err := saveLocalDevice(device); err != nil {
+			return nil, err
+		}
+	}
+	return device, nil
+}
+
+// saveLocalDevice writes this device's ID
+func saveLocalDevice(device *localDevice) error {
+	if err := paths.EnsureConfigDir(); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	data, err := json.MarshalIndent(device, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal device: %v", err)
+	}
+	if err := writeFileAtomic(paths.GetConfigPath(deviceFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write device: %v", err)
+	}
+	return nil
+}
+
+// deviceName is the name this device announces: its host name
+func deviceName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// announceDevice tells the hub this device uses the identity and returns the
+// identity's devices along with this device's ID
+func announceDevice(ctx context.Context, config *Config, privateKey *rsa.PrivateKey) ([]clspclient.Device, string, error) {
+	device, err := loadLocalDevice()
+	if err != nil {
+		return nil, "", err
+	}
+	devices, err := hubClient(config, privateKey).AnnounceDevice(ctx, device.ID, deviceName())
+	if err != nil {
+		return nil, device.ID, err
+	}
+	device.AnnouncedAt = time.Now()
+	if err := saveLocalDevice(device); err != nil {
+		return nil, device.ID, err
+	}
+	return devices, device.ID, nil
+}
+
+// maybeAnnounceDevice announces this device if it has not done so for
+// deviceAnnounceInterval. The device list is informational, so failures are ignored.
+func maybeAnnounceDevice(ctx context.Context, config *Config, privateKey *rsa.PrivateKey) {
+	device, err := loadLocalDevice()
+	if err != nil || time.Since(device.AnnouncedAt) < deviceAnnounceInterval {
+		return
+	}
+	announceDevice(ctx, config, privateKey)
+}
@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// directoryFile caches the hub's signed directory snapshot for offline lookups
+const directoryFile = "directory.json"
+
+// directoryRefreshAge is the age after which an online listing refreshes the cached
+// directory snapshot
+const directoryRefreshAge = 24 * time.Hour
+
+// loadDirectorySnapshot reads the cached snapshot, returning nil if there is none
+func loadDirectorySnapshot() (*clspclient.DirectorySnapshot, error) {
+	data, err := os.ReadFile(paths.GetConfigPath(directoryFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory snapshot: %v", err)
+	}
+	var snapshot clspclient.DirectorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse directory snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// pinnedHubKey returns the hub signing key pinned in config, pinning offered on first use
+func pinnedHubKey(config *Config, offered string) (*rsa.PublicKey, error) {
+	if config.HubPublicKey == "" {
+		config.HubPublicKey = offered
+		if err := SaveConfig(config); err != nil {
+			return nil, fmt.Errorf("failed to save config: %v", err)
+		}
+	}
+	hubKey, err := crypto.LoadPublicKeyFromPEM([]byte(config.HubPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hub public key: %v", err)
+	}
+	return hubKey, nil
+}
+
+// syncDirectory downloads the hub's directory snapshot, verifies it against the
+// pinned hub key and caches it
+func syncDirectory(ctx context.Context, config *Config) (*clspclient.DirectorySnapshot, error) {
+	snapshot, err := hubClient(config, nil).Directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config.HubPublicKey != "" && config.HubPublicKey != snapshot.HubPublicKey {
+		return nil, fmt.Errorf("hub signing key has changed; refusing the directory snapshot")
+	}
+	hubKey, err := pinnedHubKey(config, snapshot.HubPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := snapshot.Verify(hubKey); err != nil {
+		return nil, err
+	}
+
+	if err := paths.EnsureConfigDir(); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %v", err)
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal directory snapshot: %v", err)
+	}
+	if err := os.WriteFile(paths.GetConfigPath(directoryFile), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write directory snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// refreshDirectory renews the cached snapshot once it is older than
+// directoryRefreshAge; failures are left for the next online command
+func refreshDirectory(ctx context.Context, config *Config) {
+	snapshot, err := loadDirectorySnapshot()
+	if err == nil && snapshot != nil && time.Since(snapshot.GeneratedAt) < directoryRefreshAge {
+		return
+	}
+	syncDirectory(ctx, config)
+}
+
+// offlineRecipient resolves a recipient from the cached directory snapshot, which
+// must still be valid and signed by the pinned hub key
+func offlineRecipient(config *Config, nameOrID string) (*User, error) {
+	snapshot, err := loadDirectorySnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("no directory snapshot for offline use; run 'clsp directory --sync' while online")
+	}
+	if config.HubPublicKey == "" {
+		return nil, fmt.Errorf("no pinned hub key to check the directory snapshot with")
+	}
+	hubKey, err := crypto.LoadPublicKeyFromPEM([]byte(config.HubPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hub public key: %v", err)
+	}
+	if err := snapshot.Verify(hubKey); err != nil {
+		return nil, err
+	}
+	if time.Now().After(snapshot.ExpiresAt) {
+		return nil, fmt.Errorf("the directory snapshot expired on %s; sync it while online", snapshot.ExpiresAt.Format(time.RFC3339))
+	}
+	user, ok := snapshot.Find(nameOrID)
+	if !ok {
+		return nil, fmt.Errorf("recipient not found in the directory snapshot of %s: %s", snapshot.GeneratedAt.Format(time.RFC3339), nameOrID)
+	}
+	return user, nil
+}
+
+// ShowDirectory downloads the directory snapshot when sync is set, then lists the
+// cached snapshot's users, optionally only those whose display name contains search
+func ShowDirectory(ctx context.Context, sync bool, search string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	snapshot, err := loadDirectorySnapshot()
+	if err != nil {
+		return err
+	}
+	if sync {
+		if snapshot, err = syncDirectory(ctx, config); err != nil {
+			return err
+		}
+	}
+	if snapshot == nil {
+		return fmt.Errorf("no directory snapshot yet; download one with 'clsp directory --sync'")
+	}
+
+	var users []clspclient.DirectoryEntry
+	for _, u := range snapshot.Users {
+		if search == "" || strings.Contains(strings.ToLower(u.DisplayName), strings.ToLower(search)) {
+			users = append(users, u)
+		}
+	}
+	if JSONOutput {
+		return printJSON(users)
+	}
+
+	opts := renderOptionsFromConfig(config)
+	fmt.Printf("Directory snapshot of %s (%d users, valid until %s)\n",
+		snapshot.GeneratedAt.Format(time.RFC3339), len(snapshot.Users), snapshot.ExpiresAt.Format(time.RFC3339))
+	for _, u := range users {
+		fingerprint, err := keyFingerprint(u.PublicKey)
+		if err != nil {
+			fingerprint = "invalid key"
+		}
+		fmt.Printf("  %s (%s) %s\n", safeLine(u.DisplayName, opts), safeLine(u.ID, opts), crypto.ShortenFingerprint(fingerprint))
+	}
+	return nil
+}
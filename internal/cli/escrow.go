@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// SetEscrow turns key escrow on or off. Turning it on shows the hub's escrow key and
+// what escrow means, and records the key only after the user agrees; sends then fail
+// rather than escrow to any other key the hub may publish later.
+func SetEscrow(ctx context.Context, enable bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if !enable {
+		if config.EscrowFingerprint == "" {
+			fmt.Println("Key escrow is already off")
+			return nil
+		}
+		config.EscrowFingerprint = ""
+		if err := SaveConfig(config); err != nil {
+			return err
+		}
+		fmt.Println("Key escrow turned off; messages you send from now on are not escrowed")
+		fmt.Println("Messages sent while it was on stay readable with the recovery key until they expire")
+		return nil
+	}
+
+	info, err := hubClient(config, nil).Health(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reach hub: %v", err)
+	}
+	fingerprint, err := info.Config.EscrowFingerprint()
+	if err != nil {
+		return err
+	}
+	if fingerprint == "" {
+		return fmt.Errorf("this hub publishes no escrow key; key escrow is only for organizations that require it")
+	}
+	if fingerprint == config.EscrowFingerprint {
+		fmt.Printf("Key escrow is already on (recovery key %s)\n", crypto.ShortenFingerprint(fingerprint))
+		return nil
+	}
+
+	fmt.Println("WARNING: key escrow weakens end-to-end encryption.")
+	fmt.Println("With escrow on, the key of every message you send is also encrypted to your")
+	fmt.Println("organization's recovery key. Whoever holds that key can read those messages,")
+	fmt.Println("and neither you nor the recipient will know when they do. Recipients see that")
+	fmt.Println("your messages are escrowed. Only turn this on if your organization requires it.")
+	fmt.Printf("\nRecovery key fingerprint: %s\n", fingerprint)
+	if config.EscrowFingerprint != "" {
+		fmt.Printf("This REPLACES the recovery key you agreed to before: %s\n", config.EscrowFingerprint)
+	}
+	fmt.Println("Check this fingerprint with your organization before agreeing.")
+	fmt.Print("Escrow the keys of messages you send to this recovery key? (y/N): ")
+	var response string
+	fmt.Scanln(&response)
+	if response != "y" && response != "Y" {
+		return fmt.Errorf("key escrow not turned on")
+	}
+
+	config.EscrowFingerprint = fingerprint
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	fmt.Println("Key escrow turned on; 'clsp config --escrow off' turns it off again")
+	return nil
+}
+
+// escrowFingerprint returns the escrow key fingerprint to send with, or "" when the
+// user has not agreed to escrow. A hub that dropped its escrow key gets the message
+// unescrowed; one that replaced the key gets nothing until the user agrees again.
+func escrowFingerprint(ctx context.Context, config *Config, client *clspclient.Client) (string, error) {
+	if config.EscrowFingerprint == "" {
+		return "", nil
+	}
+	info, err := client.CachedHealth(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	current, err := info.Config.EscrowFingerprint()
+	if err != nil {
+		return "", err
+	}
+	switch current {
+	case "":
+		fmt.Fprintln(notices(), "Note: the hub no longer publishes an escrow key; this message is not escrowed")
+		return "", nil
+	case config.EscrowFingerprint:
+		return current, nil
+	}
+	return "", fmt.Errorf("not sent: the hub's escrow key changed to %s, which you have not agreed to; review it with 'clsp config --escrow on' or turn escrow off with 'clsp config --escrow off'",
+		crypto.ShortenFingerprint(current))
+}
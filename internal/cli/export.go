@@ -0,0 +1,315 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Transcript is a conversation exported for audit: every message with how its
+// signature checked out, the key it was signed with and the time the hub accepted it,
+// together with the keys in effect and the state of the local archive
+type Transcript struct {
+	ExportedAt time.Time `json:"exported_at"`
+	Hub        string    `json:"hub"`
+	// You and Contact are the two parties with the keys in effect at export time
+	You     TranscriptParty `json:"you"`
+	Contact TranscriptParty `json:"contact"`
+	// Archive is the integrity check of the local message archive the received
+	// messages come from
+	Archive  *ArchiveIntegrity `json:"archive"`
+	Messages []TranscriptEntry `json:"messages"`
+}
+
+// TranscriptParty is one side of an exported conversation
+type TranscriptParty struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name,omitempty"`
+	// Fingerprint is the identity key fingerprint; for the contact, the pinned one
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// SigningKey is the Ed25519 signing key fingerprint, if any
+	SigningKey string `json:"signing_key,omitempty"`
+	// PinnedAt and VerifiedAt tell when the contact's key was pinned and compared
+	// out-of-band (clsp verify)
+	PinnedAt   *time.Time `json:"pinned_at,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// PreviousKeys are fingerprints of keys replaced by rotations the pin followed
+	PreviousKeys []string `json:"previous_keys,omitempty"`
+}
+
+// TranscriptEntry is one message of a transcript
+type TranscriptEntry struct {
+	MessageJSON
+	// Direction is received or sent
+	Direction   string `json:"direction"`
+	RecipientID string `json:"recipient_id"`
+	// TimeSource tells where Time comes from: hub for received messages, whose
+	// timestamp the hub checked against its clock, and local for the copies of
+	// messages you sent
+	TimeSource string `json:"time_source"`
+	// SignatureAlg is rsa or ed25519, and SignedWith the fingerprint of the key the
+	// signature verified with (empty when it did not verify). For sent messages they
+	// describe the copy kept locally, which is signed with your identity key.
+	SignatureAlg string `json:"signature_alg"`
+	SignedWith   string `json:"signed_with,omitempty"`
+	// Digest is the SHA-256 of the stored envelope (of the first part of a split
+	// message), as recorded in the archive integrity chain for received messages
+	Digest string `json:"digest"`
+}
+
+// ExportConversation writes the transcript of the conversation with user (an alias,
+// display name or user ID) to out, as text or, with --json, as JSON. Messages are
+// synced from the hub first unless source is ListLocal.
+func ExportConversation(ctx context.Context, user string, source ListSource, out io.Writer) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	h, err := readConversations(ctx, config, store, privateKey, keys, source)
+	if err != nil {
+		return err
+	}
+	archive, err := store.verifyIntegrity(ctx, crypto.LocalMACKey(privateKey))
+	if err != nil {
+		return err
+	}
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return err
+	}
+
+	counterpart := resolveContact(ctx, config, user, source != ListLocal)
+	aliases, names := contactNames(config)
+	t := &Transcript{
+		ExportedAt: time.Now().UTC(),
+		Hub:        config.HubURL,
+		You:        TranscriptParty{ID: config.UserID, DisplayName: config.DisplayName},
+		Contact:    TranscriptParty{ID: counterpart, DisplayName: names[counterpart]},
+		Archive:    archive,
+		Messages:   []TranscriptEntry{},
+	}
+	if fingerprint, err := crypto.Fingerprint(&privateKey.PublicKey); err == nil {
+		t.You.Fingerprint = fingerprint
+	}
+	if signingKey, err := loadSigningPublicKey(); err == nil && signingKey != nil {
+		t.You.SigningKey = crypto.SigningKeyFingerprint(signingKey)
+	}
+	pin, pinned := known.Keys[counterpart]
+	if pinned {
+		firstSeen := pin.FirstSeen.UTC()
+		t.Contact.Fingerprint = pin.Fingerprint
+		t.Contact.PinnedAt = &firstSeen
+		t.Contact.VerifiedAt = pin.VerifiedAt
+		if t.Contact.DisplayName == "" {
+			t.Contact.DisplayName = pin.DisplayName
+		}
+		if key, err := crypto.LoadSigningPublicKeyFromPEM(pin.SigningKey); pin.SigningKey != "" && err == nil {
+			t.Contact.SigningKey = crypto.SigningKeyFingerprint(key)
+		}
+		for _, previous := range pin.PreviousKeys {
+			if fingerprint, err := keyFingerprint(previous); err == nil {
+				t.Contact.PreviousKeys = append(t.Contact.PreviousKeys, fingerprint)
+			}
+		}
+	}
+
+	for _, r := range h.received {
+		if r.msg.Sender != counterpart {
+			continue
+		}
+		entry := transcriptEntry(r, "received", "hub")
+		if r.signature != SignatureInvalid && pinned {
+			entry.SignedWith = pinnedKeyUsed(pin, &r.msg)
+		}
+		t.Messages = append(t.Messages, entry)
+	}
+	for _, r := range h.sent {
+		if r.msg.Recipient != counterpart {
+			continue
+		}
+		entry := transcriptEntry(r, "sent", "local")
+		for _, key := range append([]*rsa.PrivateKey{privateKey}, keys.Retired...) {
+			if crypto.VerifySignature(&key.PublicKey, &r.msg) == nil {
+				entry.SignedWith, _ = crypto.Fingerprint(&key.PublicKey)
+				break
+			}
+		}
+		t.Messages = append(t.Messages, entry)
+	}
+	sort.SliceStable(t.Messages, func(i, j int) bool { return t.Messages[i].Time.Before(t.Messages[j].Time) })
+
+	if JSONOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	}
+	label := contactLabel(counterpart, aliases, names)
+	if label == counterpart && t.Contact.DisplayName != "" {
+		label = t.Contact.DisplayName
+	}
+	writeTranscript(out, t, label, renderOptionsFromConfig(config))
+	return nil
+}
+
+// transcriptEntry describes a message for a transcript. As in 'clsp list', the content
+// of a message whose signature is invalid is withheld; its digest still identifies it.
+func transcriptEntry(r receivedMessage, direction, timeSource string) TranscriptEntry {
+	entry := TranscriptEntry{
+		MessageJSON:  messageJSON(r),
+		Direction:    direction,
+		RecipientID:  r.msg.Recipient,
+		TimeSource:   timeSource,
+		SignatureAlg: "rsa",
+	}
+	if r.msg.SignatureAlg == crypto.SignatureEd25519 {
+		entry.SignatureAlg = "ed25519"
+	}
+	if digest, err := archiveDigest(&r.msg); err == nil {
+		entry.Digest = hex.EncodeToString(digest)
+	}
+	return entry
+}
+
+// pinnedKeyUsed returns the fingerprint of the pinned key of a contact that msg's
+// signature verifies with, looking at keys replaced by rotations too
+func pinnedKeyUsed(pin KnownKey, msg *crypto.Message) string {
+	if msg.SignatureAlg == crypto.SignatureEd25519 {
+		key, err := crypto.LoadSigningPublicKeyFromPEM(pin.SigningKey)
+		if pin.SigningKey == "" || err != nil || crypto.VerifyMessageSignature(nil, key, msg) != nil {
+			return ""
+		}
+		return "Ed25519 " + crypto.SigningKeyFingerprint(key)
+	}
+	for _, pemKey := range append([]string{pin.PublicKey}, pin.PreviousKeys...) {
+		key, err := crypto.LoadPublicKeyFromPEM([]byte(pemKey))
+		if err != nil || crypto.VerifySignature(key, msg) != nil {
+			continue
+		}
+		fingerprint, _ := crypto.Fingerprint(key)
+		return fingerprint
+	}
+	return ""
+}
+
+// writeTranscript prints a transcript as text
+func writeTranscript(out io.Writer, t *Transcript, label string, opts renderOptions) {
+	party := func(role string, p TranscriptParty) {
+		fmt.Fprintf(out, "%s: %s (%s)\n", role, safeLine(p.DisplayName, opts), safeLine(p.ID, opts))
+		if p.Fingerprint == "" {
+			fmt.Fprintln(out, "  Key fingerprint: none pinned")
+		} else {
+			fmt.Fprintf(out, "  Key fingerprint: %s\n", p.Fingerprint)
+		}
+		if p.SigningKey != "" {
+			fmt.Fprintf(out, "  Signing key: Ed25519 %s\n", p.SigningKey)
+		}
+		if p.PinnedAt != nil {
+			fmt.Fprintf(out, "  Pinned: %s\n", p.PinnedAt.Format(time.RFC3339))
+		}
+		if p.VerifiedAt != nil {
+			fmt.Fprintf(out, "  Verified out-of-band: %s\n", p.VerifiedAt.UTC().Format(time.RFC3339))
+		} else if p.Fingerprint != "" && role == "Contact" {
+			fmt.Fprintln(out, "  Verified out-of-band: no")
+		}
+		for _, previous := range p.PreviousKeys {
+			fmt.Fprintf(out, "  Previous key: %s\n", previous)
+		}
+	}
+
+	fmt.Fprintf(out, "CLSP conversation transcript with %s\n", safeLine(label, opts))
+	fmt.Fprintf(out, "Exported: %s\n", t.ExportedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "Hub: %s\n", safeLine(t.Hub, opts))
+	party("You", t.You)
+	party("Contact", t.Contact)
+	if t.Archive.OK() {
+		fmt.Fprintf(out, "Archive integrity: OK (%d messages)\n", t.Archive.Intact)
+	} else {
+		fmt.Fprintln(out, "Archive integrity: FAILED; the local archive was changed outside clsp (see 'clsp archive verify')")
+	}
+	fmt.Fprintf(out, "Messages: %d\n", len(t.Messages))
+
+	for _, m := range t.Messages {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "\n---\nMessage ID: %s\n", safeLine(m.ID, opts))
+		if len(m.PartIDs) > 1 {
+			fmt.Fprintf(&b, "Parts: %s\n", safeLine(strings.Join(m.PartIDs, ", "), opts))
+		} else if m.Parts > 0 {
+			fmt.Fprintf(&b, "Part: %d of %d (other parts not received)\n", m.Part, m.Parts)
+		}
+		fmt.Fprintf(&b, "Direction: %s\n", m.Direction)
+		fmt.Fprintf(&b, "From: %s\n", safeLine(m.SenderID, opts))
+		fmt.Fprintf(&b, "To: %s\n", safeLine(m.RecipientID, opts))
+		if m.TimeSource == "hub" {
+			fmt.Fprintf(&b, "Hub time: %s\n", m.Time.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(&b, "Sent: %s (local clock)\n", m.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(&b, "Status: %s\n", safeLine(m.Status, opts))
+		if m.InReplyTo != "" {
+			fmt.Fprintf(&b, "In reply to: %s\n", safeLine(m.InReplyTo, opts))
+		}
+		copyOf := ""
+		if m.Direction == "sent" {
+			copyOf = "Local copy "
+		}
+		fmt.Fprintf(&b, "%sSignature: %s (%s)\n", copyOf, m.Signature, m.SignatureAlg)
+		if m.SignedWith != "" {
+			fmt.Fprintf(&b, "%sSigned with: %s\n", copyOf, m.SignedWith)
+		}
+		if m.Escrowed {
+			fmt.Fprintln(&b, "Escrowed: yes")
+		}
+		fmt.Fprintf(&b, "%sEnvelope SHA-256: %s\n", copyOf, m.Digest)
+		if a := m.Attachment; a != nil {
+			fmt.Fprintf(&b, "Attachment: %s (%s, %d bytes)\n", safeLine(a.Filename, opts), safeLine(a.ContentType, opts), a.Size)
+			if a.SHA256 != "" {
+				fmt.Fprintf(&b, "Attachment SHA-256: %s\n", a.SHA256)
+			}
+		}
+		if m.Signature == SignatureInvalid {
+			fmt.Fprintln(&b, "Message: [withheld: the signature does not match the sender's key]")
+		} else {
+			indent := strings.Repeat(" ", len("Message: "))
+			fmt.Fprintf(&b, "Message: %s\n", strings.TrimPrefix(renderBody(m.Content, opts, indent), indent))
+		}
+		out.Write(b.Bytes())
+	}
+}
+
+// ExportConversationFile writes the transcript to path instead of standard output.
+// The file is not encrypted, even with encryption at rest, so it can be read outside clsp.
+func ExportConversationFile(ctx context.Context, user string, source ListSource, path string) error {
+	var b bytes.Buffer
+	if err := ExportConversation(ctx, user, source, &b); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write transcript: %v", err)
+	}
+	fmt.Fprintf(notices(), "Transcript written to %s\n", path)
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package cli
+
+import "os"
+
+// tryLockFile always succeeds where the platform has no file locking
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+// unlockFile is a no-op where the platform has no file locking
+func unlockFile(f *os.File) error {
+	return nil
+}
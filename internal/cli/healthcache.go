@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// healthCacheFile holds recent hub health checks so consecutive commands skip them
+const healthCacheFile = "hub_health.json"
+
+// cachedHealth is one hub's entry in the health cache file
+type cachedHealth struct {
+	Info      HubInfo       `json:"info"`
+	ClockSkew time.Duration `json:"clock_skew"`
+	Fetched   time.Time     `json:"fetched"`
+}
+
+// fileHealthCache is a clspclient.HealthCache kept in the runtime directory, shared by
+// every clsp process of the user. Losing it only costs a health check, so it is
+// written without locking and any unreadable content is ignored.
+type fileHealthCache struct{}
+
+// hubHealth is the health cache used by every hub client of this process
+var hubHealth clspclient.HealthCache = fileHealthCache{}
+
+func (fileHealthCache) path() (string, error) {
+	return paths.GetRuntimePath(healthCacheFile)
+}
+
+func (f fileHealthCache) load() map[string]cachedHealth {
+	entries := make(map[string]cachedHealth)
+	path, err := f.path()
+	if err != nil {
+		return entries
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &entries)
+	}
+	return entries
+}
+
+func (f fileHealthCache) save(entries map[string]cachedHealth) {
+	path, err := f.path()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	writeFileAtomic(path, data, 0600)
+}
+
+func (f fileHealthCache) Get(hubURL string) (*HubInfo, time.Time, bool) {
+	e, ok := f.load()[hubURL]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	info := e.Info
+	info.ClockSkew = e.ClockSkew
+	return &info, e.Fetched, true
+}
+
+func (f fileHealthCache) Put(hubURL string, info *HubInfo, fetched time.Time) {
+	entries := f.load()
+	entries[hubURL] = cachedHealth{Info: *info, ClockSkew: info.ClockSkew, Fetched: fetched}
+	f.save(entries)
+}
+
+func (f fileHealthCache) Forget(hubURL string) {
+	entries := f.load()
+	if _, ok := entries[hubURL]; !ok {
+		return
+	}
+	delete(entries, hubURL)
+	f.save(entries)
+}
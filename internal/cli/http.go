@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// DefaultRequestTimeout bounds hub requests made before the hub's own timeout is known
+const DefaultRequestTimeout = 5 * time.Second
+
+// newHubClient returns an HTTP client for talking to the hub. If ctx already carries
+// a deadline (for example from the global --timeout flag), that deadline governs the
+// request instead of the fixed per-request timeout.
+func newHubClient(ctx context.Context, timeout time.Duration) *http.Client {
+	if _, ok := ctx.Deadline(); ok {
+		timeout = 0
+	}
+	return &http.Client{
+		Timeout: timeout,
+	}
+}
+
+// EnableVerbose logs every HTTP request this process makes, with its status and
+// duration, to stderr (for --verbose). Query strings are left out, as they carry
+// request signatures.
+func EnableVerbose() {
+	http.DefaultTransport = verboseTransport{next: http.DefaultTransport}
+}
+
+// verboseTransport logs the requests it passes on to next
+type verboseTransport struct {
+	next http.RoundTripper
+}
+
+func (t verboseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Round(100 * time.Microsecond)
+	target := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[http] %s %s failed after %s: %v\n", req.Method, target, elapsed, err)
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[http] %s %s -> %d (%s)\n", req.Method, target, resp.StatusCode, elapsed)
+	return resp, nil
+}
+
+// hubClient returns a hub client acting as the configured identity. key may be nil
+// for calls that neither encrypt, decrypt nor sign.
+func hubClient(config *Config, key *rsa.PrivateKey) *clspclient.Client {
+	client := newClient(config.HubURL, config.UserID, key)
+	client.CipherSuites = config.CipherSuites
+	client.Compression = config.Compression
+	return client
+}
+
+// lookupClient returns a hub client to look nameOrID up with. Users of other hubs are
+// looked up through a signed request, so the identity key is loaded for them.
+func lookupClient(config *Config, nameOrID string) (*clspclient.Client, error) {
+	if !strings.Contains(nameOrID, "@") {
+		return hubClient(config, nil), nil
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+	return hubClient(config, privateKey), nil
+}
+
+// newClient returns a hub client that reuses recent health checks from the cache
+// shared by all clsp commands, instead of repeating one before every request
+func newClient(hubURL, userID string, key *rsa.PrivateKey) *clspclient.Client {
+	client := clspclient.New(hubURL, userID, key)
+	client.HealthCache = hubHealth
+	// Identities with a signing key sign messages and requests with it
+	if key != nil {
+		signingKey, err := loadSigningKey(key)
+		if err != nil {
+			fmt.Fprintf(notices(), "Warning: signing with the identity key instead: %v\n", err)
+		}
+		client.SigningKey = signingKey
+	}
+	return client
+}
+
+// hubGet performs a GET request bound to ctx
+func hubGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// hubPost performs a POST request bound to ctx, so cancelling ctx aborts a partial upload
+func hubPost(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return client.Do(req)
+}
@@ -0,0 +1,264 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// resolveHubURL returns hubURL, or the configured hub when it is empty
+func resolveHubURL(hubURL string) (string, error) {
+	if hubURL != "" {
+		return hubURL, nil
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return "", fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.HubURL == "" {
+		return "", fmt.Errorf("no hub configured; use --hub or 'clsp config --set-hub'")
+	}
+	return config.HubURL, nil
+}
+
+// ShowHubInfo prints the status, configuration and API version of a hub
+// (the configured hub when hubURL is empty)
+func ShowHubInfo(ctx context.Context, hubURL string) error {
+	hubURL, err := resolveHubURL(hubURL)
+	if err != nil {
+		return err
+	}
+	client := newClient(hubURL, "", nil)
+
+	// Always ask the hub here; the fresh answer also updates the cache
+	info, err := warnClockSkew(client.Health(ctx))
+	if err != nil {
+		return err
+	}
+	config, err := client.Config(ctx)
+	if err != nil {
+		return err
+	}
+	info.Config = *config
+
+	fmt.Printf("Hub: %s\n", hubURL)
+	fmt.Printf("Status: %s\n", info.Status)
+	if !info.ServerTime.IsZero() {
+		fmt.Printf("Hub time: %s (%s)\n", info.ServerTime.Local().Format(time.RFC3339), describeSkew(info.ClockSkew))
+	}
+	fmt.Printf("Round trip: %v\n", info.RoundTrip.Round(time.Millisecond))
+	if info.Protocol > 0 {
+		fmt.Printf("Protocol: version %d (hub speaks %s)\n", info.Protocol, joinInts(info.ProtocolVersions))
+	} else {
+		fmt.Println("Protocol: unversioned (older hub)")
+	}
+	if len(info.EnvelopeFormats) > 0 {
+		fmt.Printf("Envelope formats: %s\n", strings.Join(info.EnvelopeFormats, ", "))
+	}
+	printHubConfig(info)
+
+	schema, err := client.Schema(ctx)
+	switch {
+	case errors.Is(err, clspclient.ErrNoSchema):
+		fmt.Println("API schema: not published (older hub)")
+	case err != nil:
+		fmt.Printf("API schema: unavailable (%v)\n", err)
+	default:
+		fmt.Printf("API schema: version %d, %d endpoints\n", schema.Version, len(schema.Endpoints))
+		fmt.Printf("Message formats: %s\n", joinInts(schema.MessageVersions))
+		if schema.Version != clspclient.SchemaVersion {
+			fmt.Printf("Warning: this client expects API schema version %d\n", clspclient.SchemaVersion)
+		}
+	}
+	return nil
+}
+
+// printHubConfig prints the parts of a hub's configuration that matter to its users
+func printHubConfig(info *HubInfo) {
+	if info.Config.MessageExpiry > 0 {
+		fmt.Printf("Message expiry: %v\n", info.Config.MessageExpiry)
+	} else {
+		fmt.Println("Message expiry: never")
+	}
+	switch {
+	case info.Config.RequireClientCert:
+		fmt.Println("TLS: enabled, client certificate required")
+	case info.Config.UseTLS:
+		fmt.Println("TLS: enabled")
+	default:
+		fmt.Println("TLS: disabled")
+	}
+	switch {
+	case info.Config.RequireOIDC && info.Config.RequireInvite:
+		fmt.Printf("Registration: single sign-on via %s, with an invite code\n", info.Config.OIDCIssuer)
+	case info.Config.RequireOIDC:
+		fmt.Printf("Registration: single sign-on via %s\n", info.Config.OIDCIssuer)
+	case info.Config.RequireInvite:
+		fmt.Println("Registration: invite only")
+	default:
+		fmt.Println("Registration: open")
+	}
+}
+
+// MeasureHubLatency times count health checks against a hub and prints the spread
+func MeasureHubLatency(ctx context.Context, hubURL string, count int) error {
+	hubURL, err := resolveHubURL(hubURL)
+	if err != nil {
+		return err
+	}
+	if count < 1 {
+		return fmt.Errorf("count must be at least 1")
+	}
+	client := clspclient.New(hubURL, "", nil)
+
+	var rtts []time.Duration
+	var skew time.Duration
+	failed := 0
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		info, err := client.Health(ctx)
+		if err != nil {
+			fmt.Printf("  #%d: %v\n", i+1, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  #%d: %v\n", i+1, info.RoundTrip.Round(100*time.Microsecond))
+		rtts = append(rtts, info.RoundTrip)
+		skew = info.ClockSkew
+	}
+
+	fmt.Printf("\n%s: %d sent, %d failed\n", hubURL, count, failed)
+	if len(rtts) == 0 {
+		return fmt.Errorf("hub did not answer")
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	var total time.Duration
+	for _, d := range rtts {
+		total += d
+	}
+	fmt.Printf("Round trip: min %v, avg %v, median %v, max %v\n",
+		rtts[0].Round(100*time.Microsecond),
+		(total / time.Duration(len(rtts))).Round(100*time.Microsecond),
+		rtts[len(rtts)/2].Round(100*time.Microsecond),
+		rtts[len(rtts)-1].Round(100*time.Microsecond))
+	fmt.Printf("Clock: %s\n", describeSkew(skew))
+	return nil
+}
+
+// ShowHubLimits prints the limits a hub enforces on its users
+func ShowHubLimits(ctx context.Context, hubURL string) error {
+	hubURL, err := resolveHubURL(hubURL)
+	if err != nil {
+		return err
+	}
+	client := clspclient.New(hubURL, "", nil)
+
+	var limits clspclient.SchemaLimits
+	schema, err := client.Schema(ctx)
+	switch {
+	case err == nil:
+		limits = schema.Limits
+	case errors.Is(err, clspclient.ErrNoSchema):
+		// Older hubs publish the same values in their configuration
+		config, err := client.Config(ctx)
+		if err != nil {
+			return err
+		}
+		limits = clspclient.SchemaLimits{
+			MaxMessageSize:     config.MaxMessageSize,
+			RateLimit:          config.RateLimit,
+			MaxStorageBytes:    config.MaxStorageBytes,
+			MaxUsers:           config.MaxUsers,
+			MaxAttachmentSize:  config.MaxAttachmentSize,
+			MessageExpiry:      int64(config.MessageExpiry / time.Second),
+			ClockSkewTolerance: int64(config.ClockSkewTolerance / time.Second),
+		}
+	default:
+		return err
+	}
+
+	fmt.Printf("Limits of %s:\n", hubURL)
+	fmt.Printf("  Message size:     %s\n", limitString(int64(limits.MaxMessageSize), formatSize(int64(limits.MaxMessageSize))+" per part (longer messages are split)"))
+	fmt.Printf("  Attachment size:  %s\n", limitString(limits.MaxAttachmentSize, formatSize(limits.MaxAttachmentSize)))
+	fmt.Printf("  Send rate:        %s\n", limitString(int64(limits.RateLimit), fmt.Sprintf("%d messages/minute", limits.RateLimit)))
+	fmt.Printf("  Message expiry:   %s\n", limitString(limits.MessageExpiry, (time.Duration(limits.MessageExpiry)*time.Second).String()))
+	fmt.Printf("  Hub storage:      %s\n", limitString(limits.MaxStorageBytes, formatSize(limits.MaxStorageBytes)))
+	fmt.Printf("  Accounts:         %s\n", limitString(int64(limits.MaxUsers), fmt.Sprintf("%d", limits.MaxUsers)))
+	fmt.Printf("  Clock tolerance:  %s\n", limitString(limits.ClockSkewTolerance, (time.Duration(limits.ClockSkewTolerance)*time.Second).String()))
+	return nil
+}
+
+// SizeLimitHint suggests what to do about err when the hub refused something as too
+// large, and returns "" for other errors
+func SizeLimitHint(err error) string {
+	var tooLarge *clspclient.TooLargeError
+	if !errors.As(err, &tooLarge) {
+		return ""
+	}
+	switch tooLarge.Code {
+	case clspclient.LimitMessageSize:
+		return "The hub's message size limit changed since clsp last checked it; send again and the message is split to fit."
+	case clspclient.LimitAttachmentSize:
+		return "Send a smaller file, or ask the hub operator to raise its attachment limit ('clsp hub limits' shows it)."
+	default:
+		return "See 'clsp hub limits' for what the hub accepts."
+	}
+}
+
+// limitString returns description, or "unlimited" when the limit is zero
+func limitString(limit int64, description string) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return description
+}
+
+// formatSize renders a byte count with a binary unit
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// describeSkew explains a clock difference to the hub
+func describeSkew(skew time.Duration) string {
+	skew = skew.Round(time.Second)
+	switch {
+	case skew == 0:
+		return "in sync with this machine"
+	case skew > 0:
+		return fmt.Sprintf("%v ahead of this machine", skew)
+	default:
+		return fmt.Sprintf("%v behind this machine", -skew)
+	}
+}
+
+// joinInts renders a list of numbers separated by commas
+func joinInts(values []int) string {
+	s := ""
+	for i, v := range values {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d", v)
+	}
+	return s
+}
@@ -0,0 +1,207 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Privacy levels for notifications, inbox summaries and badges
+const (
+	PrivacyFull   = "full"   // sender names and content previews
+	PrivacyCounts = "counts" // message counts only
+	PrivacyNone   = "none"   // no message information at all
+)
+
+// previewWidth is the maximum display width of a content preview
+const previewWidth = 40
+
+// ValidPrivacyLevel reports whether level is a known privacy level
+func ValidPrivacyLevel(level string) bool {
+	switch level {
+	case PrivacyFull, PrivacyCounts, PrivacyNone:
+		return true
+	}
+	return false
+}
+
+// privacyLevel returns the configured privacy level, defaulting to full previews
+func (c *Config) privacyLevel() string {
+	if ValidPrivacyLevel(c.PrivacyLevel) {
+		return c.PrivacyLevel
+	}
+	return PrivacyFull
+}
+
+// inboxEntry is one unread message as it may be shown in a summary
+type inboxEntry struct {
+	Sender  string
+	Preview string
+}
+
+// fetchUnread returns the unread messages waiting on the hub without marking them read
+func fetchUnread(ctx context.Context, config *Config) ([]crypto.Message, error) {
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+	messages, _, err := fetchMessages(ctx, config, privateKey, true, 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	// The hub only knows of explicit reads; messages already shown by 'clsp list'
+	// are read as far as the summary is concerned
+	if messages, err = dropLocallyRead(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	// A split message counts once, represented by its first part
+	whole := messages[:0]
+	for _, msg := range messages {
+		if msg.Part == nil || msg.Part.Index == 0 {
+			whole = append(whole, msg)
+		}
+	}
+	return whole, nil
+}
+
+// inboxEntries builds summary entries for messages. Senders and previews are only
+// resolved at the full privacy level, so lower levels never need the private key.
+func inboxEntries(ctx context.Context, config *Config, messages []crypto.Message) ([]inboxEntry, error) {
+	entries := make([]inboxEntry, len(messages))
+	if config.privacyLevel() != PrivacyFull {
+		return entries, nil
+	}
+
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string]string, len(config.UserAliases))
+	for alias, id := range config.UserAliases {
+		aliases[id] = alias
+	}
+
+	signatures, err := newSignatureChecker(ctx, config, privateKey, true)
+	if err != nil {
+		return nil, err
+	}
+	defer signatures.save()
+
+	opts := renderOptionsFromConfig(config)
+	for i := range messages {
+		msg := &messages[i]
+		sender := msg.Sender
+		if alias, ok := aliases[sender]; ok {
+			sender = alias
+		}
+		entries[i].Sender = safeLine(sender, opts)
+
+		if signatures.check(msg) == SignatureInvalid {
+			entries[i].Preview = "(invalid signature; see 'clsp list')"
+			continue
+		}
+		content, err := crypto.DecryptMessage(keys, msg)
+		if err != nil {
+			entries[i].Preview = "(unable to decrypt)"
+			continue
+		}
+		entries[i].Preview = previewText(string(content), opts)
+	}
+	return entries, nil
+}
+
+// previewText reduces a message body to a single sanitized line of at most previewWidth columns
+func previewText(s string, opts renderOptions) string {
+	line := safeLine(strings.Join(strings.Fields(s), " "), opts)
+	if displayWidth(line) <= previewWidth {
+		return line
+	}
+	head, _ := splitAtWidth(line, previewWidth-3)
+	return head + "..."
+}
+
+// formatInboxSummary renders entries at the given privacy level; it returns an empty
+// string when there is nothing to show. Every notification surface should go through
+// this so the privacy level is applied the same way everywhere.
+func formatInboxSummary(level string, entries []inboxEntry) string {
+	switch level {
+	case PrivacyNone:
+		return ""
+	case PrivacyCounts:
+		return fmt.Sprintf("%d unread message(s)", len(entries))
+	}
+
+	if len(entries) == 0 {
+		return "No unread messages"
+	}
+
+	// Group by sender, keeping the first preview from each
+	counts := make(map[string]int)
+	previews := make(map[string]string)
+	var senders []string
+	for _, e := range entries {
+		if counts[e.Sender] == 0 {
+			senders = append(senders, e.Sender)
+			previews[e.Sender] = e.Preview
+		}
+		counts[e.Sender]++
+	}
+	sort.SliceStable(senders, func(i, j int) bool { return counts[senders[i]] > counts[senders[j]] })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d unread message(s)", len(entries))
+	for _, s := range senders {
+		fmt.Fprintf(&b, "\n  %s (%d): %s", s, counts[s], previews[s])
+	}
+	return b.String()
+}
+
+// formatBadge renders the unread count for status bars; nothing is shown at the none level
+func formatBadge(level string, entries []inboxEntry) string {
+	if level == PrivacyNone {
+		return ""
+	}
+	return fmt.Sprintf("%d", len(entries))
+}
+
+// InboxSummary prints a summary of unread messages, or just the badge count,
+// honouring the configured privacy level
+func InboxSummary(ctx context.Context, badge bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	level := config.privacyLevel()
+	if level == PrivacyNone {
+		return nil
+	}
+
+	messages, err := fetchUnread(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if badge {
+		fmt.Println(formatBadge(level, make([]inboxEntry, len(messages))))
+		return nil
+	}
+
+	entries, err := inboxEntries(ctx, config, messages)
+	if err != nil {
+		return err
+	}
+	fmt.Println(formatInboxSummary(level, entries))
+	return nil
+}
@@ -15,7 +15,7 @@ func Install() error {
 	}
 
 	// Create default config if it doesn't exist
-	configPath := paths.GetConfigPath("config.json")
+	configPath := paths.GetConfigPath(configFile)
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		config := DefaultConfig()
 		if err := SaveConfig(config); err != nil {
@@ -31,7 +31,7 @@ func Install() error {
 
 // IsInstalled checks if CLSP is properly installed
 func IsInstalled() bool {
-	configPath := paths.GetConfigPath("config.json")
+	configPath := paths.GetConfigPath(configFile)
 	_, err := os.Stat(configPath)
 	return err == nil
 }
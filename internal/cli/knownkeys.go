@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// KnownKey is a contact's public key pinned locally
+type KnownKey struct {
+	DisplayName string    `json:"display_name"`
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastChecked time.Time `json:"last_checked"`
+	// ChangedAt is set while the directory offers a key different from the pinned one
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+	// RemovedAt is set while the contact is missing from the directory
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+	// VerifiedAt is set once the user compared the pinned fingerprint with the contact
+	// out-of-band (clsp verify); pinning a different key clears it
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// SigningKey is the contact's Ed25519 signing key (PEM) once seen certified by the
+	// pinned key; pinning a different key clears it
+	SigningKey string `json:"signing_key,omitempty"`
+	// PreviousKeys are keys the contact replaced by key rotations the pin followed, so
+	// messages they signed before a rotation still verify
+	PreviousKeys []string `json:"previous_keys,omitempty"`
+}
+
+// KnownKeys is the local pin store, keyed by user ID
+type KnownKeys struct {
+	LastAudit time.Time           `json:"last_audit"`
+	Keys      map[string]KnownKey `json:"keys"`
+}
+
+// knownKeysPath returns the location of the pin store
+func knownKeysPath() string {
+	return paths.GetConfigPath("known_keys.json")
+}
+
+// LoadKnownKeys reads the pin store, returning an empty one if none exists yet
+func LoadKnownKeys() (*KnownKeys, error) {
+	known := &KnownKeys{Keys: make(map[string]KnownKey)}
+	data, err := readLocalFile(knownKeysPath())
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known keys: %v", err)
+	}
+	if err := json.Unmarshal(data, known); err != nil {
+		return nil, fmt.Errorf("failed to parse known keys: %v", err)
+	}
+	if known.Keys == nil {
+		known.Keys = make(map[string]KnownKey)
+	}
+	return known, nil
+}
+
+// SaveKnownKeys writes the pin store
+func SaveKnownKeys(known *KnownKeys) error {
+	if err := paths.EnsureConfigDir(); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	data, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal known keys: %v", err)
+	}
+	if err := writeLocalFile(knownKeysPath(), data); err != nil {
+		return fmt.Errorf("failed to write known keys: %v", err)
+	}
+	return nil
+}
+
+// Key verification states reported for a contact's current directory key
+const (
+	KeyVerified   = "verified"
+	KeyUnverified = "unverified"
+	KeyChanged    = "changed"
+)
+
+// keyState describes the key with fingerprint that the directory offers for userID
+// against the local pins
+func (k *KnownKeys) keyState(userID, fingerprint string) string {
+	pin, ok := k.Keys[userID]
+	switch {
+	case !ok:
+		return KeyUnverified
+	case pin.Fingerprint != fingerprint:
+		return KeyChanged
+	case pin.VerifiedAt != nil:
+		return KeyVerified
+	default:
+		return KeyUnverified
+	}
+}
+
+// checkPinnedKey compares the key the hub offers for a recipient with the pinned one,
+// like SSH known_hosts: a contact seen for the first time is pinned, and a key that
+// differs from its pin is refused until the user accepts it.
+func checkPinnedKey(config *Config, recipient *User) error {
+	fingerprint, err := keyFingerprint(recipient.PublicKey)
+	if err != nil {
+		return fmt.Errorf("hub offers an invalid key for %s: %v", recipient.DisplayName, err)
+	}
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return err
+	}
+
+	opts := renderOptionsFromConfig(config)
+	name := safeLine(recipient.DisplayName, opts)
+	now := time.Now()
+	pin, ok := known.Keys[recipient.ID]
+	switch {
+	case !ok:
+		known.Keys[recipient.ID] = KnownKey{
+			DisplayName: recipient.DisplayName,
+			Fingerprint: fingerprint,
+			PublicKey:   recipient.PublicKey,
+			FirstSeen:   now,
+			LastChecked: now,
+		}
+		if err := SaveKnownKeys(known); err != nil {
+			return err
+		}
+		fmt.Fprintf(notices(), "Pinned the key of %s on first use (fingerprint %s)\n", name, crypto.ShortenFingerprint(fingerprint))
+		fmt.Fprintf(notices(), "Compare it with %s and run 'clsp verify %s' to mark it verified\n", name, safeLine(recipient.DisplayName, opts))
+		return nil
+	case pin.Fingerprint == fingerprint:
+		return nil
+	}
+
+	if known.followRotation(recipient, fingerprint) {
+		if err := SaveKnownKeys(known); err != nil {
+			return err
+		}
+		rotationNotice(name, pin.Fingerprint, fingerprint)
+		return nil
+	}
+	if pin.ChangedAt == nil {
+		pin.ChangedAt = &now
+		known.Keys[recipient.ID] = pin
+		if err := SaveKnownKeys(known); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nWARNING: THE KEY OF %s HAS CHANGED\n", strings.ToUpper(name))
+	fmt.Fprintf(os.Stderr, "  pinned  %s (since %s)\n", pin.Fingerprint, pin.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(os.Stderr, "  offered %s\n", fingerprint)
+	fmt.Fprintln(os.Stderr, "Either the contact replaced their key or someone, possibly the hub, is intercepting")
+	fmt.Fprintln(os.Stderr, "your messages. Confirm the new fingerprint with them out-of-band, then accept it")
+	fmt.Fprintf(os.Stderr, "with 'clsp verify %s'.\n\n", safeLine(recipient.DisplayName, opts))
+	return fmt.Errorf("not sent: the key of %s differs from the pinned key", name)
+}
+
+// followRotation pins the key u offers if it replaced the pinned key through key
+// rotations signed by the pinned key and, once seen, the pinned signing key. The pin
+// stays verified, since the pinned key vouched for its successor. It reports whether
+// the pin was updated.
+func (k *KnownKeys) followRotation(u *User, fingerprint string) bool {
+	pin, ok := k.Keys[u.ID]
+	if !ok || len(u.KeyRotations) == 0 {
+		return false
+	}
+	var signingKey ed25519.PublicKey
+	if pin.SigningKey != "" {
+		key, err := crypto.LoadSigningPublicKeyFromPEM(pin.SigningKey)
+		if err != nil {
+			return false
+		}
+		signingKey = key
+	}
+	if u.RotatedFrom(pin.PublicKey, signingKey) != nil {
+		return false
+	}
+
+	pin.PreviousKeys = append(pin.PreviousKeys, pin.PublicKey)
+	pin.Fingerprint = fingerprint
+	pin.PublicKey = u.PublicKey
+	pin.SigningKey = ""
+	if newKey, err := crypto.LoadPublicKeyFromPEM([]byte(u.PublicKey)); err == nil {
+		if _, err := u.VerifySigningKey(newKey); err == nil {
+			pin.SigningKey = u.SigningKey
+		}
+	}
+	pin.ChangedAt = nil
+	pin.LastChecked = time.Now()
+	k.Keys[u.ID] = pin
+	return true
+}
+
+// rotationNotice tells the user a contact's pin followed a key rotation
+func rotationNotice(name, from, to string) {
+	fmt.Fprintf(notices(), "%s rotated their key from %s to %s; the new key is signed by the pinned one and is pinned now\n",
+		name, crypto.ShortenFingerprint(from), crypto.ShortenFingerprint(to))
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspapi"
+)
+
+// Announcement represents a hub-signed service notice
+type Announcement = clspapi.Announcement
+
+// fetchAnnouncements downloads the active announcements and verifies them against the pinned hub key
+func fetchAnnouncements(ctx context.Context, config *Config) ([]Announcement, error) {
+	api := &clspapi.Client{BaseURL: config.HubURL, HTTPClient: newHubClient(ctx, DefaultRequestTimeout)}
+
+	feed, err := api.GetAnnouncements(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get announcements: %v", err)
+	}
+
+	// Pin the hub key on first use and refuse announcements signed by anything else
+	if config.HubPublicKey == "" {
+		config.HubPublicKey = feed.HubPublicKey
+	} else if config.HubPublicKey != feed.HubPublicKey {
+		return nil, fmt.Errorf("hub signing key has changed; refusing to show announcements")
+	}
+
+	hubKey, err := crypto.LoadPublicKeyFromPEM([]byte(config.HubPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hub public key: %v", err)
+	}
+
+	var verified []Announcement
+	for _, ann := range feed.Announcements {
+		payload := crypto.AnnouncementPayload(ann.ID, ann.Body, ann.CreatedAt.Unix(), ann.ExpiresAt.Unix())
+		if err := crypto.VerifyData(hubKey, payload, ann.Signature); err != nil {
+			fmt.Printf("Warning: ignoring announcement %s with invalid signature\n", ann.ID)
+			continue
+		}
+		verified = append(verified, ann)
+	}
+
+	return verified, nil
+}
+
+// ShowAnnouncements prints hub announcements. Unless all is set, only notices that
+// have not been acknowledged yet are shown, and they are acknowledged afterwards.
+func ShowAnnouncements(ctx context.Context, all bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	announcements, err := fetchAnnouncements(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	shown := printAnnouncements(config, announcements, all)
+	if shown == 0 {
+		fmt.Println("No new announcements")
+	}
+
+	if err := SaveConfig(config); err != nil {
+		return fmt.Errorf("failed to save config: %v", err)
+	}
+	return nil
+}
+
+// NotifyAnnouncements shows unacknowledged announcements at command startup.
+// It is best-effort: any failure is silently ignored so it never blocks a command.
+func NotifyAnnouncements(ctx context.Context) {
+	config, err := LoadConfig()
+	if err != nil || config.UserID == "" {
+		return
+	}
+
+	announcements, err := fetchAnnouncements(ctx, config)
+	if err != nil {
+		return
+	}
+
+	if printAnnouncements(config, announcements, false) > 0 {
+		fmt.Println()
+	}
+	SaveConfig(config)
+}
+
+// printAnnouncements prints the given announcements and records them as acknowledged
+func printAnnouncements(config *Config, announcements []Announcement, all bool) int {
+	acked := make(map[string]bool)
+	for _, id := range config.AckedAnnouncements {
+		acked[id] = true
+	}
+
+	opts := renderOptionsFromConfig(config)
+	shown := 0
+	var stillActive []string
+	for _, ann := range announcements {
+		if all || !acked[ann.ID] {
+			fmt.Printf("[Hub notice %s]\n%s\n", ann.CreatedAt.Format("2006-01-02 15:04"), renderBody(ann.Body, opts, "  "))
+			shown++
+		}
+		stillActive = append(stillActive, ann.ID)
+	}
+
+	// Only remember announcements the hub still serves so the list doesn't grow forever
+	config.AckedAnnouncements = stillActive
+	return shown
+}
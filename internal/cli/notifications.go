@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// localTimezone returns the IANA name of this machine's time zone, or "" when it
+// cannot be determined
+func localTimezone() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
+	}
+	if name := time.Local.String(); name != "Local" {
+		return name
+	}
+	// /etc/localtime is usually a link into the zoneinfo database
+	if target, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+		if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+			return target[i+len("zoneinfo/"):]
+		}
+	}
+	return ""
+}
+
+// parseQuietHours parses a window given as HH:MM-HH:MM
+func parseQuietHours(window, timezone string) (*clspclient.QuietHours, error) {
+	start, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("quiet hours must look like 22:00-07:00")
+	}
+	for _, t := range []string{start, end} {
+		if _, err := time.Parse("15:04", t); err != nil {
+			return nil, fmt.Errorf("invalid time of day %q (use HH:MM)", t)
+		}
+	}
+	if timezone == "" {
+		timezone = localTimezone()
+		if timezone == "" {
+			return nil, fmt.Errorf("could not determine your time zone; pass --tz (e.g. Europe/Berlin)")
+		}
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", timezone)
+	}
+	return &clspclient.QuietHours{Start: start, End: end, Timezone: timezone}, nil
+}
+
+// Notifications shows the user's notification settings on the hub, or changes them.
+// webhook and quiet are left unchanged when empty and cleared when "off"; quiet is a
+// window such as 22:00-07:00 in timezone (this machine's zone when empty).
+func Notifications(ctx context.Context, webhook, quiet, timezone string) error {
+	if timezone != "" && (quiet == "" || quiet == "off") {
+		return fmt.Errorf("--tz only applies together with --quiet")
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	client := hubClient(config, privateKey)
+
+	settings, err := client.Notifications(ctx)
+	if err != nil {
+		return err
+	}
+	if webhook != "" || quiet != "" {
+		switch webhook {
+		case "":
+		case "off":
+			settings.WebhookURL = ""
+		default:
+			settings.WebhookURL = webhook
+		}
+		switch quiet {
+		case "":
+		case "off":
+			settings.QuietHours = nil
+		default:
+			if settings.QuietHours, err = parseQuietHours(quiet, timezone); err != nil {
+				return err
+			}
+		}
+		if settings, err = client.SetNotifications(ctx, *settings); err != nil {
+			return err
+		}
+		fmt.Fprintln(notices(), "Notification settings updated")
+	}
+
+	if JSONOutput {
+		return printJSON(settings)
+	}
+	if settings.WebhookURL != "" {
+		fmt.Printf("Webhook: %s\n", settings.WebhookURL)
+	} else {
+		fmt.Println("Webhook: none")
+	}
+	if q := settings.QuietHours; q != nil {
+		zone := q.Timezone
+		if zone == "" {
+			zone = "UTC"
+		}
+		fmt.Printf("Quiet hours: %s-%s (%s)\n", q.Start, q.End, zone)
+	} else {
+		fmt.Println("Quiet hours: none")
+	}
+	return nil
+}
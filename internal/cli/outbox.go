@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// queuedMessage is a message encrypted while the hub was unreachable, kept in the
+// outbox until it can be posted
+type queuedMessage struct {
+	// Recipient is the name or ID the message was addressed to, for display
+	Recipient string          `json:"recipient"`
+	Envelope  *crypto.Message `json:"envelope"`
+	QueuedAt  time.Time       `json:"queued_at"`
+}
+
+// OutboxJSON is a queued message as shown by `clsp outbox --json`
+type OutboxJSON struct {
+	ID        string    `json:"id"`
+	Recipient string    `json:"recipient"`
+	QueuedAt  time.Time `json:"queued_at"`
+}
+
+// createOutbox creates the table of queued messages. Rows are sealed like archived
+// envelopes, so with encryption at rest the outbox does not reveal recipients.
+func createOutbox(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			id TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			queued_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox: %v", err)
+	}
+	return nil
+}
+
+// queue adds a message to the outbox
+func (st *localStore) queue(ctx context.Context, q *queuedMessage) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("failed to encode queued message: %v", err)
+	}
+	sealed, err := sealLocalData(data)
+	if err != nil {
+		return err
+	}
+	_, err = st.db.ExecContext(ctx, "INSERT INTO outbox (id, data, queued_at) VALUES (?, ?, ?)", q.Envelope.ID, sealed, q.QueuedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to queue message: %v", err)
+	}
+	return nil
+}
+
+// queued returns the outbox, oldest first
+func (st *localStore) queued(ctx context.Context) ([]*queuedMessage, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT data FROM outbox ORDER BY queued_at, rowid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []*queuedMessage
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read outbox: %v", err)
+		}
+		plain, err := openLocalData(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open queued message: %v", err)
+		}
+		var q queuedMessage
+		if err := json.Unmarshal(plain, &q); err != nil || q.Envelope == nil {
+			return nil, fmt.Errorf("corrupt queued message")
+		}
+		messages = append(messages, &q)
+	}
+	return messages, rows.Err()
+}
+
+// dequeue removes a message from the outbox
+func (st *localStore) dequeue(ctx context.Context, id string) error {
+	if _, err := st.db.ExecContext(ctx, "DELETE FROM outbox WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to update outbox: %v", err)
+	}
+	return nil
+}
+
+// queueOffline encrypts a message to the recipient found in the cached directory
+// snapshot and keeps it in the outbox for the next time the hub is reachable
+func queueOffline(ctx context.Context, config *Config, client *clspclient.Client, recipient, message string, allowDuplicate bool) error {
+	if config.EscrowFingerprint != "" {
+		return fmt.Errorf("key escrow is on, which needs the hub's current escrow key; try again once the hub is reachable")
+	}
+	user, err := offlineRecipient(config, recipient)
+	if err != nil {
+		return err
+	}
+	if err := checkPinnedKey(config, user); err != nil {
+		return err
+	}
+	msg, err := client.SealMessage(user, []byte(message), allowDuplicate)
+	if err != nil {
+		return err
+	}
+
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.queue(ctx, &queuedMessage{Recipient: recipient, Envelope: msg, QueuedAt: time.Now()}); err != nil {
+		return err
+	}
+	if err := store.recordSent(ctx, client.Key, config.UserID, user.ID, []string{msg.ID}, []byte(message), "", time.Now(), time.Time{}); err != nil {
+		fmt.Fprintf(notices(), "Warning: %v\n", err)
+	}
+	fmt.Printf("Hub unreachable; message to %s queued in the outbox\n", recipient)
+	fmt.Printf("Message ID: %s (sent with the next online 'clsp send' or 'clsp list', or 'clsp outbox --flush')\n", msg.ID)
+	return nil
+}
+
+// flushOutbox posts queued messages, oldest first, stamped with the hub's time. It
+// stops at the first failure, leaving the rest queued, and returns how many were sent.
+func flushOutbox(ctx context.Context, client *clspclient.Client, store *localStore) (int, error) {
+	queue, err := store.queued(ctx)
+	if err != nil || len(queue) == 0 {
+		return 0, err
+	}
+	info, err := client.CachedHealth(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, q := range queue {
+		q.Envelope.Timestamp = info.HubNow().Unix()
+		if _, err := client.PostEnvelope(ctx, q.Envelope); err != nil {
+			return sent, fmt.Errorf("failed to send queued message %s: %v", q.Envelope.ID, err)
+		}
+		if err := store.dequeue(ctx, q.Envelope.ID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// sendQueued flushes the outbox before an online command, reporting the outcome as
+// a notice so the command itself goes ahead either way
+func sendQueued(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, store *localStore) {
+	sent, err := flushOutbox(ctx, hubClient(config, privateKey), store)
+	if sent > 0 {
+		fmt.Fprintf(notices(), "Sent %d queued message(s) from the outbox\n", sent)
+	}
+	if err != nil {
+		fmt.Fprintf(notices(), "Warning: %v; it stays in the outbox\n", err)
+	}
+}
+
+// Outbox lists the queued messages, or sends them when flush is set
+func Outbox(ctx context.Context, flush bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if flush {
+		privateKey, err := loadIdentityKey()
+		if err != nil {
+			return fmt.Errorf("failed to load private key: %v", err)
+		}
+		sent, err := flushOutbox(ctx, hubClient(config, privateKey), store)
+		fmt.Printf("Sent %d queued message(s)\n", sent)
+		return err
+	}
+
+	queue, err := store.queued(ctx)
+	if err != nil {
+		return err
+	}
+	if JSONOutput {
+		out := make([]OutboxJSON, 0, len(queue))
+		for _, q := range queue {
+			out = append(out, OutboxJSON{ID: q.Envelope.ID, Recipient: q.Recipient, QueuedAt: q.QueuedAt})
+		}
+		return printJSON(out)
+	}
+	if len(queue) == 0 {
+		fmt.Println("The outbox is empty")
+		return nil
+	}
+	opts := renderOptionsFromConfig(config)
+	for _, q := range queue {
+		fmt.Printf("%s to %s, queued %s\n", q.Envelope.ID, safeLine(q.Recipient, opts), q.QueuedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("%d message(s) waiting; send them with 'clsp outbox --flush'\n", len(queue))
+	return nil
+}
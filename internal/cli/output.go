@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// JSONOutput makes commands that support it print JSON on stdout instead of text;
+// warnings and prompts then go to stderr so stdout stays parseable
+var JSONOutput bool
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// notices returns where informational messages go: stdout normally, stderr in JSON mode
+func notices() io.Writer {
+	if JSONOutput {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// MessageJSON is a received message in `clsp list --json` output
+type MessageJSON struct {
+	ID       string `json:"id"`
+	SenderID string `json:"sender_id"`
+	// RecipientID is set on your own messages in `clsp list --with` output
+	RecipientID string    `json:"recipient_id,omitempty"`
+	Time        time.Time `json:"time"`
+	Status      string    `json:"status"`
+	// Content is empty when Signature is invalid
+	Content string `json:"content"`
+	// Signature is the sender authenticity state: verified, unverified or invalid
+	Signature string `json:"signature"`
+	// Escrowed is set when the sender also wrapped the message key to their
+	// organization's recovery key
+	Escrowed bool `json:"escrowed,omitempty"`
+	// PartIDs lists the IDs of every part of a reassembled split message
+	PartIDs []string `json:"part_ids,omitempty"`
+	// Part and Parts locate a piece of a split message whose other parts are missing
+	Part       int             `json:"part,omitempty"`
+	Parts      int             `json:"parts,omitempty"`
+	Attachment *AttachmentJSON `json:"attachment,omitempty"`
+	// InReplyTo is the ID of the message this one answers
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	// Depth is the nesting level of a reply in `clsp list --thread` output
+	Depth int `json:"depth,omitempty"`
+	// ExpiresAt is when the message is deleted at its sender's request
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AttachmentJSON describes a message attachment in JSON output
+type AttachmentJSON struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// SHA256 is the hex digest of the content and ModTime the modification time of the
+	// sender's file, when the sender recorded them
+	SHA256  string     `json:"sha256,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+}
+
+// ScreenedJSON is a message in `clsp screened list --json` output
+type ScreenedJSON struct {
+	MessageJSON
+	// Rule is the kind of screening rule the message matched
+	Rule string `json:"rule"`
+}
+
+// ScreenRulesJSON is the output of `clsp screened rules --json`
+type ScreenRulesJSON struct {
+	Rules   []ScreenRule `json:"rules"`
+	Allowed []string     `json:"allowed"`
+}
+
+// UserJSON is a directory entry in `clsp users --json` output
+type UserJSON struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Alias       string `json:"alias,omitempty"`
+	// Fingerprint and KeyState are set with --fingerprint; KeyState is one of
+	// verified, unverified, changed or you
+	Fingerprint string `json:"fingerprint,omitempty"`
+	KeyState    string `json:"key_state,omitempty"`
+}
+
+// messageJSON converts a decrypted message for JSON output
+func messageJSON(r receivedMessage) MessageJSON {
+	out := MessageJSON{
+		ID:        r.msg.ID,
+		SenderID:  r.msg.Sender,
+		Time:      time.Unix(r.msg.Timestamp, 0).UTC(),
+		Status:    r.msg.Status,
+		Content:   string(r.content),
+		Signature: r.signature,
+		Escrowed:  r.escrowed,
+		InReplyTo: r.msg.InReplyTo,
+	}
+	if r.signature == SignatureInvalid {
+		out.Content = ""
+	}
+	if r.msg.ExpiresAt != 0 {
+		expiresAt := time.Unix(r.msg.ExpiresAt, 0).UTC()
+		out.ExpiresAt = &expiresAt
+	}
+	switch {
+	case r.parts > 1:
+		out.PartIDs = r.ids
+	case r.missing:
+		out.Part = r.msg.Part.Index + 1
+		out.Parts = r.msg.Part.Total
+	}
+	if a := r.msg.Attachment; a != nil {
+		out.Attachment = &AttachmentJSON{Filename: a.Filename, ContentType: a.ContentType, Size: a.Size}
+		if len(a.SHA256) > 0 {
+			out.Attachment.SHA256 = hex.EncodeToString(a.SHA256)
+		}
+		if a.ModTime != 0 {
+			modTime := time.Unix(a.ModTime, 0).UTC()
+			out.Attachment.ModTime = &modTime
+		}
+	}
+	return out
+}
+
+// ConfigJSON is the configuration as shown by `clsp config --show --json`
+type ConfigJSON struct {
+	*Config
+	// EncryptionAtRest is the key source of local file encryption, empty when off
+	EncryptionAtRest string `json:"encryption_at_rest"`
+}
+
+// ShowConfigJSON prints the configuration as JSON
+func ShowConfigJSON(config *Config) error {
+	source, err := LocalEncryption()
+	if err != nil {
+		return fmt.Errorf("failed to read encryption settings: %v", err)
+	}
+	return printJSON(ConfigJSON{Config: config, EncryptionAtRest: source})
+}
+
+// signatureBadge describes a message's signature state for text output
+func signatureBadge(state string) string {
+	switch state {
+	case SignatureVerified:
+		return "verified (signed by the sender's pinned key)"
+	case SignatureInvalid:
+		return "INVALID (not signed by the sender's key)"
+	default:
+		return "unverified (sender's key not pinned or changed; see 'clsp verify')"
+	}
+}
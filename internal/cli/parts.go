@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"sort"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// receivedMessage is a decrypted message ready for display
+type receivedMessage struct {
+	msg     crypto.Message
+	content []byte
+	// parts is the number of pieces the content was reassembled from (zero for a whole message)
+	parts int
+	// ids lists the message IDs of all reassembled pieces
+	ids []string
+	// missing is set on a piece whose siblings have not all arrived yet
+	missing bool
+	// signature is the sender authenticity state (see SignatureVerified)
+	signature string
+	// escrowed is set when the sender escrowed the message key (of any part)
+	escrowed bool
+}
+
+// joinParts reassembles split messages whose parts are all present. The assembled
+// message takes the place of its first part; parts of incomplete groups are kept
+// as they are and marked missing.
+func joinParts(received []receivedMessage) []receivedMessage {
+	groups := make(map[string][]receivedMessage)
+	for _, r := range received {
+		if p := r.msg.Part; p != nil {
+			groups[p.Group] = append(groups[p.Group], r)
+		}
+	}
+
+	var out []receivedMessage
+	emitted := make(map[string]bool)
+	for _, r := range received {
+		p := r.msg.Part
+		if p == nil {
+			out = append(out, r)
+			continue
+		}
+		if emitted[p.Group] {
+			continue
+		}
+
+		pieces := groups[p.Group]
+		sort.Slice(pieces, func(i, j int) bool { return pieces[i].msg.Part.Index < pieces[j].msg.Part.Index })
+		if !completeGroup(pieces) {
+			r.missing = true
+			out = append(out, r)
+			continue
+		}
+
+		emitted[p.Group] = true
+		assembled := pieces[0]
+		assembled.parts = len(pieces)
+		assembled.content = nil
+		for _, piece := range pieces {
+			assembled.content = append(assembled.content, piece.content...)
+			assembled.ids = append(assembled.ids, piece.msg.ID)
+			assembled.signature = weakerSignature(assembled.signature, piece.signature)
+			assembled.escrowed = assembled.escrowed || piece.escrowed
+			if piece.msg.Attachment != nil {
+				assembled.msg.Attachment = piece.msg.Attachment
+			}
+		}
+		out = append(out, assembled)
+	}
+	return out
+}
+
+// completeGroup reports whether sorted pieces hold every part of their message exactly once
+func completeGroup(pieces []receivedMessage) bool {
+	total := pieces[0].msg.Part.Total
+	if total <= 0 || len(pieces) != total {
+		return false
+	}
+	for i, piece := range pieces {
+		if piece.msg.Part.Index != i || piece.msg.Part.Total != total {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+const (
+	// prekeyRotation is how long a prekey is offered to senders before it is replaced
+	prekeyRotation = 7 * 24 * time.Hour
+	// prekeyGrace covers senders working from a stale directory listing
+	prekeyGrace = 24 * time.Hour
+)
+
+// storedPrekey is the private half of a prekey kept on this device
+type storedPrekey struct {
+	ID         string    `json:"id"`
+	PrivateKey []byte    `json:"private_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// prekeysPath returns the location of the prekey file, next to the identity key
+func prekeysPath() string {
+	return paths.GetKeyPath("prekeys")
+}
+
+// loadPrekeys reads this device's prekeys, oldest first; the file is sealed with the identity key
+func loadPrekeys(identity *rsa.PrivateKey) ([]storedPrekey, error) {
+	sealed, err := os.ReadFile(prekeysPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prekeys: %v", err)
+	}
+	data, err := crypto.OpenLocal(identity, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open prekeys: %v", err)
+	}
+	var prekeys []storedPrekey
+	if err := json.Unmarshal(data, &prekeys); err != nil {
+		return nil, fmt.Errorf("failed to parse prekeys: %v", err)
+	}
+	sort.Slice(prekeys, func(i, j int) bool { return prekeys[i].CreatedAt.Before(prekeys[j].CreatedAt) })
+	return prekeys, nil
+}
+
+// savePrekeys writes this device's prekeys sealed with the identity key
+func savePrekeys(identity *rsa.PrivateKey, prekeys []storedPrekey) error {
+	data, err := json.Marshal(prekeys)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prekeys: %v", err)
+	}
+	sealed, err := crypto.SealLocal(identity, data)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(prekeysPath(), sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write prekeys: %v", err)
+	}
+	return nil
+}
+
+// refreshPrekeys publishes a new prekey when none exists or the current one is due for
+// rotation, and deletes retired prekeys once every message encrypted to them must have
+// expired on the hub. Deleting them is what provides forward secrecy: messages
+// encrypted to a deleted prekey cannot be read even if the identity key leaks.
+func refreshPrekeys(ctx context.Context, config *Config, identity *rsa.PrivateKey, hubInfo *HubInfo) error {
+	prekeys, err := loadPrekeys(identity)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// Publish afresh if the directory offers a prekey this device does not hold, as
+	// after restoring the identity elsewhere; senders would otherwise use it
+	stale := len(prekeys) == 0 || now.Sub(prekeys[len(prekeys)-1].CreatedAt) >= prekeyRotation
+	if !stale {
+		published, err := publishedPrekey(ctx, config)
+		if err != nil {
+			return err
+		}
+		// A prekey offering other suites than configured is replaced too, so a
+		// change made with 'clsp config --cipher-suites' reaches senders at once, as
+		// do the compression algorithms of a newer clsp
+		stale = published == nil || !hasPrekey(prekeys, published.ID) ||
+			strings.Join(published.Suites, ",") != strings.Join(crypto.PrekeySuites(OfferedCipherSuites(config)), ",")
+	}
+
+	changed := false
+	if stale {
+		prekey, private, err := hubClient(config, identity).PublishPrekey(ctx)
+		if err != nil {
+			return err
+		}
+		prekeys = append(prekeys, storedPrekey{
+			ID:         prekey.ID,
+			PrivateKey: private.Bytes(),
+			CreatedAt:  time.Unix(prekey.CreatedAt, 0),
+		})
+		changed = true
+	}
+
+	// A prekey stops being offered when its successor is published; messages sent to
+	// it until then stay on the hub for at most the message expiry (forever without one)
+	retention := hubInfo.Config.MessageExpiry + prekeyGrace
+	kept := prekeys[:0]
+	for i, p := range prekeys {
+		if hubInfo.Config.MessageExpiry > 0 && i < len(prekeys)-1 && now.Sub(prekeys[i+1].CreatedAt) > retention {
+			changed = true
+			continue
+		}
+		kept = append(kept, p)
+	}
+
+	if !changed {
+		return nil
+	}
+	return savePrekeys(identity, kept)
+}
+
+// publishedPrekey returns the prekey the directory offers for this user, or nil
+func publishedPrekey(ctx context.Context, config *Config) (*clspclient.Prekey, error) {
+	users, err := hubClient(config, nil).Users(ctx, clspclient.UserQuery{Search: config.DisplayName})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.ID == config.UserID && u.Prekey != nil {
+			return u.Prekey, nil
+		}
+	}
+	return nil, nil
+}
+
+// OfferedCipherSuites returns the cipher suites published with this user's prekeys
+func OfferedCipherSuites(config *Config) []string {
+	if len(config.CipherSuites) > 0 {
+		return config.CipherSuites
+	}
+	return crypto.CipherSuites()
+}
+
+// ParseCipherSuites parses a comma-separated list of cipher suites for
+// 'clsp config --cipher-suites', most preferred first; "default" yields nil
+func ParseCipherSuites(list string) ([]string, error) {
+	if list == "default" {
+		return nil, nil
+	}
+	var suites []string
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if _, ok := crypto.LookupCipherSuite(id); !ok || id == "" {
+			return nil, fmt.Errorf("unknown cipher suite %q (supported: %s)", id, strings.Join(crypto.CipherSuites(), ", "))
+		}
+		for _, s := range suites {
+			if s == id {
+				return nil, fmt.Errorf("cipher suite %s listed twice", id)
+			}
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// ParseCompression parses the algorithm for 'clsp config --compression'; "off" yields
+// the empty string for none
+func ParseCompression(value string) (string, error) {
+	if value == "off" {
+		return "", nil
+	}
+	if !crypto.IsCompression(value) {
+		return "", fmt.Errorf("unknown compression %q (supported: %s, or off)", value, strings.Join(crypto.Compressions(), ", "))
+	}
+	return value, nil
+}
+
+// hasPrekey reports whether prekeys holds the prekey with the given ID
+func hasPrekey(prekeys []storedPrekey, id string) bool {
+	for _, p := range prekeys {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ensurePrekeys runs refreshPrekeys, reporting failures as a warning: without a
+// current prekey senders fall back to the identity key, so messaging keeps working
+func ensurePrekeys(ctx context.Context, config *Config, identity *rsa.PrivateKey) {
+	if config.RegistrationPending {
+		return
+	}
+	hubInfo, err := CheckHubHealth(ctx, config.HubURL)
+	if err == nil {
+		err = refreshPrekeys(ctx, config, identity, hubInfo)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not refresh prekeys: %v\n", err)
+	}
+}
+
+// loadKeyring returns the keys that decrypt this user's messages, including identity
+// keys replaced by key rotations
+func loadKeyring(identity *rsa.PrivateKey) (*crypto.Keyring, error) {
+	keys := &crypto.Keyring{
+		Identity: identity,
+		Prekeys:  make(map[string]*ecdh.PrivateKey),
+	}
+	prekeys, err := loadPrekeys(identity)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range prekeys {
+		private, err := ecdh.X25519().NewPrivateKey(p.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt prekey %s: %v", p.ID, err)
+		}
+		keys.Prekeys[p.ID] = private
+	}
+	retired, err := loadRetiredKeys(identity)
+	if err != nil {
+		return nil, err
+	}
+	if keys.Retired, err = parseRetiredKeys(retired); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
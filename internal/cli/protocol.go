@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mattd/clsp/pkg/conformance"
+)
+
+// protocolCheck is one self-test result as printed with --json
+type protocolCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProtocolSelfTest checks that this build encrypts, decrypts and signs exactly as the
+// published test vectors require, so its messages stay readable by other versions and
+// other implementations. It needs no keys or hub.
+func ProtocolSelfTest() error {
+	results := conformance.SelfTest()
+	failed := 0
+	checks := make([]protocolCheck, 0, len(results))
+	for _, r := range results {
+		check := protocolCheck{Name: r.Name, OK: r.Err == nil}
+		if r.Err != nil {
+			check.Error = r.Err.Error()
+			failed++
+		}
+		checks = append(checks, check)
+	}
+
+	if JSONOutput {
+		if err := printJSON(checks); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range checks {
+			if c.OK {
+				fmt.Printf("ok    %s\n", c.Name)
+			} else {
+				fmt.Printf("FAIL  %s: %s\n", c.Name, c.Error)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed; this build is not compatible with the published protocol", failed, len(checks))
+	}
+	fmt.Fprintf(notices(), "All %d checks passed\n", len(checks))
+	return nil
+}
+
+// ProtocolVectors prints the published test vectors, for checking another
+// implementation against this one
+func ProtocolVectors() error {
+	_, err := os.Stdout.Write(conformance.PublishedJSON())
+	return err
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Proxy settings besides a proxy URL
+const (
+	// ProxyEnvironment uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY (the default)
+	ProxyEnvironment = "env"
+	// ProxyOff connects to the hub directly, ignoring the environment
+	ProxyOff = "off"
+	// ProxyTor routes through the SOCKS port of a local Tor daemon
+	ProxyTor = "tor"
+)
+
+// torSOCKSAddress is where a Tor daemon listens for SOCKS connections by default
+const torSOCKSAddress = "127.0.0.1:9050"
+
+var (
+	// proxyOverride is the proxy given with --proxy, which wins over the configuration
+	proxyOverride string
+	// configuredProxy holds the proxy setting of the last configuration loaded
+	configuredProxy atomic.Value
+)
+
+// UseProxy routes hub requests through the proxy each configuration names, or
+// through override (from --proxy) when it is set. It must be called before any
+// request is made.
+func UseProxy(override string) error {
+	if override != "" {
+		if _, err := ParseProxy(override); err != nil {
+			return err
+		}
+	}
+	proxyOverride = override
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("cannot configure a proxy on %T", http.DefaultTransport)
+	}
+	transport = transport.Clone()
+	transport.Proxy = proxyForRequest
+	http.DefaultTransport = transport
+	return nil
+}
+
+// proxyForRequest returns the proxy req goes through, or nil to connect directly.
+// Onion services cannot be reached directly, so a request to a .onion host that
+// would otherwise go without a proxy goes through the local Tor daemon.
+func proxyForRequest(req *http.Request) (*url.URL, error) {
+	setting := proxyOverride
+	if setting == "" {
+		setting, _ = configuredProxy.Load().(string)
+	}
+	proxy, err := ParseProxy(setting)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil && !strings.EqualFold(setting, ProxyOff) {
+		proxy, err = http.ProxyFromEnvironment(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if proxy == nil && isOnionHost(req.URL.Hostname()) {
+		return ParseProxy(ProxyTor)
+	}
+	return proxy, nil
+}
+
+// isOnionHost reports whether host is a Tor onion service address
+func isOnionHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
+
+// ParseProxy checks a proxy setting and returns the proxy URL it names. It returns a
+// nil URL for "" and ProxyEnvironment, which leave the choice to the environment,
+// and for ProxyOff. A bare host:port is an HTTP proxy.
+func ParseProxy(setting string) (*url.URL, error) {
+	switch strings.ToLower(setting) {
+	case "", ProxyEnvironment, ProxyOff:
+		return nil, nil
+	case ProxyTor:
+		return &url.URL{Scheme: "socks5", Host: torSOCKSAddress}, nil
+	}
+	if !strings.Contains(setting, "://") {
+		setting = "http://" + setting
+	}
+	proxy, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", setting, err)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// Go's SOCKS5 client always leaves name resolution to the proxy
+		proxy.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https, socks5 or socks5h)", proxy.Scheme)
+	}
+	if proxy.Hostname() == "" || proxy.Port() == "" {
+		return nil, fmt.Errorf("proxy %q needs a host and port", setting)
+	}
+	return proxy, nil
+}
+
+// describeProxy returns a proxy setting as shown by 'clsp config --show', with any
+// password hidden
+func describeProxy(setting string) string {
+	switch strings.ToLower(setting) {
+	case "", ProxyEnvironment:
+		return "from the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY)"
+	case ProxyOff:
+		return "off (direct connections)"
+	case ProxyTor:
+		return fmt.Sprintf("tor (socks5://%s)", torSOCKSAddress)
+	}
+	if proxy, err := ParseProxy(setting); err == nil {
+		return proxy.Redacted()
+	}
+	return setting
+}
+
+// DescribeProxy returns the proxy hub requests use under config, for display
+func DescribeProxy(config *Config) string {
+	if proxyOverride != "" {
+		return describeProxy(proxyOverride) + " (from --proxy)"
+	}
+	return describeProxy(config.Proxy)
+}
@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// ReadMessages marks received messages as read, together with the other parts of
+// split messages; with all set, every message not yet read is marked. Unless read
+// receipts are off, the hub records the reads so the senders see the messages move
+// from delivered to read in 'clsp status'. Nothing else marks messages read on the hub.
+func ReadMessages(ctx context.Context, messageIDs []string, all bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var ids []string
+	if all {
+		if ids, err = unreadIDs(ctx, config, store, keys); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			fmt.Println("No unread messages")
+			return nil
+		}
+	}
+	synced := false
+	for _, id := range messageIDs {
+		msg, err := store.Message(ctx, id)
+		if err != nil {
+			return err
+		}
+		// Messages not listed yet are fetched first
+		if msg == nil && !synced {
+			synced = true
+			if err := syncMessages(ctx, config, store, keys, true); err != nil {
+				return fmt.Errorf("failed to fetch messages: %v", err)
+			}
+			if msg, err = store.Message(ctx, id); err != nil {
+				return err
+			}
+		}
+		if msg == nil {
+			return fmt.Errorf("message %s not found (it may have expired, or was not sent to you)", id)
+		}
+		parts, err := store.partIDs(ctx, msg)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, parts...)
+	}
+
+	if err := store.MarkRead(ctx, ids); err != nil {
+		return err
+	}
+	if config.NoReadReceipts {
+		fmt.Printf("Marked %d message(s) read (read receipts are off; the senders were not told)\n", len(ids))
+		return nil
+	}
+	// Receipts that could not be sent before go along with these
+	pending, err := store.pendingReads(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := hubClient(config, privateKey).MarkRead(ctx, append(ids, pending...)); err != nil {
+		if err := store.queueReads(ctx, ids); err != nil {
+			return err
+		}
+		fmt.Printf("Marked %d message(s) read locally; the hub could not be reached (%v), so the receipts are sent with the next online 'clsp list', 'clsp read' or 'clsp watch'\n", len(ids), err)
+		return nil
+	}
+	if err := store.clearReads(ctx, pending); err != nil {
+		return err
+	}
+	fmt.Printf("Marked %d message(s) read\n", len(ids))
+	return nil
+}
+
+// createPendingReads creates the table of read receipts the hub has not been told of
+// yet, so reads made while it was unreachable are not lost
+func createPendingReads(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS pending_reads (id TEXT PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("failed to create pending read receipts: %v", err)
+	}
+	return nil
+}
+
+// queueReads keeps read receipts for sending later
+func (st *localStore) queueReads(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if _, err := st.db.ExecContext(ctx, "INSERT OR IGNORE INTO pending_reads (id) VALUES (?)", id); err != nil {
+			return fmt.Errorf("failed to queue read receipt: %v", err)
+		}
+	}
+	return nil
+}
+
+// pendingReads returns the IDs of messages whose read receipts are still to be sent
+func (st *localStore) pendingReads(ctx context.Context) ([]string, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT id FROM pending_reads")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending read receipts: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read pending read receipts: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// clearReads forgets read receipts once the hub has them
+func (st *localStore) clearReads(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if _, err := st.db.ExecContext(ctx, "DELETE FROM pending_reads WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to update pending read receipts: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendPendingReads tells the hub of reads it missed while unreachable, reporting
+// failures as a notice so the command itself goes ahead. With read receipts turned
+// off since, the pending receipts are dropped instead.
+func sendPendingReads(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, store *localStore) {
+	pending, err := store.pendingReads(ctx)
+	if err != nil || len(pending) == 0 {
+		return
+	}
+	if !config.NoReadReceipts {
+		if _, err := hubClient(config, privateKey).MarkRead(ctx, pending); err != nil {
+			fmt.Fprintf(notices(), "Warning: failed to send %d pending read receipt(s): %v\n", len(pending), err)
+			return
+		}
+	}
+	if err := store.clearReads(ctx, pending); err != nil {
+		fmt.Fprintf(notices(), "Warning: %v\n", err)
+	}
+}
+
+// unreadIDs returns the messages the hub has not recorded as read, which includes
+// those 'clsp list' already showed, together with those unread in the local store.
+// Without the hub only the local store is consulted.
+func unreadIDs(ctx context.Context, config *Config, store *localStore, keys *crypto.Keyring) ([]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	if !config.NoReadReceipts {
+		pending, _, err := fetchMessages(ctx, config, keys.Identity, true, 0, time.Time{})
+		if err != nil {
+			fmt.Fprintf(notices(), "Could not reach the hub (%v); marking the local history only\n", err)
+		}
+		if err := store.Save(ctx, pending, keys); err != nil {
+			return nil, err
+		}
+		for _, msg := range pending {
+			seen[msg.ID] = true
+			ids = append(ids, msg.ID)
+		}
+	}
+	local, err := store.Messages(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range local {
+		if !seen[msg.ID] {
+			ids = append(ids, msg.ID)
+		}
+	}
+	return ids, nil
+}
+
+// dropLocallyRead removes messages the local store has marked read or screened
+func dropLocallyRead(ctx context.Context, messages []crypto.Message) ([]crypto.Message, error) {
+	store, err := openLocalStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	read, err := store.readIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	screened, err := store.screenedIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unread := messages[:0]
+	for _, msg := range messages {
+		if _, ok := screened[msg.ID]; !ok && !read[msg.ID] {
+			unread = append(unread, msg)
+		}
+	}
+	return unread, nil
+}
+
+// Receipts shows the user's receipt policy on the hub, or sets it to policy: everyone,
+// contacts (the users they sent a message to) or none. The hub applies it to
+// delivery and read receipts alike.
+func Receipts(ctx context.Context, policy string) error {
+	switch policy {
+	case "", clspclient.ReceiptsEveryone, clspclient.ReceiptsContacts, clspclient.ReceiptsNone:
+	default:
+		return fmt.Errorf("invalid receipt policy %q (use everyone, contacts or none)", policy)
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	client := hubClient(config, privateKey)
+
+	if policy == "" {
+		policy, err = client.Receipts(ctx)
+	} else {
+		policy, err = client.SetReceipts(ctx, policy)
+	}
+	if err != nil {
+		return err
+	}
+
+	if JSONOutput {
+		return printJSON(map[string]string{"receipts": policy})
+	}
+	switch policy {
+	case clspclient.ReceiptsNone:
+		fmt.Println("Receipts: none (no sender sees when you fetch or read their messages)")
+	case clspclient.ReceiptsContacts:
+		fmt.Println("Receipts: contacts (only people you have sent a message to see when you fetch or read theirs)")
+	default:
+		fmt.Println("Receipts: everyone (senders see when you fetch and read their messages)")
+	}
+	if config.NoReadReceipts && policy != clspclient.ReceiptsNone {
+		fmt.Println("Read receipts are off on this device ('clsp config --read-receipts'), so senders only see deliveries")
+	}
+	return nil
+}
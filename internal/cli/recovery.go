@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// recoveryKeyFile holds the key and ID derived from the recovery phrase, sealed with
+// the identity key, so the recovery kit on the hub can be updated without the phrase
+const recoveryKeyFile = "recovery.key"
+
+// recoverySecret is what the recovery phrase derives
+type recoverySecret struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// loadRecoverySecret returns the recovery key and ID, or nil when no recovery phrase
+// is set up
+func loadRecoverySecret(identity *rsa.PrivateKey) (*recoverySecret, error) {
+	sealed, err := os.ReadFile(paths.GetKeyPath(recoveryKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recovery key: %v", err)
+	}
+	data, err := crypto.OpenLocal(identity, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recovery key: %v", err)
+	}
+	var secret recoverySecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse recovery key: %v", err)
+	}
+	return &secret, nil
+}
+
+// saveRecoverySecret writes the recovery key and ID sealed with the identity key
+func saveRecoverySecret(identity *rsa.PrivateKey, secret *recoverySecret) error {
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovery key: %v", err)
+	}
+	sealed, err := crypto.SealLocal(identity, data)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(paths.GetKeyPath(recoveryKeyFile), sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery key: %v", err)
+	}
+	return nil
+}
+
+// uploadRecoveryKit stores the identity's current files on the hub, encrypted with the
+// recovery key
+func uploadRecoveryKit(ctx context.Context, config *Config, identity *rsa.PrivateKey, secret *recoverySecret) error {
+	backup, err := collectBackup(config)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovery kit: %v", err)
+	}
+	kit, err := crypto.Seal(secret.Key, data)
+	if err != nil {
+		return err
+	}
+	if err := hubClient(config, identity).SetRecovery(ctx, secret.ID, kit); err != nil {
+		return fmt.Errorf("failed to store recovery kit: %v", err)
+	}
+	return nil
+}
+
+// refreshRecoveryKit uploads the identity's files again when a recovery phrase is set
+// up, so recovering does not bring back keys or contacts that have since changed
+func refreshRecoveryKit(ctx context.Context, config *Config, identity *rsa.PrivateKey) error {
+	secret, err := loadRecoverySecret(identity)
+	if err != nil || secret == nil {
+		return err
+	}
+	return uploadRecoveryKit(ctx, config, identity, secret)
+}
+
+// setupRecovery creates a recovery phrase, stores the recovery kit it encrypts on the
+// hub and shows the phrase once
+func setupRecovery(ctx context.Context, config *Config, identity *rsa.PrivateKey) error {
+	phrase, err := crypto.NewMnemonic()
+	if err != nil {
+		return err
+	}
+	entropy, err := crypto.MnemonicEntropy(phrase)
+	if err != nil {
+		return err
+	}
+	key, id, err := crypto.RecoveryKeys(entropy)
+	if err != nil {
+		return err
+	}
+	secret := &recoverySecret{ID: id, Key: key}
+	if err := saveRecoverySecret(identity, secret); err != nil {
+		return err
+	}
+	if err := uploadRecoveryKit(ctx, config, identity, secret); err != nil {
+		os.Remove(paths.GetKeyPath(recoveryKeyFile))
+		return err
+	}
+
+	fmt.Println("\nYour recovery phrase:")
+	fmt.Println()
+	words := strings.Fields(phrase)
+	for i := 0; i < len(words); i += 4 {
+		var line strings.Builder
+		for j := i; j < i+4 && j < len(words); j++ {
+			fmt.Fprintf(&line, "  %2d. %-10s", j+1, words[j])
+		}
+		fmt.Println(strings.TrimRight(line.String(), " "))
+	}
+	fmt.Println("\nWrite it down and keep it somewhere safe; it is not shown again. Anyone with the")
+	fmt.Println("phrase can take over your identity. Recover it on a new device with")
+	fmt.Printf("'clsp restore --mnemonic --hub %s'.\n", config.HubURL)
+	if encrypted, err := crypto.IsPrivateKeyEncrypted(paths.GetKeyPath("private.key")); err == nil && encrypted {
+		fmt.Println("Your private key stays protected by its passphrase, which you will need as well.")
+	}
+	return nil
+}
+
+// offerRecovery asks whether to set up a recovery phrase for a new identity
+func offerRecovery(ctx context.Context, config *Config, identity *rsa.PrivateKey) {
+	fmt.Print("\nCreate a recovery phrase to restore your identity if you lose this device? (Y/n): ")
+	var response string
+	fmt.Scanln(&response)
+	if response == "n" || response == "N" {
+		fmt.Println("You can create one later with 'clsp recovery setup'.")
+		return
+	}
+	if err := setupRecovery(ctx, config, identity); err != nil {
+		fmt.Printf("Warning: recovery phrase not set up: %v\n", err)
+		fmt.Println("Try again with 'clsp recovery setup'.")
+	}
+}
+
+// Recovery shows whether a recovery phrase is set up, or carries out action: "setup"
+// replaces any phrase with a new one, "update" stores the identity's current files in
+// the recovery kit, and "disable" removes the kit from the hub.
+func Recovery(ctx context.Context, action string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.RegistrationPending {
+		return fmt.Errorf("registration is pending; run 'clsp init --resume' first")
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	secret, err := loadRecoverySecret(privateKey)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "":
+		if secret == nil {
+			fmt.Println("No recovery phrase is set up. Create one with 'clsp recovery setup'.")
+		} else {
+			fmt.Println("A recovery phrase is set up; your identity can be recovered with it on a new device.")
+		}
+	case "setup":
+		if secret != nil {
+			fmt.Print("A recovery phrase is already set up. Replace it? The current phrase stops working. (y/N): ")
+			var response string
+			fmt.Scanln(&response)
+			if response != "y" && response != "Y" {
+				return fmt.Errorf("recovery phrase not replaced")
+			}
+		}
+		return setupRecovery(ctx, config, privateKey)
+	case "update":
+		if secret == nil {
+			return fmt.Errorf("no recovery phrase is set up; create one with 'clsp recovery setup'")
+		}
+		if err := uploadRecoveryKit(ctx, config, privateKey, secret); err != nil {
+			return err
+		}
+		fmt.Println("Recovery kit updated")
+	case "disable":
+		if err := hubClient(config, privateKey).DeleteRecovery(ctx); err != nil {
+			return fmt.Errorf("failed to remove recovery kit: %v", err)
+		}
+		if err := os.Remove(paths.GetKeyPath(recoveryKeyFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove recovery key: %v", err)
+		}
+		fmt.Println("Recovery phrase disabled; it can no longer recover your identity")
+	default:
+		return fmt.Errorf("unknown recovery action %q", action)
+	}
+	return nil
+}
+
+// RestoreMnemonic recovers an identity from its recovery phrase: the phrase derives
+// the ID of the recovery kit on hubURL and the key it is encrypted with
+func RestoreMnemonic(ctx context.Context, hubURL string) error {
+	if hubURL == "" {
+		defaultHub := "http://localhost:8080"
+		fmt.Printf("Hub URL [%s]: ", defaultHub)
+		fmt.Scanln(&hubURL)
+		if hubURL == "" {
+			hubURL = defaultHub
+		}
+	}
+	if _, err := url.Parse(hubURL); err != nil {
+		return fmt.Errorf("invalid hub URL: %v", err)
+	}
+
+	phrase, err := readPassphrase("Recovery phrase: ")
+	if err != nil {
+		return err
+	}
+	entropy, err := crypto.MnemonicEntropy(string(phrase))
+	if err != nil {
+		return err
+	}
+	key, id, err := crypto.RecoveryKeys(entropy)
+	if err != nil {
+		return err
+	}
+
+	client := newClient(hubURL, "", nil)
+	recovery, err := client.FetchRecovery(ctx, id)
+	if errors.Is(err, clspclient.ErrNoRecoveryKit) {
+		return fmt.Errorf("the hub has no identity for this recovery phrase")
+	}
+	if err != nil {
+		return err
+	}
+	data, err := crypto.Open(key, recovery.Kit)
+	if err != nil {
+		return fmt.Errorf("failed to open recovery kit: %v", err)
+	}
+	backup, err := parseBackup(data)
+	if err != nil {
+		return err
+	}
+	if backup.UserID != recovery.UserID {
+		return fmt.Errorf("the recovery kit belongs to another identity than the hub reports")
+	}
+	fmt.Printf("Recovery kit of %s (%s), updated %s\n", backup.DisplayName, backup.UserID, backup.CreatedAt.Local().Format("2006-01-02 15:04"))
+	return installBackup(ctx, backup)
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// Invite is the identity a hub operator provisioned for an invite code, empty when
+// the code only admits a new account
+type Invite = clspclient.Invite
+
+// lookupInvite asks the hub which identity an invite code reserves
+func lookupInvite(ctx context.Context, hubURL, code string, timeout time.Duration) (*Invite, error) {
+	client := clspclient.New(hubURL, "", nil)
+	client.Timeout = timeout
+	return client.LookupInvite(ctx, code)
+}
+
+// completeRegistration publishes the saved identity to the hub, with its signing key
+// certified by privateKey, and clears the pending flag
+func completeRegistration(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, publicKeyPEM []byte, hubInfo *HubInfo) error {
+	token, err := ssoToken(ctx, hubInfo)
+	if err != nil {
+		return err
+	}
+
+	err = hubClient(config, privateKey).Register(ctx, clspclient.RegisterRequest{
+		DisplayName:  config.DisplayName,
+		PublicKeyPEM: publicKeyPEM,
+		InviteCode:   config.InviteCode,
+		IDToken:      token,
+	})
+	if err != nil {
+		return err
+	}
+
+	config.RegistrationPending = false
+	config.InviteCode = ""
+	if err := SaveConfig(config); err != nil {
+		return fmt.Errorf("registered with hub but failed to save config: %v", err)
+	}
+
+	return nil
+}
+
+// ResumeInit retries hub registration for an identity that was saved locally by an
+// interrupted or failed `clsp init`, reusing the existing user ID and keys.
+func ResumeInit(ctx context.Context) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.UserID == "" {
+		return fmt.Errorf("no saved identity to resume; run 'clsp init' first")
+	}
+	if !config.RegistrationPending {
+		fmt.Println("Identity is already registered; re-announcing it to the hub")
+	}
+
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("saved identity has no usable private key (run 'clsp init' to start over): %v", err)
+	}
+	publicKeyPEM, err := crypto.PublicKeyToPEM(&privateKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %v", err)
+	}
+
+	// Identities made before signing keys existed get one now
+	if _, err := ensureSigningKey(privateKey); err != nil {
+		return err
+	}
+
+	fmt.Println("Checking hub connection...")
+	hubInfo, err := CheckHubHealth(ctx, config.HubURL)
+	if err != nil {
+		return fmt.Errorf("hub not available: %v", err)
+	}
+
+	fmt.Println("Registering with hub...")
+	if err := completeRegistration(ctx, config, privateKey, publicKeyPEM, hubInfo); err != nil {
+		return err
+	}
+
+	ensurePrekeys(ctx, config, privateKey)
+
+	fmt.Println("Registration successful!")
+	fmt.Printf("\nYour user ID: %s\n", config.UserID)
+	fmt.Printf("Display name: %s\n", config.DisplayName)
+	return nil
+}
@@ -0,0 +1,244 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"golang.org/x/text/width"
+)
+
+// defaultTerminalWidth is used when stdout is not a terminal
+const defaultTerminalWidth = 80
+
+// renderOptions controls how untrusted text is shown in the terminal
+type renderOptions struct {
+	// renderANSI passes through SGR (color/style) escape sequences; all other
+	// escape sequences are always neutralized
+	renderANSI bool
+	// stripEmoji replaces emoji with a placeholder for terminals that can't draw them
+	stripEmoji bool
+}
+
+// renderOptionsFromConfig returns the rendering options selected in the client configuration
+func renderOptionsFromConfig(config *Config) renderOptions {
+	return renderOptions{
+		renderANSI: config.RenderANSI,
+		stripEmoji: config.StripEmoji,
+	}
+}
+
+// isBidiControl reports whether r can reorder surrounding text (Trojan Source style attacks)
+func isBidiControl(r rune) bool {
+	switch {
+	case r >= 0x202A && r <= 0x202E: // LRE, RLE, PDF, LRO, RLO
+		return true
+	case r >= 0x2066 && r <= 0x2069: // LRI, RLI, FSI, PDI
+		return true
+	case r == 0x200E || r == 0x200F || r == 0x061C: // LRM, RLM, ALM
+		return true
+	}
+	return false
+}
+
+// isEmoji reports whether r falls in the common emoji blocks
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+		return true
+	case r >= 0x2600 && r <= 0x27BF:
+		return true
+	case r == 0xFE0F || r == 0x200D: // variation selector, zero width joiner
+		return true
+	}
+	return false
+}
+
+// sanitizeText neutralizes characters that could corrupt or spoof terminal output.
+// Control and bidi characters are shown as visible escapes, escape sequences are
+// stripped unless they are SGR styles and ANSI rendering is enabled. Newlines and
+// tabs are kept unless singleLine is set.
+func sanitizeText(s string, opts renderOptions, singleLine bool) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		// Escape sequences: CSI (ESC [ ... final byte) and everything else starting with ESC
+		if r == 0x1b {
+			seq, n := scanEscape(s[i:])
+			if opts.renderANSI && strings.HasPrefix(seq, "\x1b[") && strings.HasSuffix(seq, "m") {
+				b.WriteString(seq)
+			}
+			i += n
+			continue
+		}
+
+		switch {
+		case r == '\n' || r == '\t':
+			if singleLine {
+				b.WriteString(fmt.Sprintf("\\x%02x", r))
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '\r':
+			// A bare carriage return can overwrite what was already printed
+			b.WriteString("\\r")
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r <= 0x9f):
+			b.WriteString(fmt.Sprintf("\\x%02x", r))
+		case isBidiControl(r):
+			b.WriteString(fmt.Sprintf("<U+%04X>", r))
+		case opts.stripEmoji && isEmoji(r):
+			if r != 0xFE0F && r != 0x200D {
+				b.WriteString("[emoji]")
+			}
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+
+	if opts.renderANSI {
+		// Never let a colour leak into the rest of the output
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+// scanEscape returns the escape sequence at the start of s and its length in bytes
+func scanEscape(s string) (string, int) {
+	if len(s) < 2 {
+		return s, len(s)
+	}
+	switch s[1] {
+	case '[': // CSI: parameters and intermediates, then a final byte in 0x40-0x7e
+		for j := 2; j < len(s); j++ {
+			if s[j] >= 0x40 && s[j] <= 0x7e {
+				return s[:j+1], j + 1
+			}
+		}
+		return s, len(s)
+	case ']', 'P', '_', '^': // OSC/DCS/APC/PM: terminated by BEL or ESC \
+		for j := 2; j < len(s); j++ {
+			if s[j] == 0x07 {
+				return s[:j+1], j + 1
+			}
+			if s[j] == 0x1b && j+1 < len(s) && s[j+1] == '\\' {
+				return s[:j+2], j + 2
+			}
+		}
+		return s, len(s)
+	default:
+		return s[:2], 2
+	}
+}
+
+// runeWidth returns the number of terminal columns r occupies
+func runeWidth(r rune) int {
+	switch {
+	case r == 0:
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case isEmoji(r) && r != 0xFE0F && r != 0x200D:
+		return 2
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// displayWidth returns the number of terminal columns s occupies, ignoring escape sequences
+func displayWidth(s string) int {
+	w := 0
+	for i := 0; i < len(s); {
+		if s[i] == 0x1b {
+			_, n := scanEscape(s[i:])
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		w += runeWidth(r)
+		i += size
+	}
+	return w
+}
+
+// terminalWidth returns the width of the terminal attached to stdout
+func terminalWidth() int {
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+		return w
+	}
+	return defaultTerminalWidth
+}
+
+// wrapText wraps s so no line exceeds maxWidth columns, breaking at spaces where
+// possible and inside long words otherwise. Each wrapped line is prefixed with indent.
+func wrapText(s string, maxWidth int, indent string) string {
+	avail := maxWidth - displayWidth(indent)
+	if avail < 10 {
+		avail = 10
+	}
+
+	var out []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line, lineWidth := "", 0
+		for _, word := range strings.Fields(paragraph) {
+			wordWidth := displayWidth(word)
+			if lineWidth > 0 && lineWidth+1+wordWidth > avail {
+				out = append(out, line)
+				line, lineWidth = "", 0
+			}
+			// Hard-break words wider than a whole line (the line is empty here)
+			for wordWidth > avail {
+				head, _ := splitAtWidth(word, avail)
+				out = append(out, head)
+				word = word[len(head):]
+				wordWidth = displayWidth(word)
+			}
+			if lineWidth > 0 {
+				line += " "
+				lineWidth++
+			}
+			line += word
+			lineWidth += wordWidth
+		}
+		out = append(out, line)
+	}
+
+	for i := range out {
+		out[i] = indent + out[i]
+	}
+	return strings.Join(out, "\n")
+}
+
+// splitAtWidth returns the longest non-empty prefix of s that fits in maxWidth columns
+func splitAtWidth(s string, maxWidth int) (string, int) {
+	w := 0
+	for i, r := range s {
+		rw := runeWidth(r)
+		if w+rw > maxWidth && i > 0 {
+			return s[:i], w
+		}
+		w += rw
+	}
+	return s, w
+}
+
+// safeLine sanitizes untrusted single-line text such as names and filenames
+func safeLine(s string, opts renderOptions) string {
+	return sanitizeText(s, opts, true)
+}
+
+// renderBody sanitizes and wraps an untrusted message body for the current terminal
+func renderBody(s string, opts renderOptions, indent string) string {
+	return wrapText(sanitizeText(s, opts, false), terminalWidth(), indent)
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// MessageRequests shows the message requests waiting on the hub, or applies action:
+// "accept" or "decline" the request of user, or turn requests "on" or "off". While
+// requests are on, messages from people you never wrote to or accepted wait on the
+// hub, unread, until you accept their sender; accepted messages are then fetched.
+func MessageRequests(ctx context.Context, action, user string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	client := hubClient(config, privateKey)
+
+	var requests *clspclient.MessageRequests
+	switch action {
+	case "":
+		requests, err = client.MessageRequests(ctx)
+	case "on", "off":
+		requests, err = client.SetMessageRequests(ctx, action == "on")
+	case "accept", "decline":
+		var senderID string
+		if senderID, err = requestSender(ctx, config, client, user); err != nil {
+			return err
+		}
+		if action == "decline" {
+			if requests, err = client.DeclineRequest(ctx, senderID); err != nil {
+				return err
+			}
+			fmt.Fprintf(notices(), "Declined %s; their pending messages were deleted\n", senderID)
+			break
+		}
+		if requests, err = client.AcceptRequest(ctx, senderID); err != nil {
+			return err
+		}
+		fmt.Fprintf(notices(), "Accepted %s; their messages are in your inbox ('clsp list --with %s')\n", senderID, senderID)
+		fetchAccepted(ctx, config, privateKey)
+	default:
+		return fmt.Errorf("unknown requests action %q (use accept, decline, on or off)", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	if JSONOutput {
+		return printJSON(requests)
+	}
+	printRequests(config, requests)
+	return nil
+}
+
+// requestSender returns the ID of the sender user names: a sender or display name
+// among the pending requests, or else a contact as resolved elsewhere
+func requestSender(ctx context.Context, config *Config, client *clspclient.Client, user string) (string, error) {
+	if user == "" {
+		return "", fmt.Errorf("a sender is required")
+	}
+	requests, err := client.MessageRequests(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range requests.Requests {
+		if r.SenderID == user || (r.SenderName != "" && r.SenderName == user) {
+			return r.SenderID, nil
+		}
+	}
+	return resolveContact(ctx, config, user, true), nil
+}
+
+// fetchAccepted copies the messages of an accepted request into the local store.
+// They were stored on the hub before the last sync, so the whole inbox is fetched.
+func fetchAccepted(ctx context.Context, config *Config, privateKey *rsa.PrivateKey) {
+	store, err := openLocalStore()
+	if err != nil {
+		fmt.Fprintf(notices(), "Warning: %v\n", err)
+		return
+	}
+	defer store.Close()
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		fmt.Fprintf(notices(), "Warning: %v\n", err)
+		return
+	}
+	fetched, _, err := fetchMessages(ctx, config, privateKey, false, 0, time.Time{})
+	if err == nil {
+		err = store.Save(ctx, fetched, keys)
+	}
+	if err != nil {
+		fmt.Fprintf(notices(), "Warning: the accepted messages were not fetched (%v); 'clsp list' fetches them later\n", err)
+	}
+}
+
+// printRequests lists pending message requests with what is known of each sender
+func printRequests(config *Config, requests *clspclient.MessageRequests) {
+	if requests.Enabled {
+		fmt.Println("Message requests: on (messages from people you never wrote to wait here until you accept them)")
+	} else {
+		fmt.Println("Message requests: off (every message goes to your inbox; turn on with 'clsp requests on')")
+	}
+	if len(requests.Requests) == 0 {
+		fmt.Println("No pending message requests")
+		return
+	}
+	opts := renderOptionsFromConfig(config)
+	for _, r := range requests.Requests {
+		fmt.Printf("\nFrom: %s\n", safeLine(r.SenderID, opts))
+		if r.SenderName != "" {
+			fmt.Printf("Name: %s\n", safeLine(r.SenderName, opts))
+		}
+		if publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(r.PublicKey)); err == nil {
+			if fingerprint, err := crypto.ShortFingerprint(publicKey); err == nil {
+				fmt.Printf("Fingerprint: %s\n", fingerprint)
+			}
+		}
+		fmt.Printf("Messages: %d (first %s, last %s)\n", r.Messages, r.FirstAt.Format(time.RFC3339), r.LastAt.Format(time.RFC3339))
+		fmt.Println("---")
+	}
+	fmt.Println("Read a sender's messages with 'clsp requests accept <sender>', or delete them with 'clsp requests decline <sender>'")
+}
+
+// reportRequests tells the user that message requests are waiting, staying quiet if
+// the hub cannot say
+func reportRequests(ctx context.Context, config *Config, privateKey *rsa.PrivateKey) {
+	requests, err := hubClient(config, privateKey).MessageRequests(ctx)
+	if err != nil || len(requests.Requests) == 0 {
+		return
+	}
+	fmt.Fprintf(notices(), "%d message request(s) waiting; review them with 'clsp requests'\n", len(requests.Requests))
+}
@@ -0,0 +1,249 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// retiredKeysFile holds the identity keys replaced by 'clsp key rotate', sealed with
+// the current identity key
+const retiredKeysFile = "retired.keys"
+
+// retiredKey is an identity key kept after a rotation to open older messages
+type retiredKey struct {
+	PrivateKey []byte    `json:"private_key"`
+	RetiredAt  time.Time `json:"retired_at"`
+}
+
+// loadRetiredKeys returns the replaced identity keys, newest first
+func loadRetiredKeys(identity *rsa.PrivateKey) ([]retiredKey, error) {
+	sealed, err := os.ReadFile(paths.GetKeyPath(retiredKeysFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retired keys: %v", err)
+	}
+	data, err := crypto.OpenLocal(identity, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retired keys: %v", err)
+	}
+	var retired []retiredKey
+	if err := json.Unmarshal(data, &retired); err != nil {
+		return nil, fmt.Errorf("failed to parse retired keys: %v", err)
+	}
+	return retired, nil
+}
+
+// saveRetiredKeys writes the replaced identity keys sealed with the identity key
+func saveRetiredKeys(identity *rsa.PrivateKey, retired []retiredKey) error {
+	data, err := json.Marshal(retired)
+	if err != nil {
+		return fmt.Errorf("failed to marshal retired keys: %v", err)
+	}
+	sealed, err := crypto.SealLocal(identity, data)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(paths.GetKeyPath(retiredKeysFile), sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write retired keys: %v", err)
+	}
+	return nil
+}
+
+// parseRetiredKeys returns the private keys of retired entries
+func parseRetiredKeys(retired []retiredKey) ([]*rsa.PrivateKey, error) {
+	keys := make([]*rsa.PrivateKey, 0, len(retired))
+	for _, r := range retired {
+		key, err := x509.ParsePKCS1PrivateKey(r.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt retired key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RotateKey replaces the identity's RSA encryption key. The hub gets the new key with
+// a rotation signed by the current key and the signing key, which contacts' clients
+// check to pin the new key without a new fingerprint comparison. The current key is
+// kept, sealed with the new one, to open messages encrypted to it, and everything
+// sealed with it locally is sealed again with the new key.
+func RotateKey(ctx context.Context) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.RegistrationPending {
+		return fmt.Errorf("registration is pending; run 'clsp init --resume' first")
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	signingKey, err := loadSigningKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if signingKey == nil {
+		return fmt.Errorf("your identity has no signing key to sign the rotation; run 'clsp init --resume' to create and publish one")
+	}
+
+	// Gather everything sealed with the current key before anything changes
+	retired, err := loadRetiredKeys(privateKey)
+	if err != nil {
+		return err
+	}
+	prekeys, err := loadPrekeys(privateKey)
+	if err != nil {
+		return err
+	}
+	recovery, err := loadRecoverySecret(privateKey)
+	if err != nil {
+		return err
+	}
+	meta, err := loadStorageMeta()
+	if err != nil {
+		return err
+	}
+	var identityStorageKey []byte
+	if meta != nil && meta.KeySource == KeySourceIdentity {
+		if identityStorageKey, err = localStorageKey(); err != nil {
+			return err
+		}
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// The archive chain is rebuilt under the new key, which must not bless changes made
+	// outside clsp
+	report, err := store.verifyIntegrity(ctx, crypto.LocalMACKey(privateKey))
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("the local archive was changed outside clsp; check it with 'clsp archive verify' before rotating")
+	}
+
+	keyPath := paths.GetKeyPath("private.key")
+	encrypted, err := crypto.IsPrivateKeyEncrypted(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	var passphrase []byte
+	if encrypted {
+		if passphrase, err = readPassphrase("Passphrase of your identity (it protects the new key too): "); err != nil {
+			return err
+		}
+		if _, err := crypto.LoadEncryptedPrivateKey(keyPath, passphrase); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Rotating replaces your encryption key. Contacts' clients accept the new key through a")
+	fmt.Println("rotation signed by your current key and your signing key; the current key is kept to")
+	fmt.Println("read messages encrypted to it.")
+	fmt.Print("Rotate your key? (y/N): ")
+	var response string
+	fmt.Scanln(&response)
+	if response != "y" && response != "Y" {
+		return fmt.Errorf("key not rotated")
+	}
+
+	fmt.Println("Generating encryption keys...")
+	newKey, _, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate keys: %v", err)
+	}
+	// The new key is saved before the hub learns of it, so it cannot be lost in between
+	newKeyPath := keyPath + ".new"
+	if encrypted {
+		err = crypto.SaveEncryptedPrivateKey(newKey, newKeyPath, passphrase)
+	} else {
+		err = crypto.SavePrivateKey(newKey, newKeyPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save new private key: %v", err)
+	}
+
+	if _, err := hubClient(config, privateKey).RotateKey(ctx, newKey); err != nil {
+		os.Remove(newKeyPath)
+		return err
+	}
+
+	// The hub has the new key now; switch the local files over
+	fail := func(err error) error {
+		return fmt.Errorf("the hub has your new key, but updating local files failed: %v (the new key is kept in %s until installed)", err, newKeyPath)
+	}
+	retired = append([]retiredKey{{PrivateKey: x509.MarshalPKCS1PrivateKey(privateKey), RetiredAt: time.Now()}}, retired...)
+	if err := saveRetiredKeys(newKey, retired); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(newKeyPath, keyPath); err != nil {
+		return fail(fmt.Errorf("failed to install new private key: %v", err))
+	}
+	if err := crypto.SavePublicKey(&newKey.PublicKey, paths.GetKeyPath("public.pem")); err != nil {
+		return fail(err)
+	}
+	sealedSigningKey, err := crypto.SealSigningKey(signingKey, &newKey.PublicKey)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.WriteFile(paths.GetKeyPath(signingKeyFile), sealedSigningKey, 0600); err != nil {
+		return fail(fmt.Errorf("failed to save signing key: %v", err))
+	}
+	signingKeys[newKey] = signingKey
+	if len(prekeys) > 0 {
+		if err := savePrekeys(newKey, prekeys); err != nil {
+			return fail(err)
+		}
+	}
+	if recovery != nil {
+		if err := saveRecoverySecret(newKey, recovery); err != nil {
+			return fail(err)
+		}
+	}
+	if err := store.reseal(ctx, crypto.LocalMACKey(newKey)); err != nil {
+		return fail(err)
+	}
+	if identityStorageKey != nil {
+		if meta.WrappedKey, err = crypto.SealLocal(newKey, identityStorageKey); err != nil {
+			return fail(err)
+		}
+		if err := saveStorageMeta(meta); err != nil {
+			return fail(err)
+		}
+	}
+	if stopKeyAgent() {
+		if lock, err := sessionAutoLock(); err == nil {
+			startKeyAgent(newKey, lock.idleLockPeriod())
+		}
+	}
+
+	// The hub dropped the prekey signed by the previous key
+	ensurePrekeys(ctx, config, newKey)
+	// A recovery kit holding the previous key would recover an identity that can no
+	// longer read new messages
+	if err := refreshRecoveryKit(ctx, config, newKey); err != nil {
+		fmt.Printf("Warning: %v; run 'clsp recovery update' to retry\n", err)
+	}
+
+	fingerprint, err := crypto.Fingerprint(&newKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Key rotated")
+	fmt.Printf("New key fingerprint: %s\n", crypto.ShortenFingerprint(fingerprint))
+	fmt.Println("Contacts' clients follow the rotation the next time they send to you or read your messages")
+	return nil
+}
@@ -0,0 +1,357 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// scheduleLayouts are the forms `clsp send --at` accepts, in local time unless a
+// zone is given
+var scheduleLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// scheduledMessage is a message kept locally until it is due. The content is
+// encrypted to your own key, like the copies of sent messages.
+type scheduledMessage struct {
+	ID string `json:"id"`
+	// Recipient is the name or ID the message is addressed to
+	Recipient      string          `json:"recipient"`
+	Content        *crypto.Message `json:"content"`
+	AttachmentPath string          `json:"attachment_path,omitempty"`
+	AllowDuplicate bool            `json:"allow_duplicate,omitempty"`
+	Expiry         time.Duration   `json:"expiry,omitempty"`
+	DueAt          time.Time       `json:"due_at"`
+	ScheduledAt    time.Time       `json:"scheduled_at"`
+	// Attempts counts failed attempts to send the message, the last failing with LastError
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ScheduledJSON is a scheduled message as shown by `clsp scheduled list --json`
+type ScheduledJSON struct {
+	ID          string    `json:"id"`
+	Recipient   string    `json:"recipient"`
+	DueAt       time.Time `json:"due_at"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	Preview     string    `json:"preview"`
+	Attachment  string    `json:"attachment,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// createScheduled creates the table of scheduled messages. Rows are sealed like the
+// outbox, so with encryption at rest they do not reveal recipients.
+func createScheduled(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS scheduled (
+			id TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			due_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create scheduled messages table: %v", err)
+	}
+	return nil
+}
+
+// saveScheduled adds a scheduled message, or replaces it after a failed attempt
+func (st *localStore) saveScheduled(ctx context.Context, s *scheduledMessage) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode scheduled message: %v", err)
+	}
+	sealed, err := sealLocalData(data)
+	if err != nil {
+		return err
+	}
+	_, err = st.db.ExecContext(ctx, "INSERT OR REPLACE INTO scheduled (id, data, due_at) VALUES (?, ?, ?)", s.ID, sealed, s.DueAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled message: %v", err)
+	}
+	return nil
+}
+
+// scheduledMessages returns the scheduled messages due at or before until (all of
+// them when until is zero), soonest first
+func (st *localStore) scheduledMessages(ctx context.Context, until time.Time) ([]*scheduledMessage, error) {
+	query, args := "SELECT data FROM scheduled ORDER BY due_at, rowid", []any{}
+	if !until.IsZero() {
+		query, args = "SELECT data FROM scheduled WHERE due_at <= ? ORDER BY due_at, rowid", []any{until.Unix()}
+	}
+	rows, err := st.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []*scheduledMessage
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read scheduled messages: %v", err)
+		}
+		plain, err := openLocalData(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open scheduled message: %v", err)
+		}
+		var s scheduledMessage
+		if err := json.Unmarshal(plain, &s); err != nil || s.Content == nil {
+			return nil, fmt.Errorf("corrupt scheduled message")
+		}
+		messages = append(messages, &s)
+	}
+	return messages, rows.Err()
+}
+
+// deleteScheduled removes a scheduled message, reporting whether it existed
+func (st *localStore) deleteScheduled(ctx context.Context, id string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, "DELETE FROM scheduled WHERE id = ?", id)
+	if err != nil {
+		return false, fmt.Errorf("failed to update scheduled messages: %v", err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// rewriteScheduled seals scheduled messages read under the previous at-rest settings
+// again under the current ones
+func (st *localStore) rewriteScheduled(ctx context.Context, messages []*scheduledMessage) error {
+	for _, s := range messages {
+		if err := st.saveScheduled(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseScheduleTime reads the time given to `clsp send --at`: a date and time such as
+// 2024-06-01T09:00 (local time unless it carries a zone), or a time of day such as
+// 09:00, meaning its next occurrence after now
+func ParseScheduleTime(at string, now time.Time) (time.Time, error) {
+	at = strings.TrimSpace(at)
+	if t, err := time.ParseInLocation("15:04", at, time.Local); err == nil {
+		due := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due, nil
+	}
+	for _, layout := range scheduleLayouts {
+		if t, err := time.ParseInLocation(layout, at, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use e.g. 2024-06-01T09:00, '2024-06-01 09:00' or 09:00)", at)
+}
+
+// ScheduleMessage keeps a message to recipient locally until due. 'clsp watch' sends
+// it once the time comes, and so does the first online 'clsp send' or 'clsp list'
+// afterwards; nothing reaches the hub before then.
+func ScheduleMessage(ctx context.Context, recipient, message string, due time.Time, opts SendOptions) error {
+	if !due.After(time.Now()) {
+		return fmt.Errorf("scheduled time %s has already passed", due.Local().Format("2006-01-02 15:04"))
+	}
+	if opts.DryRun || opts.InReplyTo != "" {
+		return fmt.Errorf("dry runs and replies cannot be scheduled")
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	s := &scheduledMessage{
+		ID:             uuid.New().String(),
+		Recipient:      recipient,
+		AllowDuplicate: opts.AllowDuplicate,
+		Expiry:         opts.Expiry,
+		DueAt:          due,
+		ScheduledAt:    time.Now(),
+	}
+	// The file is read when the message is sent, so it must still be there then
+	if opts.AttachmentPath != "" {
+		if s.AttachmentPath, err = filepath.Abs(opts.AttachmentPath); err != nil {
+			return fmt.Errorf("failed to resolve attachment path: %v", err)
+		}
+		if _, err := os.Stat(s.AttachmentPath); err != nil {
+			return fmt.Errorf("failed to read attachment: %v", err)
+		}
+	}
+	if s.Content, err = crypto.EncryptMessage(privateKey, &privateKey.PublicKey, nil, []byte(message), nil); err != nil {
+		return fmt.Errorf("failed to encrypt scheduled message: %v", err)
+	}
+
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.saveScheduled(ctx, s); err != nil {
+		return err
+	}
+
+	fmt.Printf("Message to %s scheduled for %s\n", safeLine(recipient, renderOptionsFromConfig(config)), due.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("Scheduled ID: %s (cancel with 'clsp scheduled cancel %s')\n", s.ID, s.ID)
+	fmt.Println("It is sent by a running 'clsp watch', or else by the first 'clsp send' or 'clsp list' after that time")
+	return nil
+}
+
+// flushScheduled sends the scheduled messages due by now. A message that fails is
+// kept, with the error recorded, and tried again next time; the others go ahead.
+// It returns how many were sent.
+func flushScheduled(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, store *localStore, now time.Time) (int, error) {
+	due, err := store.scheduledMessages(ctx, now)
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return 0, err
+	}
+	client := hubClient(config, privateKey)
+	opts := renderOptionsFromConfig(config)
+	sent := 0
+	for _, s := range due {
+		message, err := crypto.DecryptMessage(keys, s.Content)
+		if err != nil {
+			fmt.Fprintf(notices(), "Warning: cannot open scheduled message %s: %v\n", s.ID, err)
+			continue
+		}
+		sendOpts, err := prepareSend(ctx, config, client, SendOptions{
+			AttachmentPath: s.AttachmentPath,
+			AllowDuplicate: s.AllowDuplicate,
+			Expiry:         s.Expiry,
+		})
+		if err == nil {
+			var result *clspclient.SendResult
+			if result, err = client.SendMessage(ctx, s.Recipient, message, sendOpts); err == nil {
+				if !result.AlreadyDelivered() {
+					keepSent(ctx, config, privateKey, result.RecipientID, result.IDs, string(message), "", result.ExpiresAt)
+				}
+				if _, err := store.deleteScheduled(ctx, s.ID); err != nil {
+					return sent, err
+				}
+				fmt.Fprintf(notices(), "Sent the message scheduled for %s to %s (message ID: %s)\n", s.DueAt.Local().Format("2006-01-02 15:04"), safeLine(s.Recipient, opts), result.IDs[0])
+				sent++
+				continue
+			}
+		}
+		s.Attempts++
+		s.LastError = err.Error()
+		if err := store.saveScheduled(ctx, s); err != nil {
+			return sent, err
+		}
+		fmt.Fprintf(notices(), "Warning: failed to send scheduled message %s to %s: %v; it stays scheduled\n", s.ID, safeLine(s.Recipient, opts), err)
+	}
+	return sent, nil
+}
+
+// sendScheduled sends the scheduled messages that are due before or during an online
+// command, reporting failures as notices so the command itself goes ahead either way
+func sendScheduled(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, store *localStore) {
+	if _, err := flushScheduled(ctx, config, privateKey, store, time.Now()); err != nil {
+		fmt.Fprintf(notices(), "Warning: %v\n", err)
+	}
+}
+
+// ScheduledMessages lists the messages waiting to be sent at a later time
+func ScheduledMessages(ctx context.Context) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	scheduled, err := store.scheduledMessages(ctx, time.Time{})
+	if err != nil {
+		return err
+	}
+	out := make([]ScheduledJSON, 0, len(scheduled))
+	for _, s := range scheduled {
+		preview := "(cannot be decrypted)"
+		if content, err := crypto.DecryptMessage(keys, s.Content); err == nil {
+			preview = string(content)
+		}
+		out = append(out, ScheduledJSON{
+			ID:          s.ID,
+			Recipient:   s.Recipient,
+			DueAt:       s.DueAt,
+			ScheduledAt: s.ScheduledAt,
+			Preview:     preview,
+			Attachment:  s.AttachmentPath,
+			Attempts:    s.Attempts,
+			LastError:   s.LastError,
+		})
+	}
+	if JSONOutput {
+		return printJSON(out)
+	}
+	if len(out) == 0 {
+		fmt.Println("No messages are scheduled")
+		return nil
+	}
+	opts := renderOptionsFromConfig(config)
+	for _, s := range out {
+		fmt.Printf("%s to %s at %s: %s\n", s.ID, safeLine(s.Recipient, opts), s.DueAt.Local().Format("2006-01-02 15:04"), previewText(s.Preview, opts))
+		if s.Attachment != "" {
+			fmt.Printf("  Attachment: %s\n", safeLine(s.Attachment, opts))
+		}
+		if s.LastError != "" {
+			fmt.Printf("  Not sent yet: %d failed attempt(s), last: %s\n", s.Attempts, safeLine(s.LastError, opts))
+		}
+	}
+	fmt.Printf("%d message(s) scheduled; cancel one with 'clsp scheduled cancel <id>'\n", len(out))
+	return nil
+}
+
+// CancelScheduled deletes a scheduled message before it is sent
+func CancelScheduled(ctx context.Context, id string) error {
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	deleted, err := store.deleteScheduled(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("no scheduled message %s (it may have been sent already)", id)
+	}
+	fmt.Printf("Scheduled message %s cancelled\n", id)
+	return nil
+}
@@ -0,0 +1,453 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of screening rule. Messages matching a rule go to the screened folder instead
+// of the inbox, where 'clsp screened list' shows them.
+const (
+	// ScreenSender screens a sender, given by user ID
+	ScreenSender = "sender"
+	// ScreenKeyword screens messages containing a word or phrase, ignoring case
+	ScreenKeyword = "keyword"
+	// ScreenSize screens messages whose text and attachment exceed a number of bytes
+	ScreenSize = "size"
+	// ScreenFirstTime screens senders you have not exchanged messages with before
+	ScreenFirstTime = "first-time"
+)
+
+// ScreenRule is a local filtering rule for incoming messages
+type ScreenRule struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value,omitempty"`
+}
+
+// String describes the rule for listings
+func (r ScreenRule) String() string {
+	switch r.Kind {
+	case ScreenSender:
+		return "from " + r.Value
+	case ScreenKeyword:
+		return "containing " + strconv.Quote(r.Value)
+	case ScreenSize:
+		n, _ := strconv.ParseInt(r.Value, 10, 64)
+		return "larger than " + formatSize(n)
+	case ScreenFirstTime:
+		return "from first-time senders"
+	}
+	return r.Kind
+}
+
+// createScreened creates the table of messages screened out of the inbox. Only the
+// kind of the matching rule is kept, so sealed archives do not reveal keywords.
+func createScreened(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS screened (
+			id TEXT PRIMARY KEY,
+			rule TEXT NOT NULL,
+			screened_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create screened messages table: %v", err)
+	}
+	return nil
+}
+
+// screenedIDs returns the IDs of screened messages with the kind of rule each matched
+func (st *localStore) screenedIDs(ctx context.Context) (map[string]string, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT id, rule FROM screened")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read screened messages: %v", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]string)
+	for rows.Next() {
+		var id, rule string
+		if err := rows.Scan(&id, &rule); err != nil {
+			return nil, fmt.Errorf("failed to read screened messages: %v", err)
+		}
+		ids[id] = rule
+	}
+	return ids, rows.Err()
+}
+
+// screen moves messages to the screened folder
+func (st *localStore) screen(ctx context.Context, ids []string, rule string) error {
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if _, err := st.db.ExecContext(ctx, "INSERT OR IGNORE INTO screened (id, rule, screened_at) VALUES (?, ?, ?)", id, rule, now); err != nil {
+			return fmt.Errorf("failed to screen message %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// unscreen returns messages to the inbox
+func (st *localStore) unscreen(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if _, err := st.db.ExecContext(ctx, "DELETE FROM screened WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to unscreen message %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// correspondents returns the users you exchanged messages with: the senders of
+// messages shown in the inbox and the recipients of messages you sent
+func (st *localStore) correspondents(ctx context.Context) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, query := range []string{
+		"SELECT envelope FROM messages WHERE read = 1 AND id NOT IN (SELECT id FROM screened)",
+		"SELECT envelope FROM sent",
+	} {
+		rows, err := st.db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+		for rows.Next() {
+			var envelope []byte
+			if err := rows.Scan(&envelope); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read local messages: %v", err)
+			}
+			msg, err := openEnvelope(envelope)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			known[msg.Sender] = true
+			known[msg.Recipient] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+	}
+	return known, nil
+}
+
+// screenRule returns the first rule r matches, or nil. known holds your
+// correspondents, loaded only when a first-time rule needs them.
+func screenRule(rules []ScreenRule, r receivedMessage, known func() map[string]bool) *ScreenRule {
+	for i, rule := range rules {
+		switch rule.Kind {
+		case ScreenSender:
+			if r.msg.Sender == rule.Value {
+				return &rules[i]
+			}
+		case ScreenKeyword:
+			if strings.Contains(strings.ToLower(string(r.content)), strings.ToLower(rule.Value)) {
+				return &rules[i]
+			}
+		case ScreenSize:
+			limit, err := strconv.ParseInt(rule.Value, 10, 64)
+			size := int64(len(r.content))
+			if r.msg.Attachment != nil {
+				size += r.msg.Attachment.Size
+			}
+			if err == nil && size > limit {
+				return &rules[i]
+			}
+		case ScreenFirstTime:
+			if !known()[r.msg.Sender] {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// screenReceived leaves out the messages in the screened folder and screens new
+// messages that match a rule, unless their sender was allowed. Messages shown
+// before are not screened again when rules change. It returns the messages for the
+// inbox and how many were newly screened.
+func screenReceived(ctx context.Context, config *Config, store *localStore, received []receivedMessage) ([]receivedMessage, int, error) {
+	screened, err := store.screenedIDs(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	allowed := make(map[string]bool, len(config.ScreenAllowed))
+	for _, id := range config.ScreenAllowed {
+		allowed[id] = true
+	}
+	var known map[string]bool
+	var knownErr error
+	loadKnown := func() map[string]bool {
+		if known == nil && knownErr == nil {
+			known, knownErr = store.correspondents(ctx)
+		}
+		return known
+	}
+
+	inbox := received[:0]
+	added := 0
+	for _, r := range received {
+		if _, ok := screened[r.msg.ID]; ok {
+			continue
+		}
+		if r.msg.Status != "read" && !r.missing && !allowed[r.msg.Sender] {
+			if rule := screenRule(config.ScreenRules, r, loadKnown); rule != nil {
+				if err := store.screen(ctx, append([]string{r.msg.ID}, r.ids...), rule.Kind); err != nil {
+					return nil, 0, err
+				}
+				added++
+				continue
+			}
+		}
+		inbox = append(inbox, r)
+	}
+	if knownErr != nil {
+		return nil, 0, knownErr
+	}
+	return inbox, added, nil
+}
+
+// reportScreened tells the user that new messages were screened
+func reportScreened(n int) {
+	if n > 0 {
+		fmt.Fprintf(notices(), "%d new message(s) screened; review them with 'clsp screened list'\n", n)
+	}
+}
+
+// ScreenedMessages lists the messages in the screened folder, newest first
+func ScreenedMessages(ctx context.Context) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+
+	screened, err := store.screenedIDs(ctx)
+	if err != nil {
+		return err
+	}
+	all, err := store.Messages(ctx, false)
+	if err != nil {
+		return err
+	}
+	if err := store.LoadSavedKeys(ctx, keys); err != nil {
+		return err
+	}
+	messages := all[:0]
+	for _, msg := range all {
+		if _, ok := screened[msg.ID]; ok {
+			messages = append(messages, msg)
+		}
+	}
+	received, err := openReceived(ctx, config, keys, messages, false)
+	if err != nil {
+		return err
+	}
+	shown := joinParts(received)
+
+	if JSONOutput {
+		out := make([]ScreenedJSON, 0, len(shown))
+		for _, r := range shown {
+			out = append(out, ScreenedJSON{MessageJSON: messageJSON(r), Rule: screened[r.msg.ID]})
+		}
+		return printJSON(out)
+	}
+	if len(shown) == 0 {
+		fmt.Println("No screened messages")
+		return nil
+	}
+	opts := renderOptionsFromConfig(config)
+	for _, r := range shown {
+		fmt.Printf("\nScreened by: %s rule\n", screened[r.msg.ID])
+		printReceived(r, opts)
+	}
+	fmt.Println("Move a sender's messages to the inbox with 'clsp screened allow <user>'")
+	return nil
+}
+
+// AllowSender exempts a sender from screening and moves their screened messages to
+// the inbox, where the next 'clsp list' shows them
+func AllowSender(ctx context.Context, user string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	id := resolveContact(ctx, config, user, true)
+	screened, err := store.screenedIDs(ctx)
+	if err != nil {
+		return err
+	}
+	all, err := store.Messages(ctx, false)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, msg := range all {
+		if _, ok := screened[msg.ID]; ok && msg.Sender == id {
+			ids = append(ids, msg.ID)
+		}
+	}
+	if err := store.unscreen(ctx, ids); err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, a := range config.ScreenAllowed {
+		allowed = allowed || a == id
+	}
+	if !allowed {
+		config.ScreenAllowed = append(config.ScreenAllowed, id)
+	}
+	// Allowing a sender lifts a rule screening them by name
+	rules := config.ScreenRules[:0]
+	for _, r := range config.ScreenRules {
+		if r.Kind != ScreenSender || r.Value != id {
+			rules = append(rules, r)
+		}
+	}
+	config.ScreenRules = rules
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	fmt.Printf("Messages from %s are no longer screened; %d moved to the inbox\n", id, len(ids))
+	return nil
+}
+
+// ScreenRuleChange adds or removes screening rules for 'clsp screened rules'
+type ScreenRuleChange struct {
+	Sender     string
+	Keyword    string
+	LargerThan string
+	// FirstTime is "on" or "off" to add or remove the first-time sender rule
+	FirstTime string
+	// Remove is the 1-based number of a rule to remove, as listed (0 for none)
+	Remove int
+}
+
+// ScreenRules applies change to the screening rules and lists them
+func ScreenRules(ctx context.Context, change ScreenRuleChange) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	modified := false
+	add := func(rule ScreenRule) {
+		for _, r := range config.ScreenRules {
+			if r == rule {
+				return
+			}
+		}
+		config.ScreenRules = append(config.ScreenRules, rule)
+		modified = true
+	}
+	if change.Remove > 0 {
+		if change.Remove > len(config.ScreenRules) {
+			return fmt.Errorf("there is no rule %d", change.Remove)
+		}
+		config.ScreenRules = append(config.ScreenRules[:change.Remove-1], config.ScreenRules[change.Remove:]...)
+		modified = true
+	}
+	if change.Sender != "" {
+		id := resolveContact(ctx, config, change.Sender, true)
+		add(ScreenRule{Kind: ScreenSender, Value: id})
+		// Screening a sender overrides having allowed them
+		allowed := config.ScreenAllowed[:0]
+		for _, a := range config.ScreenAllowed {
+			if a != id {
+				allowed = append(allowed, a)
+			}
+		}
+		config.ScreenAllowed = allowed
+	}
+	if change.Keyword != "" {
+		add(ScreenRule{Kind: ScreenKeyword, Value: change.Keyword})
+	}
+	if change.LargerThan != "" {
+		n, err := parseSize(change.LargerThan)
+		if err != nil {
+			return err
+		}
+		add(ScreenRule{Kind: ScreenSize, Value: strconv.FormatInt(n, 10)})
+	}
+	switch change.FirstTime {
+	case "":
+	case "on":
+		add(ScreenRule{Kind: ScreenFirstTime})
+	case "off":
+		rules := config.ScreenRules[:0]
+		for _, r := range config.ScreenRules {
+			if r.Kind != ScreenFirstTime {
+				rules = append(rules, r)
+			}
+		}
+		modified = modified || len(rules) != len(config.ScreenRules)
+		config.ScreenRules = rules
+	default:
+		return fmt.Errorf("--first-time must be on or off")
+	}
+	if modified {
+		if err := SaveConfig(config); err != nil {
+			return err
+		}
+	}
+
+	if JSONOutput {
+		return printJSON(ScreenRulesJSON{Rules: config.ScreenRules, Allowed: config.ScreenAllowed})
+	}
+	if len(config.ScreenRules) == 0 {
+		fmt.Println("No screening rules; every message goes to the inbox")
+	} else {
+		fmt.Println("Messages go to the screened folder when they are:")
+		for i, r := range config.ScreenRules {
+			fmt.Printf("  %d. %s\n", i+1, r)
+		}
+	}
+	if len(config.ScreenAllowed) > 0 {
+		fmt.Printf("Never screened: %s\n", strings.Join(config.ScreenAllowed, ", "))
+	}
+	return nil
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (use bytes or a number with K, M or G)", s)
+	}
+	return n << shift, nil
+}
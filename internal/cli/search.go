@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Message content can only be searched once decrypted, so 'clsp list --search' and
+// 'clsp list --sent --search' search on the client. There is no persistent index:
+// every search decrypts and scans the messages being listed, loading them into an
+// in-memory SQLite FTS5 table that is dropped when the search ends. The cost grows
+// with the history on every search, but plaintext never reaches the disk, even with
+// encryption at rest off, and messages that expire or are deleted cannot linger in
+// an index. Each word of a search must begin a word of the content, in any order and
+// ignoring case and accents. Builds without FTS5 (the sqlite_fts5 build tag) fall
+// back to a substring match.
+
+// errNoSearchTerms reports a search without letters or digits, which the index
+// cannot match
+var errNoSearchTerms = errors.New("query has no searchable terms")
+
+// errNoFTS5 reports that the SQLite library was built without FTS5
+var errNoFTS5 = errors.New("SQLite was built without FTS5")
+
+// searchContent returns the messages whose content matches search, in their order
+func searchContent(ctx context.Context, messages []receivedMessage, search string) ([]receivedMessage, error) {
+	if len(searchWords(search)) == 0 {
+		return nil, errNoSearchTerms
+	}
+	matches, err := matchIndexed(ctx, messages, search)
+	if err == errNoFTS5 {
+		matches = matchSubstring(messages, search)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %v", err)
+	}
+	matched := make([]receivedMessage, 0, len(matches))
+	for i, r := range messages {
+		if matches[i] {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+// matchIndexed indexes messages in memory for this one search and returns the
+// positions of those matching search, which must have searchable terms
+func matchIndexed(ctx context.Context, messages []receivedMessage, search string) (map[int]bool, error) {
+	words := searchWords(search)
+	if len(words) == 0 {
+		return nil, errNoSearchTerms
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, "CREATE VIRTUAL TABLE message_search USING fts5(content, tokenize = 'unicode61 remove_diacritics 2')"); err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			return nil, errNoFTS5
+		}
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i, r := range messages {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO message_search (rowid, content) VALUES (?, ?)", i, string(r.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + word + `"*`
+	}
+	rows, err := db.QueryContext(ctx, "SELECT rowid FROM message_search WHERE message_search MATCH ?", strings.Join(terms, " "))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	matches := make(map[int]bool)
+	for rows.Next() {
+		var i int
+		if err := rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		matches[i] = true
+	}
+	return matches, rows.Err()
+}
+
+// matchSubstring returns the positions of the messages containing every word of
+// search, for SQLite builds without FTS5
+func matchSubstring(messages []receivedMessage, search string) map[int]bool {
+	words := searchWords(search)
+	matches := make(map[int]bool)
+	if len(words) == 0 {
+		return matches
+	}
+	for i, r := range messages {
+		content := strings.ToLower(string(r.content))
+		matches[i] = true
+		for _, word := range words {
+			if !strings.Contains(content, word) {
+				matches[i] = false
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// searchWords splits a search into lowercase words of letters and digits, the
+// tokens the index holds
+func searchWords(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
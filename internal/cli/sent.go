@@ -0,0 +1,389 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// sentMessage is a message you sent as kept in the local store. The envelope holds
+// the content encrypted to your own key, addressed and timed like the original.
+type sentMessage struct {
+	msg crypto.Message
+	// partIDs lists the hub IDs of every part of a split message
+	partIDs []string
+	// state is the delivery state last reported by the hub (empty until checked), and
+	// gone is set once the hub no longer holds the message, after which it stays as is
+	state string
+	gone  bool
+}
+
+// createSent creates the table of sent messages. Like received envelopes, rows are
+// sealed with encryption at rest and the recipient column is then left empty.
+func createSent(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sent (
+			id TEXT PRIMARY KEY,
+			recipient_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			envelope BLOB NOT NULL,
+			part_ids TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create sent messages table: %v", err)
+	}
+	// Stores created before delivery tracking lack the state columns, and those
+	// created before sender expiry the expiry column
+	for _, column := range []string{"state TEXT NOT NULL DEFAULT ''", "gone INTEGER NOT NULL DEFAULT 0", "expires_at INTEGER NOT NULL DEFAULT 0"} {
+		if _, err := db.Exec("ALTER TABLE sent ADD COLUMN " + column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("failed to upgrade sent messages table: %v", err)
+		}
+	}
+	return nil
+}
+
+// sealSent encodes a sent message's envelope for the store, returning the recipient
+// to record in the clear (empty when the envelope is sealed)
+func sealSent(msg *crypto.Message) (envelope []byte, recipient string, err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	sealed, err := sealLocalData(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if isSealed(sealed) {
+		return sealed, "", nil
+	}
+	return data, msg.Recipient, nil
+}
+
+// recordSent keeps a copy of a message you sent, encrypted to your own key. ids are
+// the hub IDs of its parts; the first one identifies the message. A copy of a message
+// sent with an expiry is deleted along with it.
+func (st *localStore) recordSent(ctx context.Context, privateKey *rsa.PrivateKey, senderID, recipientID string, ids []string, content []byte, inReplyTo string, sentAt, expiresAt time.Time) error {
+	var expires int64
+	if !expiresAt.IsZero() {
+		expires = expiresAt.Unix()
+	}
+	msg, err := crypto.EncryptMessageEscrowed(privateKey, &privateKey.PublicKey, nil, content, nil, nil, nil, inReplyTo, expires)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sent message copy: %v", err)
+	}
+	msg.ID = ids[0]
+	msg.Sender = senderID
+	msg.Recipient = recipientID
+	msg.Timestamp = sentAt.Unix()
+
+	envelope, recipient, err := sealSent(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode sent message: %v", err)
+	}
+	_, err = st.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO sent (id, recipient_id, timestamp, envelope, part_ids, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		msg.ID, recipient, msg.Timestamp, envelope, strings.Join(ids, ","), expires,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record sent message: %v", err)
+	}
+	return nil
+}
+
+// sentMessages returns the sent messages, newest first, leaving out those past the
+// expiry they were sent with
+func (st *localStore) sentMessages(ctx context.Context) ([]sentMessage, error) {
+	return st.querySent(ctx, "WHERE "+notExpired, time.Now().Unix())
+}
+
+// allSentMessages returns every sent message, expired ones included, for rewriting
+// under new at-rest settings
+func (st *localStore) allSentMessages(ctx context.Context) ([]sentMessage, error) {
+	return st.querySent(ctx, "")
+}
+
+// querySent returns the sent messages matching where, newest first
+func (st *localStore) querySent(ctx context.Context, where string, args ...interface{}) ([]sentMessage, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT envelope, part_ids, state, gone FROM sent "+where+" ORDER BY timestamp DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sent messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []sentMessage
+	for rows.Next() {
+		var envelope []byte
+		var partIDs, state string
+		var gone bool
+		if err := rows.Scan(&envelope, &partIDs, &state, &gone); err != nil {
+			return nil, fmt.Errorf("failed to read sent messages: %v", err)
+		}
+		msg, err := openEnvelope(envelope)
+		if err != nil {
+			return nil, err
+		}
+		sent := sentMessage{msg: *msg, state: state, gone: gone}
+		if partIDs != "" {
+			sent.partIDs = strings.Split(partIDs, ",")
+		}
+		messages = append(messages, sent)
+	}
+	return messages, rows.Err()
+}
+
+// sentByID returns the sent message one of whose parts has the given ID, or nil if
+// there is none
+func (st *localStore) sentByID(ctx context.Context, id string) (*sentMessage, error) {
+	sent, err := st.querySent(ctx, "WHERE id = ? OR instr(',' || part_ids || ',', ?) > 0", id, ","+id+",")
+	if err != nil || len(sent) == 0 {
+		return nil, err
+	}
+	return &sent[0], nil
+}
+
+// deleteSent removes your copy of a sent message
+func (st *localStore) deleteSent(ctx context.Context, id string) error {
+	if _, err := st.db.ExecContext(ctx, "DELETE FROM sent WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete sent message %s: %v", id, err)
+	}
+	return nil
+}
+
+// setSentState records the delivery state of a sent message as last seen
+func (st *localStore) setSentState(ctx context.Context, id, state string, gone bool) error {
+	if _, err := st.db.ExecContext(ctx, "UPDATE sent SET state = ?, gone = ? WHERE id = ?", state, gone, id); err != nil {
+		return fmt.Errorf("failed to update sent message %s: %v", id, err)
+	}
+	return nil
+}
+
+// rewriteSent stores sent messages again with the current at-rest settings
+func (st *localStore) rewriteSent(ctx context.Context, messages []sentMessage) error {
+	for i := range messages {
+		envelope, recipient, err := sealSent(&messages[i].msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode sent message %s: %v", messages[i].msg.ID, err)
+		}
+		if _, err := st.db.ExecContext(ctx, "UPDATE sent SET envelope = ?, recipient_id = ? WHERE id = ?", envelope, recipient, messages[i].msg.ID); err != nil {
+			return fmt.Errorf("failed to rewrite sent message %s: %v", messages[i].msg.ID, err)
+		}
+	}
+	return nil
+}
+
+// keepSent records a message just sent, warning rather than failing since the
+// message itself already went out
+func keepSent(ctx context.Context, config *Config, privateKey *rsa.PrivateKey, recipientID string, ids []string, content, inReplyTo string, expiresAt time.Time) {
+	store, err := openLocalStore()
+	if err == nil {
+		err = store.recordSent(ctx, privateKey, config.UserID, recipientID, ids, []byte(content), inReplyTo, time.Now(), expiresAt)
+		store.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(notices(), "Warning: the message was sent but not recorded locally: %v\n", err)
+	}
+}
+
+// openSent decrypts your copies of sent messages into the form received messages are
+// shown in, with the signature checked against your own key. Copies that fail to
+// decrypt are reported and skipped.
+func openSent(config *Config, keys *crypto.Keyring, privateKey *rsa.PrivateKey, sent []sentMessage) []receivedMessage {
+	opts := renderOptionsFromConfig(config)
+	var out []receivedMessage
+	for _, s := range sent {
+		content, err := crypto.DecryptMessage(keys, &s.msg)
+		if err != nil {
+			fmt.Fprintf(notices(), "Failed to decrypt your copy of message %s: %v\n", safeLine(s.msg.ID, opts), err)
+			continue
+		}
+		r := receivedMessage{msg: s.msg, content: content, signature: SignatureVerified}
+		r.msg.Status = s.state
+		if r.msg.Status == "" {
+			r.msg.Status = "sent"
+		}
+		if !signedByOwnKey(privateKey, keys.Retired, &s.msg) {
+			r.signature = SignatureInvalid
+		}
+		if len(s.partIDs) > 1 {
+			r.parts = len(s.partIDs)
+			r.ids = s.partIDs
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// signedByOwnKey reports whether msg carries your signature, made by your identity
+// key or, for copies kept before a key rotation, one of the keys it replaced
+func signedByOwnKey(privateKey *rsa.PrivateKey, retired []*rsa.PrivateKey, msg *crypto.Message) bool {
+	if crypto.VerifySignature(&privateKey.PublicKey, msg) == nil {
+		return true
+	}
+	for _, key := range retired {
+		if crypto.VerifySignature(&key.PublicKey, msg) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSentLookups bounds the hub queries one 'clsp list --sent' makes to refresh
+// delivery states, newest messages first
+const maxSentLookups = 50
+
+// ListSent lists the messages you sent, newest first, with their delivery state.
+// Unless source is ListLocal the outbox is flushed and the states of messages the hub
+// may still hold are refreshed first; read messages and those the hub no longer holds
+// keep their last known state. search matches the content, and limit (zero for all)
+// bounds the number shown.
+func ListSent(ctx context.Context, limit int, search string, source ListSource) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if source != ListLocal {
+		sendQueued(ctx, config, privateKey, store)
+		sendScheduled(ctx, config, privateKey, store)
+	}
+	if err := store.purgeExpired(ctx, crypto.LocalMACKey(privateKey)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	sent, err := store.sentMessages(ctx)
+	if err != nil {
+		return err
+	}
+	queued, err := store.queued(ctx)
+	if err != nil {
+		return err
+	}
+	inOutbox := make(map[string]bool, len(queued))
+	for _, q := range queued {
+		inOutbox[q.Envelope.ID] = true
+	}
+
+	if source != ListLocal {
+		refreshSentStates(ctx, hubClient(config, privateKey), store, sent, inOutbox)
+	}
+
+	shown := openSent(config, keys, privateKey, sent)
+	if search != "" {
+		if shown, err = searchContent(ctx, shown, search); err != nil {
+			return err
+		}
+	}
+	if limit > 0 && len(shown) > limit {
+		shown = shown[:limit]
+	}
+	gone := make(map[string]bool)
+	for _, s := range sent {
+		gone[s.msg.ID] = s.gone
+	}
+	status := func(r receivedMessage) string {
+		switch {
+		case inOutbox[r.msg.ID]:
+			return "queued"
+		case gone[r.msg.ID] && (r.msg.Status == "sent" || r.msg.Status == "stored"):
+			return "expired"
+		}
+		return r.msg.Status
+	}
+
+	if JSONOutput {
+		out := make([]MessageJSON, 0, len(shown))
+		for _, r := range shown {
+			m := messageJSON(r)
+			m.RecipientID = r.msg.Recipient
+			m.Status = status(r)
+			out = append(out, m)
+		}
+		return printJSON(out)
+	}
+	if len(shown) == 0 {
+		fmt.Println("No sent messages in your history")
+		return nil
+	}
+
+	aliases, names := contactNames(config)
+	opts := renderOptionsFromConfig(config)
+	for _, r := range shown {
+		msg := r.msg
+		fmt.Printf("\nMessage ID: %s\n", safeLine(msg.ID, opts))
+		fmt.Printf("To: %s (%s)\n", safeLine(contactLabel(msg.Recipient, aliases, names), opts), safeLine(msg.Recipient, opts))
+		fmt.Printf("Time: %s\n", time.Unix(msg.Timestamp, 0).Format(time.RFC3339))
+		state := status(r)
+		if gone[msg.ID] && state != "expired" {
+			state += " (no longer on the hub)"
+		}
+		fmt.Printf("Status: %s\n", safeLine(state, opts))
+		if msg.InReplyTo != "" {
+			fmt.Printf("In reply to: %s\n", safeLine(msg.InReplyTo, opts))
+		}
+		if r.parts > 1 {
+			fmt.Printf("Parts: %d (other part IDs: %s)\n", r.parts, safeLine(strings.Join(r.ids[1:], ", "), opts))
+		}
+		if r.signature == SignatureInvalid {
+			fmt.Println("Message: [withheld: your copy fails its signature check and was altered]")
+			fmt.Println("---")
+			continue
+		}
+		indent := strings.Repeat(" ", len("Message: "))
+		fmt.Printf("Message: %s\n", strings.TrimPrefix(renderBody(string(r.content), opts, indent), indent))
+		fmt.Println("---")
+	}
+	return nil
+}
+
+// refreshSentStates asks the hub for the delivery state of sent messages whose state
+// may still change, recording what it reports. A split message is tracked through its
+// first part. The first failure to reach the hub ends the refresh with a notice.
+func refreshSentStates(ctx context.Context, client *clspclient.Client, store *localStore, sent []sentMessage, inOutbox map[string]bool) {
+	lookups := 0
+	for i := range sent {
+		s := &sent[i]
+		if s.gone || s.state == "read" || inOutbox[s.msg.ID] {
+			continue
+		}
+		if lookups >= maxSentLookups {
+			return
+		}
+		lookups++
+		status, err := client.MessageStatus(ctx, s.msg.ID)
+		switch {
+		case errors.Is(err, clspclient.ErrMessageNotFound):
+			s.gone = true
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Could not check delivery states with the hub (%v); showing the last known ones\n", err)
+			return
+		default:
+			s.state = status.State
+		}
+		if err := store.setSentState(ctx, s.msg.ID, s.state, s.gone); err != nil {
+			fmt.Fprintf(notices(), "Warning: %v\n", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	"golang.org/x/term"
+)
+
+// DefaultAutoLockAfter is the idle period after which an unlocked identity is locked again
+const DefaultAutoLockAfter = 15 * time.Minute
+
+// idleLockPeriod returns the configured auto-lock period; a negative value disables auto-lock
+func (c *Config) idleLockPeriod() time.Duration {
+	if c.AutoLockAfter == 0 {
+		return DefaultAutoLockAfter
+	}
+	return c.AutoLockAfter
+}
+
+// errIdentityLocked is returned by loadIdentityKey when the key is protected, no key
+// agent holds it and prompting is turned off
+var errIdentityLocked = errors.New("identity is locked; run 'clsp unlock'")
+
+// noPassphrasePrompt keeps loadIdentityKey from prompting, in processes without a
+// terminal of their own such as the daemon
+var noPassphrasePrompt bool
+
+// loadIdentityKey returns the user's private key, from the key agent or by prompting
+// for the passphrase when the key is protected
+func loadIdentityKey() (*rsa.PrivateKey, error) {
+	keyPath := paths.GetKeyPath("private.key")
+	encrypted, err := crypto.IsPrivateKeyEncrypted(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+	if !encrypted {
+		return crypto.LoadPrivateKey(keyPath)
+	}
+
+	config, err := sessionAutoLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	if privateKey := agentKey(); privateKey != nil {
+		return privateKey, nil
+	}
+	if noPassphrasePrompt {
+		return nil, errIdentityLocked
+	}
+
+	passphrase, err := readPassphrase("Passphrase to unlock your identity: ")
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := crypto.LoadEncryptedPrivateKey(keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err := startKeyAgent(privateKey, config.idleLockPeriod()); err != nil {
+		fmt.Fprintf(notices(), "Warning: failed to keep the key unlocked: %v\n", err)
+	}
+	return privateKey, nil
+}
+
+// loadIdentityPublicKey returns the user's public key without unlocking the private key when possible
+func loadIdentityPublicKey() (*rsa.PublicKey, error) {
+	if publicKey, err := crypto.LoadPublicKey(); err == nil {
+		return publicKey, nil
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return nil, err
+	}
+	return &privateKey.PublicKey, nil
+}
+
+// readPassphrase reads a passphrase without echo from a terminal, or a line from piped stdin
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(notices(), prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(notices())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		return passphrase, nil
+	}
+
+	// Read byte by byte so input meant for later prompts is left on stdin
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 0 || err != nil {
+			if len(line) == 0 {
+				return nil, fmt.Errorf("failed to read passphrase: no input")
+			}
+			break
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		line = append(line, buf[0])
+	}
+	return []byte(strings.TrimRight(string(line), "\r")), nil
+}
+
+// Lock drops any cached unlocked key material so the passphrase is required on next
+// use, in the key agent and in a running daemon
+func Lock() error {
+	stopKeyAgent()
+	lockDaemon()
+	fmt.Println("Identity locked")
+	return nil
+}
+
+// Unlock prompts for the passphrase and keeps the unlocked key in a key agent until it
+// is locked or goes idle
+func Unlock() error {
+	keyPath := paths.GetKeyPath("private.key")
+	encrypted, err := crypto.IsPrivateKeyEncrypted(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	if !encrypted {
+		fmt.Println("Your private key is not passphrase protected; nothing to unlock")
+		fmt.Println("Use 'clsp passphrase' to protect it")
+		return nil
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	privateKey, err := crypto.LoadEncryptedPrivateKey(keyPath, passphrase)
+	if err != nil {
+		return err
+	}
+	config, err := sessionAutoLock()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if err := startKeyAgent(privateKey, config.idleLockPeriod()); err != nil {
+		return err
+	}
+	fmt.Println("Identity unlocked")
+	return nil
+}
+
+// SetPassphrase protects the private key with a new passphrase, or removes protection
+func SetPassphrase(remove bool) error {
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return err
+	}
+	keyPath := paths.GetKeyPath("private.key")
+
+	if remove {
+		if err := crypto.SavePrivateKey(privateKey, keyPath); err != nil {
+			return err
+		}
+		fmt.Println("Passphrase removed; your private key is now stored unencrypted")
+		if source, err := LocalEncryption(); err == nil && source == KeySourceIdentity {
+			fmt.Println("Warning: local files are encrypted with your identity, which no longer needs a passphrase;")
+			fmt.Println("use 'clsp config --encrypt on --key-source keyring' to keep them protected")
+		}
+		return Lock()
+	}
+
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		return fmt.Errorf("passphrase cannot be empty (use --remove to drop protection)")
+	}
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return err
+	}
+	if string(passphrase) != string(confirm) {
+		return fmt.Errorf("passphrases do not match")
+	}
+
+	if err := crypto.SaveEncryptedPrivateKey(privateKey, keyPath, passphrase); err != nil {
+		return err
+	}
+	if err := crypto.SavePublicKey(&privateKey.PublicKey, paths.GetKeyPath("public.pem")); err != nil {
+		return err
+	}
+	fmt.Println("Passphrase set")
+	return Lock()
+}
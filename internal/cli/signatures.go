@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Signature states shown with received messages
+const (
+	// SignatureVerified means the sender's pinned key signed the message
+	SignatureVerified = "verified"
+	// SignatureUnverified means no key was available to check the signature with, or
+	// the sender has a new key that was not accepted yet
+	SignatureUnverified = "unverified"
+	// SignatureInvalid means the signature does not match the sender's key: the message
+	// was altered, or someone other than the claimed sender wrote it
+	SignatureInvalid = "invalid"
+)
+
+// signatureChecker verifies received messages against their senders' pinned keys.
+// Senders without a pin are looked up in the hub directory, when online, and pinned
+// on first use as clsp send does.
+type signatureChecker struct {
+	ctx    context.Context
+	config *Config
+	known  *KnownKeys
+	online bool
+	// key signs lookups of senders of other hubs
+	key *rsa.PrivateKey
+
+	directory map[string]User
+	fetched   bool
+	pinned    bool
+	keys      map[string]*rsa.PublicKey
+}
+
+// newSignatureChecker returns a checker; online allows it to query the hub directory,
+// signing lookups of users of other hubs with key
+func newSignatureChecker(ctx context.Context, config *Config, key *rsa.PrivateKey, online bool) (*signatureChecker, error) {
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &signatureChecker{ctx: ctx, config: config, known: known, online: online, key: key, keys: make(map[string]*rsa.PublicKey)}, nil
+}
+
+// directoryUser returns the sender's current directory entry, fetching the directory
+// once per command. Senders of other hubs (id@hub) are looked up through the hub one
+// at a time.
+func (c *signatureChecker) directoryUser(id string) (User, bool) {
+	if !c.online {
+		return User{}, false
+	}
+	if strings.Contains(id, "@") {
+		if u, ok := c.directory[id]; ok {
+			return u, true
+		}
+		u, err := hubClient(c.config, c.key).FederatedUser(c.ctx, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not fetch the key of %s (%v); its signatures are unverified\n", id, err)
+			return User{}, false
+		}
+		if c.directory == nil {
+			c.directory = make(map[string]User)
+		}
+		c.directory[id] = *u
+		return *u, true
+	}
+	if !c.fetched {
+		c.fetched = true
+		users, err := fetchDirectory(c.ctx, c.config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not fetch sender keys (%v); signatures of new senders are unverified\n", err)
+			return User{}, false
+		}
+		if c.directory == nil {
+			c.directory = make(map[string]User, len(users))
+		}
+		for _, u := range users {
+			c.directory[u.ID] = u
+		}
+	}
+	u, ok := c.directory[id]
+	return u, ok
+}
+
+// parseKey parses a PEM public key, caching the result
+func (c *signatureChecker) parseKey(pemKey string) *rsa.PublicKey {
+	if key, ok := c.keys[pemKey]; ok {
+		return key
+	}
+	key, err := crypto.LoadPublicKeyFromPEM([]byte(pemKey))
+	if err != nil {
+		key = nil
+	}
+	c.keys[pemKey] = key
+	return key
+}
+
+// senderKey returns the sender's pinned key, pinning the directory key of a sender
+// seen for the first time
+func (c *signatureChecker) senderKey(senderID string) *rsa.PublicKey {
+	if pin, ok := c.known.Keys[senderID]; ok {
+		return c.parseKey(pin.PublicKey)
+	}
+	u, ok := c.directoryUser(senderID)
+	if !ok {
+		return nil
+	}
+	fingerprint, err := keyFingerprint(u.PublicKey)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	c.known.Keys[senderID] = KnownKey{
+		DisplayName: u.DisplayName,
+		Fingerprint: fingerprint,
+		PublicKey:   u.PublicKey,
+		FirstSeen:   now,
+		LastChecked: now,
+	}
+	c.pinned = true
+	return c.parseKey(u.PublicKey)
+}
+
+// signingKey returns the sender's Ed25519 signing key: the pinned one, or else the
+// directory's if the sender's pinned identity key certified it, which is then pinned
+func (c *signatureChecker) signingKey(senderID string, identityKey *rsa.PublicKey) ed25519.PublicKey {
+	pin := c.known.Keys[senderID]
+	if pin.SigningKey != "" {
+		if key, err := crypto.LoadSigningPublicKeyFromPEM(pin.SigningKey); err == nil {
+			return key
+		}
+	}
+	u, ok := c.directoryUser(senderID)
+	if !ok || u.PublicKey != pin.PublicKey {
+		return nil
+	}
+	key, err := u.VerifySigningKey(identityKey)
+	if err != nil {
+		return nil
+	}
+	pin.SigningKey = u.SigningKey
+	c.known.Keys[senderID] = pin
+	c.pinned = true
+	return key
+}
+
+// check returns the signature state of msg; call it before decrypting the message
+func (c *signatureChecker) check(msg *crypto.Message) string {
+	key := c.senderKey(msg.Sender)
+	if key == nil {
+		return SignatureUnverified
+	}
+	var signingKey ed25519.PublicKey
+	if msg.SignatureAlg == crypto.SignatureEd25519 {
+		signingKey = c.signingKey(msg.Sender, key)
+	}
+	if crypto.VerifyMessageSignature(key, signingKey, msg) == nil {
+		return SignatureVerified
+	}
+	// Messages signed before a key rotation the pin followed
+	if msg.SignatureAlg == "" {
+		for _, previous := range c.known.Keys[msg.Sender].PreviousKeys {
+			if key := c.parseKey(previous); key != nil && crypto.VerifySignature(key, msg) == nil {
+				return SignatureVerified
+			}
+		}
+	}
+	if u, ok := c.directoryUser(msg.Sender); ok {
+		pin := c.known.Keys[msg.Sender]
+		if u.PublicKey != pin.PublicKey {
+			if fingerprint, err := keyFingerprint(u.PublicKey); err == nil && c.known.followRotation(&u, fingerprint) {
+				c.pinned = true
+				rotationNotice(safeLine(u.DisplayName, renderOptionsFromConfig(c.config)), pin.Fingerprint, fingerprint)
+				return c.check(msg)
+			}
+		}
+		if current := c.parseKey(u.PublicKey); current != nil {
+			certified, _ := u.VerifySigningKey(current)
+			if crypto.VerifyMessageSignature(current, certified, msg) == nil {
+				// A new signing key certified by the pinned identity key is as good as it
+				if u.PublicKey == pin.PublicKey {
+					pin.SigningKey = u.SigningKey
+					c.known.Keys[msg.Sender] = pin
+					c.pinned = true
+					return SignatureVerified
+				}
+				// A sender who replaced their key signs with one that is not pinned yet
+				return SignatureUnverified
+			}
+		}
+	}
+	if msg.SignatureAlg == crypto.SignatureEd25519 && signingKey == nil {
+		return SignatureUnverified
+	}
+	return SignatureInvalid
+}
+
+// save stores the keys of senders pinned during the checks
+func (c *signatureChecker) save() {
+	if !c.pinned {
+		return
+	}
+	if err := SaveKnownKeys(c.known); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	c.pinned = false
+}
+
+// weakerSignature returns the less trustworthy of two signature states
+func weakerSignature(a, b string) string {
+	rank := map[string]int{SignatureVerified: 0, SignatureUnverified: 1, SignatureInvalid: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
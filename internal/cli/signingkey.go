@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"os"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+)
+
+// Files of the Ed25519 signing key: the private key sealed to the RSA identity key,
+// so it is unlocked together with it, and the public key for 'clsp whoami'
+const (
+	signingKeyFile       = "signing.key"
+	signingPublicKeyFile = "signing.pub"
+)
+
+// signingKeys caches unsealed signing keys per identity key within a command
+var signingKeys = make(map[*rsa.PrivateKey]ed25519.PrivateKey)
+
+// loadSigningKey returns the signing key of the identity, or nil if it has none yet
+func loadSigningKey(privateKey *rsa.PrivateKey) (ed25519.PrivateKey, error) {
+	if key, ok := signingKeys[privateKey]; ok {
+		return key, nil
+	}
+	data, err := os.ReadFile(paths.GetKeyPath(signingKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	key, err := crypto.OpenSigningKey(data, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	signingKeys[privateKey] = key
+	return key, nil
+}
+
+// createSigningKey generates a signing key for the identity and saves it sealed to
+// the identity key
+func createSigningKey(privateKey *rsa.PrivateKey) (ed25519.PrivateKey, error) {
+	key, err := crypto.GenerateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := crypto.SealSigningKey(key, &privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := crypto.SigningPublicKeyToPEM(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(paths.GetKeyPath(signingKeyFile), sealed, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save signing key: %v", err)
+	}
+	if err := os.WriteFile(paths.GetKeyPath(signingPublicKeyFile), []byte(publicKeyPEM), 0644); err != nil {
+		return nil, fmt.Errorf("failed to save signing key: %v", err)
+	}
+	signingKeys[privateKey] = key
+	return key, nil
+}
+
+// ensureSigningKey returns the identity's signing key, creating one for identities
+// made before signing keys existed
+func ensureSigningKey(privateKey *rsa.PrivateKey) (ed25519.PrivateKey, error) {
+	key, err := loadSigningKey(privateKey)
+	if err != nil || key != nil {
+		return key, err
+	}
+	fmt.Println("Generating signing key...")
+	return createSigningKey(privateKey)
+}
+
+// loadSigningPublicKey returns the public half of the identity's signing key without
+// unlocking the identity, or nil if it has none
+func loadSigningPublicKey() (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(paths.GetKeyPath(signingPublicKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	return crypto.LoadSigningPublicKeyFromPEM(string(data))
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// oidcTokenEnv lets scripts supply an ID token instead of the interactive device login
+const oidcTokenEnv = "CLSP_OIDC_TOKEN"
+
+// deviceGrantType is the OAuth 2.0 device authorization grant (RFC 8628)
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// ssoToken returns an ID token for hubs that gate registration on OIDC, or "" when the
+// hub does not. The token comes from CLSP_OIDC_TOKEN or an interactive device login.
+func ssoToken(ctx context.Context, hubInfo *HubInfo) (string, error) {
+	if !hubInfo.Config.RequireOIDC {
+		return "", nil
+	}
+	if token := strings.TrimSpace(os.Getenv(oidcTokenEnv)); token != "" {
+		return token, nil
+	}
+	return deviceLogin(ctx, hubInfo.Config.OIDCIssuer, hubInfo.Config.OIDCClientID)
+}
+
+// postForm submits an OAuth form request and decodes the JSON response, returning
+// the OAuth error code (if any) separately from transport errors
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, out interface{}) (string, error) {
+	resp, err := hubPost(ctx, client, endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&oauthErr)
+		if oauthErr.Error == "" {
+			return "", fmt.Errorf("%s returned status %d", endpoint, resp.StatusCode)
+		}
+		return oauthErr.Error, nil
+	}
+	return "", json.NewDecoder(resp.Body).Decode(out)
+}
+
+// deviceLogin runs the device authorization flow against the identity provider and
+// returns the resulting ID token
+func deviceLogin(ctx context.Context, issuer, clientID string) (string, error) {
+	client := newHubClient(ctx, DefaultRequestTimeout)
+
+	resp, err := hubGet(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("failed to reach identity provider: %v", err)
+	}
+	var disc struct {
+		TokenEndpoint               string `json:"token_endpoint"`
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&disc)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse identity provider metadata: %v", err)
+	}
+	if disc.DeviceAuthorizationEndpoint == "" {
+		return "", fmt.Errorf("identity provider does not support device login; set %s to an ID token instead", oidcTokenEnv)
+	}
+
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	form := url.Values{"client_id": {clientID}, "scope": {"openid email profile"}}
+	if code, err := postForm(ctx, client, disc.DeviceAuthorizationEndpoint, form, &auth); err != nil || code != "" {
+		if err == nil {
+			err = fmt.Errorf("%s", code)
+		}
+		return "", fmt.Errorf("device login failed: %v", err)
+	}
+
+	fmt.Println("\nThis hub requires single sign-on.")
+	if auth.VerificationURIComplete != "" {
+		fmt.Printf("Open %s to sign in\n", auth.VerificationURIComplete)
+	} else {
+		fmt.Printf("Open %s and enter code: %s\n", auth.VerificationURI, auth.UserCode)
+	}
+	fmt.Println("Waiting for sign-in...")
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	if auth.ExpiresIn <= 0 {
+		deadline = time.Now().Add(10 * time.Minute)
+	}
+
+	poll := url.Values{"grant_type": {deviceGrantType}, "device_code": {auth.DeviceCode}, "client_id": {clientID}}
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var tok struct {
+			IDToken string `json:"id_token"`
+		}
+		code, err := postForm(ctx, client, disc.TokenEndpoint, poll, &tok)
+		if err != nil {
+			return "", fmt.Errorf("device login failed: %v", err)
+		}
+		switch code {
+		case "":
+			if tok.IDToken == "" {
+				return "", fmt.Errorf("identity provider returned no ID token")
+			}
+			return tok.IDToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("device login failed: %s", code)
+		}
+	}
+	return "", fmt.Errorf("device login expired")
+}
@@ -0,0 +1,408 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// localStoreFile is the client's message history database in the config directory
+const localStoreFile = "messages.db"
+
+// ListSource selects where clsp list reads messages from
+type ListSource int
+
+const (
+	// ListMerged syncs new messages from the hub into the local store and lists the store
+	ListMerged ListSource = iota
+	// ListLocal lists the local store without contacting the hub
+	ListLocal
+	// ListRemote lists only the messages the hub currently holds
+	ListRemote
+)
+
+// localStore keeps received messages after they expire on the hub. Messages are
+// stored as the envelopes the hub delivered, still encrypted to the user's key,
+// and are only decrypted when shown; with encryption at rest the envelopes are
+// sealed again, hiding their metadata too. Messages encrypted to a prekey also keep
+// their content key sealed with the identity key, since the prekey is deleted
+// after a while.
+type localStore struct {
+	db *sql.DB
+}
+
+// openLocalStore opens (creating if needed) the local message store
+func openLocalStore() (*localStore, error) {
+	if err := paths.EnsureConfigDir(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", paths.GetConfigPath(localStoreFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local message store: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			sender_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			envelope BLOB NOT NULL,
+			read INTEGER NOT NULL DEFAULT 0,
+			stored_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create local message store: %v", err)
+	}
+	// Stores created before forward secrecy lack the sealed key column, and those
+	// created before sender expiry the expiry column
+	for _, column := range []string{"local_key BLOB", "expires_at INTEGER NOT NULL DEFAULT 0"} {
+		if _, err := db.Exec("ALTER TABLE messages ADD COLUMN " + column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("failed to upgrade local message store: %v", err)
+		}
+	}
+	if err := createArchiveChain(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createOutbox(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createPendingReads(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createSent(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createScreened(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createScheduled(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &localStore{db: db}, nil
+}
+
+// Close closes the store
+func (st *localStore) Close() error {
+	return st.db.Close()
+}
+
+// Save records messages fetched from the hub; messages already stored keep their
+// envelope, but pick up a read status reported by the hub. keys seals the content
+// keys of messages encrypted to a prekey. The sender's expiry is kept in the clear,
+// so expired messages can be purged without opening every envelope.
+func (st *localStore) Save(ctx context.Context, messages []crypto.Message, keys *crypto.Keyring) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save messages locally: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Messages are added to the integrity chain as they are first stored
+	var chain *archiveChain
+	if keys != nil && keys.Identity != nil {
+		if chain, err = openArchiveChain(ctx, tx, crypto.LocalMACKey(keys.Identity)); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	for i := range messages {
+		msg := &messages[i]
+		envelope, sender, err := sealEnvelope(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode message %s: %v", msg.ID, err)
+		}
+		// A message whose prekey is unknown is still stored; it stays unreadable
+		localKey, _ := keys.SaveMessageKey(msg)
+		read := msg.Status == "read"
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO messages (id, sender_id, timestamp, envelope, read, stored_at, local_key, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET read = MAX(read, excluded.read), local_key = COALESCE(local_key, excluded.local_key)`,
+			msg.ID, sender, msg.Timestamp, envelope, read, now, localKey, msg.ExpiresAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save message %s locally: %v", msg.ID, err)
+		}
+		if chain != nil {
+			if err := chain.append(ctx, tx, msg); err != nil {
+				return err
+			}
+		}
+	}
+	if chain != nil {
+		if err := chain.saveHead(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save messages locally: %v", err)
+	}
+	return nil
+}
+
+// notExpired selects stored messages whose sender's expiry has not passed; expired
+// ones are never shown, even before purgeExpired deletes them
+const notExpired = "(expires_at = 0 OR expires_at > ?)"
+
+// Messages returns stored messages, newest first, with their status reflecting
+// whether they have been shown in a full listing
+func (st *localStore) Messages(ctx context.Context, unreadOnly bool) ([]crypto.Message, error) {
+	query := "SELECT envelope, read FROM messages WHERE " + notExpired
+	if unreadOnly {
+		query += " AND read = 0"
+	}
+	query += " ORDER BY timestamp DESC"
+
+	rows, err := st.db.QueryContext(ctx, query, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []crypto.Message
+	for rows.Next() {
+		var envelope []byte
+		var read bool
+		if err := rows.Scan(&envelope, &read); err != nil {
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+		msg, err := openEnvelope(envelope)
+		if err != nil {
+			return nil, err
+		}
+		msg.Status = "unread"
+		if read {
+			msg.Status = "read"
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+// Message returns the stored message with the given ID, or nil if there is none
+func (st *localStore) Message(ctx context.Context, id string) (*crypto.Message, error) {
+	var envelope []byte
+	err := st.db.QueryRowContext(ctx, "SELECT envelope FROM messages WHERE id = ? AND "+notExpired, id, time.Now().Unix()).Scan(&envelope)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local message %s: %v", id, err)
+	}
+	return openEnvelope(envelope)
+}
+
+// sealEnvelope encodes a message for the store. With encryption at rest the envelope
+// is sealed and the sender column left empty, so the archive does not reveal who
+// the user talks to.
+func sealEnvelope(msg *crypto.Message) (envelope []byte, sender string, err error) {
+	envelope, err = json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	sealed, err := sealLocalData(envelope)
+	if err != nil {
+		return nil, "", err
+	}
+	if isSealed(sealed) {
+		return sealed, "", nil
+	}
+	return envelope, msg.Sender, nil
+}
+
+// openEnvelope decodes a stored envelope, decrypting it if it was sealed
+func openEnvelope(envelope []byte) (*crypto.Message, error) {
+	envelope, err := openLocalData(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local message: %v", err)
+	}
+	var msg crypto.Message
+	if err := json.Unmarshal(envelope, &msg); err != nil {
+		return nil, fmt.Errorf("corrupt local message: %v", err)
+	}
+	return &msg, nil
+}
+
+// envelopes returns every stored message, decrypted, for rewriting under new
+// at-rest settings
+func (st *localStore) envelopes(ctx context.Context) ([]crypto.Message, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT envelope FROM messages")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []crypto.Message
+	for rows.Next() {
+		var envelope []byte
+		if err := rows.Scan(&envelope); err != nil {
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+		msg, err := openEnvelope(envelope)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+// rewriteEnvelopes stores messages again with the current at-rest settings
+func (st *localStore) rewriteEnvelopes(ctx context.Context, messages []crypto.Message) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite local messages: %v", err)
+	}
+	defer tx.Rollback()
+
+	for i := range messages {
+		envelope, sender, err := sealEnvelope(&messages[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode message %s: %v", messages[i].ID, err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET envelope = ?, sender_id = ? WHERE id = ?", envelope, sender, messages[i].ID); err != nil {
+			return fmt.Errorf("failed to rewrite local message %s: %v", messages[i].ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rewrite local messages: %v", err)
+	}
+	// Drop the old plaintext pages from the database file
+	if _, err := st.db.ExecContext(ctx, "VACUUM"); err != nil {
+		return fmt.Errorf("failed to compact local message store: %v", err)
+	}
+	return nil
+}
+
+// LoadSavedKeys adds the sealed content keys of stored messages to keys
+func (st *localStore) LoadSavedKeys(ctx context.Context, keys *crypto.Keyring) error {
+	rows, err := st.db.QueryContext(ctx, "SELECT id, local_key FROM messages WHERE local_key IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("failed to read local message keys: %v", err)
+	}
+	defer rows.Close()
+
+	if keys.SavedKeys == nil {
+		keys.SavedKeys = make(map[string][]byte)
+	}
+	for rows.Next() {
+		var id string
+		var sealed []byte
+		if err := rows.Scan(&id, &sealed); err != nil {
+			return fmt.Errorf("failed to read local message keys: %v", err)
+		}
+		keys.SavedKeys[id] = sealed
+	}
+	return rows.Err()
+}
+
+// readIDs returns the IDs of stored messages already marked read
+func (st *localStore) readIDs(ctx context.Context) (map[string]bool, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT id FROM messages WHERE read = 1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local messages: %v", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read local messages: %v", err)
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// partIDs returns the IDs of every stored part of the split message msg belongs to,
+// or just msg's ID when it was not split
+func (st *localStore) partIDs(ctx context.Context, msg *crypto.Message) ([]string, error) {
+	if msg.Part == nil {
+		return []string{msg.ID}, nil
+	}
+	messages, err := st.envelopes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range messages {
+		if m.Part != nil && m.Part.Group == msg.Part.Group && m.Sender == msg.Sender {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, nil
+}
+
+// purgeExpired deletes received messages and copies of sent ones whose sender's
+// expiry has passed. Deleted messages keep their link in the integrity chain, marked
+// as expired with key, so 'clsp archive verify' does not report them as tampering.
+func (st *localStore) purgeExpired(ctx context.Context, key []byte) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to purge expired messages: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM messages WHERE expires_at != 0 AND expires_at <= ?", now)
+	if err != nil {
+		return fmt.Errorf("failed to purge expired messages: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to purge expired messages: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to purge expired messages: %v", err)
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to purge expired message %s: %v", id, err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE archive_chain SET expired_mac = ? WHERE message_id = ?", expiredMAC(key, id), id); err != nil {
+			return fmt.Errorf("failed to purge expired message %s: %v", id, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sent WHERE expires_at != 0 AND expires_at <= ?", now); err != nil {
+		return fmt.Errorf("failed to purge expired sent messages: %v", err)
+	}
+	return tx.Commit()
+}
+
+// MarkRead records that messages were shown
+func (st *localStore) MarkRead(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if _, err := st.db.ExecContext(ctx, "UPDATE messages SET read = 1 WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to update local message %s: %v", id, err)
+		}
+	}
+	return nil
+}
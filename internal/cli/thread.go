@@ -0,0 +1,277 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// ReplyMessage answers a received message: the reply goes to its sender, marked as
+// in reply to it, so both sides can follow the conversation with 'clsp list --thread'
+func ReplyMessage(ctx context.Context, messageID, text string, opts SendOptions) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	msg, err := store.Message(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	// Messages not listed yet are fetched first
+	if msg == nil {
+		privateKey, err := loadIdentityKey()
+		if err != nil {
+			return fmt.Errorf("failed to load private key: %v", err)
+		}
+		keys, err := loadKeyring(privateKey)
+		if err != nil {
+			return err
+		}
+		if err := syncMessages(ctx, config, store, keys, true); err != nil {
+			return fmt.Errorf("failed to fetch messages: %v", err)
+		}
+		if msg, err = store.Message(ctx, messageID); err != nil {
+			return err
+		}
+	}
+	if msg == nil {
+		return fmt.Errorf("message %s not found among the messages you received", messageID)
+	}
+
+	opts.InReplyTo = msg.ID
+	return SendMessage(ctx, msg.Sender, text, opts)
+}
+
+// maxThreadLookups bounds the hub queries a thread listing makes for your own
+// messages that received messages reply to
+const maxThreadLookups = 50
+
+// threadNode is a message in a thread with the replies to it. Received messages and
+// your kept copies of sent ones come from the local history; your messages sent
+// before copies were kept are known only from the hub's delivery status, so sent
+// holds that instead of a decrypted message.
+type threadNode struct {
+	r       receivedMessage
+	sent    *clspclient.DeliveryStatus
+	replies []*threadNode
+}
+
+// id returns the message ID
+func (n *threadNode) id() string {
+	if n.sent != nil {
+		return n.sent.ID
+	}
+	return n.r.msg.ID
+}
+
+// parent returns the ID of the message this one answers
+func (n *threadNode) parent() string {
+	if n.sent != nil {
+		return n.sent.InReplyTo
+	}
+	return n.r.msg.InReplyTo
+}
+
+// time returns when the message was sent
+func (n *threadNode) time() time.Time {
+	if n.sent != nil {
+		return n.sent.CreatedAt
+	}
+	return time.Unix(n.r.msg.Timestamp, 0)
+}
+
+// ListThread shows the conversation messageID belongs to: the earliest message of it
+// in the local history, then every reply below the message it answers. Messages are
+// synced from the hub first unless source is ListLocal. Your own messages without a
+// local copy are filled in from the hub while it still stores them; without them a
+// thread starts at the earliest message present.
+func ListThread(ctx context.Context, messageID string, source ListSource) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+
+	if source != ListLocal {
+		if err := syncMessages(ctx, config, store, keys, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not sync with the hub (%v); showing local history\n", err)
+		}
+	}
+	messages, err := store.Messages(ctx, false)
+	if err != nil {
+		return err
+	}
+	if err := store.LoadSavedKeys(ctx, keys); err != nil {
+		return err
+	}
+	received, err := openReceived(ctx, config, keys, messages, source != ListLocal)
+	if err != nil {
+		return err
+	}
+	sent, err := store.sentMessages(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Index every message under each of its part IDs, since a reply may name any part
+	nodes := make(map[string]*threadNode)
+	var all []*threadNode
+	for _, r := range append(joinParts(received), openSent(config, keys, privateKey, sent)...) {
+		node := &threadNode{r: r}
+		all = append(all, node)
+		nodes[r.msg.ID] = node
+		for _, id := range r.ids {
+			nodes[id] = node
+		}
+	}
+	// Replies to your own messages without a local copy are linked up through the hub,
+	// which tells the sender what each of their messages answered while it is stored
+	if source != ListLocal {
+		client := hubClient(config, privateKey)
+		lookups := 0
+		for i := 0; i < len(all) && lookups < maxThreadLookups; i++ {
+			id := all[i].parent()
+			if id == "" || nodes[id] != nil {
+				continue
+			}
+			lookups++
+			status, err := client.MessageStatus(ctx, id)
+			if err != nil {
+				continue
+			}
+			node := &threadNode{sent: status}
+			all = append(all, node)
+			nodes[id] = node
+		}
+	}
+
+	start, ok := nodes[messageID]
+	if !ok {
+		return fmt.Errorf("message %s not found in your history", messageID)
+	}
+	for _, node := range all {
+		if parent, ok := nodes[node.parent()]; ok && parent != node {
+			parent.replies = append(parent.replies, node)
+		}
+	}
+
+	// Walk up to the earliest message present, guarding against reply loops
+	root := start
+	visited := map[*threadNode]bool{root: true}
+	for {
+		parent, ok := nodes[root.parent()]
+		if !ok || visited[parent] {
+			break
+		}
+		visited[parent] = true
+		root = parent
+	}
+
+	var ordered []*threadNode
+	var depths []int
+	shown := make(map[*threadNode]bool)
+	var walk func(node *threadNode, depth int)
+	walk = func(node *threadNode, depth int) {
+		if shown[node] {
+			return
+		}
+		shown[node] = true
+		ordered = append(ordered, node)
+		depths = append(depths, depth)
+		sort.SliceStable(node.replies, func(i, j int) bool {
+			return node.replies[i].time().Before(node.replies[j].time())
+		})
+		for _, reply := range node.replies {
+			walk(reply, depth+1)
+		}
+	}
+	walk(root, 0)
+
+	var shownIDs []string
+	for _, node := range ordered {
+		if node.sent == nil && node.r.msg.Sender != config.UserID {
+			shownIDs = append(shownIDs, node.r.msg.ID)
+			shownIDs = append(shownIDs, node.r.ids...)
+		}
+	}
+	if JSONOutput {
+		out := make([]MessageJSON, 0, len(ordered))
+		for i, node := range ordered {
+			var m MessageJSON
+			if node.sent != nil {
+				m = MessageJSON{ID: node.sent.ID, SenderID: config.UserID, Time: node.sent.CreatedAt.UTC(), Status: node.sent.State, InReplyTo: node.sent.InReplyTo}
+			} else {
+				m = messageJSON(node.r)
+				if node.r.msg.Sender == config.UserID {
+					m.RecipientID = node.r.msg.Recipient
+				}
+			}
+			m.Depth = depths[i]
+			out = append(out, m)
+		}
+		if err := printJSON(out); err != nil {
+			return err
+		}
+		return store.MarkRead(ctx, shownIDs)
+	}
+
+	opts := renderOptionsFromConfig(config)
+	if id := root.parent(); id != "" {
+		fmt.Printf("(in reply to %s, which is not in your history)\n", safeLine(id, opts))
+	}
+	for i, node := range ordered {
+		indent := strings.Repeat("    ", depths[i])
+		if node.sent != nil {
+			fmt.Printf("\n%s%s  you  %s  [%s]\n", indent, node.sent.CreatedAt.Format(time.RFC3339), safeLine(node.sent.ID, opts), safeLine(node.sent.State, opts))
+			fmt.Printf("%s  (sent to %s; your copy is not kept)\n", indent, safeLine(node.sent.RecipientID, opts))
+			continue
+		}
+		from := node.r.msg.Sender
+		if from == config.UserID {
+			from = "you"
+		}
+		printThreadEntry(node.r, from, indent, opts)
+	}
+	return store.MarkRead(ctx, shownIDs)
+}
+
+// printThreadEntry displays a message of a thread or conversation at the given
+// indentation, naming its sender as from
+func printThreadEntry(r receivedMessage, from, indent string, opts renderOptions) {
+	fmt.Printf("\n%s%s  %s  %s  [%s]\n", indent, time.Unix(r.msg.Timestamp, 0).Format(time.RFC3339),
+		safeLine(from, opts), safeLine(r.msg.ID, opts), r.signature)
+	if r.signature == SignatureInvalid {
+		fmt.Printf("%s  [withheld: the signature does not match the sender's key]\n", indent)
+	} else {
+		fmt.Println(renderBody(string(r.content), opts, indent+"  "))
+	}
+	if r.missing {
+		fmt.Printf("%s  (part %d of %d; remaining parts not received yet)\n", indent, r.msg.Part.Index+1, r.msg.Part.Total)
+	}
+	if a := r.msg.Attachment; a != nil {
+		fmt.Printf("%s  Attachment: %s (%d bytes; save with 'clsp save %s')\n", indent, safeLine(a.Filename, opts), a.Size, safeLine(r.msg.ID, opts))
+	}
+}
@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The configured hub's certificate is checked against the CA bundle in
+// Config.TLSCertPath instead of the system roots when one is set, or against the
+// pinned key in Config.HubCertPin, which replaces CA validation altogether so that
+// hubs with self-signed certificates can be trusted on first use. Connections to
+// other hosts are verified as usual. Hubs that ask for a client certificate get the
+// one in Config.TLSClientCert if it was issued by a CA they accept.
+
+// pinPrefix starts a certificate pin, naming its hash
+const pinPrefix = "sha256/"
+
+// hubTLS is the TLS trust the configuration last loaded sets for its hub
+type hubTLS struct {
+	host     string
+	caFile   string
+	pin      string
+	certFile string
+	keyFile  string
+}
+
+var (
+	// configuredTLS holds the hubTLS of the last configuration loaded
+	configuredTLS atomic.Value
+	// hubTransport is the transport UseHubTLS set up; pin fetches start from it
+	hubTransport *http.Transport
+)
+
+// storeHubTLS makes the TLS settings of config govern connections to its hub
+func storeHubTLS(config *Config) {
+	settings := hubTLS{
+		caFile:   config.TLSCertPath,
+		pin:      config.HubCertPin,
+		certFile: config.TLSClientCert,
+		keyFile:  config.TLSClientKey,
+	}
+	if u, err := url.Parse(config.HubURL); err == nil {
+		settings.host = u.Hostname()
+	}
+	configuredTLS.Store(settings)
+}
+
+// UseHubTLS verifies the hub's certificate against the configured CA bundle or pin.
+// It must be called before any request is made, after UseProxy.
+func UseHubTLS() error {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("cannot configure TLS on %T", http.DefaultTransport)
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// verifyConnection does the verification, with the trust the hub needs
+		InsecureSkipVerify:   true,
+		VerifyConnection:     verifyConnection,
+		GetClientCertificate: clientCertificate,
+	}
+	hubTransport = transport
+	http.DefaultTransport = transport
+	return nil
+}
+
+// verifyConnection checks the certificate chain of a connection
+func verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("tls: %s sent no certificate", cs.ServerName)
+	}
+	settings, _ := configuredTLS.Load().(hubTLS)
+	isHub := settings.host != "" && strings.EqualFold(cs.ServerName, settings.host)
+
+	if isHub && settings.pin != "" {
+		for _, cert := range cs.PeerCertificates {
+			if CertificatePin(cert) == settings.pin {
+				return nil
+			}
+		}
+		return fmt.Errorf("tls: the certificate of %s does not match the pinned key %s (re-pin with 'clsp config --pin-hub-cert' only if the hub changed it)", cs.ServerName, settings.pin)
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if isHub && settings.caFile != "" {
+		roots, err := loadCertPool(settings.caFile)
+		if err != nil {
+			return err
+		}
+		opts.Roots = roots
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// clientCertificate returns the configured client certificate when the server accepts
+// its issuer, and otherwise none, leaving it to the server to refuse the connection
+func clientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	settings, _ := configuredTLS.Load().(hubTLS)
+	if settings.certFile == "" {
+		return &tls.Certificate{}, nil
+	}
+	cert, err := LoadClientCertificate(settings.certFile, settings.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if info.SupportsCertificate(cert) != nil {
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
+
+// LoadClientCertificate loads a PEM client certificate and its private key
+func LoadClientCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// CheckCABundle reports whether path holds a usable CA bundle
+func CheckCABundle(path string) error {
+	_, err := loadCertPool(path)
+	return err
+}
+
+// CertificatePin returns the pin of cert: the SHA-256 hash of its public key
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// FetchHubCertificate connects to the hub at hubURL and returns the certificate it
+// presents, without verifying it: it is what the user is about to decide to trust
+func FetchHubCertificate(ctx context.Context, hubURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(hubURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hub URL: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("the hub URL %s does not use https", hubURL)
+	}
+
+	base := hubTransport
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		InsecureSkipVerify:   true,
+		GetClientCertificate: clientCertificate,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport, Timeout: DefaultRequestTimeout}
+	resp, err := hubGet(ctx, client, strings.TrimSuffix(hubURL, "/")+"/health")
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("the hub presented no certificate")
+	}
+	return resp.TLS.PeerCertificates[0], nil
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// UnsendJSON is the result of `clsp unsend --json`
+type UnsendJSON struct {
+	ID string `json:"id"`
+	// Parts lists the hub IDs deleted, more than one for a split message
+	Parts []string `json:"parts"`
+	// Queued is set when the message was still in the outbox and never reached the hub
+	Queued bool `json:"queued,omitempty"`
+	// Delivered is set when the recipient had already fetched the message
+	Delivered bool `json:"delivered"`
+}
+
+// Unsend takes back a message you sent: it is removed from the outbox if it never
+// left, or deleted from the hub if the recipient has not fetched it yet or it was
+// sent within the hub's unsend window. Every part of a split message is deleted, and
+// your own copy goes too. A recipient who already fetched the message keeps it.
+func Unsend(ctx context.Context, messageID string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result := UnsendJSON{ID: messageID, Parts: []string{messageID}}
+	sent, err := store.sentByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if sent != nil {
+		result.ID = sent.msg.ID
+		if len(sent.partIDs) > 0 {
+			result.Parts = sent.partIDs
+		}
+	}
+
+	queued, err := store.queued(ctx)
+	if err != nil {
+		return err
+	}
+	for _, q := range queued {
+		if q.Envelope.ID == result.ID {
+			result.Queued = true
+			if err := store.dequeue(ctx, q.Envelope.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !result.Queued {
+		client := hubClient(config, privateKey)
+		deleted := 0
+		for _, id := range result.Parts {
+			unsent, err := client.Unsend(ctx, id)
+			switch {
+			case errors.Is(err, clspclient.ErrMessageNotFound) && deleted > 0:
+				// The hub no longer holds this part, which is as good as deleting it
+				continue
+			case errors.Is(err, clspclient.ErrMessageNotFound):
+				if sent != nil && strings.Contains(sent.msg.Recipient, "@") {
+					return fmt.Errorf("message %s went to another hub, which does not take messages back", result.ID)
+				}
+				return fmt.Errorf("message %s not found (it may have expired, or was not sent by you)", result.ID)
+			case errors.Is(err, clspclient.ErrTooLateToUnsend) && deleted > 0:
+				return fmt.Errorf("deleted %d of the %d parts of message %s; the recipient already fetched the rest and the hub's unsend window has passed", deleted, len(result.Parts), result.ID)
+			case errors.Is(err, clspclient.ErrTooLateToUnsend):
+				return fmt.Errorf("message %s was already fetched by its recipient and the hub's unsend window has passed", result.ID)
+			case err != nil:
+				return err
+			}
+			deleted++
+			result.Delivered = result.Delivered || unsent.Delivered
+		}
+	}
+
+	if sent != nil {
+		if err := store.deleteSent(ctx, sent.msg.ID); err != nil {
+			return err
+		}
+	}
+
+	if JSONOutput {
+		return printJSON(result)
+	}
+	opts := renderOptionsFromConfig(config)
+	switch {
+	case result.Queued:
+		fmt.Printf("Message %s removed from the outbox; it never reached the hub\n", safeLine(result.ID, opts))
+	case result.Delivered:
+		fmt.Printf("Message %s deleted from the hub\n", safeLine(result.ID, opts))
+		fmt.Println("The recipient had already fetched it, so it may remain on their devices")
+	default:
+		fmt.Printf("Message %s deleted from the hub before the recipient fetched it\n", safeLine(result.ID, opts))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// normalizeFingerprint strips separators from a fingerprint as typed or pasted by a
+// user, leaving lowercase hex digits
+func normalizeFingerprint(s string) string {
+	s = strings.ToLower(s)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == ':' || r == '-' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// VerifyContact marks a contact's current key as verified after the user compared its
+// fingerprint with the contact out-of-band. With expected set, the fingerprint the
+// contact gave (short or full) is checked instead of asking. A hub that substitutes
+// its own key for the contact's shows up here as a mismatch.
+func VerifyContact(ctx context.Context, user, expected string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	lookup := user
+	if id, ok := config.UserAliases[user]; ok {
+		lookup = id
+	}
+	client, err := lookupClient(config, lookup)
+	if err != nil {
+		return err
+	}
+	contact, err := client.FindUser(ctx, lookup)
+	if err != nil {
+		return err
+	}
+	if contact.ID == config.UserID {
+		return fmt.Errorf("that is your own identity; compare 'clsp whoami' with your contacts instead")
+	}
+	fingerprint, err := keyFingerprint(contact.PublicKey)
+	if err != nil {
+		return fmt.Errorf("hub offers an invalid key for %s: %v", user, err)
+	}
+	known, err := LoadKnownKeys()
+	if err != nil {
+		return err
+	}
+
+	opts := renderOptionsFromConfig(config)
+	fmt.Printf("User: %s (%s)\n", safeLine(contact.DisplayName, opts), safeLine(contact.ID, opts))
+	fmt.Printf("Fingerprint: %s\n", fingerprint)
+
+	pin, pinned := known.Keys[contact.ID]
+	switch known.keyState(contact.ID, fingerprint) {
+	case KeyVerified:
+		fmt.Printf("Already verified on %s\n", pin.VerifiedAt.Format(time.RFC3339))
+		return nil
+	case KeyChanged:
+		fmt.Printf("Warning: this is NOT the key pinned on %s:\n  %s\n", pin.FirstSeen.Format(time.RFC3339), pin.Fingerprint)
+		fmt.Println("Only continue if the contact confirms they replaced their key.")
+	}
+
+	if expected != "" {
+		given := normalizeFingerprint(expected)
+		full := normalizeFingerprint(fingerprint)
+		short := len(full) / 2
+		if _, err := hex.DecodeString(given); err != nil || len(given) < short {
+			return fmt.Errorf("give at least the short fingerprint (%d hex digits) shown by 'clsp whoami'", short)
+		}
+		if !strings.HasPrefix(full, given) {
+			return fmt.Errorf("fingerprint does not match the key the hub offers for %s; do not trust this key", user)
+		}
+	} else {
+		fmt.Printf("Ask %s for the fingerprint shown by 'clsp whoami' over a channel you trust.\n", safeLine(contact.DisplayName, opts))
+		fmt.Print("Does it match the fingerprint above? (y/N): ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			return fmt.Errorf("key not verified")
+		}
+	}
+
+	now := time.Now()
+	if !pinned || pin.Fingerprint != fingerprint {
+		pin = KnownKey{FirstSeen: now}
+	}
+	pin.DisplayName = contact.DisplayName
+	pin.Fingerprint = fingerprint
+	pin.PublicKey = contact.PublicKey
+	pin.LastChecked = now
+	pin.ChangedAt = nil
+	pin.RemovedAt = nil
+	pin.VerifiedAt = &now
+	known.Keys[contact.ID] = pin
+	if err := SaveKnownKeys(known); err != nil {
+		return err
+	}
+	fmt.Printf("Key of %s marked as verified\n", safeLine(contact.DisplayName, opts))
+	return nil
+}
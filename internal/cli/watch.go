@@ -0,0 +1,353 @@
+package cli
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// DefaultWatchInterval is how often 'clsp watch' polls the hub while connected
+const DefaultWatchInterval = 15 * time.Second
+
+// watchRetryDelay and maxWatchBackoff bound the delay between reconnection attempts,
+// which doubles after each failure
+const (
+	watchRetryDelay = 2 * time.Second
+	maxWatchBackoff = 5 * time.Minute
+)
+
+// WatchEventJSON is one line of `clsp watch --json` output. Type is message, online,
+// offline, disconnected or reconnected.
+type WatchEventJSON struct {
+	Type        string       `json:"type"`
+	Time        time.Time    `json:"time"`
+	Message     *MessageJSON `json:"message,omitempty"`
+	UserID      string       `json:"user_id,omitempty"`
+	DisplayName string       `json:"display_name,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// watcher follows the hub for 'clsp watch'. The last sync time in config is the
+// cursor each poll resumes from, so a poll after an outage catches up on everything
+// stored meanwhile.
+type watcher struct {
+	store      *localStore
+	privateKey *rsa.PrivateKey
+	keys       *crypto.Keyring
+	// shown holds the IDs of messages already displayed or in the history beforehand
+	shown map[string]bool
+	// online maps the IDs of users online at the last poll to their display names;
+	// nil until the first poll
+	online map[string]string
+	// sink, when set, receives every event instead of stdout, and new messages are
+	// left unread (see the daemon)
+	sink func(WatchEventJSON)
+	// wake, when set, starts the next poll early
+	wake chan struct{}
+	// busy is held during a poll, so work that must not overlap one can wait for it
+	busy sync.Mutex
+
+	// lastPoll and lastErr record the outcome of the last poll, under statusMu;
+	// locked is set while the keys are dropped (see lock)
+	statusMu sync.Mutex
+	lastPoll time.Time
+	lastErr  error
+	locked   bool
+}
+
+// newWatcher returns a watcher that treats the messages already in the local history
+// as shown
+func newWatcher(ctx context.Context, store *localStore, privateKey *rsa.PrivateKey, keys *crypto.Keyring) (*watcher, error) {
+	w := &watcher{store: store, privateKey: privateKey, keys: keys, shown: make(map[string]bool)}
+	history, err := store.envelopes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range history {
+		w.shown[msg.ID] = true
+	}
+	return w, nil
+}
+
+// Watch polls the hub every interval, printing new messages and users coming online
+// or going offline until ctx is cancelled. When the hub cannot be reached it retries
+// with a growing delay, and once back it syncs from where it left off, sends the
+// outbox and read receipts held meanwhile and reports the net presence changes.
+// Scheduled messages are sent by the first poll after they are due.
+func Watch(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	store, err := openLocalStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	w, err := newWatcher(ctx, store, privateKey, keys)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(notices(), "Watching %s for messages every %s (Ctrl-C to stop)\n", config.HubURL, interval)
+	return w.run(ctx, interval)
+}
+
+// run polls every interval until ctx is cancelled, retrying with a growing delay
+// while the hub cannot be reached. It returns early only on a local failure.
+func (w *watcher) run(ctx context.Context, interval time.Duration) error {
+	var lostAt time.Time
+	delay := watchRetryDelay
+	for {
+		w.busy.Lock()
+		err := w.poll(ctx)
+		w.busy.Unlock()
+		w.statusMu.Lock()
+		w.lastPoll, w.lastErr = time.Now(), err
+		w.statusMu.Unlock()
+		if ctx.Err() != nil {
+			return nil
+		}
+		var wait time.Duration
+		switch {
+		case errors.Is(err, errIdentityLocked):
+			wait = interval
+		case err != nil && !isHubError(err):
+			return err
+		case err != nil:
+			if lostAt.IsZero() {
+				lostAt = time.Now()
+				delay = watchRetryDelay
+				w.event(WatchEventJSON{Type: "disconnected", Error: err.Error()},
+					fmt.Sprintf("Lost connection to the hub (%v); reconnecting", err))
+			} else {
+				delay = min(delay*2, maxWatchBackoff)
+			}
+			// Jitter keeps clients that lost the hub together from returning in step
+			wait = delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		default:
+			if !lostAt.IsZero() {
+				w.event(WatchEventJSON{Type: "reconnected"},
+					fmt.Sprintf("Reconnected to the hub after %s; caught up", time.Since(lostAt).Round(time.Second)))
+				lostAt = time.Time{}
+			}
+			wait = interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// status returns the time and error of the last poll
+func (w *watcher) status() (time.Time, error) {
+	w.statusMu.Lock()
+	defer w.statusMu.Unlock()
+	return w.lastPoll, w.lastErr
+}
+
+// isLocked reports whether the watcher's keys are dropped
+func (w *watcher) isLocked() bool {
+	w.statusMu.Lock()
+	defer w.statusMu.Unlock()
+	return w.locked
+}
+
+// lock drops the watcher's keys and the cached storage key, as when the identity was
+// locked; the caller holds busy
+func (w *watcher) lock() {
+	w.privateKey, w.keys = nil, nil
+	storageKey = nil
+	w.statusMu.Lock()
+	w.locked = true
+	w.statusMu.Unlock()
+}
+
+// unlock loads the keys again after lock. Without a terminal to prompt on it fails
+// with errIdentityLocked until the identity is unlocked. The caller holds busy.
+func (w *watcher) unlock() error {
+	if w.privateKey != nil {
+		return nil
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		return err
+	}
+	keys, err := loadKeyring(privateKey)
+	if err != nil {
+		return err
+	}
+	w.privateKey, w.keys = privateKey, keys
+	w.statusMu.Lock()
+	w.locked = false
+	w.statusMu.Unlock()
+	return nil
+}
+
+// hubError marks a poll failure that came from reaching the hub rather than from
+// local state, so watching goes on
+type hubError struct{ err error }
+
+func (e hubError) Error() string { return e.err.Error() }
+
+// isHubError reports whether err is a hubError
+func isHubError(err error) bool {
+	_, ok := err.(hubError)
+	return ok
+}
+
+// poll runs one sync: it fetches messages since the last sync, flushes what was held
+// back while offline, sends scheduled messages that are due, shows what is new and
+// checks presence
+func (w *watcher) poll(ctx context.Context) error {
+	if err := w.unlock(); err != nil {
+		return err
+	}
+	// Reloaded each time so settings changed while watching apply and are not overwritten
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if err := syncMessages(ctx, config, w.store, w.keys, false); err != nil {
+		return hubError{err}
+	}
+	sendQueued(ctx, config, w.privateKey, w.store)
+	sendScheduled(ctx, config, w.privateKey, w.store)
+	sendPendingReads(ctx, config, w.privateKey, w.store)
+	if err := w.showNew(ctx, config); err != nil {
+		return err
+	}
+	users, err := hubClient(config, nil).Users(ctx, clspclient.UserQuery{Online: true})
+	if err != nil {
+		return hubError{err}
+	}
+	w.updatePresence(config, users)
+	return nil
+}
+
+// showNew prints stored messages not shown yet, oldest first, and marks them read
+// locally as 'clsp list' does; with a sink they go there instead and stay unread.
+// Pieces of split messages wait until every part arrived.
+func (w *watcher) showNew(ctx context.Context, config *Config) error {
+	messages, err := w.store.Messages(ctx, false)
+	if err != nil {
+		return err
+	}
+	var fresh []crypto.Message
+	for _, msg := range messages {
+		if !w.shown[msg.ID] {
+			fresh = append(fresh, msg)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+	if err := w.store.LoadSavedKeys(ctx, w.keys); err != nil {
+		return err
+	}
+	received, err := openReceived(ctx, config, w.keys, fresh, true)
+	if err != nil {
+		return err
+	}
+	// Messages that failed to decrypt were reported once and are not retried
+	for _, msg := range fresh {
+		w.shown[msg.ID] = true
+	}
+
+	joined, screened, err := screenReceived(ctx, config, w.store, joinParts(received))
+	if err != nil {
+		return err
+	}
+	reportScreened(screened)
+	sort.SliceStable(joined, func(i, j int) bool { return joined[i].msg.Timestamp < joined[j].msg.Timestamp })
+	opts := renderOptionsFromConfig(config)
+	var shownIDs []string
+	for _, r := range joined {
+		if r.missing {
+			delete(w.shown, r.msg.ID)
+			continue
+		}
+		shownIDs = append(shownIDs, r.msg.ID)
+		shownIDs = append(shownIDs, r.ids...)
+		if JSONOutput || w.sink != nil {
+			out := messageJSON(r)
+			w.event(WatchEventJSON{Type: "message", Time: time.Unix(r.msg.Timestamp, 0).UTC(), Message: &out}, "")
+			continue
+		}
+		printReceived(r, opts)
+	}
+	if w.sink != nil {
+		return nil
+	}
+	return w.store.MarkRead(ctx, shownIDs)
+}
+
+// updatePresence reports users who came online or went offline since the last poll.
+// After an outage only the net change shows, not every transition missed meanwhile.
+func (w *watcher) updatePresence(config *Config, users []clspclient.User) {
+	online := make(map[string]string, len(users))
+	for _, u := range users {
+		if u.ID != config.UserID {
+			online[u.ID] = u.DisplayName
+		}
+	}
+	if w.online != nil {
+		opts := renderOptionsFromConfig(config)
+		for id, name := range online {
+			if _, ok := w.online[id]; !ok {
+				w.event(WatchEventJSON{Type: "online", UserID: id, DisplayName: name},
+					fmt.Sprintf("%s is online", safeLine(name, opts)))
+			}
+		}
+		for id, name := range w.online {
+			if _, ok := online[id]; !ok {
+				w.event(WatchEventJSON{Type: "offline", UserID: id, DisplayName: name},
+					fmt.Sprintf("%s went offline", safeLine(name, opts)))
+			}
+		}
+	}
+	w.online = online
+}
+
+// event prints a watch event as a JSON line, or as text prefixed with the time, or
+// passes it to the sink
+func (w *watcher) event(e WatchEventJSON, text string) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if w.sink != nil {
+		w.sink(e)
+		return
+	}
+	if JSONOutput {
+		json.NewEncoder(os.Stdout).Encode(e)
+		return
+	}
+	fmt.Printf("[%s] %s\n", e.Time.Local().Format("15:04:05"), text)
+}
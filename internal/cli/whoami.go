@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/internal/paths"
+	"github.com/mattd/clsp/pkg/clspclient"
+)
+
+// Whoami prints a summary of the local identity and its registration status on the hub
+func Whoami(ctx context.Context) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	profile := paths.Profile
+	if profile == "" {
+		profile = "default"
+	}
+	fmt.Printf("Profile: %s (%s)\n", profile, paths.ConfigDir)
+	if config.UserID == "" {
+		fmt.Println("No identity initialized. Run 'clsp init' to create one.")
+		return nil
+	}
+
+	fmt.Printf("User ID: %s\n", config.UserID)
+	fmt.Printf("Display name: %s\n", config.DisplayName)
+	fmt.Printf("Hub: %s\n", config.HubURL)
+
+	var localKeyPEM string
+	publicKey, err := loadIdentityPublicKey()
+	if err != nil {
+		fmt.Printf("Key fingerprint: unavailable (%v)\n", err)
+	} else {
+		fingerprint, err := crypto.Fingerprint(publicKey)
+		if err != nil {
+			return err
+		}
+		short, err := crypto.ShortFingerprint(publicKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Key fingerprint: %s\n", short)
+		fmt.Printf("Full fingerprint: %s\n", fingerprint)
+		if pemBytes, err := crypto.PublicKeyToPEM(publicKey); err == nil {
+			localKeyPEM = string(pemBytes)
+		}
+	}
+
+	signingKey, err := loadSigningPublicKey()
+	switch {
+	case err != nil:
+		fmt.Printf("Signing key: unavailable (%v)\n", err)
+	case signingKey == nil:
+		fmt.Println("Signing key: none (run 'clsp init --resume' to create one)")
+	default:
+		fmt.Printf("Signing key: Ed25519 %s\n", crypto.SigningKeyFingerprint(signingKey))
+	}
+
+	fmt.Printf("Registration: %s\n", registrationStatus(ctx, config, localKeyPEM))
+	if info, err := hubClient(config, nil).CachedHealth(ctx); err == nil && info.Config.FederationName != "" {
+		fmt.Printf("Address: %s@%s (for users of other hubs)\n", config.DisplayName, info.Config.FederationName)
+	}
+
+	printDevices(ctx, config)
+
+	return nil
+}
+
+// registrationStatus describes whether the hub knows this identity with the local key
+func registrationStatus(ctx context.Context, config *Config, localKeyPEM string) string {
+	if config.RegistrationPending {
+		return "pending (run 'clsp init --resume')"
+	}
+
+	users, err := hubClient(config, nil).Users(ctx, clspclient.UserQuery{Search: config.DisplayName})
+	if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	}
+
+	for _, u := range users {
+		if u.ID != config.UserID {
+			continue
+		}
+		if localKeyPEM != "" && u.PublicKey != localKeyPEM {
+			return "registered, but the hub has a DIFFERENT public key for this account"
+		}
+		return "registered"
+	}
+	return "not registered on this hub"
+}
+
+// printDevices lists the devices that announced themselves for this identity,
+// announcing this one first so it is included
+func printDevices(ctx context.Context, config *Config) {
+	if config.RegistrationPending {
+		return
+	}
+	privateKey, err := loadIdentityKey()
+	if err != nil {
+		fmt.Printf("Devices: unavailable (%v)\n", err)
+		return
+	}
+	devices, thisID, err := announceDevice(ctx, config, privateKey)
+	if err != nil {
+		fmt.Printf("Devices: unavailable (%v)\n", err)
+		return
+	}
+	fmt.Println("Devices:")
+	for _, d := range devices {
+		name := d.Name
+		if d.ID == thisID {
+			name += " (this device)"
+		}
+		fmt.Printf("  %-32s first seen %s, last seen %s\n", name, d.FirstSeen.Local().Format("2006-01-02"), d.LastSeen.Local().Format("2006-01-02"))
+	}
+}
@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// AttachmentChunkSize is the plaintext size of each chunk of an uploaded attachment
+const AttachmentChunkSize = 1 << 20
+
+// chunkAAD labels attachment chunks, so a chunk cannot pass for message content
+const chunkAAD = "clsp-attachment-chunk-v1"
+
+// NewAttachmentKey returns a random key for encrypting an attachment's chunks
+func NewAttachmentKey() ([]byte, error) {
+	key := make([]byte, AESKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate attachment key: %v", err)
+	}
+	return key, nil
+}
+
+// ChunkCount returns the number of chunks a file of size bytes is split into; an empty
+// file still has one (empty) chunk, so its end is authenticated like any other
+func ChunkCount(size int64, chunkSize int) int64 {
+	if size <= 0 {
+		return 1
+	}
+	return (size + int64(chunkSize) - 1) / int64(chunkSize)
+}
+
+// EncryptedChunkSize is the ciphertext size of a full chunk
+func EncryptedChunkSize(chunkSize int) int64 {
+	return int64(chunkSize) + GCMOverhead
+}
+
+// EncryptedAttachmentSize returns the total ciphertext size of a file of size bytes
+func EncryptedAttachmentSize(size int64, chunkSize int) int64 {
+	return size + ChunkCount(size, chunkSize)*GCMOverhead
+}
+
+// chunkNonce derives the nonce of chunk index. Each attachment has its own key, so
+// nonces only need to be unique within it; the final flag marks the last chunk so a
+// truncated download fails authentication instead of yielding a shorter file.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptChunk encrypts chunk index of an attachment. Chunks are independent, so an
+// interrupted upload can resume at any chunk boundary.
+func EncryptChunk(key []byte, index int64, last bool, plaintext []byte) ([]byte, error) {
+	gcm, err := newMessageGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, chunkNonce(index, last), plaintext, []byte(chunkAAD)), nil
+}
+
+// DecryptChunk decrypts and authenticates chunk index of an attachment
+func DecryptChunk(key []byte, index int64, last bool, ciphertext []byte) ([]byte, error) {
+	gcm, err := newMessageGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, chunkNonce(index, last), ciphertext, []byte(chunkAAD))
+	if err != nil {
+		return nil, fmt.Errorf("attachment chunk %d failed authentication (tampered or corrupt)", index)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for message content and inline attachments. Plaintext is
+// compressed before it is encrypted, since ciphertext does not compress; the
+// algorithm is recorded in the envelope, where the signature covers it. Uploaded
+// attachments are never compressed: their chunks keep fixed sizes so an interrupted
+// upload can resume at any chunk boundary.
+//
+// Compressing before encryption lets the ciphertext length depend on the content, so
+// someone who can put text of their choosing into a message and watch its size may
+// learn whether it repeats text already there. Senders therefore only compress when
+// their user asks for it.
+const (
+	// CompressionZstd is Zstandard, which compresses better and faster than deflate
+	CompressionZstd = "zstd"
+	// CompressionDeflate is raw deflate (RFC 1951), for clients without a zstd library
+	CompressionDeflate = "deflate"
+)
+
+// CompressionThreshold is the smallest plaintext worth compressing. Below it the
+// compressor's framing outweighs what it saves, so shorter content is sent as is; so
+// is any content that does not shrink.
+const CompressionThreshold = 256
+
+// maxDecompressedSize bounds what one compressed field may expand to, so a message
+// crafted to expand enormously is rejected instead of exhausting memory
+const maxDecompressedSize = 64 << 20
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+)
+
+// Compressions returns the compression algorithms this package reads, most preferred
+// first. Clients list them in their prekey after their cipher suites.
+func Compressions() []string {
+	return []string{CompressionZstd, CompressionDeflate}
+}
+
+// IsCompression reports whether id names a compression algorithm this package reads
+func IsCompression(id string) bool {
+	for _, c := range Compressions() {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateCompression returns preferred if the recipient's prekey offers it, and
+// otherwise the empty string for no compression. Recipients without a prekey, or
+// whose client predates compression, offer none.
+func NegotiateCompression(offered []string, preferred string) string {
+	if preferred == "" || !IsCompression(preferred) {
+		return ""
+	}
+	for _, id := range offered {
+		if id == preferred {
+			return id
+		}
+	}
+	return ""
+}
+
+// compressPlaintext compresses data with algorithm if it is long enough and shrinks,
+// returning the bytes to encrypt and the algorithm used, empty when data is unchanged
+func compressPlaintext(algorithm string, data []byte) ([]byte, string, error) {
+	if algorithm == "" || len(data) < CompressionThreshold {
+		return data, "", nil
+	}
+	compressed, err := Compress(algorithm, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(data) {
+		return data, "", nil
+	}
+	return compressed, algorithm, nil
+}
+
+// Compress compresses data with one of Compressions
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionDeflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress: %v", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+// Decompress reverses Compress, refusing output beyond 64 MiB
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %v", err)
+		}
+		return out, nil
+	case CompressionDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %v", err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, fmt.Errorf("failed to decompress: content expands beyond %d bytes", maxDecompressedSize)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q (a newer clsp may read this message)", algorithm)
+	}
+}
@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Envelope limits. Fields beyond them cannot come from a well-behaved client, so a
+// message exceeding one is rejected as malformed rather than processed.
+const (
+	// maxEnvelopeString bounds identifiers, statuses and file names
+	maxEnvelopeString = 1024
+	// maxEnvelopeKey bounds wrapped keys and signatures (an RSA-8192 block)
+	maxEnvelopeKey = 1024
+	// MaxMessageParts is the largest number of parts a split message may have
+	MaxMessageParts = 1 << 16
+)
+
+// gcmNonceSize is the nonce length of the message AES-GCM
+const gcmNonceSize = 12
+
+// Validate checks that the message is well formed for its version: key material and
+// nonces have the lengths the format requires, and parts and attachments are
+// consistent. It does not check the signature or decrypt anything, so it can run on
+// messages from untrusted hubs before any further processing.
+func (m *Message) Validate() error {
+	for name, s := range map[string]string{
+		"id": m.ID, "sender": m.Sender, "recipient": m.Recipient, "status": m.Status,
+		"prekey_id": m.PrekeyID, "dedupe_key": m.DedupeKey, "escrow_id": m.EscrowID,
+		"in_reply_to": m.InReplyTo, "sig_alg": m.SignatureAlg, "suite": m.Suite,
+		"compression": m.Compression,
+	} {
+		if len(s) > maxEnvelopeString {
+			return fmt.Errorf("malformed message: %s too long", name)
+		}
+	}
+	if m.Timestamp < 0 {
+		return fmt.Errorf("malformed message: negative timestamp")
+	}
+	if m.ExpiresAt < 0 {
+		return fmt.Errorf("malformed message: negative expiry")
+	}
+	if len(m.Signature) > maxEnvelopeKey {
+		return fmt.Errorf("malformed message: signature too long")
+	}
+	if m.SignatureAlg != "" && m.SignatureAlg != SignatureEd25519 {
+		return fmt.Errorf("malformed message: unknown signature algorithm")
+	}
+
+	nonceSize := gcmNonceSize
+	switch m.Version {
+	case MessageVersionX25519:
+		if len(m.EphemeralKey) != 32 || m.PrekeyID == "" {
+			return fmt.Errorf("malformed message: invalid ephemeral key")
+		}
+		if len(m.EncryptedKey) != 0 {
+			return fmt.Errorf("malformed message: unexpected wrapped key")
+		}
+	case MessageVersionGCM, MessageVersionCTR:
+		if len(m.EncryptedKey) == 0 || len(m.EncryptedKey) > maxEnvelopeKey {
+			return fmt.Errorf("malformed message: invalid wrapped key")
+		}
+		if len(m.EphemeralKey) != 0 || m.PrekeyID != "" {
+			return fmt.Errorf("malformed message: unexpected ephemeral key")
+		}
+		if m.Version == MessageVersionCTR {
+			nonceSize = 16
+		}
+	default:
+		return fmt.Errorf("unsupported message version %d", m.Version)
+	}
+	if (len(m.EscrowedKey) == 0) != (m.EscrowID == "") || len(m.EscrowedKey) > maxEnvelopeKey {
+		return fmt.Errorf("malformed message: invalid escrow fields")
+	}
+	if len(m.EscrowedKey) != 0 && m.Version == MessageVersionCTR {
+		return fmt.Errorf("malformed message: legacy message with escrow")
+	}
+	// Suites this build does not know are left for the recipient's client to check,
+	// so hubs need no upgrade for clients to adopt a new one
+	overhead := GCMOverhead
+	if m.Suite != "" {
+		if m.Version == MessageVersionCTR {
+			return fmt.Errorf("malformed message: legacy message with cipher suite")
+		}
+		if suite, ok := LookupCipherSuite(m.Suite); ok {
+			nonceSize, overhead = suite.NonceSize, suite.Overhead
+		} else {
+			nonceSize, overhead = len(m.IV), 0
+			if nonceSize == 0 || nonceSize > maxEnvelopeKey {
+				return fmt.Errorf("malformed message: invalid nonce")
+			}
+		}
+	}
+	if len(m.IV) != nonceSize {
+		return fmt.Errorf("malformed message: invalid nonce")
+	}
+	// Like suites, compression algorithms this build does not know are left for the
+	// recipient's client
+	if m.Compression != "" && m.Version == MessageVersionCTR {
+		return fmt.Errorf("malformed message: legacy message with compression")
+	}
+	if m.Version != MessageVersionCTR && len(m.Content) < overhead {
+		return fmt.Errorf("malformed message: content too short")
+	}
+
+	if p := m.Part; p != nil {
+		if p.Group == "" || len(p.Group) > maxEnvelopeString {
+			return fmt.Errorf("malformed message: invalid part group")
+		}
+		if p.Total < 1 || p.Total > MaxMessageParts || p.Index < 0 || p.Index >= p.Total {
+			return fmt.Errorf("malformed message: part %d of %d", p.Index, p.Total)
+		}
+	}
+
+	if a := m.Attachment; a != nil {
+		if len(a.Filename) > maxEnvelopeString || len(a.ContentType) > maxEnvelopeString || len(a.ID) > maxEnvelopeString || len(a.Compression) > maxEnvelopeString {
+			return fmt.Errorf("malformed message: attachment field too long")
+		}
+		if a.Size < 0 || a.ChunkSize < 0 {
+			return fmt.Errorf("malformed message: negative attachment size")
+		}
+		if len(a.SealedInfo) > maxEnvelopeKey {
+			return fmt.Errorf("malformed message: attachment info too long")
+		}
+		if m.Version == MessageVersionCTR {
+			if a.Uploaded() || len(a.Nonce) != 0 || len(a.SealedInfo) != 0 || a.Compression != "" {
+				return fmt.Errorf("malformed message: legacy attachment with authenticated fields")
+			}
+		} else if len(a.Nonce) != nonceSize {
+			return fmt.Errorf("malformed message: invalid attachment nonce")
+		} else if len(a.SealedInfo) != 0 && len(a.SealedInfo) < nonceSize+overhead {
+			return fmt.Errorf("malformed message: attachment info too short")
+		}
+		if a.Uploaded() {
+			if a.ChunkSize == 0 || len(a.SealedKey) == 0 || len(a.SealedKey) > maxEnvelopeKey || len(a.Content) != 0 || a.Compression != "" {
+				return fmt.Errorf("malformed message: invalid uploaded attachment")
+			}
+		} else if len(a.SealedKey) != 0 || a.ChunkSize != 0 {
+			return fmt.Errorf("malformed message: inline attachment with upload fields")
+		}
+	}
+	return nil
+}
+
+// EncodeMessage returns the canonical JSON encoding of a well-formed message, as sent
+// to and stored by the hub. DecodeMessage of the result yields an equal message, and
+// encoding that again yields the same bytes.
+func EncodeMessage(m *Message) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// DecodeMessage parses one JSON message and validates it. Malformed input, including
+// trailing data after the message, returns an error and never a partial message.
+func DecodeMessage(data []byte) (*Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var m Message
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("malformed message: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("malformed message: trailing data")
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
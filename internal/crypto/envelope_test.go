@@ -0,0 +1,103 @@
+package crypto_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/conformance"
+)
+
+// seedEnvelopes adds every envelope published in pkg/conformance to the seed corpus
+// and returns the recipient's keyring, so seeds get through decryption
+func seedEnvelopes(f *testing.F) (*crypto.Keyring, *rsa.PublicKey) {
+	v, err := conformance.Published()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, mv := range v.Messages {
+		f.Add([]byte(mv.Envelope))
+	}
+
+	recipient := parseKey(f, v.Keys.Recipient)
+	sender := parseKey(f, v.Keys.Sender)
+	prekey, err := ecdh.X25519().NewPrivateKey(v.Keys.RecipientPrekey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	keys := &crypto.Keyring{Identity: recipient, Prekeys: make(map[string]*ecdh.PrivateKey)}
+	for _, pv := range v.Prekeys {
+		keys.Prekeys[pv.Prekey.ID] = prekey
+	}
+	return keys, &sender.PublicKey
+}
+
+// parseKey reads a PEM-encoded PKCS #1 private key from the vectors
+func parseKey(f *testing.F, data string) *rsa.PrivateKey {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		f.Fatal("failed to decode private key PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return key
+}
+
+// FuzzDecodeMessage checks that DecodeMessage either rejects data or returns a message
+// that re-encodes canonically, and that verifying and decrypting any accepted message
+// fails cleanly instead of panicking
+func FuzzDecodeMessage(f *testing.F) {
+	keys, sender := seedEnvelopes(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := crypto.DecodeMessage(data)
+		if err != nil {
+			if msg != nil {
+				t.Fatal("DecodeMessage returned a message with an error")
+			}
+			return
+		}
+
+		encoded, err := crypto.EncodeMessage(msg)
+		if err != nil {
+			t.Fatalf("accepted message does not encode: %v", err)
+		}
+		again, err := crypto.DecodeMessage(encoded)
+		if err != nil {
+			t.Fatalf("encoded message does not decode: %v", err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatal("message changed across a round trip")
+		}
+		reencoded, err := crypto.EncodeMessage(again)
+		if err != nil || !bytes.Equal(encoded, reencoded) {
+			t.Fatal("message encoding is not canonical")
+		}
+
+		crypto.VerifySignature(sender, msg)
+		crypto.DecryptMessage(keys, msg)
+	})
+}
+
+// FuzzParts checks that part metadata accepted by DecodeMessage stays within the
+// bounds that reassembly relies on
+func FuzzParts(f *testing.F) {
+	seedEnvelopes(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := crypto.DecodeMessage(data)
+		if err != nil || msg.Part == nil {
+			return
+		}
+		if p := msg.Part; p.Index < 0 || p.Index >= p.Total || p.Total > crypto.MaxMessageParts || p.Group == "" {
+			t.Fatalf("out-of-range part accepted: %d of %d in %q", p.Index, p.Total, p.Group)
+		}
+	})
+}
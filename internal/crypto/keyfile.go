@@ -0,0 +1,163 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// encryptedKeyPEMType marks a private key sealed with a passphrase
+	encryptedKeyPEMType = "CLSP ENCRYPTED PRIVATE KEY"
+
+	// Argon2id parameters used to derive the key-encryption key from a passphrase
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	saltSize     = 16
+)
+
+// ErrPassphraseRequired is returned when loading a passphrase-protected key without a passphrase
+var ErrPassphraseRequired = errors.New("private key is protected by a passphrase")
+
+// DeriveKey derives a 256-bit key from a passphrase and salt using Argon2id
+func DeriveKey(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, AESKeySize)
+}
+
+// IsPrivateKeyEncrypted reports whether the key file at path is passphrase protected
+func IsPrivateKeyEncrypted(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, fmt.Errorf("failed to decode private key PEM")
+	}
+	return block.Type == encryptedKeyPEMType, nil
+}
+
+// SaveEncryptedPrivateKey saves a private key sealed with AES-GCM under a passphrase-derived key
+func SaveEncryptedPrivateKey(privateKey *rsa.PrivateKey, path string, passphrase []byte) error {
+	sealed, err := SealWithPassphrase(encryptedKeyPEMType, x509.MarshalPKCS1PrivateKey(privateKey), passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	if err := os.WriteFile(path, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	return nil
+}
+
+// LoadEncryptedPrivateKey loads a private key, unsealing it with passphrase if it is protected
+func LoadEncryptedPrivateKey(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	if block.Type != encryptedKeyPEMType {
+		return LoadPrivateKey(path)
+	}
+
+	der, err := OpenWithPassphrase(encryptedKeyPEMType, data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	return priv, nil
+}
+
+// SealWithPassphrase encrypts data with AES-GCM under a key derived from passphrase,
+// returning a PEM block of pemType that carries the KDF salt and nonce
+func SealWithPassphrase(pemType string, data, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	gcm, err := newGCM(DeriveKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	pemBlock := &pem.Block{
+		Type: pemType,
+		Headers: map[string]string{
+			"KDF":   "argon2id",
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, data, []byte(pemType)),
+	}
+	return pem.EncodeToMemory(pemBlock), nil
+}
+
+// OpenWithPassphrase decrypts a PEM block of pemType written by SealWithPassphrase
+func OpenWithPassphrase(pemType string, data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("not a %s", strings.ToLower(pemType))
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key nonce: %v", err)
+	}
+
+	gcm, err := newGCM(DeriveKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid key nonce length")
+	}
+	plain, err := gcm.Open(nil, nonce, block.Bytes, []byte(pemType))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect passphrase")
+	}
+	return plain, nil
+}
+
+// newGCM creates an AES-GCM AEAD for the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
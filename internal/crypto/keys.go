@@ -3,11 +3,14 @@ package crypto
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/mattd/clsp/internal/paths"
 )
@@ -63,6 +66,9 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode private key PEM")
 	}
+	if block.Type == encryptedKeyPEMType {
+		return nil, ErrPassphraseRequired
+	}
 	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse private key: %v", err)
@@ -70,6 +76,21 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
 	return priv, nil
 }
 
+// SavePublicKey saves a public key in PEM format so it can be read without unlocking the private key
+func SavePublicKey(publicKey *rsa.PublicKey, path string) error {
+	publicKeyPEM, err := PublicKeyToPEM(publicKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	if err := os.WriteFile(path, publicKeyPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	return nil
+}
+
 // LoadPublicKey loads the public key from disk
 func LoadPublicKey() (*rsa.PublicKey, error) {
 	publicKeyPEM, err := os.ReadFile(paths.GetKeyPath("public.pem"))
@@ -129,3 +150,43 @@ func PublicKeyToPEM(publicKey *rsa.PublicKey) ([]byte, error) {
 
 	return publicKeyPEM, nil
 }
+
+// Fingerprint returns the SHA-256 fingerprint of a public key's DER encoding,
+// formatted as space-separated groups of four hex digits
+func Fingerprint(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	encoded := hex.EncodeToString(sum[:])
+
+	var groups []string
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// shortFingerprintGroups is how many leading groups of the fingerprint (128 bits)
+// make up the short form people read out to each other
+const shortFingerprintGroups = 8
+
+// ShortFingerprint returns the first 128 bits of a public key's fingerprint, in the
+// same format as Fingerprint
+func ShortFingerprint(publicKey *rsa.PublicKey) (string, error) {
+	fingerprint, err := Fingerprint(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return ShortenFingerprint(fingerprint), nil
+}
+
+// ShortenFingerprint cuts a fingerprint returned by Fingerprint to its short form
+func ShortenFingerprint(fingerprint string) string {
+	groups := strings.Fields(fingerprint)
+	if len(groups) > shortFingerprintGroups {
+		groups = groups[:shortFingerprintGroups]
+	}
+	return strings.Join(groups, " ")
+}
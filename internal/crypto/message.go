@@ -4,12 +4,16 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 )
 
 const (
@@ -17,78 +21,340 @@ const (
 	AESKeySize = 32
 )
 
+// Message format versions. Messages without a version field predate authenticated
+// encryption and are still accepted for decryption.
+const (
+	// MessageVersionCTR is the legacy AES-CTR format without ciphertext integrity
+	MessageVersionCTR = 0
+	// MessageVersionGCM encrypts content and attachment with AES-256-GCM under a key
+	// wrapped to the recipient's RSA identity key
+	MessageVersionGCM = 1
+	// MessageVersionX25519 is MessageVersionGCM with the key agreed between an
+	// ephemeral X25519 key and the recipient's prekey, for forward secrecy
+	MessageVersionX25519 = 2
+
+	// CurrentMessageVersion is the format produced for recipients with a prekey
+	CurrentMessageVersion = MessageVersionX25519
+)
+
+// Additional authenticated data labels, so a content ciphertext cannot be swapped
+// into the attachment slot or vice versa
+const (
+	contentAAD    = "clsp-content-v1"
+	attachmentAAD = "clsp-attachment-v1"
+)
+
+// escrowLabel is the OAEP label of escrowed message keys, so a key wrapped to the
+// recovery key cannot be passed off as one wrapped to a recipient or vice versa
+const escrowLabel = "clsp-escrow-v1"
+
 // Message represents an encrypted message with metadata
 type Message struct {
-	ID           string      `json:"id"`
-	Sender       string      `json:"sender"`
-	Recipient    string      `json:"recipient"`
-	Timestamp    int64       `json:"timestamp"`
-	Status       string      `json:"status"`
-	EncryptedKey []byte      `json:"encrypted_key"`
-	IV           []byte      `json:"iv"`
-	Content      []byte      `json:"content"`
-	Signature    []byte      `json:"signature"`
+	Version int `json:"version,omitempty"`
+	// Suite is the cipher suite of the content and attachment (see LookupCipherSuite),
+	// empty for SuiteAES256GCM. It is covered by the signature, so a hub cannot
+	// relabel a message.
+	Suite        string `json:"suite,omitempty"`
+	ID           string `json:"id"`
+	Sender       string `json:"sender"`
+	Recipient    string `json:"recipient"`
+	Timestamp    int64  `json:"timestamp"`
+	Status       string `json:"status"`
+	EncryptedKey []byte `json:"encrypted_key,omitempty"`
+	// EphemeralKey and PrekeyID carry the sender's half of the X25519 exchange
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	PrekeyID     string `json:"prekey_id,omitempty"`
+	IV           []byte `json:"iv"`
+	Content      []byte `json:"content"`
+	Signature    []byte `json:"signature"`
+	// SignatureAlg is SignatureEd25519 for messages signed with the sender's signing
+	// key, and empty for those signed with their RSA key
+	SignatureAlg string      `json:"sig_alg,omitempty"`
 	Attachment   *Attachment `json:"attachment,omitempty"`
+	DedupeKey    string      `json:"dedupe_key,omitempty"`
+	// EscrowedKey is the message key wrapped to an organizational recovery key, set
+	// only when the sender agreed to escrow; EscrowID is that key's fingerprint. Both
+	// are covered by the signature, so a hub cannot add or strip them.
+	EscrowedKey []byte `json:"escrowed_key,omitempty"`
+	EscrowID    string `json:"escrow_id,omitempty"`
+	// Part links the pieces of a long message split to fit the hub's size limit
+	Part *MessagePart `json:"part,omitempty"`
+	// InReplyTo is the ID of the message this one answers. It is covered by the
+	// signature, so a hub cannot move a reply to another thread.
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	// ExpiresAt is the Unix time by which the sender wants the message deleted from
+	// the hub and the recipient's device, or zero to leave it to the hub's expiry. It
+	// is covered by the signature, so a hub cannot extend it.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Compression is the algorithm the content was compressed with before it was
+	// encrypted (see Compressions), or empty when it was not
+	Compression string `json:"compression,omitempty"`
+}
+
+// Expired reports whether the sender's expiry of the message has passed at now
+func (m *Message) Expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && now.Unix() >= m.ExpiresAt
+}
+
+// MessagePart identifies one piece of a split message. It is authenticated together
+// with the content, so parts cannot be reordered or moved between messages unnoticed.
+type MessagePart struct {
+	Group string `json:"group"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+}
+
+// GCMOverhead is the number of bytes AES-GCM adds to each encrypted content
+const GCMOverhead = 16
+
+// contentAADFor returns the additional authenticated data for a message's content
+func contentAADFor(part *MessagePart) []byte {
+	if part == nil {
+		return []byte(contentAAD)
+	}
+	return []byte(fmt.Sprintf("%s\x00part\x00%s\x00%d\x00%d", contentAAD, part.Group, part.Index, part.Total))
 }
 
-// Attachment represents an encrypted file attachment
+// Attachment represents an encrypted file attachment. Small attachments travel inline
+// in Content; uploaded attachments are stored by the hub under ID in chunks encrypted
+// with their own Key (see EncryptChunk), and the message carries only the reference.
 type Attachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
 	Size        int64  `json:"size"`
 	Content     []byte `json:"content"`
+	// Nonce is the attachment's own GCM nonce (absent in legacy CTR messages)
+	Nonce []byte `json:"nonce,omitempty"`
+	// Compression is the algorithm an inline attachment's content was compressed with
+	// before it was encrypted, or empty when it was not. Size remains the size of the
+	// file itself.
+	Compression string `json:"compression,omitempty"`
+
+	// ID is the hub's identifier of an uploaded attachment
+	ID string `json:"id,omitempty"`
+	// ChunkSize is the plaintext size of each chunk of an uploaded attachment
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// SealedKey is Key encrypted under the message key
+	SealedKey []byte `json:"sealed_key,omitempty"`
+	// Key is the chunk key of an uploaded attachment; it never leaves this process
+	// unencrypted
+	Key []byte `json:"-"`
+
+	// SHA256 and ModTime (Unix seconds) describe the original file; both are optional.
+	// They travel encrypted in SealedInfo, so the hub cannot match the file against
+	// known ones, and DecryptMessage restores them.
+	SHA256  []byte `json:"-"`
+	ModTime int64  `json:"-"`
+	// SealedInfo is SHA256 and ModTime sealed under the message key, after the nonce
+	// they were sealed with
+	SealedInfo []byte `json:"sealed_info,omitempty"`
 }
 
-// EncryptMessage encrypts a message for a recipient using their public key
-func EncryptMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, content []byte, attachment *Attachment) (*Message, error) {
-	// Generate random AES key
-	aesKey := make([]byte, AESKeySize)
-	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
-		return nil, fmt.Errorf("failed to generate AES key: %v", err)
+// attachmentInfo is the plaintext of Attachment.SealedInfo
+type attachmentInfo struct {
+	SHA256  []byte `json:"sha256,omitempty"`
+	ModTime int64  `json:"mod_time,omitempty"`
+}
+
+// VerifyDigest checks content's SHA-256 digest against the one the sender recorded,
+// if any
+func (a *Attachment) VerifyDigest(sum []byte) error {
+	if len(a.SHA256) > 0 && !hmac.Equal(sum, a.SHA256) {
+		return fmt.Errorf("attachment does not match its SHA-256 digest (corrupted in transfer, or the file changed while it was sent)")
 	}
+	return nil
+}
 
-	// Encrypt AES key with recipient's public key
-	encryptedKey, err := rsa.EncryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		recipientPublicKey,
-		aesKey,
-		nil,
-	)
+// Uploaded reports whether the attachment content is stored on the hub separately
+func (a *Attachment) Uploaded() bool {
+	return a.ID != ""
+}
+
+// aad returns the additional authenticated data binding the attachment metadata
+// to its ciphertext, so renaming or retyping an attachment is detected
+func (a *Attachment) aad() []byte {
+	if a.Uploaded() {
+		return []byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%s\x00%d", attachmentAAD, a.Filename, a.ContentType, a.Size, a.ID, a.ChunkSize))
+	}
+	return []byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d", attachmentAAD, a.Filename, a.ContentType, a.Size))
+}
+
+// infoAAD returns the additional authenticated data of SealedInfo, which binds it to
+// the rest of the attachment
+func (a *Attachment) infoAAD() []byte {
+	return append(a.aad(), []byte("\x00info")...)
+}
+
+// EncryptMessage encrypts a message for a recipient. With the recipient's prekey the
+// key is agreed over X25519 for forward secrecy, and the content encrypted with a
+// cipher suite the prekey lists (see NegotiateCipherSuite); without one (recipients
+// whose client predates prekeys) the key is wrapped to their RSA public key and the
+// content encrypted with AES-256-GCM.
+func EncryptMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, prekey *Prekey, content []byte, attachment *Attachment) (*Message, error) {
+	return EncryptMessagePart(senderPrivateKey, recipientPublicKey, prekey, content, attachment, nil)
+}
+
+// EncryptMessagePart encrypts one part of a split message; part may be nil for a whole message
+func EncryptMessagePart(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, prekey *Prekey, content []byte, attachment *Attachment, part *MessagePart) (*Message, error) {
+	return EncryptMessageEscrowed(senderPrivateKey, recipientPublicKey, prekey, content, attachment, part, nil, "", 0)
+}
+
+// EncryptMessageEscrowed is EncryptMessagePart that additionally wraps the message key
+// to escrowKey, an organizational recovery key, when it is not nil. Whoever holds the
+// recovery key can then decrypt the message with RecoverMessage; only call it for
+// senders who explicitly agreed to that. inReplyTo, if set, marks the message as a
+// reply to that message ID, and expiresAt, if not zero, is the Unix time by which the
+// message is to be deleted.
+func EncryptMessageEscrowed(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, prekey *Prekey, content []byte, attachment *Attachment, part *MessagePart, escrowKey *rsa.PublicKey, inReplyTo string, expiresAt int64) (*Message, error) {
+	return EncryptMessageFrom(rand.Reader, senderPrivateKey, recipientPublicKey, prekey, content, attachment, part, escrowKey, inReplyTo, expiresAt)
+}
+
+// EncryptMessageFrom is EncryptMessageEscrowed taking the message key, ephemeral key
+// and nonces from random, so that test vectors can be reproduced exactly. Messages to
+// real recipients must use crypto/rand. RSA-OAEP padding may draw on crypto/rand
+// regardless, so only messages encrypted to a prekey are fully reproducible.
+func EncryptMessageFrom(random io.Reader, senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, prekey *Prekey, content []byte, attachment *Attachment, part *MessagePart, escrowKey *rsa.PublicKey, inReplyTo string, expiresAt int64) (*Message, error) {
+	return EncryptMessageWith(random, senderPrivateKey, recipientPublicKey, prekey, content, attachment, EncryptOptions{
+		Part:      part,
+		EscrowKey: escrowKey,
+		InReplyTo: inReplyTo,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// EncryptOptions are the optional settings of EncryptMessageWith
+type EncryptOptions struct {
+	// Part identifies one part of a split message
+	Part *MessagePart
+	// EscrowKey, if set, is the organizational recovery key the message key is also
+	// wrapped to (see EncryptMessageEscrowed)
+	EscrowKey *rsa.PublicKey
+	// InReplyTo is the ID of the message this one answers
+	InReplyTo string
+	// ExpiresAt is the Unix time by which the message is to be deleted
+	ExpiresAt int64
+	// Compression is the algorithm to compress the content and an inline attachment
+	// with before encryption, each only if it is at least CompressionThreshold bytes
+	// and shrinks. Use only one the recipient's prekey offers (see NegotiateCompression).
+	Compression string
+}
+
+// EncryptMessageWith is EncryptMessageFrom with its optional settings in opts
+func EncryptMessageWith(random io.Reader, senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, prekey *Prekey, content []byte, attachment *Attachment, opts EncryptOptions) (*Message, error) {
+	part, escrowKey := opts.Part, opts.EscrowKey
+	msg := &Message{
+		Attachment: attachment,
+		Part:       part,
+		InReplyTo:  opts.InReplyTo,
+		ExpiresAt:  opts.ExpiresAt,
+	}
+
+	content, compression, err := compressPlaintext(opts.Compression, content)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt AES key: %v", err)
+		return nil, err
+	}
+	msg.Compression = compression
+	if attachment != nil && !attachment.Uploaded() {
+		if attachment.Content, attachment.Compression, err = compressPlaintext(opts.Compression, attachment.Content); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create AES cipher
-	block, err := aes.NewCipher(aesKey)
+	var aesKey []byte
+	suiteID := SuiteAES256GCM
+	if prekey != nil {
+		// Agree a one-off key with the recipient's prekey
+		key, ephemeral, err := wrapKeyX25519(random, prekey)
+		if err != nil {
+			return nil, err
+		}
+		aesKey = key
+		msg.Version = MessageVersionX25519
+		msg.EphemeralKey = ephemeral
+		msg.PrekeyID = prekey.ID
+		suiteID = NegotiateCipherSuite(prekey.Suites)
+	} else {
+		// Generate random AES key
+		aesKey = make([]byte, AESKeySize)
+		if _, err := io.ReadFull(random, aesKey); err != nil {
+			return nil, fmt.Errorf("failed to generate AES key: %v", err)
+		}
+
+		// Encrypt AES key with recipient's public key
+		encryptedKey, err := rsa.EncryptOAEP(
+			sha256.New(),
+			random,
+			recipientPublicKey,
+			aesKey,
+			nil,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt AES key: %v", err)
+		}
+		msg.Version = MessageVersionGCM
+		msg.EncryptedKey = encryptedKey
+	}
+
+	suite, _ := LookupCipherSuite(suiteID)
+	if suite.ID != SuiteAES256GCM {
+		msg.Suite = suite.ID
+	}
+	gcm, err := suite.New(aesKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+		return nil, err
 	}
 
-	// Generate IV
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	// Generate nonce
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(random, iv); err != nil {
 		return nil, fmt.Errorf("failed to generate IV: %v", err)
 	}
 
 	// Encrypt content
-	stream := cipher.NewCTR(block, iv)
-	encryptedContent := make([]byte, len(content))
-	stream.XORKeyStream(encryptedContent, content)
+	encryptedContent := gcm.Seal(nil, iv, content, contentAADFor(part))
 
-	// If there's an attachment, encrypt it
+	// If there's an attachment, encrypt it (or, once uploaded, its chunk key) under
+	// its own nonce
 	if attachment != nil {
-		attachmentContent := make([]byte, len(attachment.Content))
-		stream.XORKeyStream(attachmentContent, attachment.Content)
-		attachment.Content = attachmentContent
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(random, nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate attachment nonce: %v", err)
+		}
+		if attachment.Uploaded() {
+			if len(attachment.Key) != AESKeySize {
+				return nil, fmt.Errorf("uploaded attachment has no key")
+			}
+			attachment.SealedKey = gcm.Seal(nil, nonce, attachment.Key, attachment.aad())
+		} else {
+			attachment.Content = gcm.Seal(nil, nonce, attachment.Content, attachment.aad())
+		}
+		attachment.Nonce = nonce
+
+		if len(attachment.SHA256) > 0 || attachment.ModTime != 0 {
+			info, err := json.Marshal(attachmentInfo{SHA256: attachment.SHA256, ModTime: attachment.ModTime})
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode attachment info: %v", err)
+			}
+			infoNonce := make([]byte, gcm.NonceSize())
+			if _, err := io.ReadFull(random, infoNonce); err != nil {
+				return nil, fmt.Errorf("failed to generate attachment info nonce: %v", err)
+			}
+			attachment.SealedInfo = gcm.Seal(infoNonce, infoNonce, info, attachment.infoAAD())
+		}
 	}
 
-	// Create message
-	msg := &Message{
-		EncryptedKey: encryptedKey,
-		IV:           iv,
-		Content:      encryptedContent,
-		Attachment:   attachment,
+	msg.IV = iv
+	msg.Content = encryptedContent
+
+	if escrowKey != nil {
+		escrowed, err := rsa.EncryptOAEP(sha256.New(), random, escrowKey, aesKey, []byte(escrowLabel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to escrow message key: %v", err)
+		}
+		if msg.EscrowID, err = Fingerprint(escrowKey); err != nil {
+			return nil, err
+		}
+		msg.EscrowedKey = escrowed
 	}
 
 	// Sign message
@@ -113,25 +379,173 @@ func EncryptMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.Pu
 	return msg, nil
 }
 
-// DecryptMessage decrypts a message using the recipient's private key
-func DecryptMessage(recipientPrivateKey *rsa.PrivateKey, msg *Message) ([]byte, error) {
-	// Decrypt AES key
+// DecryptMessage decrypts a message using the recipient's keys. Malformed messages
+// are rejected before any key is used.
+func DecryptMessage(keys *Keyring, msg *Message) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	aesKey, err := keys.messageKey(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Version {
+	case MessageVersionGCM, MessageVersionX25519:
+		return decryptAEAD(aesKey, msg)
+	case MessageVersionCTR:
+		return decryptCTR(aesKey, msg)
+	default:
+		return nil, fmt.Errorf("unsupported message version %d", msg.Version)
+	}
+}
+
+// RecoverMessage decrypts an escrowed message with the organizational recovery key it
+// was escrowed to, without any key of the recipient
+func RecoverMessage(escrowPrivateKey *rsa.PrivateKey, msg *Message) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(msg.EscrowedKey) == 0 {
+		return nil, fmt.Errorf("message was not escrowed")
+	}
+	fingerprint, err := Fingerprint(&escrowPrivateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint != msg.EscrowID {
+		return nil, fmt.Errorf("message was escrowed to a different recovery key (%s)", ShortenFingerprint(msg.EscrowID))
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, escrowPrivateKey, msg.EscrowedKey, []byte(escrowLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt escrowed key: %v", err)
+	}
+	return decryptAEAD(aesKey, msg)
+}
+
+// unwrapKeyRSA decrypts a message key wrapped to the recipient's RSA key
+func unwrapKeyRSA(recipientPrivateKey *rsa.PrivateKey, encryptedKey []byte) ([]byte, error) {
 	aesKey, err := rsa.DecryptOAEP(
 		sha256.New(),
 		rand.Reader,
 		recipientPrivateKey,
-		msg.EncryptedKey,
+		encryptedKey,
 		nil,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt AES key: %v", err)
 	}
+	return aesKey, nil
+}
+
+// newMessageGCM returns the AES-GCM AEAD for a message key
+func newMessageGCM(aesKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
+
+// decryptAEAD opens an authenticated message with its cipher suite, failing if content
+// or attachment was altered
+func decryptAEAD(aesKey []byte, msg *Message) ([]byte, error) {
+	suite, ok := LookupCipherSuite(msg.Suite)
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher suite %q (a newer clsp may read this message)", msg.Suite)
+	}
+	gcm, err := suite.New(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.IV) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid message nonce")
+	}
+
+	decryptedContent, err := gcm.Open(nil, msg.IV, msg.Content, contentAADFor(msg.Part))
+	if err != nil {
+		return nil, fmt.Errorf("message content failed authentication (tampered or corrupt)")
+	}
+	if msg.Compression != "" {
+		if decryptedContent, err = Decompress(msg.Compression, decryptedContent); err != nil {
+			return nil, fmt.Errorf("message content: %v", err)
+		}
+	}
+
+	if msg.Attachment != nil {
+		if len(msg.Attachment.Nonce) != gcm.NonceSize() {
+			return nil, fmt.Errorf("invalid attachment nonce")
+		}
+		if msg.Attachment.Uploaded() {
+			key, err := gcm.Open(nil, msg.Attachment.Nonce, msg.Attachment.SealedKey, msg.Attachment.aad())
+			if err != nil {
+				return nil, fmt.Errorf("attachment failed authentication (tampered or corrupt)")
+			}
+			msg.Attachment.Key = key
+		} else {
+			attachmentContent, err := gcm.Open(nil, msg.Attachment.Nonce, msg.Attachment.Content, msg.Attachment.aad())
+			if err != nil {
+				return nil, fmt.Errorf("attachment failed authentication (tampered or corrupt)")
+			}
+			if msg.Attachment.Compression != "" {
+				if attachmentContent, err = Decompress(msg.Attachment.Compression, attachmentContent); err != nil {
+					return nil, fmt.Errorf("attachment: %v", err)
+				}
+				if int64(len(attachmentContent)) != msg.Attachment.Size {
+					return nil, fmt.Errorf("attachment does not decompress to its size")
+				}
+			}
+			msg.Attachment.Content = attachmentContent
+		}
+		if err := openAttachmentInfo(gcm, msg.Attachment); err != nil {
+			return nil, err
+		}
+		if !msg.Attachment.Uploaded() {
+			sum := sha256.Sum256(msg.Attachment.Content)
+			if err := msg.Attachment.VerifyDigest(sum[:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return decryptedContent, nil
+}
+
+// openAttachmentInfo restores an attachment's SHA256 and ModTime from SealedInfo
+func openAttachmentInfo(gcm cipher.AEAD, a *Attachment) error {
+	if len(a.SealedInfo) == 0 {
+		return nil
+	}
+	if len(a.SealedInfo) < gcm.NonceSize() {
+		return fmt.Errorf("invalid attachment info")
+	}
+	nonce, sealed := a.SealedInfo[:gcm.NonceSize()], a.SealedInfo[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, sealed, a.infoAAD())
+	if err != nil {
+		return fmt.Errorf("attachment info failed authentication (tampered or corrupt)")
+	}
+	var info attachmentInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("invalid attachment info: %v", err)
+	}
+	a.SHA256, a.ModTime = info.SHA256, info.ModTime
+	return nil
+}
 
+// decryptCTR decrypts a legacy unauthenticated AES-CTR message
+func decryptCTR(aesKey []byte, msg *Message) ([]byte, error) {
 	// Create AES cipher
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
 	}
+	if len(msg.IV) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid message IV")
+	}
 
 	// Decrypt content
 	stream := cipher.NewCTR(block, msg.IV)
@@ -140,6 +554,9 @@ func DecryptMessage(recipientPrivateKey *rsa.PrivateKey, msg *Message) ([]byte,
 
 	// If there's an attachment, decrypt it
 	if msg.Attachment != nil {
+		if msg.Attachment.Uploaded() {
+			return nil, fmt.Errorf("uploaded attachments require an authenticated message")
+		}
 		attachmentContent := make([]byte, len(msg.Attachment.Content))
 		stream.XORKeyStream(attachmentContent, msg.Attachment.Content)
 		msg.Attachment.Content = attachmentContent
@@ -148,16 +565,22 @@ func DecryptMessage(recipientPrivateKey *rsa.PrivateKey, msg *Message) ([]byte,
 	return decryptedContent, nil
 }
 
-// VerifySignature verifies the message signature using the sender's public key
+// VerifySignature verifies the message signature using the sender's public key. The
+// signature covers the encrypted payload as produced by EncryptMessagePart, before the
+// routing fields were filled in, so it must be checked before DecryptMessage replaces
+// the attachment content.
 func VerifySignature(senderPublicKey *rsa.PublicKey, msg *Message) error {
-	// Create a copy of the message without the signature
-	msgCopy := *msg
-	msgCopy.Signature = nil
+	if len(msg.Signature) == 0 {
+		return fmt.Errorf("message is not signed")
+	}
+	if msg.SignatureAlg != "" {
+		return fmt.Errorf("message is signed with a %s key, not an RSA key", msg.SignatureAlg)
+	}
 
-	// Marshal the message
-	msgBytes, err := json.Marshal(msgCopy)
+	// Marshal a copy of the message as it was signed
+	msgBytes, err := signedMessageBytes(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %v", err)
+		return err
 	}
 
 	// Verify signature
@@ -175,3 +598,21 @@ func VerifySignature(senderPublicKey *rsa.PublicKey, msg *Message) error {
 
 	return nil
 }
+
+// DedupeKey derives a deterministic, sender-keyed hash of a message's plaintext so the
+// hub can recognise accidental double-sends without learning anything about the content
+func DedupeKey(senderPrivateKey *rsa.PrivateKey, recipientID string, content []byte, attachment *Attachment) string {
+	secret := sha256.Sum256(append([]byte("clsp-dedupe"), x509.MarshalPKCS1PrivateKey(senderPrivateKey)...))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(recipientID))
+	mac.Write([]byte{0})
+	mac.Write(content)
+	if attachment != nil {
+		mac.Write([]byte{0})
+		mac.Write([]byte(attachment.Filename))
+		mac.Write([]byte{0})
+		mac.Write(attachment.Content)
+		mac.Write([]byte(attachment.ID))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// mnemonicEntropySize is the entropy of a recovery phrase in bytes; with its BIP39
+// checksum it is written as 24 words
+const mnemonicEntropySize = 32
+
+var (
+	mnemonicWords = strings.Fields(mnemonicWordlist)
+	// mnemonicIndex maps each word, and its first four letters, to its index
+	mnemonicIndex = func() map[string]int {
+		index := make(map[string]int, 2*len(mnemonicWords))
+		for i, w := range mnemonicWords {
+			index[w] = i
+			if len(w) > 4 {
+				index[w[:4]] = i
+			}
+		}
+		return index
+	}()
+)
+
+// NewMnemonic returns a random BIP39-style recovery phrase of 24 words
+func NewMnemonic() (string, error) {
+	entropy := make([]byte, mnemonicEntropySize)
+	if _, err := io.ReadFull(rand.Reader, entropy); err != nil {
+		return "", fmt.Errorf("failed to generate recovery phrase: %v", err)
+	}
+	return MnemonicFromEntropy(entropy)
+}
+
+// MnemonicFromEntropy writes 32 bytes of entropy as a recovery phrase, the inverse of
+// MnemonicEntropy
+func MnemonicFromEntropy(entropy []byte) (string, error) {
+	if len(entropy) != mnemonicEntropySize {
+		return "", fmt.Errorf("a recovery phrase holds %d bytes of entropy, not %d", mnemonicEntropySize, len(entropy))
+	}
+	checksum := sha256.Sum256(entropy)
+	// 256 bits of entropy and 8 of checksum make 24 groups of 11 bits
+	bits := append(append([]byte{}, entropy...), checksum[0])
+	words := make([]string, 0, len(bits)*8/11)
+	for i := 0; i < len(bits)*8; i += 11 {
+		index := 0
+		for j := i; j < i+11; j++ {
+			index = index<<1 | int(bits[j/8]>>(7-j%8)&1)
+		}
+		words = append(words, mnemonicWords[index])
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicEntropy checks a recovery phrase written by NewMnemonic and returns its
+// entropy. Case and spacing do not matter, and words may be shortened to their first
+// four letters.
+func MnemonicEntropy(phrase string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) != (mnemonicEntropySize*8+mnemonicEntropySize/4)/11 {
+		return nil, fmt.Errorf("a recovery phrase has 24 words, not %d", len(words))
+	}
+	bits := make([]byte, mnemonicEntropySize+1)
+	for i, w := range words {
+		index, ok := mnemonicIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("word %d (%q) is not in the recovery wordlist", i+1, w)
+		}
+		for j := 0; j < 11; j++ {
+			if index>>(10-j)&1 == 1 {
+				bit := i*11 + j
+				bits[bit/8] |= 1 << (7 - bit%8)
+			}
+		}
+	}
+	entropy := bits[:mnemonicEntropySize]
+	if checksum := sha256.Sum256(entropy); checksum[0] != bits[mnemonicEntropySize] {
+		return nil, fmt.Errorf("the recovery phrase is mistyped (checksum mismatch)")
+	}
+	return entropy, nil
+}
+
+// RecoveryKeys derives from a recovery phrase's entropy the key that encrypts the
+// recovery kit and the ID the hub stores it under, which reveals nothing of the key
+func RecoveryKeys(entropy []byte) (key []byte, id string, err error) {
+	key = make([]byte, AESKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, entropy, nil, []byte("clsp-recovery-key")), key); err != nil {
+		return nil, "", fmt.Errorf("failed to derive recovery key: %v", err)
+	}
+	rawID := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, entropy, nil, []byte("clsp-recovery-id")), rawID); err != nil {
+		return nil, "", fmt.Errorf("failed to derive recovery ID: %v", err)
+	}
+	return key, hex.EncodeToString(rawID), nil
+}
@@ -0,0 +1,273 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// x25519KeyInfo labels the key derived from the X25519 shared secret
+const x25519KeyInfo = "clsp-x25519-v1"
+
+// Prekey is a medium-term X25519 public key a user publishes in the hub directory.
+// Senders agree a fresh key with it for every message using an ephemeral key of
+// their own; once the recipient deletes the private half, messages encrypted to
+// it cannot be decrypted even with the long-term identity key.
+type Prekey struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	CreatedAt int64  `json:"created_at"`
+	// Suites are the cipher suites the owner's client reads, most preferred first,
+	// followed by the compression algorithms it reads (see Compressions); prekeys from
+	// clients that predate suites list none. Senders skip entries they do not know.
+	Suites []string `json:"suites,omitempty"`
+	// Signature by the owner's identity key, so the hub cannot substitute its own
+	// prekey, nor strip suites to make senders fall back to a weaker one
+	Signature []byte `json:"signature"`
+}
+
+// payload returns the canonical bytes covered by a prekey signature
+func (p *Prekey) payload() []byte {
+	payload := fmt.Sprintf("clsp-prekey\n%s\n%d\n%x", p.ID, p.CreatedAt, p.PublicKey)
+	if len(p.Suites) > 0 {
+		payload += "\n" + strings.Join(p.Suites, ",")
+	}
+	return []byte(payload)
+}
+
+// Verify checks that the prekey was signed by the owner of identityKey
+func (p *Prekey) Verify(identityKey *rsa.PublicKey) error {
+	if len(p.PublicKey) != 32 || p.ID != prekeyID(p.PublicKey) {
+		return fmt.Errorf("malformed prekey")
+	}
+	if err := VerifyData(identityKey, p.payload(), p.Signature); err != nil {
+		return fmt.Errorf("prekey signature invalid: %v", err)
+	}
+	return nil
+}
+
+// prekeyID derives a short identifier from a prekey's public half
+func prekeyID(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GeneratePrekey creates a new X25519 prekey signed by the identity key, listing
+// suites as the cipher suites its owner reads (nil lists every registered suite)
+// and then the compression algorithms this package reads
+func GeneratePrekey(identity *rsa.PrivateKey, suites []string) (*Prekey, *ecdh.PrivateKey, error) {
+	for _, id := range suites {
+		if _, ok := LookupCipherSuite(id); !ok || id == "" {
+			return nil, nil, fmt.Errorf("unknown cipher suite %q", id)
+		}
+	}
+	suites = PrekeySuites(suites)
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate prekey: %v", err)
+	}
+	p, err := NewPrekey(identity, private, time.Now(), suites)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, private, nil
+}
+
+// PrekeySuites returns the list GeneratePrekey publishes for suites: the cipher
+// suites (every registered one for nil), followed by Compressions
+func PrekeySuites(suites []string) []string {
+	if suites == nil {
+		suites = CipherSuites()
+	}
+	return append(append([]string(nil), suites...), Compressions()...)
+}
+
+// NewPrekey publishes an existing X25519 key as a prekey created at createdAt,
+// signed by the identity key and listing suites as given
+func NewPrekey(identity *rsa.PrivateKey, private *ecdh.PrivateKey, createdAt time.Time, suites []string) (*Prekey, error) {
+	p := &Prekey{
+		ID:        prekeyID(private.PublicKey().Bytes()),
+		PublicKey: private.PublicKey().Bytes(),
+		CreatedAt: createdAt.Unix(),
+		Suites:    suites,
+	}
+	var err error
+	if p.Signature, err = SignData(identity, p.payload()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Keyring holds the keys a recipient decrypts messages with
+type Keyring struct {
+	// Identity is the long-term key; it opens messages sent without a prekey
+	Identity *rsa.PrivateKey
+	// Prekeys are the private halves of the user's prekeys by ID
+	Prekeys map[string]*ecdh.PrivateKey
+	// SavedKeys are content keys of individual messages by message ID, sealed with
+	// SaveMessageKey, so local copies stay readable after their prekey is deleted
+	SavedKeys map[string][]byte
+	// Retired are identity keys replaced by a key rotation, newest first; they open
+	// messages encrypted or sealed before the rotation
+	Retired []*rsa.PrivateKey
+}
+
+// agreeKey derives a message key from an X25519 exchange, binding both public keys
+func agreeKey(private *ecdh.PrivateKey, peer *ecdh.PublicKey, ephemeral, prekey []byte) ([]byte, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+	info := append([]byte(x25519KeyInfo), ephemeral...)
+	info = append(info, prekey...)
+	key := make([]byte, AESKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive message key: %v", err)
+	}
+	return key, nil
+}
+
+// wrapKeyX25519 agrees a fresh message key with the recipient's prekey, returning the
+// key and the ephemeral public key the recipient needs to derive it again. The
+// ephemeral key is read from random as 32 bytes, so a given reader always yields the
+// same key.
+func wrapKeyX25519(random io.Reader, prekey *Prekey) ([]byte, []byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(prekey.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid prekey: %v", err)
+	}
+	seed := make([]byte, 32)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+	ephemeral, err := ecdh.X25519().NewPrivateKey(seed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	key, err := agreeKey(ephemeral, peer, ephemeralPublic, prekey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, ephemeralPublic, nil
+}
+
+// messageKey recovers the content key of a message from the keyring
+func (k *Keyring) messageKey(msg *Message) ([]byte, error) {
+	if msg.Version != MessageVersionX25519 {
+		if k.Identity == nil {
+			return nil, fmt.Errorf("no identity key")
+		}
+		key, err := unwrapKeyRSA(k.Identity, msg.EncryptedKey)
+		for _, retired := range k.Retired {
+			if err == nil {
+				break
+			}
+			if retiredKey, retiredErr := unwrapKeyRSA(retired, msg.EncryptedKey); retiredErr == nil {
+				key, err = retiredKey, nil
+			}
+		}
+		return key, err
+	}
+
+	if private, ok := k.Prekeys[msg.PrekeyID]; ok {
+		peer, err := ecdh.X25519().NewPublicKey(msg.EphemeralKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %v", err)
+		}
+		return agreeKey(private, peer, msg.EphemeralKey, private.PublicKey().Bytes())
+	}
+	if sealed, ok := k.SavedKeys[msg.ID]; ok && k.Identity != nil {
+		key, err := OpenLocal(k.Identity, sealed)
+		for _, retired := range k.Retired {
+			if err == nil {
+				break
+			}
+			if retiredKey, retiredErr := OpenLocal(retired, sealed); retiredErr == nil {
+				key, err = retiredKey, nil
+			}
+		}
+		return key, err
+	}
+	return nil, fmt.Errorf("prekey %s is no longer available (the message predates the retained prekeys)", msg.PrekeyID)
+}
+
+// SaveMessageKey returns msg's content key sealed for local storage, for use in
+// SavedKeys once the prekey is gone. Messages sent without a prekey return nil,
+// since the identity key alone opens them.
+func (k *Keyring) SaveMessageKey(msg *Message) ([]byte, error) {
+	if msg.Version != MessageVersionX25519 {
+		return nil, nil
+	}
+	key, err := k.messageKey(msg)
+	if err != nil {
+		return nil, err
+	}
+	return SealLocal(k.Identity, key)
+}
+
+// localKey derives the key that seals data kept on the user's device
+func localKey(identity *rsa.PrivateKey) []byte {
+	sum := sha256.Sum256(append([]byte("clsp-local"), x509.MarshalPKCS1PrivateKey(identity)...))
+	return sum[:]
+}
+
+// LocalMACKey derives the key that authenticates data kept on the user's device, such
+// as the integrity chain of the message archive
+func LocalMACKey(identity *rsa.PrivateKey) []byte {
+	sum := sha256.Sum256(append([]byte("clsp-local-mac"), x509.MarshalPKCS1PrivateKey(identity)...))
+	return sum[:]
+}
+
+// SealLocal encrypts data kept on the user's device (such as prekeys) under a key
+// derived from the identity key, so it is as protected as the identity itself
+func SealLocal(identity *rsa.PrivateKey, data []byte) ([]byte, error) {
+	return Seal(localKey(identity), data)
+}
+
+// OpenLocal decrypts data sealed with SealLocal
+func OpenLocal(identity *rsa.PrivateKey, sealed []byte) ([]byte, error) {
+	data, err := Open(localKey(identity), sealed)
+	if err != nil {
+		return nil, fmt.Errorf("sealed data failed authentication (wrong identity or corrupt)")
+	}
+	return data, nil
+}
+
+// Seal encrypts data with AES-256-GCM under key, prefixing a random nonce
+func Seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data sealed with Seal
+func Open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	data, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("sealed data failed authentication (wrong key or corrupt)")
+	}
+	return data, nil
+}
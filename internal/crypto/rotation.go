@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"time"
+)
+
+// KeyRotation announces that a user replaced their RSA encryption key. It is signed
+// by the replaced key and by the user's Ed25519 signing key, which stays the same, so
+// contacts who pinned the old key can follow the change without a new fingerprint
+// check.
+type KeyRotation struct {
+	PreviousKey string `json:"previous_key"`
+	PublicKey   string `json:"public_key"`
+	RotatedAt   int64  `json:"rotated_at"`
+	// PreviousSig is made by the replaced RSA key, IdentitySig by the signing key
+	PreviousSig []byte `json:"previous_sig"`
+	IdentitySig []byte `json:"identity_sig"`
+}
+
+// payload returns the canonical bytes covered by both rotation signatures
+func (r *KeyRotation) payload() []byte {
+	return []byte(fmt.Sprintf("clsp-key-rotation\n%d\n%d:%s%d:%s", r.RotatedAt, len(r.PreviousKey), r.PreviousKey, len(r.PublicKey), r.PublicKey))
+}
+
+// NewKeyRotation signs the replacement of previous by next
+func NewKeyRotation(previous *rsa.PrivateKey, signingKey ed25519.PrivateKey, next *rsa.PublicKey) (*KeyRotation, error) {
+	previousPEM, err := PublicKeyToPEM(&previous.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	nextPEM, err := PublicKeyToPEM(next)
+	if err != nil {
+		return nil, err
+	}
+	r := &KeyRotation{
+		PreviousKey: string(previousPEM),
+		PublicKey:   string(nextPEM),
+		RotatedAt:   time.Now().Unix(),
+	}
+	if r.PreviousSig, err = SignData(previous, r.payload()); err != nil {
+		return nil, err
+	}
+	r.IdentitySig = ed25519.Sign(signingKey, r.payload())
+	return r, nil
+}
+
+// Verify checks both signatures of the rotation: the replaced key's, and the signing
+// key's when signingKey is not nil
+func (r *KeyRotation) Verify(signingKey ed25519.PublicKey) error {
+	previous, err := LoadPublicKeyFromPEM([]byte(r.PreviousKey))
+	if err != nil {
+		return fmt.Errorf("invalid previous key in rotation: %v", err)
+	}
+	if _, err := LoadPublicKeyFromPEM([]byte(r.PublicKey)); err != nil {
+		return fmt.Errorf("invalid new key in rotation: %v", err)
+	}
+	if err := VerifyData(previous, r.payload(), r.PreviousSig); err != nil {
+		return fmt.Errorf("rotation is not signed by the previous key: %v", err)
+	}
+	if signingKey != nil && !ed25519.Verify(signingKey, r.payload(), r.IdentitySig) {
+		return fmt.Errorf("rotation is not signed by the signing key")
+	}
+	return nil
+}
+
+// FollowRotations checks that the key current descends from the key pinned through a
+// chain of valid rotations, each signed by the key it replaced and, when signingKey is
+// not nil, by that signing key
+func FollowRotations(pinned, current string, signingKey ed25519.PublicKey, rotations []KeyRotation) error {
+	key := pinned
+	for steps := 0; key != current; steps++ {
+		if steps == len(rotations) {
+			return fmt.Errorf("no rotation chain leads from the pinned key to the current one")
+		}
+		var next *KeyRotation
+		for i := range rotations {
+			if rotations[i].PreviousKey == key {
+				next = &rotations[i]
+				break
+			}
+		}
+		if next == nil {
+			return fmt.Errorf("no rotation chain leads from the pinned key to the current one")
+		}
+		if err := next.Verify(signingKey); err != nil {
+			return err
+		}
+		key = next.PublicKey
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// SignData signs arbitrary data with an RSA private key using PKCS#1 v1.5 over SHA-256
+func SignData(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %v", err)
+	}
+	return signature, nil
+}
+
+// VerifyData verifies a signature produced by SignData
+func VerifyData(publicKey *rsa.PublicKey, data, signature []byte) error {
+	hash := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+		return fmt.Errorf("failed to verify signature: %v", err)
+	}
+	return nil
+}
+
+// AnnouncementPayload returns the canonical bytes covered by a hub announcement signature
+func AnnouncementPayload(id, body string, createdAt, expiresAt int64) []byte {
+	return []byte(fmt.Sprintf("clsp-announcement\n%s\n%d\n%d\n%s", id, createdAt, expiresAt, body))
+}
+
+// DirectoryEntry is one user in a hub-signed directory snapshot
+type DirectoryEntry struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	PublicKey   string `json:"public_key"`
+	// SigningKey and SigningKeySig are the user's certified Ed25519 signing key, if any
+	SigningKey    string `json:"signing_key,omitempty"`
+	SigningKeySig []byte `json:"signing_key_sig,omitempty"`
+}
+
+// DirectoryPayload returns the canonical bytes covered by a directory snapshot
+// signature. Entries are hashed with their lengths so no two snapshots share a payload;
+// signing keys are only hashed when present, so entries without one hash as before.
+func DirectoryPayload(generatedAt, expiresAt int64, entries []DirectoryEntry) []byte {
+	hash := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(hash, "%d:%s%d:%s%d:%s", len(e.ID), e.ID, len(e.DisplayName), e.DisplayName, len(e.PublicKey), e.PublicKey)
+		if e.SigningKey != "" {
+			fmt.Fprintf(hash, "s%d:%s%d:%x", len(e.SigningKey), e.SigningKey, len(e.SigningKeySig), e.SigningKeySig)
+		}
+	}
+	return []byte(fmt.Sprintf("clsp-directory\n%d\n%d\n%d\n%x", generatedAt, expiresAt, len(entries), hash.Sum(nil)))
+}
+
+// RequestPayload returns the canonical bytes a user signs to authenticate a hub request
+// such as a status query. The action names the request so a signature for one request
+// type cannot be replayed as another.
+func RequestPayload(action, userID string, timestamp int64, fields ...string) []byte {
+	payload := fmt.Sprintf("clsp-request\n%s\n%s\n%d", action, userID, timestamp)
+	for _, f := range fields {
+		payload += "\n" + f
+	}
+	return []byte(payload)
+}
@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// SignatureEd25519 is the SignatureAlg of messages signed with an Ed25519 signing key.
+// Messages without a SignatureAlg are signed with the sender's RSA key.
+const SignatureEd25519 = "ed25519"
+
+// sealedSigningKeyPEMType marks a signing key sealed to the owner's RSA key
+const sealedSigningKeyPEMType = "CLSP SEALED SIGNING KEY"
+
+// signingKeyLabel is the OAEP label of sealed signing keys, so a sealed signing key
+// cannot be passed off as a message key or vice versa
+const signingKeyLabel = "clsp-signing-key-v1"
+
+// GenerateSigningKey creates an Ed25519 signing key
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return key, nil
+}
+
+// SigningPublicKeyToPEM encodes an Ed25519 public key as PEM
+func SigningPublicKeyToPEM(publicKey ed25519.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal signing key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// LoadSigningPublicKeyFromPEM parses an Ed25519 public key from PEM
+func LoadSigningPublicKeyFromPEM(pemData string) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode signing key PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is not an Ed25519 key")
+	}
+	return publicKey, nil
+}
+
+// SigningKeyFingerprint returns the SHA-256 fingerprint of an Ed25519 public key,
+// grouped like Fingerprint
+func SigningKeyFingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	encoded := hex.EncodeToString(sum[:])
+	var groups []string
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SealSigningKey encrypts a signing key to its owner's RSA key for storage next to
+// it, so unlocking the RSA key also unlocks the signing key
+func SealSigningKey(signingKey ed25519.PrivateKey, owner *rsa.PublicKey) ([]byte, error) {
+	sealed, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, owner, signingKey.Seed(), []byte(signingKeyLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal signing key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: sealedSigningKeyPEMType, Bytes: sealed}), nil
+}
+
+// OpenSigningKey decrypts a signing key sealed by SealSigningKey
+func OpenSigningKey(data []byte, owner *rsa.PrivateKey) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sealedSigningKeyPEMType {
+		return nil, fmt.Errorf("failed to decode sealed signing key")
+	}
+	seed, err := rsa.DecryptOAEP(sha256.New(), nil, owner, block.Bytes, []byte(signingKeyLabel))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("failed to unseal signing key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKeyPayload returns the bytes an RSA key signs to certify a signing key
+func signingKeyPayload(signingKeyPEM string) []byte {
+	return []byte("clsp-signing-key\n" + signingKeyPEM)
+}
+
+// CertifySigningKey signs a signing key's PEM with the owner's RSA key, binding the
+// two so contacts who pinned the RSA key accept the signing key without a new check
+func CertifySigningKey(owner *rsa.PrivateKey, signingKeyPEM string) ([]byte, error) {
+	return SignData(owner, signingKeyPayload(signingKeyPEM))
+}
+
+// VerifySigningKey checks a certificate produced by CertifySigningKey and returns
+// the certified signing key
+func VerifySigningKey(owner *rsa.PublicKey, signingKeyPEM string, certificate []byte) (ed25519.PublicKey, error) {
+	if err := VerifyData(owner, signingKeyPayload(signingKeyPEM), certificate); err != nil {
+		return nil, fmt.Errorf("signing key is not certified by the identity key: %v", err)
+	}
+	return LoadSigningPublicKeyFromPEM(signingKeyPEM)
+}
+
+// signedMessageBytes returns the bytes a message signature covers: the message as
+// its sender produced it, before the hub filled in the routing fields
+func signedMessageBytes(msg *Message) ([]byte, error) {
+	msgCopy := *msg
+	msgCopy.Signature = nil
+	msgCopy.ID = ""
+	msgCopy.Sender = ""
+	msgCopy.Recipient = ""
+	msgCopy.Timestamp = 0
+	msgCopy.Status = ""
+	msgCopy.DedupeKey = ""
+	data, err := json.Marshal(msgCopy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+	return data, nil
+}
+
+// SignMessageEd25519 replaces the signature of a freshly encrypted message with one
+// made by an Ed25519 signing key. The signature covers SignatureAlg, so it cannot be
+// stripped to pass the message off under the RSA key.
+func SignMessageEd25519(signingKey ed25519.PrivateKey, msg *Message) error {
+	msg.SignatureAlg = SignatureEd25519
+	data, err := signedMessageBytes(msg)
+	if err != nil {
+		return err
+	}
+	msg.Signature = ed25519.Sign(signingKey, data)
+	return nil
+}
+
+// VerifyMessageSignature checks a message's signature with the sender's key for its
+// SignatureAlg: signingKey for Ed25519 signatures, which may be nil when the sender
+// has none, and rsaKey otherwise
+func VerifyMessageSignature(rsaKey *rsa.PublicKey, signingKey ed25519.PublicKey, msg *Message) error {
+	switch msg.SignatureAlg {
+	case "":
+		return VerifySignature(rsaKey, msg)
+	case SignatureEd25519:
+		if signingKey == nil {
+			return fmt.Errorf("no signing key to verify the message with")
+		}
+		data, err := signedMessageBytes(msg)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(signingKey, data, msg.Signature) {
+			return fmt.Errorf("failed to verify signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown signature algorithm %q", msg.SignatureAlg)
+	}
+}
@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher suites built into this package. A suite names the authenticated cipher that
+// encrypts a message's content and attachment under the message key; how that key
+// reaches the recipient (RSA or X25519) is given by the message version.
+const (
+	// SuiteAES256GCM is the default suite. Messages encrypted with it leave Suite
+	// empty, as messages from clients that predate suites do.
+	SuiteAES256GCM = "aes-256-gcm"
+	// SuiteXChaCha20Poly1305 uses XChaCha20-Poly1305, whose 24-byte nonces are safe
+	// to choose at random without bound and which is fast without AES hardware
+	SuiteXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// CipherSuite is an authenticated cipher messages can be encrypted with
+type CipherSuite struct {
+	// ID names the suite in message envelopes and in published prekeys
+	ID string
+	// NonceSize and Overhead are those of the AEAD, for checking envelopes without
+	// a key
+	NonceSize int
+	Overhead  int
+	// New returns the AEAD for a message key of AESKeySize bytes
+	New func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	suitesMu sync.RWMutex
+	// suites are the registered suites in order of preference
+	suites []CipherSuite
+)
+
+func init() {
+	RegisterCipherSuite(CipherSuite{ID: SuiteAES256GCM, NonceSize: gcmNonceSize, Overhead: GCMOverhead, New: newMessageGCM})
+	RegisterCipherSuite(CipherSuite{
+		ID:        SuiteXChaCha20Poly1305,
+		NonceSize: chacha20poly1305.NonceSizeX,
+		Overhead:  chacha20poly1305.Overhead,
+		New: func(key []byte) (cipher.AEAD, error) {
+			aead, err := chacha20poly1305.NewX(key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %v", err)
+			}
+			return aead, nil
+		},
+	})
+}
+
+// RegisterCipherSuite adds a suite after those registered before it, which are
+// preferred to it. Clients publish the suites they support with their prekey and
+// senders pick one the recipient published, so a new suite is only used between
+// clients that both have it. Registering an ID twice, or one that is empty or holds
+// a comma, panics.
+func RegisterCipherSuite(suite CipherSuite) {
+	if suite.ID == "" || strings.ContainsAny(suite.ID, ",\n") {
+		panic("crypto: invalid cipher suite ID " + strconv.Quote(suite.ID))
+	}
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	for _, s := range suites {
+		if s.ID == suite.ID {
+			panic("crypto: cipher suite " + suite.ID + " registered twice")
+		}
+	}
+	suites = append(suites, suite)
+}
+
+// LookupCipherSuite returns a registered suite; the empty ID is SuiteAES256GCM
+func LookupCipherSuite(id string) (CipherSuite, bool) {
+	if id == "" {
+		id = SuiteAES256GCM
+	}
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	for _, s := range suites {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return CipherSuite{}, false
+}
+
+// CipherSuites returns the IDs of the registered suites, most preferred first
+func CipherSuites() []string {
+	suitesMu.RLock()
+	defer suitesMu.RUnlock()
+	ids := make([]string, len(suites))
+	for i, s := range suites {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+// NegotiateCipherSuite picks the suite to encrypt to a recipient who published
+// offered, most preferred first: the first one registered here. Recipients who
+// published none, or none known here, get SuiteAES256GCM, which every client reads.
+func NegotiateCipherSuite(offered []string) string {
+	for _, id := range offered {
+		if _, ok := LookupCipherSuite(id); ok {
+			return id
+		}
+	}
+	return SuiteAES256GCM
+}
@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"fmt"
+
+	"github.com/mattd/clsp/pkg/clsppb"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentTypeProtobuf is the media type of envelopes encoded as clsp.v1.Message (see
+// pkg/clsppb/hub.proto), and of lists of them encoded as clsp.v1.FetchMessagesResponse.
+// Binary fields are sent as they are instead of in base64, which makes envelopes with
+// large inline content about a quarter smaller than their JSON and quicker to encode.
+const ContentTypeProtobuf = "application/x-protobuf"
+
+// EncodeMessageProto returns the protobuf encoding of a well-formed message
+func EncodeMessageProto(m *Message) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(MessageToProto(m))
+}
+
+// DecodeMessageProto parses one protobuf message and validates it
+func DecodeMessageProto(data []byte) (*Message, error) {
+	var pb clsppb.Message
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, fmt.Errorf("malformed message: %v", err)
+	}
+	m := MessageFromProto(&pb)
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MessageToProto converts an envelope to its protobuf form
+func MessageToProto(m *Message) *clsppb.Message {
+	msg := &clsppb.Message{
+		Version:      int32(m.Version),
+		Suite:        m.Suite,
+		Id:           m.ID,
+		Sender:       m.Sender,
+		Recipient:    m.Recipient,
+		Timestamp:    m.Timestamp,
+		Status:       m.Status,
+		EncryptedKey: m.EncryptedKey,
+		EphemeralKey: m.EphemeralKey,
+		PrekeyId:     m.PrekeyID,
+		Iv:           m.IV,
+		Content:      m.Content,
+		Signature:    m.Signature,
+		SigAlg:       m.SignatureAlg,
+		DedupeKey:    m.DedupeKey,
+		EscrowedKey:  m.EscrowedKey,
+		EscrowId:     m.EscrowID,
+		InReplyTo:    m.InReplyTo,
+		ExpiresAt:    m.ExpiresAt,
+		Compression:  m.Compression,
+	}
+	if a := m.Attachment; a != nil {
+		msg.Attachment = &clsppb.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			Content:     a.Content,
+			Nonce:       a.Nonce,
+			Id:          a.ID,
+			ChunkSize:   int32(a.ChunkSize),
+			SealedKey:   a.SealedKey,
+			SealedInfo:  a.SealedInfo,
+			Compression: a.Compression,
+		}
+	}
+	if p := m.Part; p != nil {
+		msg.Part = &clsppb.MessagePart{Group: p.Group, Index: int32(p.Index), Total: int32(p.Total)}
+	}
+	return msg
+}
+
+// MessageFromProto converts an envelope from its protobuf form
+func MessageFromProto(m *clsppb.Message) *Message {
+	msg := &Message{
+		Version:      int(m.Version),
+		Suite:        m.Suite,
+		ID:           m.Id,
+		Sender:       m.Sender,
+		Recipient:    m.Recipient,
+		Timestamp:    m.Timestamp,
+		Status:       m.Status,
+		EncryptedKey: m.EncryptedKey,
+		EphemeralKey: m.EphemeralKey,
+		PrekeyID:     m.PrekeyId,
+		IV:           m.Iv,
+		Content:      m.Content,
+		Signature:    m.Signature,
+		SignatureAlg: m.SigAlg,
+		DedupeKey:    m.DedupeKey,
+		EscrowedKey:  m.EscrowedKey,
+		EscrowID:     m.EscrowId,
+		InReplyTo:    m.InReplyTo,
+		ExpiresAt:    m.ExpiresAt,
+		Compression:  m.Compression,
+	}
+	if a := m.Attachment; a != nil {
+		msg.Attachment = &Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			Content:     a.Content,
+			Nonce:       a.Nonce,
+			ID:          a.Id,
+			ChunkSize:   int(a.ChunkSize),
+			SealedKey:   a.SealedKey,
+			SealedInfo:  a.SealedInfo,
+			Compression: a.Compression,
+		}
+	}
+	if p := m.Part; p != nil {
+		msg.Part = &MessagePart{Group: p.Group, Index: int(p.Index), Total: int(p.Total)}
+	}
+	return msg
+}
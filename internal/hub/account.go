@@ -0,0 +1,460 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// AccountExport is everything the hub holds about a user, returned to them by
+// GET /account/export. Message content is end-to-end encrypted, so messages are
+// exported as the envelopes the hub stores.
+type AccountExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	// User is the directory entry, including presence
+	User User `json:"user"`
+	// UpdatedAt is when the user last registered or changed their keys
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// SSOSubject is the identity provider subject the account was registered with
+	SSOSubject      string                `json:"sso_subject,omitempty"`
+	Notifications   *NotificationSettings `json:"notifications,omitempty"`
+	Receipts        string                `json:"receipts"`
+	MessageRequests bool                  `json:"message_requests"`
+	// SendQuota is the user's own quota, when an admin set one
+	SendQuota *SendQuota `json:"send_quota,omitempty"`
+	SendUsage SendUsage  `json:"send_usage"`
+	// RecoveryKit is the user's encrypted recovery kit, if they stored one
+	RecoveryKit *RecoveryKit `json:"recovery_kit,omitempty"`
+	// Invite is the provisioning record the account was claimed from
+	Invite *Invite `json:"invite,omitempty"`
+	// Devices are the client installations the user's clients announced
+	Devices []Device `json:"devices"`
+	// Messages are the stored messages the user sent or received
+	Messages []crypto.Message `json:"messages"`
+	// Attachments are the uploads the user made; their content is ciphertext
+	Attachments []AttachmentStatus `json:"attachments"`
+	// Contacts are the users the user sent a message to, and ContactOf those who sent
+	// them one, as kept for receipt policies
+	Contacts  []AccountContact `json:"contacts"`
+	ContactOf []AccountContact `json:"contact_of"`
+	// DailyUsage is the volume the user sent each day, as kept for capacity reports
+	DailyUsage []DailyUsage `json:"daily_usage"`
+	// Logs are the hub's log entries about the user
+	Logs []LogEntry `json:"logs"`
+}
+
+// AccountContact is one side of a contact relation and when it began
+type AccountContact struct {
+	UserID string    `json:"user_id"`
+	Since  time.Time `json:"since"`
+}
+
+// AccountDeletion reports an account deleted by its owner
+type AccountDeletion struct {
+	UserID      string `json:"user_id"`
+	Messages    int64  `json:"messages"`
+	Attachments int    `json:"attachments"`
+	// Deliveries counts the queued webhook notifications and relays to other hubs
+	// removed, and DeadLetters those that had already failed
+	Deliveries  int64 `json:"deliveries"`
+	DeadLetters int64 `json:"dead_letters"`
+}
+
+// handleAccount deletes the calling user's account (DELETE), signed with the account
+// key. Unlike deactivation there is no grace period: the user's profile, presence,
+// stored messages, attachments, contacts, usage, devices and log entries go at once,
+// with the webhook notifications and relays to other hubs still queued for them or
+// dead-lettered.
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.verifySignedRequest(ctx, r, "account-delete", userID)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	deletion, err := s.eraseAccount(ctx, userID)
+	if err != nil {
+		dbError(w, ctx, "Failed to delete account")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deletion)
+}
+
+// eraseAccount removes a user and every row the hub keeps about them, then their
+// attachment files. The log line it leaves does not name the user.
+func (s *Server) eraseAccount(ctx context.Context, userID string) (*AccountDeletion, error) {
+	deletion := &AccountDeletion{UserID: userID}
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM attachments WHERE owner_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		attachments = append(attachments, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Webhook deliveries for the user carry their notification URL, and relays to other
+	// hubs their messages; both go whether still queued or already dead-lettered
+	for _, table := range []struct {
+		name  string
+		count *int64
+	}{
+		{"outbound_deliveries", &deletion.Deliveries},
+		{"dead_letters", &deletion.DeadLetters},
+	} {
+		result, err := tx.ExecContext(ctx,
+			"DELETE FROM "+table.name+" WHERE kind = ? AND target IN (SELECT notify_url FROM users WHERE id = ?)",
+			DeliveryKindWebhook, userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := result.RowsAffected()
+		relayed, err := deleteRelayedMessages(ctx, tx, table.name, userID)
+		if err != nil {
+			return nil, err
+		}
+		*table.count = n + relayed
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE sender_id = ? OR recipient_id = ?", userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	deletion.Messages, _ = result.RowsAffected()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM contacts WHERE user_id = ? OR contact_id = ?", userID, userID); err != nil {
+		return nil, err
+	}
+	for _, statement := range []string{
+		"DELETE FROM attachments WHERE owner_id = ?",
+		"DELETE FROM send_usage WHERE sender_id = ?",
+		"DELETE FROM message_stats WHERE sender_id = ?",
+		"DELETE FROM hub_logs WHERE user_id = ?",
+		"DELETE FROM devices WHERE user_id = ?",
+		"DELETE FROM provisioned_users WHERE id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, statement, userID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range attachments {
+		if err := os.Remove(s.attachmentPath(id)); err != nil && !os.IsNotExist(err) {
+			// cleanupOrphanFiles removes it later
+			s.logf(LogError, "", "Failed to delete attachment %s: %v", id, err)
+			continue
+		}
+		s.uploads.Delete(id)
+		deletion.Attachments++
+	}
+	s.logf(LogInfo, "", "An account was deleted by its owner with %d messages, %d attachments, %d queued deliveries and %d dead letters",
+		deletion.Messages, deletion.Attachments, deletion.Deliveries, deletion.DeadLetters)
+	// Like the log line, the audit entry does not keep the ID of an erased account
+	s.audit(WithAuditActor(ctx, "account owner"), "account.delete", "", map[string]interface{}{
+		"messages":     deletion.Messages,
+		"attachments":  deletion.Attachments,
+		"deliveries":   deletion.Deliveries,
+		"dead_letters": deletion.DeadLetters,
+	})
+	return deletion, nil
+}
+
+// deleteRelayedMessages removes from table (outbound_deliveries or dead_letters) the
+// relays to other hubs of messages userID sent. Their payloads are envelopes whose
+// sender is the user's federated address.
+func deleteRelayedMessages(ctx context.Context, tx StoreTx, table, userID string) (int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, payload FROM "+table+" WHERE kind = ?", DeliveryKindFederation)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var envelope crypto.Message
+		if json.Unmarshal(payload, &envelope) == nil && strings.HasPrefix(envelope.Sender, userID+"@") {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+// handleAccountExport returns everything the hub holds about the calling user,
+// signed with the account key
+func (s *Server) handleAccountExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.verifySignedRequest(ctx, r, "account-export", userID)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	export, err := s.exportAccount(ctx, userID, time.Now())
+	if err != nil {
+		s.logf(LogError, userID, "Failed to export account: %v", err)
+		dbError(w, ctx, "Failed to export account")
+		return
+	}
+	s.logf(LogInfo, userID, "Account exported")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// exportAccount gathers an AccountExport for userID
+func (s *Server) exportAccount(ctx context.Context, userID string, now time.Time) (*AccountExport, error) {
+	export := &AccountExport{ExportedAt: now}
+	user, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user: %v", err)
+	}
+	export.User = user
+
+	var updatedAt sql.NullInt64
+	var ssoSubject, quota, recoveryID sql.NullString
+	var recoveryKit []byte
+	err = s.db.QueryRowContext(ctx,
+		"SELECT updated_at, sso_subject, message_requests, send_quota, recovery_id, recovery_kit FROM users WHERE id = ?",
+		userID,
+	).Scan(&updatedAt, &ssoSubject, &export.MessageRequests, &quota, &recoveryID, &recoveryKit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user: %v", err)
+	}
+	if updatedAt.Valid {
+		t := time.Unix(updatedAt.Int64, 0)
+		export.UpdatedAt = &t
+	}
+	export.SSOSubject = ssoSubject.String
+	if quota.String != "" {
+		var q SendQuota
+		if json.Unmarshal([]byte(quota.String), &q) == nil {
+			export.SendQuota = &q
+		}
+	}
+	if recoveryID.String != "" {
+		export.RecoveryKit = &RecoveryKit{RecoveryID: recoveryID.String, Kit: recoveryKit, UserID: userID}
+	}
+	if export.Notifications, err = s.notificationSettings(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to read notification settings: %v", err)
+	}
+	if export.Receipts, err = s.receiptPolicy(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to read receipt policy: %v", err)
+	}
+	if export.SendUsage, err = s.sendUsage(ctx, userID, now); err != nil {
+		return nil, fmt.Errorf("failed to read send usage: %v", err)
+	}
+
+	var invite Invite
+	var createdAt, expiresAt int64
+	var claimedAt sql.NullInt64
+	err = s.db.QueryRowContext(ctx,
+		"SELECT id, display_name, email, created_at, expires_at, claimed_at FROM provisioned_users WHERE id = ?",
+		userID,
+	).Scan(&invite.UserID, &invite.DisplayName, &invite.Email, &createdAt, &expiresAt, &claimedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read invite: %v", err)
+	}
+	if err == nil {
+		invite.CreatedAt = time.Unix(createdAt, 0)
+		invite.ExpiresAt = time.Unix(expiresAt, 0)
+		if claimedAt.Valid {
+			t := time.Unix(claimedAt.Int64, 0)
+			invite.ClaimedAt = &t
+		}
+		export.Invite = &invite
+	}
+
+	if export.Devices, err = s.userDevices(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Messages, err = s.accountMessages(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Attachments, err = s.accountAttachments(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Contacts, err = s.accountContacts(ctx, "SELECT contact_id, since FROM contacts WHERE user_id = ? ORDER BY since", userID); err != nil {
+		return nil, err
+	}
+	if export.ContactOf, err = s.accountContacts(ctx, "SELECT user_id, since FROM contacts WHERE contact_id = ? ORDER BY since", userID); err != nil {
+		return nil, err
+	}
+	if export.DailyUsage, err = s.accountDailyUsage(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Logs, err = s.Logs(ctx, LogQuery{UserID: userID}); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// accountMessages returns the stored messages a user sent or received, oldest first
+func (s *Server) accountMessages(ctx context.Context, userID string) ([]crypto.Message, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, sender_id, recipient_id, content, created_at, read_at, expires_at
+		FROM messages WHERE sender_id = ? OR recipient_id = ?
+		ORDER BY created_at, id`,
+		userID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []crypto.Message{}
+	for rows.Next() {
+		var msg Message
+		var createdUnix, expiresUnix int64
+		var readUnix sql.NullInt64
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Content, &createdUnix, &readUnix, &expiresUnix); err != nil {
+			return nil, fmt.Errorf("failed to read message: %v", err)
+		}
+		msg.CreatedAt = time.Unix(createdUnix, 0)
+		msg.ExpiresAt = time.Unix(expiresUnix, 0)
+		if readUnix.Valid {
+			readTime := time.Unix(readUnix.Int64, 0)
+			msg.ReadAt = &readTime
+		}
+		messages = append(messages, msg.Envelope())
+	}
+	return messages, rows.Err()
+}
+
+// accountAttachments returns the uploads a user made
+func (s *Server) accountAttachments(ctx context.Context, userID string) ([]AttachmentStatus, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, size, received, completed_at IS NOT NULL FROM attachments WHERE owner_id = ? ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %v", err)
+	}
+	defer rows.Close()
+
+	attachments := []AttachmentStatus{}
+	for rows.Next() {
+		var a AttachmentStatus
+		if err := rows.Scan(&a.ID, &a.Size, &a.Received, &a.Complete); err != nil {
+			return nil, fmt.Errorf("failed to read attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// accountContacts runs a query selecting a user ID and since from contacts
+func (s *Server) accountContacts(ctx context.Context, query, userID string) ([]AccountContact, error) {
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query contacts: %v", err)
+	}
+	defer rows.Close()
+
+	contacts := []AccountContact{}
+	for rows.Next() {
+		var c AccountContact
+		var since int64
+		if err := rows.Scan(&c.UserID, &since); err != nil {
+			return nil, fmt.Errorf("failed to read contact: %v", err)
+		}
+		c.Since = time.Unix(since, 0)
+		contacts = append(contacts, c)
+	}
+	return contacts, rows.Err()
+}
+
+// accountDailyUsage returns the daily stats of what a user sent
+func (s *Server) accountDailyUsage(ctx context.Context, userID string) ([]DailyUsage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT day, messages, bytes FROM message_stats WHERE sender_id = ? ORDER BY day",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %v", err)
+	}
+	defer rows.Close()
+
+	usage := []DailyUsage{}
+	for rows.Next() {
+		var u DailyUsage
+		var day int64
+		if err := rows.Scan(&day, &u.Messages, &u.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to read usage: %v", err)
+		}
+		u.Day = time.Unix(day, 0).UTC()
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,332 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// adminTokenPrefix makes admin tokens recognisable in logs and secret scanners
+const adminTokenPrefix = "clsp_adm_"
+
+// hashAdminToken returns the hex SHA-256 of an admin token as stored in settings
+func hashAdminToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RotateAdminToken generates a new admin token for this hub (or tenant), replacing
+// any previous one. Only its hash is stored, so the token is returned exactly once.
+func (s *Server) RotateAdminToken(ctx context.Context) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate admin token: %v", err)
+	}
+	token := adminTokenPrefix + hex.EncodeToString(buf)
+
+	s.mu.RLock()
+	data, err := json.Marshal(s.config)
+	s.mu.RUnlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal hub configuration: %v", err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO settings (id, config, admin_token_hash) VALUES (1, ?, ?) ON CONFLICT(id) DO UPDATE SET admin_token_hash = excluded.admin_token_hash",
+		string(data), hashAdminToken(token),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store admin token: %v", err)
+	}
+	s.audit(ctx, "admin.token_rotate", "", nil)
+	return token, nil
+}
+
+// authorizeAdmin checks the request's bearer token against the stored admin token hash
+func (s *Server) authorizeAdmin(ctx context.Context, r *http.Request) bool {
+	token, err := bearerToken(r)
+	if err != nil {
+		return false
+	}
+
+	var stored sql.NullString
+	if err := s.db.QueryRowContext(ctx, "SELECT admin_token_hash FROM settings WHERE id = 1").Scan(&stored); err != nil {
+		return false
+	}
+	if !stored.Valid || stored.String == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashAdminToken(token)), []byte(stored.String)) == 1
+}
+
+// requireAdmin checks the admin token, answering 401 when it is missing or wrong
+func (s *Server) requireAdmin(w http.ResponseWriter, ctx context.Context, r *http.Request) bool {
+	if s.authorizeAdmin(ctx, r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="clsp-admin"`)
+	http.Error(w, "Admin token required", http.StatusUnauthorized)
+	return false
+}
+
+// handleAdminReport serves the capacity report to holders of the admin token
+func (s *Server) handleAdminReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	days, top := 30, 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && v > 0 {
+		days = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && v > 0 {
+		top = v
+	}
+
+	report, err := s.Report(ctx, days, top)
+	if err != nil {
+		dbError(w, ctx, "Failed to build report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// HubStats is a snapshot of a hub's accounts, stored data and delivery backlog
+type HubStats struct {
+	TotalUsers       int64 `json:"total_users"`
+	ActiveUsers      int64 `json:"active_users"`
+	OnlineUsers      int64 `json:"online_users"`
+	DeactivatedUsers int64 `json:"deactivated_users"`
+	BannedUsers      int64 `json:"banned_users"`
+	StoredMessages   int64 `json:"stored_messages"`
+	UnreadMessages   int64 `json:"unread_messages"`
+	// UndeliveredMessages are stored messages their recipient has not fetched yet
+	UndeliveredMessages int64 `json:"undelivered_messages"`
+	// QueuedDeliveries are webhook calls and federation relays waiting to be sent, and
+	// DeadLetters those that ran out of attempts
+	QueuedDeliveries int64 `json:"queued_deliveries"`
+	DeadLetters      int64 `json:"dead_letters"`
+	Attachments      int64 `json:"attachments"`
+	// StoredBytes counts message content and attachments, as the storage quota does
+	StoredBytes     int64 `json:"stored_bytes"`
+	MaxUsers        int   `json:"max_users"`
+	MaxStorageBytes int64 `json:"max_storage_bytes"`
+	// DatabaseBytes is the size of the database, -1 when it cannot be measured
+	DatabaseBytes int64     `json:"database_bytes"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// Stats counts the hub's accounts, stored data and pending deliveries
+func (s *Server) Stats(ctx context.Context) (*HubStats, error) {
+	cfg := s.Config()
+	stats := &HubStats{
+		MaxUsers:        cfg.MaxUsers,
+		MaxStorageBytes: cfg.MaxStorageBytes,
+		DatabaseBytes:   s.db.Size(ctx),
+		StartedAt:       s.startedAt.UTC(),
+		UptimeSeconds:   int64(time.Since(s.startedAt).Seconds()),
+	}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE deactivated_at IS NULL),
+			COUNT(*) FILTER (WHERE deactivated_at IS NULL AND online = 1),
+			COUNT(*) FILTER (WHERE deactivated_at IS NOT NULL AND banned_at IS NULL),
+			COUNT(*) FILTER (WHERE banned_at IS NOT NULL)
+		FROM users`,
+	).Scan(&stats.TotalUsers, &stats.ActiveUsers, &stats.OnlineUsers, &stats.DeactivatedUsers, &stats.BannedUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count users: %v", err)
+	}
+	err = s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COUNT(*) FILTER (WHERE read_at IS NULL), COUNT(*) FILTER (WHERE fetched_at IS NULL AND read_at IS NULL) FROM messages",
+	).Scan(&stats.StoredMessages, &stats.UnreadMessages, &stats.UndeliveredMessages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count messages: %v", err)
+	}
+	err = s.db.QueryRowContext(ctx,
+		"SELECT (SELECT COUNT(*) FROM outbound_deliveries), (SELECT COUNT(*) FROM dead_letters)",
+	).Scan(&stats.QueuedDeliveries, &stats.DeadLetters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count pending deliveries: %v", err)
+	}
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM attachments").Scan(&stats.Attachments); err != nil {
+		return nil, fmt.Errorf("failed to count attachments: %v", err)
+	}
+	if stats.StoredBytes, err = s.storedBytes(ctx); err != nil {
+		return nil, fmt.Errorf("failed to measure storage: %v", err)
+	}
+	return stats, nil
+}
+
+// PurgeResult reports how many messages an admin request deleted
+type PurgeResult struct {
+	Messages int64 `json:"messages"`
+}
+
+// handleAdminUsers lists accounts (GET, ?all=true to include deactivated and banned
+// ones) or deletes one immediately (DELETE ?user=<id or name>)
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		users, err := s.ListUsers(ctx, r.URL.Query().Get("all") == "true")
+		if err != nil {
+			dbError(w, ctx, "Failed to list users")
+			return
+		}
+		if users == nil {
+			users = []UserSummary{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	case http.MethodDelete:
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			http.Error(w, "User required", http.StatusBadRequest)
+			return
+		}
+		deleted, err := s.DeleteUser(ctx, user)
+		if errors.Is(err, errUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Failed to delete user")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PurgeResult{Messages: deleted})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminBans bans (POST ?user=&reason=) or unbans (DELETE ?user=) an account
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "User required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = s.BanUser(ctx, user, r.URL.Query().Get("reason"))
+	case http.MethodDelete:
+		err = s.UnbanUser(ctx, user)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errNotBanned):
+		http.Error(w, "User is not banned", http.StatusConflict)
+	case err != nil:
+		dbError(w, ctx, "Failed to update ban")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminMessages purges stored messages (DELETE with ?user=, ?before=<unix
+// time> or ?all=true)
+func (s *Server) handleAdminMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := MessagePurge{UserID: query.Get("user"), All: query.Get("all") == "true"}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before time", http.StatusBadRequest)
+			return
+		}
+		filter.Before = time.Unix(before, 0)
+	}
+	if filter.UserID == "" && filter.Before.IsZero() && !filter.All {
+		http.Error(w, "Give user, before or all=true", http.StatusBadRequest)
+		return
+	}
+
+	n, err := s.PurgeMessages(ctx, filter)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Failed to purge messages")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PurgeResult{Messages: n})
+}
+
+// handleAdminStats serves account, storage and delivery counts with the uptime
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		dbError(w, ctx, "Failed to count hub data")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
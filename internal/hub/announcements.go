@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Announcement represents a hub-signed service notice shown to clients
+type Announcement struct {
+	ID        string    `json:"id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Signature []byte    `json:"signature"`
+}
+
+// AnnouncementFeed is the response body of the /announcements endpoint
+type AnnouncementFeed struct {
+	HubPublicKey  string         `json:"hub_public_key"`
+	Announcements []Announcement `json:"announcements"`
+}
+
+// PostAnnouncement signs and stores a new announcement that stays visible for the given duration
+func (s *Server) PostAnnouncement(ctx context.Context, body string, validFor time.Duration) (*Announcement, error) {
+	now := time.Now()
+	ann := &Announcement{
+		ID:        uuid.New().String(),
+		Body:      body,
+		CreatedAt: time.Unix(now.Unix(), 0),
+		ExpiresAt: time.Unix(now.Add(validFor).Unix(), 0),
+	}
+
+	signature, err := crypto.SignData(s.hubKey, crypto.AnnouncementPayload(ann.ID, ann.Body, ann.CreatedAt.Unix(), ann.ExpiresAt.Unix()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign announcement: %v", err)
+	}
+	ann.Signature = signature
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO announcements (id, body, created_at, expires_at, signature) VALUES (?, ?, ?, ?, ?)",
+		ann.ID,
+		ann.Body,
+		ann.CreatedAt.Unix(),
+		ann.ExpiresAt.Unix(),
+		ann.Signature,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store announcement: %v", err)
+	}
+	s.audit(ctx, "announcement.post", ann.ID, map[string]interface{}{"body": ann.Body, "expires_at": ann.ExpiresAt.UTC()})
+
+	return ann, nil
+}
+
+// ListAnnouncements returns all announcements that have not yet expired, oldest first
+func (s *Server) ListAnnouncements(ctx context.Context) ([]Announcement, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, body, created_at, expires_at, signature FROM announcements WHERE expires_at > ? ORDER BY created_at ASC",
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query announcements: %v", err)
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		var ann Announcement
+		var createdUnix, expiresUnix int64
+		if err := rows.Scan(&ann.ID, &ann.Body, &createdUnix, &expiresUnix, &ann.Signature); err != nil {
+			return nil, fmt.Errorf("failed to scan announcement: %v", err)
+		}
+		ann.CreatedAt = time.Unix(createdUnix, 0)
+		ann.ExpiresAt = time.Unix(expiresUnix, 0)
+		announcements = append(announcements, ann)
+	}
+
+	return announcements, rows.Err()
+}
+
+// RemoveAnnouncement deletes an announcement by ID
+func (s *Server) RemoveAnnouncement(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM announcements WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete announcement: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("announcement not found: %s", id)
+	}
+	s.audit(ctx, "announcement.remove", id, nil)
+	return nil
+}
+
+// handleAnnouncements returns the active hub announcements together with the hub's public key
+func (s *Server) handleAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	announcements, err := s.ListAnnouncements(ctx)
+	if err != nil {
+		dbError(w, ctx, "Failed to query announcements")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnnouncementFeed{
+		HubPublicKey:  string(s.hubPublicKey),
+		Announcements: announcements,
+	})
+}
@@ -0,0 +1,464 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxAttachmentWrite bounds the body of a single upload request; clients send
+	// one chunk per request
+	maxAttachmentWrite = 64 << 20
+	// attachmentGrace is how long an unfinished upload, or a finished one no message
+	// refers to, is kept before cleanup deletes it
+	attachmentGrace = 24 * time.Hour
+)
+
+// AttachmentStatus reports the progress of an attachment upload
+type AttachmentStatus struct {
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	Received int64  `json:"received"`
+	Complete bool   `json:"complete"`
+}
+
+// attachmentDir is where uploaded attachment ciphertext is kept, in the data directory
+func (s *Server) attachmentDir() string {
+	return filepath.Join(s.dataDir, "attachments")
+}
+
+// attachmentPath returns the file holding an attachment. IDs are generated by the
+// hub and validated before use, so they are safe as file names.
+func (s *Server) attachmentPath(id string) string {
+	return filepath.Join(s.attachmentDir(), id)
+}
+
+// uploadLock serializes writes to one attachment
+func (s *Server) uploadLock(id string) *sync.Mutex {
+	lock, _ := s.uploads.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// storedBytes returns the volume of stored messages and attachments, for the quota
+func (s *Server) storedBytes(ctx context.Context) (int64, error) {
+	var stored int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT (SELECT COALESCE(SUM(LENGTH(content)), 0) FROM messages)
+			+ (SELECT COALESCE(SUM(size), 0) FROM attachments)`,
+	).Scan(&stored)
+	return stored, err
+}
+
+// handleAttachment stores and serves end-to-end encrypted attachments too large to
+// travel inside a message. POST reserves an upload of a given size, PUT appends to it
+// at the offset the hub has reached (so an interrupted upload resumes there), and GET
+// streams the ciphertext, honouring Range requests. The hub never sees the key.
+func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.handleAttachmentCreate(w, r)
+	case http.MethodPut:
+		s.handleAttachmentUpload(w, r)
+	case http.MethodGet, http.MethodHead:
+		s.handleAttachmentDownload(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAttachmentCreate reserves an attachment upload for the signing user
+func (s *Server) handleAttachmentCreate(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	var req struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Size <= 0 {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid attachment size", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	ok, err := s.verifySignedRequest(ctx, r, "attachment-create", userID, strconv.FormatInt(req.Size, 10))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := s.Config()
+	if cfg.MaxAttachmentSize > 0 && req.Size > cfg.MaxAttachmentSize {
+		s.logf(LogWarn, userID, "Attachment of %d bytes rejected (limit %d)", req.Size, cfg.MaxAttachmentSize)
+		writeSizeLimitError(w, LimitAttachmentSize, cfg.MaxAttachmentSize, req.Size,
+			"Attachment exceeds the hub limit of %d bytes", cfg.MaxAttachmentSize)
+		return
+	}
+	if cfg.MaxStorageBytes > 0 {
+		stored, err := s.storedBytes(ctx)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if stored+req.Size > cfg.MaxStorageBytes {
+			s.logf(LogError, userID, "Attachment rejected: storage quota of %d bytes reached", cfg.MaxStorageBytes)
+			http.Error(w, "Hub storage quota reached", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	id := uuid.New().String()
+	if err := os.MkdirAll(s.attachmentDir(), 0700); err != nil {
+		s.logf(LogError, userID, "Failed to create attachment directory: %v", err)
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.OpenFile(s.attachmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		s.logf(LogError, userID, "Failed to create attachment file: %v", err)
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO attachments (id, owner_id, size, received, created_at) VALUES (?, ?, ?, 0, ?)",
+		id, userID, req.Size, time.Now().Unix(),
+	)
+	if err != nil {
+		os.Remove(s.attachmentPath(id))
+		dbError(w, ctx, "Failed to store attachment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AttachmentStatus{ID: id, Size: req.Size})
+}
+
+// loadAttachment returns the upload status and owner of an attachment
+func (s *Server) loadAttachment(ctx context.Context, id string) (*AttachmentStatus, string, error) {
+	var status AttachmentStatus
+	var owner string
+	var completedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, owner_id, size, received, completed_at FROM attachments WHERE id = ?", id,
+	).Scan(&status.ID, &owner, &status.Size, &status.Received, &completedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	status.Complete = completedAt.Valid
+	return &status, owner, nil
+}
+
+// handleAttachmentUpload appends a chunk of ciphertext to an upload. The write
+// only counts once the whole request body has been stored.
+func (s *Server) handleAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	query := r.URL.Query()
+	id, userID := query.Get("id"), query.Get("user_id")
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if _, uuidErr := uuid.Parse(id); uuidErr != nil || err != nil || offset < 0 {
+		http.Error(w, "Attachment ID and offset required", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.verifySignedRequest(ctx, r, "attachment-upload", userID, id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	lock := s.uploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	status, owner, err := s.loadAttachment(ctx, id)
+	if err == sql.ErrNoRows || (err == nil && owner != userID) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if status.Complete || offset != status.Received {
+		// Tell the client where to resume
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	remaining := status.Size - status.Received
+	if remaining > maxAttachmentWrite {
+		remaining = maxAttachmentWrite
+	}
+	f, err := os.OpenFile(s.attachmentPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		s.logf(LogError, userID, "Failed to open attachment %s: %v", id, err)
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Stream the body to disk; on any failure drop the partial write so the
+	// stored size stays at a boundary the client wrote completely
+	written, err := io.Copy(io.NewOffsetWriter(f, offset), http.MaxBytesReader(w, r.Body, remaining))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(offset)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeSizeLimitError(w, LimitAttachmentSize, status.Size, 0, "Upload exceeds the reserved attachment size of %d bytes", status.Size)
+			return
+		}
+		s.logf(LogWarn, userID, "Upload of attachment %s interrupted at %d bytes: %v", id, offset, err)
+		http.Error(w, "Upload interrupted", http.StatusBadRequest)
+		return
+	}
+
+	// The body may have taken longer than the request timeout to arrive
+	ctx, cancel = s.requestContext(r)
+	defer cancel()
+
+	status.Received = offset + written
+	var completedAt interface{}
+	if status.Received == status.Size {
+		status.Complete = true
+		completedAt = time.Now().Unix()
+	}
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE attachments SET received = ?, completed_at = ? WHERE id = ?",
+		status.Received, completedAt, id,
+	)
+	if err != nil {
+		f.Truncate(offset)
+		dbError(w, ctx, "Failed to store attachment")
+		return
+	}
+	if status.Complete {
+		s.logf(LogDebug, userID, "Attachment %s uploaded (%d bytes)", id, status.Size)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleAttachmentStatus reports how much of an upload the hub holds, to its owner
+func (s *Server) handleAttachmentStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	id, userID := r.URL.Query().Get("id"), r.URL.Query().Get("user_id")
+	if id == "" {
+		http.Error(w, "Attachment ID required", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.verifySignedRequest(ctx, r, "attachment-status", userID, id)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	status, owner, err := s.loadAttachment(ctx, id)
+	if err == sql.ErrNoRows || (err == nil && owner != userID) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleAttachmentDownload streams a complete attachment to its uploader or to the
+// recipient of a message that refers to it
+func (s *Server) handleAttachmentDownload(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	id, userID := r.URL.Query().Get("id"), r.URL.Query().Get("user_id")
+	if _, err := uuid.Parse(id); err != nil {
+		http.Error(w, "Attachment ID required", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.verifySignedRequest(ctx, r, "attachment", userID, id)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var allowed bool
+	var createdAt int64
+	err = s.db.QueryRowContext(ctx, `
+		SELECT a.owner_id = ? OR EXISTS(SELECT 1 FROM messages m WHERE m.attachment_id = a.id AND m.recipient_id = ? AND m.request = 0),
+			a.created_at
+		FROM attachments a WHERE a.id = ? AND a.completed_at IS NOT NULL`,
+		userID, userID, id,
+	).Scan(&allowed, &createdAt)
+	if err == sql.ErrNoRows || (err == nil && !allowed) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+
+	f, err := os.Open(s.attachmentPath(id))
+	if err != nil {
+		s.logf(LogError, userID, "Failed to open attachment %s: %v", id, err)
+		http.Error(w, "Attachment unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Unix(createdAt, 0), f)
+}
+
+// checkMessageAttachment verifies that an uploaded attachment referenced by a message
+// is complete and was uploaded by the message's sender, and returns its size
+func (s *Server) checkMessageAttachment(ctx context.Context, id, senderID string) (bool, int64, error) {
+	status, owner, err := s.loadAttachment(ctx, id)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return status.Complete && owner == senderID, status.Size, nil
+}
+
+// cleanupAttachments deletes uploads abandoned before completion and attachments no
+// stored message refers to any more, once the grace period has passed, and returns
+// how many there were and the bytes they took up. With dryRun nothing is deleted.
+func (s *Server) cleanupAttachments(ctx context.Context, dryRun bool) (int, int64, error) {
+	cutoff := time.Now().Add(-attachmentGrace).Unix()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, received FROM attachments a
+		WHERE (a.completed_at IS NULL AND a.created_at <= ?)
+			OR (a.completed_at <= ? AND NOT EXISTS(SELECT 1 FROM messages m WHERE m.attachment_id = a.id))`,
+		cutoff, cutoff,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []string
+	var total int64
+	for rows.Next() {
+		var id string
+		var received int64
+		if err := rows.Scan(&id, &received); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		total += received
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		return len(ids), total, nil
+	}
+
+	for _, id := range ids {
+		if err := os.Remove(s.attachmentPath(id)); err != nil && !os.IsNotExist(err) {
+			s.logf(LogError, "", "Failed to delete attachment %s: %v", id, err)
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM attachments WHERE id = ?", id); err != nil {
+			return 0, 0, err
+		}
+		s.uploads.Delete(id)
+	}
+	if len(ids) > 0 {
+		s.logf(LogInfo, "", "Deleted %d unused attachments", len(ids))
+	}
+	return len(ids), total, nil
+}
+
+// cleanupOrphanFiles deletes files in the attachment directory that no upload
+// refers to, such as those left by a deleted record or a restored database backup,
+// once they are older than the grace period. It returns how many there were and
+// their bytes; with dryRun nothing is deleted.
+func (s *Server) cleanupOrphanFiles(ctx context.Context, dryRun bool) (int, int64, error) {
+	entries, err := os.ReadDir(s.attachmentDir())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := time.Now().Add(-attachmentGrace)
+	count, total := 0, int64(0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM attachments WHERE id = ?)", entry.Name()).Scan(&exists); err != nil {
+			return count, total, err
+		}
+		if exists {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(s.attachmentDir(), entry.Name())); err != nil && !os.IsNotExist(err) {
+				s.logf(LogError, "", "Failed to delete orphaned attachment file %s: %v", entry.Name(), err)
+				continue
+			}
+		}
+		count++
+		total += info.Size()
+	}
+	if count > 0 && !dryRun {
+		s.logf(LogInfo, "", "Deleted %d orphaned attachment files", count)
+	}
+	return count, total, nil
+}
@@ -0,0 +1,288 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ActorHub is the audit actor of actions the hub takes by itself
+const ActorHub = "hub"
+
+// AuditEntry is one record of an admin or destructive action
+type AuditEntry struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Actor is who acted: "admin <ip>" for holders of the admin token, "user <id>"
+	// for signed requests, "cli <account>" for clsp-hub commands run on the host
+	Actor string `json:"actor"`
+	// Action names what was done, as <category>.<verb>, such as user.ban
+	Action string `json:"action"`
+	// Target is what was acted on, such as a user ID; empty when the action is hub-wide
+	Target  string                 `json:"target,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditQuery selects audit entries
+type AuditQuery struct {
+	// Since drops entries older than this time (zero includes all)
+	Since time.Time
+	// Action keeps entries with this action, or of this category when it has no dot
+	Action string
+	// Actor and Target keep only entries with exactly this actor or target
+	Actor  string
+	Target string
+	// Limit caps the number of entries, keeping the newest (zero means no cap)
+	Limit int
+}
+
+// createAuditLog creates the audit log table and keeps it append-only: the database
+// refuses to change or delete its rows
+func createAuditLog(db Store) error {
+	statements := []string{`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT ''
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time)",
+	}
+	if db.Driver() == DriverPostgres {
+		statements = append(statements,
+			`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'the audit log is append-only';
+			END
+			$$ LANGUAGE plpgsql`,
+			"DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log",
+			"CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()",
+		)
+	} else {
+		statements = append(statements,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log BEGIN
+				SELECT RAISE(ABORT, 'the audit log is append-only');
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log BEGIN
+				SELECT RAISE(ABORT, 'the audit log is append-only');
+			END`,
+		)
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create audit log: %v", err)
+		}
+	}
+	return nil
+}
+
+// auditActorKey carries the audit actor in a context
+type auditActorKey struct{}
+
+// WithAuditActor returns a context under which the hub records actions as made by actor
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// auditActor returns the actor recorded for actions under ctx, the hub itself when
+// none was set
+func auditActor(ctx context.Context) string {
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return ActorHub
+}
+
+// requestActor names who made r: the admin for requests with a bearer token, which
+// are only acted on once the token checks out, or the user a request is signed by
+func requestActor(r *http.Request) string {
+	if _, err := bearerToken(r); err == nil {
+		return "admin " + remoteIP(r)
+	}
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		return "user " + userID
+	}
+	return "anonymous " + remoteIP(r)
+}
+
+// RecordAudit appends an entry to the audit log for action on target by the actor of ctx
+func (s *Server) RecordAudit(ctx context.Context, action, target string, details map[string]interface{}) error {
+	data := ""
+	if len(details) > 0 {
+		b, err := json.Marshal(details)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit details: %v", err)
+		}
+		data = string(b)
+	}
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO audit_log (time, actor, action, target, details) VALUES (?, ?, ?, ?, ?)",
+		time.Now().UnixNano(), auditActor(ctx), action, target, data,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
+	}
+	return nil
+}
+
+// audit records an action that has already been carried out, so a failure to record
+// it is logged rather than returned
+func (s *Server) audit(ctx context.Context, action, target string, details map[string]interface{}) {
+	if err := s.RecordAudit(ctx, action, target, details); err != nil {
+		slog.Error("Failed to record audit entry", "action", action, "error", err)
+	}
+}
+
+// configChanges compares two serialized hub configurations and returns each setting
+// that differs with its old and new value
+func configChanges(before, after []byte) map[string]interface{} {
+	var old, current map[string]interface{}
+	json.Unmarshal(before, &old)
+	json.Unmarshal(after, &current)
+
+	keys := make(map[string]bool)
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range current {
+		keys[k] = true
+	}
+	changes := make(map[string]interface{})
+	for k := range keys {
+		if !reflect.DeepEqual(old[k], current[k]) {
+			changes[k] = map[string]interface{}{"from": old[k], "to": current[k]}
+		}
+	}
+	return changes
+}
+
+// AuditLog returns audit entries matching q, oldest first
+func (s *Server) AuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	query := "SELECT id, time, actor, action, target, details FROM audit_log WHERE 1 = 1"
+	var args []interface{}
+
+	if !q.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, q.Since.UnixNano())
+	}
+	if q.Action != "" {
+		query += " AND (action = ? OR action LIKE ?)"
+		args = append(args, q.Action, q.Action+".%")
+	}
+	if q.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, q.Actor)
+	}
+	if q.Target != "" {
+		query += " AND target = ?"
+		args = append(args, q.Target)
+	}
+	query += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var nanos int64
+		var details string
+		if err := rows.Scan(&e.ID, &nanos, &e.Actor, &e.Action, &e.Target, &details); err != nil {
+			return nil, fmt.Errorf("failed to read audit entry: %v", err)
+		}
+		e.Time = time.Unix(0, nanos)
+		if details != "" {
+			if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+				return nil, fmt.Errorf("failed to parse details of audit entry %d: %v", e.ID, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	// Newest entries were selected; present them in chronological order
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// handleAdminAudit serves the audit log as a JSON array, or as JSON Lines with
+// ?format=jsonl for export. ?since=<unix time>, ?action=, ?actor=, ?target= and
+// ?limit= narrow it down.
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	q := AuditQuery{Action: params.Get("action"), Actor: params.Get("actor"), Target: params.Get("target")}
+	if v := params.Get("since"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since time", http.StatusBadRequest)
+			return
+		}
+		q.Since = time.Unix(since, 0)
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "jsonl" {
+		http.Error(w, "Format must be json or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := s.AuditLog(ctx, q)
+	if err != nil {
+		dbError(w, ctx, "Failed to read audit log")
+		return
+	}
+
+	if format == "jsonl" {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(b.Bytes())
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// A closed deployment can require every client to present a certificate issued by
+// its own client CA (TLSOptions.ClientCAFile) before any request is served. The CA
+// and the certificates handed to users are created with 'clsp-hub admin issue-cert'.
+
+// Client CA files created in the hub's data directory unless others are named
+const (
+	ClientCACertFile = "client-ca.pem"
+	ClientCAKeyFile  = "client-ca-key.pem"
+)
+
+// clientCAValidity is how long a client CA created by the hub is valid
+const clientCAValidity = 10 * 365 * 24 * time.Hour
+
+// DefaultClientCertValidity is how long an issued client certificate is valid
+const DefaultClientCertValidity = 365 * 24 * time.Hour
+
+// ClientCAPaths returns the default client CA certificate and key paths in dataDir
+func ClientCAPaths(dataDir string) (certPath, keyPath string) {
+	return filepath.Join(dataDir, ClientCACertFile), filepath.Join(dataDir, ClientCAKeyFile)
+}
+
+// requireClientCerts makes config demand a client certificate signed by a CA in
+// opts.ClientCAFile. TLS-ALPN-01 challenges are exempt, as the ACME server presents
+// no certificate; like autocert, a hello is only taken for one when acme-tls/1 is the
+// sole protocol offered, so a client cannot slip past by listing it among others.
+func requireClientCerts(config *tls.Config, opts TLSOptions) error {
+	if opts.ClientCAFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(opts.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates in %s", opts.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(opts.ACMEDomains) > 0 {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+				return nil, nil
+			}
+			challenge := config.Clone()
+			challenge.ClientAuth = tls.NoClientCert
+			challenge.NextProtos = []string{acme.ALPNProto}
+			challenge.GetConfigForClient = nil
+			return challenge, nil
+		}
+	}
+	return nil
+}
+
+// CreateClientCA creates a client CA named name, saving its certificate and key to
+// certPath and keyPath. Existing files are never overwritten.
+func CreateClientCA(certPath, keyPath, name string) error {
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %v", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(clientCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to save CA key: %v", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to save CA certificate: %v", err)
+	}
+	return nil
+}
+
+// IssueClientCert issues a client certificate for commonName (usually the user's
+// name) signed by the CA in caCertPath and caKeyPath, valid for validity. It returns
+// the PEM certificate and private key.
+func IssueClientCert(caCertPath, caKeyPath, commonName string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	ca, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load client CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse client CA: %v", err)
+	}
+	if !caCert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", caCertPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyPEM, err = encodeECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// newSerialNumber returns a random certificate serial number
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+// encodeECKey encodes an ECDSA private key as PEM
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
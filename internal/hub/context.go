@@ -0,0 +1,41 @@
+package hub
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// cleanupTimeout bounds each background maintenance statement
+const cleanupTimeout = 1 * time.Minute
+
+// Database maintenance (Store.Optimize) runs once a day and may take a while on a
+// large database, since VACUUM rewrites it
+const (
+	optimizeInterval = 24 * time.Hour
+	optimizeTimeout  = 30 * time.Minute
+)
+
+// requestContext derives a context for handling r whose deadline is the hub timeout.
+// The context is also cancelled when the client disconnects, and records actions
+// taken under it as made by whoever made r.
+func (s *Server) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	s.mu.RLock()
+	timeout := s.config.HubTimeout
+	s.mu.RUnlock()
+
+	ctx := WithAuditActor(r.Context(), requestActor(r))
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// dbError reports a failed database call, distinguishing requests that ran out of time
+func dbError(w http.ResponseWriter, ctx context.Context, message string) {
+	if ctx.Err() == context.DeadlineExceeded {
+		http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
@@ -0,0 +1,406 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// deliveryInterval is how often the scheduler looks for due outbound deliveries
+	deliveryInterval = 15 * time.Second
+	// deliveryBatch caps the deliveries attempted per scheduler pass
+	deliveryBatch = 50
+	// deliveryAttemptTimeout bounds a single delivery attempt
+	deliveryAttemptTimeout = 30 * time.Second
+	// deliveryBaseBackoff is the wait after the first failed attempt; it doubles with each retry
+	deliveryBaseBackoff = 30 * time.Second
+	// deliveryMaxBackoff caps the wait between attempts
+	deliveryMaxBackoff = 1 * time.Hour
+	// deliveryMaxAttempts is the number of attempts before a delivery is dead-lettered
+	deliveryMaxAttempts = 10
+)
+
+// DeliveryKindWebhook POSTs the payload as JSON to the target URL
+const DeliveryKindWebhook = "webhook"
+
+// Deliverer sends one outbound payload to a remote target. Errors are retried with
+// backoff unless wrapped with PermanentDeliveryError.
+type Deliverer func(ctx context.Context, target string, payload []byte) error
+
+// permanentDeliveryError marks a failure that retrying cannot fix
+type permanentDeliveryError struct {
+	err error
+}
+
+func (e *permanentDeliveryError) Error() string { return e.err.Error() }
+func (e *permanentDeliveryError) Unwrap() error { return e.err }
+
+// PermanentDeliveryError wraps err so the delivery is dead-lettered without further retries
+func PermanentDeliveryError(err error) error {
+	return &permanentDeliveryError{err: err}
+}
+
+// errDeadLetterNotFound is returned when a dead letter ID does not exist
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is an outbound delivery that failed permanently or ran out of attempts
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Target      string    `json:"target"`
+	PayloadSize int       `json:"payload_size"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	CreatedAt   time.Time `json:"created_at"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+// DeliveryQueue summarizes the outbound queue for the admin API
+type DeliveryQueue struct {
+	Pending     int          `json:"pending"`
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// RegisterDeliverer installs the sender for a delivery kind
+func (s *Server) RegisterDeliverer(kind string, d Deliverer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deliverers == nil {
+		s.deliverers = make(map[string]Deliverer)
+	}
+	s.deliverers[kind] = d
+}
+
+// deliverer returns the sender registered for kind
+func (s *Server) deliverer(kind string) (Deliverer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.deliverers[kind]
+	return d, ok
+}
+
+// EnqueueDelivery queues a payload for delivery to a remote target; the first
+// attempt happens on the scheduler's next pass
+func (s *Server) EnqueueDelivery(ctx context.Context, kind, target string, payload []byte) (string, error) {
+	if _, ok := s.deliverer(kind); !ok {
+		return "", fmt.Errorf("unknown delivery kind: %s", kind)
+	}
+	id := uuid.New().String()
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO outbound_deliveries (id, kind, target, payload, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, kind, target, payload, now, now,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to queue delivery: %v", err)
+	}
+	return id, nil
+}
+
+// deliveryBackoff returns the wait before the next attempt after attempts failures
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := deliveryBaseBackoff
+	for i := 1; i < attempts && backoff < deliveryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > deliveryMaxBackoff {
+		backoff = deliveryMaxBackoff
+	}
+	return backoff
+}
+
+// deliveryLoop periodically attempts due outbound deliveries
+func (s *Server) deliveryLoop() {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.processDeliveries()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// pendingDelivery is a queued delivery loaded for an attempt
+type pendingDelivery struct {
+	id        string
+	kind      string
+	target    string
+	payload   []byte
+	attempts  int
+	createdAt int64
+	// nextAttemptAt is the time the attempt was due, as loaded
+	nextAttemptAt int64
+}
+
+// processDeliveries runs one scheduler pass over the deliveries that are due
+func (s *Server) processDeliveries() {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, kind, target, payload, attempts, created_at, next_attempt_at FROM outbound_deliveries WHERE next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?",
+		time.Now().Unix(), deliveryBatch,
+	)
+	if err != nil {
+		s.logf(LogError, "", "Failed to load outbound deliveries: %v", err)
+		return
+	}
+	var due []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.kind, &d.target, &d.payload, &d.attempts, &d.createdAt, &d.nextAttemptAt); err != nil {
+			rows.Close()
+			s.logf(LogError, "", "Failed to read outbound delivery: %v", err)
+			return
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if !s.claimDelivery(ctx, d) {
+			continue
+		}
+		s.attemptDelivery(ctx, d)
+	}
+}
+
+// claimDelivery reserves a due delivery for this process by moving its next attempt
+// past the attempt's timeout. Hub replicas sharing a database each run the queue;
+// only the one whose claim lands makes the attempt, and a claim left by a replica
+// that stopped midway runs out on its own.
+func (s *Server) claimDelivery(ctx context.Context, d pendingDelivery) bool {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE outbound_deliveries SET next_attempt_at = ? WHERE id = ? AND next_attempt_at = ?",
+		time.Now().Add(2*deliveryAttemptTimeout).Unix(), d.id, d.nextAttemptAt,
+	)
+	if err != nil {
+		s.logf(LogError, "", "Failed to claim delivery %s: %v", d.id, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+// attemptDelivery tries one delivery and reschedules or dead-letters it on failure
+func (s *Server) attemptDelivery(ctx context.Context, d pendingDelivery) {
+	var err error
+	deliver, ok := s.deliverer(d.kind)
+	if !ok {
+		err = PermanentDeliveryError(fmt.Errorf("no deliverer for kind %s", d.kind))
+	} else {
+		attemptCtx, cancel := context.WithTimeout(ctx, deliveryAttemptTimeout)
+		err = deliver(attemptCtx, d.target, d.payload)
+		cancel()
+	}
+
+	if err == nil {
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM outbound_deliveries WHERE id = ?", d.id); err != nil {
+			s.logf(LogError, "", "Failed to remove delivered %s: %v", d.id, err)
+		}
+		return
+	}
+
+	d.attempts++
+	var permanent *permanentDeliveryError
+	if errors.As(err, &permanent) || d.attempts >= deliveryMaxAttempts {
+		if d.kind == DeliveryKindFederation {
+			s.event(LogWarn, EventFederationFailure, "", "Relay %s to hub %s dead-lettered after %d attempt(s): %v", d.id, d.target, d.attempts, err)
+		} else {
+			s.logf(LogWarn, "", "Delivery %s to %s dead-lettered after %d attempt(s): %v", d.id, d.target, d.attempts, err)
+		}
+		if err := s.deadLetter(ctx, d, err.Error()); err != nil {
+			s.logf(LogError, "", "Failed to dead-letter delivery %s: %v", d.id, err)
+		}
+		return
+	}
+
+	if d.kind == DeliveryKindFederation {
+		s.event(LogWarn, EventFederationFailure, "", "Relay %s to hub %s failed (attempt %d, will retry): %v", d.id, d.target, d.attempts, err)
+	}
+	_, dbErr := s.db.ExecContext(ctx,
+		"UPDATE outbound_deliveries SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		d.attempts, time.Now().Add(deliveryBackoff(d.attempts)).Unix(), err.Error(), d.id,
+	)
+	if dbErr != nil {
+		s.logf(LogError, "", "Failed to reschedule delivery %s: %v", d.id, dbErr)
+	}
+}
+
+// deadLetter moves a delivery from the queue to the dead-letter table
+func (s *Server) deadLetter(ctx context.Context, d pendingDelivery, lastError string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO dead_letters (id, kind, target, payload, attempts, last_error, created_at, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		d.id, d.kind, d.target, d.payload, d.attempts, lastError, d.createdAt, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM outbound_deliveries WHERE id = ?", d.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeliveryQueue returns the number of pending deliveries and the dead letters, newest first
+func (s *Server) DeliveryQueue(ctx context.Context) (*DeliveryQueue, error) {
+	queue := &DeliveryQueue{DeadLetters: []DeadLetter{}}
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM outbound_deliveries").Scan(&queue.Pending); err != nil {
+		return nil, fmt.Errorf("failed to count pending deliveries: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, kind, target, LENGTH(payload), attempts, last_error, created_at, failed_at FROM dead_letters ORDER BY failed_at DESC",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dl DeadLetter
+		var createdUnix, failedUnix int64
+		if err := rows.Scan(&dl.ID, &dl.Kind, &dl.Target, &dl.PayloadSize, &dl.Attempts, &dl.LastError, &createdUnix, &failedUnix); err != nil {
+			return nil, fmt.Errorf("failed to read dead letter: %v", err)
+		}
+		dl.CreatedAt = time.Unix(createdUnix, 0)
+		dl.FailedAt = time.Unix(failedUnix, 0)
+		queue.DeadLetters = append(queue.DeadLetters, dl)
+	}
+	return queue, rows.Err()
+}
+
+// RetryDeadLetter puts a dead letter back on the queue with a fresh attempt budget
+func (s *Server) RetryDeadLetter(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO outbound_deliveries (id, kind, target, payload, next_attempt_at, last_error, created_at)
+		SELECT id, kind, target, payload, CAST(? AS BIGINT), last_error, created_at FROM dead_letters WHERE id = ?`,
+		time.Now().Unix(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to requeue dead letter: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errDeadLetterNotFound
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to requeue dead letter: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.audit(ctx, "deadletter.retry", id, nil)
+	return nil
+}
+
+// DropDeadLetter discards a dead letter
+func (s *Server) DropDeadLetter(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to drop dead letter: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errDeadLetterNotFound
+	}
+	s.audit(ctx, "deadletter.drop", id, nil)
+	return nil
+}
+
+// deliverWebhook POSTs a JSON payload; client errors other than timeouts and rate
+// limiting will not succeed on retry and are treated as permanent
+func deliverWebhook(ctx context.Context, target string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return PermanentDeliveryError(fmt.Errorf("invalid webhook target: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return PermanentDeliveryError(fmt.Errorf("webhook returned %s", resp.Status))
+	default:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// handleAdminDeadLetters lists (GET), requeues (POST) or drops (DELETE ?id=) dead letters
+func (s *Server) handleAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		queue, err := s.DeliveryQueue(ctx)
+		if err != nil {
+			dbError(w, ctx, "Failed to list dead letters")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queue)
+	case http.MethodPost, http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Dead letter ID required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.Method == http.MethodPost {
+			err = s.RetryDeadLetter(ctx, id)
+		} else {
+			err = s.DropDeadLetter(ctx, id)
+		}
+		if errors.Is(err, errDeadLetterNotFound) {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Failed to update dead letter")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,186 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"unicode"
+)
+
+// Devices are the client installations that use an identity. Every device restored
+// from an identity holds the same keys, so the hub cannot tell them apart by key;
+// instead each one announces itself with an ID it chose and a name, and the hub keeps
+// when it was first and last seen.
+
+// maxDevices bounds the devices kept per user; the one seen longest ago goes first
+const maxDevices = 20
+
+// maxDeviceName bounds a device's name, and maxDeviceID its ID
+const (
+	maxDeviceName = 64
+	maxDeviceID   = 64
+)
+
+// Device is a client installation of a user's identity
+type Device struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// createDevices creates the table of the devices users announced
+func createDevices(db Store) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS devices (
+			user_id TEXT NOT NULL,
+			id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			first_seen INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL,
+			PRIMARY KEY (user_id, id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create devices table: %v", err)
+	}
+	return nil
+}
+
+// validDevice reports whether d has an ID and name a device may announce
+func validDevice(d Device) bool {
+	if d.ID == "" || len(d.ID) > maxDeviceID || d.Name == "" || len(d.Name) > maxDeviceName {
+		return false
+	}
+	for _, c := range d.ID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	for _, c := range d.Name {
+		if !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleDevices lists the calling user's devices (GET), or records that one of them
+// is in use (POST), signed over the method and the SHA-256 of the body. Both answer
+// with the devices, most recently seen first.
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "devices", userID, r.Method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var device Device
+		if err := json.Unmarshal(body, &device); err != nil || !validDevice(device) {
+			http.Error(w, "Invalid device", http.StatusBadRequest)
+			return
+		}
+		if err := s.recordDevice(ctx, userID, device, time.Now()); err != nil {
+			dbError(w, ctx, "Failed to record device")
+			return
+		}
+	}
+
+	devices, err := s.userDevices(ctx, userID)
+	if err != nil {
+		dbError(w, ctx, "Failed to list devices")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// recordDevice stores that a user's device is in use, keeping the name it gave last,
+// and forgets the devices seen longest ago beyond maxDevices
+func (s *Server) recordDevice(ctx context.Context, userID string, device Device, now time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE devices SET name = ?, last_seen = ? WHERE user_id = ? AND id = ?",
+		device.Name, now.Unix(), userID, device.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO devices (user_id, id, name, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)",
+			userID, device.ID, device.Name, now.Unix(), now.Unix(),
+		); err != nil {
+			return err
+		}
+		s.logf(LogInfo, userID, "New device %s announced", device.ID)
+	}
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM devices WHERE user_id = ? AND id NOT IN (SELECT id FROM devices WHERE user_id = ? ORDER BY last_seen DESC, id LIMIT ?)",
+		userID, userID, maxDevices,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// userDevices returns a user's devices, most recently seen first
+func (s *Server) userDevices(ctx context.Context, userID string) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, name, first_seen, last_seen FROM devices WHERE user_id = ? ORDER BY last_seen DESC, id",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&d.ID, &d.Name, &firstSeen, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to read device: %v", err)
+		}
+		d.FirstSeen = time.Unix(firstSeen, 0)
+		d.LastSeen = time.Unix(lastSeen, 0)
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
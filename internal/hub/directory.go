@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+const (
+	// directorySnapshotInterval is how long a directory snapshot is served before it
+	// is rebuilt, so new users and key changes appear within this period
+	directorySnapshotInterval = 15 * time.Minute
+	// directorySnapshotValidity is how long clients may rely on a snapshot offline
+	directorySnapshotValidity = 7 * 24 * time.Hour
+)
+
+// DirectorySnapshot is the hub-signed list of active users and their keys, which
+// clients cache to resolve recipients and look up keys while offline
+type DirectorySnapshot struct {
+	HubPublicKey string                  `json:"hub_public_key"`
+	GeneratedAt  time.Time               `json:"generated_at"`
+	ExpiresAt    time.Time               `json:"expires_at"`
+	Users        []crypto.DirectoryEntry `json:"users"`
+	Signature    []byte                  `json:"signature"`
+}
+
+// DirectorySnapshot returns the current signed directory snapshot, building a new one
+// when the last is older than directorySnapshotInterval
+func (s *Server) DirectorySnapshot(ctx context.Context) (*DirectorySnapshot, error) {
+	s.directoryMu.Lock()
+	defer s.directoryMu.Unlock()
+	if s.directory != nil && time.Since(s.directory.GeneratedAt) < directorySnapshotInterval {
+		return s.directory, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, display_name, public_key, signing_key, signing_key_sig FROM users WHERE deactivated_at IS NULL ORDER BY id",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []crypto.DirectoryEntry{}
+	for rows.Next() {
+		var u crypto.DirectoryEntry
+		var signingKey sql.NullString
+		if err := rows.Scan(&u.ID, &u.DisplayName, &u.PublicKey, &signingKey, &u.SigningKeySig); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		u.SigningKey = signingKey.String
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	snapshot := &DirectorySnapshot{
+		HubPublicKey: string(s.hubPublicKey),
+		GeneratedAt:  now,
+		ExpiresAt:    now.Add(directorySnapshotValidity),
+		Users:        users,
+	}
+	snapshot.Signature, err = crypto.SignData(s.hubKey, crypto.DirectoryPayload(now.Unix(), snapshot.ExpiresAt.Unix(), users))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign directory: %v", err)
+	}
+	s.directory = snapshot
+	return snapshot, nil
+}
+
+// handleDirectory serves the signed directory snapshot
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	snapshot, err := s.DirectorySnapshot(ctx)
+	if err != nil {
+		s.logf(LogError, "", "Failed to build directory snapshot: %v", err)
+		dbError(w, ctx, "Failed to build directory")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", snapshot.GeneratedAt.UTC().Format(http.TimeFormat))
+	json.NewEncoder(w).Encode(snapshot)
+}
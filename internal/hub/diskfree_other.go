@@ -0,0 +1,10 @@
+//go:build !unix
+
+package hub
+
+import "errors"
+
+// diskFree is not implemented on this platform; the report omits the projection
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space not available on this platform")
+}
@@ -0,0 +1,57 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// SetEscrowKey publishes pemKey as the organizational recovery key that clients whose
+// users agreed to escrow also wrap message keys to; an empty key turns escrow off.
+// Clients never escrow without their user's consent, whatever the hub publishes.
+func (s *Server) SetEscrowKey(pemKey string) error {
+	if pemKey != "" {
+		if _, err := crypto.LoadPublicKeyFromPEM([]byte(pemKey)); err != nil {
+			return fmt.Errorf("invalid escrow key: %v", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.EscrowKey = pemKey
+	return nil
+}
+
+// EscrowedMessage returns a stored message for recovery with the escrow private key,
+// failing if its sender did not escrow it
+func (s *Server) EscrowedMessage(ctx context.Context, id string) (*crypto.Message, error) {
+	var msg Message
+	var createdUnix, expiresUnix int64
+	var readUnix sql.NullInt64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, sender_id, recipient_id, content, created_at, read_at, expires_at FROM messages WHERE id = ?",
+		id,
+	).Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Content, &createdUnix, &readUnix, &expiresUnix)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("message %s not found (it may have expired)", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	msg.CreatedAt = time.Unix(createdUnix, 0)
+	msg.ExpiresAt = time.Unix(expiresUnix, 0)
+	if readUnix.Valid {
+		readTime := time.Unix(readUnix.Int64, 0)
+		msg.ReadAt = &readTime
+	}
+
+	envelope := msg.Envelope()
+	if len(envelope.EscrowedKey) == 0 {
+		return nil, fmt.Errorf("message %s was not escrowed by its sender", id)
+	}
+	s.logf(LogWarn, msg.SenderID, "Escrowed message %s opened for recovery", id)
+	s.audit(ctx, "escrow.recover", id, map[string]interface{}{"sender_id": msg.SenderID, "recipient_id": msg.RecipientID})
+	return &envelope, nil
+}
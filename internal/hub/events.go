@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of operational events streamed at /admin/events
+const (
+	EventRegistration      = "registration"       // an account registered, or was refused
+	EventBan               = "ban"                // an account was banned or unbanned
+	EventRateLimit         = "rate_limit"         // a sender ran into their outbound quota
+	EventFederationFailure = "federation_failure" // a relay to or from another hub failed
+)
+
+const (
+	// eventBacklog is how many recent events a new subscriber can replay
+	eventBacklog = 256
+	// eventSubscriberBuffer is how many events a slow subscriber may fall behind
+	// before it misses some
+	eventSubscriberBuffer = 64
+	// eventKeepAlive is how often an idle stream gets a comment line, so proxies keep
+	// the connection open
+	eventKeepAlive = 30 * time.Second
+)
+
+// Event is an operational event, kept in memory for admins watching the hub live.
+// Events are also written to the hub log.
+type Event struct {
+	// ID increases with each event since the hub started
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Level   string    `json:"level"`
+	UserID  string    `json:"user_id,omitempty"`
+	Message string    `json:"message"`
+}
+
+// eventBroker fans events out to subscribed streams and keeps the latest for replay.
+// Its zero value is ready to use.
+type eventBroker struct {
+	mu      sync.Mutex
+	lastID  int64
+	backlog []Event
+	subs    map[chan Event]struct{}
+}
+
+// publish records e and passes it to every subscriber that keeps up
+func (b *eventBroker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	b.backlog = append(b.backlog, e)
+	if len(b.backlog) > eventBacklog {
+		b.backlog = b.backlog[len(b.backlog)-eventBacklog:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns the kept events newer than afterID and a channel of later ones
+func (b *eventBroker) subscribe(afterID int64) ([]Event, chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var replay []Event
+	for _, e := range b.backlog {
+		if e.ID > afterID {
+			replay = append(replay, e)
+		}
+	}
+	ch := make(chan Event, eventSubscriberBuffer)
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	return replay, ch
+}
+
+// unsubscribe stops passing events to ch
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// event logs an operational event like logf and streams it to watching admins
+func (s *Server) event(level, kind, userID, format string, args ...interface{}) {
+	s.logf(level, userID, format, args...)
+	s.events.publish(Event{
+		Time:    time.Now(),
+		Kind:    kind,
+		Level:   level,
+		UserID:  userID,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// handleAdminEvents streams operational events as server-sent events, starting with
+// the kept ones newer than the Last-Event-ID header or ?since=<id>. With ?follow=false
+// the stream ends after those; ?kind= (comma-separated) selects kinds.
+func (s *Server) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	authorized := s.requireAdmin(w, ctx, r)
+	cancel()
+	if !authorized {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	since := r.Header.Get("Last-Event-ID")
+	if v := query.Get("since"); v != "" {
+		since = v
+	}
+	var afterID int64
+	if since != "" {
+		n, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid event ID", http.StatusBadRequest)
+			return
+		}
+		afterID = n
+	}
+	kinds := make(map[string]bool)
+	for _, k := range strings.Split(query.Get("kind"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			kinds[k] = true
+		}
+	}
+
+	replay, ch := s.events.subscribe(afterID)
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) error {
+		if len(kinds) > 0 && !kinds[e.Kind] {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Kind, data)
+		return err
+	}
+	for _, e := range replay {
+		if send(e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	if query.Get("follow") == "false" {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if send(e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.stopChan:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,845 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Federation lets users of different hubs write to each other. Each federated hub has
+// a name, the host (and port) peers reach it at, and a user of another hub is
+// addressed as name@hub or id@hub. The sender's hub relays the envelope to the
+// recipient's hub through the outbound delivery queue, signing each request with its
+// hub key; the receiving hub pins that key on first contact.
+//
+// Peer names arrive in requests, so a hub only reaches names that are host names of
+// public addresses (see checkPeerName and peerClient), and only fetches the key of a
+// hub that contacts it when one of its users addressed that hub or its admin allows
+// it (see peerKnown).
+
+// DeliveryKindFederation relays an envelope to the hub named by the target
+const DeliveryKindFederation = "federation"
+
+// Headers of requests between federated hubs
+const (
+	// FederationHubHeader names the hub making the request
+	FederationHubHeader = "X-Clsp-Hub"
+	// FederationTimestampHeader and FederationSignatureHeader carry the Unix time and
+	// the hub key's base64 signature over the request (see federationPayload)
+	FederationTimestampHeader = "X-Clsp-Hub-Timestamp"
+	FederationSignatureHeader = "X-Clsp-Hub-Signature"
+)
+
+// maxFederatedEnvelope bounds an envelope relayed by a peer hub
+const maxFederatedEnvelope = 16 << 20
+
+// First-contact fetches of peer keys are limited to maxPeerKeyFetches in each
+// peerKeyFetchInterval, and to one per peer in that interval
+const (
+	peerKeyFetchInterval = time.Minute
+	maxPeerKeyFetches    = 10
+)
+
+// errPeerUnknown refuses a hub that contacts this one first: no user of this hub
+// addressed it and it is not in FederationPeers
+var errPeerUnknown = errors.New("this hub only accepts hubs its users wrote to or its admin allows")
+
+// errKeyFetchLimited refuses a first contact while too many keys were fetched lately
+var errKeyFetchLimited = errors.New("too many hubs made first contact; try again later")
+
+// sharedAddressSpace is the carrier-grade NAT range, not public though netip does not
+// count it as private
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// FederationKey is the public key a hub signs federation requests with
+type FederationKey struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+// FederationPeer is a hub whose key this hub pinned
+type FederationPeer struct {
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// SetFederation makes the hub federate under name, the host (and port) peers reach it
+// at; an empty name turns federation off. With insecure set peers are reached over
+// plain HTTP, which is only meant for testing.
+func (s *Server) SetFederation(name string, insecure bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.FederationName = name
+	s.config.FederationInsecure = insecure
+}
+
+// SetFederationAllowPrivate lets peer names be IP addresses and local names, and
+// peers be reached at private addresses, as for hubs on a private network
+func (s *Server) SetFederationAllowPrivate(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.FederationAllowPrivate = allow
+}
+
+// AllowPeer adds a hub to FederationPeers, so its key is fetched when it first
+// contacts this hub though no user of this hub addressed it
+func (s *Server) AllowPeer(ctx context.Context, name string) error {
+	if err := s.checkPeerName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, peer := range s.config.FederationPeers {
+		if peer == name {
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.config.FederationPeers = append(append([]string(nil), s.config.FederationPeers...), name)
+	s.mu.Unlock()
+	s.audit(ctx, "federation.allow", name, nil)
+	return nil
+}
+
+// DisallowPeer removes a hub from FederationPeers; a key already pinned for it stays
+func (s *Server) DisallowPeer(ctx context.Context, name string) error {
+	s.mu.Lock()
+	var peers []string
+	for _, peer := range s.config.FederationPeers {
+		if peer != name {
+			peers = append(peers, peer)
+		}
+	}
+	found := len(peers) < len(s.config.FederationPeers)
+	s.config.FederationPeers = peers
+	s.mu.Unlock()
+	if !found {
+		return fmt.Errorf("%s is not an allowed hub", name)
+	}
+	s.audit(ctx, "federation.disallow", name, nil)
+	return nil
+}
+
+// createFederationAddressed creates the table of hubs the users of this hub addressed
+func createFederationAddressed(db Store) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS federation_addressed (
+			name TEXT PRIMARY KEY,
+			first_addressed INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create federation_addressed table: %v", err)
+	}
+	return nil
+}
+
+// splitAddress splits a federated address into the user (name or ID) and hub parts
+func splitAddress(address string) (user, hubName string, ok bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return address, "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+// peerURL returns the base URL of a peer hub
+func (s *Server) peerURL(name string) string {
+	if s.Config().FederationInsecure {
+		return "http://" + name
+	}
+	return "https://" + name
+}
+
+// checkPeerName checks that a peer hub's name is a host name with an optional port.
+// IP addresses and local names are refused unless FederationAllowPrivate is set.
+func (s *Server) checkPeerName(name string) error {
+	host := name
+	if h, port, err := net.SplitHostPort(name); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("hub name %q has an invalid port", name)
+		}
+		host = h
+	}
+	allowPrivate := s.Config().FederationAllowPrivate
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		if !allowPrivate {
+			return fmt.Errorf("hub name %q is an IP address, not a host name", name)
+		}
+		return nil
+	}
+	if !validHostName(host) {
+		return fmt.Errorf("hub name %q is not a host name", name)
+	}
+	host = strings.ToLower(host)
+	local := !strings.Contains(host, ".") || host == "localhost" || strings.HasSuffix(host, ".localhost") ||
+		strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".internal")
+	if local && !allowPrivate {
+		return fmt.Errorf("hub name %q is a local name", name)
+	}
+	return nil
+}
+
+// validHostName reports whether host is made of DNS labels of letters, digits and
+// inner hyphens
+func validHostName(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// publicAddress reports whether ip is a unicast address on the public internet
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// peerClient returns the HTTP client for requests to peer hubs. It follows no
+// redirects and, unless FederationAllowPrivate is set, refuses to connect to an
+// address that is not public, whatever the peer's name resolved to.
+func (s *Server) peerClient() *http.Client {
+	dialer := &net.Dialer{Timeout: deliveryAttemptTimeout}
+	if !s.Config().FederationAllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !publicAddress(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: deliveryAttemptTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// federationPayload returns the bytes a hub signs for a federation request
+func federationPayload(hubName string, ts int64, method, path string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return crypto.RequestPayload("federation", hubName, ts, method, path, hex.EncodeToString(sum[:]))
+}
+
+// peerRequest sends a request signed with the hub key to a peer hub
+func (s *Server) peerRequest(ctx context.Context, method, peer, path string, query url.Values, body []byte) (*http.Response, error) {
+	if err := s.checkPeerName(peer); err != nil {
+		return nil, PermanentDeliveryError(err)
+	}
+	name := s.Config().FederationName
+	endpoint := s.peerURL(peer) + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, PermanentDeliveryError(fmt.Errorf("invalid peer hub %q: %v", peer, err))
+	}
+	ts := time.Now().Unix()
+	sig, err := crypto.SignData(s.hubKey, federationPayload(name, ts, method, path, body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FederationHubHeader, name)
+	req.Header.Set(FederationTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(FederationSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return s.peerClient().Do(req)
+}
+
+// keyFetchLimiter spaces out first-contact fetches of peer keys, which the hub makes
+// for whoever names a peer in a request; it starts afresh when the hub restarts
+type keyFetchLimiter struct {
+	mu     sync.Mutex
+	recent []time.Time
+	last   map[string]time.Time
+}
+
+// allow reports whether the key of peer may be fetched now, counting the fetch if so
+func (l *keyFetchLimiter) allow(peer string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, at := range l.last {
+		if now.Sub(at) >= peerKeyFetchInterval {
+			delete(l.last, name)
+		}
+	}
+	recent := l.recent[:0]
+	for _, at := range l.recent {
+		if now.Sub(at) < peerKeyFetchInterval {
+			recent = append(recent, at)
+		}
+	}
+	l.recent = recent
+	if _, ok := l.last[peer]; ok || len(l.recent) >= maxPeerKeyFetches {
+		return false
+	}
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	l.last[peer] = now
+	l.recent = append(l.recent, now)
+	return true
+}
+
+// notePeerAddressed remembers that a user of this hub addressed peer, whose key may
+// then be fetched when it contacts this hub
+func (s *Server) notePeerAddressed(ctx context.Context, peer string) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO federation_addressed (name, first_addressed) VALUES (?, ?)",
+		peer, time.Now().Unix(),
+	)
+	return err
+}
+
+// peerKnown reports whether a user of this hub addressed peer or the admin allows it
+// in FederationPeers; only the keys of such hubs are fetched on first contact
+func (s *Server) peerKnown(ctx context.Context, peer string) (bool, error) {
+	for _, name := range s.Config().FederationPeers {
+		if name == peer {
+			return true, nil
+		}
+	}
+	var addressed bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM federation_addressed WHERE name = ?)", peer).Scan(&addressed)
+	return addressed, err
+}
+
+// peerKey returns the pinned key of a peer hub, fetching and pinning it on first
+// contact when the peer is known (see peerKnown) and the fetch limit allows
+func (s *Server) peerKey(ctx context.Context, peer string) (*rsa.PublicKey, error) {
+	var publicKeyPEM string
+	err := s.db.QueryRowContext(ctx, "SELECT public_key FROM federation_peers WHERE name = ?", peer).Scan(&publicKeyPEM)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		return crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM))
+	}
+
+	known, err := s.peerKnown(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, errPeerUnknown
+	}
+	if !s.keyFetches.allow(peer, time.Now()) {
+		return nil, errKeyFetchLimited
+	}
+	resp, err := s.peerRequest(ctx, http.MethodGet, peer, "/federation/key", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub %s: %v", peer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hub %s returned %s for its key", peer, resp.Status)
+	}
+	var key FederationKey
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&key); err != nil {
+		return nil, fmt.Errorf("hub %s sent an invalid key: %v", peer, err)
+	}
+	if key.Name != peer {
+		return nil, fmt.Errorf("hub %s calls itself %s", peer, key.Name)
+	}
+	publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(key.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("hub %s sent an invalid key: %v", peer, err)
+	}
+	now := time.Now().Unix()
+	_, err = s.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO federation_peers (name, public_key, first_seen, last_seen) VALUES (?, ?, ?, ?)",
+		peer, key.PublicKey, now, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.logf(LogInfo, "", "Pinned the key of federated hub %s", peer)
+	return publicKey, nil
+}
+
+// verifyPeer checks that a request was signed by the key pinned for the hub it names,
+// returning that hub's name, or "" when the signature does not hold. A hub whose key
+// may not be fetched yet is refused with errPeerUnknown or errKeyFetchLimited.
+func (s *Server) verifyPeer(ctx context.Context, r *http.Request, body []byte) (string, error) {
+	peer := r.Header.Get(FederationHubHeader)
+	ts, err := strconv.ParseInt(r.Header.Get(FederationTimestampHeader), 10, 64)
+	if peer == "" || err != nil {
+		return "", nil
+	}
+	window := s.Config().ClockSkewTolerance
+	if window <= 0 {
+		window = signedRequestMaxAge
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > window || age < -window {
+		return "", nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(FederationSignatureHeader))
+	if err != nil {
+		return "", nil
+	}
+	publicKey, err := s.peerKey(ctx, peer)
+	if err != nil {
+		s.event(LogWarn, EventFederationFailure, "", "Federation request from %s refused: %v", peer, err)
+		if errors.Is(err, errPeerUnknown) || errors.Is(err, errKeyFetchLimited) {
+			return "", err
+		}
+		return "", nil
+	}
+	if crypto.VerifyData(publicKey, federationPayload(peer, ts, r.Method, r.URL.Path, body), sig) != nil {
+		return "", nil
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE federation_peers SET last_seen = ? WHERE name = ?", time.Now().Unix(), peer); err != nil {
+		return "", err
+	}
+	return peer, nil
+}
+
+// federationEnabled answers 404 and returns false when the hub does not federate
+func (s *Server) federationEnabled(w http.ResponseWriter) bool {
+	if s.Config().FederationName == "" {
+		http.Error(w, "This hub does not federate", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// handleFederationKey publishes the key the hub signs federation requests with
+func (s *Server) handleFederationKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.federationEnabled(w) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FederationKey{Name: s.Config().FederationName, PublicKey: string(s.hubPublicKey)})
+}
+
+// handleFederationUser returns the directory entry of ?address=name@hub or id@hub,
+// with its ID and display name qualified by the hub. Addresses of this hub are looked
+// up locally; others are asked of their hub, so clients only talk to their own, for
+// requests signed by a user of this hub.
+func (s *Server) handleFederationUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.federationEnabled(w) {
+		return
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	address := r.URL.Query().Get("address")
+	name, peer, ok := splitAddress(address)
+	if !ok {
+		http.Error(w, "Address must look like name@hub", http.StatusBadRequest)
+		return
+	}
+
+	if peer == s.Config().FederationName {
+		user, err := scanUser(s.db.QueryRowContext(ctx,
+			"SELECT "+userColumns+" FROM users WHERE (id = ? OR display_name = ?) AND deactivated_at IS NULL",
+			name, name,
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		user.ID += "@" + peer
+		user.DisplayName += "@" + peer
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+		return
+	}
+
+	// A hub only asks the hub an address belongs to, never a third one
+	if r.Header.Get(FederationHubHeader) != "" {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	// Other hubs are only asked for users of this hub, signed over the address
+	userID := r.URL.Query().Get("user_id")
+	valid, err := s.verifySignedRequest(ctx, r, "federation-user", userID, address)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+	if err := s.checkPeerName(peer); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot look up %s: %v", address, err), http.StatusBadRequest)
+		return
+	}
+	if err := s.notePeerAddressed(ctx, peer); err != nil {
+		s.logf(LogError, userID, "Failed to record hub %s as addressed: %v", peer, err)
+	}
+	resp, err := s.peerRequest(ctx, http.MethodGet, peer, "/federation/user", url.Values{"address": {address}}, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Hub %s is unreachable", peer), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var user User
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&user) != nil {
+		http.Error(w, fmt.Sprintf("Hub %s returned an invalid answer", peer), http.StatusBadGateway)
+		return
+	}
+	if !strings.HasSuffix(user.ID, "@"+peer) || !strings.HasSuffix(user.DisplayName, "@"+peer) {
+		http.Error(w, fmt.Sprintf("Hub %s answered for another hub", peer), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// relayToPeer answers a send to a user of another hub: the message passes the
+// sender's checks here and is queued for the recipient's hub, which makes the checks
+// that concern the recipient when it arrives. The sender becomes id@this-hub, so the
+// recipient's hub and client can tell where it came from.
+func (s *Server) relayToPeer(ctx context.Context, w http.ResponseWriter, msg *crypto.Message, peer string, dryRun bool) {
+	own := s.Config().FederationName
+	if own == "" {
+		http.Error(w, "This hub does not federate; recipients must be users of this hub", http.StatusNotFound)
+		return
+	}
+	if strings.Contains(msg.Sender, "@") {
+		http.Error(w, "Sender must be a user of this hub", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkPeerName(peer); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot relay to %s: %v", msg.Recipient, err), http.StatusBadRequest)
+		return
+	}
+	var senderActive, senderBanned bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deactivated_at IS NULL), EXISTS(SELECT 1 FROM users WHERE id = ? AND banned_at IS NOT NULL)",
+		msg.Sender, msg.Sender,
+	).Scan(&senderActive, &senderBanned)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !senderActive {
+		http.Error(w, "Sender not found or deactivated", http.StatusForbidden)
+		return
+	}
+	if senderBanned {
+		s.logf(LogWarn, msg.Sender, "Message from banned sender rejected")
+		http.Error(w, "Sender is banned", http.StatusForbidden)
+		return
+	}
+	if msg.Attachment != nil && msg.Attachment.Uploaded() {
+		http.Error(w, "Uploaded attachments cannot be sent to users of other hubs", http.StatusBadRequest)
+		return
+	}
+
+	relayed := *msg
+	relayed.Sender = msg.Sender + "@" + own
+	payload, err := encodeEnvelope(&relayed)
+	if err != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	quota, err := s.checkSendQuota(ctx, msg.Sender, int64(len(payload)), time.Now(), !dryRun)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	quota.setHeaders(w.Header())
+	if quota.exceeded != "" {
+		s.event(LogWarn, EventRateLimit, msg.Sender, "Message rejected: %s quota reached", quota.exceeded)
+		quota.refuse(w)
+		return
+	}
+
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SendResult{ID: msg.ID, Status: SendStatusValid})
+		return
+	}
+
+	if _, err := s.EnqueueDelivery(ctx, DeliveryKindFederation, peer, payload); err != nil {
+		dbError(w, ctx, "Failed to queue message")
+		return
+	}
+	now := time.Now()
+	if err := s.recordSendUsage(ctx, msg.Sender, int64(len(payload)), now); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record send usage: %v", err)
+	}
+	if err := s.recordContact(ctx, msg.Sender, msg.Recipient, now); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record contact: %v", err)
+	}
+	if err := s.notePeerAddressed(ctx, peer); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record hub %s as addressed: %v", peer, err)
+	}
+	s.logf(LogInfo, msg.Sender, "Message %s queued for hub %s", msg.ID, peer)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(SendResult{ID: msg.ID, Status: SendStatusRelayed})
+}
+
+// deliverFederated posts a relayed envelope to the recipient's hub. Refusals other
+// than timeouts and rate limiting will not succeed on retry and are treated as
+// permanent.
+func (s *Server) deliverFederated(ctx context.Context, peer string, payload []byte) error {
+	if s.Config().FederationName == "" {
+		return PermanentDeliveryError(fmt.Errorf("federation is turned off"))
+	}
+	resp, err := s.peerRequest(ctx, http.MethodPost, peer, "/federation/deliver", nil, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("hub %s returned %s", peer, resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return PermanentDeliveryError(fmt.Errorf("hub %s refused the message: %s", peer, strings.TrimSpace(string(body))))
+	default:
+		return fmt.Errorf("hub %s returned %s", peer, resp.Status)
+	}
+}
+
+// handleFederationDeliver stores a message relayed by a peer hub for one of this
+// hub's users. The envelope's sender must belong to the relaying hub; delivering the
+// same message twice stores it once.
+func (s *Server) handleFederationDeliver(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.federationEnabled(w) {
+		return
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFederatedEnvelope))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	peer, err := s.verifyPeer(ctx, r, body)
+	switch {
+	case errors.Is(err, errPeerUnknown):
+		http.Error(w, "Hub refused: "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errKeyFetchLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(peerKeyFetchInterval.Seconds())))
+		http.Error(w, "Hub refused: "+err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if peer == "" {
+		http.Error(w, "Invalid or expired hub signature", http.StatusUnauthorized)
+		return
+	}
+
+	var msg crypto.Message
+	if err := json.Unmarshal(body, &msg); err != nil || msg.ID == "" {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+	if err := msg.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, home, ok := splitAddress(msg.Sender); !ok || home != peer {
+		http.Error(w, "Sender does not belong to the relaying hub", http.StatusForbidden)
+		return
+	}
+	recipient, home, ok := splitAddress(msg.Recipient)
+	if ok && home != s.Config().FederationName {
+		http.Error(w, "Recipient does not belong to this hub", http.StatusNotFound)
+		return
+	}
+	msg.Recipient = recipient
+	if msg.Attachment != nil && msg.Attachment.Uploaded() {
+		http.Error(w, "Uploaded attachments are not relayed between hubs", http.StatusBadRequest)
+		return
+	}
+	if !s.checkEnvelopeSize(w, &msg) {
+		return
+	}
+	// A message that reached its sender's expiry while queued is not stored, but the
+	// relaying hub has nothing left to retry
+	if msg.Expired(time.Now()) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var recipientActive, exists bool
+	err = s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deactivated_at IS NULL), EXISTS(SELECT 1 FROM messages WHERE id = ?)",
+		msg.Recipient, msg.ID,
+	).Scan(&recipientActive, &exists)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !recipientActive {
+		http.Error(w, "Recipient not found or deactivated", http.StatusNotFound)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	envelope, err := encodeEnvelope(&msg)
+	if err != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+	if maxBytes := s.Config().MaxStorageBytes; maxBytes > 0 {
+		stored, err := s.storedBytes(ctx)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if stored+int64(len(envelope)) > maxBytes {
+			s.logf(LogError, msg.Recipient, "Message relayed by %s rejected: storage quota of %d bytes reached", peer, maxBytes)
+			http.Error(w, "Hub storage quota reached", http.StatusInsufficientStorage)
+			return
+		}
+	}
+	receipts, err := s.receiptsAllowed(ctx, msg.Recipient, msg.Sender)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	request, err := s.isMessageRequest(ctx, msg.Recipient, msg.Sender)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+
+	now := time.Now()
+	var inReplyTo interface{}
+	if msg.InReplyTo != "" {
+		inReplyTo = msg.InReplyTo
+	}
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO messages (id, sender_id, recipient_id, content, created_at, expires_at, dedupe_key, in_reply_to, no_receipts, request) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.ID, msg.Sender, msg.Recipient, envelope, now.Unix(), s.messageExpiry(&msg, now).Unix(), msg.DedupeKey, inReplyTo, !receipts, request,
+	)
+	if err != nil {
+		dbError(w, ctx, "Failed to store message")
+		return
+	}
+	s.logf(LogInfo, msg.Recipient, "Message %s relayed by hub %s", msg.ID, peer)
+	if !request && s.notifyRecipient(ctx, msg.Recipient, msg.ID, now) {
+		if _, err := s.db.ExecContext(ctx, "UPDATE messages SET quiet = 1 WHERE id = ?", msg.ID); err != nil {
+			s.logf(LogError, msg.Recipient, "Failed to tag message %s as quiet: %v", msg.ID, err)
+		}
+	}
+	if !request {
+		s.inbox.notify(msg.Recipient)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FederationPeers returns the hubs whose keys this hub pinned
+func (s *Server) FederationPeers(ctx context.Context) ([]FederationPeer, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, public_key, first_seen, last_seen FROM federation_peers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := []FederationPeer{}
+	for rows.Next() {
+		var peer FederationPeer
+		var publicKeyPEM string
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&peer.Name, &publicKeyPEM, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		if key, err := crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM)); err == nil {
+			peer.Fingerprint, _ = crypto.Fingerprint(key)
+		}
+		peer.FirstSeen = time.Unix(firstSeen, 0)
+		peer.LastSeen = time.Unix(lastSeen, 0)
+		peers = append(peers, peer)
+	}
+	return peers, rows.Err()
+}
+
+// ForgetPeer drops the pinned key of a peer hub, so the key it presents next is
+// pinned instead, as after the peer replaced its hub key
+func (s *Server) ForgetPeer(ctx context.Context, name string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM federation_peers WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no federated hub named %s", name)
+	}
+	s.logf(LogInfo, "", "Pinned key of federated hub %s forgotten", name)
+	s.audit(ctx, "federation.forget", name, nil)
+	return nil
+}
@@ -0,0 +1,291 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// TestCheckPeerName checks which names a peer hub may have, by default and with
+// FederationAllowPrivate set
+func TestCheckPeerName(t *testing.T) {
+	tests := []struct {
+		name         string
+		public       bool
+		allowPrivate bool
+	}{
+		{"hub.example.com", true, true},
+		{"hub.example.com:8443", true, true},
+		{"HUB.Example.com", true, true},
+		{"localhost", false, true},
+		{"localhost:18480", false, true},
+		{"hub.localhost", false, true},
+		{"printer.local", false, true},
+		{"metadata.google.internal", false, true},
+		{"intranet", false, true},
+		{"127.0.0.1", false, true},
+		{"127.0.0.1:443", false, true},
+		{"10.0.0.1", false, true},
+		{"192.168.1.10:8080", false, true},
+		{"169.254.169.254", false, true},
+		{"[::1]:443", false, true},
+		{"[fe80::1]:443", false, true},
+		{"hub.example.com:0", false, false},
+		{"hub.example.com:99999", false, false},
+		{"hub_1.example.com", false, false},
+		{"-hub.example.com", false, false},
+		{"hub..example.com", false, false},
+		{"hub.example.com/path", false, false},
+		{"user@hub.example.com", false, false},
+		{"", false, false},
+	}
+
+	s := newTestServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.SetFederationAllowPrivate(false)
+			if err := s.checkPeerName(tt.name); (err == nil) != tt.public {
+				t.Errorf("accepted %v, want %v (%v)", err == nil, tt.public, err)
+			}
+			s.SetFederationAllowPrivate(true)
+			if err := s.checkPeerName(tt.name); (err == nil) != tt.allowPrivate {
+				t.Errorf("with private peers allowed, accepted %v, want %v (%v)", err == nil, tt.allowPrivate, err)
+			}
+		})
+	}
+}
+
+// TestPublicAddress checks which addresses peer hubs may be reached at
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.public {
+				t.Errorf("public %v, want %v", got, tt.public)
+			}
+		})
+	}
+}
+
+// TestPeerClientAddresses checks that the client for peer hubs only connects to
+// public addresses, whether given directly or through a name that resolves to a
+// private one, and never follows a redirect
+func TestPeerClientAddresses(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer redirect.Close()
+	port := fmt.Sprintf(":%d", redirect.Listener.Addr().(*net.TCPAddr).Port)
+
+	s := newTestServer(t)
+	tests := []struct {
+		name         string
+		url          string
+		allowPrivate bool
+		refused      bool
+	}{
+		{"loopback", redirect.URL, false, true},
+		{"name resolving to loopback", "http://localhost" + port, false, true},
+		{"link-local", "http://169.254.169.254" + port, false, true},
+		{"private", "http://10.255.255.1" + port, false, true},
+		{"loopback with private peers allowed", redirect.URL, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.SetFederationAllowPrivate(tt.allowPrivate)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := s.peerClient().Do(req)
+			if tt.refused {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("connected to a non-public address")
+				}
+				if !strings.Contains(err.Error(), "non-public address") {
+					t.Fatalf("refused for another reason: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			// The redirect is handed back, not followed to where it points
+			if resp.StatusCode != http.StatusFound || redirected.Load() != 0 {
+				t.Fatalf("status %d after %d requests to the redirect target", resp.StatusCode, redirected.Load())
+			}
+		})
+	}
+}
+
+// federationTestHub is a hub serving federation requests over plain HTTP on loopback
+type federationTestHub struct {
+	*Server
+	name string
+	// keyFetches counts the requests for the hub's key
+	keyFetches atomic.Int32
+}
+
+// newFederationTestHub starts a hub named after the loopback address it listens on
+func newFederationTestHub(t *testing.T) *federationTestHub {
+	t.Helper()
+	h := &federationTestHub{Server: newTestServer(t)}
+	handler := h.Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/federation/key" {
+			h.keyFetches.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	h.name = ts.Listener.Addr().String()
+	h.SetFederation(h.name, true)
+	h.SetFederationAllowPrivate(true)
+	return h
+}
+
+// TestFederationPeerAllowlist checks that a hub only accepts, and only fetches the
+// key of, peers that the admin allowed or that one of its users addressed
+func TestFederationPeerAllowlist(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, local *federationTestHub, peer string)
+		accepted bool
+	}{
+		{"unknown peer", func(t *testing.T, local *federationTestHub, peer string) {}, false},
+		{"other peer allowed", func(t *testing.T, local *federationTestHub, peer string) {
+			if err := local.AllowPeer(context.Background(), "hub.example.com"); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"peer allowed", func(t *testing.T, local *federationTestHub, peer string) {
+			if err := local.AllowPeer(context.Background(), peer); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"peer addressed by a user", func(t *testing.T, local *federationTestHub, peer string) {
+			if err := local.notePeerAddressed(context.Background(), peer); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"peer allowed, then disallowed", func(t *testing.T, local *federationTestHub, peer string) {
+			if err := local.AllowPeer(context.Background(), peer); err != nil {
+				t.Fatal(err)
+			}
+			if err := local.DisallowPeer(context.Background(), peer); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := newFederationTestHub(t)
+			remote := newFederationTestHub(t)
+			bob := addTestUser(t, local.Server, "bob")
+			dave := addTestUser(t, remote.Server, "dave")
+			tt.setup(t, local, remote.name)
+
+			msg, err := crypto.EncryptMessage(dave.Key, &bob.Key.PublicKey, nil, []byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.ID = uuid.New().String()
+			msg.Sender = dave.ID + "@" + remote.name
+			msg.Recipient = bob.ID + "@" + local.name
+			msg.Timestamp = time.Now().Unix()
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := remote.peerRequest(context.Background(), http.MethodPost, local.name, "/federation/deliver", nil, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if tt.accepted {
+				if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+					t.Fatalf("status %d, want the message accepted: %s", resp.StatusCode, body)
+				}
+				if n := count(t, local.Server, "messages"); n != 1 {
+					t.Fatalf("%d messages stored, want 1", n)
+				}
+				if n := remote.keyFetches.Load(); n != 1 {
+					t.Fatalf("peer key fetched %d times, want once", n)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+			}
+			if n := count(t, local.Server, "messages"); n != 0 {
+				t.Fatalf("%d messages stored from a refused peer", n)
+			}
+			if n := remote.keyFetches.Load(); n != 0 {
+				t.Fatalf("key of a refused peer fetched %d times", n)
+			}
+		})
+	}
+}
+
+// TestPeerRequestRefusesPrivateNames checks that a relay to a peer named by a
+// private address fails for good without reaching it
+func TestPeerRequestRefusesPrivateNames(t *testing.T) {
+	local := newFederationTestHub(t)
+	remote := newFederationTestHub(t)
+	remote.SetFederationAllowPrivate(false)
+
+	_, err := remote.peerRequest(context.Background(), http.MethodGet, local.name, "/federation/key", nil, nil)
+	var permanent *permanentDeliveryError
+	if err == nil || !errors.As(err, &permanent) {
+		t.Fatalf("got %v, want a permanent delivery error", err)
+	}
+	if n := local.keyFetches.Load(); n != 0 {
+		t.Fatalf("private peer reached %d times", n)
+	}
+}
@@ -0,0 +1,267 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultInactivityNotice is how long the owner of an unused account has to use it
+// again once warned, when InactivityPolicy.Notice is not set
+const DefaultInactivityNotice = 14 * 24 * time.Hour
+
+// InactivityPolicy retires accounts nobody uses any more. An account that has neither
+// sent nor fetched messages for After is flagged and its owner warned through their
+// notification webhook; if it is still unused once Notice has passed, it is
+// deactivated, and purged like any deactivated account after the user purge delay.
+type InactivityPolicy struct {
+	// After is how long an account may go unused before its owner is warned; zero
+	// keeps unused accounts
+	After time.Duration `json:"after,omitempty"`
+	// Notice is how long a warned owner has to use the account again; zero uses
+	// DefaultInactivityNotice
+	Notice time.Duration `json:"notice,omitempty"`
+}
+
+// notice returns the effective notice period
+func (p InactivityPolicy) notice() time.Duration {
+	if p.Notice > 0 {
+		return p.Notice
+	}
+	return DefaultInactivityNotice
+}
+
+// SetInactivity replaces the policy for unused accounts
+func (s *Server) SetInactivity(policy InactivityPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Inactivity = policy
+}
+
+// InactiveUser is an unused account the garbage collector warned or deactivated
+type InactiveUser struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	LastSeen    time.Time `json:"last_seen"`
+	// DeactivateAt is when the account is deactivated unless it is used again
+	DeactivateAt time.Time `json:"deactivate_at"`
+}
+
+// GCReport describes a garbage collection pass, or with DryRun what one would do
+type GCReport struct {
+	DryRun     bool             `json:"dry_run"`
+	Inactivity InactivityPolicy `json:"inactivity"`
+	// Warned are unused accounts whose owners are warned by this pass
+	Warned []InactiveUser `json:"warned,omitempty"`
+	// Deactivated are warned accounts still unused once their notice ran out
+	Deactivated []InactiveUser `json:"deactivated,omitempty"`
+	// Attachments are abandoned uploads and attachments no stored message refers to
+	Attachments     int   `json:"attachments"`
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	// OrphanFiles are files in the attachment directory no upload refers to
+	OrphanFiles int   `json:"orphan_files"`
+	OrphanBytes int64 `json:"orphan_bytes"`
+}
+
+// AccountNotification is the webhook payload warning a user that their unused account
+// will be deactivated
+type AccountNotification struct {
+	Event        string    `json:"event"`
+	UserID       string    `json:"user_id"`
+	LastSeen     time.Time `json:"last_seen"`
+	DeactivateAt time.Time `json:"deactivate_at"`
+	Time         time.Time `json:"time"`
+}
+
+// CollectGarbage retires unused accounts under the inactivity policy and deletes
+// attachments nothing refers to. With dryRun it only reports what it would do.
+func (s *Server) CollectGarbage(ctx context.Context, dryRun bool) (*GCReport, error) {
+	now := time.Now()
+	report := &GCReport{DryRun: dryRun, Inactivity: s.Config().Inactivity}
+
+	if err := s.retireInactiveUsers(ctx, now, dryRun, report); err != nil {
+		return nil, fmt.Errorf("failed to retire unused accounts: %v", err)
+	}
+
+	var err error
+	if report.Attachments, report.AttachmentBytes, err = s.cleanupAttachments(ctx, dryRun); err != nil {
+		return nil, fmt.Errorf("failed to clean up attachments: %v", err)
+	}
+	if report.OrphanFiles, report.OrphanBytes, err = s.cleanupOrphanFiles(ctx, dryRun); err != nil {
+		return nil, fmt.Errorf("failed to clean up attachment files: %v", err)
+	}
+	// The hourly pass is only recorded when it changed something
+	acted := len(report.Warned) > 0 || len(report.Deactivated) > 0 || report.Attachments > 0 || report.OrphanFiles > 0
+	if !dryRun && (acted || auditActor(ctx) != ActorHub) {
+		s.audit(ctx, "gc.run", "", map[string]interface{}{
+			"warned":       len(report.Warned),
+			"deactivated":  len(report.Deactivated),
+			"attachments":  report.Attachments,
+			"orphan_files": report.OrphanFiles,
+		})
+	}
+	return report, nil
+}
+
+// retireInactiveUsers warns the owners of accounts unused for longer than the policy
+// allows and deactivates those still unused once the notice has passed. Accounts used
+// again since their warning are cleared of it.
+func (s *Server) retireInactiveUsers(ctx context.Context, now time.Time, dryRun bool, report *GCReport) error {
+	if !dryRun {
+		if _, err := s.db.ExecContext(ctx,
+			"UPDATE users SET inactive_warned_at = NULL WHERE inactive_warned_at IS NOT NULL AND last_seen > inactive_warned_at",
+		); err != nil {
+			return err
+		}
+	}
+
+	policy := report.Inactivity
+	if policy.After <= 0 {
+		return nil
+	}
+	notice := policy.notice()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, display_name, last_seen, inactive_warned_at FROM users
+		WHERE deactivated_at IS NULL AND banned_at IS NULL AND last_seen <= ?
+		ORDER BY last_seen ASC, id ASC`,
+		now.Add(-policy.After).Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	var warn, deactivate []InactiveUser
+	for rows.Next() {
+		var u InactiveUser
+		var lastSeen int64
+		var warnedAt sql.NullInt64
+		if err := rows.Scan(&u.ID, &u.DisplayName, &lastSeen, &warnedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		u.LastSeen = time.Unix(lastSeen, 0)
+		switch {
+		case !warnedAt.Valid || warnedAt.Int64 < lastSeen:
+			u.DeactivateAt = now.Add(notice)
+			warn = append(warn, u)
+		case now.Sub(time.Unix(warnedAt.Int64, 0)) >= notice:
+			u.DeactivateAt = now
+			deactivate = append(deactivate, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	report.Warned, report.Deactivated = warn, deactivate
+	if dryRun {
+		return nil
+	}
+
+	for _, u := range warn {
+		if _, err := s.db.ExecContext(ctx, "UPDATE users SET inactive_warned_at = ? WHERE id = ?", now.Unix(), u.ID); err != nil {
+			return err
+		}
+		s.logf(LogWarn, u.ID, "Account unused since %s; deactivating it on %s unless it is used again",
+			u.LastSeen.UTC().Format(time.RFC3339), u.DeactivateAt.UTC().Format(time.RFC3339))
+		s.notifyInactive(ctx, u, now)
+	}
+	for _, u := range deactivate {
+		if _, err := s.db.ExecContext(ctx,
+			"UPDATE users SET deactivated_at = ?, online = 0 WHERE id = ? AND deactivated_at IS NULL",
+			now.Unix(), u.ID,
+		); err != nil {
+			return err
+		}
+		s.logf(LogInfo, u.ID, "User deactivated after going unused since %s", u.LastSeen.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// notifyInactive queues the webhook warning the owner of an unused account, if they
+// registered one
+func (s *Server) notifyInactive(ctx context.Context, u InactiveUser, now time.Time) {
+	settings, err := s.notificationSettings(ctx, u.ID)
+	if err != nil {
+		s.logf(LogError, u.ID, "Failed to load notification settings: %v", err)
+		return
+	}
+	if settings.WebhookURL == "" || !s.Config().UserWebhooks {
+		return
+	}
+	payload, err := json.Marshal(AccountNotification{
+		Event:        "account_inactive",
+		UserID:       u.ID,
+		LastSeen:     u.LastSeen.UTC(),
+		DeactivateAt: u.DeactivateAt.UTC(),
+		Time:         now.UTC(),
+	})
+	if err != nil {
+		return
+	}
+	if _, err := s.EnqueueDelivery(ctx, DeliveryKindWebhook, settings.WebhookURL, payload); err != nil {
+		s.logf(LogError, u.ID, "Failed to queue inactivity warning: %v", err)
+	}
+}
+
+// handleAdminGC reports what a garbage collection pass would do (GET), runs one now
+// (POST) or changes the inactivity policy and reports (PUT). PUT takes the durations
+// to change as the query parameters inactive_after and inactive_notice; 0 clears
+// one and parameters left out keep their current value.
+func (s *Server) handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	dryRun := true
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		dryRun = false
+	case http.MethodPut:
+		policy := s.Config().Inactivity
+		query := r.URL.Query()
+		for name, field := range map[string]*time.Duration{
+			"inactive_after":  &policy.After,
+			"inactive_notice": &policy.Notice,
+		} {
+			v := query.Get(name)
+			if v == "" {
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid duration for "+name, http.StatusBadRequest)
+				return
+			}
+			*field = d
+		}
+		s.SetInactivity(policy)
+		if err := s.SaveConfig(ctx); err != nil {
+			dbError(w, ctx, "Failed to save inactivity policy")
+			return
+		}
+		s.logf(LogInfo, "", "Inactivity policy changed by admin")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.CollectGarbage(ctx, dryRun)
+	if err != nil {
+		s.logf(LogError, "", "Garbage collection failed: %v", err)
+		dbError(w, ctx, "Garbage collection failed")
+		return
+	}
+	if !dryRun {
+		s.logf(LogInfo, "", "Garbage collection run by admin")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,546 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clsppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC interface (see pkg/clsppb) is served on a port of its own. Each call is
+// made into a request to the HTTP handler of its endpoint, and the JSON answer into
+// protobuf, so both transports share every check, limit and log line of the API.
+
+// watchRefresh is how often a Watch stream looks again for unread messages without
+// being woken, in case one was stored by another hub process
+const watchRefresh = 30 * time.Second
+
+// watchPageSize is the page size a Watch stream reads unread messages in
+const watchPageSize = 100
+
+// watchUserKey carries, in the context of a Watch stream's fetches, the user whose
+// signed subscription the stream checked
+type watchUserKey struct{}
+
+// SetGRPCPort makes Start also serve the gRPC interface on port (zero disables it);
+// /health then reports the port
+func (s *Server) SetGRPCPort(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.GRPCPort = port
+}
+
+// startGRPC starts serving the gRPC interface on port, over TLS with the hub's
+// certificate file when it serves HTTPS with one
+func (s *Server) startGRPC(port int, opts TLSOptions) error {
+	var serverOpts []grpc.ServerOption
+	switch {
+	case len(opts.ACMEDomains) > 0:
+		return fmt.Errorf("the gRPC interface needs a certificate file; it cannot serve ACME certificates")
+	case opts.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+		if err := requireClientCerts(config, opts); err != nil {
+			return err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC: %v", err)
+	}
+	s.grpcServer = grpc.NewServer(serverOpts...)
+	clsppb.RegisterHubServer(s.grpcServer, &grpcService{s: s, api: s.Handler()})
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil {
+			slog.Error("gRPC listener stopped", "port", port, "error", err)
+		}
+	}()
+	return nil
+}
+
+// grpcService implements the gRPC interface on top of the HTTP API
+type grpcService struct {
+	clsppb.UnimplementedHubServer
+	s   *Server
+	api http.Handler
+}
+
+// call serves a request for path (under the current protocol version) to the HTTP
+// API, returning the response, or the call's error if its status is not a success.
+// The caller's bearer token and address are passed on.
+func (g *grpcService) call(ctx context.Context, method, path string, query url.Values, body []byte) (*responseBuffer, error) {
+	return g.callWith(ctx, method, path, "application/json", query, body)
+}
+
+// callWith is call with a body of the given content type
+func (g *grpcService) callWith(ctx context.Context, method, path, contentType string, query url.Values, body []byte) (*responseBuffer, error) {
+	target := APIPrefix + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			req.Header.Set("Authorization", auth[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	resp := &responseBuffer{header: make(http.Header)}
+	g.api.ServeHTTP(resp, req)
+	if resp.status < 200 || resp.status > 299 {
+		return nil, resp.err()
+	}
+	return resp, nil
+}
+
+// responseBuffer records the response of an HTTP handler
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// decode reads the JSON body of the response into v
+func (b *responseBuffer) decode(v interface{}) error {
+	if err := json.Unmarshal(b.body.Bytes(), v); err != nil {
+		return status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// err returns the gRPC error matching a failed response
+func (b *responseBuffer) err() error {
+	message := strings.TrimSpace(b.body.String())
+	if b.status == http.StatusRequestEntityTooLarge {
+		var refusal SizeLimitError
+		if json.Unmarshal(b.body.Bytes(), &refusal) == nil && refusal.Message != "" {
+			message = refusal.Message
+		}
+	}
+	if retry := b.header.Get("Retry-After"); retry != "" {
+		message += fmt.Sprintf(" (retry after %ss)", retry)
+	}
+	return status.Error(grpcCode(b.status), message)
+}
+
+// grpcCode returns the gRPC status code of an HTTP status
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusGone:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusUpgradeRequired, http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusBadGateway:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// pageQuery adds the paging parameters of a list call to query
+func pageQuery(query url.Values, limit int32, since int64, cursor string) {
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(int(limit)))
+	}
+	if since > 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+}
+
+func (g *grpcService) Health(ctx context.Context, req *clsppb.HealthRequest) (*clsppb.HealthResponse, error) {
+	resp, err := g.call(ctx, http.MethodGet, "/health", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var health struct {
+		Status           string                 `json:"status"`
+		Config           map[string]interface{} `json:"config"`
+		ServerTime       time.Time              `json:"server_time"`
+		ProtocolVersions []int32                `json:"protocol_versions"`
+		OnionAddress     string                 `json:"onion_address"`
+	}
+	if err := resp.decode(&health); err != nil {
+		return nil, err
+	}
+	config, err := structpb.NewStruct(health.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode configuration: %v", err)
+	}
+	return &clsppb.HealthResponse{
+		Status:           health.Status,
+		Config:           config,
+		ServerTime:       timestamppb.New(health.ServerTime),
+		ProtocolVersions: health.ProtocolVersions,
+		OnionAddress:     health.OnionAddress,
+	}, nil
+}
+
+func (g *grpcService) ListUsers(ctx context.Context, req *clsppb.ListUsersRequest) (*clsppb.ListUsersResponse, error) {
+	query := url.Values{}
+	if req.Online {
+		query.Set("online", "true")
+	}
+	if req.Search != "" {
+		query.Set("search", req.Search)
+	}
+	pageQuery(query, req.Limit, req.Since, req.Cursor)
+	resp, err := g.call(ctx, http.MethodGet, "/users", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := resp.decode(&users); err != nil {
+		return nil, err
+	}
+	list := &clsppb.ListUsersResponse{NextCursor: resp.header.Get(NextCursorHeader)}
+	for i := range users {
+		list.Users = append(list.Users, userToProto(&users[i]))
+	}
+	return list, nil
+}
+
+func (g *grpcService) SendMessage(ctx context.Context, req *clsppb.SendMessageRequest) (*clsppb.SendResult, error) {
+	if req.Message == nil {
+		return nil, status.Error(codes.InvalidArgument, "Message required")
+	}
+	// The handler checks the signature over the bytes it reads, so it is passed the
+	// encoding the sender signed
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req.Message)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid message: %v", err)
+	}
+	query := url.Values{
+		"user_id": {req.Message.Sender},
+		"ts":      {strconv.FormatInt(req.Ts, 10)},
+		"sig":     {base64.RawURLEncoding.EncodeToString(req.Sig)},
+	}
+	if req.DryRun {
+		query.Set("dry_run", "true")
+	}
+	resp, err := g.callWith(ctx, http.MethodPost, "/message", crypto.ContentTypeProtobuf, query, body)
+	if err != nil {
+		return nil, err
+	}
+	var result SendResult
+	if err := resp.decode(&result); err != nil {
+		return nil, err
+	}
+	return &clsppb.SendResult{
+		Id:               result.ID,
+		Status:           result.Status,
+		ReceiptsDisabled: result.ReceiptsDisabled,
+		Request:          result.Request,
+	}, nil
+}
+
+func (g *grpcService) FetchMessages(ctx context.Context, req *clsppb.FetchMessagesRequest) (*clsppb.FetchMessagesResponse, error) {
+	query := url.Values{
+		"user_id": {req.UserId},
+		"ts":      {strconv.FormatInt(req.Ts, 10)},
+		"sig":     {base64.RawURLEncoding.EncodeToString(req.Sig)},
+	}
+	if req.Unread {
+		query.Set("unread", "true")
+	}
+	if req.Search != "" {
+		query.Set("search", req.Search)
+	}
+	pageQuery(query, req.Limit, req.Since, req.Cursor)
+	messages, next, err := g.fetch(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	list := &clsppb.FetchMessagesResponse{NextCursor: next}
+	for i := range messages {
+		list.Messages = append(list.Messages, crypto.MessageToProto(&messages[i]))
+	}
+	return list, nil
+}
+
+// fetch reads a page of messages from /messages, returning the cursor of the next
+func (g *grpcService) fetch(ctx context.Context, query url.Values) ([]crypto.Message, string, error) {
+	resp, err := g.call(ctx, http.MethodGet, "/messages", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var messages []crypto.Message
+	if err := resp.decode(&messages); err != nil {
+		return nil, "", err
+	}
+	return messages, resp.header.Get(NextCursorHeader), nil
+}
+
+// unread returns all of a user's unread messages, oldest first
+func (g *grpcService) unread(ctx context.Context, userID string) ([]crypto.Message, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"unread":  {"true"},
+		"limit":   {strconv.Itoa(watchPageSize)},
+	}
+	var all []crypto.Message
+	for {
+		messages, next, err := g.fetch(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, messages...)
+		if next == "" {
+			break
+		}
+		query.Set("cursor", next)
+	}
+	for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+		all[i], all[j] = all[j], all[i]
+	}
+	return all, nil
+}
+
+func (g *grpcService) Watch(stream clsppb.Hub_WatchServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	sub := first.GetSubscribe()
+	userID := sub.GetUserId()
+	if userID == "" {
+		return status.Error(codes.InvalidArgument, "A watch must start by subscribing to a user ID")
+	}
+	// The stream fetches for as long as it lasts, so the subscription's signature is
+	// checked once here rather than by each fetch
+	ok := g.s.signatureFresh(sub.GetTs())
+	if ok {
+		if ok, err = g.s.verifySignature(stream.Context(), sub.GetTs(), sub.GetSig(), "messages", userID); err != nil {
+			return status.Error(codes.Internal, "Database error")
+		}
+	}
+	if !ok {
+		return status.Error(codes.Unauthenticated, "Invalid or expired request signature")
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(stream.Context(), watchUserKey{}, userID))
+	defer cancel()
+
+	wake := g.s.inbox.subscribe(userID)
+	defer g.s.inbox.unsubscribe(userID, wake)
+
+	// Messages and read results are sent from different goroutines
+	var sendMu sync.Mutex
+	send := func(event *clsppb.WatchEvent) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(event)
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := g.watchRequests(ctx, stream, userID, send); err != nil && err != io.EOF {
+			failed <- err
+		}
+	}()
+
+	// sent holds the unread messages already sent, so each is sent once
+	sent := make(map[string]bool)
+	refresh := time.NewTicker(watchRefresh)
+	defer refresh.Stop()
+	for {
+		messages, err := g.unread(ctx, userID)
+		if err != nil {
+			return err
+		}
+		unread := make(map[string]bool, len(messages))
+		for i := range messages {
+			unread[messages[i].ID] = true
+			if sent[messages[i].ID] {
+				continue
+			}
+			if err := send(&clsppb.WatchEvent{Event: &clsppb.WatchEvent_Message{Message: crypto.MessageToProto(&messages[i])}}); err != nil {
+				return err
+			}
+		}
+		sent = unread
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-failed:
+			return err
+		case <-wake:
+		case <-refresh.C:
+		}
+	}
+}
+
+// watchRequests serves the MarkRead requests of a Watch stream until it fails or the
+// client stops sending
+func (g *grpcService) watchRequests(ctx context.Context, stream clsppb.Hub_WatchServer, userID string, send func(*clsppb.WatchEvent) error) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		mark := req.GetMarkRead()
+		if mark == nil {
+			return status.Error(codes.InvalidArgument, "A watch subscribes once; later requests must mark messages read")
+		}
+		body, err := json.Marshal(ReadRequest{IDs: mark.Ids})
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		query := url.Values{
+			"user_id": {userID},
+			"ts":      {strconv.FormatInt(mark.Ts, 10)},
+			"sig":     {base64.RawURLEncoding.EncodeToString(mark.Sig)},
+		}
+		resp, err := g.call(ctx, http.MethodPost, "/message/read", query, body)
+		if err != nil {
+			return err
+		}
+		var result ReadResult
+		if err := resp.decode(&result); err != nil {
+			return err
+		}
+		if err := send(&clsppb.WatchEvent{Event: &clsppb.WatchEvent_Read{Read: &clsppb.ReadResult{Marked: result.Marked}}}); err != nil {
+			return err
+		}
+	}
+}
+
+// inboxBroker wakes the Watch streams of a user when a message is stored for them.
+// Its zero value is ready to use.
+type inboxBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+// notify wakes the streams watching userID; a stream already woken stays so
+func (b *inboxBroker) notify(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel woken when a message is stored for userID
+func (b *inboxBroker) subscribe(userID string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if b.subs == nil {
+		b.subs = make(map[string]map[chan struct{}]struct{})
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan struct{}]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe stops waking ch
+func (b *inboxBroker) unsubscribe(userID string, ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[userID], ch)
+	if len(b.subs[userID]) == 0 {
+		delete(b.subs, userID)
+	}
+}
+
+// userToProto converts a directory entry to its protobuf form
+func userToProto(u *User) *clsppb.User {
+	user := &clsppb.User{
+		Id:            u.ID,
+		DisplayName:   u.DisplayName,
+		PublicKey:     u.PublicKey,
+		LastSeen:      timestamppb.New(u.LastSeen),
+		Online:        u.Online,
+		SigningKey:    u.SigningKey,
+		SigningKeySig: u.SigningKeySig,
+	}
+	if p := u.Prekey; p != nil {
+		user.Prekey = &clsppb.Prekey{Id: p.ID, PublicKey: p.PublicKey, CreatedAt: p.CreatedAt, Suites: p.Suites, Signature: p.Signature}
+	}
+	for _, r := range u.KeyRotations {
+		user.KeyRotations = append(user.KeyRotations, &clsppb.KeyRotation{
+			PreviousKey: r.PreviousKey,
+			PublicKey:   r.PublicKey,
+			RotatedAt:   r.RotatedAt,
+			PreviousSig: r.PreviousSig,
+			IdentitySig: r.IdentitySig,
+		})
+	}
+	return user
+}
@@ -0,0 +1,33 @@
+package hub
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"os"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// loadOrCreateHubKey loads the hub's signing key from disk, generating a new one on first run
+func loadOrCreateHubKey(path string) (*rsa.PrivateKey, []byte, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		privateKey, publicKeyPEM, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate hub key: %v", err)
+		}
+		if err := crypto.SavePrivateKey(privateKey, path); err != nil {
+			return nil, nil, fmt.Errorf("failed to save hub key: %v", err)
+		}
+		return privateKey, publicKeyPEM, nil
+	}
+
+	privateKey, err := crypto.LoadPrivateKey(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load hub key: %v", err)
+	}
+	publicKeyPEM, err := crypto.PublicKeyToPEM(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode hub public key: %v", err)
+	}
+	return privateKey, publicKeyPEM, nil
+}
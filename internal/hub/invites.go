@@ -0,0 +1,246 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errInviteCodeNotFound is returned when revoking an invite code that does not exist
+var errInviteCodeNotFound = errors.New("invite code not found")
+
+// InviteCode lets its holders register with a name of their choosing while the hub
+// requires invites. Unlike a provisioning Invite it reserves no identity and may
+// allow more than one registration.
+type InviteCode struct {
+	ID string `json:"id"`
+	// Code is the plaintext code, only set right after creation; the hub keeps a hash
+	Code    string `json:"code,omitempty"`
+	Note    string `json:"note,omitempty"`
+	MaxUses int    `json:"max_uses"`
+	Uses    int    `json:"uses"`
+	// ExpiresAt is zero for a code that never expires
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// usable reports whether the code can still admit a registration at now
+func (c *InviteCode) usable(now time.Time) bool {
+	return c.Uses < c.MaxUses && (c.ExpiresAt.IsZero() || now.Before(c.ExpiresAt))
+}
+
+// createInviteCodes creates the table of invite codes
+func createInviteCodes(db Store) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS invite_codes (
+			id TEXT PRIMARY KEY,
+			code_hash TEXT NOT NULL UNIQUE,
+			note TEXT NOT NULL DEFAULT '',
+			max_uses INTEGER NOT NULL,
+			uses INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create invite_codes table: %v", err)
+	}
+	return nil
+}
+
+// CreateInviteCode mints a code admitting up to uses registrations until ttl has
+// passed (zero for no expiry). The plaintext code is returned exactly once.
+func (s *Server) CreateInviteCode(ctx context.Context, uses int, ttl time.Duration, note string) (*InviteCode, error) {
+	if uses < 1 {
+		return nil, fmt.Errorf("an invite code must allow at least one use")
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate invite code: %v", err)
+	}
+	now := time.Now()
+	invite := &InviteCode{
+		ID:        uuid.New().String(),
+		Code:      code,
+		Note:      strings.TrimSpace(note),
+		MaxUses:   uses,
+		CreatedAt: now,
+	}
+	var expiresAt int64
+	if ttl > 0 {
+		invite.ExpiresAt = now.Add(ttl)
+		expiresAt = invite.ExpiresAt.Unix()
+	}
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO invite_codes (id, code_hash, note, max_uses, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		invite.ID, hashInviteCode(code), invite.Note, uses, now.Unix(), expiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store invite code: %v", err)
+	}
+	details := map[string]interface{}{"uses": uses, "note": invite.Note}
+	if ttl > 0 {
+		details["expires_at"] = invite.ExpiresAt.UTC()
+	}
+	s.audit(ctx, "invite.create", invite.ID, details)
+	return invite, nil
+}
+
+// ListInviteCodes returns invite codes, oldest first; unless all is set, only those
+// that can still be used
+func (s *Server) ListInviteCodes(ctx context.Context, all bool) ([]InviteCode, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, note, max_uses, uses, created_at, expires_at FROM invite_codes ORDER BY created_at, id",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invite codes: %v", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	codes := []InviteCode{}
+	for rows.Next() {
+		var c InviteCode
+		var createdAt, expiresAt int64
+		if err := rows.Scan(&c.ID, &c.Note, &c.MaxUses, &c.Uses, &createdAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("failed to read invite code: %v", err)
+		}
+		c.CreatedAt = time.Unix(createdAt, 0)
+		if expiresAt > 0 {
+			c.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		if all || c.usable(now) {
+			codes = append(codes, c)
+		}
+	}
+	return codes, rows.Err()
+}
+
+// RevokeInviteCode deletes an invite code by ID; accounts it admitted are kept
+func (s *Server) RevokeInviteCode(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM invite_codes WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite code: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errInviteCodeNotFound
+	}
+	s.audit(ctx, "invite.revoke", id, nil)
+	return nil
+}
+
+// lookupInviteCode returns the invite code matching code if it can still be used
+func (s *Server) lookupInviteCode(ctx context.Context, code string) (*InviteCode, error) {
+	var c InviteCode
+	var createdAt, expiresAt int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, note, max_uses, uses, created_at, expires_at FROM invite_codes WHERE code_hash = ?",
+		hashInviteCode(code),
+	).Scan(&c.ID, &c.Note, &c.MaxUses, &c.Uses, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt > 0 {
+		c.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	if !c.usable(time.Now()) {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// useInviteCode counts a registration against code within tx, reporting false when
+// the code is unknown, used up or expired
+func useInviteCode(ctx context.Context, tx StoreTx, code string, now time.Time) (bool, error) {
+	result, err := tx.ExecContext(ctx,
+		"UPDATE invite_codes SET uses = uses + 1 WHERE code_hash = ? AND uses < max_uses AND (expires_at = 0 OR expires_at > ?)",
+		hashInviteCode(code), now.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// handleAdminInvites lists invite codes (GET, ?all=true to include used up and
+// expired ones), mints one (POST ?uses=&ttl=&note=) or revokes one (DELETE ?id=)
+func (s *Server) handleAdminInvites(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		codes, err := s.ListInviteCodes(ctx, query.Get("all") == "true")
+		if err != nil {
+			dbError(w, ctx, "Failed to list invite codes")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(codes)
+	case http.MethodPost:
+		uses := 1
+		if v := query.Get("uses"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid number of uses", http.StatusBadRequest)
+				return
+			}
+			uses = n
+		}
+		ttl := DefaultInviteTTL
+		if v := query.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		invite, err := s.CreateInviteCode(ctx, uses, ttl, query.Get("note"))
+		if err != nil {
+			dbError(w, ctx, "Failed to create invite code")
+			return
+		}
+		s.logf(LogInfo, "", "Invite code %s created by admin for %d registration(s)", invite.ID, uses)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(invite)
+	case http.MethodDelete:
+		id := query.Get("id")
+		if id == "" {
+			http.Error(w, "Invite code ID required", http.StatusBadRequest)
+			return
+		}
+		err := s.RevokeInviteCode(ctx, id)
+		if errors.Is(err, errInviteCodeNotFound) {
+			http.Error(w, "Invite code not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Failed to revoke invite code")
+			return
+		}
+		s.logf(LogInfo, "", "Invite code %s revoked by admin", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
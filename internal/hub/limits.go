@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Requests over a size limit are answered with 413 and a SizeLimitError, so clients
+// can tell which limit was hit and by how much instead of showing the hub's text.
+
+// Codes of a SizeLimitError
+const (
+	// LimitMessageSize is MaxMessageSize, for the encrypted text of a message
+	LimitMessageSize = "message_too_large"
+	// LimitAttachmentSize is MaxAttachmentSize, for uploaded and inline attachments
+	LimitAttachmentSize = "attachment_too_large"
+	// LimitRequestSize is the bound on a request body
+	LimitRequestSize = "request_too_large"
+)
+
+// maxEnvelopeBody bounds a /message request when the hub caps neither message nor
+// attachment size
+const maxEnvelopeBody = 64 << 20
+
+// envelopeOverhead allows for the parts of an envelope besides its content and inline
+// attachment: wrapped keys, signatures and metadata
+const envelopeOverhead = 256 << 10
+
+// SizeLimitError is the body of a 413 response
+type SizeLimitError struct {
+	// Message explains the refusal
+	Message string `json:"error"`
+	// Code names the limit exceeded (LimitMessageSize, LimitAttachmentSize or
+	// LimitRequestSize)
+	Code string `json:"code"`
+	// Limit is the largest size accepted in bytes
+	Limit int64 `json:"limit"`
+	// Size is the size refused, when the hub knows it
+	Size int64 `json:"size,omitempty"`
+}
+
+// writeSizeLimitError answers 413 with a SizeLimitError
+func writeSizeLimitError(w http.ResponseWriter, code string, limit, size int64, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(SizeLimitError{
+		Message: fmt.Sprintf(format, args...),
+		Code:    code,
+		Limit:   limit,
+		Size:    size,
+	})
+}
+
+// requestTooLarge answers 413 for a body cut off by http.MaxBytesReader and reports
+// true, or reports false for any other read error
+func requestTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeSizeLimitError(w, LimitRequestSize, tooLarge.Limit, 0, "Request exceeds the hub limit of %d bytes", tooLarge.Limit)
+	return true
+}
+
+// envelopeBodyLimit returns the largest /message request body the hub reads: room
+// for the largest message and inline attachment it accepts, JSON-encoded
+func (s *Server) envelopeBodyLimit() int64 {
+	cfg := s.Config()
+	if cfg.MaxMessageSize <= 0 || cfg.MaxAttachmentSize <= 0 {
+		return maxEnvelopeBody
+	}
+	content := int64(base64.StdEncoding.EncodedLen(cfg.MaxMessageSize))
+	attachment := int64(base64.StdEncoding.EncodedLen(int(cfg.MaxAttachmentSize)))
+	return content + attachment + envelopeOverhead
+}
+
+// checkEnvelopeSize answers 413 and reports false if the content or inline
+// attachment of msg exceeds the hub's limits
+func (s *Server) checkEnvelopeSize(w http.ResponseWriter, msg *crypto.Message) bool {
+	cfg := s.Config()
+	if size := len(msg.Content); cfg.MaxMessageSize > 0 && size > cfg.MaxMessageSize {
+		s.logf(LogWarn, msg.Sender, "Message of %d bytes rejected (limit %d)", size, cfg.MaxMessageSize)
+		writeSizeLimitError(w, LimitMessageSize, int64(cfg.MaxMessageSize), int64(size),
+			"Message content exceeds the hub limit of %d bytes", cfg.MaxMessageSize)
+		return false
+	}
+	if msg.Attachment == nil {
+		return true
+	}
+	if size := int64(len(msg.Attachment.Content)); cfg.MaxAttachmentSize > 0 && size > cfg.MaxAttachmentSize {
+		s.logf(LogWarn, msg.Sender, "Inline attachment of %d bytes rejected (limit %d)", size, cfg.MaxAttachmentSize)
+		writeSizeLimitError(w, LimitAttachmentSize, cfg.MaxAttachmentSize, size,
+			"Attachment exceeds the hub limit of %d bytes", cfg.MaxAttachmentSize)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat names rotated log files; it sorts chronologically
+const rotatedTimeFormat = "20060102-150405"
+
+// rotatingFile is an append-only log file that rotates itself when it grows past
+// maxSize bytes or gets older than maxAge, keeping at most maxBackups old files
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenLogFile opens the log file configured in cfg, or returns nil if file logging is off
+func OpenLogFile(cfg HubConfig) (io.WriteCloser, error) {
+	if cfg.LogFile == "" {
+		return nil, nil
+	}
+	rf := &rotatingFile{
+		path:       cfg.LogFile,
+		maxSize:    int64(cfg.LogMaxSizeMB) << 20,
+		maxAge:     cfg.LogMaxAge,
+		maxBackups: cfg.LogMaxBackups,
+		compress:   cfg.LogCompress,
+	}
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens (or creates) the current log file
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.openedAt = info.ModTime()
+	if rf.size == 0 {
+		rf.openedAt = time.Now()
+	}
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past its limits
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.due(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must be rotated before writing n more bytes
+func (rf *rotatingFile) due(n int64) bool {
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.openedAt) >= rf.maxAge
+}
+
+// rotate renames the current file aside, starts a new one, and compresses and prunes
+// old files in the background
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", rf.path, time.Now().Format(rotatedTimeFormat))
+	if _, err := os.Stat(rotated); err == nil {
+		rotated = fmt.Sprintf("%s.%s-%d", rf.path, time.Now().Format(rotatedTimeFormat), time.Now().Nanosecond())
+	}
+	renameErr := os.Rename(rf.path, rotated)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	go rf.cleanup(rotated)
+	return nil
+}
+
+// cleanup compresses a freshly rotated file and removes backups beyond maxBackups
+func (rf *rotatingFile) cleanup(rotated string) {
+	if rf.compress {
+		if err := gzipFile(rotated); err != nil {
+			slog.Error("Failed to compress rotated log", "file", rotated, "error", err)
+		}
+	}
+	if rf.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	// Skip compressions still in progress
+	kept := backups[:0]
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".tmp") {
+			kept = append(kept, b)
+		}
+	}
+	sort.Strings(kept)
+	for len(kept) > rf.maxBackups {
+		os.Remove(kept[0])
+		kept = kept[1:]
+	}
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the current log file
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
@@ -0,0 +1,270 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Log levels, in increasing severity
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+// logLevels ranks levels for filtering
+var logLevels = map[string]int{LogDebug: 0, LogInfo: 1, LogWarn: 2, LogError: 3}
+
+// slogLevels maps levels to those of the process log
+var slogLevels = map[string]slog.Level{
+	LogDebug: slog.LevelDebug,
+	LogInfo:  slog.LevelInfo,
+	LogWarn:  slog.LevelWarn,
+	LogError: slog.LevelError,
+}
+
+// ValidLogLevel reports whether level is a known log level
+func ValidLogLevel(level string) bool {
+	_, ok := logLevels[level]
+	return ok
+}
+
+// Formats of the process log
+const (
+	LogFormatText = "text" // key=value pairs, one record per line
+	LogFormatJSON = "json" // one JSON object per line
+)
+
+// ValidLogFormat reports whether format is a known log format; empty means text
+func ValidLogFormat(format string) bool {
+	return format == "" || format == LogFormatText || format == LogFormatJSON
+}
+
+// NewLogHandler returns the handler for the process log, writing records to w in
+// format. It passes every level: each Server filters by its own log level before
+// logging, so tenants with different levels can share the process log.
+func NewLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+const (
+	// logRetainEntries is the size of the persisted log ring buffer
+	logRetainEntries = 10000
+	// logWriteTimeout bounds persisting one log entry
+	logWriteTimeout = 2 * time.Second
+)
+
+// LogEntry is one persisted hub log record
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	UserID  string    `json:"user_id,omitempty"`
+	Message string    `json:"message"`
+}
+
+// LogQuery selects persisted log entries
+type LogQuery struct {
+	// MinLevel drops entries below this level (empty includes all)
+	MinLevel string
+	// Since drops entries older than this time (zero includes all)
+	Since time.Time
+	// UserID keeps only entries about this user (empty includes all)
+	UserID string
+	// Limit caps the number of entries, keeping the newest (zero means no cap)
+	Limit int
+}
+
+// logf persists a log line in the hub's log ring buffer, so operators can query it
+// later with 'clsp-hub logs', and echoes it to the process log while serving.
+// userID may be empty when the event is not about a particular user.
+func (s *Server) logf(level, userID, format string, args ...interface{}) {
+	if !s.logEnabled(level) {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	// One-off admin commands report outcomes themselves
+	if s.serving.Load() {
+		var attrs []slog.Attr
+		if userID != "" {
+			attrs = append(attrs, slog.String("user_id", userID))
+		}
+		slog.LogAttrs(context.Background(), slogLevels[level], message, attrs...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logWriteTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO hub_logs (time, level, user_id, message) VALUES (?, ?, ?, ?)",
+		time.Now().UnixNano(), level, userID, message,
+	)
+	if err != nil {
+		slog.Error("Failed to persist log entry", "error", err)
+		return
+	}
+
+	// Keep the table a fixed-size ring buffer
+	_, err = s.db.ExecContext(ctx, "DELETE FROM hub_logs WHERE id <= (SELECT MAX(id) FROM hub_logs) - ?", logRetainEntries)
+	if err != nil {
+		slog.Error("Failed to trim hub logs", "error", err)
+	}
+}
+
+// logEnabled reports whether entries at level are logged
+func (s *Server) logEnabled(level string) bool {
+	s.mu.RLock()
+	min := s.logLevel
+	s.mu.RUnlock()
+	if min == "" {
+		min = LogInfo
+	}
+	return logLevels[level] >= logLevels[min]
+}
+
+// withRequestLog records each request in the process log once it is answered, with
+// its method, path, status, duration, remote IP and the user it was made for. Requests
+// are logged at info level and those that failed on the hub at error level; they are
+// not persisted, as the ring buffer holds what handlers log about their outcome.
+func (s *Server) withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		level := LogInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = LogError
+		}
+		if !s.serving.Load() || !s.logEnabled(level) {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", remoteIP(r)),
+		}
+		if userID := r.URL.Query().Get("user_id"); userID != "" {
+			attrs = append(attrs, slog.String("user_id", userID))
+		}
+		slog.LogAttrs(r.Context(), slogLevels[level], "request", attrs...)
+	})
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status before sending it
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the implicit 200 of a handler that writes without a header
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// remoteIP returns the address a request came from, without its port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Logs returns persisted log entries matching q, oldest first
+func (s *Server) Logs(ctx context.Context, q LogQuery) ([]LogEntry, error) {
+	query := "SELECT time, level, user_id, message FROM hub_logs WHERE 1 = 1"
+	var args []interface{}
+
+	if q.MinLevel != "" {
+		min, ok := logLevels[q.MinLevel]
+		if !ok {
+			return nil, fmt.Errorf("unknown log level: %s", q.MinLevel)
+		}
+		var levels []string
+		for level, rank := range logLevels {
+			if rank >= min {
+				levels = append(levels, "?")
+				args = append(args, level)
+			}
+		}
+		query += " AND level IN (" + strings.Join(levels, ", ") + ")"
+	}
+	if !q.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, q.Since.UnixNano())
+	}
+	if q.UserID != "" {
+		query += " AND user_id = ?"
+		args = append(args, q.UserID)
+	}
+	query += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query logs: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		var nanos int64
+		if err := rows.Scan(&nanos, &e.Level, &e.UserID, &e.Message); err != nil {
+			return nil, fmt.Errorf("failed to read log entry: %v", err)
+		}
+		e.Time = time.Unix(0, nanos)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read logs: %v", err)
+	}
+
+	// Newest entries were selected; present them in chronological order
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
@@ -0,0 +1,160 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DeliveryMetrics summarizes how quickly stored messages are fetched by recipients
+type DeliveryMetrics struct {
+	Since time.Time `json:"since"`
+
+	// Delivered counts messages fetched for the first time during the period
+	Delivered int64 `json:"delivered"`
+	// ExpiredUnfetched counts messages that expired without ever being fetched
+	ExpiredUnfetched int64 `json:"expired_unfetched"`
+
+	// Store-to-first-fetch latency over the period
+	LatencyAvg time.Duration `json:"latency_avg"`
+	LatencyMax time.Duration `json:"latency_max"`
+	// Percentiles over messages still held by the hub
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP90 time.Duration `json:"latency_p90"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+
+	// Backlog lists recipients with messages that have never been fetched, deepest first
+	Backlog []UserBacklog `json:"backlog"`
+}
+
+// UserBacklog is the undelivered mailbox state of one recipient
+type UserBacklog struct {
+	UserID      string        `json:"user_id"`
+	DisplayName string        `json:"display_name"`
+	Pending     int64         `json:"pending"`
+	OldestAge   time.Duration `json:"oldest_age"`
+	// NextExpiry is how long until the oldest pending message expires unread
+	NextExpiry time.Duration `json:"next_expiry"`
+	LastSeen   time.Time     `json:"last_seen"`
+}
+
+// percentile returns the p-th percentile (0-100) of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// DeliveryMetrics reports delivery latency over the last days days and the current
+// backlog of up to top recipients
+func (s *Server) DeliveryMetrics(ctx context.Context, days, top int) (*DeliveryMetrics, error) {
+	now := time.Now()
+	since := time.Unix(statsDay(now.AddDate(0, 0, -(days-1))), 0)
+	m := &DeliveryMetrics{Since: since}
+
+	var latencySum, latencyMax int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(delivered), 0), COALESCE(SUM(latency_sum), 0),
+			COALESCE(MAX(latency_max), 0), COALESCE(SUM(expired_unfetched), 0)
+		FROM delivery_stats WHERE day >= ?`,
+		since.Unix(),
+	).Scan(&m.Delivered, &latencySum, &latencyMax, &m.ExpiredUnfetched)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery stats: %v", err)
+	}
+	if m.Delivered > 0 {
+		m.LatencyAvg = time.Duration(latencySum/m.Delivered) * time.Second
+	}
+	m.LatencyMax = time.Duration(latencyMax) * time.Second
+
+	// Percentiles need individual samples, which only exist while messages are stored
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT fetched_at - created_at FROM messages WHERE fetched_at IS NOT NULL AND fetched_at >= ?",
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery latencies: %v", err)
+	}
+	var samples []time.Duration
+	for rows.Next() {
+		var secs int64
+		if err := rows.Scan(&secs); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read delivery latencies: %v", err)
+		}
+		samples = append(samples, time.Duration(secs)*time.Second)
+	}
+	rows.Close()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	m.LatencyP50 = percentile(samples, 50)
+	m.LatencyP90 = percentile(samples, 90)
+	m.LatencyP99 = percentile(samples, 99)
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT m.recipient_id, COALESCE(u.display_name, ''), COUNT(*), MIN(m.created_at),
+			MIN(m.expires_at), COALESCE(u.last_seen, 0)
+		FROM messages m LEFT JOIN users u ON u.id = m.recipient_id
+		WHERE m.fetched_at IS NULL AND m.expires_at > ?
+		GROUP BY m.recipient_id, u.display_name, u.last_seen
+		ORDER BY COUNT(*) DESC, MIN(m.created_at)
+		LIMIT ?`,
+		now.Unix(), top,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backlog: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b UserBacklog
+		var oldest, expiry, lastSeen int64
+		if err := rows.Scan(&b.UserID, &b.DisplayName, &b.Pending, &oldest, &expiry, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to read backlog: %v", err)
+		}
+		b.OldestAge = now.Sub(time.Unix(oldest, 0)).Round(time.Second)
+		b.NextExpiry = time.Unix(expiry, 0).Sub(now).Round(time.Second)
+		b.LastSeen = time.Unix(lastSeen, 0)
+		m.Backlog = append(m.Backlog, b)
+	}
+	return m, rows.Err()
+}
+
+// handleAdminMetrics serves delivery metrics to holders of the admin token
+func (s *Server) handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	days, top := 7, 20
+	if v, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && v > 0 {
+		days = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && v > 0 {
+		top = v
+	}
+
+	metrics, err := s.DeliveryMetrics(ctx, days, top)
+	if err != nil {
+		dbError(w, ctx, "Failed to collect metrics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
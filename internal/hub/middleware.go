@@ -0,0 +1,220 @@
+package hub
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Every request passes through the same chain: request logging, panic recovery,
+// response compression, then the limits of its route (a deadline on its context and
+// a cap on its body) before reaching its handler. The connection limits below are
+// set on every listener the hub opens.
+
+// Connection limits of the hub's HTTP servers
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 1 * time.Minute
+	serverWriteTimeout      = 1 * time.Minute
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// transferTimeout replaces the connection limits and the request deadline on routes
+// that move large bodies, so slow links can finish them
+const transferTimeout = 15 * time.Minute
+
+// defaultMaxBody caps the request bodies of routes that do not bound their own
+const defaultMaxBody = 1 << 20
+
+// routeKind selects the limits a route runs with
+type routeKind int
+
+const (
+	// routeDefault runs with the hub timeout as its deadline and defaultMaxBody
+	routeDefault routeKind = iota
+	// routeLarge bounds its own body and may take transferTimeout to read it
+	routeLarge
+	// routeTransfer moves attachment ciphertext: it bounds its own body, may take
+	// transferTimeout either way and is not compressed, ciphertext being incompressible
+	routeTransfer
+	// routeStream holds its connection open for as long as the client listens and is
+	// not compressed, so events are not held back
+	routeStream
+)
+
+// routeKinds lists the routes whose limits differ from routeDefault
+var routeKinds = map[string]routeKind{
+	"/message":            routeLarge,
+	"/federation/deliver": routeLarge,
+	"/attachment":         routeTransfer,
+	"/admin/events":       routeStream,
+}
+
+// newHTTPServer returns a server for handler on addr with the hub's connection limits
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+// withMiddleware wraps the hub's routes in its middleware chain
+func (s *Server) withMiddleware(mux http.Handler) http.Handler {
+	return s.withCORS(s.withRequestLog(s.withRecovery(withCompression(s.withRouteLimits(mux)))))
+}
+
+// withRecovery answers 500 to a request whose handler panics, logging the panic and
+// its stack, instead of leaving the client with a dropped connection
+func (s *Server) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Raised on purpose to abort the response
+				panic(p)
+			}
+			s.logf(LogError, "", "Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			if rec.status == 0 {
+				http.Error(rec, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// withRouteLimits applies the deadline and body cap of each request's route
+func (s *Server) withRouteLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := routeKinds[apiPath(r.URL.Path)]
+		rc := http.NewResponseController(w)
+		ctx := r.Context()
+		var cancel context.CancelFunc
+
+		switch kind {
+		case routeDefault:
+			s.mu.RLock()
+			timeout := s.config.HubTimeout
+			s.mu.RUnlock()
+			if timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, defaultMaxBody)
+		case routeLarge:
+			rc.SetReadDeadline(time.Now().Add(transferTimeout))
+		case routeTransfer:
+			deadline := time.Now().Add(transferTimeout)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+		case routeStream:
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+		}
+		if cancel != nil {
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCompression gzips the responses of clients that accept it, except on routes
+// that transfer ciphertext or stream
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := routeKinds[apiPath(r.URL.Path)]
+		if kind == routeTransfer || kind == routeStream {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses what a handler writes, once it sends a status that
+// has a body
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader starts compressing unless the status has no body or the handler
+// encoded the body itself
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	hasBody := status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+	if hasBody && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+// Write compresses p, sending the implicit 200 first
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been compressed so far
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController the underlying writer
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close ends the compressed stream
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
@@ -0,0 +1,194 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// migration is one step in the evolution of the hub's database schema
+type migration struct {
+	version     int
+	description string
+	// up applies the step. Steps are not run in a transaction, so each must be safe
+	// to run again after being interrupted: create with IF NOT EXISTS, add columns
+	// with addColumnIfMissing and write backfills that skip rows already done.
+	up func(db Store) error
+}
+
+// migrations are the schema changes in the order they were made. Append new steps
+// with the next version; never change or reorder one that has been released, since
+// databases already past it will not run it again.
+var migrations = []migration{
+	{1, "Tables of hubs before versioned migrations", createTables},
+	{2, "Backfill users.updated_at and messages.fetched_at", backfillTimestamps},
+	{3, "Add users.inactive_warned_at", func(db Store) error {
+		return addColumnIfMissing(db, "users", "inactive_warned_at", "INTEGER")
+	}},
+	{4, "Add message requests", addMessageRequests},
+	{5, "Add invite codes", createInviteCodes},
+	{6, "Index message lookups", indexMessages},
+	{7, "Add full-text search of display names", createUserSearch},
+	{8, "Add the append-only audit log", createAuditLog},
+	{9, "Remember the hubs users addressed", createFederationAddressed},
+	{10, "Add the devices of each user", createDevices},
+}
+
+// messageIndexes serve the hub's frequent message lookups: a recipient's pending
+// messages, a sender's messages, the hourly expiry sweep and attachment references
+var messageIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS idx_messages_recipient ON messages (recipient_id, read_at, expires_at)",
+	"CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages (sender_id)",
+	"CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at)",
+	"CREATE INDEX IF NOT EXISTS idx_messages_attachment ON messages (attachment_id)",
+}
+
+// indexMessages creates messageIndexes
+func indexMessages(db Store) error {
+	for _, statement := range messageIndexes {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to index messages: %v", err)
+		}
+	}
+	return nil
+}
+
+// addMessageRequests adds the users' message request setting and the flag on
+// messages held as requests
+func addMessageRequests(db Store) error {
+	if err := addColumnIfMissing(db, "users", "message_requests", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "messages", "request", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// backfillTimestamps fills in timestamps for rows written before they were tracked
+func backfillTimestamps(db Store) error {
+	if _, err := db.Exec("UPDATE users SET updated_at = last_seen WHERE updated_at IS NULL"); err != nil {
+		return fmt.Errorf("failed to backfill updated_at: %v", err)
+	}
+	// Messages read before fetches were tracked were necessarily fetched
+	if _, err := db.Exec("UPDATE messages SET fetched_at = read_at WHERE fetched_at IS NULL AND read_at IS NOT NULL"); err != nil {
+		return fmt.Errorf("failed to backfill fetched_at: %v", err)
+	}
+	return nil
+}
+
+// Migration describes a schema migration and whether the database has had it
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	// AppliedAt is when the migration was applied, zero while it is pending
+	AppliedAt time.Time `json:"applied_at,omitempty"`
+}
+
+// LatestDatabaseVersion is the schema version this hub brings databases up to
+func LatestDatabaseVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// createSchemaVersion creates the table recording applied migrations
+func createSchemaVersion(ctx context.Context, db Store) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+	return nil
+}
+
+// DatabaseVersion returns the version of the newest migration applied to db, 0 for a
+// database that predates migrations or is empty
+func DatabaseVersion(ctx context.Context, db Store) (int, error) {
+	if err := createSchemaVersion(ctx, db); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// Migrations lists the migrations this hub knows, oldest first, with when each was
+// applied to db
+func Migrations(ctx context.Context, db Store) ([]Migration, error) {
+	if err := createSchemaVersion(ctx, db); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema versions: %v", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to read schema versions: %v", err)
+		}
+		applied[version] = time.Unix(at, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema versions: %v", err)
+	}
+
+	list := make([]Migration, len(migrations))
+	for i, m := range migrations {
+		list[i] = Migration{Version: m.version, Description: m.description, AppliedAt: applied[m.version]}
+	}
+	return list, nil
+}
+
+// CheckDatabaseVersion returns an error unless db is at this hub's schema version
+func CheckDatabaseVersion(ctx context.Context, db Store) error {
+	version, err := DatabaseVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	switch latest := LatestDatabaseVersion(); {
+	case version > latest:
+		return fmt.Errorf("database schema version %d is newer than this hub supports (%d); upgrade clsp-hub", version, latest)
+	case version < latest:
+		return fmt.Errorf("database schema version %d is older than this hub needs (%d); run 'clsp-hub migrate'", version, latest)
+	}
+	return nil
+}
+
+// Migrate applies the migrations db has not had, in order, and returns them. A
+// database written by a newer hub is left alone, as this one cannot know its schema.
+func Migrate(ctx context.Context, db Store) ([]Migration, error) {
+	version, err := DatabaseVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if latest := LatestDatabaseVersion(); version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than this hub supports (%d); upgrade clsp-hub", version, latest)
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.up(db); err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		now := time.Now()
+		// Another hub sharing the database may have recorded the same step meanwhile
+		if _, err := db.ExecContext(ctx,
+			"INSERT OR IGNORE INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+			m.version, m.description, now.Unix(),
+		); err != nil {
+			return applied, fmt.Errorf("failed to record migration %d: %v", m.version, err)
+		}
+		applied = append(applied, Migration{Version: m.version, Description: m.description, AppliedAt: now})
+	}
+	return applied, nil
+}
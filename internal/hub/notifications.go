@@ -0,0 +1,212 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	// Quiet hours are kept in the user's time zone, which must resolve on any host
+	_ "time/tzdata"
+)
+
+// maxNotificationsBody bounds the size of a notification settings update
+const maxNotificationsBody = 4096
+
+// QuietHours is a daily window, in the user's time zone, during which the hub stores
+// messages for the user without notifying them
+type QuietHours struct {
+	// Start and End are times of day as HH:MM; a window that ends before it starts
+	// runs past midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA zone name such as "Europe/Berlin"; empty means UTC
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (use HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks the window's times and time zone
+func (q *QuietHours) Validate() error {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("quiet hours must not start and end at the same time")
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", q.Timezone)
+	}
+	return nil
+}
+
+// Active reports whether t falls inside the window
+func (q *QuietHours) Active(t time.Time) bool {
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	loc, err3 := time.LoadLocation(q.Timezone)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// NotificationSettings are a user's choices for how the hub tells them about new messages
+type NotificationSettings struct {
+	// WebhookURL receives a POST for each message stored for the user (empty for none)
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// QuietHours, if set, suppresses notifications during a daily window
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// MessageNotification is the webhook payload for a newly stored message. It carries
+// no content or sender, which the hub cannot read or should not reveal to third parties.
+type MessageNotification struct {
+	Event       string    `json:"event"`
+	MessageID   string    `json:"message_id"`
+	RecipientID string    `json:"recipient_id"`
+	Time        time.Time `json:"time"`
+}
+
+// notificationSettings loads a user's notification settings
+func (s *Server) notificationSettings(ctx context.Context, userID string) (*NotificationSettings, error) {
+	var webhook, quiet sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT notify_url, quiet_hours FROM users WHERE id = ?", userID).Scan(&webhook, &quiet)
+	if err != nil {
+		return nil, err
+	}
+	settings := &NotificationSettings{WebhookURL: webhook.String}
+	if quiet.String != "" {
+		var q QuietHours
+		if err := json.Unmarshal([]byte(quiet.String), &q); err == nil {
+			settings.QuietHours = &q
+		}
+	}
+	return settings, nil
+}
+
+// notifyRecipient queues the webhook notification for a stored message unless the
+// recipient is in quiet hours, and reports whether quiet hours suppressed it
+func (s *Server) notifyRecipient(ctx context.Context, recipientID, messageID string, now time.Time) bool {
+	settings, err := s.notificationSettings(ctx, recipientID)
+	if err != nil {
+		s.logf(LogError, recipientID, "Failed to load notification settings: %v", err)
+		return false
+	}
+	if settings.QuietHours != nil && settings.QuietHours.Active(now) {
+		return true
+	}
+	if settings.WebhookURL == "" || !s.Config().UserWebhooks {
+		return false
+	}
+	payload, err := json.Marshal(MessageNotification{Event: "message", MessageID: messageID, RecipientID: recipientID, Time: now.UTC()})
+	if err != nil {
+		return false
+	}
+	if _, err := s.EnqueueDelivery(ctx, DeliveryKindWebhook, settings.WebhookURL, payload); err != nil {
+		s.logf(LogError, recipientID, "Failed to queue message notification: %v", err)
+	}
+	return false
+}
+
+// handleNotifications returns (GET) or replaces (POST) the calling user's notification
+// settings. Requests are signed over the method and the SHA-256 of the body.
+func (s *Server) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotificationsBody))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "notifications", userID, r.Method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var settings NotificationSettings
+		if err := json.Unmarshal(body, &settings); err != nil {
+			http.Error(w, "Invalid notification settings", http.StatusBadRequest)
+			return
+		}
+		if settings.WebhookURL != "" {
+			if !s.Config().UserWebhooks {
+				http.Error(w, "This hub does not send webhook notifications", http.StatusForbidden)
+				return
+			}
+			u, err := url.Parse(settings.WebhookURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				http.Error(w, "Invalid webhook URL", http.StatusBadRequest)
+				return
+			}
+		}
+		var quiet interface{}
+		if settings.QuietHours != nil {
+			if err := settings.QuietHours.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			encoded, _ := json.Marshal(settings.QuietHours)
+			quiet = string(encoded)
+		}
+		_, err := s.db.ExecContext(ctx,
+			"UPDATE users SET notify_url = ?, quiet_hours = ? WHERE id = ?",
+			settings.WebhookURL, quiet, userID,
+		)
+		if err != nil {
+			dbError(w, ctx, "Failed to store notification settings")
+			return
+		}
+		s.logf(LogInfo, userID, "Notification settings updated")
+	}
+
+	settings, err := s.notificationSettings(ctx, userID)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,319 @@
+package hub
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcLeeway is the clock allowance applied to token expiry and not-before checks
+const oidcLeeway = time.Minute
+
+// oidcKeyRefreshInterval limits how often an unknown key ID triggers a JWKS refetch
+const oidcKeyRefreshInterval = 5 * time.Minute
+
+// errNoBearerToken is returned when a request carries no Authorization bearer token
+var errNoBearerToken = errors.New("missing bearer token")
+
+// OIDCIdentity is the SSO account an ID token was issued for
+type OIDCIdentity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+// bindingKey is the value stored in users.sso_subject
+func (id OIDCIdentity) bindingKey() string {
+	return id.Issuer + "|" + id.Subject
+}
+
+// oidcVerifier validates ID tokens from one issuer for one client ID
+type oidcVerifier struct {
+	issuer   string
+	clientID string
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// oidcDiscovery holds the fields of the provider metadata the hub and client need
+type oidcDiscovery struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// jsonWebKey is one key of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcVerifier returns a verifier for the configured provider, or nil if
+// registration is not gated by OIDC
+func (s *Server) oidcVerifier() *oidcVerifier {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.config.RequireOIDC || s.config.OIDCIssuer == "" {
+		return nil
+	}
+	if s.oidc == nil || s.oidc.issuer != s.config.OIDCIssuer || s.oidc.clientID != s.config.OIDCClientID {
+		s.oidc = &oidcVerifier{
+			issuer:   s.config.OIDCIssuer,
+			clientID: s.config.OIDCClientID,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return s.oidc
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", errNoBearerToken
+	}
+	return strings.TrimSpace(auth[7:]), nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// refreshKeys refetches the provider's signing keys via discovery
+func (v *oidcVerifier) refreshKeys(ctx context.Context) error {
+	var disc oidcDiscovery
+	if err := v.getJSON(ctx, strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &disc); err != nil {
+		return fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if disc.Issuer != v.issuer {
+		return fmt.Errorf("OIDC discovery returned issuer %q, expected %q", disc.Issuer, v.issuer)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, disc.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch OIDC keys: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when it is unknown
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.keys != nil && time.Since(v.fetchedAt) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := v.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// publicKey converts an RSA or EC JWK to a Go public key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Verify checks an ID token's signature, issuer, audience and validity period
+func (v *oidcVerifier) Verify(ctx context.Context, token string) (*OIDCIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	dec := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := dec.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := dec.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	var hash crypto.Hash
+	switch header.Alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		// Never accept "none" or symmetric algorithms
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg[:2] != "RS" || rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if header.Alg[:2] != "ES" || len(sig) != 2*size {
+			return nil, errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	var claims struct {
+		Iss   string          `json:"iss"`
+		Sub   string          `json:"sub"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   int64           `json:"exp"`
+		Nbf   int64           `json:"nbf"`
+		Email string          `json:"email"`
+	}
+	raw, err = dec.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	now := time.Now()
+	if claims.Iss != v.issuer {
+		return nil, errors.New("token issued by a different provider")
+	}
+	if !audienceContains(claims.Aud, v.clientID) {
+		return nil, errors.New("token not issued for this hub")
+	}
+	if claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0).Add(oidcLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != 0 && now.Add(oidcLeeway).Before(time.Unix(claims.Nbf, 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &OIDCIdentity{Issuer: claims.Iss, Subject: claims.Sub, Email: claims.Email}, nil
+}
+
+// audienceContains reports whether an aud claim (string or array) includes clientID
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientID
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		for _, a := range many {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package hub
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The hub is published as a Tor onion service through the control port of a Tor
+// daemon: the hub authenticates, asks Tor to add a service forwarding to its own port
+// and keeps the control connection open, since Tor removes the service when the
+// connection closes. The service key is kept next to the database so the .onion
+// address stays the same across restarts.
+
+// DefaultTorControlAddr is where a Tor daemon listens for controllers by default
+const DefaultTorControlAddr = "127.0.0.1:9051"
+
+// onionKeyFile holds the onion service's private key in the hub's data directory
+const onionKeyFile = "onion_key"
+
+// torControlTimeout bounds connecting and each exchange with the control port
+const torControlTimeout = 30 * time.Second
+
+// OnionOptions selects how the hub reaches Tor to publish its onion service
+type OnionOptions struct {
+	// ControlAddr is the Tor control port (DefaultTorControlAddr when empty)
+	ControlAddr string
+	// ControlPassword authenticates with HashedControlPassword (empty uses cookie or
+	// no authentication, as the daemon offers)
+	ControlPassword string
+	// KeyFile holds the service key (default: onionKeyFile in the data directory)
+	KeyFile string
+}
+
+// OnionService is a published onion service; it stays reachable until Close
+type OnionService struct {
+	conn *textproto.Conn
+	// Address is the service's hostname, ending in .onion
+	Address string
+	// Port is the virtual port clients connect to
+	Port int
+}
+
+// Close removes the onion service by closing the control connection
+func (o *OnionService) Close() error {
+	return o.conn.Close()
+}
+
+// URL returns the hub URL clients use to reach the service
+func (o *OnionService) URL(useTLS bool) string {
+	if useTLS {
+		return "https://" + o.Address
+	}
+	return "http://" + o.Address
+}
+
+// PublishOnion publishes an onion service that forwards port 80 (443 with useTLS) to
+// localPort on this machine, reusing the key saved in dataDir or creating one
+func PublishOnion(opts OnionOptions, dataDir string, localPort int, useTLS bool) (*OnionService, error) {
+	addr := opts.ControlAddr
+	if addr == "" {
+		addr = DefaultTorControlAddr
+	}
+	keyFile := opts.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(dataDir, onionKeyFile)
+	}
+
+	raw, err := net.DialTimeout("tcp", addr, torControlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the Tor control port at %s: %v", addr, err)
+	}
+	conn := textproto.NewConn(raw)
+	ok := false
+	defer func() {
+		if !ok {
+			conn.Close()
+		}
+	}()
+
+	raw.SetDeadline(time.Now().Add(torControlTimeout))
+	if err := torAuthenticate(conn, opts.ControlPassword); err != nil {
+		return nil, err
+	}
+
+	key := "NEW:ED25519-V3"
+	if data, err := os.ReadFile(keyFile); err == nil {
+		key = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read onion service key: %v", err)
+	}
+
+	port := 80
+	if useTLS {
+		port = 443
+	}
+	lines, err := torCommand(conn, fmt.Sprintf("ADD_ONION %s Port=%d,127.0.0.1:%d", key, port, localPort))
+	if err != nil {
+		return nil, fmt.Errorf("Tor refused to add the onion service: %v", err)
+	}
+	service := &OnionService{conn: conn, Port: port}
+	for _, line := range lines {
+		name, value, _ := strings.Cut(line, "=")
+		switch name {
+		case "ServiceID":
+			service.Address = value + ".onion"
+		case "PrivateKey":
+			if err := os.WriteFile(keyFile, []byte(value+"\n"), 0600); err != nil {
+				return nil, fmt.Errorf("failed to save onion service key: %v", err)
+			}
+		}
+	}
+	if service.Address == "" {
+		return nil, fmt.Errorf("Tor did not return the onion service address")
+	}
+
+	raw.SetDeadline(time.Time{})
+	ok = true
+	return service, nil
+}
+
+// torAuthenticate authenticates on the control connection with password, the cookie
+// file the daemon names, or no credentials, whichever the daemon accepts
+func torAuthenticate(conn *textproto.Conn, password string) error {
+	lines, err := torCommand(conn, "PROTOCOLINFO 1")
+	if err != nil {
+		return fmt.Errorf("Tor control port did not answer PROTOCOLINFO: %v", err)
+	}
+	var methods []string
+	var cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range torFields(strings.TrimPrefix(line, "AUTH ")) {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "METHODS":
+				methods = strings.Split(value, ",")
+			case "COOKIEFILE":
+				cookieFile = value
+			}
+		}
+	}
+	offered := func(method string) bool {
+		for _, m := range methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	var credential string
+	switch {
+	case password != "" && offered("HASHEDPASSWORD"):
+		credential = torQuote(password)
+	case offered("NULL"):
+	case offered("COOKIE") && cookieFile != "":
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the Tor control cookie: %v", err)
+		}
+		credential = hex.EncodeToString(cookie)
+	case offered("HASHEDPASSWORD"):
+		return fmt.Errorf("the Tor control port needs a password (--tor-password)")
+	default:
+		return fmt.Errorf("no supported Tor control authentication method among %s", strings.Join(methods, ", "))
+	}
+
+	command := "AUTHENTICATE"
+	if credential != "" {
+		command += " " + credential
+	}
+	if _, err := torCommand(conn, command); err != nil {
+		return fmt.Errorf("Tor control authentication failed: %v", err)
+	}
+	return nil
+}
+
+// torCommand sends a command and returns the lines of a successful reply, without
+// their status codes and the final "OK"
+func torCommand(conn *textproto.Conn, command string) ([]string, error) {
+	if err := conn.PrintfLine("%s", command); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		code, sep, text := line[:3], line[3], line[4:]
+		if code != "250" {
+			return nil, fmt.Errorf("%s", text)
+		}
+		switch sep {
+		case ' ':
+			return lines, nil
+		case '-':
+			lines = append(lines, text)
+		case '+':
+			// A data reply runs until a line holding a single dot
+			data, err := conn.ReadDotLines()
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, text)
+			lines = append(lines, data...)
+		default:
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+	}
+}
+
+// torFields splits a reply line into space-separated fields, keeping quoted values
+// (with their quotes and escapes removed) whole
+func torFields(s string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			field.WriteByte(s[i])
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// torQuote quotes s as a control protocol string
+func torQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// SetOnionAddress makes /health report the onion service the hub is published as
+func (s *Server) SetOnionAddress(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onionAddress = address
+}
@@ -0,0 +1,429 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// The API is also published as an OpenAPI 3.0 document at /openapi.json, for
+// third-party clients and tooling. It is built from the same endpoints table and
+// types as /schema, so the two cannot drift apart, and Handler checks the table
+// against its routes. pkg/clspapi holds a typed client generated from it.
+
+// OpenAPIVersion is the OpenAPI specification version the document follows
+const OpenAPIVersion = "3.0.3"
+
+// Security schemes of the OpenAPI document
+const (
+	securityAdmin = "adminToken"
+	securityOIDC  = "oidcToken"
+)
+
+// OpenAPIDocument is an OpenAPI 3.0 document, limited to what the hub's API uses
+type OpenAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Servers    []OpenAPIServer                  `json:"servers"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components OpenAPIComponents                `json:"components"`
+}
+
+// OpenAPIInfo describes the API as a whole
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+// OpenAPIServer is a URL the paths are relative to
+type OpenAPIServer struct {
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPIComponents holds the schemas and security schemes operations refer to
+type OpenAPIComponents struct {
+	Schemas         map[string]*JSONSchema    `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme is an HTTP authentication scheme
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme"`
+	Description string `json:"description,omitempty"`
+}
+
+// Operation is one method of one path
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	// Auth is the scheme of EndpointSchema.Auth; signed requests carry their
+	// signature in the query parameters
+	Auth string `json:"x-clsp-auth"`
+	// Paginated operations set X-Next-Cursor while more items remain
+	Paginated bool `json:"x-clsp-paginated,omitempty"`
+}
+
+// Parameter is a query or path parameter
+type Parameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *JSONSchema `json:"schema"`
+}
+
+// RequestBody is the body an operation accepts
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is one response of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// Header is a response header
+type Header struct {
+	Description string      `json:"description"`
+	Schema      *JSONSchema `json:"schema"`
+}
+
+// MediaType gives the schema of a body in one content type
+type MediaType struct {
+	Schema *JSONSchema `json:"schema"`
+}
+
+// JSONSchema is the subset of the OpenAPI schema object the hub's types need; an
+// empty schema allows any value
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+}
+
+// OpenAPI describes the hub's API as an OpenAPI document. Unlike /schema it leaves
+// out the hub's current limits, so every hub of a version serves the same document.
+func OpenAPI() *OpenAPIDocument {
+	b := newOpenAPIBuilder()
+	doc := &OpenAPIDocument{
+		OpenAPI: OpenAPIVersion,
+		Info: OpenAPIInfo{
+			Title:       "clsp hub",
+			Description: "Relay and directory of clsp end-to-end encrypted messages. Signed requests carry the query parameters user_id, ts and sig; see /schema for how they are signed and for the hub's limits.",
+			Version:     fmt.Sprintf("%d", SchemaVersion),
+		},
+		Servers: []OpenAPIServer{{URL: APIPrefix, Description: "the current protocol version, relative to the hub's URL"}},
+		Paths:   make(map[string]map[string]*Operation),
+		Components: OpenAPIComponents{
+			Schemas: b.schemas,
+			SecuritySchemes: map[string]SecurityScheme{
+				securityAdmin: {Type: "http", Scheme: "bearer", Description: "Admin token from 'clsp-hub admin-token'"},
+				securityOIDC:  {Type: "http", Scheme: "bearer", Description: "OIDC ID token, required only when require_oidc is set"},
+			},
+		},
+	}
+	for _, ep := range endpoints {
+		if doc.Paths[ep.Path] == nil {
+			doc.Paths[ep.Path] = make(map[string]*Operation)
+		}
+		doc.Paths[ep.Path][strings.ToLower(ep.Method)] = b.operation(ep)
+	}
+	return doc
+}
+
+// openAPIBuilder converts endpoints and their Go types to OpenAPI
+type openAPIBuilder struct {
+	schemas map[string]*JSONSchema
+	// names maps the types of schemaTypes to their names there
+	names map[reflect.Type]string
+}
+
+func newOpenAPIBuilder() *openAPIBuilder {
+	b := &openAPIBuilder{
+		schemas: make(map[string]*JSONSchema),
+		names:   map[reflect.Type]string{reflect.TypeOf(Schema{}): "Schema"},
+	}
+	for name, v := range schemaTypes {
+		b.names[reflect.TypeOf(v)] = name
+	}
+	return b
+}
+
+// operation converts one endpoint
+func (b *openAPIBuilder) operation(ep EndpointSchema) *Operation {
+	op := &Operation{
+		OperationID: operationID(ep.Method, ep.Path),
+		Summary:     ep.Description,
+		Responses:   make(map[string]*Response),
+		Auth:        ep.Auth,
+		Paginated:   ep.Paginated,
+	}
+	switch ep.Auth {
+	case AuthAdmin:
+		op.Security = []map[string][]string{{securityAdmin: {}}}
+	case AuthOIDC:
+		// The token is optional unless the hub requires SSO
+		op.Security = []map[string][]string{{securityOIDC: {}}, {}}
+	}
+
+	for _, segment := range strings.Split(ep.Path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:     strings.Trim(segment, "{}"),
+				In:       "path",
+				Required: true,
+				Schema:   &JSONSchema{Type: "string"},
+			})
+		}
+	}
+	for _, p := range ep.Query {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name:        p.Name,
+			In:          "query",
+			Description: p.Description,
+			Required:    p.Required,
+			Schema:      paramSchema(p.Type),
+		})
+	}
+
+	switch {
+	case ep.RequestMedia != "":
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{
+			ep.RequestMedia: {Schema: &JSONSchema{Type: "string", Format: "binary"}},
+		}}
+	case ep.Request != "":
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{
+			"application/json": {Schema: b.named(ep.Request)},
+		}}
+		if ep.Protobuf {
+			op.RequestBody.Content[crypto.ContentTypeProtobuf] = MediaType{Schema: &JSONSchema{Type: "string", Format: "binary"}}
+		}
+	}
+
+	success := &Response{Description: http.StatusText(ep.Status)}
+	switch {
+	case ep.ResponseMedia == "text/event-stream":
+		success.Description = "Stream of " + ep.Response + " events"
+		success.Content = map[string]MediaType{ep.ResponseMedia: {Schema: b.named(ep.Response)}}
+	case ep.ResponseMedia == "application/json":
+		success.Content = map[string]MediaType{ep.ResponseMedia: {Schema: &JSONSchema{Type: "object"}}}
+	case ep.ResponseMedia != "":
+		success.Content = map[string]MediaType{ep.ResponseMedia: {Schema: &JSONSchema{Type: "string", Format: "binary"}}}
+	case ep.Response != "":
+		success.Content = map[string]MediaType{"application/json": {Schema: b.named(ep.Response)}}
+		if ep.Protobuf && op.RequestBody == nil {
+			success.Content[crypto.ContentTypeProtobuf] = MediaType{Schema: &JSONSchema{Type: "string", Format: "binary"}}
+		}
+	}
+	if ep.Paginated {
+		success.Headers = map[string]Header{
+			"X-Next-Cursor": {Description: "cursor of the next page, absent on the last", Schema: &JSONSchema{Type: "string"}},
+		}
+	}
+	op.Responses[fmt.Sprintf("%d", ep.Status)] = success
+
+	if op.RequestBody != nil {
+		op.Responses["413"] = &Response{
+			Description: "The body exceeds a hub limit",
+			Content:     map[string]MediaType{"application/json": {Schema: b.named("SizeLimitError")}},
+		}
+	}
+	op.Responses["default"] = &Response{
+		Description: "The error, in plain text",
+		Content:     map[string]MediaType{"text/plain": {Schema: &JSONSchema{Type: "string"}}},
+	}
+	return op
+}
+
+// named returns the schema of a name used in EndpointSchema, "[]T" being an array
+func (b *openAPIBuilder) named(name string) *JSONSchema {
+	if elem, ok := strings.CutPrefix(name, "[]"); ok {
+		return &JSONSchema{Type: "array", Items: b.named(elem)}
+	}
+	if name == "Schema" {
+		return b.ref(reflect.TypeOf(Schema{}))
+	}
+	v, ok := schemaTypes[name]
+	if !ok {
+		panic(fmt.Sprintf("hub: endpoint refers to unknown type %s", name))
+	}
+	return b.ref(reflect.TypeOf(v))
+}
+
+// ref adds struct type t to the components and returns a reference to it
+func (b *openAPIBuilder) ref(t reflect.Type) *JSONSchema {
+	name, ok := b.names[t]
+	if !ok {
+		name = t.Name()
+	}
+	if _, done := b.schemas[name]; !done {
+		// Claim the name first, so recursive types terminate
+		b.schemas[name] = nil
+		b.schemas[name] = b.object(t)
+	}
+	return &JSONSchema{Ref: "#/components/schemas/" + name}
+}
+
+// object converts the JSON fields of a struct type; fields that are neither
+// omitempty nor pointers are required
+func (b *openAPIBuilder) object(t reflect.Type) *JSONSchema {
+	schema := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// Embedded structs contribute their fields
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := b.object(f.Type)
+			for k, v := range embedded.Properties {
+				schema.Properties[k] = v
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema.Properties[name] = b.field(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// field converts the type of a field
+func (b *openAPIBuilder) field(t reflect.Type) *JSONSchema {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return &JSONSchema{Type: "integer", Format: "int64", Description: "duration in nanoseconds"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return &JSONSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.field(t.Elem())
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &JSONSchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: b.field(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: b.field(t.Elem())}
+	case reflect.Struct:
+		if t.Name() != "" {
+			return b.ref(t)
+		}
+		return b.object(t)
+	}
+	return &JSONSchema{}
+}
+
+// paramSchema converts a ParamSchema type
+func paramSchema(typ string) *JSONSchema {
+	switch typ {
+	case "integer":
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case "boolean":
+		return &JSONSchema{Type: "boolean"}
+	case "base64url":
+		return &JSONSchema{Type: "string", Format: "base64url"}
+	}
+	return &JSONSchema{Type: "string"}
+}
+
+// operationID names an operation after its method and path: GET /admin/users is
+// getAdminUsers and DELETE /message/{id} deleteMessageById
+func operationID(method, path string) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(method))
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			id.WriteString("By")
+			segment = strings.Trim(segment, "{}")
+		}
+		segment = strings.TrimSuffix(segment, ".json")
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			runes := []rune(word)
+			runes[0] = unicode.ToUpper(runes[0])
+			id.WriteString(string(runes))
+		}
+	}
+	return id.String()
+}
+
+// checkRoutes panics unless the routes registered by Handler and the paths in
+// endpoints are the same. A route ending in / serves the paths with a parameter
+// after it.
+func checkRoutes(patterns []string) {
+	routed := make(map[string]bool)
+	for _, pattern := range patterns {
+		routed[pattern] = true
+	}
+	documented := make(map[string]bool)
+	for _, ep := range endpoints {
+		route := ep.Path
+		if i := strings.Index(route, "{"); i >= 0 {
+			route = route[:i]
+		}
+		if !routed[route] {
+			panic(fmt.Sprintf("hub: %s %s is documented but not routed", ep.Method, ep.Path))
+		}
+		documented[route] = true
+	}
+	for _, pattern := range patterns {
+		if !documented[pattern] {
+			panic(fmt.Sprintf("hub: route %s is missing from the API description", pattern))
+		}
+	}
+}
+
+// handleOpenAPI serves the API as an OpenAPI document
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OpenAPI())
+}
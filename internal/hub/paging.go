@@ -0,0 +1,84 @@
+package hub
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NextCursorHeader carries the cursor for the next page of a paginated listing;
+// it is absent on the last page
+const NextCursorHeader = "X-Next-Cursor"
+
+// pageParams are the pagination and incremental sync parameters of a listing
+type pageParams struct {
+	// limit is the page size (zero returns everything)
+	limit int
+	// cursor positions the page after the last item of the previous one
+	cursorTime int64
+	cursorID   string
+	hasCursor  bool
+	// since keeps only items created or changed at or after this time (zero includes all)
+	since int64
+}
+
+// parsePageParams reads limit, cursor and since (unix seconds) from the query
+func parsePageParams(r *http.Request) (pageParams, error) {
+	var p pageParams
+	q := r.URL.Query()
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return p, fmt.Errorf("invalid limit")
+		}
+		p.limit = limit
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid since")
+		}
+		p.since = since
+	}
+	if v := q.Get("cursor"); v != "" {
+		ts, id, err := decodeCursor(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid cursor")
+		}
+		p.cursorTime, p.cursorID, p.hasCursor = ts, id, true
+	}
+	return p, nil
+}
+
+// encodeCursor returns an opaque cursor for the item with the given sort time and ID
+func encodeCursor(ts int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", ts, id)))
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(cursor string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+	tsStr, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return 0, "", fmt.Errorf("malformed cursor")
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return ts, id, nil
+}
+
+// setNextCursor advertises the next page when the query returned more than a page
+func setNextCursor(w http.ResponseWriter, p pageParams, fetched int, last time.Time, lastID string) {
+	if p.limit > 0 && fetched > p.limit {
+		w.Header().Set(NextCursorHeader, encodeCursor(last.Unix(), lastID))
+	}
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// maxPrekeyBody bounds the size of a prekey upload
+const maxPrekeyBody = 4096
+
+// handlePrekey publishes a user's new X25519 prekey in the directory. The request is
+// signed by the user, and the prekey itself must carry the user's signature, since
+// senders rely on it to agree message keys.
+func (s *Server) handlePrekey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	var prekey crypto.Prekey
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrekeyBody)).Decode(&prekey); err != nil {
+		http.Error(w, "Invalid prekey", http.StatusBadRequest)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" || prekey.ID == "" {
+		http.Error(w, "User ID and prekey required", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.verifySignedRequest(ctx, r, "prekey", userID, prekey.ID)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var publicKeyPEM string
+	err = s.db.QueryRowContext(ctx, "SELECT public_key FROM users WHERE id = ?", userID).Scan(&publicKeyPEM)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM))
+	if err != nil {
+		http.Error(w, "Invalid registered key", http.StatusBadRequest)
+		return
+	}
+	if err := prekey.Verify(publicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := json.Marshal(&prekey)
+	if err != nil {
+		http.Error(w, "Invalid prekey", http.StatusBadRequest)
+		return
+	}
+	// Bumping updated_at lets incremental directory syncs pick up the new prekey
+	_, err = s.db.ExecContext(ctx, "UPDATE users SET prekey = ?, updated_at = ? WHERE id = ?", string(encoded), time.Now().Unix(), userID)
+	if err != nil {
+		dbError(w, ctx, "Failed to store prekey")
+		return
+	}
+
+	s.logf(LogInfo, userID, "Prekey %s published", prekey.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Preset is a bundle of settings for a kind of deployment. Presets are applied when
+// the hub starts and override the stored configuration for that run only.
+type Preset struct {
+	Name        string
+	Description string
+
+	// TempDB runs the hub on a throwaway database in the system temp directory
+	TempDB bool
+	// RequireTLS refuses to start without a certificate or ACME domain
+	RequireTLS bool
+	// CORSOrigins are the browser origins allowed to call the hub ("*" for any)
+	CORSOrigins []string
+	// LogLevel is the lowest level logged
+	LogLevel string
+
+	// apply adjusts the hub configuration
+	apply func(cfg *HubConfig)
+}
+
+// presets are the bundles selectable with 'clsp-hub -preset'
+var presets = map[string]Preset{
+	"dev": {
+		Name:        "dev",
+		Description: "local development: temporary database, any CORS origin, debug logging, lenient limits",
+		TempDB:      true,
+		CORSOrigins: []string{"*"},
+		LogLevel:    LogDebug,
+		apply: func(cfg *HubConfig) {
+			cfg.MessageExpiry = 24 * time.Hour
+			cfg.ClockSkewTolerance = 0
+			cfg.DedupeWindow = 0
+			cfg.UserPurgeDelay = time.Hour
+		},
+	},
+	"prod": {
+		Name:        "prod",
+		Description: "production: TLS required, no CORS, strict size, clock and duplicate limits",
+		RequireTLS:  true,
+		LogLevel:    LogInfo,
+		apply: func(cfg *HubConfig) {
+			cfg.HubTimeout = 10 * time.Second
+			cfg.ClockSkewTolerance = 2 * time.Minute
+			cfg.DedupeWindow = time.Minute
+			cfg.MaxMessageSize = 64 * 1024
+			if cfg.RateLimit <= 0 || cfg.RateLimit > 60 {
+				cfg.RateLimit = 60
+			}
+		},
+	},
+}
+
+// LookupPreset returns the named preset
+func LookupPreset(name string) (Preset, error) {
+	p, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+	}
+	return p, nil
+}
+
+// PresetNames lists the available presets
+func PresetNames() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TempDBPath returns the database path used by presets with TempDB set
+func (p Preset) TempDBPath() string {
+	return filepath.Join(os.TempDir(), "clsp-hub-"+p.Name, "hub.db")
+}
+
+// CheckTLS fails if the preset requires TLS and opts do not enable it
+func (p Preset) CheckTLS(opts TLSOptions) error {
+	if p.RequireTLS && !opts.Enabled() {
+		return fmt.Errorf("the %s preset requires TLS; pass -tls-cert/-tls-key or -acme-domain", p.Name)
+	}
+	return nil
+}
+
+// ApplyPreset applies a preset's settings to the running configuration (not saved)
+func (s *Server) ApplyPreset(p Preset) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.apply != nil {
+		p.apply(&s.config)
+	}
+	s.corsOrigins = p.CORSOrigins
+	if p.LogLevel != "" {
+		s.logLevel = p.LogLevel
+	}
+}
+
+// SetLogLevel sets the lowest level that is logged
+func (s *Server) SetLogLevel(level string) error {
+	if !ValidLogLevel(level) {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logLevel = level
+	return nil
+}
+
+// withCORS answers preflight requests and adds CORS headers for allowed origins
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		origins := s.corsOrigins
+		s.mu.RUnlock()
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := false
+		for _, o := range origins {
+			if o == "*" || o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Expose-Headers", NextCursorHeader+", "+ProtocolHeader)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+ProtocolHeader)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,289 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultInviteTTL is how long an invite code stays valid unless told otherwise
+const DefaultInviteTTL = 14 * 24 * time.Hour
+
+// ProvisionEntry describes an account to pre-create
+type ProvisionEntry struct {
+	DisplayName string
+	Email       string
+	// Source identifies where the entry came from (e.g. "csv" or an LDAP DN) so
+	// repeated syncs do not provision the same person twice
+	Source string
+}
+
+// Invite is a provisioned account and, right after creation, its plaintext invite code.
+// /invite answers an InviteCode with an Invite without user ID and display name.
+type Invite struct {
+	UserID      string     `json:"user_id"`
+	DisplayName string     `json:"display_name"`
+	Email       string     `json:"email,omitempty"`
+	Code        string     `json:"code,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+}
+
+// ProvisionResult reports the outcome of a provisioning run
+type ProvisionResult struct {
+	Created []Invite
+	// Skipped maps display names to the reason they were not provisioned
+	Skipped map[string]string
+}
+
+// newInviteCode returns a random, human-typeable invite code such as ABCD-EFGH-IJKL-MNOP
+func newInviteCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	var groups []string
+	for i := 0; i < len(raw); i += 4 {
+		groups = append(groups, raw[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// hashInviteCode normalizes an invite code and returns the hash stored in the database
+func hashInviteCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ProvisionUsers pre-creates accounts with invite codes. Entries whose display name is
+// already registered or provisioned, or whose source was provisioned before, are skipped.
+func (s *Server) ProvisionUsers(ctx context.Context, entries []ProvisionEntry, ttl time.Duration) (*ProvisionResult, error) {
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	result := &ProvisionResult{Skipped: make(map[string]string)}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, e := range entries {
+		name := strings.TrimSpace(e.DisplayName)
+		if name == "" {
+			continue
+		}
+
+		var taken bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS(SELECT 1 FROM users WHERE display_name = ?)
+				OR EXISTS(SELECT 1 FROM provisioned_users WHERE display_name = ? AND claimed_at IS NULL)`,
+			name, name,
+		).Scan(&taken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check display name: %v", err)
+		}
+		if taken {
+			result.Skipped[name] = "display name already in use"
+			continue
+		}
+
+		if e.Source != "" {
+			var seen bool
+			err := tx.QueryRowContext(ctx,
+				"SELECT EXISTS(SELECT 1 FROM provisioned_users WHERE source = ?)", e.Source,
+			).Scan(&seen)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check source: %v", err)
+			}
+			if seen {
+				result.Skipped[name] = "already provisioned"
+				continue
+			}
+		}
+
+		code, err := newInviteCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate invite code: %v", err)
+		}
+		invite := Invite{
+			UserID:      uuid.New().String(),
+			DisplayName: name,
+			Email:       strings.TrimSpace(e.Email),
+			Code:        code,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO provisioned_users (id, display_name, email, source, invite_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			invite.UserID, invite.DisplayName, invite.Email, e.Source, hashInviteCode(code), now.Unix(), invite.ExpiresAt.Unix(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision %s: %v", name, err)
+		}
+		result.Created = append(result.Created, invite)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit provisioning: %v", err)
+	}
+	for _, invite := range result.Created {
+		s.audit(ctx, "provision.create", invite.UserID, map[string]interface{}{"display_name": invite.DisplayName, "expires_at": invite.ExpiresAt.UTC()})
+	}
+	return result, nil
+}
+
+// ListInvites returns provisioned accounts; unless all is set, only unclaimed ones
+func (s *Server) ListInvites(ctx context.Context, all bool) ([]Invite, error) {
+	query := "SELECT id, display_name, email, created_at, expires_at, claimed_at FROM provisioned_users"
+	if !all {
+		query += " WHERE claimed_at IS NULL"
+	}
+	query += " ORDER BY created_at, display_name"
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %v", err)
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		var inv Invite
+		var createdAt, expiresAt int64
+		var claimedAt sql.NullInt64
+		if err := rows.Scan(&inv.UserID, &inv.DisplayName, &inv.Email, &createdAt, &expiresAt, &claimedAt); err != nil {
+			return nil, fmt.Errorf("failed to read invite: %v", err)
+		}
+		inv.CreatedAt = time.Unix(createdAt, 0)
+		inv.ExpiresAt = time.Unix(expiresAt, 0)
+		if claimedAt.Valid {
+			t := time.Unix(claimedAt.Int64, 0)
+			inv.ClaimedAt = &t
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInvite deletes an unclaimed provisioned account by user ID or display name
+func (s *Server) RevokeInvite(ctx context.Context, idOrName string) error {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM provisioned_users WHERE (id = ? OR display_name = ?) AND claimed_at IS NULL",
+		idOrName, idOrName,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no unclaimed invite for %s", idOrName)
+	}
+	s.audit(ctx, "provision.revoke", idOrName, nil)
+	return nil
+}
+
+// handleInvite resolves an invite code to the identity reserved for it, or to an empty
+// identity for an invite code that lets its holder choose one
+func (s *Server) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Invite code required", http.StatusBadRequest)
+		return
+	}
+
+	var inv Invite
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, display_name, expires_at FROM provisioned_users WHERE invite_hash = ? AND claimed_at IS NULL",
+		hashInviteCode(code),
+	).Scan(&inv.UserID, &inv.DisplayName, &expiresAt)
+	if err == sql.ErrNoRows {
+		open, err := s.lookupInviteCode(ctx, code)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if open == nil {
+			http.Error(w, "Invalid or expired invite code", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Invite{ExpiresAt: open.ExpiresAt})
+		return
+	}
+	if err == nil && time.Now().Unix() > expiresAt {
+		http.Error(w, "Invalid or expired invite code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	inv.ExpiresAt = time.Unix(expiresAt, 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// checkProvisioned enforces reservations made by provisioning during registration.
+// It returns an HTTP status and message when the registration must be refused, and
+// whether the registration claims a provisioned account.
+func checkProvisioned(ctx context.Context, tx StoreTx, userID, displayName, inviteCode string) (int, string, bool, error) {
+	var reservedName, inviteHash string
+	var expiresAt int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT display_name, invite_hash, expires_at FROM provisioned_users WHERE id = ? AND claimed_at IS NULL",
+		userID,
+	).Scan(&reservedName, &inviteHash, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", false, err
+	}
+
+	if err == sql.ErrNoRows {
+		// Unclaimed provisioned names are reserved for their invitees
+		var reserved bool
+		err := tx.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM provisioned_users WHERE display_name = ? AND claimed_at IS NULL)",
+			displayName,
+		).Scan(&reserved)
+		if err != nil {
+			return 0, "", false, err
+		}
+		if reserved {
+			return http.StatusConflict, "Display name already taken", false, nil
+		}
+		return 0, "", false, nil
+	}
+
+	if inviteCode == "" || hashInviteCode(inviteCode) != inviteHash || time.Now().Unix() > expiresAt {
+		return http.StatusForbidden, "Invalid or expired invite code", false, nil
+	}
+	if displayName != reservedName {
+		return http.StatusForbidden, "Display name does not match the invite", false, nil
+	}
+	return 0, "", true, nil
+}
@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ReadProvisionCSV parses a CSV file with a header row. A display_name (or name)
+// column is required; an email column is optional.
+func ReadProvisionCSV(r io.Reader) ([]ProvisionEntry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+
+	nameCol, emailCol := -1, -1
+	for i, col := range header {
+		switch strings.ToLower(strings.TrimSpace(col)) {
+		case "display_name", "name":
+			nameCol = i
+		case "email", "mail":
+			emailCol = i
+		}
+	}
+	if nameCol < 0 {
+		return nil, fmt.Errorf("CSV header must include a display_name column")
+	}
+
+	var entries []ProvisionEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %v", err)
+		}
+		if nameCol >= len(record) {
+			continue
+		}
+		entry := ProvisionEntry{DisplayName: record[nameCol]}
+		if emailCol >= 0 && emailCol < len(record) {
+			entry.Email = record[emailCol]
+		}
+		if entry.Email != "" {
+			entry.Source = "email:" + strings.ToLower(strings.TrimSpace(entry.Email))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// LDAPSource describes the directory query used by an LDAP sync
+type LDAPSource struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	Filter       string
+	NameAttr     string
+	EmailAttr    string
+}
+
+// ReadProvisionLDAP searches an LDAP directory and returns one entry per matching
+// object, keyed by DN so repeated syncs only provision new people
+func ReadProvisionLDAP(src LDAPSource) ([]ProvisionEntry, error) {
+	conn, err := ldap.DialURL(src.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %v", err)
+	}
+	defer conn.Close()
+
+	if src.BindDN != "" {
+		if err := conn.Bind(src.BindDN, src.BindPassword); err != nil {
+			return nil, fmt.Errorf("LDAP bind failed: %v", err)
+		}
+	}
+
+	filter := src.Filter
+	if filter == "" {
+		filter = "(objectClass=person)"
+	}
+	nameAttr := src.NameAttr
+	if nameAttr == "" {
+		nameAttr = "cn"
+	}
+	emailAttr := src.EmailAttr
+	if emailAttr == "" {
+		emailAttr = "mail"
+	}
+
+	req := ldap.NewSearchRequest(
+		src.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{nameAttr, emailAttr},
+		nil,
+	)
+	res, err := conn.SearchWithPaging(req, 500)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %v", err)
+	}
+
+	entries := make([]ProvisionEntry, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		name := e.GetAttributeValue(nameAttr)
+		if name == "" {
+			continue
+		}
+		entries = append(entries, ProvisionEntry{
+			DisplayName: name,
+			Email:       e.GetAttributeValue(emailAttr),
+			Source:      "ldap:" + strings.ToLower(e.DN),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,132 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Receipt policies, which decide the senders who see when a user fetched and read
+// their messages
+const (
+	ReceiptsEveryone = "everyone" // every sender (the default)
+	ReceiptsContacts = "contacts" // only users the recipient has sent a message to
+	ReceiptsNone     = "none"     // no sender
+)
+
+// ReceiptSettings are a user's receipt policy
+type ReceiptSettings struct {
+	Receipts string `json:"receipts"`
+}
+
+// receiptPolicy returns a user's receipt policy
+func (s *Server) receiptPolicy(ctx context.Context, userID string) (string, error) {
+	var policy sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT receipts FROM users WHERE id = ?", userID).Scan(&policy)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if policy.String == "" {
+		return ReceiptsEveryone, nil
+	}
+	return policy.String, nil
+}
+
+// receiptsAllowed reports whether the recipient's policy lets the sender see when
+// their messages are delivered and read
+func (s *Server) receiptsAllowed(ctx context.Context, recipientID, senderID string) (bool, error) {
+	policy, err := s.receiptPolicy(ctx, recipientID)
+	if err != nil {
+		return false, err
+	}
+	switch policy {
+	case ReceiptsNone:
+		return false, nil
+	case ReceiptsContacts:
+		var contact bool
+		err := s.db.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?)",
+			recipientID, senderID,
+		).Scan(&contact)
+		return contact, err
+	}
+	return true, nil
+}
+
+// recordContact notes that userID sent a message to contactID, which makes contactID
+// one of userID's contacts for the receipt policy
+func (s *Server) recordContact(ctx context.Context, userID, contactID string, now time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO contacts (user_id, contact_id, since) VALUES (?, ?, ?)",
+		userID, contactID, now.Unix(),
+	)
+	return err
+}
+
+// handleReceipts returns (GET) or sets (POST) the calling user's receipt policy,
+// signed over the method and the SHA-256 of the body. The policy applies to messages
+// already stored as well as to new ones.
+func (s *Server) handleReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "receipts", userID, r.Method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var settings ReceiptSettings
+		if err := json.Unmarshal(body, &settings); err != nil {
+			http.Error(w, "Invalid receipt settings", http.StatusBadRequest)
+			return
+		}
+		switch settings.Receipts {
+		case ReceiptsEveryone, ReceiptsContacts, ReceiptsNone:
+		default:
+			http.Error(w, "Receipts must be everyone, contacts or none", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.db.ExecContext(ctx, "UPDATE users SET receipts = ? WHERE id = ?", settings.Receipts, userID); err != nil {
+			dbError(w, ctx, "Failed to store receipt settings")
+			return
+		}
+		s.logf(LogInfo, userID, "Receipt policy set to %s", settings.Receipts)
+	}
+
+	policy, err := s.receiptPolicy(ctx, userID)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReceiptSettings{Receipts: policy})
+}
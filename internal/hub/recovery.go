@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// maxRecoveryBody bounds the size of a recovery kit, which holds the user's key files
+// and configuration
+const maxRecoveryBody = 256 << 10
+
+// RecoveryKit is a user's identity encrypted with a key derived from their recovery
+// phrase. The hub only sees ciphertext, stored under an ID also derived from the
+// phrase, so only someone holding the phrase can fetch it.
+type RecoveryKit struct {
+	RecoveryID string `json:"recovery_id"`
+	Kit        []byte `json:"kit"`
+	// UserID is set when the hub returns a kit
+	UserID string `json:"user_id,omitempty"`
+}
+
+// handleRecovery stores (POST) or removes (DELETE) the calling user's recovery kit,
+// signed over the method and the SHA-256 of the body, or returns the kit stored under
+// ?id= (GET) to anyone who can derive that ID from the recovery phrase
+func (s *Server) handleRecovery(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if r.Method == http.MethodGet {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Recovery ID required", http.StatusBadRequest)
+			return
+		}
+		kit := RecoveryKit{RecoveryID: id}
+		err := s.db.QueryRowContext(ctx,
+			"SELECT id, recovery_kit FROM users WHERE recovery_id = ? AND deactivated_at IS NULL",
+			id,
+		).Scan(&kit.UserID, &kit.Kit)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No recovery kit for this phrase", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		s.logf(LogInfo, kit.UserID, "Recovery kit fetched")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(kit)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecoveryBody))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "recovery", userID, r.Method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var id, kit interface{}
+	if r.Method == http.MethodPost {
+		var req RecoveryKit
+		if err := json.Unmarshal(body, &req); err != nil || len(req.RecoveryID) != 64 || len(req.Kit) == 0 {
+			http.Error(w, "Invalid recovery kit", http.StatusBadRequest)
+			return
+		}
+		id, kit = req.RecoveryID, req.Kit
+	}
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE users SET recovery_id = ?, recovery_kit = ? WHERE id = ?",
+		id, kit, userID,
+	)
+	if err != nil {
+		dbError(w, ctx, "Failed to store recovery kit")
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.logf(LogInfo, userID, "Recovery kit stored")
+	} else {
+		s.logf(LogInfo, userID, "Recovery kit removed")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DailyUsage is the message volume stored on one day
+type DailyUsage struct {
+	Day      time.Time `json:"day"`
+	Messages int64     `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// TopTalker is a sender ranked by stored bytes over the report period
+type TopTalker struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Messages    int64  `json:"messages"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// SizeBucket is one bucket of the message size distribution
+type SizeBucket struct {
+	Label    string `json:"label"`
+	Messages int64  `json:"messages"`
+}
+
+// CapacityReport summarizes storage usage and growth for capacity planning
+type CapacityReport struct {
+	Since          time.Time    `json:"since"`
+	DatabaseBytes  int64        `json:"database_bytes"`
+	StoredMessages int64        `json:"stored_messages"`
+	StoredBytes    int64        `json:"stored_bytes"`
+	Daily          []DailyUsage `json:"daily"`
+	TopTalkers     []TopTalker  `json:"top_talkers"`
+	Sizes          []SizeBucket `json:"sizes"`
+
+	// IngestPerDay is the average bytes stored per day over the period
+	IngestPerDay float64 `json:"ingest_per_day"`
+	// GrowthPerDay is the ingest rate minus the rate at which messages currently expire
+	GrowthPerDay float64 `json:"growth_per_day"`
+	// DiskFreeBytes is the free space on the database volume (-1 if unknown)
+	DiskFreeBytes int64 `json:"disk_free_bytes"`
+	// DaysToFull is the projected number of days until the volume fills (zero if not growing or unknown)
+	DaysToFull float64 `json:"days_to_full"`
+}
+
+// Report builds a capacity report over the last days days, listing up to top senders
+func (s *Server) Report(ctx context.Context, days, top int) (*CapacityReport, error) {
+	now := time.Now()
+	since := time.Unix(statsDay(now.AddDate(0, 0, -(days-1))), 0)
+	report := &CapacityReport{Since: since, DiskFreeBytes: -1}
+
+	if size := s.db.Size(ctx); size >= 0 {
+		report.DatabaseBytes = size
+	}
+
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(LENGTH(content)), 0) FROM messages",
+	).Scan(&report.StoredMessages, &report.StoredBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure stored messages: %v", err)
+	}
+
+	// Storage growth per day
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT day, SUM(messages), SUM(bytes) FROM message_stats WHERE day >= ? GROUP BY day ORDER BY day",
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message stats: %v", err)
+	}
+	var ingested int64
+	for rows.Next() {
+		var day int64
+		var usage DailyUsage
+		if err := rows.Scan(&day, &usage.Messages, &usage.Bytes); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read message stats: %v", err)
+		}
+		usage.Day = time.Unix(day, 0).UTC()
+		ingested += usage.Bytes
+		report.Daily = append(report.Daily, usage)
+	}
+	rows.Close()
+
+	// Top talkers
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT st.sender_id, COALESCE(u.display_name, ''), SUM(st.messages), SUM(st.bytes)
+		FROM message_stats st LEFT JOIN users u ON u.id = st.sender_id
+		WHERE st.day >= ?
+		GROUP BY st.sender_id, u.display_name
+		ORDER BY SUM(st.bytes) DESC
+		LIMIT ?`,
+		since.Unix(), top,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read top talkers: %v", err)
+	}
+	for rows.Next() {
+		var t TopTalker
+		if err := rows.Scan(&t.UserID, &t.DisplayName, &t.Messages, &t.Bytes); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read top talkers: %v", err)
+		}
+		report.TopTalkers = append(report.TopTalkers, t)
+	}
+	rows.Close()
+
+	// Message size distribution
+	counts := make([]int64, len(sizeBucketLabels))
+	rows, err = s.db.QueryContext(ctx,
+		"SELECT bucket, SUM(messages) FROM message_size_stats WHERE day >= ? GROUP BY bucket",
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read size stats: %v", err)
+	}
+	for rows.Next() {
+		var bucket int
+		var n int64
+		if err := rows.Scan(&bucket, &n); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read size stats: %v", err)
+		}
+		if bucket >= 0 && bucket < len(counts) {
+			counts[bucket] += n
+		}
+	}
+	rows.Close()
+	for i, label := range sizeBucketLabels {
+		report.Sizes = append(report.Sizes, SizeBucket{Label: label, Messages: counts[i]})
+	}
+
+	// Messages stored one expiry period ago are the ones expiring now, so their
+	// volume approximates what cleanup removes each day
+	report.IngestPerDay = float64(ingested) / float64(days)
+	expiry := s.Config().MessageExpiry
+	var expiring int64
+	err = s.db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(bytes), 0) FROM message_stats WHERE day >= ? AND day < ?",
+		since.Add(-expiry).Unix(), now.Add(-expiry).Unix(),
+	).Scan(&expiring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message stats: %v", err)
+	}
+	report.GrowthPerDay = report.IngestPerDay - float64(expiring)/float64(days)
+
+	// The volume of a database server is not the hub's to measure
+	if s.db.Driver() != DriverSQLite {
+		return report, nil
+	}
+	if free, err := diskFree(s.dataDir); err == nil {
+		report.DiskFreeBytes = free
+		if report.GrowthPerDay > 0 {
+			report.DaysToFull = float64(free) / report.GrowthPerDay
+		}
+	}
+
+	return report, nil
+}
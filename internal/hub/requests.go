@@ -0,0 +1,217 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Actions on the message requests of /requests
+const (
+	RequestAccept  = "accept"  // move a sender's messages to the inbox and make them a contact
+	RequestDecline = "decline" // delete a sender's pending messages
+	RequestsOn     = "on"      // hold messages from first-time senders as requests
+	RequestsOff    = "off"     // deliver every message to the inbox (the default)
+)
+
+// MessageRequest summarizes the messages a first-time sender is waiting to have
+// accepted. Their content stays on the hub, out of the recipient's inbox, until then.
+type MessageRequest struct {
+	SenderID string `json:"sender_id"`
+	// SenderName and PublicKey are the sender's directory entry, empty for users of
+	// other hubs
+	SenderName string    `json:"sender_name,omitempty"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	Messages   int       `json:"messages"`
+	FirstAt    time.Time `json:"first_at"`
+	LastAt     time.Time `json:"last_at"`
+}
+
+// RequestsAction is the body of POST /requests
+type RequestsAction struct {
+	Action string `json:"action"`
+	// SenderID is the sender whose request is accepted or declined
+	SenderID string `json:"sender_id,omitempty"`
+}
+
+// RequestsResult is the response of /requests
+type RequestsResult struct {
+	// Enabled is set when the user holds messages from first-time senders as requests
+	Enabled  bool             `json:"enabled"`
+	Requests []MessageRequest `json:"requests"`
+}
+
+// isMessageRequest reports whether a message from senderID must wait for recipientID
+// to accept it: the recipient turned message requests on, and never wrote to the
+// sender or accepted them before
+func (s *Server) isMessageRequest(ctx context.Context, recipientID, senderID string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRowContext(ctx, "SELECT message_requests FROM users WHERE id = ?", recipientID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil || !enabled {
+		return false, err
+	}
+	var contact bool
+	err = s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?)",
+		recipientID, senderID,
+	).Scan(&contact)
+	return !contact, err
+}
+
+// messageRequests lists the senders waiting for userID to accept them, oldest first
+func (s *Server) messageRequests(ctx context.Context, userID string, now time.Time) ([]MessageRequest, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.sender_id, COALESCE(u.display_name, ''), COALESCE(u.public_key, ''), COUNT(*), MIN(m.created_at), MAX(m.created_at)
+		FROM messages m LEFT JOIN users u ON u.id = m.sender_id
+		WHERE m.recipient_id = ? AND m.request = 1 AND m.expires_at > ?
+		GROUP BY m.sender_id, u.display_name, u.public_key
+		ORDER BY MIN(m.created_at)`,
+		userID, now.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []MessageRequest{}
+	for rows.Next() {
+		var req MessageRequest
+		var first, last int64
+		if err := rows.Scan(&req.SenderID, &req.SenderName, &req.PublicKey, &req.Messages, &first, &last); err != nil {
+			return nil, err
+		}
+		req.FirstAt = time.Unix(first, 0)
+		req.LastAt = time.Unix(last, 0)
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// answerRequest accepts or declines the pending messages of senderID to userID and
+// returns how many there were. Accepting makes the sender a contact, so their later
+// messages go straight to the inbox.
+func (s *Server) answerRequest(ctx context.Context, userID, senderID string, accept bool, now time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if accept {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO contacts (user_id, contact_id, since) VALUES (?, ?, ?)",
+			userID, senderID, now.Unix(),
+		); err != nil {
+			return 0, err
+		}
+		result, err = tx.ExecContext(ctx, "UPDATE messages SET request = 0 WHERE recipient_id = ? AND sender_id = ? AND request = 1", userID, senderID)
+	} else {
+		result, err = tx.ExecContext(ctx, "DELETE FROM messages WHERE recipient_id = ? AND sender_id = ? AND request = 1", userID, senderID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	if accept && n > 0 {
+		s.inbox.notify(userID)
+	}
+	return n, nil
+}
+
+// handleRequests lists the calling user's message requests (GET), or accepts or
+// declines one, or turns requests on or off (POST), signed over the method and the
+// SHA-256 of the body. Messages held as requests are left out of /messages.
+func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "requests", userID, r.Method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var action RequestsAction
+		if err := json.Unmarshal(body, &action); err != nil {
+			http.Error(w, "Invalid request action", http.StatusBadRequest)
+			return
+		}
+		switch action.Action {
+		case RequestAccept, RequestDecline:
+			if action.SenderID == "" {
+				http.Error(w, "Sender ID required", http.StatusBadRequest)
+				return
+			}
+			n, err := s.answerRequest(ctx, userID, action.SenderID, action.Action == RequestAccept, time.Now())
+			if err != nil {
+				dbError(w, ctx, "Failed to answer message request")
+				return
+			}
+			if n == 0 && action.Action == RequestDecline {
+				http.Error(w, "No message request from this sender", http.StatusNotFound)
+				return
+			}
+			if action.Action == RequestAccept {
+				s.logf(LogInfo, userID, "Accepted message request from %s (%d message(s))", action.SenderID, n)
+			} else {
+				s.logf(LogInfo, userID, "Declined message request from %s (%d message(s) deleted)", action.SenderID, n)
+			}
+		case RequestsOn, RequestsOff:
+			if _, err := s.db.ExecContext(ctx, "UPDATE users SET message_requests = ? WHERE id = ?", action.Action == RequestsOn, userID); err != nil {
+				dbError(w, ctx, "Failed to store message request settings")
+				return
+			}
+			s.logf(LogInfo, userID, "Message requests turned %s", action.Action)
+		default:
+			http.Error(w, "Action must be accept, decline, on or off", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var result RequestsResult
+	if err := s.db.QueryRowContext(ctx, "SELECT message_requests FROM users WHERE id = ?", userID).Scan(&result.Enabled); err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if result.Requests, err = s.messageRequests(ctx, userID, time.Now()); err != nil {
+		dbError(w, ctx, "Failed to list message requests")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
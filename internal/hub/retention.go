@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RetentionRule limits how long messages of one kind are kept in each delivery state.
+// Undelivered counts from when the message was stored, Delivered from when it was
+// first fetched (so it also covers read messages) and Read from when the recipient
+// marked it read. Zero leaves the message to its own expiry, which a rule can only
+// shorten.
+type RetentionRule struct {
+	Undelivered time.Duration `json:"undelivered,omitempty"`
+	Delivered   time.Duration `json:"delivered,omitempty"`
+	Read        time.Duration `json:"read,omitempty"`
+}
+
+// RetentionPolicy holds separate rules for plain messages and for messages carrying
+// an uploaded attachment, which are usually far larger
+type RetentionPolicy struct {
+	Text        RetentionRule `json:"text"`
+	Attachments RetentionRule `json:"attachments"`
+}
+
+// retentionParams maps the query parameters of PUT /admin/retention to the rule
+// durations they set
+func retentionParams(p *RetentionPolicy) map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"text_undelivered":        &p.Text.Undelivered,
+		"text_delivered":          &p.Text.Delivered,
+		"text_read":               &p.Text.Read,
+		"attachments_undelivered": &p.Attachments.Undelivered,
+		"attachments_delivered":   &p.Attachments.Delivered,
+		"attachments_read":        &p.Attachments.Read,
+	}
+}
+
+// SetRetention replaces the retention policy
+func (s *Server) SetRetention(policy RetentionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Retention = policy
+}
+
+// applyRetention deletes the messages the retention policy no longer keeps, returning
+// how many were deleted. Their attachments go with the next cleanupAttachments pass.
+func (s *Server) applyRetention(ctx context.Context, now time.Time) (int64, error) {
+	policy := s.Config().Retention
+	var total int64
+	for _, kind := range []struct {
+		rule      RetentionRule
+		condition string
+	}{
+		{policy.Text, "attachment_id IS NULL"},
+		{policy.Attachments, "attachment_id IS NOT NULL"},
+	} {
+		for _, state := range []struct {
+			age         time.Duration
+			condition   string
+			undelivered bool
+		}{
+			{kind.rule.Undelivered, "fetched_at IS NULL AND created_at <= ?", true},
+			{kind.rule.Delivered, "fetched_at <= ?", false},
+			{kind.rule.Read, "read_at <= ?", false},
+		} {
+			if state.age <= 0 {
+				continue
+			}
+			where := kind.condition + " AND " + state.condition
+			cutoff := now.Add(-state.age).Unix()
+			// Undelivered purges count towards the delivery stats like expiries do
+			if state.undelivered {
+				if err := s.recordUnfetched(ctx, now, where, cutoff); err != nil {
+					return total, err
+				}
+			}
+			result, err := s.db.ExecContext(ctx, "DELETE FROM messages WHERE "+where, cutoff)
+			if err != nil {
+				return total, fmt.Errorf("failed to apply retention policy: %v", err)
+			}
+			n, _ := result.RowsAffected()
+			total += n
+		}
+	}
+	if total > 0 {
+		s.logf(LogInfo, "", "Retention policy removed %d messages", total)
+	}
+	return total, nil
+}
+
+// handleAdminRetention shows (GET) or changes (PUT) the retention policy. PUT takes
+// the durations to change as query parameters, such as attachments_delivered=168h;
+// 0 clears a rule and parameters left out keep their current value.
+func (s *Server) handleAdminRetention(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		policy := s.Config().Retention
+		query := r.URL.Query()
+		for name, field := range retentionParams(&policy) {
+			v := query.Get(name)
+			if v == "" {
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid duration for "+name, http.StatusBadRequest)
+				return
+			}
+			*field = d
+		}
+		s.SetRetention(policy)
+		if err := s.SaveConfig(ctx); err != nil {
+			dbError(w, ctx, "Failed to save retention policy")
+			return
+		}
+		s.logf(LogInfo, "", "Retention policy changed by admin")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Config().Retention)
+}
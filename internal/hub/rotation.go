@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// maxRotationBody bounds the size of a key rotation request
+const maxRotationBody = 16 << 10
+
+// maxKeyRotations is the number of past rotations kept per user, enough for contacts
+// who were away through several rotations to follow them
+const maxKeyRotations = 20
+
+// KeyRotationRequest is the body of POST /key/rotate
+type KeyRotationRequest struct {
+	UserID   string             `json:"user_id"`
+	Rotation crypto.KeyRotation `json:"rotation"`
+	// SigningKeySig certifies the user's signing key with the new key
+	SigningKeySig []byte `json:"signing_key_sig"`
+}
+
+// handleKeyRotate replaces a user's RSA key with one announced by a key rotation. The
+// rotation authenticates the request: it must be signed by the registered key and by
+// the registered signing key, which stays in place certified by the new key. Prekeys
+// were signed by the old key, so the current one is dropped.
+func (s *Server) handleKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	var req KeyRotationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRotationBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid key rotation", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.Rotation.PublicKey == "" {
+		http.Error(w, "User ID and rotation required", http.StatusBadRequest)
+		return
+	}
+
+	var publicKey string
+	var signingKey, rotationsJSON sql.NullString
+	var banned bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT public_key, signing_key, key_rotations, banned_at IS NOT NULL FROM users WHERE id = ? AND deactivated_at IS NULL",
+		req.UserID,
+	).Scan(&publicKey, &signingKey, &rotationsJSON, &banned)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if banned {
+		http.Error(w, "Account is banned", http.StatusForbidden)
+		return
+	}
+	if signingKey.String == "" {
+		http.Error(w, "Key rotation needs a registered signing key", http.StatusConflict)
+		return
+	}
+	if req.Rotation.PreviousKey != publicKey {
+		http.Error(w, "Rotation does not start from the registered key", http.StatusConflict)
+		return
+	}
+
+	signingPublicKey, err := crypto.LoadSigningPublicKeyFromPEM(signingKey.String)
+	if err != nil {
+		http.Error(w, "Invalid registered signing key", http.StatusBadRequest)
+		return
+	}
+	if err := req.Rotation.Verify(signingPublicKey); err != nil {
+		s.logf(LogWarn, req.UserID, "Key rotation rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	newKey, err := crypto.LoadPublicKeyFromPEM([]byte(req.Rotation.PublicKey))
+	if err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	if _, err := crypto.VerifySigningKey(newKey, signingKey.String, req.SigningKeySig); err != nil {
+		http.Error(w, "Invalid signing key certificate", http.StatusBadRequest)
+		return
+	}
+
+	var rotations []crypto.KeyRotation
+	if rotationsJSON.String != "" {
+		if err := json.Unmarshal([]byte(rotationsJSON.String), &rotations); err != nil {
+			rotations = nil
+		}
+	}
+	rotations = append(rotations, req.Rotation)
+	if len(rotations) > maxKeyRotations {
+		rotations = rotations[len(rotations)-maxKeyRotations:]
+	}
+	encoded, err := json.Marshal(rotations)
+	if err != nil {
+		http.Error(w, "Invalid key rotation", http.StatusBadRequest)
+		return
+	}
+
+	// The previous key must still be the registered one, in case another rotation won
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE users SET public_key = ?, signing_key_sig = ?, prekey = NULL, key_rotations = ?, updated_at = ? WHERE id = ? AND public_key = ?",
+		req.Rotation.PublicKey, req.SigningKeySig, string(encoded), time.Now().Unix(), req.UserID, publicKey,
+	)
+	if err != nil {
+		dbError(w, ctx, "Failed to store key rotation")
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Rotation does not start from the registered key", http.StatusConflict)
+		return
+	}
+
+	s.logf(LogInfo, req.UserID, "Key rotated")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,422 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// SchemaVersion is bumped whenever an endpoint, parameter or shape in the schema
+// changes incompatibly; additions keep the version
+const SchemaVersion = 1
+
+// Authentication schemes named in EndpointSchema.Auth
+const (
+	AuthNone   = "none"   // no credentials
+	AuthSigned = "signed" // user_id, ts and sig query parameters signed by the user's key
+	AuthAdmin  = "admin"  // Authorization: Bearer <admin token>
+	AuthOIDC   = "oidc"   // Authorization: Bearer <OIDC ID token> when the hub requires SSO
+)
+
+// Schema is the machine-readable description of the hub's API served at /schema
+type Schema struct {
+	Version int `json:"version"`
+	// BasePath prefixes every endpoint path; hubs also serve the bare paths, for
+	// clients that predate it
+	BasePath string `json:"base_path"`
+	// MessageVersions lists the message envelope formats the hub relays
+	MessageVersions []int        `json:"message_versions"`
+	Limits          SchemaLimits `json:"limits"`
+	// Auth describes each authentication scheme
+	Auth      map[string]string `json:"auth"`
+	Endpoints []EndpointSchema  `json:"endpoints"`
+	// Types describes the JSON objects named in endpoint shapes, field by field
+	Types map[string]map[string]string `json:"types"`
+}
+
+// SchemaLimits are the hub's current limits (zero means unlimited)
+type SchemaLimits struct {
+	MaxMessageSize  int   `json:"max_message_size"`
+	RateLimit       int   `json:"rate_limit"`
+	MaxStorageBytes int64 `json:"max_storage_bytes"`
+	MaxUsers        int   `json:"max_users"`
+	// MaxAttachmentSize caps the encrypted size of an uploaded attachment
+	MaxAttachmentSize int64 `json:"max_attachment_size"`
+	// MessageExpiry and ClockSkewTolerance are in seconds
+	MessageExpiry      int64 `json:"message_expiry_seconds"`
+	ClockSkewTolerance int64 `json:"clock_skew_tolerance_seconds"`
+}
+
+// EndpointSchema describes one method of one endpoint
+type EndpointSchema struct {
+	Method      string        `json:"method"`
+	Path        string        `json:"path"`
+	Description string        `json:"description"`
+	Auth        string        `json:"auth"`
+	Query       []ParamSchema `json:"query,omitempty"`
+	// Request and Response name a type in Schema.Types; "[]T" is an array of T
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+	// RequestMedia and ResponseMedia are the content types of bodies that are not
+	// JSON; Response then names the type of each item of a stream
+	RequestMedia  string `json:"request_media,omitempty"`
+	ResponseMedia string `json:"response_media,omitempty"`
+	// Status is the status code of a successful response
+	Status int `json:"status"`
+	// Paginated endpoints accept limit, cursor and since and set X-Next-Cursor
+	Paginated bool `json:"paginated,omitempty"`
+	// Protobuf endpoints also take their envelope (with Content-Type) or serve their
+	// envelopes (with Accept) as protobuf; see EnvelopeFormats
+	Protobuf bool `json:"protobuf,omitempty"`
+}
+
+// ParamSchema describes a query parameter
+type ParamSchema struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// signedParams are the query parameters of a signed request
+var signedParams = []ParamSchema{
+	{Name: "user_id", Type: "string", Required: true, Description: "the signing user"},
+	{Name: "ts", Type: "integer", Required: true, Description: "unix time of the request, within the clock skew tolerance"},
+	{Name: "sig", Type: "base64url", Required: true, Description: "signature over the request payload"},
+}
+
+// pagedParams are the query parameters of a paginated listing
+var pagedParams = []ParamSchema{
+	{Name: "limit", Type: "integer", Description: "page size (all items when absent)"},
+	{Name: "cursor", Type: "string", Description: "X-Next-Cursor of the previous page"},
+	{Name: "since", Type: "integer", Description: "unix time; only items created or changed since"},
+}
+
+// endpoints lists the public API; Handler refuses to start when a route is missing
+// from it
+var endpoints = []EndpointSchema{
+	{Method: "GET", Path: "/health", Description: "Hub status, configuration and clock. Clients list the protocol versions they speak in X-CLSP-Protocol and the hub answers with the one it chose, or with 426 and the versions it speaks", Auth: AuthNone, Response: "Health", Status: 200},
+	{Method: "GET", Path: "/config", Description: "Hub configuration", Auth: AuthNone, Response: "HubConfig", Status: 200},
+	{Method: "GET", Path: "/schema", Description: "This description", Auth: AuthNone, Response: "Schema", Status: 200},
+	{Method: "GET", Path: "/openapi.json", Description: "This API as an OpenAPI 3.0 document", Auth: AuthNone, Status: 200, ResponseMedia: "application/json"},
+	{Method: "GET", Path: "/check-username", Description: "Whether a display name is free", Auth: AuthNone, Status: 200,
+		Query: []ParamSchema{{Name: "username", Type: "string", Required: true}}, Response: "UsernameAvailability"},
+	{Method: "POST", Path: "/register", Description: "Publish or re-announce an identity, optionally with an Ed25519 signing key certified by its RSA key; new accounts need an invite code when require_invite is set. The request is signed with the RSA key being registered, over the action register with the display name and the key's fingerprint as fields (401 without a valid signature); an account registered with another key answers 409, as its key is only replaced by a key rotation", Auth: AuthOIDC, Query: signedParams, Request: "Registration", Status: 201},
+	{Method: "GET", Path: "/users", Description: "Active user directory, ordered by ID", Auth: AuthNone, Response: "[]User", Status: 200, Paginated: true,
+		Query: append([]ParamSchema{
+			{Name: "online", Type: "boolean", Description: "only users seen recently"},
+			{Name: "search", Type: "string", Description: "display name search: each word must begin a word of the name"},
+		}, pagedParams...)},
+	{Method: "GET", Path: "/directory", Description: "Signed snapshot of the active users and their keys, for offline address books; rebuilt every 15 minutes", Auth: AuthNone, Response: "DirectorySnapshot", Status: 200},
+	{Method: "POST", Path: "/key/rotate", Description: "Replace the user's RSA key; the rotation must be signed by the registered key and signing key, and the request certifies the signing key with the new key", Auth: AuthNone, Request: "KeyRotationRequest", Status: 204},
+	{Method: "POST", Path: "/prekey", Description: "Publish the user's signed X25519 prekey", Auth: AuthSigned, Query: signedParams, Request: "Prekey", Status: 204},
+	{Method: "POST", Path: "/message", Description: "Store an encrypted message for its recipient, or queue it for the recipient's hub when addressed as id@hub (status relayed, 202); with dry_run the checks run but nothing is stored (status valid, 200). An expires_at set by the sender deletes it before the hub's message expiry. X-Quota-* headers report the sender's remaining outbound quota; 429 with Retry-After when it is used up, 413 with a SizeLimitError when the content or an inline attachment exceeds the hub's limits. The envelope may be sent as protobuf (Content-Type application/x-protobuf, a clsp.v1.Message). Signed by the sender over the SHA-256 of the body", Auth: AuthSigned, Request: "Message", Response: "SendResult", Status: 201, Protobuf: true,
+		Query: append([]ParamSchema{{Name: "dry_run", Type: "boolean", Description: "validate without storing"}}, signedParams...)},
+	{Method: "POST", Path: "/attachment", Description: "Reserve an upload of an encrypted attachment of the given size (413 with a SizeLimitError above max_attachment_size)", Auth: AuthSigned, Query: signedParams, Request: "AttachmentReservation", Response: "AttachmentStatus", Status: 201},
+	{Method: "PUT", Path: "/attachment", Description: "Append ciphertext at offset, which must equal the bytes received so far (409 returns the status to resume from)", Auth: AuthSigned, RequestMedia: "application/octet-stream", Response: "AttachmentStatus", Status: 200,
+		Query: append([]ParamSchema{{Name: "id", Type: "string", Required: true}, {Name: "offset", Type: "integer", Required: true}}, signedParams...)},
+	{Method: "GET", Path: "/attachment/status", Description: "Upload progress, for the uploader", Auth: AuthSigned, Response: "AttachmentStatus", Status: 200,
+		Query: append([]ParamSchema{{Name: "id", Type: "string", Required: true}}, signedParams...)},
+	{Method: "GET", Path: "/attachment", Description: "Attachment ciphertext, for the uploader and recipients of messages referring to it; supports Range", Auth: AuthSigned, ResponseMedia: "application/octet-stream", Status: 200,
+		Query: append([]ParamSchema{{Name: "id", Type: "string", Required: true}}, signedParams...)},
+	{Method: "GET", Path: "/message/status", Description: "Delivery state of a message, for its sender; receipts_disabled when the recipient's receipt policy hides it", Auth: AuthSigned, Response: "MessageStatus", Status: 200,
+		Query: append([]ParamSchema{{Name: "id", Type: "string", Required: true}}, signedParams...)},
+	{Method: "DELETE", Path: "/message/{id}", Description: "Delete a message, for its sender; signed over the message ID. Unfetched messages can be deleted until they expire, fetched ones only within unsend_window of being sent (409 after that); delivered reports that the recipient may still hold a copy", Auth: AuthSigned, Query: signedParams, Response: "UnsendResult", Status: 200},
+	{Method: "POST", Path: "/message/read", Description: "Mark received messages read, for their senders' read receipts; signed over the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "ReadRequest", Response: "ReadResult", Status: 200},
+	{Method: "GET", Path: "/messages", Description: "Received messages, newest first; marks them delivered, never read, so only the recipient may fetch them. Served as protobuf (a clsp.v1.FetchMessagesResponse) when Accept lists application/x-protobuf", Auth: AuthSigned, Response: "[]Message", Status: 200, Paginated: true, Protobuf: true,
+		Query: append(append([]ParamSchema{
+			{Name: "unread", Type: "boolean", Description: "only messages not marked read"},
+			{Name: "search", Type: "string", Description: "sender display name search, as for /users; content is encrypted and never searched"},
+		}, pagedParams...), signedParams...)},
+	{Method: "GET", Path: "/notifications", Description: "The user's webhook and quiet hours; signed over the method and the SHA-256 of the (empty) body", Auth: AuthSigned, Query: signedParams, Response: "NotificationSettings", Status: 200},
+	{Method: "POST", Path: "/notifications", Description: "Replace the user's webhook and quiet hours; signed over the method and the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "NotificationSettings", Response: "NotificationSettings", Status: 200},
+	{Method: "GET", Path: "/receipts", Description: "The user's receipt policy (everyone, contacts or none); signed over the method and the SHA-256 of the (empty) body", Auth: AuthSigned, Query: signedParams, Response: "ReceiptSettings", Status: 200},
+	{Method: "POST", Path: "/receipts", Description: "Set which senders see when the user fetched and read their messages; contacts are the users they sent a message to. Signed over the method and the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "ReceiptSettings", Response: "ReceiptSettings", Status: 200},
+	{Method: "GET", Path: "/requests", Description: "Whether the user holds messages from first-time senders as requests, and the senders waiting to be accepted; signed over the method and the SHA-256 of the (empty) body", Auth: AuthSigned, Query: signedParams, Response: "RequestsResult", Status: 200},
+	{Method: "POST", Path: "/requests", Description: "Accept a sender (their messages go to /messages and they become a contact) or decline them (their messages are deleted, 404 when there are none), or turn requests on or off. Signed over the method and the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "RequestsAction", Response: "RequestsResult", Status: 200},
+	{Method: "GET", Path: "/devices", Description: "The devices the user's clients announced, most recently seen first; signed over the method and the SHA-256 of the (empty) body", Auth: AuthSigned, Query: signedParams, Response: "[]Device", Status: 200},
+	{Method: "POST", Path: "/devices", Description: "Record that a device of the user is in use, under the ID and name it chose; the devices seen longest ago are forgotten beyond twenty. Answers with the devices; signed over the method and the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "Device", Response: "[]Device", Status: 200},
+	{Method: "POST", Path: "/recovery", Description: "Store the user's recovery kit, encrypted with a key derived from their recovery phrase; signed over the method and the SHA-256 of the body", Auth: AuthSigned, Query: signedParams, Request: "RecoveryKit", Status: 204},
+	{Method: "DELETE", Path: "/recovery", Description: "Remove the user's recovery kit; signed over the method and the SHA-256 of the (empty) body", Auth: AuthSigned, Query: signedParams, Status: 204},
+	{Method: "GET", Path: "/recovery", Description: "The recovery kit stored under an ID derived from a recovery phrase", Auth: AuthNone, Response: "RecoveryKit", Status: 200,
+		Query: []ParamSchema{{Name: "id", Type: "string", Required: true}}},
+	{Method: "DELETE", Path: "/account", Description: "Delete the user's account at once, with their profile, presence, stored messages sent or received, attachments, contacts, usage, devices, log entries and pending or failed webhook notifications and relays of their messages; signed with the account key", Auth: AuthSigned, Query: signedParams, Response: "AccountDeletion", Status: 200},
+	{Method: "GET", Path: "/account/export", Description: "Everything the hub holds about the user, with stored messages as their encrypted envelopes; signed with the account key", Auth: AuthSigned, Query: signedParams, Response: "AccountExport", Status: 200},
+	{Method: "GET", Path: "/federation/key", Description: "The name and public key this hub signs federation requests with; 404 when it does not federate", Auth: AuthNone, Response: "FederationKey", Status: 200},
+	{Method: "GET", Path: "/federation/user", Description: "Directory entry of a user of any federated hub, with ID and display name qualified as name@hub; other hubs are asked on the client's behalf when a user of this hub signs the request over the address", Auth: AuthNone, Response: "User", Status: 200,
+		Query: []ParamSchema{
+			{Name: "address", Type: "string", Required: true, Description: "name@hub or id@hub"},
+			{Name: "user_id", Type: "string", Description: "the signing user; user_id, ts and sig are required for addresses of other hubs"},
+			{Name: "ts", Type: "integer", Description: "unix time of the request, within the clock skew tolerance"},
+			{Name: "sig", Type: "base64url", Description: "signature over the address"},
+		}},
+	{Method: "POST", Path: "/federation/deliver", Description: "Store a message relayed by another hub, whose key signs the request in the X-Clsp-Hub, X-Clsp-Hub-Timestamp and X-Clsp-Hub-Signature headers; the key is pinned on first contact, which is only made with hubs this hub's users addressed or its admin allows (403 otherwise, 429 while too many hubs make first contact)", Auth: AuthNone, Request: "Message", Status: 204},
+	{Method: "GET", Path: "/announcements", Description: "Signed service announcements", Auth: AuthNone, Response: "AnnouncementFeed", Status: 200},
+	{Method: "GET", Path: "/invite", Description: "Identity reserved by an invite code; user ID and display name are empty for an invite code that lets its holder choose them", Auth: AuthNone, Response: "Invite", Status: 200,
+		Query: []ParamSchema{{Name: "code", Type: "string", Required: true}}},
+	{Method: "GET", Path: "/admin/report", Description: "Capacity planning report", Auth: AuthAdmin, Response: "CapacityReport", Status: 200,
+		Query: []ParamSchema{{Name: "days", Type: "integer"}, {Name: "top", Type: "integer"}}},
+	{Method: "GET", Path: "/admin/metrics", Description: "Delivery latency and backlog", Auth: AuthAdmin, Response: "DeliveryMetrics", Status: 200,
+		Query: []ParamSchema{{Name: "days", Type: "integer"}, {Name: "top", Type: "integer"}}},
+	{Method: "GET", Path: "/admin/deadletters", Description: "Outbound delivery queue and dead letters", Auth: AuthAdmin, Response: "DeliveryQueue", Status: 200},
+	{Method: "POST", Path: "/admin/deadletters", Description: "Requeue a dead letter", Auth: AuthAdmin, Status: 204,
+		Query: []ParamSchema{{Name: "id", Type: "string", Required: true}}},
+	{Method: "DELETE", Path: "/admin/deadletters", Description: "Discard a dead letter", Auth: AuthAdmin, Status: 204,
+		Query: []ParamSchema{{Name: "id", Type: "string", Required: true}}},
+	{Method: "GET", Path: "/admin/users", Description: "Accounts with their stored message volume", Auth: AuthAdmin, Response: "[]UserSummary", Status: 200,
+		Query: []ParamSchema{{Name: "all", Type: "boolean", Description: "include deactivated and banned accounts"}}},
+	{Method: "DELETE", Path: "/admin/users", Description: "Delete an account and its messages immediately", Auth: AuthAdmin, Response: "PurgeResult", Status: 200,
+		Query: []ParamSchema{{Name: "user", Type: "string", Required: true, Description: "user ID or display name"}}},
+	{Method: "POST", Path: "/admin/bans", Description: "Ban an account", Auth: AuthAdmin, Status: 204,
+		Query: []ParamSchema{{Name: "user", Type: "string", Required: true, Description: "user ID or display name"}, {Name: "reason", Type: "string"}}},
+	{Method: "DELETE", Path: "/admin/bans", Description: "Lift a ban", Auth: AuthAdmin, Status: 204,
+		Query: []ParamSchema{{Name: "user", Type: "string", Required: true, Description: "user ID or display name"}}},
+	{Method: "DELETE", Path: "/admin/messages", Description: "Purge stored messages", Auth: AuthAdmin, Response: "PurgeResult", Status: 200,
+		Query: []ParamSchema{
+			{Name: "user", Type: "string", Description: "only messages sent or received by this user"},
+			{Name: "before", Type: "integer", Description: "only messages stored before this Unix time"},
+			{Name: "all", Type: "boolean", Description: "required when no other filter is given"},
+		}},
+	{Method: "GET", Path: "/admin/stats", Description: "Account, storage and pending delivery counts, database size and uptime", Auth: AuthAdmin, Response: "HubStats", Status: 200},
+	{Method: "GET", Path: "/admin/retention", Description: "Current retention policy", Auth: AuthAdmin, Response: "RetentionPolicy", Status: 200},
+	{Method: "PUT", Path: "/admin/retention", Description: "Change the retention policy; durations such as 168h, 0 clears a rule and parameters left out keep their value", Auth: AuthAdmin, Response: "RetentionPolicy", Status: 200,
+		Query: []ParamSchema{
+			{Name: "text_undelivered", Type: "string", Description: "keep messages without an attachment this long while never fetched"},
+			{Name: "text_delivered", Type: "string", Description: "keep messages without an attachment this long after they were fetched"},
+			{Name: "text_read", Type: "string", Description: "keep messages without an attachment this long after they were read"},
+			{Name: "attachments_undelivered", Type: "string", Description: "keep messages with an attachment this long while never fetched"},
+			{Name: "attachments_delivered", Type: "string", Description: "keep messages with an attachment this long after they were fetched"},
+			{Name: "attachments_read", Type: "string", Description: "keep messages with an attachment this long after they were read"},
+		}},
+	{Method: "GET", Path: "/admin/quotas", Description: "Default outbound quota and senders with their own; with user, that sender's quota and usage too", Auth: AuthAdmin, Response: "QuotaSettings", Status: 200,
+		Query: []ParamSchema{{Name: "user", Type: "string", Description: "user ID or display name"}}},
+	{Method: "PUT", Path: "/admin/quotas", Description: "Change the default outbound quota, or give user their own; 0 turns a limit off and parameters left out keep their value", Auth: AuthAdmin, Response: "QuotaSettings", Status: 200,
+		Query: []ParamSchema{
+			{Name: "user", Type: "string", Description: "override this sender's quota instead of the default"},
+			{Name: "hourly_messages", Type: "integer", Description: "messages per clock hour"},
+			{Name: "daily_messages", Type: "integer", Description: "messages per UTC day"},
+			{Name: "hourly_bytes", Type: "integer", Description: "bytes per clock hour, envelopes and attachments"},
+			{Name: "daily_bytes", Type: "integer", Description: "bytes per UTC day, envelopes and attachments"},
+			{Name: "burst", Type: "integer", Description: "messages sendable at once, refilled at this many per minute"},
+		}},
+	{Method: "DELETE", Path: "/admin/quotas", Description: "Return a sender to the default outbound quota", Auth: AuthAdmin, Response: "QuotaSettings", Status: 200,
+		Query: []ParamSchema{{Name: "user", Type: "string", Required: true, Description: "user ID or display name"}}},
+	{Method: "GET", Path: "/admin/gc", Description: "What a garbage collection pass would do now: unused accounts to warn or deactivate, unreferenced attachments and files", Auth: AuthAdmin, Response: "GCReport", Status: 200},
+	{Method: "POST", Path: "/admin/gc", Description: "Run a garbage collection pass now (the hub also runs one hourly)", Auth: AuthAdmin, Response: "GCReport", Status: 200},
+	{Method: "PUT", Path: "/admin/gc", Description: "Change the inactivity policy and report what a pass would do under it; 0 clears a duration and parameters left out keep their value", Auth: AuthAdmin, Response: "GCReport", Status: 200,
+		Query: []ParamSchema{
+			{Name: "inactive_after", Type: "string", Description: "warn the owners of accounts unused this long, such as 4320h (0 keeps unused accounts)"},
+			{Name: "inactive_notice", Type: "string", Description: "deactivate warned accounts still unused after this long (0 uses 336h)"},
+		}},
+	{Method: "GET", Path: "/admin/events", Description: "Operational events (registrations, bans, quota trips, federation failures) as a text/event-stream of Event, each with its ID and kind; the last 256 since the hub started are replayed, then the stream follows new ones", Auth: AuthAdmin, Response: "Event", ResponseMedia: "text/event-stream", Status: 200,
+		Query: []ParamSchema{
+			{Name: "since", Type: "integer", Description: "replay only events after this ID (also taken from Last-Event-ID)"},
+			{Name: "kind", Type: "string", Description: "comma-separated kinds to stream: registration, ban, rate_limit, federation_failure"},
+			{Name: "follow", Type: "boolean", Description: "false ends the stream after the replay"},
+		}},
+	{Method: "GET", Path: "/admin/audit", Description: "The append-only audit log of admin and destructive actions (bans, deletions, purges, configuration changes), oldest first; format=jsonl exports it as JSON Lines", Auth: AuthAdmin, Response: "[]AuditEntry", Status: 200,
+		Query: []ParamSchema{
+			{Name: "since", Type: "integer", Description: "only entries from this Unix time on"},
+			{Name: "action", Type: "string", Description: "only this action, such as user.ban, or this category, such as user"},
+			{Name: "actor", Type: "string", Description: "only entries by this actor"},
+			{Name: "target", Type: "string", Description: "only entries about this target, such as a user ID"},
+			{Name: "limit", Type: "integer", Description: "at most this many of the newest entries"},
+			{Name: "format", Type: "string", Description: "json (default) or jsonl"},
+		}},
+	{Method: "GET", Path: "/admin/invites", Description: "Invite codes that can still admit a registration, without the codes themselves", Auth: AuthAdmin, Response: "[]InviteCode", Status: 200,
+		Query: []ParamSchema{{Name: "all", Type: "boolean", Description: "include used up and expired codes"}}},
+	{Method: "POST", Path: "/admin/invites", Description: "Mint an invite code; the plaintext code is returned only in this response", Auth: AuthAdmin, Response: "InviteCode", Status: 201,
+		Query: []ParamSchema{
+			{Name: "uses", Type: "integer", Description: "registrations the code admits (default 1)"},
+			{Name: "ttl", Type: "string", Description: "validity such as 72h, 0 for none (default 336h)"},
+			{Name: "note", Type: "string", Description: "who or what the code is for"},
+		}},
+	{Method: "DELETE", Path: "/admin/invites", Description: "Revoke an invite code; accounts it admitted are kept", Auth: AuthAdmin, Status: 204,
+		Query: []ParamSchema{{Name: "id", Type: "string", Required: true}}},
+}
+
+// schemaTypes are the named JSON shapes referenced by endpoints
+var schemaTypes = map[string]interface{}{
+	"HubConfig":          HubConfig{},
+	"RetentionPolicy":    RetentionPolicy{},
+	"GCReport":           GCReport{},
+	"SendQuota":          SendQuota{},
+	"SenderQuota":        SenderQuota{},
+	"QuotaSettings":      QuotaSettings{},
+	"User":               User{},
+	"DirectorySnapshot":  DirectorySnapshot{},
+	"DirectoryEntry":     crypto.DirectoryEntry{},
+	"Registration":       registerRequest{},
+	"Prekey":             crypto.Prekey{},
+	"KeyRotationRequest": KeyRotationRequest{},
+	"KeyRotation":        crypto.KeyRotation{},
+	"Message":            crypto.Message{},
+	"MessagePart":        crypto.MessagePart{},
+	"Attachment":         crypto.Attachment{},
+	"SendResult":         SendResult{},
+	"SizeLimitError":     SizeLimitError{},
+	"AttachmentStatus":   AttachmentStatus{},
+	"AttachmentReservation": struct {
+		Size int64 `json:"size"`
+	}{},
+	"MessageStatus":        MessageStatus{},
+	"ReadRequest":          ReadRequest{},
+	"ReadResult":           ReadResult{},
+	"UnsendResult":         UnsendResult{},
+	"Announcement":         Announcement{},
+	"AnnouncementFeed":     AnnouncementFeed{},
+	"Invite":               Invite{},
+	"InviteCode":           InviteCode{},
+	"Event":                Event{},
+	"CapacityReport":       CapacityReport{},
+	"DeliveryMetrics":      DeliveryMetrics{},
+	"DeliveryQueue":        DeliveryQueue{},
+	"UserSummary":          UserSummary{},
+	"PurgeResult":          PurgeResult{},
+	"HubStats":             HubStats{},
+	"AuditEntry":           AuditEntry{},
+	"NotificationSettings": NotificationSettings{},
+	"ReceiptSettings":      ReceiptSettings{},
+	"RequestsAction":       RequestsAction{},
+	"RequestsResult":       RequestsResult{},
+	"MessageRequest":       MessageRequest{},
+	"RecoveryKit":          RecoveryKit{},
+	"Device":               Device{},
+	"AccountDeletion":      AccountDeletion{},
+	"AccountExport":        AccountExport{},
+	"FederationKey":        FederationKey{},
+	"MessageNotification":  MessageNotification{},
+	"UsernameAvailability": struct {
+		Available bool `json:"available"`
+	}{},
+	"Health": struct {
+		Status           string    `json:"status"`
+		Config           HubConfig `json:"config"`
+		ServerTime       time.Time `json:"server_time"`
+		ProtocolVersions []int     `json:"protocol_versions"`
+		EnvelopeFormats  []string  `json:"envelope_formats"`
+	}{},
+}
+
+// BuildSchema describes the hub's API with its current limits
+func (s *Server) BuildSchema() Schema {
+	cfg := s.Config()
+	schema := Schema{
+		Version:         SchemaVersion,
+		BasePath:        APIPrefix,
+		MessageVersions: []int{crypto.MessageVersionCTR, crypto.MessageVersionGCM, crypto.MessageVersionX25519},
+		Limits: SchemaLimits{
+			MaxMessageSize:     cfg.MaxMessageSize,
+			RateLimit:          cfg.RateLimit,
+			MaxStorageBytes:    cfg.MaxStorageBytes,
+			MaxUsers:           cfg.MaxUsers,
+			MaxAttachmentSize:  cfg.MaxAttachmentSize,
+			MessageExpiry:      int64(cfg.MessageExpiry / time.Second),
+			ClockSkewTolerance: int64(cfg.ClockSkewTolerance / time.Second),
+		},
+		Auth: map[string]string{
+			AuthNone:   "no credentials",
+			AuthSigned: "query parameters user_id, ts (unix seconds) and sig: base64url PKCS#1 v1.5 SHA-256 signature by the user's key over \"clsp-request\\n<action>\\n<user_id>\\n<ts>\" followed by \"\\n<field>\" for each request field",
+			AuthAdmin:  "Authorization: Bearer <admin token from 'clsp-hub admin-token'>",
+			AuthOIDC:   "Authorization: Bearer <OIDC ID token>, required only when require_oidc is set",
+		},
+		Endpoints: endpoints,
+		Types:     make(map[string]map[string]string),
+	}
+	describeType(schema.Types, "Schema", reflect.TypeOf(Schema{}))
+	for name, v := range schemaTypes {
+		describeType(schema.Types, name, reflect.TypeOf(v))
+	}
+	return schema
+}
+
+// describeType adds the JSON fields of struct type t to types under name, along
+// with the named struct types its fields refer to
+func describeType(types map[string]map[string]string, name string, t reflect.Type) {
+	if _, done := types[name]; done {
+		return
+	}
+	types[name] = structFields(types, t)
+}
+
+// structFields maps the JSON fields of a struct type to type descriptions
+func structFields(types map[string]map[string]string, t reflect.Type) map[string]string {
+	fields := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// Embedded structs contribute their fields
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range structFields(types, f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		desc := describeField(types, f.Type)
+		if strings.Contains(opts, "omitempty") || f.Type.Kind() == reflect.Ptr {
+			desc += " (optional)"
+		}
+		fields[name] = desc
+	}
+	return fields
+}
+
+// describeField names the JSON type of a field, describing named structs in types
+func describeField(types map[string]map[string]string, t reflect.Type) string {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return "timestamp"
+	case t == reflect.TypeOf(time.Duration(0)):
+		return "duration (nanoseconds)"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return describeField(types, t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "base64"
+		}
+		return "[]" + describeField(types, t.Elem())
+	case reflect.Map:
+		return "map of " + describeField(types, t.Elem())
+	case reflect.Struct:
+		if t.Name() != "" {
+			describeType(types, t.Name(), t)
+			return t.Name()
+		}
+		return "object"
+	}
+	return t.Kind().String()
+}
+
+// handleSchema serves the API description
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.BuildSchema())
+}
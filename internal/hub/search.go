@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Message content reaches the hub encrypted, so the hub can only search metadata:
+// the display names of users, which /users?search= matches directly and
+// /messages?search= through the message's sender. Names are matched word by word,
+// each search word as a prefix, with a full-text index: FTS5 on SQLite and a GIN
+// index over to_tsvector on PostgreSQL. SQLite builds without FTS5 (the
+// sqlite_fts5 build tag) fall back to a substring scan.
+
+// userSearchMode is how a store looks up users by display name
+type userSearchMode int
+
+const (
+	// userSearchLike scans display names with LIKE
+	userSearchLike userSearchMode = iota
+	// userSearchFTS5 queries the users_fts table
+	userSearchFTS5
+	// userSearchPostgres queries the GIN index on display names
+	userSearchPostgres
+)
+
+// createUserSearch creates the full-text index over display names, if the database
+// supports one. On SQLite the index is an FTS5 table kept up to date by triggers.
+func createUserSearch(db Store) error {
+	if db.Driver() == DriverPostgres {
+		if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_users_display_name_fts ON users USING GIN (to_tsvector('simple', display_name))"); err != nil {
+			return fmt.Errorf("failed to index display names: %v", err)
+		}
+		return nil
+	}
+	available, err := hasFTS5(context.Background(), db)
+	if err != nil || !available {
+		return err
+	}
+	for _, statement := range []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(user_id UNINDEXED, display_name, tokenize = 'unicode61 remove_diacritics 2')",
+		`CREATE TRIGGER IF NOT EXISTS users_fts_insert AFTER INSERT ON users BEGIN
+			INSERT INTO users_fts (user_id, display_name) VALUES (new.id, new.display_name);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS users_fts_update AFTER UPDATE OF id, display_name ON users BEGIN
+			DELETE FROM users_fts WHERE user_id = old.id;
+			INSERT INTO users_fts (user_id, display_name) VALUES (new.id, new.display_name);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS users_fts_delete AFTER DELETE ON users BEGIN
+			DELETE FROM users_fts WHERE user_id = old.id;
+		END`,
+		// Users registered before the index, or while an interrupted run left it partial
+		"INSERT INTO users_fts (user_id, display_name) SELECT id, display_name FROM users WHERE id NOT IN (SELECT user_id FROM users_fts)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to index display names: %v", err)
+		}
+	}
+	return nil
+}
+
+// hasFTS5 reports whether the SQLite library the hub was built with has FTS5
+func hasFTS5(ctx context.Context, db Store) (bool, error) {
+	var enabled bool
+	if err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return false, fmt.Errorf("failed to check for FTS5: %v", err)
+	}
+	return enabled, nil
+}
+
+// prepareUserSearch returns how db is searched. A database migrated by a hub built
+// without FTS5 gets its index now; one indexed by a hub built with FTS5 cannot be
+// opened without it, since its triggers would fail every registration.
+func prepareUserSearch(ctx context.Context, db Store) (userSearchMode, error) {
+	if db.Driver() == DriverPostgres {
+		return userSearchPostgres, nil
+	}
+	available, err := hasFTS5(ctx, db)
+	if err != nil {
+		return userSearchLike, err
+	}
+	var indexed bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'users_fts')").Scan(&indexed); err != nil {
+		return userSearchLike, fmt.Errorf("failed to look for the search index: %v", err)
+	}
+	switch {
+	case available:
+		if !indexed {
+			if err := createUserSearch(db); err != nil {
+				return userSearchLike, err
+			}
+		}
+		return userSearchFTS5, nil
+	case indexed:
+		return userSearchLike, fmt.Errorf("the database has a full-text index but this hub was built without FTS5; rebuild it with -tags sqlite_fts5")
+	}
+	return userSearchLike, nil
+}
+
+// userSearchCondition returns an SQL condition selecting rows whose user ID column
+// belongs to a user whose display name matches search, with its arguments
+func (s *Server) userSearchCondition(column, search string) (string, []interface{}) {
+	words := searchWords(search)
+	if len(words) == 0 {
+		return "1 = 0", nil
+	}
+	switch s.userSearch {
+	case userSearchFTS5:
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = `"` + word + `"*`
+		}
+		return column + " IN (SELECT user_id FROM users_fts WHERE users_fts MATCH ?)", []interface{}{strings.Join(terms, " ")}
+	case userSearchPostgres:
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = word + ":*"
+		}
+		return column + " IN (SELECT id FROM users WHERE to_tsvector('simple', display_name) @@ to_tsquery('simple', ?))", []interface{}{strings.Join(terms, " & ")}
+	}
+	conditions := make([]string, len(words))
+	args := make([]interface{}, len(words))
+	for i, word := range words {
+		conditions[i] = "LOWER(display_name) LIKE ?"
+		args[i] = "%" + word + "%"
+	}
+	return column + " IN (SELECT id FROM users WHERE " + strings.Join(conditions, " AND ") + ")", args
+}
+
+// searchWords splits a search into lowercase words of letters and digits, the
+// tokens the full-text indexes hold
+func searchWords(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
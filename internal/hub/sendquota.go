@@ -0,0 +1,440 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Response headers of POST /message reporting what remains of the sender's outbound
+// quota, so clients can slow down before they are refused. Only limits the sender is
+// subject to are reported; the reset headers give the seconds until a window starts
+// over.
+const (
+	QuotaHourlyMessagesHeader = "X-Quota-Hourly-Messages-Remaining"
+	QuotaDailyMessagesHeader  = "X-Quota-Daily-Messages-Remaining"
+	QuotaHourlyBytesHeader    = "X-Quota-Hourly-Bytes-Remaining"
+	QuotaDailyBytesHeader     = "X-Quota-Daily-Bytes-Remaining"
+	QuotaBurstHeader          = "X-Quota-Burst-Remaining"
+	QuotaHourlyResetHeader    = "X-Quota-Hourly-Reset"
+	QuotaDailyResetHeader     = "X-Quota-Daily-Reset"
+)
+
+// SendQuota limits what one sender may send. Hourly limits apply to the current clock
+// hour and daily ones to the current UTC day; bytes count the stored envelope and any
+// uploaded attachment. Burst caps messages sent in quick succession: a sender may send
+// Burst messages at once, and the allowance refills at Burst messages per minute.
+// Zero leaves a limit off.
+type SendQuota struct {
+	HourlyMessages int64 `json:"hourly_messages,omitempty"`
+	DailyMessages  int64 `json:"daily_messages,omitempty"`
+	HourlyBytes    int64 `json:"hourly_bytes,omitempty"`
+	DailyBytes     int64 `json:"daily_bytes,omitempty"`
+	Burst          int64 `json:"burst,omitempty"`
+}
+
+// Limited reports whether any limit of the quota is set
+func (q SendQuota) Limited() bool {
+	return q != SendQuota{}
+}
+
+// quotaParams maps the query parameters of PUT /admin/quotas to the limits they set
+func quotaParams(q *SendQuota) map[string]*int64 {
+	return map[string]*int64{
+		"hourly_messages": &q.HourlyMessages,
+		"daily_messages":  &q.DailyMessages,
+		"hourly_bytes":    &q.HourlyBytes,
+		"daily_bytes":     &q.DailyBytes,
+		"burst":           &q.Burst,
+	}
+}
+
+// SendUsage is what a sender has sent in the current hour and day
+type SendUsage struct {
+	HourlyMessages int64 `json:"hourly_messages"`
+	DailyMessages  int64 `json:"daily_messages"`
+	HourlyBytes    int64 `json:"hourly_bytes"`
+	DailyBytes     int64 `json:"daily_bytes"`
+}
+
+// SenderQuota is the quota applying to one sender and their use of it
+type SenderQuota struct {
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	Quota       SendQuota `json:"quota"`
+	// Override is set when an admin gave the sender their own quota in place of the
+	// hub default
+	Override bool      `json:"override"`
+	Usage    SendUsage `json:"usage"`
+}
+
+// QuotaSettings are the default outbound quota and the senders with their own
+type QuotaSettings struct {
+	Default   SendQuota     `json:"default"`
+	Overrides []SenderQuota `json:"overrides"`
+	// Sender is the sender asked about, whether or not they have an override
+	Sender *SenderQuota `json:"sender,omitempty"`
+}
+
+// SetSendQuota sets the default outbound quota of every sender without an override
+func (s *Server) SetSendQuota(quota SendQuota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.SendQuota = quota
+}
+
+// senderQuota returns the quota applying to a sender and whether it is an override
+func (s *Server) senderQuota(ctx context.Context, userID string) (SendQuota, bool, error) {
+	var override sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT send_quota FROM users WHERE id = ?", userID).Scan(&override)
+	if err != nil && err != sql.ErrNoRows {
+		return SendQuota{}, false, err
+	}
+	if override.String != "" {
+		var quota SendQuota
+		if err := json.Unmarshal([]byte(override.String), &quota); err == nil {
+			return quota, true, nil
+		}
+	}
+	return s.Config().SendQuota, false, nil
+}
+
+// SetSenderQuota gives a sender their own outbound quota, or returns them to the hub
+// default when quota is nil
+func (s *Server) SetSenderQuota(ctx context.Context, idOrName string, quota *SendQuota) error {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if quota != nil {
+		data, err := json.Marshal(quota)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET send_quota = ? WHERE id = ?", value, id); err != nil {
+		return fmt.Errorf("failed to update send quota: %v", err)
+	}
+	if quota == nil {
+		s.logf(LogInfo, id, "Send quota override removed by admin")
+		s.audit(ctx, "quota.reset", id, nil)
+	} else {
+		s.logf(LogInfo, id, "Send quota override set by admin")
+		s.audit(ctx, "quota.set", id, map[string]interface{}{"quota": quota})
+	}
+	return nil
+}
+
+// quotaHour returns the start of the clock hour of t, the key of send_usage rows
+func quotaHour(t time.Time) int64 {
+	return t.UTC().Truncate(time.Hour).Unix()
+}
+
+// sendUsage sums what a sender sent in the current hour and UTC day
+func (s *Server) sendUsage(ctx context.Context, userID string, now time.Time) (SendUsage, error) {
+	var usage SendUsage
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE WHEN hour = ? THEN messages END), 0),
+			COALESCE(SUM(CASE WHEN hour = ? THEN bytes END), 0),
+			COALESCE(SUM(messages), 0), COALESCE(SUM(bytes), 0)
+		FROM send_usage WHERE sender_id = ? AND hour >= ?`,
+		quotaHour(now), quotaHour(now), userID, statsDay(now),
+	).Scan(&usage.HourlyMessages, &usage.HourlyBytes, &usage.DailyMessages, &usage.DailyBytes)
+	return usage, err
+}
+
+// recordSendUsage counts a stored message against its sender's quota
+func (s *Server) recordSendUsage(ctx context.Context, userID string, size int64, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO send_usage (sender_id, hour, messages, bytes) VALUES (?, ?, 1, ?)
+		ON CONFLICT(sender_id, hour) DO UPDATE SET messages = send_usage.messages + 1, bytes = send_usage.bytes + excluded.bytes`,
+		userID, quotaHour(now), size,
+	)
+	return err
+}
+
+// pruneSendUsage deletes usage of days past, which no quota counts any more
+func (s *Server) pruneSendUsage(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM send_usage WHERE hour < ?", statsDay(now))
+	return err
+}
+
+// burstBucket is a sender's allowance of messages sent in quick succession
+type burstBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// burstLimiter keeps the burst allowance of each sender in memory; it starts full
+// again when the hub restarts
+type burstLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*burstBucket
+}
+
+// take refills the sender's allowance for the time passed and, when consume is set,
+// uses one message of it. It returns the whole messages left and, when none was
+// available, how long until one is.
+func (l *burstLimiter) take(userID string, burst int64, now time.Time, consume bool) (int64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*burstBucket)
+	}
+	b, ok := l.buckets[userID]
+	if !ok {
+		b = &burstBucket{tokens: float64(burst), at: now}
+		l.buckets[userID] = b
+	}
+	perSecond := float64(burst) / 60
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.at).Seconds()*perSecond)
+	b.at = now
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	if consume {
+		b.tokens--
+	}
+	return int64(b.tokens), 0
+}
+
+// quotaCheck is the outcome of checking a message against its sender's quota
+type quotaCheck struct {
+	quota SendQuota
+	usage SendUsage
+	burst int64
+	now   time.Time
+	// exceeded names the limit that refused the message, retryAfter when it allows
+	// another one
+	exceeded   string
+	retryAfter time.Duration
+}
+
+// checkSendQuota checks whether a message of size bytes fits the sender's quota. The
+// message is counted against the burst allowance when consume is set; its hourly and
+// daily usage is recorded once stored.
+func (s *Server) checkSendQuota(ctx context.Context, userID string, size int64, now time.Time, consume bool) (*quotaCheck, error) {
+	quota, _, err := s.senderQuota(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	check := &quotaCheck{quota: quota, now: now}
+	if !quota.Limited() {
+		return check, nil
+	}
+	if check.usage, err = s.sendUsage(ctx, userID, now); err != nil {
+		return nil, err
+	}
+
+	nextHour := time.Unix(quotaHour(now), 0).Add(time.Hour).Sub(now)
+	nextDay := time.Unix(statsDay(now), 0).Add(24 * time.Hour).Sub(now)
+	for _, limit := range []struct {
+		name         string
+		limit, after int64
+		reset        time.Duration
+	}{
+		{"hourly message", quota.HourlyMessages, check.usage.HourlyMessages + 1, nextHour},
+		{"hourly byte", quota.HourlyBytes, check.usage.HourlyBytes + size, nextHour},
+		{"daily message", quota.DailyMessages, check.usage.DailyMessages + 1, nextDay},
+		{"daily byte", quota.DailyBytes, check.usage.DailyBytes + size, nextDay},
+	} {
+		if limit.limit > 0 && limit.after > limit.limit && limit.reset > check.retryAfter {
+			check.exceeded, check.retryAfter = limit.name, limit.reset
+		}
+	}
+	if quota.Burst > 0 {
+		var wait time.Duration
+		check.burst, wait = s.bursts.take(userID, quota.Burst, now, consume && check.exceeded == "")
+		if wait > 0 && check.exceeded == "" {
+			check.exceeded, check.retryAfter = "burst", wait
+		}
+	}
+	if check.exceeded == "" && consume {
+		check.usage.HourlyMessages++
+		check.usage.DailyMessages++
+		check.usage.HourlyBytes += size
+		check.usage.DailyBytes += size
+	}
+	return check, nil
+}
+
+// setHeaders reports the remaining quota in the response headers
+func (c *quotaCheck) setHeaders(h http.Header) {
+	remaining := func(header string, limit, used int64) {
+		if limit > 0 {
+			h.Set(header, strconv.FormatInt(max(limit-used, 0), 10))
+		}
+	}
+	remaining(QuotaHourlyMessagesHeader, c.quota.HourlyMessages, c.usage.HourlyMessages)
+	remaining(QuotaDailyMessagesHeader, c.quota.DailyMessages, c.usage.DailyMessages)
+	remaining(QuotaHourlyBytesHeader, c.quota.HourlyBytes, c.usage.HourlyBytes)
+	remaining(QuotaDailyBytesHeader, c.quota.DailyBytes, c.usage.DailyBytes)
+	if c.quota.Burst > 0 {
+		h.Set(QuotaBurstHeader, strconv.FormatInt(c.burst, 10))
+	}
+	if c.quota.HourlyMessages > 0 || c.quota.HourlyBytes > 0 {
+		reset := time.Unix(quotaHour(c.now), 0).Add(time.Hour).Sub(c.now)
+		h.Set(QuotaHourlyResetHeader, strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10))
+	}
+	if c.quota.DailyMessages > 0 || c.quota.DailyBytes > 0 {
+		reset := time.Unix(statsDay(c.now), 0).Add(24 * time.Hour).Sub(c.now)
+		h.Set(QuotaDailyResetHeader, strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10))
+	}
+}
+
+// refuse answers a message the quota does not allow with 429 and Retry-After
+func (c *quotaCheck) refuse(w http.ResponseWriter) {
+	retry := int64(math.Ceil(c.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	http.Error(w, fmt.Sprintf("Outbound %s quota reached; retry in %v", c.exceeded, time.Duration(retry)*time.Second), http.StatusTooManyRequests)
+}
+
+// loadSenderQuota returns the quota and usage of one sender
+func (s *Server) loadSenderQuota(ctx context.Context, idOrName string, now time.Time) (*SenderQuota, error) {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return nil, err
+	}
+	result := &SenderQuota{UserID: id}
+	if err := s.db.QueryRowContext(ctx, "SELECT display_name FROM users WHERE id = ?", id).Scan(&result.DisplayName); err != nil {
+		return nil, err
+	}
+	if result.Quota, result.Override, err = s.senderQuota(ctx, id); err != nil {
+		return nil, err
+	}
+	if result.Usage, err = s.sendUsage(ctx, id, now); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// quotaSettings returns the default quota and every sender with an override
+func (s *Server) quotaSettings(ctx context.Context, now time.Time) (*QuotaSettings, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM users WHERE send_quota IS NOT NULL ORDER BY display_name")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	settings := &QuotaSettings{Default: s.Config().SendQuota, Overrides: []SenderQuota{}}
+	for _, id := range ids {
+		sender, err := s.loadSenderQuota(ctx, id, now)
+		if err != nil {
+			return nil, err
+		}
+		settings.Overrides = append(settings.Overrides, *sender)
+	}
+	return settings, nil
+}
+
+// handleAdminQuotas shows (GET), changes (PUT) or removes (DELETE) outbound quotas.
+// Without ?user= PUT changes the hub default; with it PUT changes that sender's
+// override, created from the default if needed, and DELETE returns the sender to the
+// default. Every method answers with the quota settings, including the sender's. PUT takes the limits to change as query parameters, such
+// as daily_messages=500; 0 turns a limit off and parameters left out keep their value.
+func (s *Server) handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	if !s.requireAdmin(w, ctx, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	user := query.Get("user")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var quota SendQuota
+		if user == "" {
+			quota = s.Config().SendQuota
+		} else {
+			current, err := s.loadSenderQuota(ctx, user, time.Now())
+			if errors.Is(err, errUserNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				dbError(w, ctx, "Database error")
+				return
+			}
+			quota = current.Quota
+		}
+		for name, field := range quotaParams(&quota) {
+			v := query.Get(name)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid limit for "+name, http.StatusBadRequest)
+				return
+			}
+			*field = n
+		}
+		if user == "" {
+			s.SetSendQuota(quota)
+			if err := s.SaveConfig(ctx); err != nil {
+				dbError(w, ctx, "Failed to save send quota")
+				return
+			}
+			s.logf(LogInfo, "", "Default send quota changed by admin")
+		} else if err := s.SetSenderQuota(ctx, user, &quota); err != nil {
+			dbError(w, ctx, "Failed to save send quota")
+			return
+		}
+	case http.MethodDelete:
+		if user == "" {
+			http.Error(w, "User required", http.StatusBadRequest)
+			return
+		}
+		err := s.SetSenderQuota(ctx, user, nil)
+		if errors.Is(err, errUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(w, ctx, "Failed to remove send quota")
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := s.quotaSettings(ctx, time.Now())
+	if err == nil && user != "" {
+		settings.Sender, err = s.loadSenderQuota(ctx, user, time.Now())
+	}
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Failed to load send quotas")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
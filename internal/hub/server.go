@@ -1,21 +1,26 @@
 package hub
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattd/clsp/internal/crypto"
 	"github.com/mattd/clsp/internal/paths"
-	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -32,16 +37,152 @@ type HubConfig struct {
 	HubTimeout    time.Duration `json:"hub_timeout"`
 	HubRetryCount int           `json:"hub_retry_count"`
 	HubRetryDelay time.Duration `json:"hub_retry_delay"`
+
+	// RequireClientCert reports whether clients must present a certificate from the
+	// hub's client CA (see TLSOptions.ClientCAFile)
+	RequireClientCert bool `json:"require_client_cert,omitempty"`
+	// GRPCPort is the port of the hub's gRPC interface (zero when it serves none)
+	GRPCPort int `json:"grpc_port,omitempty"`
+
+	// ClockSkewTolerance is how far a message timestamp may differ from hub time
+	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance"`
+	// DedupeWindow suppresses identical sends from the same sender to the same
+	// recipient within this window (zero disables de-duplication)
+	DedupeWindow time.Duration `json:"dedupe_window"`
+	// UserPurgeDelay is how long a deactivated user is kept before being purged
+	UserPurgeDelay time.Duration `json:"user_purge_delay"`
+	// UnsendWindow is how long after sending a sender may still delete a message the
+	// recipient already fetched (zero allows only unfetched messages to be deleted)
+	UnsendWindow time.Duration `json:"unsend_window"`
+
+	// RequireOIDC makes /register require an ID token from OIDCIssuer, binding
+	// each identity to one SSO account
+	RequireOIDC  bool   `json:"require_oidc,omitempty"`
+	OIDCIssuer   string `json:"oidc_issuer,omitempty"`
+	OIDCClientID string `json:"oidc_client_id,omitempty"`
+
+	// RequireInvite makes /register require an invite code for new accounts: one
+	// minted through /admin/invites, or the code of a provisioned account
+	RequireInvite bool `json:"require_invite,omitempty"`
+
+	// MaxUsers caps the number of active accounts (zero means unlimited)
+	MaxUsers int `json:"max_users,omitempty"`
+	// MaxStorageBytes caps the total size of stored messages (zero means unlimited)
+	MaxStorageBytes int64 `json:"max_storage_bytes,omitempty"`
+	// MaxMessageSize caps the encrypted text of a single message in bytes; clients split
+	// longer content into linked parts (zero means unlimited)
+	MaxMessageSize int `json:"max_message_size"`
+	// MaxAttachmentSize caps the encrypted size of a single uploaded attachment in
+	// bytes (zero means unlimited)
+	MaxAttachmentSize int64 `json:"max_attachment_size,omitempty"`
+
+	// LogFile receives the hub's log output in addition to stderr (empty disables file
+	// logging). The file is rotated when it exceeds LogMaxSizeMB or gets older than
+	// LogMaxAge (zero disables either limit); rotated files are gzipped if LogCompress
+	// is set, and only the newest LogMaxBackups are kept (zero keeps all).
+	LogFile       string        `json:"log_file,omitempty"`
+	LogMaxSizeMB  int           `json:"log_max_size_mb"`
+	LogMaxAge     time.Duration `json:"log_max_age"`
+	LogMaxBackups int           `json:"log_max_backups"`
+	LogCompress   bool          `json:"log_compress"`
+	// LogFormat is the format of the process log: LogFormatText (the default) or
+	// LogFormatJSON
+	LogFormat string `json:"log_format,omitempty"`
+
+	// UserWebhooks lets users register a webhook the hub calls when a message is
+	// stored for them. It is off by default because the hub then makes requests to
+	// addresses chosen by its users.
+	UserWebhooks bool `json:"user_webhooks,omitempty"`
+
+	// EscrowKey is the PEM public key of the organization's recovery key. Clients of
+	// users who opted in to escrow wrap each message key to it as well (empty for none).
+	EscrowKey string `json:"escrow_key,omitempty"`
+
+	// Retention purges messages earlier than their expiry depending on their delivery
+	// state and whether they carry an attachment (see RetentionPolicy)
+	Retention RetentionPolicy `json:"retention"`
+
+	// SendQuota limits what each sender may send per hour and day, apart from the
+	// senders an admin gave their own quota (see SendQuota)
+	SendQuota SendQuota `json:"send_quota"`
+
+	// Inactivity warns the owners of long unused accounts and then deactivates them
+	// (see InactivityPolicy)
+	Inactivity InactivityPolicy `json:"inactivity"`
+
+	// FederationName is the host (and port) other hubs reach this one at; users of
+	// other hubs address this hub's users as name@FederationName (empty disables
+	// federation). FederationInsecure reaches peers over plain HTTP, for testing.
+	FederationName     string `json:"federation_name,omitempty"`
+	FederationInsecure bool   `json:"federation_insecure,omitempty"`
+	// FederationAllowPrivate accepts IP addresses and local names as peer names and
+	// reaches peers at private, loopback and link-local addresses, which are refused
+	// otherwise so that peer names taken from requests cannot point into the hub's
+	// own network.
+	FederationAllowPrivate bool `json:"federation_allow_private,omitempty"`
+	// FederationPeers are the hubs whose key is fetched on first contact though no
+	// user of this hub has addressed them yet
+	FederationPeers []string `json:"federation_peers,omitempty"`
 }
 
 // Server represents a CLSP hub server
 type Server struct {
 	port     int
-	db       *sql.DB
+	db       Store
+	dataDir  string
 	server   *http.Server
 	stopChan chan struct{}
 	mu       sync.RWMutex
 	config   HubConfig
+
+	// userSearch is how display names are searched (see prepareUserSearch)
+	userSearch userSearchMode
+
+	// hubKey signs hub-originated data such as announcements
+	hubKey       *rsa.PrivateKey
+	hubPublicKey []byte
+
+	// oidc validates registration tokens when RequireOIDC is set
+	oidc *oidcVerifier
+
+	// directory is the signed directory snapshot last served, rebuilt once it is
+	// older than directorySnapshotInterval
+	directoryMu sync.Mutex
+	directory   *DirectorySnapshot
+
+	// uploads serializes writes to each attachment, by ID
+	uploads sync.Map
+
+	// bursts holds each sender's allowance under SendQuota.Burst
+	bursts burstLimiter
+	// keyFetches spaces out first-contact fetches of peer hub keys
+	keyFetches keyFetchLimiter
+
+	// deliverers send queued outbound deliveries, by kind
+	deliverers map[string]Deliverer
+
+	// tls selects HTTPS serving (see SetTLS)
+	tls TLSOptions
+	// onionAddress is the onion service the hub is published as (see SetOnionAddress)
+	onionAddress string
+
+	// corsOrigins are the browser origins allowed to call the hub (see ApplyPreset)
+	corsOrigins []string
+	// logLevel is the lowest level logged (empty means info)
+	logLevel string
+
+	// serving is set once the hub handles requests; log lines are then echoed to stderr
+	serving atomic.Bool
+	// startedAt is when the server was opened, the start of its uptime
+	startedAt time.Time
+
+	// events streams operational events to admins (see handleAdminEvents)
+	events eventBroker
+
+	// grpcServer serves the gRPC interface when a gRPC port is set (see SetGRPCPort)
+	grpcServer *grpc.Server
+	// inbox wakes the Watch streams of users messages are stored for
+	inbox inboxBroker
 }
 
 // User represents a CLSP user
@@ -51,6 +192,15 @@ type User struct {
 	PublicKey   string    `json:"public_key"`
 	LastSeen    time.Time `json:"last_seen"`
 	Online      bool      `json:"online"`
+	// Prekey is the user's current signed X25519 prekey, if their client published one
+	Prekey *crypto.Prekey `json:"prekey,omitempty"`
+	// SigningKey is the user's Ed25519 signing key (PEM), if their client has one, and
+	// SigningKeySig its certificate from the RSA key in PublicKey
+	SigningKey    string `json:"signing_key,omitempty"`
+	SigningKeySig []byte `json:"signing_key_sig,omitempty"`
+	// KeyRotations are the user's latest key rotations, oldest first, for contacts who
+	// pinned a key the user has since replaced
+	KeyRotations []crypto.KeyRotation `json:"key_rotations,omitempty"`
 }
 
 // Message represents a stored message
@@ -64,6 +214,36 @@ type Message struct {
 	ExpiresAt   time.Time  `json:"expires_at"`
 }
 
+// registerRequest is the body of POST /register
+type registerRequest struct {
+	User
+	// InviteCode claims an account pre-created by provisioning, or is an invite code
+	// admitting a new account
+	InviteCode string `json:"invite_code,omitempty"`
+}
+
+// Send statuses reported by the message endpoint
+const (
+	SendStatusStored    = "stored"
+	SendStatusDuplicate = "already_delivered"
+	// SendStatusValid answers a dry run whose message would have been stored
+	SendStatusValid = "valid"
+	// SendStatusRelayed answers a message queued for a user of another hub
+	SendStatusRelayed = "relayed"
+)
+
+// SendResult is the response body of a successful POST /message
+type SendResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// ReceiptsDisabled is set when the recipient's receipt policy keeps the sender
+	// from seeing when the message is delivered and read
+	ReceiptsDisabled bool `json:"receipts_disabled,omitempty"`
+	// Request is set when the message waits as a message request until the recipient
+	// accepts the sender
+	Request bool `json:"request,omitempty"`
+}
+
 // NewServer creates a new hub server with default configuration
 func NewServer(dbPath string) (*Server, error) {
 	// If no dbPath is provided, use the default global path
@@ -76,13 +256,26 @@ func NewServer(dbPath string) (*Server, error) {
 		return nil, fmt.Errorf("failed to create database directory: %v", err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := OpenStore(DriverSQLite, dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
+	}
+	return NewServerWithStore(db, filepath.Dir(dbPath))
+}
+
+// NewServerWithStore creates a hub server on an open store. dataDir holds the files
+// kept outside the database: the hub key and uploaded attachments, which hub replicas
+// sharing one database must share as well.
+func NewServerWithStore(db Store, dataDir string) (*Server, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
 	server := &Server{
-		db: db,
+		db:        db,
+		dataDir:   dataDir,
+		startedAt: time.Now(),
 		config: HubConfig{
 			MessageExpiry: 30 * 24 * time.Hour, // 30 days
 			UseTLS:        false,
@@ -90,14 +283,44 @@ func NewServer(dbPath string) (*Server, error) {
 			HubTimeout:    10 * time.Second,
 			HubRetryCount: 3,
 			HubRetryDelay: 1 * time.Second,
+
+			ClockSkewTolerance: 5 * time.Minute,
+			UserPurgeDelay:     30 * 24 * time.Hour, // 30 days
+			UnsendWindow:       10 * time.Minute,
+			MaxMessageSize:     64 * 1024,
+
+			LogMaxSizeMB:  100,
+			LogMaxBackups: 10,
+			LogCompress:   true,
 		},
 		stopChan: make(chan struct{}),
 	}
+	server.RegisterDeliverer(DeliveryKindWebhook, deliverWebhook)
+	server.RegisterDeliverer(DeliveryKindFederation, server.deliverFederated)
+
+	if _, err := Migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	userSearch, err := prepareUserSearch(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	server.userSearch = userSearch
+
+	if err := server.loadConfig(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	if err := server.createTables(); err != nil {
+	hubKey, hubPublicKey, err := loadOrCreateHubKey(filepath.Join(dataDir, "hub_key.pem"))
+	if err != nil {
 		db.Close()
 		return nil, err
 	}
+	server.hubKey = hubKey
+	server.hubPublicKey = hubPublicKey
 
 	return server, nil
 }
@@ -105,29 +328,84 @@ func NewServer(dbPath string) (*Server, error) {
 // Start initializes and starts the hub server
 func (s *Server) Start() error {
 	// Start cleanup goroutine
+	s.serving.Store(true)
 	go s.cleanupLoop()
+	go s.deliveryLoop()
 
-	// Setup HTTP server
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/config", s.handleConfig)
-	mux.HandleFunc("/check-username", s.handleCheckUsername)
-	mux.HandleFunc("/register", s.handleRegister)
-	mux.HandleFunc("/users", s.handleUsers)
-	mux.HandleFunc("/message", s.handleMessage)
-	mux.HandleFunc("/messages", s.handleMessages)
+	s.server = newHTTPServer(fmt.Sprintf(":%d", s.port), s.Handler())
 
-	s.server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: mux,
+	s.mu.RLock()
+	opts := s.tls
+	grpcPort := s.config.GRPCPort
+	s.mu.RUnlock()
+	if grpcPort > 0 {
+		if err := s.startGRPC(grpcPort, opts); err != nil {
+			return err
+		}
 	}
+	return listenAndServe(s.server, opts, s.dataDir)
+}
 
-	return s.server.ListenAndServe()
+// Handler returns the hub's HTTP routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	var patterns []string
+	handle := func(pattern string, handler http.HandlerFunc) {
+		patterns = append(patterns, pattern)
+		mux.HandleFunc(pattern, handler)
+	}
+	handle("/health", s.handleHealth)
+	handle("/config", s.handleConfig)
+	handle("/schema", s.handleSchema)
+	handle("/openapi.json", s.handleOpenAPI)
+	handle("/check-username", s.handleCheckUsername)
+	handle("/register", s.handleRegister)
+	handle("/users", s.handleUsers)
+	handle("/directory", s.handleDirectory)
+	handle("/prekey", s.handlePrekey)
+	handle("/key/rotate", s.handleKeyRotate)
+	handle("/message", s.handleMessage)
+	handle("/attachment", s.handleAttachment)
+	handle("/attachment/status", s.handleAttachmentStatus)
+	handle("/message/status", s.handleMessageStatus)
+	handle("/message/read", s.handleMessageRead)
+	handle("/message/", s.handleUnsend)
+	handle("/messages", s.handleMessages)
+	handle("/notifications", s.handleNotifications)
+	handle("/recovery", s.handleRecovery)
+	handle("/receipts", s.handleReceipts)
+	handle("/requests", s.handleRequests)
+	handle("/devices", s.handleDevices)
+	handle("/account", s.handleAccount)
+	handle("/account/export", s.handleAccountExport)
+	handle("/federation/key", s.handleFederationKey)
+	handle("/federation/user", s.handleFederationUser)
+	handle("/federation/deliver", s.handleFederationDeliver)
+	handle("/announcements", s.handleAnnouncements)
+	handle("/invite", s.handleInvite)
+	handle("/admin/report", s.handleAdminReport)
+	handle("/admin/metrics", s.handleAdminMetrics)
+	handle("/admin/deadletters", s.handleAdminDeadLetters)
+	handle("/admin/users", s.handleAdminUsers)
+	handle("/admin/bans", s.handleAdminBans)
+	handle("/admin/messages", s.handleAdminMessages)
+	handle("/admin/stats", s.handleAdminStats)
+	handle("/admin/retention", s.handleAdminRetention)
+	handle("/admin/quotas", s.handleAdminQuotas)
+	handle("/admin/gc", s.handleAdminGC)
+	handle("/admin/invites", s.handleAdminInvites)
+	handle("/admin/events", s.handleAdminEvents)
+	handle("/admin/audit", s.handleAdminAudit)
+	checkRoutes(patterns)
+	return s.withMiddleware(withVersions(mux))
 }
 
 // Shutdown gracefully shuts down the hub server
 func (s *Server) Shutdown() {
 	close(s.stopChan)
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
 	if s.server != nil {
 		s.server.Close()
 	}
@@ -136,10 +414,12 @@ func (s *Server) Shutdown() {
 	}
 }
 
-// createTables creates the necessary database tables
-func (s *Server) createTables() error {
+// createTables creates the database tables as they were when versioned migrations
+// were introduced; it is the first migration, and brings the databases of older hubs
+// up to the same point
+func createTables(db Store) error {
 	// Create users table
-	_, err := s.db.Exec(`
+	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
 			id TEXT PRIMARY KEY,
 			display_name TEXT NOT NULL,
@@ -153,7 +433,7 @@ func (s *Server) createTables() error {
 	}
 
 	// Create messages table
-	_, err = s.db.Exec(`
+	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS messages (
 			id TEXT PRIMARY KEY,
 			sender_id TEXT NOT NULL,
@@ -170,41 +450,390 @@ func (s *Server) createTables() error {
 		return fmt.Errorf("failed to create messages table: %v", err)
 	}
 
+	// Create announcements table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS announcements (
+			id TEXT PRIMARY KEY,
+			body TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			signature BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create announcements table: %v", err)
+	}
+
+	// Create settings table holding the persisted hub configuration
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			config TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create settings table: %v", err)
+	}
+
+	// Create provisioned_users table holding accounts pre-created with invite codes
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS provisioned_users (
+			id TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			invite_hash TEXT NOT NULL UNIQUE,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			claimed_at INTEGER
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create provisioned_users table: %v", err)
+	}
+
+	// Create tenants table; only used by the root database of a multi-tenant hub
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS tenants (
+			name TEXT PRIMARY KEY,
+			hosts TEXT NOT NULL DEFAULT '',
+			path_prefix TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tenants table: %v", err)
+	}
+
+	// Create daily stats tables used by capacity reports; these outlive expired messages
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS message_stats (
+			day INTEGER NOT NULL,
+			sender_id TEXT NOT NULL,
+			messages INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			PRIMARY KEY (day, sender_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message_stats table: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS message_size_stats (
+			day INTEGER NOT NULL,
+			bucket INTEGER NOT NULL,
+			messages INTEGER NOT NULL,
+			PRIMARY KEY (day, bucket)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message_size_stats table: %v", err)
+	}
+
+	// Create the hourly send counts checked against outbound quotas
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS send_usage (
+			sender_id TEXT NOT NULL,
+			hour INTEGER NOT NULL,
+			messages INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			PRIMARY KEY (sender_id, hour)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create send_usage table: %v", err)
+	}
+
+	// Create the record of who wrote to whom, which makes up the contacts of receipt
+	// policies
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS contacts (
+			user_id TEXT NOT NULL,
+			contact_id TEXT NOT NULL,
+			since INTEGER NOT NULL,
+			PRIMARY KEY (user_id, contact_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create contacts table: %v", err)
+	}
+
+	// Create the keys of federated hubs, pinned when each first contacts this one
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS federation_peers (
+			name TEXT PRIMARY KEY,
+			public_key TEXT NOT NULL,
+			first_seen INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create federation_peers table: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS delivery_stats (
+			day INTEGER PRIMARY KEY,
+			delivered INTEGER NOT NULL DEFAULT 0,
+			latency_sum INTEGER NOT NULL DEFAULT 0,
+			latency_max INTEGER NOT NULL DEFAULT 0,
+			expired_unfetched INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create delivery_stats table: %v", err)
+	}
+
+	// Create outbound delivery queue and dead-letter tables
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS outbound_deliveries (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			target TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at INTEGER NOT NULL,
+			last_error TEXT,
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create outbound_deliveries table: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			target TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			failed_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create dead_letters table: %v", err)
+	}
+
+	// Create the persisted log ring buffer
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS hub_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INTEGER NOT NULL,
+			level TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			message TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create hub_logs table: %v", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_hub_logs_user ON hub_logs (user_id)"); err != nil {
+		return fmt.Errorf("failed to create hub_logs index: %v", err)
+	}
+
+	// Create attachments table; the encrypted content lives in files under attachmentDir
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS attachments (
+			id TEXT PRIMARY KEY,
+			owner_id TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			received INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			completed_at INTEGER,
+			FOREIGN KEY (owner_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create attachments table: %v", err)
+	}
+
+	// Columns added after the initial schema
+	if err := addColumnIfMissing(db, "users", "deactivated_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "dedupe_key", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "sso_subject", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "settings", "admin_token_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "fetched_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "updated_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "prekey", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "attachment_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "banned_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "ban_reason", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "notify_url", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "quiet_hours", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "quiet", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "signing_key", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "signing_key_sig", "BLOB"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "key_rotations", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "in_reply_to", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "send_quota", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "receipts", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "messages", "no_receipts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "recovery_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "recovery_kit", "BLOB"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_recovery ON users (recovery_id)"); err != nil {
+		return fmt.Errorf("failed to create recovery index: %v", err)
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table created by an older hub version
+func addColumnIfMissing(db Store, table, column, definition string) error {
+	exists, err := db.HasColumn(table, column)
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %v", table, column, err)
+	}
 	return nil
 }
 
-// cleanupLoop periodically cleans up expired messages and updates user online status
+// cleanupLoop periodically cleans up expired messages and updates user online status,
+// and optimizes the database once a day
 func (s *Server) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
+	optimizeTicker := time.NewTicker(optimizeInterval)
+	defer optimizeTicker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			// Delete expired messages
-			_, err := s.db.Exec(
-				"DELETE FROM messages WHERE expires_at <= ?",
-				time.Now().Unix(),
-			)
-			if err != nil {
-				log.Printf("Failed to delete expired messages: %v", err)
-			}
-
-			// Update user online status (users inactive for more than 5 minutes are considered offline)
-			_, err = s.db.Exec(
-				"UPDATE users SET online = 0 WHERE last_seen <= ?",
-				time.Now().Add(-5*time.Minute).Unix(),
-			)
-			if err != nil {
-				log.Printf("Failed to update user online status: %v", err)
-			}
-
+			s.cleanup()
+		case <-optimizeTicker.C:
+			s.optimize()
 		case <-s.stopChan:
 			return
 		}
 	}
 }
 
+// cleanup runs a single maintenance pass
+func (s *Server) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	// Count messages expiring without ever being fetched before deleting them
+	if err := s.recordExpiredUnfetched(ctx, time.Now()); err != nil {
+		s.logf(LogError, "", "Failed to record undelivered expiries: %v", err)
+	}
+
+	// Delete expired messages
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM messages WHERE expires_at <= ?",
+		time.Now().Unix(),
+	)
+	if err != nil {
+		s.logf(LogError, "", "Failed to delete expired messages: %v", err)
+	}
+
+	// Delete messages the retention policy no longer keeps
+	if _, err := s.applyRetention(ctx, time.Now()); err != nil {
+		s.logf(LogError, "", "Failed to apply retention policy: %v", err)
+	}
+
+	// Delete send counts no quota window covers any more
+	if err := s.pruneSendUsage(ctx, time.Now()); err != nil {
+		s.logf(LogError, "", "Failed to prune send usage: %v", err)
+	}
+
+	// Delete expired announcements
+	_, err = s.db.ExecContext(ctx,
+		"DELETE FROM announcements WHERE expires_at <= ?",
+		time.Now().Unix(),
+	)
+	if err != nil {
+		s.logf(LogError, "", "Failed to delete expired announcements: %v", err)
+	}
+
+	// Update user online status (users inactive for more than 5 minutes are considered offline)
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE users SET online = 0 WHERE last_seen <= ?",
+		time.Now().Add(-5*time.Minute).Unix(),
+	)
+	if err != nil {
+		s.logf(LogError, "", "Failed to update user online status: %v", err)
+	}
+
+	// Purge deactivated users whose grace period has elapsed
+	if err := s.purgeDeactivatedUsers(ctx); err != nil {
+		s.logf(LogError, "", "Failed to purge deactivated users: %v", err)
+	}
+
+	// Retire unused accounts and delete attachments nothing refers to
+	if _, err := s.CollectGarbage(ctx, false); err != nil {
+		s.logf(LogError, "", "Garbage collection failed: %v", err)
+	}
+}
+
+// optimize refreshes the database statistics and reclaims the space of deleted rows
+func (s *Server) optimize() {
+	ctx, cancel := context.WithTimeout(context.Background(), optimizeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	before := s.db.Size(ctx)
+	if err := s.db.Optimize(ctx); err != nil {
+		s.logf(LogError, "", "Database maintenance failed: %v", err)
+		return
+	}
+	after := s.db.Size(ctx)
+	if before >= 0 && after >= 0 {
+		s.logf(LogInfo, "", "Database optimized in %v (%d bytes reclaimed)", time.Since(start).Round(time.Millisecond), before-after)
+	} else {
+		s.logf(LogInfo, "", "Database optimized in %v", time.Since(start).Round(time.Millisecond))
+	}
+}
+
 // handleRegister handles user registration
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -212,23 +841,72 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid user data", http.StatusBadRequest)
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid user data", http.StatusBadRequest)
+		}
 		return
 	}
+	user := req.User
 
 	// Validate required fields
 	if user.ID == "" || user.DisplayName == "" || user.PublicKey == "" {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
+	identityKey, err := crypto.LoadPublicKeyFromPEM([]byte(user.PublicKey))
+	if err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	fingerprint, err := crypto.Fingerprint(identityKey)
+	if err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	// The registration must be signed with the private half of the key it registers,
+	// so nobody can publish a key they do not hold
+	if !s.registrationSigned(r, user.ID, user.DisplayName, fingerprint, identityKey) {
+		s.event(LogWarn, EventRegistration, user.ID, "Rejected registration without proof of the key")
+		http.Error(w, "Registration must be signed with the registered key", http.StatusUnauthorized)
+		return
+	}
+	// A signing key must be certified by the identity key registered with it
+	if user.SigningKey != "" {
+		if _, err := crypto.VerifySigningKey(identityKey, user.SigningKey, user.SigningKeySig); err != nil {
+			http.Error(w, "Invalid signing key certificate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// In OIDC mode the registration must carry an ID token from the configured provider
+	var ssoSubject sql.NullString
+	if verifier := s.oidcVerifier(); verifier != nil {
+		token, err := bearerToken(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clsp"`)
+			http.Error(w, "SSO login required", http.StatusUnauthorized)
+			return
+		}
+		identity, err := verifier.Verify(ctx, token)
+		if err != nil {
+			s.event(LogWarn, EventRegistration, user.ID, "Rejected registration token: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clsp", error="invalid_token"`)
+			http.Error(w, "Invalid SSO token", http.StatusUnauthorized)
+			return
+		}
+		ssoSubject = sql.NullString{String: identity.bindingKey(), Valid: true}
+	}
 
 	// Check if display name is taken by another user
 	var existingUserID string
-	err := s.db.QueryRow("SELECT id FROM users WHERE display_name = ? AND id != ?", user.DisplayName, user.ID).Scan(&existingUserID)
+	err = s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE display_name = ? AND id != ?", user.DisplayName, user.ID).Scan(&existingUserID)
 	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, ctx, "Database error")
 		return
 	}
 	if existingUserID != "" {
@@ -237,57 +915,212 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Begin transaction
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, ctx, "Database error")
 		return
 	}
 	defer tx.Rollback()
 
-	// Check if user exists
-	var exists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", user.ID).Scan(&exists)
+	// Check if user exists. An existing account keeps its key: registering it anew
+	// only re-announces it, and replacing it takes a key rotation signed by the old key.
+	var registeredKey string
+	err = tx.QueryRowContext(ctx, "SELECT public_key FROM users WHERE id = ?", user.ID).Scan(&registeredKey)
+	if err != nil && err != sql.ErrNoRows {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	exists := err == nil
+	if exists && !sameKey(registeredKey, fingerprint) {
+		s.event(LogWarn, EventRegistration, user.ID, "Registration refused: account is registered with another key")
+		http.Error(w, "Account is registered with another key; replace it with a key rotation", http.StatusConflict)
+		return
+	}
+
+	// Banned accounts stay out, including under a new ID with the same key
+	var banned bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE banned_at IS NOT NULL AND (id = ? OR public_key = ?))",
+		user.ID, user.PublicKey,
+	).Scan(&banned)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if banned {
+		s.event(LogWarn, EventRegistration, user.ID, "Registration refused for banned account")
+		http.Error(w, "Account is banned", http.StatusForbidden)
+		return
+	}
+
+	// Deactivated accounts must be reactivated by an operator first
+	var deactivated bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deactivated_at IS NOT NULL)", user.ID).Scan(&deactivated)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if deactivated {
+		s.event(LogWarn, EventRegistration, user.ID, "Registration refused for deactivated account")
+		http.Error(w, "Account is deactivated", http.StatusForbidden)
+		return
+	}
+
+	// New accounts count against the user quota
+	if maxUsers := s.Config().MaxUsers; maxUsers > 0 && !exists {
+		var active int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE deactivated_at IS NULL").Scan(&active); err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if active >= maxUsers {
+			s.event(LogWarn, EventRegistration, user.ID, "Registration refused: user quota of %d reached", maxUsers)
+			http.Error(w, "User quota reached", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Provisioned accounts can only be claimed with their invite code
+	status, reason, claims, err := checkProvisioned(ctx, tx, user.ID, user.DisplayName, req.InviteCode)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, ctx, "Database error")
 		return
 	}
+	if status != 0 {
+		http.Error(w, reason, status)
+		return
+	}
+	if claims {
+		_, err = tx.ExecContext(ctx, "UPDATE provisioned_users SET claimed_at = ? WHERE id = ?", time.Now().Unix(), user.ID)
+		if err != nil {
+			dbError(w, ctx, "Failed to claim invite")
+			return
+		}
+	}
+
+	// Other new accounts use up an invite code when they give one or the hub requires it
+	if !claims && !exists && (req.InviteCode != "" || s.Config().RequireInvite) {
+		if req.InviteCode == "" {
+			s.event(LogWarn, EventRegistration, user.ID, "Registration refused: no invite code")
+			http.Error(w, "Registration requires an invite code", http.StatusForbidden)
+			return
+		}
+		ok, err := useInviteCode(ctx, tx, req.InviteCode, time.Now())
+		if err != nil {
+			dbError(w, ctx, "Failed to use invite code")
+			return
+		}
+		if !ok {
+			s.event(LogWarn, EventRegistration, user.ID, "Registration refused: invalid or expired invite code")
+			http.Error(w, "Invalid or expired invite code", http.StatusForbidden)
+			return
+		}
+	}
 
+	// An SSO account is bound to exactly one identity, and a bound identity only to its account
+	if ssoSubject.Valid {
+		var boundID string
+		err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE sso_subject = ? AND id != ?", ssoSubject.String, user.ID).Scan(&boundID)
+		if err != nil && err != sql.ErrNoRows {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if boundID != "" {
+			http.Error(w, "SSO account is already bound to another identity", http.StatusConflict)
+			return
+		}
+	}
 	if exists {
-		// Update existing user
-		_, err = tx.Exec(
-			"UPDATE users SET display_name = ?, public_key = ?, last_seen = ?, online = ? WHERE id = ?",
+		var bound sql.NullString
+		if err := tx.QueryRowContext(ctx, "SELECT sso_subject FROM users WHERE id = ?", user.ID).Scan(&bound); err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if bound.Valid && ssoSubject.Valid && bound.String != ssoSubject.String {
+			s.event(LogWarn, EventRegistration, user.ID, "Registration refused: identity is bound to a different SSO account")
+			http.Error(w, "Identity is bound to a different SSO account", http.StatusForbidden)
+			return
+		}
+		if !ssoSubject.Valid {
+			ssoSubject = bound
+		}
+	}
+
+	if exists {
+		// Update existing user; a signing key sent along replaces the current one
+		_, err = tx.ExecContext(ctx,
+			`UPDATE users SET signing_key = CASE WHEN ? != '' THEN ? ELSE signing_key END,
+				signing_key_sig = CASE WHEN ? != '' THEN ? ELSE signing_key_sig END,
+				display_name = ?, last_seen = ?, online = ?, sso_subject = ?, updated_at = ? WHERE id = ?`,
+			user.SigningKey, user.SigningKey,
+			user.SigningKey, user.SigningKeySig,
 			user.DisplayName,
-			user.PublicKey,
 			time.Now().Unix(),
 			true,
+			ssoSubject,
+			time.Now().Unix(),
 			user.ID,
 		)
 	} else {
 		// Insert new user
-		_, err = tx.Exec(
-			"INSERT INTO users (id, display_name, public_key, last_seen, online) VALUES (?, ?, ?, ?, ?)",
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO users (id, display_name, public_key, signing_key, signing_key_sig, last_seen, online, sso_subject, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			user.ID,
 			user.DisplayName,
 			user.PublicKey,
+			user.SigningKey,
+			user.SigningKeySig,
 			time.Now().Unix(),
 			true,
+			ssoSubject,
+			time.Now().Unix(),
 		)
 	}
 
 	if err != nil {
-		http.Error(w, "Failed to store user", http.StatusInternalServerError)
+		dbError(w, ctx, "Failed to store user")
 		return
 	}
 
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, ctx, "Database error")
 		return
 	}
 
+	if exists {
+		s.event(LogInfo, EventRegistration, user.ID, "User %s re-registered", user.DisplayName)
+	} else {
+		s.event(LogInfo, EventRegistration, user.ID, "User %s registered", user.DisplayName)
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// registrationSigned reports whether a registration carries a signature by the
+// private half of the identity key it registers, over the user ID, display name and
+// the key's fingerprint
+func (s *Server) registrationSigned(r *http.Request, userID, displayName, fingerprint string, identityKey *rsa.PublicKey) bool {
+	if r.URL.Query().Get("user_id") != userID {
+		return false
+	}
+	ts, sig, ok := s.requestSignature(r)
+	if !ok {
+		return false
+	}
+	payload := crypto.RequestPayload("register", userID, ts, displayName, fingerprint)
+	return crypto.VerifyData(identityKey, payload, sig) == nil
+}
+
+// sameKey reports whether a registered public key (PEM) has the given fingerprint
+func sameKey(publicKeyPEM, fingerprint string) bool {
+	key, err := crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM))
+	if err != nil {
+		return false
+	}
+	registered, err := crypto.Fingerprint(key)
+	return err == nil && registered == fingerprint
+}
+
 // handleUsers returns a list of users
 func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -295,128 +1128,454 @@ func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
 	// Parse query parameters
 	onlineOnly := r.URL.Query().Get("online") == "true"
 	search := r.URL.Query().Get("search")
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Build query
-	query := "SELECT id, display_name, public_key, last_seen, online FROM users"
+	query := "SELECT " + userColumns + " FROM users"
 	args := []interface{}{}
-	conditions := []string{}
+	conditions := []string{"deactivated_at IS NULL"}
 
 	if onlineOnly {
 		conditions = append(conditions, "online = 1")
 	}
 	if search != "" {
-		conditions = append(conditions, "display_name LIKE ?")
-		args = append(args, "%"+search+"%")
+		condition, searchArgs := s.userSearchCondition("id", search)
+		conditions = append(conditions, condition)
+		args = append(args, searchArgs...)
+	}
+
+	if page.since > 0 {
+		conditions = append(conditions, "updated_at >= ?")
+		args = append(args, page.since)
+	}
+	if page.hasCursor {
+		conditions = append(conditions, "id > ?")
+		args = append(args, page.cursorID)
 	}
 
-	if len(conditions) > 0 {
-		query += " WHERE " + strings.Join(conditions, " AND ")
+	query += " WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id"
+	if page.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.limit+1)
 	}
 
 	// Execute query
-	rows, err := s.db.Query(query, args...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		http.Error(w, "Failed to query users", http.StatusInternalServerError)
+		dbError(w, ctx, "Failed to query users")
 		return
 	}
 	defer rows.Close()
 
 	var users []User
+	fetched := 0
 	for rows.Next() {
-		var user User
-		var lastSeenUnix int64
-		if err := rows.Scan(&user.ID, &user.DisplayName, &user.PublicKey, &lastSeenUnix, &user.Online); err != nil {
-			http.Error(w, "Failed to scan user", http.StatusInternalServerError)
+		user, err := scanUser(rows)
+		if err != nil {
+			dbError(w, ctx, "Failed to scan user")
 			return
 		}
-		user.LastSeen = time.Unix(lastSeenUnix, 0)
+		fetched++
+		if page.limit > 0 && fetched > page.limit {
+			break
+		}
 		users = append(users, user)
 	}
+	if len(users) > 0 {
+		setNextCursor(w, page, fetched, time.Time{}, users[len(users)-1].ID)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(users)
 }
 
-// handleMessage handles message delivery
+// userColumns are the columns of a directory entry, in the order scanUser reads them
+const userColumns = "id, display_name, public_key, last_seen, online, prekey, signing_key, signing_key_sig, key_rotations"
+
+// scanUser reads a directory entry selected with userColumns
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	var lastSeenUnix int64
+	var prekey, signingKey, rotations sql.NullString
+	if err := row.Scan(&user.ID, &user.DisplayName, &user.PublicKey, &lastSeenUnix, &user.Online, &prekey, &signingKey, &user.SigningKeySig, &rotations); err != nil {
+		return User{}, err
+	}
+	user.LastSeen = time.Unix(lastSeenUnix, 0)
+	user.SigningKey = signingKey.String
+	if rotations.String != "" {
+		json.Unmarshal([]byte(rotations.String), &user.KeyRotations)
+	}
+	if prekey.String != "" {
+		var p crypto.Prekey
+		if json.Unmarshal([]byte(prekey.String), &p) == nil {
+			user.Prekey = &p
+		}
+	}
+	return user, nil
+}
+
+// handleMessage handles message delivery. With dry_run=true the message goes through
+// every check a real send makes but is not stored, so clients can validate a send
+// before committing to it; a duplicate is still reported as already delivered.
 func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
 
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.envelopeBodyLimit()))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid message", http.StatusBadRequest)
+		}
+		return
+	}
 	var msg crypto.Message
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+	if err := readEnvelope(r, bytes.NewReader(body), &msg); err != nil {
 		http.Error(w, "Invalid message", http.StatusBadRequest)
 		return
 	}
+	if msg.ID == "" || msg.Sender == "" || msg.Recipient == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	// Only the sender can send in its name, so quotas, bans and message requests all
+	// apply to the user who really sent
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "message", msg.Sender, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+	// The sender the signature proved; who gets held as a message request, and whose
+	// messages make a contact, is decided on it alone
+	sender := msg.Sender
+	if err := msg.Validate(); err != nil {
+		s.logf(LogWarn, msg.Sender, "Message rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkEnvelopeSize(w, &msg) {
+		return
+	}
+
+	// Reject timestamps outside the skew tolerance, which indicate a broken clock or a
+	// replay; a missing timestamp would opt out of the check, so it is refused too
+	if tolerance := s.Config().ClockSkewTolerance; tolerance > 0 {
+		if msg.Timestamp == 0 {
+			http.Error(w, "Message timestamp required", http.StatusBadRequest)
+			return
+		}
+		skew := time.Since(time.Unix(msg.Timestamp, 0))
+		if skew > tolerance || skew < -tolerance {
+			http.Error(w, fmt.Sprintf("Message timestamp differs from hub time by %v (tolerance %v); check your clock", skew.Round(time.Second), tolerance), http.StatusBadRequest)
+			return
+		}
+	}
+	if msg.Expired(time.Now()) {
+		http.Error(w, "Message has already expired", http.StatusBadRequest)
+		return
+	}
+
+	// Users of other hubs are addressed as id@hub; this hub's own name is dropped
+	if _, peer, ok := splitAddress(msg.Recipient); ok {
+		if own := s.Config().FederationName; own != "" && peer == own {
+			msg.Recipient, _, _ = splitAddress(msg.Recipient)
+		} else {
+			s.relayToPeer(ctx, w, &msg, peer, dryRun)
+			return
+		}
+	}
+
+	// Reject messages to unknown or deactivated recipients
+	var recipientActive bool
+	err = s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND deactivated_at IS NULL)",
+		msg.Recipient,
+	).Scan(&recipientActive)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !recipientActive {
+		http.Error(w, "Recipient not found or deactivated", http.StatusNotFound)
+		return
+	}
+
+	var senderBanned bool
+	err = s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND banned_at IS NOT NULL)",
+		msg.Sender,
+	).Scan(&senderBanned)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if senderBanned {
+		s.logf(LogWarn, msg.Sender, "Message from banned sender rejected")
+		http.Error(w, "Sender is banned", http.StatusForbidden)
+		return
+	}
+
+	// Suppress accidental double-sends within the dedupe window
+	dedupeKey := msg.DedupeKey
+	if dedupeKey == "" {
+		dedupeKey = envelopeHash(&msg)
+	}
+	if window := s.Config().DedupeWindow; window > 0 {
+		var existingID string
+		err = s.db.QueryRowContext(ctx,
+			"SELECT id FROM messages WHERE sender_id = ? AND recipient_id = ? AND dedupe_key = ? AND created_at > ? LIMIT 1",
+			msg.Sender,
+			msg.Recipient,
+			dedupeKey,
+			time.Now().Add(-window).Unix(),
+		).Scan(&existingID)
+		if err != nil && err != sql.ErrNoRows {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if existingID != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(SendResult{ID: existingID, Status: SendStatusDuplicate})
+			return
+		}
+	}
+
+	// An uploaded attachment must be complete and belong to the sender
+	var attachmentID interface{}
+	var attachmentSize int64
+	if msg.Attachment != nil && msg.Attachment.Uploaded() {
+		ok, size, err := s.checkMessageAttachment(ctx, msg.Attachment.ID, msg.Sender)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if !ok {
+			http.Error(w, "Attachment not found or not fully uploaded", http.StatusBadRequest)
+			return
+		}
+		attachmentID = msg.Attachment.ID
+		attachmentSize = size
+	}
+
+	envelope, err := encodeEnvelope(&msg)
+	if err != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	// Enforce the storage quota
+	if maxBytes := s.Config().MaxStorageBytes; maxBytes > 0 {
+		stored, err := s.storedBytes(ctx)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if stored+int64(len(envelope)) > maxBytes {
+			s.logf(LogError, msg.Sender, "Message rejected: storage quota of %d bytes reached", maxBytes)
+			http.Error(w, "Hub storage quota reached", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	// Enforce the sender's outbound quota; a dry run is checked without using it up
+	sendSize := int64(len(envelope)) + attachmentSize
+	quota, err := s.checkSendQuota(ctx, msg.Sender, sendSize, time.Now(), !dryRun)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	quota.setHeaders(w.Header())
+	if quota.exceeded != "" {
+		s.event(LogWarn, EventRateLimit, msg.Sender, "Message rejected: %s quota reached", quota.exceeded)
+		quota.refuse(w)
+		return
+	}
 
-	// Set message expiry
-	expiresAt := time.Now().Add(s.config.MessageExpiry)
+	// The recipient's receipt policy is settled when the message is stored, so the
+	// sender knows at once whether to expect receipts
+	receipts, err := s.receiptsAllowed(ctx, msg.Recipient, sender)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	// Messages from first-time senders wait out of the inbox if the recipient asks
+	request, err := s.isMessageRequest(ctx, msg.Recipient, sender)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SendResult{ID: msg.ID, Status: SendStatusValid, ReceiptsDisabled: !receipts, Request: request})
+		return
+	}
+
+	expiresAt := s.messageExpiry(&msg, time.Now())
+
+	// Replies keep the ID they answer, so threads can be followed on the hub
+	var inReplyTo interface{}
+	if msg.InReplyTo != "" {
+		inReplyTo = msg.InReplyTo
+	}
 
 	// Store message
-	_, err := s.db.Exec(
-		"INSERT INTO messages (id, sender_id, recipient_id, content, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO messages (id, sender_id, recipient_id, content, created_at, expires_at, dedupe_key, attachment_id, in_reply_to, no_receipts, request) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		msg.ID,
 		msg.Sender,
 		msg.Recipient,
-		msg.Content,
+		envelope,
 		time.Now().Unix(),
 		expiresAt.Unix(),
+		dedupeKey,
+		attachmentID,
+		inReplyTo,
+		!receipts,
+		request,
 	)
 	if err != nil {
-		http.Error(w, "Failed to store message", http.StatusInternalServerError)
+		dbError(w, ctx, "Failed to store message")
 		return
 	}
 
+	if err := s.recordMessageStats(ctx, msg.Sender, int64(len(envelope)), time.Now()); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record message stats: %v", err)
+	}
+	if err := s.recordSendUsage(ctx, msg.Sender, sendSize, time.Now()); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record send usage: %v", err)
+	}
+	if err := s.recordContact(ctx, sender, msg.Recipient, time.Now()); err != nil {
+		s.logf(LogError, msg.Sender, "Failed to record contact: %v", err)
+	}
+
+	// Tag messages that arrive during the recipient's quiet hours so their sender can
+	// tell why no notification went out; message requests notify no one
+	if !request && s.notifyRecipient(ctx, msg.Recipient, msg.ID, time.Now()) {
+		if _, err := s.db.ExecContext(ctx, "UPDATE messages SET quiet = 1 WHERE id = ?", msg.ID); err != nil {
+			s.logf(LogError, msg.Recipient, "Failed to tag message %s as quiet: %v", msg.ID, err)
+		}
+	}
+	if !request {
+		s.inbox.notify(msg.Recipient)
+	}
+
 	// Update sender's last seen time
-	_, err = s.db.Exec(
+	_, err = s.db.ExecContext(ctx,
 		"UPDATE users SET last_seen = ?, online = 1 WHERE id = ?",
 		time.Now().Unix(),
 		msg.Sender,
 	)
 	if err != nil {
-		log.Printf("Failed to update sender's last seen time: %v", err)
+		s.logf(LogError, msg.Sender, "Failed to update sender's last seen time: %v", err)
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SendResult{ID: msg.ID, Status: SendStatusStored, ReceiptsDisabled: !receipts, Request: request})
+}
+
+// markRead sets read_at on a recipient's unread messages among ids, and fetched_at
+// where it is still missing, since a message read was also delivered. It returns
+// the number of messages newly marked.
+func (s *Server) markRead(ctx context.Context, userID string, ids []string, now time.Time) (int64, error) {
+	const batch = 500
+	var marked int64
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > batch {
+			n = batch
+		}
+		args := []interface{}{now.Unix(), now.Unix(), userID, now.Unix()}
+		for _, id := range ids[:n] {
+			args = append(args, id)
+		}
+		result, err := s.db.ExecContext(ctx,
+			"UPDATE messages SET read_at = ?, fetched_at = COALESCE(fetched_at, ?) WHERE recipient_id = ? AND read_at IS NULL AND expires_at > ? AND id IN (?"+strings.Repeat(", ?", n-1)+")",
+			args...,
+		)
+		if err != nil {
+			return marked, err
+		}
+		if rows, err := result.RowsAffected(); err == nil {
+			marked += rows
+		}
+		ids = ids[n:]
+	}
+	return marked, nil
 }
 
-// handleMessages returns messages for a user
+// handleMessages returns messages for a user. Fetching records delivery but never
+// marks messages read, so checking for messages sends no read receipt; recipients
+// report reads through /message/read. Messages held as requests are left out until
+// the recipient accepts their sender through /requests.
 func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
 		http.Error(w, "User ID required", http.StatusBadRequest)
 		return
 	}
 
-	// Parse query parameters
-	unreadOnly := r.URL.Query().Get("unread") == "true"
-	limit := 0
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		var err error
-		limit, err = strconv.Atoi(limitStr)
+	// Only the recipient may fetch, since a fetch records messages as delivered; a
+	// gRPC Watch checks the signature of its subscription once for all its fetches
+	if watcher, _ := ctx.Value(watchUserKey{}).(string); watcher != userID {
+		ok, err := s.verifySignedRequest(ctx, r, "messages", userID)
 		if err != nil {
-			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			dbError(w, ctx, "Database error")
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
 			return
 		}
 	}
+
+	// Parse query parameters
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	search := r.URL.Query().Get("search")
 
 	// Build query
 	query := `
 		SELECT m.id, m.sender_id, m.recipient_id, m.content, m.created_at, m.read_at, m.expires_at,
-			   u.display_name as sender_name
+			   m.fetched_at, COALESCE(u.display_name, m.sender_id) as sender_name
 		FROM messages m
-		JOIN users u ON m.sender_id = u.id
-		WHERE m.recipient_id = ? AND m.expires_at > ?
+		LEFT JOIN users u ON m.sender_id = u.id
+		WHERE m.recipient_id = ? AND m.expires_at > ? AND m.request = 0
 	`
 	args := []interface{}{userID, time.Now().Unix()}
 
@@ -424,72 +1583,88 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 		query += " AND m.read_at IS NULL"
 	}
 	if search != "" {
-		// Note: This is a simple search. For better search, consider using FTS5
-		query += " AND m.content LIKE ?"
-		args = append(args, "%"+search+"%")
+		// Content is encrypted; only the sender's name can be searched
+		condition, searchArgs := s.userSearchCondition("m.sender_id", search)
+		query += " AND " + condition
+		args = append(args, searchArgs...)
+	}
+	if page.since > 0 {
+		query += " AND m.created_at >= ?"
+		args = append(args, page.since)
+	}
+	if page.hasCursor {
+		query += " AND (m.created_at < ? OR (m.created_at = ? AND m.id < ?))"
+		args = append(args, page.cursorTime, page.cursorTime, page.cursorID)
 	}
 
-	query += " ORDER BY m.created_at DESC"
+	query += " ORDER BY m.created_at DESC, m.id DESC"
 
-	if limit > 0 {
+	// Fetch one extra row to learn whether another page follows
+	if page.limit > 0 {
 		query += " LIMIT ?"
-		args = append(args, limit)
+		args = append(args, page.limit+1)
 	}
 
 	// Execute query
-	rows, err := s.db.Query(query, args...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		http.Error(w, "Failed to query messages", http.StatusInternalServerError)
+		dbError(w, ctx, "Failed to query messages")
 		return
 	}
 	defer rows.Close()
 
-	var messages []Message
+	var messages []crypto.Message
+	var firstFetched []Message
+	fetched := 0
+	var last Message
 	for rows.Next() {
 		var msg Message
 		var createdUnix, expiresUnix int64
-		var readUnix sql.NullInt64
+		var readUnix, fetchedUnix sql.NullInt64
 		var senderName string
 		if err := rows.Scan(
 			&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Content,
-			&createdUnix, &readUnix, &expiresUnix, &senderName,
+			&createdUnix, &readUnix, &expiresUnix, &fetchedUnix, &senderName,
 		); err != nil {
-			http.Error(w, "Failed to scan message", http.StatusInternalServerError)
+			dbError(w, ctx, "Failed to scan message")
 			return
 		}
+		fetched++
+		if page.limit > 0 && fetched > page.limit {
+			break
+		}
 		msg.CreatedAt = time.Unix(createdUnix, 0)
 		msg.ExpiresAt = time.Unix(expiresUnix, 0)
 		if readUnix.Valid {
 			readTime := time.Unix(readUnix.Int64, 0)
 			msg.ReadAt = &readTime
 		}
-		messages = append(messages, msg)
+		messages = append(messages, msg.Envelope())
+		last = msg
+		if !fetchedUnix.Valid {
+			firstFetched = append(firstFetched, msg)
+		}
 	}
+	rows.Close()
 
-	// Mark messages as read
-	if !unreadOnly {
-		_, err = s.db.Exec(
-			"UPDATE messages SET read_at = ? WHERE recipient_id = ? AND read_at IS NULL",
-			time.Now().Unix(),
-			userID,
-		)
-		if err != nil {
-			log.Printf("Failed to mark messages as read: %v", err)
-		}
+	// Record delivery latency for messages fetched for the first time
+	if err := s.recordFirstFetch(ctx, firstFetched, time.Now()); err != nil {
+		s.logf(LogError, userID, "Failed to record message delivery: %v", err)
 	}
 
+	setNextCursor(w, page, fetched, last.CreatedAt, last.ID)
+
 	// Update user's last seen time
-	_, err = s.db.Exec(
+	_, err = s.db.ExecContext(ctx,
 		"UPDATE users SET last_seen = ?, online = 1 WHERE id = ?",
 		time.Now().Unix(),
 		userID,
 	)
 	if err != nil {
-		log.Printf("Failed to update user's last seen time: %v", err)
+		s.logf(LogError, userID, "Failed to update user's last seen time: %v", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	writeEnvelopes(w, r, messages)
 }
 
 // handleHealth handles the health check endpoint
@@ -498,18 +1673,35 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !writeProtocol(w, r) {
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
 
 	// Check database connection
-	if err := s.db.Ping(); err != nil {
+	if err := s.db.PingContext(ctx); err != nil {
 		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	s.mu.RLock()
+	health := map[string]interface{}{
+		"status":      "ok",
+		"config":      s.config,
+		"server_time": time.Now().UTC(),
+		// The body is the same whichever version was negotiated
+		"protocol_versions": ProtocolVersions,
+		"envelope_formats":  EnvelopeFormats,
+	}
+	if s.onionAddress != "" {
+		health["onion_address"] = s.onionAddress
+	}
+	s.mu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "ok",
-		"config": s.config,
-	})
+	json.NewEncoder(w).Encode(health)
 }
 
 // handleConfig handles the hub configuration endpoint
@@ -530,6 +1722,9 @@ func (s *Server) handleCheckUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
 	username := r.URL.Query().Get("username")
 	if username == "" {
 		http.Error(w, "Username required", http.StatusBadRequest)
@@ -537,9 +1732,13 @@ func (s *Server) handleCheckUsername(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE display_name = ?)", username).Scan(&exists)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM users WHERE display_name = ?)
+			OR EXISTS(SELECT 1 FROM provisioned_users WHERE display_name = ? AND claimed_at IS NULL)`,
+		username, username,
+	).Scan(&exists)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, ctx, "Database error")
 		return
 	}
 
@@ -549,6 +1748,59 @@ func (s *Server) handleCheckUsername(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// SetOIDC configures OIDC-gated registration; an empty issuer turns the mode off
+func (s *Server) SetOIDC(issuer, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.OIDCIssuer = issuer
+	s.config.OIDCClientID = clientID
+	s.config.RequireOIDC = issuer != ""
+}
+
+// SetQuotas sets the user and storage quotas (zero means unlimited)
+func (s *Server) SetQuotas(maxUsers int, maxStorageBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.MaxUsers = maxUsers
+	s.config.MaxStorageBytes = maxStorageBytes
+}
+
+// SetMaxMessageSize sets the largest message content the hub accepts (zero means unlimited)
+func (s *Server) SetMaxMessageSize(maxSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.MaxMessageSize = maxSize
+}
+
+// SetMaxAttachmentSize sets the largest attachment the hub accepts (zero means unlimited)
+func (s *Server) SetMaxAttachmentSize(maxSize int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.MaxAttachmentSize = maxSize
+}
+
+// SetLogFile configures file logging and its rotation limits
+func (s *Server) SetLogFile(path string, maxSizeMB int, maxAge time.Duration, maxBackups int, compress bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.LogFile = path
+	s.config.LogMaxSizeMB = maxSizeMB
+	s.config.LogMaxAge = maxAge
+	s.config.LogMaxBackups = maxBackups
+	s.config.LogCompress = compress
+}
+
+// SetLogFormat sets the format of the process log, applied when the hub next starts
+func (s *Server) SetLogFormat(format string) error {
+	if !ValidLogFormat(format) {
+		return fmt.Errorf("unknown log format %q (use %s or %s)", format, LogFormatText, LogFormatJSON)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.LogFormat = format
+	return nil
+}
+
 // SetPort sets the port number for the server
 func (s *Server) SetPort(port int) {
 	s.port = port
@@ -561,6 +1813,16 @@ func (s *Server) SetTimeout(timeout time.Duration) {
 	s.config.HubTimeout = timeout
 }
 
+// messageExpiry returns when a message stored at now is deleted: after the hub's
+// message expiry, or sooner if its sender asked for that
+func (s *Server) messageExpiry(msg *crypto.Message, now time.Time) time.Time {
+	expiresAt := now.Add(s.Config().MessageExpiry)
+	if msg.ExpiresAt != 0 && msg.ExpiresAt < expiresAt.Unix() {
+		expiresAt = time.Unix(msg.ExpiresAt, 0)
+	}
+	return expiresAt
+}
+
 // SetMessageExpiry sets the message expiry duration
 func (s *Server) SetMessageExpiry(expiry time.Duration) {
 	s.mu.Lock()
@@ -574,3 +1836,47 @@ func (s *Server) SetRateLimit(limit int) {
 	defer s.mu.Unlock()
 	s.config.RateLimit = limit
 }
+
+// SetUserPurgeDelay sets how long deactivated users are kept before being purged
+func (s *Server) SetUserPurgeDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.UserPurgeDelay = delay
+}
+
+// SetDedupeWindow sets the duplicate-send suppression window (zero disables it)
+func (s *Server) SetDedupeWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.DedupeWindow = window
+}
+
+// SetUnsendWindow sets how long after sending a fetched message may still be deleted
+// by its sender (zero limits unsending to unfetched messages)
+func (s *Server) SetUnsendWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.UnsendWindow = window
+}
+
+// SetUserWebhooks allows or forbids user-registered webhook notifications
+func (s *Server) SetUserWebhooks(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.UserWebhooks = enabled
+}
+
+// SetRequireInvite opens registration to anyone or restricts it to holders of an
+// invite code
+func (s *Server) SetRequireInvite(required bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.RequireInvite = required
+}
+
+// SetClockSkewTolerance sets how far message timestamps may drift from hub time
+func (s *Server) SetClockSkewTolerance(tolerance time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.ClockSkewTolerance = tolerance
+}
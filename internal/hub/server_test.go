@@ -0,0 +1,175 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// newTestServer returns a hub on a fresh database in a temporary directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(filepath.Join(t.TempDir(), "hub.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// testUser is a registered user and their identity key
+type testUser struct {
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// addTestUser registers a user with a new identity key
+func addTestUser(t *testing.T, s *Server, name string) testUser {
+	t.Helper()
+	key, publicKeyPEM, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := testUser{ID: uuid.New().String(), Key: key}
+	if _, err := s.db.Exec(
+		"INSERT INTO users (id, display_name, public_key, last_seen) VALUES (?, ?, ?, ?)",
+		u.ID, name, string(publicKeyPEM), time.Now().Unix(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// signedQuery signs a request for action as userID with key at ts, as clients do
+func signedQuery(t *testing.T, key *rsa.PrivateKey, userID string, ts time.Time, action string, fields ...string) url.Values {
+	t.Helper()
+	payload := crypto.RequestPayload(action, userID, ts.Unix(), fields...)
+	sig, err := crypto.SignData(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{}
+	query.Set("user_id", userID)
+	query.Set("ts", fmt.Sprint(ts.Unix()))
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+	return query
+}
+
+// bodyHash is the SHA-256 of a request body as signed requests carry it
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// count returns the number of rows in table
+func count(t *testing.T, s *Server, table string) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestHandleMessageSignature checks that a send is only accepted signed by the
+// sender's key over its exact body, and that refused sends neither charge the
+// sender's quota nor store or relay the message
+func TestHandleMessageSignature(t *testing.T) {
+	s := newTestServer(t)
+	s.SetFederation("hub.example", false)
+	alice := addTestUser(t, s, "alice")
+	bob := addTestUser(t, s, "bob")
+	mallory := addTestUser(t, s, "mallory")
+
+	// envelope is a message from alice to recipient
+	envelope := func(recipient string) []byte {
+		msg, err := crypto.EncryptMessage(alice.Key, &bob.Key.PublicKey, nil, []byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.ID = uuid.New().String()
+		msg.Sender = alice.ID
+		msg.Recipient = recipient
+		msg.Timestamp = time.Now().Unix()
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	tests := []struct {
+		name  string
+		query func(body []byte) url.Values
+		// accepted sends are stored (201) or relayed (202); all others must get 401
+		accepted bool
+	}{
+		{"unsigned", func(body []byte) url.Values {
+			return url.Values{"user_id": {alice.ID}}
+		}, false},
+		{"stale", func(body []byte) url.Values {
+			return signedQuery(t, alice.Key, alice.ID, time.Now().Add(-time.Hour), "message", bodyHash(body))
+		}, false},
+		{"other user's key", func(body []byte) url.Values {
+			return signedQuery(t, mallory.Key, alice.ID, time.Now(), "message", bodyHash(body))
+		}, false},
+		{"other user signing as themselves", func(body []byte) url.Values {
+			return signedQuery(t, mallory.Key, mallory.ID, time.Now(), "message", bodyHash(body))
+		}, false},
+		{"different body", func(body []byte) url.Values {
+			return signedQuery(t, alice.Key, alice.ID, time.Now(), "message", bodyHash(append(body, ' ')))
+		}, false},
+		{"signed", func(body []byte) url.Values {
+			return signedQuery(t, alice.Key, alice.ID, time.Now(), "message", bodyHash(body))
+		}, true},
+	}
+
+	for _, recipient := range []struct {
+		name    string
+		address string
+		table   string
+	}{
+		{"local", bob.ID, "messages"},
+		{"federated", "dave@peer.example", "outbound_deliveries"},
+	} {
+		for _, tt := range tests {
+			t.Run(recipient.name+"/"+tt.name, func(t *testing.T) {
+				if _, err := s.db.Exec("DELETE FROM send_usage"); err != nil {
+					t.Fatal(err)
+				}
+				stored := count(t, s, recipient.table)
+
+				body := envelope(recipient.address)
+				req := httptest.NewRequest(http.MethodPost, "/messages?"+tt.query(body).Encode(), bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				s.handleMessage(rec, req)
+
+				if tt.accepted && rec.Code != http.StatusCreated && rec.Code != http.StatusAccepted {
+					t.Fatalf("status %d, want the send accepted: %s", rec.Code, rec.Body.String())
+				}
+				if !tt.accepted && rec.Code != http.StatusUnauthorized {
+					t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body.String())
+				}
+				charged, sent := count(t, s, "send_usage") > 0, count(t, s, recipient.table) > stored
+				if charged != tt.accepted || sent != tt.accepted {
+					t.Fatalf("quota charged %v and message stored or relayed %v, want %v", charged, sent, tt.accepted)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// loadConfig overlays the persisted hub configuration, if any, onto the defaults
+func (s *Server) loadConfig(ctx context.Context) error {
+	var data string
+	err := s.db.QueryRowContext(ctx, "SELECT config FROM settings WHERE id = 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load hub configuration: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.Unmarshal([]byte(data), &s.config); err != nil {
+		return fmt.Errorf("failed to parse hub configuration: %v", err)
+	}
+	return nil
+}
+
+// SaveConfig persists the current hub configuration so it survives restarts, and
+// records the settings it changed in the audit log
+func (s *Server) SaveConfig(ctx context.Context) error {
+	s.mu.RLock()
+	data, err := json.Marshal(s.config)
+	s.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal hub configuration: %v", err)
+	}
+
+	var stored string
+	err = s.db.QueryRowContext(ctx, "SELECT config FROM settings WHERE id = 1").Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to load hub configuration: %v", err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO settings (id, config) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET config = excluded.config",
+		string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save hub configuration: %v", err)
+	}
+	if changes := configChanges([]byte(stored), data); len(changes) > 0 {
+		s.audit(ctx, "config.change", "", changes)
+	}
+	return nil
+}
+
+// Config returns a copy of the current hub configuration
+func (s *Server) Config() HubConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
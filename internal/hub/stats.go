@@ -0,0 +1,123 @@
+package hub
+
+import (
+	"context"
+	"time"
+)
+
+// recordFirstFetch marks messages as fetched and adds their store-to-first-fetch
+// latency to the daily delivery stats
+func (s *Server) recordFirstFetch(ctx context.Context, messages []Message, at time.Time) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var delivered, latencySum, latencyMax int64
+	for _, m := range messages {
+		result, err := tx.ExecContext(ctx,
+			"UPDATE messages SET fetched_at = ? WHERE id = ? AND fetched_at IS NULL",
+			at.Unix(), m.ID,
+		)
+		if err != nil {
+			return err
+		}
+		// A concurrent fetch may have recorded it already
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		latency := at.Unix() - m.CreatedAt.Unix()
+		if latency < 0 {
+			latency = 0
+		}
+		delivered++
+		latencySum += latency
+		if latency > latencyMax {
+			latencyMax = latency
+		}
+	}
+
+	if delivered > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO delivery_stats (day, delivered, latency_sum, latency_max) VALUES (?, ?, ?, ?)
+			ON CONFLICT(day) DO UPDATE SET
+				delivered = delivery_stats.delivered + excluded.delivered,
+				latency_sum = delivery_stats.latency_sum + excluded.latency_sum,
+				latency_max = CASE WHEN excluded.latency_max > delivery_stats.latency_max
+					THEN excluded.latency_max ELSE delivery_stats.latency_max END`,
+			statsDay(at), delivered, latencySum, latencyMax,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordExpiredUnfetched counts messages about to expire that were never fetched
+func (s *Server) recordExpiredUnfetched(ctx context.Context, at time.Time) error {
+	return s.recordUnfetched(ctx, at, "expires_at <= ? AND fetched_at IS NULL", at.Unix())
+}
+
+// recordUnfetched adds the messages matching where, which must only match messages
+// never fetched, to the day's count of messages removed undelivered
+func (s *Server) recordUnfetched(ctx context.Context, at time.Time, where string, args ...interface{}) error {
+	var n int64
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE "+where, args...).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO delivery_stats (day, expired_unfetched) VALUES (?, ?)
+		ON CONFLICT(day) DO UPDATE SET expired_unfetched = delivery_stats.expired_unfetched + excluded.expired_unfetched`,
+		statsDay(at), n,
+	)
+	return err
+}
+
+// sizeBuckets are the upper bounds (exclusive) of the message size histogram;
+// messages at or above the last bound fall into a final open bucket
+var sizeBuckets = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20}
+
+// sizeBucketLabels name each histogram bucket, including the open one
+var sizeBucketLabels = []string{"< 1 KB", "1-10 KB", "10-100 KB", "100 KB-1 MB", ">= 1 MB"}
+
+// sizeBucket returns the histogram bucket index for a stored message size
+func sizeBucket(size int64) int {
+	for i, bound := range sizeBuckets {
+		if size < bound {
+			return i
+		}
+	}
+	return len(sizeBuckets)
+}
+
+// statsDay truncates t to the start of its UTC day, the granularity of the stats tables
+func statsDay(t time.Time) int64 {
+	return t.UTC().Truncate(24 * time.Hour).Unix()
+}
+
+// recordMessageStats adds a stored message to the daily stats tables. Unlike the
+// messages table these are never expired, so they keep the long-term trend.
+func (s *Server) recordMessageStats(ctx context.Context, senderID string, size int64, at time.Time) error {
+	day := statsDay(at)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO message_stats (day, sender_id, messages, bytes) VALUES (?, ?, 1, ?)
+		ON CONFLICT(day, sender_id) DO UPDATE SET messages = message_stats.messages + 1, bytes = message_stats.bytes + excluded.bytes`,
+		day, senderID, size,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO message_size_stats (day, bucket, messages) VALUES (?, ?, 1)
+		ON CONFLICT(day, bucket) DO UPDATE SET messages = message_size_stats.messages + 1`,
+		day, sizeBucket(size),
+	)
+	return err
+}
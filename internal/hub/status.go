@@ -0,0 +1,273 @@
+package hub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Delivery states reported by /message/status
+const (
+	DeliveryStored    = "stored"    // held by the hub, not yet fetched
+	DeliveryDelivered = "delivered" // fetched by the recipient
+	DeliveryRead      = "read"      // marked read by the recipient
+	// DeliveryNoReceipts hides whether the message was fetched or read, as the
+	// recipient's receipt policy asks
+	DeliveryNoReceipts = "receipts_disabled"
+	// DeliveryRequest is a message held as a message request, which the recipient
+	// cannot fetch until they accept the sender
+	DeliveryRequest = "request"
+)
+
+// maxReadIDs bounds the number of messages one /message/read request marks
+const maxReadIDs = 1000
+
+// signedRequestMaxAge bounds how old a signed request timestamp may be when the hub
+// has no clock skew tolerance configured
+const signedRequestMaxAge = 5 * time.Minute
+
+// MessageStatus is the delivery state of a message as shown to its sender
+type MessageStatus struct {
+	ID            string     `json:"id"`
+	RecipientID   string     `json:"recipient_id"`
+	RecipientName string     `json:"recipient_name,omitempty"`
+	State         string     `json:"state"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	ReadAt        *time.Time `json:"read_at,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	// QuietHours is set when the message arrived during the recipient's quiet hours,
+	// so they were not notified of it
+	QuietHours bool `json:"quiet_hours,omitempty"`
+	// InReplyTo is the ID of the message this one answers, if any
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	// Replies counts the stored replies to this message addressed to its sender
+	Replies int `json:"replies,omitempty"`
+}
+
+// requestSignature returns the ts and sig parameters of a signed request, reporting
+// false when either is malformed or ts is outside the allowed clock window
+func (s *Server) requestSignature(r *http.Request) (int64, []byte, bool) {
+	ts, err := strconv.ParseInt(r.URL.Query().Get("ts"), 10, 64)
+	if err != nil || !s.signatureFresh(ts) {
+		return 0, nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("sig"))
+	if err != nil {
+		return 0, nil, false
+	}
+	return ts, sig, true
+}
+
+// signatureFresh reports whether a request signed at ts is within the allowed clock window
+func (s *Server) signatureFresh(ts int64) bool {
+	window := s.Config().ClockSkewTolerance
+	if window <= 0 {
+		window = signedRequestMaxAge
+	}
+	age := time.Since(time.Unix(ts, 0))
+	return age <= window && age >= -window
+}
+
+// verifySignedRequest checks that a request was signed by userID's registered key
+// for action and fields, within the allowed clock window
+func (s *Server) verifySignedRequest(ctx context.Context, r *http.Request, action, userID string, fields ...string) (bool, error) {
+	ts, sig, ok := s.requestSignature(r)
+	if !ok {
+		return false, nil
+	}
+	return s.verifySignature(ctx, ts, sig, action, userID, fields...)
+}
+
+// verifySignature checks a request signature made at ts by userID's registered key
+// for action and fields; the caller checks that ts is fresh
+func (s *Server) verifySignature(ctx context.Context, ts int64, sig []byte, action, userID string, fields ...string) (bool, error) {
+	var publicKeyPEM string
+	var signingKeyPEM sql.NullString
+	err := s.db.QueryRowContext(ctx,
+		"SELECT public_key, signing_key FROM users WHERE id = ? AND deactivated_at IS NULL", userID,
+	).Scan(&publicKeyPEM, &signingKeyPEM)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	payload := crypto.RequestPayload(action, userID, ts, fields...)
+	// Users with a signing key sign with it; the RSA key is still accepted from
+	// clients that have not loaded it
+	if signingKeyPEM.String != "" && len(sig) == ed25519.SignatureSize {
+		signingKey, err := crypto.LoadSigningPublicKeyFromPEM(signingKeyPEM.String)
+		if err != nil {
+			return false, nil
+		}
+		return ed25519.Verify(signingKey, payload, sig), nil
+	}
+	publicKey, err := crypto.LoadPublicKeyFromPEM([]byte(publicKeyPEM))
+	if err != nil {
+		return false, nil
+	}
+	return crypto.VerifyData(publicKey, payload, sig) == nil, nil
+}
+
+// handleMessageStatus reports delivery timestamps of a message to its sender only
+func (s *Server) handleMessageStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	id := r.URL.Query().Get("id")
+	userID := r.URL.Query().Get("user_id")
+	if id == "" || userID == "" {
+		http.Error(w, "Message ID and user ID required", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.verifySignedRequest(ctx, r, "message-status", userID, id)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	status := MessageStatus{ID: id}
+	var createdAt, expiresAt int64
+	var fetchedAt, readAt sql.NullInt64
+	var recipientName, inReplyTo sql.NullString
+	var noReceipts, request bool
+	// Messages sent by someone else are reported as missing so their existence is not revealed
+	err = s.db.QueryRowContext(ctx, `
+		SELECT m.recipient_id, u.display_name, m.created_at, m.fetched_at, m.read_at, m.expires_at, m.quiet, m.in_reply_to, m.no_receipts, m.request,
+			(SELECT COUNT(*) FROM messages r WHERE r.in_reply_to = m.id AND r.recipient_id = m.sender_id AND r.expires_at > ?)
+		FROM messages m LEFT JOIN users u ON u.id = m.recipient_id
+		WHERE m.id = ? AND m.sender_id = ? AND m.expires_at > ?`,
+		time.Now().Unix(), id, userID, time.Now().Unix(),
+	).Scan(&status.RecipientID, &recipientName, &createdAt, &fetchedAt, &readAt, &expiresAt, &status.QuietHours, &inReplyTo, &noReceipts, &request, &status.Replies)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+
+	status.RecipientName = recipientName.String
+	status.InReplyTo = inReplyTo.String
+	status.CreatedAt = time.Unix(createdAt, 0)
+	status.ExpiresAt = time.Unix(expiresAt, 0)
+	status.State = DeliveryStored
+	// A policy made stricter since the message was sent applies to it too
+	if !noReceipts {
+		allowed, err := s.receiptsAllowed(ctx, status.RecipientID, userID)
+		if err != nil {
+			dbError(w, ctx, "Database error")
+			return
+		}
+		noReceipts = !allowed
+	}
+	if noReceipts {
+		status.State = DeliveryNoReceipts
+		fetchedAt, readAt = sql.NullInt64{}, sql.NullInt64{}
+	}
+	if request {
+		status.State = DeliveryRequest
+	}
+	if fetchedAt.Valid {
+		t := time.Unix(fetchedAt.Int64, 0)
+		status.DeliveredAt = &t
+		status.State = DeliveryDelivered
+	}
+	if readAt.Valid {
+		t := time.Unix(readAt.Int64, 0)
+		status.ReadAt = &t
+		status.State = DeliveryRead
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// ReadRequest lists received messages the recipient has read
+type ReadRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// ReadResult reports how many of the listed messages were newly marked read; IDs
+// that are unknown, expired, already read or addressed to someone else are skipped
+type ReadResult struct {
+	Marked int64 `json:"marked"`
+}
+
+// handleMessageRead records that the calling user read some of their messages, which
+// their senders then see in /message/status. This is the only way a message moves
+// from delivered to read.
+func (s *Server) handleMessageRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReadIDs*64))
+	if err != nil {
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+		}
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	ok, err := s.verifySignedRequest(ctx, r, "message-read", userID, hex.EncodeToString(sum[:]))
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReadRequest
+	if err := json.Unmarshal(body, &req); err != nil || len(req.IDs) == 0 {
+		http.Error(w, "Message IDs required", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxReadIDs {
+		http.Error(w, fmt.Sprintf("At most %d message IDs per request", maxReadIDs), http.StatusBadRequest)
+		return
+	}
+
+	marked, err := s.markRead(ctx, userID, req.IDs, time.Now())
+	if err != nil {
+		dbError(w, ctx, "Failed to mark messages read")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReadResult{Marked: marked})
+}
@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Database drivers the hub can store its state with
+const (
+	// DriverSQLite keeps the hub in a single SQLite file (the default)
+	DriverSQLite = "sqlite3"
+	// DriverPostgres keeps the hub in a PostgreSQL database, which several hub
+	// replicas can share
+	DriverPostgres = "postgres"
+)
+
+// Store is the SQL database holding the hub's state. Queries are written in the
+// SQLite dialect with ? placeholders; stores for other databases translate them.
+type Store interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (StoreTx, error)
+	PingContext(ctx context.Context) error
+	Close() error
+
+	// Driver names the database behind the store (DriverSQLite or DriverPostgres)
+	Driver() string
+	// HasColumn reports whether table has column, for upgrading older schemas
+	HasColumn(table, column string) (bool, error)
+	// Size returns the bytes the database takes up, or -1 when it cannot tell
+	Size(ctx context.Context) int64
+	// Optimize refreshes the query planner's statistics and reclaims the space of
+	// deleted rows
+	Optimize(ctx context.Context) error
+}
+
+// StoreTx is a transaction on a Store
+type StoreTx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	Commit() error
+	Rollback() error
+}
+
+// SQLite connection settings. WAL lets readers proceed while a write is in progress,
+// and writers wait up to sqliteBusyTimeout for one another instead of failing with
+// "database is locked".
+const (
+	sqliteBusyTimeout  = 5 * time.Second
+	sqliteMaxOpenConns = 8
+)
+
+// OpenStore opens the hub database: for DriverSQLite, dsn is the path of the
+// database file; for DriverPostgres, a connection string such as
+// postgres://clsp@db.example.com/clsp?sslmode=verify-full
+func OpenStore(driver, dsn string) (Store, error) {
+	switch driver {
+	case DriverSQLite, "":
+		db, err := sql.Open(DriverSQLite, sqliteDSN(dsn))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %v", err)
+		}
+		db.SetMaxOpenConns(sqliteMaxOpenConns)
+		db.SetMaxIdleConns(sqliteMaxOpenConns)
+		return &sqliteStore{DB: db, path: dsn}, nil
+	case DriverPostgres:
+		return openPostgresStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q (use %s or %s)", driver, DriverSQLite, DriverPostgres)
+	}
+}
+
+// sqliteDSN adds the journal and locking settings every connection to the database
+// at path opens with
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d", path, sep, sqliteBusyTimeout.Milliseconds())
+}
+
+// sqliteStore is a Store on a SQLite file; queries are already in its dialect
+type sqliteStore struct {
+	*sql.DB
+	path string
+}
+
+func (s *sqliteStore) BeginTx(ctx context.Context, opts *sql.TxOptions) (StoreTx, error) {
+	return s.DB.BeginTx(ctx, opts)
+}
+
+func (s *sqliteStore) Driver() string {
+	return DriverSQLite
+}
+
+func (s *sqliteStore) HasColumn(table, column string) (bool, error) {
+	rows, err := s.DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Size adds up the database file and its write-ahead log
+func (s *sqliteStore) Size(ctx context.Context) int64 {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return -1
+	}
+	size := info.Size()
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if info, err := os.Stat(s.path + suffix); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Optimize analyzes the tables, rebuilds the file without its free pages and
+// truncates the write-ahead log
+func (s *sqliteStore) Optimize(ctx context.Context) error {
+	for _, statement := range []string{"ANALYZE", "VACUUM", "PRAGMA wal_checkpoint(TRUNCATE)"} {
+		if _, err := s.DB.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s failed: %v", statement, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore is a Store on PostgreSQL. It translates the hub's SQLite queries:
+// ? placeholders become $1, $2..., INSERT OR IGNORE becomes ON CONFLICT DO NOTHING
+// and booleans are passed as 0 or 1, as SQLite stores them. Table definitions get
+// PostgreSQL types, and lose their foreign keys, which SQLite does not enforce
+// either (messages from other hubs name senders that are not users of this one).
+type postgresStore struct {
+	db *sql.DB
+}
+
+// Connection pool limits on PostgreSQL. Replicas share the server's connection limit,
+// so each keeps its pool modest, and connections are recycled so that a restarted
+// server or a moved load balancer target is picked up.
+const (
+	postgresMaxOpenConns    = 20
+	postgresMaxIdleConns    = 5
+	postgresConnMaxLifetime = 30 * time.Minute
+)
+
+// openPostgresStore connects to the PostgreSQL database at dsn
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("the postgres driver needs a connection string (--dsn)")
+	}
+	db, err := sql.Open(DriverPostgres, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	db.SetMaxOpenConns(postgresMaxOpenConns)
+	db.SetMaxIdleConns(postgresMaxIdleConns)
+	db.SetConnMaxLifetime(postgresConnMaxLifetime)
+	return &postgresStore{db: db}, nil
+}
+
+var (
+	pgAutoIncrement = regexp.MustCompile(`(?i)\bINTEGER PRIMARY KEY AUTOINCREMENT\b`)
+	pgForeignKey    = regexp.MustCompile(`(?i),\s*FOREIGN KEY\s*\([^)]*\)\s*REFERENCES\s+\w+\s*\([^)]*\)`)
+	pgInteger       = regexp.MustCompile(`(?i)\b(INTEGER|BOOLEAN)\b`)
+	pgBlob          = regexp.MustCompile(`(?i)\bBLOB\b`)
+)
+
+// rebind translates a query from the SQLite dialect
+func (s *postgresStore) rebind(query string) string {
+	trimmed := strings.ToUpper(strings.TrimSpace(query))
+	switch {
+	case strings.HasPrefix(trimmed, "CREATE TABLE"), strings.HasPrefix(trimmed, "ALTER TABLE"):
+		query = pgAutoIncrement.ReplaceAllString(query, "BIGSERIAL PRIMARY KEY")
+		query = pgForeignKey.ReplaceAllString(query, "")
+		query = pgInteger.ReplaceAllString(query, "BIGINT")
+		query = pgBlob.ReplaceAllString(query, "BYTEA")
+	case strings.HasPrefix(trimmed, "INSERT OR IGNORE INTO"):
+		query = strings.Replace(query, "OR IGNORE ", "", 1) + " ON CONFLICT DO NOTHING"
+	}
+
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// args passes booleans as integers, the type the hub's flag columns have
+func (s *postgresStore) args(args []interface{}) []interface{} {
+	var converted []interface{}
+	for i, arg := range args {
+		v, ok := arg.(bool)
+		if !ok {
+			continue
+		}
+		if converted == nil {
+			converted = append([]interface{}(nil), args...)
+		}
+		converted[i] = 0
+		if v {
+			converted[i] = 1
+		}
+	}
+	if converted == nil {
+		return args
+	}
+	return converted
+}
+
+func (s *postgresStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), s.args(args)...)
+}
+
+func (s *postgresStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), s.args(args)...)
+}
+
+func (s *postgresStore) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(query), s.args(args)...)
+}
+
+func (s *postgresStore) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), s.args(args)...)
+}
+
+func (s *postgresStore) BeginTx(ctx context.Context, opts *sql.TxOptions) (StoreTx, error) {
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTx{tx: tx, store: s}, nil
+}
+
+func (s *postgresStore) PingContext(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *postgresStore) Driver() string {
+	return DriverPostgres
+}
+
+func (s *postgresStore) HasColumn(table, column string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2)",
+		table, column,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (s *postgresStore) Size(ctx context.Context) int64 {
+	var size int64
+	if err := s.db.QueryRowContext(ctx, "SELECT pg_database_size(current_database())").Scan(&size); err != nil {
+		return -1
+	}
+	return size
+}
+
+// Optimize vacuums and analyzes the tables, in case autovacuum is off or lagging
+func (s *postgresStore) Optimize(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "VACUUM ANALYZE"); err != nil {
+		return fmt.Errorf("VACUUM ANALYZE failed: %v", err)
+	}
+	return nil
+}
+
+// postgresTx is a transaction on a postgresStore, translating its queries likewise
+type postgresTx struct {
+	tx    *sql.Tx
+	store *postgresStore
+}
+
+func (t *postgresTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, t.store.rebind(query), t.store.args(args)...)
+}
+
+func (t *postgresTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.QueryContext(ctx, t.store.rebind(query), t.store.args(args)...)
+}
+
+func (t *postgresTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRowContext(ctx, t.store.rebind(query), t.store.args(args)...)
+}
+
+func (t *postgresTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *postgresTx) Rollback() error {
+	return t.tx.Rollback()
+}
@@ -0,0 +1,280 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tenantNamePattern restricts tenant names to values safe as directory names and path segments
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is an isolated hub hosted by a multi-tenant hub process. Each tenant has its
+// own database (users, messages, config, quotas, admin token) and hub signing key.
+type Tenant struct {
+	Name       string    `json:"name"`
+	Hosts      []string  `json:"hosts,omitempty"`
+	PathPrefix string    `json:"path_prefix,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TenantDBPath returns the database path of a tenant hosted next to rootDBPath
+func TenantDBPath(rootDBPath, name string) string {
+	return tenantDBPath(filepath.Dir(rootDBPath), name)
+}
+
+// tenantDBPath returns the database path of a tenant of the hub with data directory dir
+func tenantDBPath(dir, name string) string {
+	return filepath.Join(dir, "tenants", name, "hub.db")
+}
+
+// ValidTenantName reports whether name can be used for a tenant
+func ValidTenantName(name string) bool {
+	return tenantNamePattern.MatchString(name)
+}
+
+// normalizePrefix turns "acme", "/acme/" or "" into "/acme" or ""
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// AddTenant registers a tenant in the root database and initializes its own database
+func (s *Server) AddTenant(ctx context.Context, t Tenant) error {
+	if !ValidTenantName(t.Name) {
+		return fmt.Errorf("invalid tenant name %q (use lowercase letters, digits and dashes)", t.Name)
+	}
+	if s.db.Driver() != DriverSQLite {
+		return fmt.Errorf("tenants need the %s driver: each has a database file of its own", DriverSQLite)
+	}
+	t.PathPrefix = normalizePrefix(t.PathPrefix)
+	if len(t.Hosts) == 0 && t.PathPrefix == "" {
+		t.PathPrefix = "/" + t.Name
+	}
+
+	existing, err := s.ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if other.Name == t.Name {
+			return fmt.Errorf("tenant %s already exists", t.Name)
+		}
+		if t.PathPrefix != "" && other.PathPrefix == t.PathPrefix {
+			return fmt.Errorf("path prefix %s is already used by tenant %s", t.PathPrefix, other.Name)
+		}
+		for _, h := range t.Hosts {
+			for _, oh := range other.Hosts {
+				if strings.EqualFold(h, oh) {
+					return fmt.Errorf("host %s is already used by tenant %s", h, other.Name)
+				}
+			}
+		}
+	}
+
+	tenant, err := NewServer(tenantDBPath(s.dataDir, t.Name))
+	if err != nil {
+		return fmt.Errorf("failed to initialize tenant database: %v", err)
+	}
+	tenant.Shutdown()
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO tenants (name, hosts, path_prefix, created_at) VALUES (?, ?, ?, ?)",
+		t.Name, strings.ToLower(strings.Join(t.Hosts, ",")), t.PathPrefix, time.Now().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register tenant: %v", err)
+	}
+	s.audit(ctx, "tenant.add", t.Name, map[string]interface{}{"hosts": t.Hosts, "path_prefix": t.PathPrefix})
+	return nil
+}
+
+// RemoveTenant unregisters a tenant. Its database is left on disk for the operator
+// to archive or delete.
+func (s *Server) RemoveTenant(ctx context.Context, name string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM tenants WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to remove tenant: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("tenant not found: %s", name)
+	}
+	s.audit(ctx, "tenant.remove", name, nil)
+	return nil
+}
+
+// ListTenants returns the tenants registered in this (root) database
+func (s *Server) ListTenants(ctx context.Context) ([]Tenant, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, hosts, path_prefix, created_at FROM tenants ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %v", err)
+	}
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		var hosts string
+		var createdAt int64
+		if err := rows.Scan(&t.Name, &hosts, &t.PathPrefix, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read tenant: %v", err)
+		}
+		if hosts != "" {
+			t.Hosts = strings.Split(hosts, ",")
+		}
+		t.CreatedAt = time.Unix(createdAt, 0)
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// TenantRouter serves several isolated tenant hubs from one process, selecting the
+// tenant by request hostname first and path prefix second
+type TenantRouter struct {
+	port       int
+	rootDBPath string
+	rootConfig HubConfig
+	tls        TLSOptions
+	server     *http.Server
+	byHost     map[string]http.Handler
+	byPrefix   map[string]http.Handler
+	tenants    []*Server
+}
+
+// NewTenantRouter opens every tenant registered in the root database
+func NewTenantRouter(rootDBPath string) (*TenantRouter, error) {
+	if rootDBPath == "" {
+		return nil, fmt.Errorf("multi-tenant mode requires a root database path")
+	}
+	root, err := NewServer(rootDBPath)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := root.ListTenants(context.Background())
+	rootConfig := root.Config()
+	root.Shutdown()
+	if err != nil {
+		return nil, err
+	}
+
+	router := &TenantRouter{
+		rootDBPath: rootDBPath,
+		rootConfig: rootConfig,
+		byHost:     make(map[string]http.Handler),
+		byPrefix:   make(map[string]http.Handler),
+	}
+	for _, t := range tenants {
+		dbPath := TenantDBPath(rootDBPath, t.Name)
+		if _, err := os.Stat(dbPath); err != nil {
+			router.Shutdown()
+			return nil, fmt.Errorf("tenant %s database missing: %v", t.Name, err)
+		}
+		srv, err := NewServer(dbPath)
+		if err != nil {
+			router.Shutdown()
+			return nil, fmt.Errorf("failed to open tenant %s: %v", t.Name, err)
+		}
+		router.tenants = append(router.tenants, srv)
+		handler := srv.Handler()
+		for _, h := range t.Hosts {
+			router.byHost[strings.ToLower(h)] = handler
+		}
+		if t.PathPrefix != "" {
+			router.byPrefix[t.PathPrefix] = http.StripPrefix(t.PathPrefix, srv.Handler())
+		}
+		slog.Info("Tenant loaded", "tenant", t.Name, "hosts", t.Hosts, "prefix", t.PathPrefix)
+	}
+	return router, nil
+}
+
+// SetPort sets the port the router listens on
+func (tr *TenantRouter) SetPort(port int) {
+	tr.port = port
+}
+
+// Tenants returns the hubs served by the router
+func (tr *TenantRouter) Tenants() []*Server {
+	return tr.tenants
+}
+
+// Config returns the root hub's configuration, which holds process-wide settings such as logging
+func (tr *TenantRouter) Config() HubConfig {
+	return tr.rootConfig
+}
+
+// SetTLS makes Start serve HTTPS for every tenant. With ACME, certificates are also
+// requested for the tenants' hostnames.
+func (tr *TenantRouter) SetTLS(opts TLSOptions) error {
+	if len(opts.ACMEDomains) > 0 {
+		domains := append([]string(nil), opts.ACMEDomains...)
+		for host := range tr.byHost {
+			domains = append(domains, host)
+		}
+		opts.ACMEDomains = domains
+	}
+	for _, srv := range tr.tenants {
+		if err := srv.SetTLS(opts); err != nil {
+			return err
+		}
+	}
+	tr.tls = opts
+	return nil
+}
+
+// ServeHTTP dispatches a request to its tenant, or answers 404 for unknown tenants
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := tr.byHost[strings.ToLower(host)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	// Match the first path segment against tenant prefixes
+	segment := r.URL.Path
+	if i := strings.IndexByte(strings.TrimPrefix(segment, "/"), '/'); i >= 0 {
+		segment = segment[:i+1]
+	}
+	if h, ok := tr.byPrefix[segment]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	http.Error(w, "Unknown tenant", http.StatusNotFound)
+}
+
+// Start runs maintenance for every tenant and serves requests
+func (tr *TenantRouter) Start() error {
+	if len(tr.tenants) == 0 {
+		return fmt.Errorf("no tenants configured; add one with 'clsp-hub tenants --add <name>'")
+	}
+	for _, srv := range tr.tenants {
+		srv.serving.Store(true)
+		go srv.cleanupLoop()
+		go srv.deliveryLoop()
+	}
+	tr.server = newHTTPServer(fmt.Sprintf(":%d", tr.port), tr)
+	return listenAndServe(tr.server, tr.tls, tr.rootDBPath)
+}
+
+// Shutdown stops the listener and closes every tenant database
+func (tr *TenantRouter) Shutdown() {
+	if tr.server != nil {
+		tr.server.Close()
+	}
+	for _, srv := range tr.tenants {
+		srv.Shutdown()
+	}
+}
@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSOptions selects how the hub serves HTTPS. Either a certificate and key file
+// or one or more ACME domains may be set; with neither the hub serves plain HTTP.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// ACMEDomains obtains certificates for these hostnames from Let's Encrypt
+	ACMEDomains []string
+	// ACMEEmail is the contact address registered with the ACME account (optional)
+	ACMEEmail string
+	// ACMECacheDir stores issued certificates and the account key between restarts
+	ACMECacheDir string
+	// ACMEHTTPAddr serves HTTP-01 challenges and redirects plain HTTP to HTTPS
+	// (empty relies on TLS-ALPN-01 challenges on the HTTPS port alone)
+	ACMEHTTPAddr string
+
+	// ClientCAFile requires every client to present a certificate signed by a CA in
+	// this PEM bundle (empty accepts clients without certificates)
+	ClientCAFile string
+}
+
+// Enabled reports whether the options turn on HTTPS
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || len(o.ACMEDomains) > 0
+}
+
+// Validate checks that the options are complete and not contradictory
+func (o TLSOptions) Validate() error {
+	if len(o.ACMEDomains) > 0 && (o.CertFile != "" || o.KeyFile != "") {
+		return fmt.Errorf("use either a certificate and key or ACME, not both")
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("a TLS certificate and key must be given together")
+	}
+	if o.ClientCAFile != "" && !o.Enabled() {
+		return fmt.Errorf("client certificates need HTTPS; pass a TLS certificate or ACME domain too")
+	}
+	return nil
+}
+
+// acmeCacheDir returns the certificate cache directory, defaulting to one in the hub's
+// data directory, next to the database
+func (o TLSOptions) acmeCacheDir(dataDir string) string {
+	if o.ACMECacheDir != "" {
+		return o.ACMECacheDir
+	}
+	return filepath.Join(dataDir, "acme")
+}
+
+// SetTLS makes Start serve HTTPS; /health then reports TLS as enabled
+func (s *Server) SetTLS(opts TLSOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tls = opts
+	s.config.UseTLS = opts.Enabled()
+	s.config.TLSCertPath = opts.CertFile
+	s.config.RequireClientCert = opts.ClientCAFile != ""
+	return nil
+}
+
+// listenAndServe serves srv over plain HTTP, a certificate file or ACME, as opts select
+func listenAndServe(srv *http.Server, opts TLSOptions, dataDir string) error {
+	switch {
+	case len(opts.ACMEDomains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opts.ACMEDomains...),
+			Cache:      autocert.DirCache(opts.acmeCacheDir(dataDir)),
+			Email:      opts.ACMEEmail,
+		}
+		srv.TLSConfig = manager.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		if err := requireClientCerts(srv.TLSConfig, opts); err != nil {
+			return err
+		}
+
+		if opts.ACMEHTTPAddr != "" {
+			go func() {
+				if err := newHTTPServer(opts.ACMEHTTPAddr, manager.HTTPHandler(nil)).ListenAndServe(); err != nil {
+					slog.Error("ACME HTTP challenge listener stopped", "addr", opts.ACMEHTTPAddr, "error", err)
+				}
+			}()
+		}
+		return srv.ListenAndServeTLS("", "")
+	case opts.CertFile != "":
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if err := requireClientCerts(srv.TLSConfig, opts); err != nil {
+			return err
+		}
+		return srv.ListenAndServeTLS(opts.CertFile, opts.KeyFile)
+	default:
+		return srv.ListenAndServe()
+	}
+}
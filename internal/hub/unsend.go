@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UnsendResult reports a message deleted by its sender
+type UnsendResult struct {
+	ID string `json:"id"`
+	// Delivered is set when the recipient had already fetched the message, so a copy
+	// may remain on their devices
+	Delivered bool `json:"delivered"`
+}
+
+// Errors of unsendMessage
+var (
+	errUnsendNotFound = errors.New("message not found or expired")
+	errUnsendTooLate  = errors.New("message already fetched by its recipient")
+)
+
+// unsendMessage deletes message id of senderID and reports whether its recipient had
+// fetched it. A fetched message is only deleted within the unsend window of being sent;
+// messages held as requests or not yet fetched can be deleted until they expire.
+func (s *Server) unsendMessage(ctx context.Context, senderID, id string, now time.Time) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var createdAt int64
+	var fetchedAt sql.NullInt64
+	// Messages sent by someone else are reported as missing so their existence is not revealed
+	err = tx.QueryRowContext(ctx,
+		"SELECT created_at, fetched_at FROM messages WHERE id = ? AND sender_id = ? AND expires_at > ?",
+		id, senderID, now.Unix(),
+	).Scan(&createdAt, &fetchedAt)
+	if err == sql.ErrNoRows {
+		return false, errUnsendNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if fetchedAt.Valid && now.Sub(time.Unix(createdAt, 0)) > s.Config().UnsendWindow {
+		return true, errUnsendTooLate
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE id = ? AND sender_id = ?", id, senderID); err != nil {
+		return false, err
+	}
+	return fetchedAt.Valid, tx.Commit()
+}
+
+// handleUnsend deletes a message at its sender's request: DELETE /message/<id>, signed
+// over the message ID. Attachments only the message referred to are left for garbage
+// collection.
+func (s *Server) handleUnsend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/message/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "User ID required", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.verifySignedRequest(ctx, r, "message-unsend", userID, id)
+	if err != nil {
+		dbError(w, ctx, "Database error")
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired request signature", http.StatusUnauthorized)
+		return
+	}
+
+	delivered, err := s.unsendMessage(ctx, userID, id, time.Now())
+	switch {
+	case errors.Is(err, errUnsendNotFound):
+		http.Error(w, "Message not found or expired", http.StatusNotFound)
+		return
+	case errors.Is(err, errUnsendTooLate):
+		window := s.Config().UnsendWindow
+		if window <= 0 {
+			http.Error(w, "Message already fetched by its recipient; this hub only deletes unfetched messages", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Message already fetched by its recipient and sent more than %v ago", window), http.StatusConflict)
+		return
+	case err != nil:
+		dbError(w, ctx, "Failed to delete message")
+		return
+	}
+	s.logf(LogInfo, userID, "Message %s deleted by its sender", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UnsendResult{ID: id, Delivered: delivered})
+}
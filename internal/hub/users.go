@@ -0,0 +1,346 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errUserNotFound is returned when a user ID or display name does not exist
+var errUserNotFound = errors.New("user not found")
+
+// errNotBanned is returned when lifting a ban from a user who is not banned
+var errNotBanned = errors.New("user is not banned")
+
+// DeactivatedUser describes a soft-deleted account awaiting purge
+type DeactivatedUser struct {
+	ID            string    `json:"id"`
+	DisplayName   string    `json:"display_name"`
+	DeactivatedAt time.Time `json:"deactivated_at"`
+	PurgeAt       time.Time `json:"purge_at"`
+}
+
+// resolveUserID accepts either a user ID or a display name and returns the user ID
+func (s *Server) resolveUserID(ctx context.Context, idOrName string) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE id = ? OR display_name = ?",
+		idOrName, idOrName,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: %s", errUserNotFound, idOrName)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up user: %v", err)
+	}
+	return id, nil
+}
+
+// DeactivateUser soft-deletes a user. The account disappears from the directory and
+// stops receiving messages, but its record is kept until the purge delay elapses.
+func (s *Server) DeactivateUser(ctx context.Context, idOrName string) error {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE users SET deactivated_at = ?, online = 0 WHERE id = ? AND deactivated_at IS NULL",
+		time.Now().Unix(),
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate user: %v", err)
+	}
+	s.logf(LogInfo, id, "User deactivated")
+	s.audit(ctx, "user.deactivate", id, nil)
+	return nil
+}
+
+// ReactivateUser restores a deactivated user that has not been purged yet
+func (s *Server) ReactivateUser(ctx context.Context, idOrName string) error {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE users SET deactivated_at = NULL, updated_at = ? WHERE id = ? AND deactivated_at IS NOT NULL AND banned_at IS NULL",
+		time.Now().Unix(),
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reactivate user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user is not deactivated (or is banned): %s", idOrName)
+	}
+	s.logf(LogInfo, id, "User reactivated")
+	s.audit(ctx, "user.reactivate", id, nil)
+	return nil
+}
+
+// ListDeactivatedUsers returns soft-deleted users and when they will be purged
+func (s *Server) ListDeactivatedUsers(ctx context.Context) ([]DeactivatedUser, error) {
+	purgeDelay := s.Config().UserPurgeDelay
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, display_name, deactivated_at FROM users WHERE deactivated_at IS NOT NULL ORDER BY deactivated_at ASC",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deactivated users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []DeactivatedUser
+	for rows.Next() {
+		var user DeactivatedUser
+		var deactivatedUnix int64
+		if err := rows.Scan(&user.ID, &user.DisplayName, &deactivatedUnix); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		user.DeactivatedAt = time.Unix(deactivatedUnix, 0)
+		user.PurgeAt = user.DeactivatedAt.Add(purgeDelay)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// purgeDeactivatedUsers permanently removes users whose grace period has elapsed,
+// together with the messages they sent or received. Banned users are kept, so the
+// ban outlives the grace period.
+func (s *Server) purgeDeactivatedUsers(ctx context.Context) error {
+	cutoff := time.Now().Add(-s.Config().UserPurgeDelay).Unix()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM messages WHERE sender_id IN (SELECT id FROM users WHERE deactivated_at <= ? AND banned_at IS NULL)
+			OR recipient_id IN (SELECT id FROM users WHERE deactivated_at <= ? AND banned_at IS NULL)`,
+		cutoff, cutoff,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM contacts WHERE user_id IN (SELECT id FROM users WHERE deactivated_at <= ? AND banned_at IS NULL)
+			OR contact_id IN (SELECT id FROM users WHERE deactivated_at <= ? AND banned_at IS NULL)`,
+		cutoff, cutoff,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM devices WHERE user_id IN (SELECT id FROM users WHERE deactivated_at <= ? AND banned_at IS NULL)",
+		cutoff,
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE deactivated_at <= ? AND banned_at IS NULL", cutoff)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		s.logf(LogInfo, "", "Purged %d deactivated users", n)
+	}
+	return nil
+}
+
+// UserSummary describes an account for operators
+type UserSummary struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	LastSeen    time.Time `json:"last_seen"`
+	Online      bool      `json:"online"`
+	// Messages and StoredBytes count the messages held for the user
+	Messages      int64      `json:"messages"`
+	StoredBytes   int64      `json:"stored_bytes"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	BannedAt      *time.Time `json:"banned_at,omitempty"`
+	BanReason     string     `json:"ban_reason,omitempty"`
+}
+
+// ListUsers returns accounts ordered by display name; deactivated and banned
+// accounts are included only when all is set
+func (s *Server) ListUsers(ctx context.Context, all bool) ([]UserSummary, error) {
+	query := `
+		SELECT u.id, u.display_name, u.last_seen, u.online, u.deactivated_at, u.banned_at, COALESCE(u.ban_reason, ''),
+			COUNT(m.id), COALESCE(SUM(LENGTH(m.content)), 0)
+		FROM users u
+		LEFT JOIN messages m ON m.recipient_id = u.id`
+	if !all {
+		query += " WHERE u.deactivated_at IS NULL"
+	}
+	query += " GROUP BY u.id ORDER BY u.display_name"
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []UserSummary
+	for rows.Next() {
+		var user UserSummary
+		var lastSeen int64
+		var deactivated, banned sql.NullInt64
+		if err := rows.Scan(&user.ID, &user.DisplayName, &lastSeen, &user.Online, &deactivated, &banned, &user.BanReason, &user.Messages, &user.StoredBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		user.LastSeen = time.Unix(lastSeen, 0)
+		if deactivated.Valid {
+			t := time.Unix(deactivated.Int64, 0)
+			user.DeactivatedAt = &t
+		}
+		if banned.Valid {
+			t := time.Unix(banned.Int64, 0)
+			user.BannedAt = &t
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser removes a user immediately, without the deactivation grace period,
+// together with the messages they sent or received. It returns the number of
+// messages deleted.
+func (s *Server) DeleteUser(ctx context.Context, idOrName string) (int64, error) {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete user: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE sender_id = ? OR recipient_id = ?", id, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete messages: %v", err)
+	}
+	deleted, _ := result.RowsAffected()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM devices WHERE user_id = ?", id); err != nil {
+		return 0, fmt.Errorf("failed to delete devices: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id); err != nil {
+		return 0, fmt.Errorf("failed to delete user: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete user: %v", err)
+	}
+	s.logf(LogInfo, id, "User deleted with %d messages", deleted)
+	s.audit(ctx, "user.delete", id, map[string]interface{}{"messages": deleted})
+	return deleted, nil
+}
+
+// BanUser deactivates a user and keeps them from coming back: a banned account is
+// never purged, cannot be reactivated by registering again, and its public key
+// cannot register under a new ID
+func (s *Server) BanUser(ctx context.Context, idOrName, reason string) error {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE users SET banned_at = ?, ban_reason = ?, deactivated_at = COALESCE(deactivated_at, ?), online = 0, updated_at = ? WHERE id = ?",
+		now, reason, now, now, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to ban user: %v", err)
+	}
+	s.event(LogWarn, EventBan, id, "User banned: %s", reason)
+	s.audit(ctx, "user.ban", id, map[string]interface{}{"reason": reason})
+	return nil
+}
+
+// UnbanUser lifts a ban and reactivates the account
+func (s *Server) UnbanUser(ctx context.Context, idOrName string) error {
+	id, err := s.resolveUserID(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE users SET banned_at = NULL, ban_reason = NULL, deactivated_at = NULL, updated_at = ? WHERE id = ? AND banned_at IS NOT NULL",
+		time.Now().Unix(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unban user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", errNotBanned, idOrName)
+	}
+	s.event(LogInfo, EventBan, id, "User unbanned")
+	s.audit(ctx, "user.unban", id, nil)
+	return nil
+}
+
+// MessagePurge selects the stored messages PurgeMessages deletes
+type MessagePurge struct {
+	// UserID limits the purge to messages sent or received by this user
+	UserID string
+	// Before limits the purge to messages stored before this time
+	Before time.Time
+	// All must be set to purge without any other filter
+	All bool
+}
+
+// PurgeMessages deletes stored messages matching filter and returns how many were
+// deleted. Attachments they referred to are removed by the next cleanup.
+func (s *Server) PurgeMessages(ctx context.Context, filter MessagePurge) (int64, error) {
+	var conditions []string
+	var args []interface{}
+	var id string
+	if filter.UserID != "" {
+		var err error
+		if id, err = s.resolveUserID(ctx, filter.UserID); err != nil {
+			return 0, err
+		}
+		conditions = append(conditions, "(sender_id = ? OR recipient_id = ?)")
+		args = append(args, id, id)
+	}
+	if !filter.Before.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.Before.Unix())
+	}
+	if len(conditions) == 0 && !filter.All {
+		return 0, fmt.Errorf("refusing to purge every message without All")
+	}
+
+	query := "DELETE FROM messages"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	s.logf(LogInfo, filter.UserID, "Purged %d messages", n)
+	details := map[string]interface{}{"messages": n}
+	if !filter.Before.IsZero() {
+		details["before"] = filter.Before.UTC()
+	}
+	if filter.All {
+		details["all"] = true
+	}
+	s.audit(ctx, "messages.purge", id, details)
+	return n, nil
+}
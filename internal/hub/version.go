@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The API is served under /v<n> for each protocol version n the hub speaks, and at
+// its bare paths for clients that predate versioning. Clients negotiate at /health:
+// they list the versions they speak in X-CLSP-Protocol and the hub answers with the
+// highest one both share, or with 426 and the versions it speaks when there is none.
+// Federation between hubs stays on the bare paths, which older peers also serve.
+
+// ProtocolHeader carries the protocol versions a client speaks, and the version the
+// hub chose in its answer
+const ProtocolHeader = "X-CLSP-Protocol"
+
+// ProtocolVersions are the versions of the HTTP API this hub serves, oldest first
+var ProtocolVersions = []int{1}
+
+// APIPrefix is the path prefix of the current protocol version
+var APIPrefix = versionPrefix(ProtocolVersions[len(ProtocolVersions)-1])
+
+// versionPrefix returns the path prefix of a protocol version
+func versionPrefix(version int) string {
+	return "/v" + strconv.Itoa(version)
+}
+
+// withVersions serves api under the prefix of every protocol version, marking its
+// responses with the version, and at the bare paths
+func withVersions(api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	for _, v := range ProtocolVersions {
+		version := strconv.Itoa(v)
+		versioned := http.StripPrefix(versionPrefix(v), api)
+		mux.Handle(versionPrefix(v)+"/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(ProtocolHeader, version)
+			versioned.ServeHTTP(w, r)
+		}))
+	}
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := pathVersion(r.URL.Path); ok {
+			http.Error(w, fmt.Sprintf("This hub does not serve protocol version %d; it speaks %s", v, formatVersions(ProtocolVersions)), http.StatusNotFound)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	return mux
+}
+
+// pathVersion returns the version a path is under, if it starts with /v<n>/
+func pathVersion(path string) (int, bool) {
+	rest, ok := strings.CutPrefix(path, "/v")
+	if !ok {
+		return 0, false
+	}
+	digits, _, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.Atoi(digits)
+	return v, err == nil && v > 0
+}
+
+// apiPath returns path without the prefix of a protocol version the hub serves
+func apiPath(path string) string {
+	for _, v := range ProtocolVersions {
+		if rest, ok := strings.CutPrefix(path, versionPrefix(v)); ok && strings.HasPrefix(rest, "/") {
+			return rest
+		}
+	}
+	return path
+}
+
+// negotiateProtocol returns the highest version among those a client listed in
+// ProtocolHeader that the hub speaks. Clients that list none get the current one.
+func negotiateProtocol(header string) (int, error) {
+	current := ProtocolVersions[len(ProtocolVersions)-1]
+	if strings.TrimSpace(header) == "" {
+		return current, nil
+	}
+	chosen := 0
+	var offered []int
+	for _, field := range strings.Split(header, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		offered = append(offered, v)
+		for _, served := range ProtocolVersions {
+			if v == served && v > chosen {
+				chosen = v
+			}
+		}
+	}
+	if chosen == 0 {
+		return 0, fmt.Errorf("this hub speaks protocol %s but the client speaks %s", formatVersions(ProtocolVersions), formatVersions(offered))
+	}
+	return chosen, nil
+}
+
+// writeProtocol sets ProtocolHeader on a /health response to the negotiated
+// version, or answers 426 with the versions the hub speaks and reports false
+func writeProtocol(w http.ResponseWriter, r *http.Request) bool {
+	version, err := negotiateProtocol(r.Header.Get(ProtocolHeader))
+	if err != nil {
+		versions := make([]string, len(ProtocolVersions))
+		for i, v := range ProtocolVersions {
+			versions[i] = strconv.Itoa(v)
+		}
+		w.Header().Set(ProtocolHeader, strings.Join(versions, ", "))
+		http.Error(w, "Incompatible client: "+err.Error(), http.StatusUpgradeRequired)
+		return false
+	}
+	w.Header().Set(ProtocolHeader, strconv.Itoa(version))
+	return true
+}
+
+// formatVersions lists versions for messages, such as "version 1" or "versions 1, 2"
+func formatVersions(versions []int) string {
+	if len(versions) == 0 {
+		return "no version"
+	}
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = strconv.Itoa(v)
+	}
+	if len(versions) == 1 {
+		return "version " + s[0]
+	}
+	return "versions " + strings.Join(s, ", ")
+}
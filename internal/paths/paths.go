@@ -23,6 +23,10 @@ var (
 	KeyDir string
 	// HubDBPath is the path to the hub database
 	HubDBPath string
+	// RuntimeDir holds short-lived session state such as unlocked key material
+	RuntimeDir string
+	// Profile is the name of the profile in use, empty for the default one
+	Profile string
 )
 
 func init() {
@@ -42,6 +46,32 @@ func init() {
 	}
 	KeyDir = filepath.Join(ConfigDir, "keys")
 	HubDBPath = filepath.Join(ConfigDir, "hub.db")
+
+	// Prefer the per-user runtime directory, which is memory-backed and cleared on logout
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		RuntimeDir = filepath.Join(runtimeDir, AppName)
+	} else {
+		RuntimeDir = filepath.Join(ConfigDir, "run")
+	}
+}
+
+// UseProfile switches ConfigDir, KeyDir and RuntimeDir to those of a named profile,
+// which keeps a separate identity, configuration and history under "profiles" in the
+// default config directory. It must be called before any of them is used.
+func UseProfile(name string) error {
+	if name == "" || name == "default" {
+		return nil
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid profile name %q (use letters, digits, '-' and '_')", name)
+		}
+	}
+	Profile = name
+	ConfigDir = filepath.Join(ConfigDir, "profiles", name)
+	KeyDir = filepath.Join(ConfigDir, "keys")
+	RuntimeDir = filepath.Join(RuntimeDir, "profiles", name)
+	return nil
 }
 
 // EnsureConfigDir ensures that the config directory exists
@@ -64,3 +94,11 @@ func GetConfigPath(filename string) string {
 func GetKeyPath(filename string) string {
 	return filepath.Join(KeyDir, filename)
 }
+
+// GetRuntimePath returns the path to a runtime (session) file, creating the runtime directory
+func GetRuntimePath(filename string) (string, error) {
+	if err := os.MkdirAll(RuntimeDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %v", err)
+	}
+	return filepath.Join(RuntimeDir, filename), nil
+}
@@ -0,0 +1,126 @@
+// Package clspapi is a typed client of the clsp hub's HTTP API, generated from the
+// OpenAPI document the hub serves at /openapi.json (a copy is in openapi.json). It
+// calls every endpoint, one method per operation, under the prefix of the protocol
+// version it was generated from, but leaves the protocol to its caller: messages
+// are sent and received as the envelopes the hub stores and signed requests take
+// their user_id, ts and sig parameters ready-made. Package clspclient builds
+// encryption, signing and retries on top of the same endpoints.
+//
+// client_gen.go and openapi.json are regenerated with 'go generate' whenever the
+// hub's endpoints or types change.
+package clspapi
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of one hub
+type Client struct {
+	// BaseURL is the hub's URL, such as https://hub.example.com
+	BaseURL string
+	// HTTPClient sends the requests; nil uses http.DefaultClient
+	HTTPClient *http.Client
+	// Token is sent as a bearer token: the admin token for /admin operations, or an
+	// OIDC ID token when the hub requires SSO
+	Token string
+}
+
+// Error is returned for a response whose status is not a success
+type Error struct {
+	StatusCode int
+	// Message is the hub's explanation
+	Message string
+	// SizeLimit details a 413 refusal, for hubs that send one
+	SizeLimit *SizeLimitError
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("hub returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("hub returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Ptr returns a pointer to v, for the optional fields of parameters
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// do sends a request and returns its response if the status is a success, leaving
+// the caller to close its body
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + basePath + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+// readError reads the body of a failed response
+func readError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		var refusal SizeLimitError
+		if json.Unmarshal(body, &refusal) == nil && refusal.Code != "" {
+			e.SizeLimit = &refusal
+			e.Message = refusal.Error
+		}
+	}
+	return e
+}
+
+// jsonBody encodes a request body
+func jsonBody(v interface{}) (io.Reader, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	return bytes.NewReader(data), nil
+}
+
+// decode reads a JSON response body into v and closes it
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// discard drains and closes a response body
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
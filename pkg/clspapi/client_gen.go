@@ -0,0 +1,2318 @@
+// Code generated by gen.go from the hub's OpenAPI document. DO NOT EDIT.
+
+package clspapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// basePath prefixes the paths of the API version this client was generated from
+const basePath = "/v1"
+
+// DeleteAccountParams are the query parameters of DeleteAccount
+type DeleteAccountParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// DeleteAccount calls DELETE /account: Delete the user's account at once, with
+// their profile, presence, stored messages sent or received, attachments,
+// contacts, usage, devices, log entries and pending or failed webhook
+// notifications and relays of their messages; signed with the account key
+func (c *Client) DeleteAccount(ctx context.Context, params DeleteAccountParams) (*AccountDeletion, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "DELETE", "/account", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result AccountDeletion
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAccountExportParams are the query parameters of GetAccountExport
+type GetAccountExportParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetAccountExport calls GET /account/export: Everything the hub holds about
+// the user, with stored messages as their encrypted envelopes; signed with the
+// account key
+func (c *Client) GetAccountExport(ctx context.Context, params GetAccountExportParams) (*AccountExport, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/account/export", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result AccountExport
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminAuditParams are the query parameters of GetAdminAudit
+type GetAdminAuditParams struct {
+	// Since is only entries from this Unix time on
+	Since *int64
+	// Action is only this action, such as user.ban, or this category, such as user
+	Action *string
+	// Actor is only entries by this actor
+	Actor *string
+	// Target is only entries about this target, such as a user ID
+	Target *string
+	// Limit is at most this many of the newest entries
+	Limit *int64
+	// Format is json (default) or jsonl
+	Format *string
+}
+
+// GetAdminAudit calls GET /admin/audit: The append-only audit log of admin and
+// destructive actions (bans, deletions, purges, configuration changes), oldest
+// first; format=jsonl exports it as JSON Lines
+func (c *Client) GetAdminAudit(ctx context.Context, params GetAdminAuditParams) ([]AuditEntry, error) {
+	query := url.Values{}
+	if params.Since != nil {
+		query.Set("since", strconv.FormatInt(*params.Since, 10))
+	}
+	if params.Action != nil {
+		query.Set("action", *params.Action)
+	}
+	if params.Actor != nil {
+		query.Set("actor", *params.Actor)
+	}
+	if params.Target != nil {
+		query.Set("target", *params.Target)
+	}
+	if params.Limit != nil {
+		query.Set("limit", strconv.FormatInt(*params.Limit, 10))
+	}
+	if params.Format != nil {
+		query.Set("format", *params.Format)
+	}
+	resp, err := c.do(ctx, "GET", "/admin/audit", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result []AuditEntry
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PostAdminBansParams are the query parameters of PostAdminBans
+type PostAdminBansParams struct {
+	// User is user ID or display name
+	User   string
+	Reason *string
+}
+
+// PostAdminBans calls POST /admin/bans: Ban an account
+func (c *Client) PostAdminBans(ctx context.Context, params PostAdminBansParams) error {
+	query := url.Values{}
+	query.Set("user", params.User)
+	if params.Reason != nil {
+		query.Set("reason", *params.Reason)
+	}
+	resp, err := c.do(ctx, "POST", "/admin/bans", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// DeleteAdminBansParams are the query parameters of DeleteAdminBans
+type DeleteAdminBansParams struct {
+	// User is user ID or display name
+	User string
+}
+
+// DeleteAdminBans calls DELETE /admin/bans: Lift a ban
+func (c *Client) DeleteAdminBans(ctx context.Context, params DeleteAdminBansParams) error {
+	query := url.Values{}
+	query.Set("user", params.User)
+	resp, err := c.do(ctx, "DELETE", "/admin/bans", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// GetAdminDeadletters calls GET /admin/deadletters: Outbound delivery queue and
+// dead letters
+func (c *Client) GetAdminDeadletters(ctx context.Context) (*DeliveryQueue, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/admin/deadletters", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result DeliveryQueue
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostAdminDeadlettersParams are the query parameters of PostAdminDeadletters
+type PostAdminDeadlettersParams struct {
+	ID string
+}
+
+// PostAdminDeadletters calls POST /admin/deadletters: Requeue a dead letter
+func (c *Client) PostAdminDeadletters(ctx context.Context, params PostAdminDeadlettersParams) error {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	resp, err := c.do(ctx, "POST", "/admin/deadletters", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// DeleteAdminDeadlettersParams are the query parameters of DeleteAdminDeadletters
+type DeleteAdminDeadlettersParams struct {
+	ID string
+}
+
+// DeleteAdminDeadletters calls DELETE /admin/deadletters: Discard a dead letter
+func (c *Client) DeleteAdminDeadletters(ctx context.Context, params DeleteAdminDeadlettersParams) error {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	resp, err := c.do(ctx, "DELETE", "/admin/deadletters", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// GetAdminEventsParams are the query parameters of GetAdminEvents
+type GetAdminEventsParams struct {
+	// Since is replay only events after this ID (also taken from Last-Event-ID)
+	Since *int64
+	// Kind is comma-separated kinds to stream: registration, ban, rate_limit,
+	// federation_failure
+	Kind *string
+	// Follow is false ends the stream after the replay
+	Follow *bool
+}
+
+// GetAdminEvents calls GET /admin/events: Operational events (registrations,
+// bans, quota trips, federation failures) as a text/event-stream of Event, each
+// with its ID and kind; the last 256 since the hub started are replayed, then
+// the stream follows new ones
+//
+// The caller reads and closes the response body.
+func (c *Client) GetAdminEvents(ctx context.Context, params GetAdminEventsParams) (*http.Response, error) {
+	query := url.Values{}
+	if params.Since != nil {
+		query.Set("since", strconv.FormatInt(*params.Since, 10))
+	}
+	if params.Kind != nil {
+		query.Set("kind", *params.Kind)
+	}
+	if params.Follow != nil {
+		query.Set("follow", strconv.FormatBool(*params.Follow))
+	}
+	resp, err := c.do(ctx, "GET", "/admin/events", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetAdminGC calls GET /admin/gc: What a garbage collection pass would do now:
+// unused accounts to warn or deactivate, unreferenced attachments and files
+func (c *Client) GetAdminGC(ctx context.Context) (*GCReport, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/admin/gc", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result GCReport
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostAdminGC calls POST /admin/gc: Run a garbage collection pass now (the hub
+// also runs one hourly)
+func (c *Client) PostAdminGC(ctx context.Context) (*GCReport, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "POST", "/admin/gc", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result GCReport
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAdminGCParams are the query parameters of PutAdminGC
+type PutAdminGCParams struct {
+	// InactiveAfter is warn the owners of accounts unused this long, such as 4320h
+	// (0 keeps unused accounts)
+	InactiveAfter *string
+	// InactiveNotice is deactivate warned accounts still unused after this long (0
+	// uses 336h)
+	InactiveNotice *string
+}
+
+// PutAdminGC calls PUT /admin/gc: Change the inactivity policy and report what
+// a pass would do under it; 0 clears a duration and parameters left out keep
+// their value
+func (c *Client) PutAdminGC(ctx context.Context, params PutAdminGCParams) (*GCReport, error) {
+	query := url.Values{}
+	if params.InactiveAfter != nil {
+		query.Set("inactive_after", *params.InactiveAfter)
+	}
+	if params.InactiveNotice != nil {
+		query.Set("inactive_notice", *params.InactiveNotice)
+	}
+	resp, err := c.do(ctx, "PUT", "/admin/gc", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result GCReport
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminInvitesParams are the query parameters of GetAdminInvites
+type GetAdminInvitesParams struct {
+	// All is include used up and expired codes
+	All *bool
+}
+
+// GetAdminInvites calls GET /admin/invites: Invite codes that can still admit a
+// registration, without the codes themselves
+func (c *Client) GetAdminInvites(ctx context.Context, params GetAdminInvitesParams) ([]InviteCode, error) {
+	query := url.Values{}
+	if params.All != nil {
+		query.Set("all", strconv.FormatBool(*params.All))
+	}
+	resp, err := c.do(ctx, "GET", "/admin/invites", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result []InviteCode
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PostAdminInvitesParams are the query parameters of PostAdminInvites
+type PostAdminInvitesParams struct {
+	// Uses is registrations the code admits (default 1)
+	Uses *int64
+	// TTL is validity such as 72h, 0 for none (default 336h)
+	TTL *string
+	// Note is who or what the code is for
+	Note *string
+}
+
+// PostAdminInvites calls POST /admin/invites: Mint an invite code; the
+// plaintext code is returned only in this response
+func (c *Client) PostAdminInvites(ctx context.Context, params PostAdminInvitesParams) (*InviteCode, error) {
+	query := url.Values{}
+	if params.Uses != nil {
+		query.Set("uses", strconv.FormatInt(*params.Uses, 10))
+	}
+	if params.TTL != nil {
+		query.Set("ttl", *params.TTL)
+	}
+	if params.Note != nil {
+		query.Set("note", *params.Note)
+	}
+	resp, err := c.do(ctx, "POST", "/admin/invites", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result InviteCode
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteAdminInvitesParams are the query parameters of DeleteAdminInvites
+type DeleteAdminInvitesParams struct {
+	ID string
+}
+
+// DeleteAdminInvites calls DELETE /admin/invites: Revoke an invite code;
+// accounts it admitted are kept
+func (c *Client) DeleteAdminInvites(ctx context.Context, params DeleteAdminInvitesParams) error {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	resp, err := c.do(ctx, "DELETE", "/admin/invites", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// DeleteAdminMessagesParams are the query parameters of DeleteAdminMessages
+type DeleteAdminMessagesParams struct {
+	// User is only messages sent or received by this user
+	User *string
+	// Before is only messages stored before this Unix time
+	Before *int64
+	// All is required when no other filter is given
+	All *bool
+}
+
+// DeleteAdminMessages calls DELETE /admin/messages: Purge stored messages
+func (c *Client) DeleteAdminMessages(ctx context.Context, params DeleteAdminMessagesParams) (*PurgeResult, error) {
+	query := url.Values{}
+	if params.User != nil {
+		query.Set("user", *params.User)
+	}
+	if params.Before != nil {
+		query.Set("before", strconv.FormatInt(*params.Before, 10))
+	}
+	if params.All != nil {
+		query.Set("all", strconv.FormatBool(*params.All))
+	}
+	resp, err := c.do(ctx, "DELETE", "/admin/messages", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result PurgeResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminMetricsParams are the query parameters of GetAdminMetrics
+type GetAdminMetricsParams struct {
+	Days *int64
+	Top  *int64
+}
+
+// GetAdminMetrics calls GET /admin/metrics: Delivery latency and backlog
+func (c *Client) GetAdminMetrics(ctx context.Context, params GetAdminMetricsParams) (*DeliveryMetrics, error) {
+	query := url.Values{}
+	if params.Days != nil {
+		query.Set("days", strconv.FormatInt(*params.Days, 10))
+	}
+	if params.Top != nil {
+		query.Set("top", strconv.FormatInt(*params.Top, 10))
+	}
+	resp, err := c.do(ctx, "GET", "/admin/metrics", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result DeliveryMetrics
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminQuotasParams are the query parameters of GetAdminQuotas
+type GetAdminQuotasParams struct {
+	// User is user ID or display name
+	User *string
+}
+
+// GetAdminQuotas calls GET /admin/quotas: Default outbound quota and senders
+// with their own; with user, that sender's quota and usage too
+func (c *Client) GetAdminQuotas(ctx context.Context, params GetAdminQuotasParams) (*QuotaSettings, error) {
+	query := url.Values{}
+	if params.User != nil {
+		query.Set("user", *params.User)
+	}
+	resp, err := c.do(ctx, "GET", "/admin/quotas", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result QuotaSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAdminQuotasParams are the query parameters of PutAdminQuotas
+type PutAdminQuotasParams struct {
+	// User is override this sender's quota instead of the default
+	User *string
+	// HourlyMessages is messages per clock hour
+	HourlyMessages *int64
+	// DailyMessages is messages per UTC day
+	DailyMessages *int64
+	// HourlyBytes is bytes per clock hour, envelopes and attachments
+	HourlyBytes *int64
+	// DailyBytes is bytes per UTC day, envelopes and attachments
+	DailyBytes *int64
+	// Burst is messages sendable at once, refilled at this many per minute
+	Burst *int64
+}
+
+// PutAdminQuotas calls PUT /admin/quotas: Change the default outbound quota, or
+// give user their own; 0 turns a limit off and parameters left out keep their
+// value
+func (c *Client) PutAdminQuotas(ctx context.Context, params PutAdminQuotasParams) (*QuotaSettings, error) {
+	query := url.Values{}
+	if params.User != nil {
+		query.Set("user", *params.User)
+	}
+	if params.HourlyMessages != nil {
+		query.Set("hourly_messages", strconv.FormatInt(*params.HourlyMessages, 10))
+	}
+	if params.DailyMessages != nil {
+		query.Set("daily_messages", strconv.FormatInt(*params.DailyMessages, 10))
+	}
+	if params.HourlyBytes != nil {
+		query.Set("hourly_bytes", strconv.FormatInt(*params.HourlyBytes, 10))
+	}
+	if params.DailyBytes != nil {
+		query.Set("daily_bytes", strconv.FormatInt(*params.DailyBytes, 10))
+	}
+	if params.Burst != nil {
+		query.Set("burst", strconv.FormatInt(*params.Burst, 10))
+	}
+	resp, err := c.do(ctx, "PUT", "/admin/quotas", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result QuotaSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteAdminQuotasParams are the query parameters of DeleteAdminQuotas
+type DeleteAdminQuotasParams struct {
+	// User is user ID or display name
+	User string
+}
+
+// DeleteAdminQuotas calls DELETE /admin/quotas: Return a sender to the default
+// outbound quota
+func (c *Client) DeleteAdminQuotas(ctx context.Context, params DeleteAdminQuotasParams) (*QuotaSettings, error) {
+	query := url.Values{}
+	query.Set("user", params.User)
+	resp, err := c.do(ctx, "DELETE", "/admin/quotas", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result QuotaSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminReportParams are the query parameters of GetAdminReport
+type GetAdminReportParams struct {
+	Days *int64
+	Top  *int64
+}
+
+// GetAdminReport calls GET /admin/report: Capacity planning report
+func (c *Client) GetAdminReport(ctx context.Context, params GetAdminReportParams) (*CapacityReport, error) {
+	query := url.Values{}
+	if params.Days != nil {
+		query.Set("days", strconv.FormatInt(*params.Days, 10))
+	}
+	if params.Top != nil {
+		query.Set("top", strconv.FormatInt(*params.Top, 10))
+	}
+	resp, err := c.do(ctx, "GET", "/admin/report", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result CapacityReport
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminRetention calls GET /admin/retention: Current retention policy
+func (c *Client) GetAdminRetention(ctx context.Context) (*RetentionPolicy, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/admin/retention", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result RetentionPolicy
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAdminRetentionParams are the query parameters of PutAdminRetention
+type PutAdminRetentionParams struct {
+	// TextUndelivered is keep messages without an attachment this long while never
+	// fetched
+	TextUndelivered *string
+	// TextDelivered is keep messages without an attachment this long after they
+	// were fetched
+	TextDelivered *string
+	// TextRead is keep messages without an attachment this long after they were
+	// read
+	TextRead *string
+	// AttachmentsUndelivered is keep messages with an attachment this long while
+	// never fetched
+	AttachmentsUndelivered *string
+	// AttachmentsDelivered is keep messages with an attachment this long after they
+	// were fetched
+	AttachmentsDelivered *string
+	// AttachmentsRead is keep messages with an attachment this long after they were
+	// read
+	AttachmentsRead *string
+}
+
+// PutAdminRetention calls PUT /admin/retention: Change the retention policy;
+// durations such as 168h, 0 clears a rule and parameters left out keep their
+// value
+func (c *Client) PutAdminRetention(ctx context.Context, params PutAdminRetentionParams) (*RetentionPolicy, error) {
+	query := url.Values{}
+	if params.TextUndelivered != nil {
+		query.Set("text_undelivered", *params.TextUndelivered)
+	}
+	if params.TextDelivered != nil {
+		query.Set("text_delivered", *params.TextDelivered)
+	}
+	if params.TextRead != nil {
+		query.Set("text_read", *params.TextRead)
+	}
+	if params.AttachmentsUndelivered != nil {
+		query.Set("attachments_undelivered", *params.AttachmentsUndelivered)
+	}
+	if params.AttachmentsDelivered != nil {
+		query.Set("attachments_delivered", *params.AttachmentsDelivered)
+	}
+	if params.AttachmentsRead != nil {
+		query.Set("attachments_read", *params.AttachmentsRead)
+	}
+	resp, err := c.do(ctx, "PUT", "/admin/retention", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result RetentionPolicy
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminStats calls GET /admin/stats: Account, storage and pending delivery
+// counts, database size and uptime
+func (c *Client) GetAdminStats(ctx context.Context) (*HubStats, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/admin/stats", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result HubStats
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAdminUsersParams are the query parameters of GetAdminUsers
+type GetAdminUsersParams struct {
+	// All is include deactivated and banned accounts
+	All *bool
+}
+
+// GetAdminUsers calls GET /admin/users: Accounts with their stored message
+// volume
+func (c *Client) GetAdminUsers(ctx context.Context, params GetAdminUsersParams) ([]UserSummary, error) {
+	query := url.Values{}
+	if params.All != nil {
+		query.Set("all", strconv.FormatBool(*params.All))
+	}
+	resp, err := c.do(ctx, "GET", "/admin/users", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result []UserSummary
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteAdminUsersParams are the query parameters of DeleteAdminUsers
+type DeleteAdminUsersParams struct {
+	// User is user ID or display name
+	User string
+}
+
+// DeleteAdminUsers calls DELETE /admin/users: Delete an account and its
+// messages immediately
+func (c *Client) DeleteAdminUsers(ctx context.Context, params DeleteAdminUsersParams) (*PurgeResult, error) {
+	query := url.Values{}
+	query.Set("user", params.User)
+	resp, err := c.do(ctx, "DELETE", "/admin/users", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result PurgeResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAnnouncements calls GET /announcements: Signed service announcements
+func (c *Client) GetAnnouncements(ctx context.Context) (*AnnouncementFeed, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/announcements", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result AnnouncementFeed
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAttachmentParams are the query parameters of GetAttachment
+type GetAttachmentParams struct {
+	ID string
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetAttachment calls GET /attachment: Attachment ciphertext, for the uploader
+// and recipients of messages referring to it; supports Range
+//
+// The caller reads and closes the response body.
+func (c *Client) GetAttachment(ctx context.Context, params GetAttachmentParams) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/attachment", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// PostAttachmentParams are the query parameters of PostAttachment
+type PostAttachmentParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostAttachment calls POST /attachment: Reserve an upload of an encrypted
+// attachment of the given size (413 with a SizeLimitError above
+// max_attachment_size)
+func (c *Client) PostAttachment(ctx context.Context, params PostAttachmentParams, body AttachmentReservation) (*AttachmentStatus, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/attachment", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result AttachmentStatus
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PutAttachmentParams are the query parameters of PutAttachment
+type PutAttachmentParams struct {
+	ID     string
+	Offset int64
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PutAttachment calls PUT /attachment: Append ciphertext at offset, which must
+// equal the bytes received so far (409 returns the status to resume from)
+func (c *Client) PutAttachment(ctx context.Context, params PutAttachmentParams, body io.Reader) (*AttachmentStatus, error) {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	query.Set("offset", strconv.FormatInt(params.Offset, 10))
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "PUT", "/attachment", query, body, "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	var result AttachmentStatus
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAttachmentStatusParams are the query parameters of GetAttachmentStatus
+type GetAttachmentStatusParams struct {
+	ID string
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetAttachmentStatus calls GET /attachment/status: Upload progress, for the
+// uploader
+func (c *Client) GetAttachmentStatus(ctx context.Context, params GetAttachmentStatusParams) (*AttachmentStatus, error) {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/attachment/status", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result AttachmentStatus
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetCheckUsernameParams are the query parameters of GetCheckUsername
+type GetCheckUsernameParams struct {
+	Username string
+}
+
+// GetCheckUsername calls GET /check-username: Whether a display name is free
+func (c *Client) GetCheckUsername(ctx context.Context, params GetCheckUsernameParams) (*UsernameAvailability, error) {
+	query := url.Values{}
+	query.Set("username", params.Username)
+	resp, err := c.do(ctx, "GET", "/check-username", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result UsernameAvailability
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetConfig calls GET /config: Hub configuration
+func (c *Client) GetConfig(ctx context.Context) (*HubConfig, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/config", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result HubConfig
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetDevicesParams are the query parameters of GetDevices
+type GetDevicesParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetDevices calls GET /devices: The devices the user's clients announced, most
+// recently seen first; signed over the method and the SHA-256 of the (empty)
+// body
+func (c *Client) GetDevices(ctx context.Context, params GetDevicesParams) ([]Device, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/devices", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result []Device
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PostDevicesParams are the query parameters of PostDevices
+type PostDevicesParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostDevices calls POST /devices: Record that a device of the user is in use,
+// under the ID and name it chose; the devices seen longest ago are forgotten
+// beyond twenty. Answers with the devices; signed over the method and the
+// SHA-256 of the body
+func (c *Client) PostDevices(ctx context.Context, params PostDevicesParams, body Device) ([]Device, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/devices", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result []Device
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetDirectory calls GET /directory: Signed snapshot of the active users and
+// their keys, for offline address books; rebuilt every 15 minutes
+func (c *Client) GetDirectory(ctx context.Context) (*DirectorySnapshot, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/directory", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result DirectorySnapshot
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostFederationDeliver calls POST /federation/deliver: Store a message relayed
+// by another hub, whose key signs the request in the X-Clsp-Hub,
+// X-Clsp-Hub-Timestamp and X-Clsp-Hub-Signature headers; the key is pinned on
+// first contact, which is only made with hubs this hub's users addressed or its
+// admin allows (403 otherwise, 429 while too many hubs make first contact)
+func (c *Client) PostFederationDeliver(ctx context.Context, body Message) error {
+	query := url.Values{}
+	reader, err := jsonBody(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/federation/deliver", query, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// GetFederationKey calls GET /federation/key: The name and public key this hub
+// signs federation requests with; 404 when it does not federate
+func (c *Client) GetFederationKey(ctx context.Context) (*FederationKey, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/federation/key", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result FederationKey
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetFederationUserParams are the query parameters of GetFederationUser
+type GetFederationUserParams struct {
+	// Address is name@hub or id@hub
+	Address string
+	// UserID is the signing user; user_id, ts and sig are required for addresses of
+	// other hubs
+	UserID *string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts *int64
+	// Sig is signature over the address
+	Sig *string
+}
+
+// GetFederationUser calls GET /federation/user: Directory entry of a user of
+// any federated hub, with ID and display name qualified as name@hub; other hubs
+// are asked on the client's behalf when a user of this hub signs the request
+// over the address
+func (c *Client) GetFederationUser(ctx context.Context, params GetFederationUserParams) (*User, error) {
+	query := url.Values{}
+	query.Set("address", params.Address)
+	if params.UserID != nil {
+		query.Set("user_id", *params.UserID)
+	}
+	if params.Ts != nil {
+		query.Set("ts", strconv.FormatInt(*params.Ts, 10))
+	}
+	if params.Sig != nil {
+		query.Set("sig", *params.Sig)
+	}
+	resp, err := c.do(ctx, "GET", "/federation/user", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result User
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetHealth calls GET /health: Hub status, configuration and clock. Clients
+// list the protocol versions they speak in X-CLSP-Protocol and the hub answers
+// with the one it chose, or with 426 and the versions it speaks
+func (c *Client) GetHealth(ctx context.Context) (*Health, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/health", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result Health
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetInviteParams are the query parameters of GetInvite
+type GetInviteParams struct {
+	Code string
+}
+
+// GetInvite calls GET /invite: Identity reserved by an invite code; user ID and
+// display name are empty for an invite code that lets its holder choose them
+func (c *Client) GetInvite(ctx context.Context, params GetInviteParams) (*Invite, error) {
+	query := url.Values{}
+	query.Set("code", params.Code)
+	resp, err := c.do(ctx, "GET", "/invite", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result Invite
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostKeyRotate calls POST /key/rotate: Replace the user's RSA key; the
+// rotation must be signed by the registered key and signing key, and the
+// request certifies the signing key with the new key
+func (c *Client) PostKeyRotate(ctx context.Context, body KeyRotationRequest) error {
+	query := url.Values{}
+	reader, err := jsonBody(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/key/rotate", query, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// PostMessageParams are the query parameters of PostMessage
+type PostMessageParams struct {
+	// DryRun is validate without storing
+	DryRun *bool
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostMessage calls POST /message: Store an encrypted message for its
+// recipient, or queue it for the recipient's hub when addressed as id@hub
+// (status relayed, 202); with dry_run the checks run but nothing is stored
+// (status valid, 200). An expires_at set by the sender deletes it before the
+// hub's message expiry. X-Quota-* headers report the sender's remaining
+// outbound quota; 429 with Retry-After when it is used up, 413 with a
+// SizeLimitError when the content or an inline attachment exceeds the hub's
+// limits. The envelope may be sent as protobuf (Content-Type
+// application/x-protobuf, a clsp.v1.Message). Signed by the sender over the
+// SHA-256 of the body
+func (c *Client) PostMessage(ctx context.Context, params PostMessageParams, body Message) (*SendResult, error) {
+	query := url.Values{}
+	if params.DryRun != nil {
+		query.Set("dry_run", strconv.FormatBool(*params.DryRun))
+	}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/message", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result SendResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostMessageReadParams are the query parameters of PostMessageRead
+type PostMessageReadParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostMessageRead calls POST /message/read: Mark received messages read, for
+// their senders' read receipts; signed over the SHA-256 of the body
+func (c *Client) PostMessageRead(ctx context.Context, params PostMessageReadParams, body ReadRequest) (*ReadResult, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/message/read", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result ReadResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetMessageStatusParams are the query parameters of GetMessageStatus
+type GetMessageStatusParams struct {
+	ID string
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetMessageStatus calls GET /message/status: Delivery state of a message, for
+// its sender; receipts_disabled when the recipient's receipt policy hides it
+func (c *Client) GetMessageStatus(ctx context.Context, params GetMessageStatusParams) (*MessageStatus, error) {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/message/status", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result MessageStatus
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteMessageByIDParams are the query parameters of DeleteMessageByID
+type DeleteMessageByIDParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// DeleteMessageByID calls DELETE /message/{id}: Delete a message, for its
+// sender; signed over the message ID. Unfetched messages can be deleted until
+// they expire, fetched ones only within unsend_window of being sent (409 after
+// that); delivered reports that the recipient may still hold a copy
+func (c *Client) DeleteMessageByID(ctx context.Context, id string, params DeleteMessageByIDParams) (*UnsendResult, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "DELETE", "/message/"+url.PathEscape(id), query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result UnsendResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetMessagesParams are the query parameters of GetMessages
+type GetMessagesParams struct {
+	// Unread is only messages not marked read
+	Unread *bool
+	// Search is sender display name search, as for /users; content is encrypted and
+	// never searched
+	Search *string
+	// Limit is page size (all items when absent)
+	Limit *int64
+	// Cursor is X-Next-Cursor of the previous page
+	Cursor *string
+	// Since is unix time; only items created or changed since
+	Since *int64
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetMessages calls GET /messages: Received messages, newest first; marks them
+// delivered, never read, so only the recipient may fetch them. Served as
+// protobuf (a clsp.v1.FetchMessagesResponse) when Accept lists
+// application/x-protobuf
+//
+// It also returns the cursor of the next page, empty on the last.
+func (c *Client) GetMessages(ctx context.Context, params GetMessagesParams) ([]Message, string, error) {
+	query := url.Values{}
+	if params.Unread != nil {
+		query.Set("unread", strconv.FormatBool(*params.Unread))
+	}
+	if params.Search != nil {
+		query.Set("search", *params.Search)
+	}
+	if params.Limit != nil {
+		query.Set("limit", strconv.FormatInt(*params.Limit, 10))
+	}
+	if params.Cursor != nil {
+		query.Set("cursor", *params.Cursor)
+	}
+	if params.Since != nil {
+		query.Set("since", strconv.FormatInt(*params.Since, 10))
+	}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/messages", query, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	var result []Message
+	if err := decode(resp, &result); err != nil {
+		return nil, "", err
+	}
+	return result, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// GetNotificationsParams are the query parameters of GetNotifications
+type GetNotificationsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetNotifications calls GET /notifications: The user's webhook and quiet
+// hours; signed over the method and the SHA-256 of the (empty) body
+func (c *Client) GetNotifications(ctx context.Context, params GetNotificationsParams) (*NotificationSettings, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/notifications", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result NotificationSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostNotificationsParams are the query parameters of PostNotifications
+type PostNotificationsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostNotifications calls POST /notifications: Replace the user's webhook and
+// quiet hours; signed over the method and the SHA-256 of the body
+func (c *Client) PostNotifications(ctx context.Context, params PostNotificationsParams, body NotificationSettings) (*NotificationSettings, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/notifications", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result NotificationSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetOpenAPI calls GET /openapi.json: This API as an OpenAPI 3.0 document
+//
+// The caller reads and closes the response body.
+func (c *Client) GetOpenAPI(ctx context.Context) (*http.Response, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/openapi.json", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// PostPrekeyParams are the query parameters of PostPrekey
+type PostPrekeyParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostPrekey calls POST /prekey: Publish the user's signed X25519 prekey
+func (c *Client) PostPrekey(ctx context.Context, params PostPrekeyParams, body Prekey) error {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/prekey", query, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// GetReceiptsParams are the query parameters of GetReceipts
+type GetReceiptsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetReceipts calls GET /receipts: The user's receipt policy (everyone,
+// contacts or none); signed over the method and the SHA-256 of the (empty) body
+func (c *Client) GetReceipts(ctx context.Context, params GetReceiptsParams) (*ReceiptSettings, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/receipts", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result ReceiptSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostReceiptsParams are the query parameters of PostReceipts
+type PostReceiptsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostReceipts calls POST /receipts: Set which senders see when the user
+// fetched and read their messages; contacts are the users they sent a message
+// to. Signed over the method and the SHA-256 of the body
+func (c *Client) PostReceipts(ctx context.Context, params PostReceiptsParams, body ReceiptSettings) (*ReceiptSettings, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/receipts", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result ReceiptSettings
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetRecoveryParams are the query parameters of GetRecovery
+type GetRecoveryParams struct {
+	ID string
+}
+
+// GetRecovery calls GET /recovery: The recovery kit stored under an ID derived
+// from a recovery phrase
+func (c *Client) GetRecovery(ctx context.Context, params GetRecoveryParams) (*RecoveryKit, error) {
+	query := url.Values{}
+	query.Set("id", params.ID)
+	resp, err := c.do(ctx, "GET", "/recovery", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result RecoveryKit
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostRecoveryParams are the query parameters of PostRecovery
+type PostRecoveryParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostRecovery calls POST /recovery: Store the user's recovery kit, encrypted
+// with a key derived from their recovery phrase; signed over the method and the
+// SHA-256 of the body
+func (c *Client) PostRecovery(ctx context.Context, params PostRecoveryParams, body RecoveryKit) error {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/recovery", query, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// DeleteRecoveryParams are the query parameters of DeleteRecovery
+type DeleteRecoveryParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// DeleteRecovery calls DELETE /recovery: Remove the user's recovery kit; signed
+// over the method and the SHA-256 of the (empty) body
+func (c *Client) DeleteRecovery(ctx context.Context, params DeleteRecoveryParams) error {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "DELETE", "/recovery", query, nil, "")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// PostRegisterParams are the query parameters of PostRegister
+type PostRegisterParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostRegister calls POST /register: Publish or re-announce an identity,
+// optionally with an Ed25519 signing key certified by its RSA key; new accounts
+// need an invite code when require_invite is set. The request is signed with
+// the RSA key being registered, over the action register with the display name
+// and the key's fingerprint as fields (401 without a valid signature); an
+// account registered with another key answers 409, as its key is only replaced
+// by a key rotation
+func (c *Client) PostRegister(ctx context.Context, params PostRegisterParams, body Registration) error {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", "/register", query, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// GetRequestsParams are the query parameters of GetRequests
+type GetRequestsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// GetRequests calls GET /requests: Whether the user holds messages from
+// first-time senders as requests, and the senders waiting to be accepted;
+// signed over the method and the SHA-256 of the (empty) body
+func (c *Client) GetRequests(ctx context.Context, params GetRequestsParams) (*RequestsResult, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	resp, err := c.do(ctx, "GET", "/requests", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result RequestsResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostRequestsParams are the query parameters of PostRequests
+type PostRequestsParams struct {
+	// UserID is the signing user
+	UserID string
+	// Ts is unix time of the request, within the clock skew tolerance
+	Ts int64
+	// Sig is signature over the request payload
+	Sig string
+}
+
+// PostRequests calls POST /requests: Accept a sender (their messages go to
+// /messages and they become a contact) or decline them (their messages are
+// deleted, 404 when there are none), or turn requests on or off. Signed over
+// the method and the SHA-256 of the body
+func (c *Client) PostRequests(ctx context.Context, params PostRequestsParams, body RequestsAction) (*RequestsResult, error) {
+	query := url.Values{}
+	query.Set("user_id", params.UserID)
+	query.Set("ts", strconv.FormatInt(params.Ts, 10))
+	query.Set("sig", params.Sig)
+	reader, err := jsonBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/requests", query, reader, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var result RequestsResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetSchema calls GET /schema: This description
+func (c *Client) GetSchema(ctx context.Context) (*Schema, error) {
+	query := url.Values{}
+	resp, err := c.do(ctx, "GET", "/schema", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var result Schema
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetUsersParams are the query parameters of GetUsers
+type GetUsersParams struct {
+	// Online is only users seen recently
+	Online *bool
+	// Search is display name search: each word must begin a word of the name
+	Search *string
+	// Limit is page size (all items when absent)
+	Limit *int64
+	// Cursor is X-Next-Cursor of the previous page
+	Cursor *string
+	// Since is unix time; only items created or changed since
+	Since *int64
+}
+
+// GetUsers calls GET /users: Active user directory, ordered by ID
+//
+// It also returns the cursor of the next page, empty on the last.
+func (c *Client) GetUsers(ctx context.Context, params GetUsersParams) ([]User, string, error) {
+	query := url.Values{}
+	if params.Online != nil {
+		query.Set("online", strconv.FormatBool(*params.Online))
+	}
+	if params.Search != nil {
+		query.Set("search", *params.Search)
+	}
+	if params.Limit != nil {
+		query.Set("limit", strconv.FormatInt(*params.Limit, 10))
+	}
+	if params.Cursor != nil {
+		query.Set("cursor", *params.Cursor)
+	}
+	if params.Since != nil {
+		query.Set("since", strconv.FormatInt(*params.Since, 10))
+	}
+	resp, err := c.do(ctx, "GET", "/users", query, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	var result []User
+	if err := decode(resp, &result); err != nil {
+		return nil, "", err
+	}
+	return result, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// AccountContact is part of AccountExport and AccountExport
+type AccountContact struct {
+	Since  time.Time `json:"since"`
+	UserID string    `json:"user_id"`
+}
+
+// AccountDeletion is returned by DeleteAccount
+type AccountDeletion struct {
+	Attachments int64  `json:"attachments"`
+	DeadLetters int64  `json:"dead_letters"`
+	Deliveries  int64  `json:"deliveries"`
+	Messages    int64  `json:"messages"`
+	UserID      string `json:"user_id"`
+}
+
+// AccountExport is returned by GetAccountExport
+type AccountExport struct {
+	Attachments     []AttachmentStatus    `json:"attachments"`
+	ContactOf       []AccountContact      `json:"contact_of"`
+	Contacts        []AccountContact      `json:"contacts"`
+	DailyUsage      []DailyUsage          `json:"daily_usage"`
+	Devices         []Device              `json:"devices"`
+	ExportedAt      time.Time             `json:"exported_at"`
+	Invite          *Invite               `json:"invite,omitempty"`
+	Logs            []LogEntry            `json:"logs"`
+	MessageRequests bool                  `json:"message_requests"`
+	Messages        []Message             `json:"messages"`
+	Notifications   *NotificationSettings `json:"notifications,omitempty"`
+	Receipts        string                `json:"receipts"`
+	RecoveryKit     *RecoveryKit          `json:"recovery_kit,omitempty"`
+	SendQuota       *SendQuota            `json:"send_quota,omitempty"`
+	SendUsage       SendUsage             `json:"send_usage"`
+	SsoSubject      string                `json:"sso_subject,omitempty"`
+	UpdatedAt       *time.Time            `json:"updated_at,omitempty"`
+	User            User                  `json:"user"`
+}
+
+// Announcement is part of AnnouncementFeed
+type Announcement struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ID        string    `json:"id"`
+	Signature []byte    `json:"signature"`
+}
+
+// AnnouncementFeed is returned by GetAnnouncements
+type AnnouncementFeed struct {
+	Announcements []Announcement `json:"announcements"`
+	HubPublicKey  string         `json:"hub_public_key"`
+}
+
+// Attachment is part of Message
+type Attachment struct {
+	ChunkSize   int64  `json:"chunk_size,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Content     []byte `json:"content"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	ID          string `json:"id,omitempty"`
+	Nonce       []byte `json:"nonce,omitempty"`
+	SealedInfo  []byte `json:"sealed_info,omitempty"`
+	SealedKey   []byte `json:"sealed_key,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// AttachmentReservation is the request body of PostAttachment
+type AttachmentReservation struct {
+	Size int64 `json:"size"`
+}
+
+// AttachmentStatus is returned by GetAttachmentStatus, PostAttachment and
+// PutAttachment
+type AttachmentStatus struct {
+	Complete bool   `json:"complete"`
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Size     int64  `json:"size"`
+}
+
+// AuditEntry is returned by GetAdminAudit
+type AuditEntry struct {
+	Action  string                     `json:"action"`
+	Actor   string                     `json:"actor"`
+	Details map[string]json.RawMessage `json:"details,omitempty"`
+	ID      int64                      `json:"id"`
+	Target  string                     `json:"target,omitempty"`
+	Time    time.Time                  `json:"time"`
+}
+
+// CapacityReport is returned by GetAdminReport
+type CapacityReport struct {
+	Daily          []DailyUsage `json:"daily"`
+	DatabaseBytes  int64        `json:"database_bytes"`
+	DaysToFull     float64      `json:"days_to_full"`
+	DiskFreeBytes  int64        `json:"disk_free_bytes"`
+	GrowthPerDay   float64      `json:"growth_per_day"`
+	IngestPerDay   float64      `json:"ingest_per_day"`
+	Since          time.Time    `json:"since"`
+	Sizes          []SizeBucket `json:"sizes"`
+	StoredBytes    int64        `json:"stored_bytes"`
+	StoredMessages int64        `json:"stored_messages"`
+	TopTalkers     []TopTalker  `json:"top_talkers"`
+}
+
+// DailyUsage is part of AccountExport and CapacityReport
+type DailyUsage struct {
+	Bytes    int64     `json:"bytes"`
+	Day      time.Time `json:"day"`
+	Messages int64     `json:"messages"`
+}
+
+// DeadLetter is part of DeliveryQueue
+type DeadLetter struct {
+	Attempts    int64     `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	FailedAt    time.Time `json:"failed_at"`
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	LastError   string    `json:"last_error"`
+	PayloadSize int64     `json:"payload_size"`
+	Target      string    `json:"target"`
+}
+
+// DeliveryMetrics is returned by GetAdminMetrics
+type DeliveryMetrics struct {
+	Backlog          []UserBacklog `json:"backlog"`
+	Delivered        int64         `json:"delivered"`
+	ExpiredUnfetched int64         `json:"expired_unfetched"`
+	// LatencyAvg is the duration in nanoseconds
+	LatencyAvg int64 `json:"latency_avg"`
+	// LatencyMax is the duration in nanoseconds
+	LatencyMax int64 `json:"latency_max"`
+	// LatencyP50 is the duration in nanoseconds
+	LatencyP50 int64 `json:"latency_p50"`
+	// LatencyP90 is the duration in nanoseconds
+	LatencyP90 int64 `json:"latency_p90"`
+	// LatencyP99 is the duration in nanoseconds
+	LatencyP99 int64     `json:"latency_p99"`
+	Since      time.Time `json:"since"`
+}
+
+// DeliveryQueue is returned by GetAdminDeadletters
+type DeliveryQueue struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+	Pending     int64        `json:"pending"`
+}
+
+// Device is the request body of PostDevices and returned by GetDevices and
+// PostDevices
+type Device struct {
+	FirstSeen time.Time `json:"first_seen"`
+	ID        string    `json:"id"`
+	LastSeen  time.Time `json:"last_seen"`
+	Name      string    `json:"name"`
+}
+
+// DirectoryEntry is part of DirectorySnapshot
+type DirectoryEntry struct {
+	DisplayName   string `json:"display_name"`
+	ID            string `json:"id"`
+	PublicKey     string `json:"public_key"`
+	SigningKey    string `json:"signing_key,omitempty"`
+	SigningKeySig []byte `json:"signing_key_sig,omitempty"`
+}
+
+// DirectorySnapshot is returned by GetDirectory
+type DirectorySnapshot struct {
+	ExpiresAt    time.Time        `json:"expires_at"`
+	GeneratedAt  time.Time        `json:"generated_at"`
+	HubPublicKey string           `json:"hub_public_key"`
+	Signature    []byte           `json:"signature"`
+	Users        []DirectoryEntry `json:"users"`
+}
+
+// EndpointSchema is part of Schema
+type EndpointSchema struct {
+	Auth          string        `json:"auth"`
+	Description   string        `json:"description"`
+	Method        string        `json:"method"`
+	Paginated     bool          `json:"paginated,omitempty"`
+	Path          string        `json:"path"`
+	Protobuf      bool          `json:"protobuf,omitempty"`
+	Query         []ParamSchema `json:"query,omitempty"`
+	Request       string        `json:"request,omitempty"`
+	RequestMedia  string        `json:"request_media,omitempty"`
+	Response      string        `json:"response,omitempty"`
+	ResponseMedia string        `json:"response_media,omitempty"`
+	Status        int64         `json:"status"`
+}
+
+// Event is returned by GetAdminEvents
+type Event struct {
+	ID      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	UserID  string    `json:"user_id,omitempty"`
+}
+
+// FederationKey is returned by GetFederationKey
+type FederationKey struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+// GCReport is returned by GetAdminGC, PostAdminGC and PutAdminGC
+type GCReport struct {
+	AttachmentBytes int64            `json:"attachment_bytes"`
+	Attachments     int64            `json:"attachments"`
+	Deactivated     []InactiveUser   `json:"deactivated,omitempty"`
+	DryRun          bool             `json:"dry_run"`
+	Inactivity      InactivityPolicy `json:"inactivity"`
+	OrphanBytes     int64            `json:"orphan_bytes"`
+	OrphanFiles     int64            `json:"orphan_files"`
+	Warned          []InactiveUser   `json:"warned,omitempty"`
+}
+
+// Health is returned by GetHealth
+type Health struct {
+	Config           HubConfig `json:"config"`
+	EnvelopeFormats  []string  `json:"envelope_formats"`
+	ProtocolVersions []int64   `json:"protocol_versions"`
+	ServerTime       time.Time `json:"server_time"`
+	Status           string    `json:"status"`
+}
+
+// HubConfig is returned by GetConfig
+type HubConfig struct {
+	// ClockSkewTolerance is the duration in nanoseconds
+	ClockSkewTolerance int64 `json:"clock_skew_tolerance"`
+	// DedupeWindow is the duration in nanoseconds
+	DedupeWindow           int64    `json:"dedupe_window"`
+	EscrowKey              string   `json:"escrow_key,omitempty"`
+	FederationAllowPrivate bool     `json:"federation_allow_private,omitempty"`
+	FederationInsecure     bool     `json:"federation_insecure,omitempty"`
+	FederationName         string   `json:"federation_name,omitempty"`
+	FederationPeers        []string `json:"federation_peers,omitempty"`
+	GrpcPort               int64    `json:"grpc_port,omitempty"`
+	HubRetryCount          int64    `json:"hub_retry_count"`
+	// HubRetryDelay is the duration in nanoseconds
+	HubRetryDelay int64 `json:"hub_retry_delay"`
+	// HubTimeout is the duration in nanoseconds
+	HubTimeout  int64            `json:"hub_timeout"`
+	Inactivity  InactivityPolicy `json:"inactivity"`
+	LogCompress bool             `json:"log_compress"`
+	LogFile     string           `json:"log_file,omitempty"`
+	LogFormat   string           `json:"log_format,omitempty"`
+	// LogMaxAge is the duration in nanoseconds
+	LogMaxAge         int64 `json:"log_max_age"`
+	LogMaxBackups     int64 `json:"log_max_backups"`
+	LogMaxSizeMb      int64 `json:"log_max_size_mb"`
+	MaxAttachmentSize int64 `json:"max_attachment_size,omitempty"`
+	MaxMessageSize    int64 `json:"max_message_size"`
+	MaxStorageBytes   int64 `json:"max_storage_bytes,omitempty"`
+	MaxUsers          int64 `json:"max_users,omitempty"`
+	// MessageExpiry is the duration in nanoseconds
+	MessageExpiry     int64           `json:"message_expiry"`
+	OIDCClientID      string          `json:"oidc_client_id,omitempty"`
+	OIDCIssuer        string          `json:"oidc_issuer,omitempty"`
+	RateLimit         int64           `json:"rate_limit"`
+	RequireClientCert bool            `json:"require_client_cert,omitempty"`
+	RequireInvite     bool            `json:"require_invite,omitempty"`
+	RequireOIDC       bool            `json:"require_oidc,omitempty"`
+	Retention         RetentionPolicy `json:"retention"`
+	SendQuota         SendQuota       `json:"send_quota"`
+	TLSCertPath       string          `json:"tls_cert_path,omitempty"`
+	// UnsendWindow is the duration in nanoseconds
+	UnsendWindow int64 `json:"unsend_window"`
+	UseTLS       bool  `json:"use_tls"`
+	// UserPurgeDelay is the duration in nanoseconds
+	UserPurgeDelay int64 `json:"user_purge_delay"`
+	UserWebhooks   bool  `json:"user_webhooks,omitempty"`
+}
+
+// HubStats is returned by GetAdminStats
+type HubStats struct {
+	ActiveUsers         int64     `json:"active_users"`
+	Attachments         int64     `json:"attachments"`
+	BannedUsers         int64     `json:"banned_users"`
+	DatabaseBytes       int64     `json:"database_bytes"`
+	DeactivatedUsers    int64     `json:"deactivated_users"`
+	DeadLetters         int64     `json:"dead_letters"`
+	MaxStorageBytes     int64     `json:"max_storage_bytes"`
+	MaxUsers            int64     `json:"max_users"`
+	OnlineUsers         int64     `json:"online_users"`
+	QueuedDeliveries    int64     `json:"queued_deliveries"`
+	StartedAt           time.Time `json:"started_at"`
+	StoredBytes         int64     `json:"stored_bytes"`
+	StoredMessages      int64     `json:"stored_messages"`
+	TotalUsers          int64     `json:"total_users"`
+	UndeliveredMessages int64     `json:"undelivered_messages"`
+	UnreadMessages      int64     `json:"unread_messages"`
+	UptimeSeconds       int64     `json:"uptime_seconds"`
+}
+
+// InactiveUser is part of GCReport and GCReport
+type InactiveUser struct {
+	DeactivateAt time.Time `json:"deactivate_at"`
+	DisplayName  string    `json:"display_name"`
+	ID           string    `json:"id"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// InactivityPolicy is part of GCReport and HubConfig
+type InactivityPolicy struct {
+	// After is the duration in nanoseconds
+	After int64 `json:"after,omitempty"`
+	// Notice is the duration in nanoseconds
+	Notice int64 `json:"notice,omitempty"`
+}
+
+// Invite is returned by GetInvite
+type Invite struct {
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+	Code        string     `json:"code,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DisplayName string     `json:"display_name"`
+	Email       string     `json:"email,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UserID      string     `json:"user_id"`
+}
+
+// InviteCode is returned by GetAdminInvites and PostAdminInvites
+type InviteCode struct {
+	Code      string     `json:"code,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ID        string     `json:"id"`
+	MaxUses   int64      `json:"max_uses"`
+	Note      string     `json:"note,omitempty"`
+	Uses      int64      `json:"uses"`
+}
+
+// KeyRotation is part of KeyRotationRequest, Registration and User
+type KeyRotation struct {
+	IdentitySig []byte `json:"identity_sig"`
+	PreviousKey string `json:"previous_key"`
+	PreviousSig []byte `json:"previous_sig"`
+	PublicKey   string `json:"public_key"`
+	RotatedAt   int64  `json:"rotated_at"`
+}
+
+// KeyRotationRequest is the request body of PostKeyRotate
+type KeyRotationRequest struct {
+	Rotation      KeyRotation `json:"rotation"`
+	SigningKeySig []byte      `json:"signing_key_sig"`
+	UserID        string      `json:"user_id"`
+}
+
+// LogEntry is part of AccountExport
+type LogEntry struct {
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	UserID  string    `json:"user_id,omitempty"`
+}
+
+// Message is the request body of PostFederationDeliver and PostMessage and
+// returned by GetMessages
+type Message struct {
+	Attachment   *Attachment  `json:"attachment,omitempty"`
+	Compression  string       `json:"compression,omitempty"`
+	Content      []byte       `json:"content"`
+	DedupeKey    string       `json:"dedupe_key,omitempty"`
+	EncryptedKey []byte       `json:"encrypted_key,omitempty"`
+	EphemeralKey []byte       `json:"ephemeral_key,omitempty"`
+	EscrowID     string       `json:"escrow_id,omitempty"`
+	EscrowedKey  []byte       `json:"escrowed_key,omitempty"`
+	ExpiresAt    int64        `json:"expires_at,omitempty"`
+	ID           string       `json:"id"`
+	InReplyTo    string       `json:"in_reply_to,omitempty"`
+	IV           []byte       `json:"iv"`
+	Part         *MessagePart `json:"part,omitempty"`
+	PrekeyID     string       `json:"prekey_id,omitempty"`
+	Recipient    string       `json:"recipient"`
+	Sender       string       `json:"sender"`
+	SigAlg       string       `json:"sig_alg,omitempty"`
+	Signature    []byte       `json:"signature"`
+	Status       string       `json:"status"`
+	Suite        string       `json:"suite,omitempty"`
+	Timestamp    int64        `json:"timestamp"`
+	Version      int64        `json:"version,omitempty"`
+}
+
+// MessagePart is part of Message
+type MessagePart struct {
+	Group string `json:"group"`
+	Index int64  `json:"index"`
+	Total int64  `json:"total"`
+}
+
+// MessageRequest is part of RequestsResult
+type MessageRequest struct {
+	FirstAt    time.Time `json:"first_at"`
+	LastAt     time.Time `json:"last_at"`
+	Messages   int64     `json:"messages"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	SenderID   string    `json:"sender_id"`
+	SenderName string    `json:"sender_name,omitempty"`
+}
+
+// MessageStatus is returned by GetMessageStatus
+type MessageStatus struct {
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	ID            string     `json:"id"`
+	InReplyTo     string     `json:"in_reply_to,omitempty"`
+	QuietHours    bool       `json:"quiet_hours,omitempty"`
+	ReadAt        *time.Time `json:"read_at,omitempty"`
+	RecipientID   string     `json:"recipient_id"`
+	RecipientName string     `json:"recipient_name,omitempty"`
+	Replies       int64      `json:"replies,omitempty"`
+	State         string     `json:"state"`
+}
+
+// NotificationSettings is the request body of PostNotifications and returned by
+// GetNotifications and PostNotifications
+type NotificationSettings struct {
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	WebhookURL string      `json:"webhook_url,omitempty"`
+}
+
+// ParamSchema is part of EndpointSchema
+type ParamSchema struct {
+	Description string `json:"description,omitempty"`
+	Name        string `json:"name"`
+	Required    bool   `json:"required,omitempty"`
+	Type        string `json:"type"`
+}
+
+// Prekey is the request body of PostPrekey
+type Prekey struct {
+	CreatedAt int64    `json:"created_at"`
+	ID        string   `json:"id"`
+	PublicKey []byte   `json:"public_key"`
+	Signature []byte   `json:"signature"`
+	Suites    []string `json:"suites,omitempty"`
+}
+
+// PurgeResult is returned by DeleteAdminMessages and DeleteAdminUsers
+type PurgeResult struct {
+	Messages int64 `json:"messages"`
+}
+
+// QuietHours is part of NotificationSettings
+type QuietHours struct {
+	End      string `json:"end"`
+	Start    string `json:"start"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// QuotaSettings is returned by DeleteAdminQuotas, GetAdminQuotas and
+// PutAdminQuotas
+type QuotaSettings struct {
+	Default   SendQuota     `json:"default"`
+	Overrides []SenderQuota `json:"overrides"`
+	Sender    *SenderQuota  `json:"sender,omitempty"`
+}
+
+// ReadRequest is the request body of PostMessageRead
+type ReadRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// ReadResult is returned by PostMessageRead
+type ReadResult struct {
+	Marked int64 `json:"marked"`
+}
+
+// ReceiptSettings is the request body of PostReceipts and returned by
+// GetReceipts and PostReceipts
+type ReceiptSettings struct {
+	Receipts string `json:"receipts"`
+}
+
+// RecoveryKit is the request body of PostRecovery and returned by GetRecovery
+type RecoveryKit struct {
+	Kit        []byte `json:"kit"`
+	RecoveryID string `json:"recovery_id"`
+	UserID     string `json:"user_id,omitempty"`
+}
+
+// Registration is the request body of PostRegister
+type Registration struct {
+	DisplayName   string        `json:"display_name"`
+	ID            string        `json:"id"`
+	InviteCode    string        `json:"invite_code,omitempty"`
+	KeyRotations  []KeyRotation `json:"key_rotations,omitempty"`
+	LastSeen      time.Time     `json:"last_seen"`
+	Online        bool          `json:"online"`
+	Prekey        *Prekey       `json:"prekey,omitempty"`
+	PublicKey     string        `json:"public_key"`
+	SigningKey    string        `json:"signing_key,omitempty"`
+	SigningKeySig []byte        `json:"signing_key_sig,omitempty"`
+}
+
+// RequestsAction is the request body of PostRequests
+type RequestsAction struct {
+	Action   string `json:"action"`
+	SenderID string `json:"sender_id,omitempty"`
+}
+
+// RequestsResult is returned by GetRequests and PostRequests
+type RequestsResult struct {
+	Enabled  bool             `json:"enabled"`
+	Requests []MessageRequest `json:"requests"`
+}
+
+// RetentionPolicy is returned by GetAdminRetention and PutAdminRetention
+type RetentionPolicy struct {
+	Attachments RetentionRule `json:"attachments"`
+	Text        RetentionRule `json:"text"`
+}
+
+// RetentionRule is part of RetentionPolicy and RetentionPolicy
+type RetentionRule struct {
+	// Delivered is the duration in nanoseconds
+	Delivered int64 `json:"delivered,omitempty"`
+	// Read is the duration in nanoseconds
+	Read int64 `json:"read,omitempty"`
+	// Undelivered is the duration in nanoseconds
+	Undelivered int64 `json:"undelivered,omitempty"`
+}
+
+// Schema is returned by GetSchema
+type Schema struct {
+	Auth            map[string]string            `json:"auth"`
+	BasePath        string                       `json:"base_path"`
+	Endpoints       []EndpointSchema             `json:"endpoints"`
+	Limits          SchemaLimits                 `json:"limits"`
+	MessageVersions []int64                      `json:"message_versions"`
+	Types           map[string]map[string]string `json:"types"`
+	Version         int64                        `json:"version"`
+}
+
+// SchemaLimits is part of Schema
+type SchemaLimits struct {
+	ClockSkewToleranceSeconds int64 `json:"clock_skew_tolerance_seconds"`
+	MaxAttachmentSize         int64 `json:"max_attachment_size"`
+	MaxMessageSize            int64 `json:"max_message_size"`
+	MaxStorageBytes           int64 `json:"max_storage_bytes"`
+	MaxUsers                  int64 `json:"max_users"`
+	MessageExpirySeconds      int64 `json:"message_expiry_seconds"`
+	RateLimit                 int64 `json:"rate_limit"`
+}
+
+// SendQuota is part of AccountExport, HubConfig, QuotaSettings and SenderQuota
+type SendQuota struct {
+	Burst          int64 `json:"burst,omitempty"`
+	DailyBytes     int64 `json:"daily_bytes,omitempty"`
+	DailyMessages  int64 `json:"daily_messages,omitempty"`
+	HourlyBytes    int64 `json:"hourly_bytes,omitempty"`
+	HourlyMessages int64 `json:"hourly_messages,omitempty"`
+}
+
+// SendResult is returned by PostMessage
+type SendResult struct {
+	ID               string `json:"id"`
+	ReceiptsDisabled bool   `json:"receipts_disabled,omitempty"`
+	Request          bool   `json:"request,omitempty"`
+	Status           string `json:"status"`
+}
+
+// SendUsage is part of AccountExport and SenderQuota
+type SendUsage struct {
+	DailyBytes     int64 `json:"daily_bytes"`
+	DailyMessages  int64 `json:"daily_messages"`
+	HourlyBytes    int64 `json:"hourly_bytes"`
+	HourlyMessages int64 `json:"hourly_messages"`
+}
+
+// SenderQuota is part of QuotaSettings and QuotaSettings
+type SenderQuota struct {
+	DisplayName string    `json:"display_name"`
+	Override    bool      `json:"override"`
+	Quota       SendQuota `json:"quota"`
+	Usage       SendUsage `json:"usage"`
+	UserID      string    `json:"user_id"`
+}
+
+// SizeBucket is part of CapacityReport
+type SizeBucket struct {
+	Label    string `json:"label"`
+	Messages int64  `json:"messages"`
+}
+
+// SizeLimitError is the body of a 413 response, in Error.SizeLimit
+type SizeLimitError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	Limit int64  `json:"limit"`
+	Size  int64  `json:"size,omitempty"`
+}
+
+// TopTalker is part of CapacityReport
+type TopTalker struct {
+	Bytes       int64  `json:"bytes"`
+	DisplayName string `json:"display_name"`
+	Messages    int64  `json:"messages"`
+	UserID      string `json:"user_id"`
+}
+
+// UnsendResult is returned by DeleteMessageByID
+type UnsendResult struct {
+	Delivered bool   `json:"delivered"`
+	ID        string `json:"id"`
+}
+
+// User is returned by GetFederationUser and GetUsers
+type User struct {
+	DisplayName   string        `json:"display_name"`
+	ID            string        `json:"id"`
+	KeyRotations  []KeyRotation `json:"key_rotations,omitempty"`
+	LastSeen      time.Time     `json:"last_seen"`
+	Online        bool          `json:"online"`
+	Prekey        *Prekey       `json:"prekey,omitempty"`
+	PublicKey     string        `json:"public_key"`
+	SigningKey    string        `json:"signing_key,omitempty"`
+	SigningKeySig []byte        `json:"signing_key_sig,omitempty"`
+}
+
+// UserBacklog is part of DeliveryMetrics
+type UserBacklog struct {
+	DisplayName string    `json:"display_name"`
+	LastSeen    time.Time `json:"last_seen"`
+	// NextExpiry is the duration in nanoseconds
+	NextExpiry int64 `json:"next_expiry"`
+	// OldestAge is the duration in nanoseconds
+	OldestAge int64  `json:"oldest_age"`
+	Pending   int64  `json:"pending"`
+	UserID    string `json:"user_id"`
+}
+
+// UserSummary is returned by GetAdminUsers
+type UserSummary struct {
+	BanReason     string     `json:"ban_reason,omitempty"`
+	BannedAt      *time.Time `json:"banned_at,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	DisplayName   string     `json:"display_name"`
+	ID            string     `json:"id"`
+	LastSeen      time.Time  `json:"last_seen"`
+	Messages      int64      `json:"messages"`
+	Online        bool       `json:"online"`
+	StoredBytes   int64      `json:"stored_bytes"`
+}
+
+// UsernameAvailability is returned by GetCheckUsername
+type UsernameAvailability struct {
+	Available bool `json:"available"`
+}
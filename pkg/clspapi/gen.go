@@ -0,0 +1,544 @@
+//go:build ignore
+
+// gen.go writes openapi.json from the hub's API description and client_gen.go, a
+// method for each of its operations and a struct for each of its schemas. Run it
+// with 'go generate' after changing the hub's endpoints or the types they use.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/mattd/clsp/internal/hub"
+)
+
+// methods orders the operations of a path
+var methods = []string{"get", "post", "put", "delete"}
+
+// initialisms are the words Go names spell in capitals
+var initialisms = map[string]string{
+	"api":     "API",
+	"gc":      "GC",
+	"http":    "HTTP",
+	"id":      "ID",
+	"ids":     "IDs",
+	"iv":      "IV",
+	"json":    "JSON",
+	"oidc":    "OIDC",
+	"openapi": "OpenAPI",
+	"rsa":     "RSA",
+	"tls":     "TLS",
+	"ttl":     "TTL",
+	"url":     "URL",
+	"utc":     "UTC",
+}
+
+func main() {
+	doc := hub.OpenAPI()
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("openapi.json", append(data, '\n'), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	g := &generator{doc: doc}
+	g.printf("// Code generated by gen.go from the hub's OpenAPI document. DO NOT EDIT.\n\n")
+	g.printf("package clspapi\n\n")
+	body := fmt.Sprintf("// basePath prefixes the paths of the API version this client was generated from\nconst basePath = %q\n\n", doc.Servers[0].URL)
+	body += g.operations() + g.models()
+	g.imports(body)
+	g.out.WriteString(body)
+
+	src, err := format.Source([]byte(g.out.String()))
+	if err != nil {
+		log.Fatalf("generated code does not parse: %v\n%s", err, g.out.String())
+	}
+	if err := os.WriteFile("client_gen.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generator accumulates the source of client_gen.go
+type generator struct {
+	doc *hub.OpenAPIDocument
+	out strings.Builder
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.out, format, args...)
+}
+
+// imports writes the import block for the packages body uses
+func (g *generator) imports(body string) {
+	g.printf("import (\n")
+	for _, pkg := range []string{"context", "encoding/json", "io", "net/http", "net/url", "strconv", "time"} {
+		name := pkg[strings.LastIndex(pkg, "/")+1:]
+		if pkg == "context" || strings.Contains(body, name+".") {
+			g.printf("\t%q\n", pkg)
+		}
+	}
+	g.printf(")\n\n")
+}
+
+// operation is one operation with the path and method it is found under
+type operation struct {
+	path   string
+	method string
+	*hub.Operation
+}
+
+// operations returns the source of the params structs and methods, in path order
+func (g *generator) operations() string {
+	var ops []operation
+	for path, byMethod := range g.doc.Paths {
+		for _, method := range methods {
+			if op := byMethod[method]; op != nil {
+				ops = append(ops, operation{path: path, method: method, Operation: op})
+			}
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].path < ops[j].path })
+
+	var out strings.Builder
+	for _, op := range ops {
+		out.WriteString(g.operation(op))
+	}
+	return out.String()
+}
+
+// operation returns the source of one operation's params struct and method
+func (g *generator) operation(op operation) string {
+	var out strings.Builder
+	name := goName(op.OperationID)
+
+	// Path parameters become arguments, query parameters fields of a struct
+	args := []string{"ctx context.Context"}
+	var query []hub.Parameter
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			args = append(args, lowerFirst(goName(p.Name))+" string")
+		} else {
+			query = append(query, p)
+		}
+	}
+	if len(query) > 0 {
+		fmt.Fprintf(&out, "// %sParams are the query parameters of %s\n", name, name)
+		fmt.Fprintf(&out, "type %sParams struct {\n", name)
+		for _, p := range query {
+			if p.Description != "" {
+				out.WriteString(comment(fmt.Sprintf("%s is %s", goName(p.Name), p.Description)))
+			}
+			typ := paramType(p.Schema)
+			if !p.Required {
+				typ = "*" + typ
+			}
+			fmt.Fprintf(&out, "\t%s %s\n", goName(p.Name), typ)
+		}
+		out.WriteString("}\n\n")
+		args = append(args, "params "+name+"Params")
+	}
+
+	var bodyType, contentType string
+	if op.RequestBody != nil {
+		for media, content := range op.RequestBody.Content {
+			if _, ok := op.RequestBody.Content["application/json"]; ok && media != "application/json" {
+				// Alternative encodings of JSON bodies are left to clspclient
+				continue
+			}
+			contentType = media
+			if media == "application/json" {
+				bodyType = g.goType(content.Schema, true)
+			} else {
+				bodyType = "io.Reader"
+			}
+		}
+		args = append(args, "body "+bodyType)
+	}
+
+	// The first success response decides what the method returns
+	var success *hub.Response
+	for _, status := range []string{"200", "201", "202", "204"} {
+		if success = op.Responses[status]; success != nil {
+			break
+		}
+	}
+	var resultType string
+	raw := false
+	for media, content := range success.Content {
+		if _, ok := success.Content["application/json"]; ok && media != "application/json" {
+			continue
+		}
+		if media == "application/json" && content.Schema.Type != "object" {
+			resultType = g.goType(content.Schema, true)
+			if content.Schema.Ref != "" {
+				resultType = "*" + resultType
+			}
+		} else {
+			raw = true
+		}
+	}
+	var results []string
+	switch {
+	case raw:
+		results = []string{"*http.Response"}
+	case resultType != "":
+		results = []string{resultType}
+	}
+	if op.Paginated {
+		results = append(results, "string")
+	}
+	results = append(results, "error")
+
+	fmt.Fprintf(&out, "%s", comment(fmt.Sprintf("%s calls %s %s: %s", name, strings.ToUpper(op.method), op.path, op.Summary)))
+	switch {
+	case raw:
+		out.WriteString("//\n// The caller reads and closes the response body.\n")
+	case op.Paginated:
+		out.WriteString("//\n// It also returns the cursor of the next page, empty on the last.\n")
+	}
+	fmt.Fprintf(&out, "func (c *Client) %s(%s) (%s) {\n", name, strings.Join(args, ", "), strings.Join(results, ", "))
+
+	// Values returned alongside an error
+	var zero []string
+	for _, r := range results[:len(results)-1] {
+		switch r {
+		case "string":
+			zero = append(zero, `""`)
+		default:
+			zero = append(zero, "nil")
+		}
+	}
+	fail := strings.Join(append(zero, "err"), ", ")
+
+	out.WriteString("\tquery := url.Values{}\n")
+	for _, p := range query {
+		field := "params." + goName(p.Name)
+		value := field
+		if !p.Required {
+			fmt.Fprintf(&out, "\tif %s != nil {\n", field)
+			value = "*" + field
+		}
+		fmt.Fprintf(&out, "\tquery.Set(%q, %s)\n", p.Name, formatParam(p.Schema, value))
+		if !p.Required {
+			out.WriteString("\t}\n")
+		}
+	}
+
+	reader := "nil"
+	switch {
+	case bodyType == "io.Reader":
+		reader = "body"
+	case bodyType != "":
+		fmt.Fprintf(&out, "\treader, err := jsonBody(body)\n\tif err != nil {\n\t\treturn %s\n\t}\n", fail)
+		reader = "reader"
+	}
+	fmt.Fprintf(&out, "\tresp, err := c.do(ctx, %q, %s, query, %s, %q)\n", strings.ToUpper(op.method), pathExpr(op.path), reader, contentType)
+	fmt.Fprintf(&out, "\tif err != nil {\n\t\treturn %s\n\t}\n", fail)
+
+	switch {
+	case raw:
+		out.WriteString("\treturn resp, nil\n")
+	case resultType != "":
+		elem := strings.TrimPrefix(resultType, "*")
+		fmt.Fprintf(&out, "\tvar result %s\n", elem)
+		fmt.Fprintf(&out, "\tif err := decode(resp, &result); err != nil {\n\t\treturn %s\n\t}\n", fail)
+		ret := "result"
+		if strings.HasPrefix(resultType, "*") {
+			ret = "&result"
+		}
+		if op.Paginated {
+			ret += `, resp.Header.Get("X-Next-Cursor")`
+		}
+		fmt.Fprintf(&out, "\treturn %s, nil\n", ret)
+	default:
+		out.WriteString("\tdiscard(resp)\n")
+		if op.Paginated {
+			out.WriteString("\treturn resp.Header.Get(\"X-Next-Cursor\"), nil\n")
+		} else {
+			out.WriteString("\treturn nil\n")
+		}
+	}
+	out.WriteString("}\n\n")
+	return out.String()
+}
+
+// models returns the source of a struct for each schema, in name order
+func (g *generator) models() string {
+	uses := g.uses()
+	names := make([]string, 0, len(g.doc.Components.Schemas))
+	for name := range g.doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		out.WriteString(comment(fmt.Sprintf("%s is %s", goName(name), uses[name])))
+		fmt.Fprintf(&out, "type %s %s\n\n", goName(name), g.structType(g.doc.Components.Schemas[name]))
+	}
+	return out.String()
+}
+
+// uses describes where each schema appears: the operations that send or return it,
+// or else the schemas holding it
+func (g *generator) uses() map[string]string {
+	sent := make(map[string][]string)
+	returned := make(map[string][]string)
+	for _, byMethod := range g.doc.Paths {
+		for _, op := range byMethod {
+			if op.RequestBody != nil {
+				for _, content := range op.RequestBody.Content {
+					if name := refName(content.Schema); name != "" {
+						sent[name] = append(sent[name], goName(op.OperationID))
+					}
+				}
+			}
+			for status, resp := range op.Responses {
+				if !strings.HasPrefix(status, "2") {
+					continue
+				}
+				for _, content := range resp.Content {
+					if name := refName(content.Schema); name != "" {
+						returned[name] = append(returned[name], goName(op.OperationID))
+					}
+				}
+			}
+		}
+	}
+	held := make(map[string][]string)
+	for parent, schema := range g.doc.Components.Schemas {
+		for _, prop := range schema.Properties {
+			if name := refName(prop); name != "" && name != parent {
+				held[name] = append(held[name], goName(parent))
+			}
+		}
+	}
+
+	uses := make(map[string]string)
+	for name := range g.doc.Components.Schemas {
+		var phrases []string
+		if ops := sent[name]; len(ops) > 0 {
+			phrases = append(phrases, "the request body of "+list(ops))
+		}
+		if ops := returned[name]; len(ops) > 0 {
+			phrases = append(phrases, "returned by "+list(ops))
+		}
+		switch {
+		case len(phrases) > 0:
+			uses[name] = strings.Join(phrases, " and ")
+		case len(held[name]) > 0:
+			uses[name] = "part of " + list(held[name])
+		case name == "SizeLimitError":
+			uses[name] = "the body of a 413 response, in Error.SizeLimit"
+		default:
+			uses[name] = "a type of the hub API"
+		}
+	}
+	return uses
+}
+
+// refName returns the schema an array or reference refers to, if any
+func refName(s *hub.JSONSchema) string {
+	if s == nil {
+		return ""
+	}
+	if s.Items != nil {
+		return refName(s.Items)
+	}
+	return strings.TrimPrefix(s.Ref, "#/components/schemas/")
+}
+
+// structType returns a struct type for an object schema
+func (g *generator) structType(s *hub.JSONSchema) string {
+	if len(s.Properties) == 0 {
+		return "struct{}"
+	}
+	required := make(map[string]bool)
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	out.WriteString("struct {\n")
+	for _, name := range names {
+		prop := s.Properties[name]
+		typ := g.goType(prop, required[name])
+		tag := name
+		if !required[name] {
+			tag += ",omitempty"
+		}
+		if prop.Description != "" {
+			out.WriteString(comment(fmt.Sprintf("%s is the %s", goName(name), prop.Description)))
+		}
+		fmt.Fprintf(&out, "\t%s %s `json:%q`\n", goName(name), typ, tag)
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// goType returns the Go type of a schema; optional structs and times are pointers,
+// so leaving them out omits them
+func (g *generator) goType(s *hub.JSONSchema, required bool) string {
+	pointer := ""
+	if !required {
+		pointer = "*"
+	}
+	if s.Ref != "" {
+		return pointer + goName(refName(s))
+	}
+	switch s.Type {
+	case "string":
+		switch s.Format {
+		case "date-time":
+			return pointer + "time.Time"
+		case "byte":
+			return "[]byte"
+		}
+		return "string"
+	case "integer":
+		if s.Format == "int32" {
+			return "int32"
+		}
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + g.goType(s.Items, true)
+	case "object":
+		switch {
+		case s.AdditionalProperties != nil:
+			return "map[string]" + g.goType(s.AdditionalProperties, true)
+		case len(s.Properties) > 0:
+			return pointer + g.structType(s)
+		}
+	}
+	return "json.RawMessage"
+}
+
+// paramType returns the Go type of a parameter
+func paramType(s *hub.JSONSchema) string {
+	switch s.Type {
+	case "integer":
+		return "int64"
+	case "boolean":
+		return "bool"
+	}
+	return "string"
+}
+
+// formatParam returns an expression formatting a parameter value for a query
+func formatParam(s *hub.JSONSchema, value string) string {
+	switch s.Type {
+	case "integer":
+		return "strconv.FormatInt(" + value + ", 10)"
+	case "boolean":
+		return "strconv.FormatBool(" + value + ")"
+	}
+	return value
+}
+
+// pathExpr returns an expression building path from its parameters
+func pathExpr(path string) string {
+	var parts []string
+	for path != "" {
+		start := strings.Index(path, "{")
+		if start < 0 {
+			parts = append(parts, fmt.Sprintf("%q", path))
+			break
+		}
+		end := strings.Index(path, "}")
+		parts = append(parts, fmt.Sprintf("%q", path[:start]))
+		parts = append(parts, "url.PathEscape("+lowerFirst(goName(path[start+1:end]))+")")
+		path = path[end+1:]
+	}
+	return strings.Join(parts, " + ")
+}
+
+// goName converts a JSON, parameter or operation name to an exported Go name
+func goName(name string) string {
+	var words []string
+	var word []rune
+	for i, r := range name {
+		switch {
+		case r == '_' || r == '-' || r == '.':
+			words = append(words, string(word))
+			word = nil
+			continue
+		case unicode.IsUpper(r) && i > 0 && len(word) > 0 && unicode.IsLower(word[len(word)-1]):
+			words = append(words, string(word))
+			word = nil
+		}
+		word = append(word, r)
+	}
+	words = append(words, string(word))
+
+	var out strings.Builder
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		if initialism, ok := initialisms[strings.ToLower(w)]; ok {
+			out.WriteString(initialism)
+			continue
+		}
+		runes := []rune(w)
+		runes[0] = unicode.ToUpper(runes[0])
+		out.WriteString(string(runes))
+	}
+	return out.String()
+}
+
+// lowerFirst returns an exported name as an unexported one
+func lowerFirst(name string) string {
+	if upper := strings.ToUpper(name); upper == name {
+		return strings.ToLower(name)
+	}
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
+
+// list joins names as English
+func list(names []string) string {
+	sort.Strings(names)
+	switch len(names) {
+	case 1:
+		return names[0]
+	case 2:
+		return names[0] + " and " + names[1]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// comment wraps text as a Go comment of lines up to 80 columns
+func comment(text string) string {
+	var out, line strings.Builder
+	for _, word := range strings.Fields(text) {
+		if line.Len() > 0 && line.Len()+1+len(word) > 77 {
+			out.WriteString("// " + line.String() + "\n")
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteString(" ")
+		}
+		line.WriteString(word)
+	}
+	out.WriteString("// " + line.String() + "\n")
+	return out.String()
+}
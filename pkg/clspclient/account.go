@@ -0,0 +1,95 @@
+package clspclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AccountDeletion reports what the hub removed with an account
+type AccountDeletion struct {
+	UserID      string `json:"user_id"`
+	Messages    int64  `json:"messages"`
+	Attachments int    `json:"attachments"`
+	// Deliveries counts the queued webhook notifications and relays to other hubs
+	// removed, and DeadLetters those that had already failed
+	Deliveries  int64 `json:"deliveries"`
+	DeadLetters int64 `json:"dead_letters"`
+}
+
+// DeleteAccount deletes the client's account from the hub at once, together with
+// its stored messages, attachments, contacts, presence and usage. The identity can
+// register again afterwards, but nothing the hub held comes back.
+func (c *Client) DeleteAccount(ctx context.Context) (*AccountDeletion, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	params, err := c.signedParams(info, "account-delete")
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := c.endpoint(ctx, "/account")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient(ctx, c.timeout(info)).Do(req)
+	if err != nil {
+		c.forgetHealth()
+		return nil, fmt.Errorf("failed to delete account: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var deletion AccountDeletion
+	if err := json.NewDecoder(resp.Body).Decode(&deletion); err != nil {
+		return nil, fmt.Errorf("failed to decode account deletion: %v", err)
+	}
+	return &deletion, nil
+}
+
+// ExportAccount writes everything the hub holds about the client's account to w, as
+// the JSON document the hub returns: profile, settings, stored messages as encrypted
+// envelopes, attachments, contacts, usage and log entries
+func (c *Client) ExportAccount(ctx context.Context, w io.Writer) error {
+	if c.Key == nil || c.UserID == "" {
+		return fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	params, err := c.signedParams(info, "account-export")
+	if err != nil {
+		return err
+	}
+	resp, err := c.get(ctx, c.timeout(info), "/account/export", params)
+	if err != nil {
+		return fmt.Errorf("failed to export account: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to read account export: %v", err)
+	}
+	return nil
+}
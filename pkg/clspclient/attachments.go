@@ -0,0 +1,420 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// ErrAttachmentsUnsupported is returned by UploadAttachment for hubs without the
+// /attachment endpoint; such hubs only accept attachments inline in the message
+var ErrAttachmentsUnsupported = errors.New("hub does not support uploaded attachments")
+
+// AttachmentStatus reports how much of an upload the hub holds
+type AttachmentStatus struct {
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	Received int64  `json:"received"`
+	Complete bool   `json:"complete"`
+}
+
+// Default retry behaviour for chunk transfers when the hub advertises none
+const (
+	defaultChunkRetries    = 3
+	defaultChunkRetryDelay = time.Second
+)
+
+// DetectContentType returns the MIME type of a file named filename that starts with
+// head (the first 512 bytes suffice). The content decides where it is recognizable;
+// otherwise the extension does, and files known by neither are
+// application/octet-stream.
+func DetectContentType(filename string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	// Plain text and unknown binary data are the sniffer's fallbacks, which an
+	// extension such as .csv or .docx narrows down
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// UploadAttachment encrypts size bytes read from r and uploads them to the hub in
+// chunks, returning the attachment to pass in SendOptions; the message then carries
+// only a reference and the sealed chunk key. Memory use does not depend on the file
+// size. An empty contentType is detected from the content and file name, and the
+// content's SHA-256 digest is recorded so the recipient can check the file they
+// download. If the upload fails part-way the returned attachment is still set, and
+// ResumeUpload continues it from where the hub left off.
+func (c *Client) UploadAttachment(ctx context.Context, r io.ReaderAt, size int64, filename, contentType string) (*Attachment, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+	if contentType == "" {
+		head := make([]byte, 512)
+		n, err := r.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read attachment: %v", err)
+		}
+		contentType = DetectContentType(filename, head[:n])
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %v", err)
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	key, err := crypto.NewAttachmentKey()
+	if err != nil {
+		return nil, err
+	}
+	attachment := &Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		ChunkSize:   crypto.AttachmentChunkSize,
+		Key:         key,
+		SHA256:      digest.Sum(nil),
+	}
+
+	encryptedSize := crypto.EncryptedAttachmentSize(size, attachment.ChunkSize)
+	if limit := info.Config.MaxAttachmentSize; limit > 0 && encryptedSize > limit {
+		return nil, fmt.Errorf("attachment exceeds the hub limit of %d bytes", limit)
+	}
+	params, err := c.signedParams(info, "attachment-create", strconv.FormatInt(encryptedSize, 10))
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]int64{"size": encryptedSize})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(ctx, c.timeout(info), "/attachment?"+params.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve attachment upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, ErrAttachmentsUnsupported
+	case http.StatusRequestEntityTooLarge:
+		return nil, parseTooLarge(resp)
+	default:
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	var status AttachmentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse hub response: %v", err)
+	}
+	attachment.ID = status.ID
+
+	return attachment, c.ResumeUpload(ctx, attachment, r)
+}
+
+// ResumeUpload uploads the chunks of attachment the hub does not hold yet, reading the
+// plaintext from r. attachment must come from UploadAttachment, whose key it carries.
+func (c *Client) ResumeUpload(ctx context.Context, attachment *Attachment, r io.ReaderAt) error {
+	if !attachment.Uploaded() || len(attachment.Key) == 0 {
+		return fmt.Errorf("attachment was not reserved by UploadAttachment")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	status, err := c.AttachmentStatus(ctx, attachment.ID)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := int64(attachment.ChunkSize)
+	encryptedChunk := crypto.EncryptedChunkSize(attachment.ChunkSize)
+	chunks := crypto.ChunkCount(attachment.Size, attachment.ChunkSize)
+	buf := make([]byte, chunkSize)
+	for !status.Complete {
+		// Chunks are written whole, so the hub only stops at chunk boundaries
+		if status.Received%encryptedChunk != 0 {
+			return fmt.Errorf("hub holds a partial chunk of attachment %s", attachment.ID)
+		}
+		index := status.Received / encryptedChunk
+		if index >= chunks {
+			return fmt.Errorf("hub expects more data than attachment %s holds", attachment.ID)
+		}
+
+		start := index * chunkSize
+		n := attachment.Size - start
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if _, err := r.ReadAt(buf[:n], start); err != nil && !(err == io.EOF && n > 0) {
+			return fmt.Errorf("failed to read attachment: %v", err)
+		}
+		chunk, err := crypto.EncryptChunk(attachment.Key, index, index == chunks-1, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		status, err = c.putChunk(ctx, info, attachment.ID, status.Received, chunk)
+		if err != nil {
+			return fmt.Errorf("chunk %d of %d: %w", index+1, chunks, err)
+		}
+		if c.Progress != nil {
+			done := status.Received / encryptedChunk * chunkSize
+			if status.Complete || done > attachment.Size {
+				done = attachment.Size
+			}
+			c.Progress(done, attachment.Size)
+		}
+	}
+	return nil
+}
+
+// AttachmentStatus returns the upload progress of an attachment this client reserved
+func (c *Client) AttachmentStatus(ctx context.Context, id string) (*AttachmentStatus, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	params, err := c.signedParams(info, "attachment-status", id)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("id", id)
+	resp, err := c.get(ctx, c.timeout(info), "/attachment/status", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	var status AttachmentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse hub response: %v", err)
+	}
+	return &status, nil
+}
+
+// putChunk writes one encrypted chunk at offset, retrying transient failures. The
+// returned status says where the next chunk goes; after a conflict (say, a retry of a
+// chunk the hub did receive) it is the hub's own position rather than offset+len(chunk).
+func (c *Client) putChunk(ctx context.Context, info *HubInfo, id string, offset int64, chunk []byte) (*AttachmentStatus, error) {
+	var lastErr error
+	for attempt := 0; attempt <= chunkRetries(info); attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, chunkRetryDelay(info)); err != nil {
+				return nil, err
+			}
+		}
+
+		params, err := c.signedParams(info, "attachment-upload", id, strconv.FormatInt(offset, 10))
+		if err != nil {
+			return nil, err
+		}
+		params.Set("id", id)
+		params.Set("offset", strconv.FormatInt(offset, 10))
+		endpoint, err := c.endpoint(ctx, "/attachment")
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"?"+params.Encode(), bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := c.httpClient(ctx, c.timeout(info)).Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		var status AttachmentStatus
+		switch {
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict:
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse hub response: %v", err)
+			}
+			return &status, nil
+		case resp.StatusCode == http.StatusRequestEntityTooLarge:
+			tooLarge := parseTooLarge(resp)
+			resp.Body.Close()
+			return nil, tooLarge
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusBadRequest:
+			// Server trouble, or a body the hub saw cut short
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		default:
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		}
+	}
+	return nil, lastErr
+}
+
+// DownloadAttachment writes the decrypted content of a received attachment to w. An
+// uploaded attachment is fetched from the hub chunk by chunk, each one authenticated
+// before it is written, so memory use does not depend on the file size and a
+// truncated or altered file is detected. Interrupted chunks are fetched again. Once
+// everything is written the content is checked against the SHA-256 digest the sender
+// recorded, if any; callers should discard what they wrote when that fails.
+func (c *Client) DownloadAttachment(ctx context.Context, attachment *Attachment, w io.Writer) error {
+	if !attachment.Uploaded() {
+		_, err := w.Write(attachment.Content)
+		return err
+	}
+	if len(attachment.Key) == 0 {
+		return fmt.Errorf("attachment key unavailable; decrypt the message first")
+	}
+	if c.Key == nil || c.UserID == "" {
+		return fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	chunkSize := int64(attachment.ChunkSize)
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid attachment chunk size")
+	}
+	encryptedChunk := crypto.EncryptedChunkSize(attachment.ChunkSize)
+	chunks := crypto.ChunkCount(attachment.Size, attachment.ChunkSize)
+	buf := make([]byte, encryptedChunk)
+	digest := sha256.New()
+	w = io.MultiWriter(w, digest)
+	for index := int64(0); index < chunks; index++ {
+		n := attachment.Size - index*chunkSize
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := buf[:n+crypto.GCMOverhead]
+		if err := c.getChunk(ctx, info, attachment.ID, index*encryptedChunk, chunk); err != nil {
+			return fmt.Errorf("chunk %d of %d: %v", index+1, chunks, err)
+		}
+		plaintext, err := crypto.DecryptChunk(attachment.Key, index, index == chunks-1, chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if c.Progress != nil {
+			c.Progress(index*chunkSize+n, attachment.Size)
+		}
+	}
+	return attachment.VerifyDigest(digest.Sum(nil))
+}
+
+// getChunk reads len(buf) bytes of an attachment's ciphertext at offset, retrying
+// transient failures
+func (c *Client) getChunk(ctx context.Context, info *HubInfo, id string, offset int64, buf []byte) error {
+	var lastErr error
+	for attempt := 0; attempt <= chunkRetries(info); attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, chunkRetryDelay(info)); err != nil {
+				return err
+			}
+		}
+
+		params, err := c.signedParams(info, "attachment", id)
+		if err != nil {
+			return err
+		}
+		params.Set("id", id)
+		endpoint, err := c.endpoint(ctx, "/attachment")
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+		resp, err := c.httpClient(ctx, c.timeout(info)).Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			_, err = io.ReadFull(resp.Body, buf)
+			resp.Body.Close()
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			lastErr = fmt.Errorf("hub returned status %d", resp.StatusCode)
+		default:
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		}
+	}
+	return lastErr
+}
+
+// chunkRetries returns how often a failed chunk transfer is retried
+func chunkRetries(info *HubInfo) int {
+	if info.Config.HubRetryCount > 0 {
+		return info.Config.HubRetryCount
+	}
+	return defaultChunkRetries
+}
+
+// chunkRetryDelay returns the pause before retrying a chunk transfer
+func chunkRetryDelay(info *HubInfo) time.Duration {
+	if info.Config.HubRetryDelay > 0 {
+		return info.Config.HubRetryDelay
+	}
+	return defaultChunkRetryDelay
+}
+
+// sleepContext waits for d or until ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
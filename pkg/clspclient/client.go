@@ -0,0 +1,745 @@
+// Package clspclient is a Go client for CLSP hubs. It lets programs and bots
+// register identities, look up users, and send and receive end-to-end encrypted
+// messages without shelling out to the clsp binary.
+//
+// A Client talks to one hub as one identity:
+//
+//	key, _ := clspclient.LoadPrivateKey("private.key")
+//	c := clspclient.New("https://hub.example.com", userID, key)
+//	result, err := c.SendMessage(ctx, "alice", []byte("hello"), clspclient.SendOptions{})
+//
+// Every method takes a context; cancelling it aborts the request in flight.
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// DefaultTimeout bounds hub requests made before the hub's own timeout is known
+const DefaultTimeout = 5 * time.Second
+
+// Client talks to a CLSP hub on behalf of one identity. UserID and Key may be left
+// empty for calls that need no identity, such as Health, Users and Register.
+type Client struct {
+	// HubURL is the base URL of the hub, e.g. "https://hub.example.com"
+	HubURL string
+	// UserID is the identity's user ID on the hub
+	UserID string
+	// Key is the identity's private key, used to encrypt, decrypt and sign
+	Key *rsa.PrivateKey
+	// SigningKey, if set, is the identity's Ed25519 signing key, which then signs
+	// messages and requests instead of Key and is published by Register
+	SigningKey ed25519.PrivateKey
+	// Prekeys are the private halves of the identity's X25519 prekeys by ID, needed
+	// to decrypt messages sent with forward secrecy (see PublishPrekey)
+	Prekeys map[string]*ecdh.PrivateKey
+	// CipherSuites are the cipher suites published with new prekeys, most preferred
+	// first; senders encrypt to the identity with the first one they support. Nil
+	// publishes every suite this package registers (see crypto.CipherSuites).
+	CipherSuites []string
+	// Compression, if set, is the algorithm (see crypto.Compressions) that compresses
+	// message content and inline attachments before encryption, for recipients whose
+	// prekey offers it. Compressed messages are smaller, but their size then depends
+	// on how repetitive the plaintext is.
+	Compression string
+
+	// HTTPClient makes the requests; nil uses a client bounded by Timeout
+	HTTPClient *http.Client
+	// Timeout bounds each request when the context carries no deadline; zero uses
+	// the hub's advertised timeout, or DefaultTimeout before that is known
+	Timeout time.Duration
+
+	// Progress, if set, is called after each attachment chunk is transferred with the
+	// plaintext bytes done so far and the total
+	Progress func(done, total int64)
+
+	// HealthCache, if set, lets requests reuse a recent health check instead of
+	// asking the hub for its configuration first (see CachedHealth)
+	HealthCache HealthCache
+	// HealthTTL is how long a cached health check is used; zero uses DefaultHealthTTL
+	HealthTTL time.Duration
+
+	// JSONEnvelopes sends and fetches envelopes as JSON even with hubs that accept
+	// protobuf, which is smaller and quicker to encode (see EnvelopeFormats)
+	JSONEnvelopes bool
+
+	refreshMu  sync.Mutex
+	refreshing bool
+
+	protocolMu sync.Mutex
+	protocol   int
+	negotiated bool
+}
+
+// New returns a client for the hub at hubURL acting as userID with key
+func New(hubURL, userID string, key *rsa.PrivateKey) *Client {
+	return &Client{
+		HubURL: strings.TrimSuffix(hubURL, "/"),
+		UserID: userID,
+		Key:    key,
+	}
+}
+
+// LoadPrivateKey reads an unencrypted PEM private key, as written by 'clsp init'
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	return crypto.LoadPrivateKey(path)
+}
+
+// LoadEncryptedPrivateKey reads a passphrase-protected private key
+func LoadEncryptedPrivateKey(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	return crypto.LoadEncryptedPrivateKey(path, passphrase)
+}
+
+// GenerateKey creates a new identity key pair and returns the public key as PEM
+func GenerateKey() (*rsa.PrivateKey, []byte, error) {
+	return crypto.GenerateKeyPair()
+}
+
+// User is an entry in the hub's user directory
+type User struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	PublicKey   string `json:"public_key"`
+	// Prekey is the user's signed X25519 prekey; senders fall back to the RSA key
+	// for users without one
+	Prekey *Prekey `json:"prekey,omitempty"`
+	// SigningKey is the user's Ed25519 signing key (PEM), if they have one, and
+	// SigningKeySig its certificate from PublicKey (see VerifySigningKey)
+	SigningKey    string `json:"signing_key,omitempty"`
+	SigningKeySig []byte `json:"signing_key_sig,omitempty"`
+	// KeyRotations are the user's latest key rotations, oldest first (see RotatedFrom)
+	KeyRotations []KeyRotation `json:"key_rotations,omitempty"`
+}
+
+// KeyRotation announces that a user replaced their RSA key, signed by the replaced
+// key and by their signing key
+type KeyRotation = crypto.KeyRotation
+
+// RotatedFrom checks that the user's current key replaced pinnedKey (PEM) through
+// their published key rotations. signingKey, if not nil, is the user's pinned signing
+// key, which must have signed every rotation as well.
+func (u *User) RotatedFrom(pinnedKey string, signingKey ed25519.PublicKey) error {
+	return crypto.FollowRotations(pinnedKey, u.PublicKey, signingKey, u.KeyRotations)
+}
+
+// VerifySigningKey returns the user's signing key once its certificate checks out
+// against identityKey, which should be the user's pinned RSA key rather than the one
+// the directory offers now
+func (u *User) VerifySigningKey(identityKey *rsa.PublicKey) (ed25519.PublicKey, error) {
+	if u.SigningKey == "" {
+		return nil, fmt.Errorf("user has no signing key")
+	}
+	return crypto.VerifySigningKey(identityKey, u.SigningKey, u.SigningKeySig)
+}
+
+// Prekey is a signed X25519 public key used to encrypt messages with forward secrecy
+type Prekey = crypto.Prekey
+
+// PublishPrekey generates a new prekey, publishes it in the hub directory and adds its
+// private half to c.Prekeys. Callers must persist the returned key for as long as
+// messages encrypted to it may arrive, and delete it afterwards; deleting it is what
+// makes those messages undecryptable should the identity key later leak.
+func (c *Client) PublishPrekey(ctx context.Context) (*Prekey, *ecdh.PrivateKey, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	prekey, private, err := crypto.GeneratePrekey(c.Key, c.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := json.Marshal(prekey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal prekey: %v", err)
+	}
+
+	params, err := c.signedParams(info, "prekey", prekey.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.post(ctx, c.timeout(info), "/prekey?"+params.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to publish prekey: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if c.Prekeys == nil {
+		c.Prekeys = make(map[string]*ecdh.PrivateKey)
+	}
+	c.Prekeys[prekey.ID] = private
+	return prekey, private, nil
+}
+
+// RotateKey replaces the client's RSA key with newKey on the hub, announcing the
+// change with a key rotation signed by the current key and the signing key, which the
+// hub must already have. On success the client uses newKey. The hub drops the prekey
+// signed by the old key; publish a new one with PublishPrekey.
+func (c *Client) RotateKey(ctx context.Context, newKey *rsa.PrivateKey) (*KeyRotation, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+	if c.SigningKey == nil {
+		return nil, fmt.Errorf("client has no signing key")
+	}
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	rotation, err := crypto.NewKeyRotation(c.Key, c.SigningKey, &newKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signingKeyPEM, err := crypto.SigningPublicKeyToPEM(c.SigningKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := crypto.CertifySigningKey(newKey, signingKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to certify signing key: %v", err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"user_id":         c.UserID,
+		"rotation":        rotation,
+		"signing_key_sig": certificate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key rotation: %v", err)
+	}
+
+	resp, err := c.post(ctx, c.timeout(info), "/key/rotate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate key: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	c.Key = newKey
+	return rotation, nil
+}
+
+// signedParams returns the query parameters that prove a request for action on fields
+// was made by the client's identity
+func (c *Client) signedParams(info *HubInfo, action string, fields ...string) (url.Values, error) {
+	if c.Key == nil && c.SigningKey == nil {
+		return nil, fmt.Errorf("client has no key to sign with")
+	}
+	ts := info.HubNow().Unix()
+	payload := crypto.RequestPayload(action, c.UserID, ts, fields...)
+	var sig []byte
+	if c.SigningKey != nil {
+		sig = ed25519.Sign(c.SigningKey, payload)
+	} else {
+		var err error
+		if sig, err = crypto.SignData(c.Key, payload); err != nil {
+			return nil, err
+		}
+	}
+	params := url.Values{}
+	params.Set("user_id", c.UserID)
+	params.Set("ts", fmt.Sprintf("%d", ts))
+	params.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+	return params, nil
+}
+
+// HubConfig is the configuration a hub publishes to clients
+type HubConfig struct {
+	MessageExpiry time.Duration `json:"message_expiry"`
+	UseTLS        bool          `json:"use_tls"`
+	TLSCertPath   string        `json:"tls_cert_path,omitempty"`
+	RateLimit     int           `json:"rate_limit"`
+	HubTimeout    time.Duration `json:"hub_timeout"`
+	HubRetryCount int           `json:"hub_retry_count"`
+	HubRetryDelay time.Duration `json:"hub_retry_delay"`
+
+	// RequireClientCert reports whether the hub only accepts clients with a
+	// certificate from its client CA
+	RequireClientCert bool `json:"require_client_cert"`
+
+	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance"`
+	DedupeWindow       time.Duration `json:"dedupe_window"`
+	// UnsendWindow is how long after sending a message its recipient already fetched
+	// can still be deleted with Unsend (zero for only unfetched messages)
+	UnsendWindow time.Duration `json:"unsend_window"`
+
+	MaxUsers          int   `json:"max_users"`
+	MaxStorageBytes   int64 `json:"max_storage_bytes"`
+	MaxMessageSize    int   `json:"max_message_size"`
+	MaxAttachmentSize int64 `json:"max_attachment_size"`
+
+	RequireOIDC  bool   `json:"require_oidc"`
+	OIDCIssuer   string `json:"oidc_issuer"`
+	OIDCClientID string `json:"oidc_client_id"`
+
+	// RequireInvite reports whether new accounts must register with an invite code
+	RequireInvite bool `json:"require_invite"`
+
+	// UserWebhooks reports whether users may register new-message webhooks
+	UserWebhooks bool `json:"user_webhooks"`
+
+	// EscrowKey is the PEM public key of the organization's recovery key, which clients
+	// of users who opted in to escrow also wrap message keys to (empty for none)
+	EscrowKey string `json:"escrow_key"`
+
+	// FederationName is the name users of other hubs address this hub's users with,
+	// as name@FederationName (empty when the hub does not federate)
+	FederationName string `json:"federation_name"`
+}
+
+// EscrowFingerprint returns the fingerprint of the hub's escrow key, or "" if the hub
+// publishes none
+func (h *HubConfig) EscrowFingerprint() (string, error) {
+	if h.EscrowKey == "" {
+		return "", nil
+	}
+	key, err := crypto.LoadPublicKeyFromPEM([]byte(h.EscrowKey))
+	if err != nil {
+		return "", fmt.Errorf("hub publishes an invalid escrow key: %v", err)
+	}
+	return crypto.Fingerprint(key)
+}
+
+// HubInfo represents the hub's configuration and status
+type HubInfo struct {
+	Status     string
+	ServerTime time.Time `json:"server_time"`
+	Config     HubConfig
+	// ProtocolVersions are the API versions the hub speaks, and Protocol the one it
+	// chose for this client (zero for hubs that predate versioning)
+	ProtocolVersions []int `json:"protocol_versions"`
+	Protocol         int   `json:"protocol"`
+	// EnvelopeFormats are the media types the hub takes and serves envelopes in; hubs
+	// that predate them list none and speak JSON
+	EnvelopeFormats []string `json:"envelope_formats"`
+
+	// ClockSkew is how far the hub clock is ahead of the local clock
+	ClockSkew time.Duration `json:"-"`
+	// RoundTrip is how long the health check took
+	RoundTrip time.Duration `json:"-"`
+}
+
+// HubNow returns the current time as seen by the hub
+func (h *HubInfo) HubNow() time.Time {
+	return time.Now().Add(h.ClockSkew)
+}
+
+// Health checks that the hub is available and returns its configuration, with the
+// clock skew estimated from the round trip, and negotiates the protocol version of
+// later requests. It always asks the hub, and records the result in c.HealthCache
+// when one is set.
+func (c *Client) Health(ctx context.Context) (*HubInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.HubURL+"/health", nil)
+	if err != nil {
+		return nil, err
+	}
+	offerProtocols(req)
+	start := time.Now()
+	resp, err := c.httpClient(ctx, DefaultTimeout).Do(req)
+	if err != nil {
+		c.forgetHealth()
+		return nil, fmt.Errorf("hub not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+	rtt := time.Since(start)
+
+	protocol, err := negotiatedProtocol(resp)
+	if err != nil {
+		c.forgetHealth()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.forgetHealth()
+		return nil, fmt.Errorf("hub returned status %d", resp.StatusCode)
+	}
+
+	var info HubInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse hub response: %v", err)
+	}
+
+	info.Protocol = protocol
+	c.setProtocol(protocol)
+
+	// Estimate clock skew against the midpoint of the request
+	info.RoundTrip = rtt
+	if !info.ServerTime.IsZero() {
+		info.ClockSkew = info.ServerTime.Sub(start.Add(rtt / 2))
+	}
+	if c.HealthCache != nil {
+		c.HealthCache.Put(c.HubURL, &info, start)
+	}
+	return &info, nil
+}
+
+// Config fetches the configuration the hub publishes to clients
+func (c *Client) Config(ctx context.Context) (*HubConfig, error) {
+	resp, err := c.get(ctx, DefaultTimeout, "/config", nil)
+	if err != nil {
+		return nil, fmt.Errorf("hub not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hub returned status %d", resp.StatusCode)
+	}
+
+	var config HubConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse hub configuration: %v", err)
+	}
+	return &config, nil
+}
+
+// CheckUsername reports whether a display name is still available on the hub
+func (c *Client) CheckUsername(ctx context.Context, username string) (bool, error) {
+	params := url.Values{}
+	params.Set("username", username)
+	resp, err := c.get(ctx, DefaultTimeout, "/check-username", params)
+	if err != nil {
+		return false, fmt.Errorf("failed to check username: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("hub returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Available bool `json:"available"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return result.Available, nil
+}
+
+// UserQuery filters the user directory
+type UserQuery struct {
+	// Online keeps only users seen recently
+	Online bool
+	// Search keeps only users whose display name has a word starting with each word
+	// of this text
+	Search string
+}
+
+// Users returns the hub's user directory matching q, following pagination
+func (c *Client) Users(ctx context.Context, q UserQuery) ([]User, error) {
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	params := url.Values{}
+	if q.Online {
+		params.Set("online", "true")
+	}
+	if q.Search != "" {
+		params.Set("search", q.Search)
+	}
+	users, err := fetchPaged[User](ctx, c, c.timeout(info), "/users", params, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %v", err)
+	}
+	return users, nil
+}
+
+// FindUser returns the directory entry whose display name or ID is nameOrID
+func (c *Client) FindUser(ctx context.Context, nameOrID string) (*User, error) {
+	if strings.Contains(nameOrID, "@") {
+		return c.FederatedUser(ctx, nameOrID)
+	}
+	users, err := c.Users(ctx, UserQuery{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if users[i].DisplayName == nameOrID || users[i].ID == nameOrID {
+			return &users[i], nil
+		}
+	}
+	return nil, fmt.Errorf("recipient not found: %s", nameOrID)
+}
+
+// FederatedUser looks up name@hub or id@hub through the client's hub, which asks the
+// user's hub. The request is signed with the client's key, as hubs only ask other
+// hubs for their own users. The returned ID and display name carry the hub as well,
+// and messages sent to that ID are relayed there.
+func (c *Client) FederatedUser(ctx context.Context, address string) (*User, error) {
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	params, err := c.signedParams(info, "federation-user", address)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("address", address)
+	resp, err := c.get(ctx, c.Timeout, "/federation/user", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %v", address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		if msg := strings.TrimSpace(string(body)); msg != "User not found" {
+			return nil, fmt.Errorf("cannot reach %s: %s", address, msg)
+		}
+		return nil, fmt.Errorf("recipient not found: %s", address)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to look up %s: %s", address, strings.TrimSpace(string(body)))
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("failed to parse user: %v", err)
+	}
+	return &user, nil
+}
+
+// Invite is the identity a hub operator provisioned for an invite code. UserID and
+// DisplayName are empty for an invite code that lets its holder choose them.
+type Invite struct {
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// LookupInvite asks the hub which identity an invite code reserves
+func (c *Client) LookupInvite(ctx context.Context, code string) (*Invite, error) {
+	params := url.Values{}
+	params.Set("code", code)
+	resp, err := c.get(ctx, c.Timeout, "/invite", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up invite: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("invite rejected: %s", strings.TrimSpace(string(body)))
+	}
+
+	var invite Invite
+	if err := json.NewDecoder(resp.Body).Decode(&invite); err != nil {
+		return nil, fmt.Errorf("failed to parse invite: %v", err)
+	}
+	return &invite, nil
+}
+
+// RegisterRequest publishes an identity in the hub's directory
+type RegisterRequest struct {
+	DisplayName string
+	// PublicKeyPEM is the identity's public key; empty derives it from the client's Key
+	PublicKeyPEM []byte
+	// InviteCode claims the identity an operator provisioned, or admits a new account
+	// to a hub that requires invites (optional)
+	InviteCode string
+	// IDToken is an OIDC ID token, required by hubs that gate registration on SSO
+	IDToken string
+}
+
+// registerBody is the body of POST /register
+type registerBody struct {
+	User
+	InviteCode string `json:"invite_code,omitempty"`
+}
+
+// Register publishes the client's identity to the hub, signed with its Key to prove
+// the key is the client's own. Registering again with the same user ID and key
+// re-announces it; an account's key is replaced only by RotateKey.
+func (c *Client) Register(ctx context.Context, req RegisterRequest) error {
+	if c.UserID == "" {
+		return fmt.Errorf("client has no user ID")
+	}
+	if c.Key == nil {
+		return fmt.Errorf("client has no key")
+	}
+	publicKeyPEM := req.PublicKeyPEM
+	if len(publicKeyPEM) == 0 {
+		var err error
+		if publicKeyPEM, err = crypto.PublicKeyToPEM(&c.Key.PublicKey); err != nil {
+			return fmt.Errorf("failed to encode public key: %v", err)
+		}
+	} else if key, err := crypto.LoadPublicKeyFromPEM(publicKeyPEM); err != nil || !key.Equal(&c.Key.PublicKey) {
+		return fmt.Errorf("public key does not belong to the client's key")
+	}
+	fingerprint, err := crypto.Fingerprint(&c.Key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("hub not available: %v", err)
+	}
+	if info.Config.RequireOIDC && req.IDToken == "" {
+		return fmt.Errorf("hub requires single sign-on via %s; an ID token is needed to register", info.Config.OIDCIssuer)
+	}
+
+	user := User{
+		ID:          c.UserID,
+		DisplayName: req.DisplayName,
+		PublicKey:   string(publicKeyPEM),
+	}
+	// The signing key is certified by the identity key so contacts who pinned that
+	// accept it without checking anew
+	if c.SigningKey != nil && c.Key != nil {
+		if user.SigningKey, err = crypto.SigningPublicKeyToPEM(c.SigningKey.Public().(ed25519.PublicKey)); err != nil {
+			return err
+		}
+		if user.SigningKeySig, err = crypto.CertifySigningKey(c.Key, user.SigningKey); err != nil {
+			return fmt.Errorf("failed to certify signing key: %v", err)
+		}
+	}
+	reqBody, err := json.Marshal(&registerBody{
+		User:       user,
+		InviteCode: req.InviteCode,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// The registration is signed with the identity key itself, even when a signing
+	// key signs other requests: it is what proves the key is ours
+	ts := info.HubNow().Unix()
+	sig, err := crypto.SignData(c.Key, crypto.RequestPayload("register", c.UserID, ts, req.DisplayName, fingerprint))
+	if err != nil {
+		return fmt.Errorf("failed to sign registration: %v", err)
+	}
+	params := url.Values{}
+	params.Set("user_id", c.UserID)
+	params.Set("ts", fmt.Sprintf("%d", ts))
+	params.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+
+	endpoint, err := c.endpoint(ctx, "/register")
+	if err != nil {
+		return fmt.Errorf("hub not available: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"?"+params.Encode(), bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.IDToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+req.IDToken)
+	}
+	resp, err := c.httpClient(ctx, c.timeout(info)).Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to register with hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("hub returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// timeout returns the per-request timeout once the hub's configuration is known
+func (c *Client) timeout(info *HubInfo) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	if info != nil && info.Config.HubTimeout > 0 {
+		return info.Config.HubTimeout
+	}
+	return DefaultTimeout
+}
+
+// httpClient returns the HTTP client for one request. If ctx already carries a
+// deadline, that deadline governs the request instead of the fixed timeout.
+func (c *Client) httpClient(ctx context.Context, timeout time.Duration) *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if _, ok := ctx.Deadline(); ok {
+		timeout = 0
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// get performs a GET request for path on the hub, bound to ctx
+func (c *Client) get(ctx context.Context, timeout time.Duration, path string, params url.Values) (*http.Response, error) {
+	return c.getAccepting(ctx, timeout, path, params, "")
+}
+
+// getAccepting performs a GET request like get, listing the media types accept (if
+// any) in its Accept header
+func (c *Client) getAccepting(ctx context.Context, timeout time.Duration, path string, params url.Values, accept string) (*http.Response, error) {
+	endpoint, err := c.endpoint(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := c.httpClient(ctx, timeout).Do(req)
+	if err != nil {
+		c.forgetHealth()
+	}
+	return resp, err
+}
+
+// post performs a POST request for path on the hub, bound to ctx, so cancelling ctx
+// aborts a partial upload
+func (c *Client) post(ctx context.Context, timeout time.Duration, path, contentType string, body io.Reader) (*http.Response, error) {
+	endpoint, err := c.endpoint(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.httpClient(ctx, timeout).Do(req)
+	if err != nil {
+		c.forgetHealth()
+	}
+	return resp, err
+}
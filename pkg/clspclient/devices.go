@@ -0,0 +1,78 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Device is a client installation of an identity, as it announced itself to the hub
+type Device struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Devices returns the devices the identity's clients announced, most recently seen
+// first
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	return c.devices(ctx, http.MethodGet, nil)
+}
+
+// AnnounceDevice tells the hub that the device with this ID and name uses the
+// identity now, and returns the devices as Devices does
+func (c *Client) AnnounceDevice(ctx context.Context, id, name string) ([]Device, error) {
+	body, err := json.Marshal(Device{ID: id, Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal device: %v", err)
+	}
+	return c.devices(ctx, http.MethodPost, body)
+}
+
+// devices sends a request to /devices signed over the method and body
+func (c *Client) devices(ctx context.Context, method string, body []byte) ([]Device, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "devices", method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	if method == http.MethodPost {
+		resp, err = c.post(ctx, c.timeout(info), "/devices?"+params.Encode(), "application/json", bytes.NewReader(body))
+	} else {
+		resp, err = c.get(ctx, c.timeout(info), "/devices", params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var devices []Device
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, fmt.Errorf("failed to decode devices: %v", err)
+	}
+	return devices, nil
+}
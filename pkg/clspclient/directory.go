@@ -0,0 +1,73 @@
+package clspclient
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// DirectoryEntry is one user in a directory snapshot
+type DirectoryEntry = crypto.DirectoryEntry
+
+// DirectorySnapshot is the hub-signed list of active users and their keys. Clients
+// can keep it to resolve recipients and look up keys while the hub is unreachable.
+type DirectorySnapshot struct {
+	HubPublicKey string           `json:"hub_public_key"`
+	GeneratedAt  time.Time        `json:"generated_at"`
+	ExpiresAt    time.Time        `json:"expires_at"`
+	Users        []DirectoryEntry `json:"users"`
+	Signature    []byte           `json:"signature"`
+}
+
+// Verify checks the snapshot's signature against the hub key the caller trusts, which
+// need not be the HubPublicKey the snapshot carries
+func (d *DirectorySnapshot) Verify(hubKey *rsa.PublicKey) error {
+	payload := crypto.DirectoryPayload(d.GeneratedAt.Unix(), d.ExpiresAt.Unix(), d.Users)
+	if err := crypto.VerifyData(hubKey, payload, d.Signature); err != nil {
+		return fmt.Errorf("directory snapshot is not signed by the hub: %v", err)
+	}
+	return nil
+}
+
+// Find returns the user whose display name or ID is nameOrID
+func (d *DirectorySnapshot) Find(nameOrID string) (*User, bool) {
+	for _, u := range d.Users {
+		if u.DisplayName == nameOrID || u.ID == nameOrID {
+			return &User{ID: u.ID, DisplayName: u.DisplayName, PublicKey: u.PublicKey}, true
+		}
+	}
+	return nil, false
+}
+
+// Directory downloads the hub's signed directory snapshot. The caller should Verify
+// it against a pinned hub key before relying on it.
+func (c *Client) Directory(ctx context.Context) (*DirectorySnapshot, error) {
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	resp, err := c.get(ctx, c.timeout(info), "/directory", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var snapshot DirectorySnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode directory: %v", err)
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,124 @@
+package clspclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultHealthTTL is how long a cached health check is used before it is repeated
+const DefaultHealthTTL = time.Minute
+
+// HealthCache keeps the results of health checks so that consecutive requests, or
+// consecutive processes when the cache is persistent, need not ask the hub for its
+// configuration before each one. Implementations must be safe for concurrent use.
+type HealthCache interface {
+	// Get returns the last health check of hubURL and when it was made
+	Get(hubURL string) (info *HubInfo, fetched time.Time, ok bool)
+	// Put records a successful health check of hubURL
+	Put(hubURL string, info *HubInfo, fetched time.Time)
+	// Forget drops the entry for hubURL, so the next request checks the hub again
+	Forget(hubURL string)
+}
+
+// NewHealthCache returns a HealthCache held in memory, which a long-running program
+// can share between its clients
+func NewHealthCache() HealthCache {
+	return &memoryHealthCache{entries: make(map[string]healthEntry)}
+}
+
+type healthEntry struct {
+	info    HubInfo
+	fetched time.Time
+}
+
+type memoryHealthCache struct {
+	mu      sync.Mutex
+	entries map[string]healthEntry
+}
+
+func (m *memoryHealthCache) Get(hubURL string) (*HubInfo, time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[hubURL]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	info := e.info
+	return &info, e.fetched, true
+}
+
+func (m *memoryHealthCache) Put(hubURL string, info *HubInfo, fetched time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[hubURL] = healthEntry{info: *info, fetched: fetched}
+}
+
+func (m *memoryHealthCache) Forget(hubURL string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, hubURL)
+}
+
+// healthTTL returns how long a cached health check stays usable
+func (c *Client) healthTTL() time.Duration {
+	if c.HealthTTL > 0 {
+		return c.HealthTTL
+	}
+	return DefaultHealthTTL
+}
+
+// CachedHealth returns the hub's configuration like Health, but answers from
+// c.HealthCache while the last check is younger than the TTL. Past half the TTL the
+// cached answer is still returned and a fresh check runs in the background; only a
+// missing or expired entry, which includes one dropped after a failed request, makes
+// the caller wait for the hub.
+func (c *Client) CachedHealth(ctx context.Context) (*HubInfo, error) {
+	if c.HealthCache == nil {
+		return c.Health(ctx)
+	}
+	info, fetched, ok := c.HealthCache.Get(c.HubURL)
+	if !ok {
+		return c.Health(ctx)
+	}
+	age := time.Since(fetched)
+	ttl := c.healthTTL()
+	if age < 0 || age >= ttl {
+		return c.Health(ctx)
+	}
+	if age >= ttl/2 {
+		c.refreshHealth()
+	}
+	info.RoundTrip = 0
+	return info, nil
+}
+
+// refreshHealth repeats the health check in the background unless one is running
+func (c *Client) refreshHealth() {
+	c.refreshMu.Lock()
+	if c.refreshing {
+		c.refreshMu.Unlock()
+		return
+	}
+	c.refreshing = true
+	c.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			c.refreshMu.Lock()
+			c.refreshing = false
+			c.refreshMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		c.Health(ctx)
+	}()
+}
+
+// forgetHealth drops the cached health check after a request failed to reach the hub,
+// or showed the hub's limits to have changed
+func (c *Client) forgetHealth() {
+	if c.HealthCache != nil {
+		c.HealthCache.Forget(c.HubURL)
+	}
+}
@@ -0,0 +1,72 @@
+package clspclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Codes of a TooLargeError, naming the hub limit exceeded
+const (
+	LimitMessageSize    = "message_too_large"
+	LimitAttachmentSize = "attachment_too_large"
+	LimitRequestSize    = "request_too_large"
+)
+
+// TooLargeError is returned when the hub refuses a request as too large (413)
+type TooLargeError struct {
+	// Code names the limit exceeded; it is empty for hubs that explain in plain text
+	Code string
+	// Limit is the largest size the hub accepts in bytes, and Size the size refused
+	// (zero when unknown)
+	Limit int64
+	Size  int64
+	// Message is the hub's explanation
+	Message string
+}
+
+func (e *TooLargeError) Error() string {
+	switch e.Code {
+	case LimitMessageSize:
+		return fmt.Sprintf("message is too large for the hub (%s encrypted, limit %s per message)", formatSize(e.Size), formatSize(e.Limit))
+	case LimitAttachmentSize:
+		if e.Size > 0 {
+			return fmt.Sprintf("attachment is too large for the hub (%s encrypted, limit %s)", formatSize(e.Size), formatSize(e.Limit))
+		}
+		return fmt.Sprintf("attachment is too large for the hub (limit %s)", formatSize(e.Limit))
+	case LimitRequestSize:
+		return fmt.Sprintf("request is too large for the hub (limit %s)", formatSize(e.Limit))
+	}
+	return fmt.Sprintf("hub refused the request as too large: %s", e.Message)
+}
+
+// parseTooLarge reads the body of a 413 response
+func parseTooLarge(resp *http.Response) *TooLargeError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var refusal struct {
+		Message string `json:"error"`
+		Code    string `json:"code"`
+		Limit   int64  `json:"limit"`
+		Size    int64  `json:"size"`
+	}
+	if json.Unmarshal(body, &refusal) != nil || refusal.Code == "" {
+		return &TooLargeError{Message: strings.TrimSpace(string(body))}
+	}
+	return &TooLargeError{Code: refusal.Code, Limit: refusal.Limit, Size: refusal.Size, Message: refusal.Message}
+}
+
+// formatSize returns a byte count in binary units
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
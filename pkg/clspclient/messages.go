@@ -0,0 +1,748 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+// Envelope is an encrypted message as stored and relayed by the hub
+type Envelope = crypto.Message
+
+// Attachment is a file sent along with a message
+type Attachment = crypto.Attachment
+
+// MessagePart identifies one piece of a message split to fit the hub's size limit
+type MessagePart = crypto.MessagePart
+
+// EncodeEnvelope returns the canonical encoding of a well-formed envelope, the form
+// sent to the hub. Decoding it with DecodeEnvelope yields an equal envelope.
+func EncodeEnvelope(env *Envelope) ([]byte, error) {
+	return crypto.EncodeMessage(env)
+}
+
+// DecodeEnvelope parses and validates an encoded envelope, such as one relayed by a
+// hub that is not trusted. Malformed envelopes are rejected with an error.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	return crypto.DecodeMessage(data)
+}
+
+// Message is a received message after decryption
+type Message struct {
+	ID        string
+	Sender    string
+	Recipient string
+	Time      time.Time
+	Status    string
+	Content   []byte
+	// Attachment describes an attached file, if any
+	Attachment *Attachment
+	// Part is set on one piece of a split message
+	Part *MessagePart
+	// Escrowed is set when the sender also wrapped the message key to an
+	// organizational recovery key, so its holder can read the message too
+	Escrowed bool
+	// InReplyTo is the ID of the message this one answers, if any
+	InReplyTo string
+	// ExpiresAt is when the sender wants the message deleted, zero when the hub's
+	// expiry applies. An expired message is no longer returned by FetchEnvelopes.
+	ExpiresAt time.Time
+}
+
+// SendOptions holds optional settings for SendMessage
+type SendOptions struct {
+	// Attachment is a file to send with the message: either one returned by
+	// UploadAttachment, or a small one carried inline with Content as the plaintext.
+	// An inline attachment without ContentType or SHA256 gets them from its content.
+	Attachment *Attachment
+	// AllowDuplicate skips hub-side duplicate suppression for intentional repeats
+	AllowDuplicate bool
+	// CheckKey, if set, is called with the recipient's directory entry before anything
+	// is encrypted to it; an error aborts the send. Callers use it to compare the key
+	// the hub offers with one pinned earlier.
+	CheckKey func(recipient *User) error
+	// EscrowFingerprint, if set, additionally wraps the message key to the hub's
+	// escrow (organizational recovery) key, which must have this fingerprint. Set it
+	// only for users who agreed to escrow that key; a different or missing key on the
+	// hub aborts the send.
+	EscrowFingerprint string
+	// InReplyTo, if set, is the ID of the message this one answers; every part of a
+	// split message carries it
+	InReplyTo string
+	// DryRun has the hub run every check on each part without storing anything, so a
+	// large or scripted send can be validated first. The result lists the IDs the parts
+	// would have had.
+	DryRun bool
+	// Expiry, if set, has the hub and the recipient's client delete the message this
+	// long after it is sent. It must be shorter than the hub's message expiry, which
+	// applies otherwise.
+	Expiry time.Duration
+}
+
+// SendResult reports what the hub stored for a sent message
+type SendResult struct {
+	// IDs lists the message ID of every part, in order (one for an unsplit message)
+	IDs []string
+	// RecipientID is the user ID the message was addressed to
+	RecipientID string
+	// Duplicates counts parts the hub had already stored and did not store again
+	Duplicates int
+	// Escrowed is set when the message key was also wrapped to the escrow key
+	Escrowed bool
+	// Quota is the sender's remaining outbound quota after the last part, or nil when
+	// the hub reports none
+	Quota *QuotaStatus
+	// ReceiptsDisabled is set when the recipient's receipt policy keeps the sender from
+	// seeing when the message is delivered and read
+	ReceiptsDisabled bool
+	// Relayed is set when the recipient belongs to another hub, which the sender's hub
+	// queued the message for; its delivery state is then not tracked
+	Relayed bool
+	// Request is set when the recipient holds messages from first-time senders as
+	// message requests; they read it only once they accept the sender
+	Request bool
+	// ExpiresAt is when the message will be deleted at the sender's request, zero
+	// when the hub's expiry applies
+	ExpiresAt time.Time
+}
+
+// AlreadyDelivered reports whether the hub had already stored the whole message
+func (r *SendResult) AlreadyDelivered() bool {
+	return len(r.IDs) > 0 && r.Duplicates == len(r.IDs)
+}
+
+// postResult is the hub's response to a stored message
+type postResult struct {
+	ID               string `json:"id"`
+	Status           string `json:"status"`
+	ReceiptsDisabled bool   `json:"receipts_disabled"`
+	Request          bool   `json:"request"`
+	// quota comes from the response headers
+	quota *QuotaStatus
+}
+
+// SendMessage encrypts content for the user whose display name or ID is recipient and
+// sends it. Content larger than the hub's limit is split into linked parts; re-sending
+// the same content resumes without duplicating parts that were already delivered.
+func (c *Client) SendMessage(ctx context.Context, recipient string, content []byte, opts SendOptions) (*SendResult, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	recipientUser, err := c.FindUser(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CheckKey != nil {
+		if err := opts.CheckKey(recipientUser); err != nil {
+			return nil, err
+		}
+	}
+	recipientPublicKey, err := crypto.LoadPublicKeyFromPEM([]byte(recipientUser.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recipient's public key: %v", err)
+	}
+
+	var escrowKey *rsa.PublicKey
+	if opts.EscrowFingerprint != "" {
+		fingerprint, err := info.Config.EscrowFingerprint()
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint == "" {
+			return nil, fmt.Errorf("hub no longer publishes an escrow key")
+		}
+		if fingerprint != opts.EscrowFingerprint {
+			return nil, fmt.Errorf("hub escrow key changed to %s", crypto.ShortenFingerprint(fingerprint))
+		}
+		escrowKey, _ = crypto.LoadPublicKeyFromPEM([]byte(info.Config.EscrowKey))
+	}
+
+	// The expiry is fixed in hub time and signed along with the message
+	var expiresAt int64
+	if opts.Expiry < 0 {
+		return nil, fmt.Errorf("message expiry must be positive")
+	}
+	if opts.Expiry > 0 {
+		if hubExpiry := info.Config.MessageExpiry; hubExpiry > 0 && opts.Expiry >= hubExpiry {
+			return nil, fmt.Errorf("message expiry must be shorter than the hub's (%s)", hubExpiry)
+		}
+		expiresAt = info.HubNow().Add(opts.Expiry).Unix()
+	}
+
+	// Use forward secrecy when the recipient's client has published a prekey, and
+	// compression when that prekey offers it
+	prekey := recipientUser.Prekey
+	compression := ""
+	if prekey != nil {
+		if err := prekey.Verify(recipientPublicKey); err != nil {
+			return nil, fmt.Errorf("recipient %s has an invalid prekey: %v", recipient, err)
+		}
+		compression = crypto.NegotiateCompression(prekey.Suites, c.Compression)
+	}
+
+	// Encryption replaces the attachment content, so work on a copy
+	var attachment *Attachment
+	if opts.Attachment != nil {
+		a := *opts.Attachment
+		if !a.Uploaded() {
+			a.Size = int64(len(a.Content))
+		}
+		if !a.Uploaded() {
+			if a.ContentType == "" {
+				a.ContentType = DetectContentType(a.Filename, a.Content)
+			}
+			if len(a.SHA256) == 0 {
+				sum := sha256.Sum256(a.Content)
+				a.SHA256 = sum[:]
+			}
+		}
+		if a.ContentType == "" {
+			a.ContentType = "application/octet-stream"
+		}
+		attachment = &a
+	}
+
+	// Derive the dedupe key before encryption replaces the attachment content
+	var dedupeKey string
+	if !opts.AllowDuplicate {
+		dedupeKey = crypto.DedupeKey(c.Key, recipientUser.ID, content, attachment)
+	}
+
+	// Split content that exceeds the hub's limit into linked parts
+	chunks := splitContent(string(content), info.Config.MaxMessageSize-crypto.GCMOverhead)
+	group := ""
+	if len(chunks) > 1 {
+		group = uuid.New().String()
+	}
+
+	result := &SendResult{RecipientID: recipientUser.ID, Escrowed: escrowKey != nil}
+	if expiresAt != 0 {
+		result.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	for i, chunk := range chunks {
+		var part *MessagePart
+		if group != "" {
+			part = &MessagePart{Group: group, Index: i, Total: len(chunks)}
+		}
+
+		// The attachment travels with the first part
+		partAttachment := attachment
+		if i > 0 {
+			partAttachment = nil
+		}
+
+		msg, err := crypto.EncryptMessageWith(rand.Reader, c.Key, recipientPublicKey, prekey, []byte(chunk), partAttachment, crypto.EncryptOptions{
+			Part:        part,
+			EscrowKey:   escrowKey,
+			InReplyTo:   opts.InReplyTo,
+			ExpiresAt:   expiresAt,
+			Compression: compression,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt message: %v", err)
+		}
+		if err := c.signMessage(msg); err != nil {
+			return nil, err
+		}
+
+		msg.ID = uuid.New().String()
+		msg.Sender = c.UserID
+		msg.Recipient = recipientUser.ID
+		msg.Timestamp = info.HubNow().Unix()
+		msg.Status = "sent"
+		msg.DedupeKey = dedupeKey
+		if dedupeKey != "" && part != nil {
+			msg.DedupeKey = fmt.Sprintf("%s:%d/%d", dedupeKey, i, len(chunks))
+		}
+
+		posted, err := c.postEnvelope(ctx, c.timeout(info), msg, opts.DryRun)
+		if err != nil {
+			if len(chunks) > 1 {
+				return nil, fmt.Errorf("part %d of %d: %w (re-running the same send resumes without duplicating delivered parts)", i+1, len(chunks), err)
+			}
+			return nil, err
+		}
+		if posted.quota != nil {
+			result.Quota = posted.quota
+		}
+		result.ReceiptsDisabled = result.ReceiptsDisabled || posted.ReceiptsDisabled
+		result.Relayed = result.Relayed || posted.Status == "relayed"
+		result.Request = result.Request || posted.Request
+		if posted.Status == "already_delivered" {
+			result.Duplicates++
+			result.IDs = append(result.IDs, posted.ID)
+			continue
+		}
+		result.IDs = append(result.IDs, msg.ID)
+	}
+	return result, nil
+}
+
+// signMessage re-signs a freshly encrypted message with the signing key, if the
+// client has one
+func (c *Client) signMessage(msg *Envelope) error {
+	if c.SigningKey == nil {
+		return nil
+	}
+	if err := crypto.SignMessageEd25519(c.SigningKey, msg); err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+	return nil
+}
+
+// SealMessage encrypts content for recipient into one envelope without contacting the
+// hub, for clients that queue messages while offline and submit them later with
+// PostEnvelope. The message is wrapped to the recipient's RSA key rather than a
+// prekey and is neither split nor escrowed. Its timestamp is left for the caller to
+// set to the hub's time when posting; the signature does not cover it.
+func (c *Client) SealMessage(recipient *User, content []byte, allowDuplicate bool) (*Envelope, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+	recipientPublicKey, err := crypto.LoadPublicKeyFromPEM([]byte(recipient.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recipient's public key: %v", err)
+	}
+	msg, err := crypto.EncryptMessage(c.Key, recipientPublicKey, nil, content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	if err := c.signMessage(msg); err != nil {
+		return nil, err
+	}
+	msg.ID = uuid.New().String()
+	msg.Sender = c.UserID
+	msg.Recipient = recipient.ID
+	msg.Status = "sent"
+	if !allowDuplicate {
+		msg.DedupeKey = crypto.DedupeKey(c.Key, recipient.ID, content, nil)
+	}
+	return msg, nil
+}
+
+// PostEnvelope submits an already encrypted message to the hub and returns the ID the
+// hub stored it under, which differs from msg.ID when the hub suppressed a duplicate
+func (c *Client) PostEnvelope(ctx context.Context, msg *Envelope) (string, error) {
+	posted, err := c.postEnvelope(ctx, c.Timeout, msg, false)
+	if err != nil {
+		return "", err
+	}
+	if posted.ID == "" {
+		return msg.ID, nil
+	}
+	return posted.ID, nil
+}
+
+// postEnvelope submits an encrypted message to the hub, signed by the sender, or only
+// has it checked when dryRun is set
+func (c *Client) postEnvelope(ctx context.Context, timeout time.Duration, msg *Envelope, dryRun bool) (*postResult, error) {
+	// Without a health check the hub is sent JSON, which every hub reads
+	info, _ := c.CachedHealth(ctx)
+	reqBody, contentType, err := c.encodeEnvelope(info, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	// The send is signed over the body, so no one else can send in the user's name
+	signer := info
+	if signer == nil {
+		signer = &HubInfo{}
+	}
+	sum := sha256.Sum256(reqBody)
+	params, err := c.signedParams(signer, "message", hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		params.Set("dry_run", "true")
+	}
+	resp, err := c.post(ctx, timeout, "/message?"+params.Encode(), contentType, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, _ := io.ReadAll(resp.Body)
+		retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return nil, &QuotaExceededError{RetryAfter: time.Duration(retry) * time.Second, Message: strings.TrimSpace(string(body))}
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		// The cached limits the message was split by are out of date
+		c.forgetHealth()
+		return nil, parseTooLarge(resp)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to send message: %s", string(body))
+	}
+
+	var result postResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	result.quota = parseQuotaStatus(resp.Header)
+	return &result, nil
+}
+
+// MessageQuery selects received messages
+type MessageQuery struct {
+	// UnreadOnly keeps only messages not yet marked read
+	UnreadOnly bool
+	// Limit caps the number of messages, keeping the newest (zero for all)
+	Limit int
+	// Search keeps only messages whose sender's display name matches, as for
+	// UserQuery.Search; the hub cannot search the encrypted content
+	Search string
+	// Since keeps only messages stored at or after this time (zero for all)
+	Since time.Time
+}
+
+// FetchEnvelopes retrieves received messages from the hub, newest first, without
+// decrypting them. The hub records them as delivered; they stay unread until
+// MarkRead reports them. The hub's clock at the start of the fetch is returned for
+// use as q.Since of the next incremental fetch.
+func (c *Client) FetchEnvelopes(ctx context.Context, q MessageQuery) ([]Envelope, time.Time, error) {
+	if c.UserID == "" {
+		return nil, time.Time{}, fmt.Errorf("client has no user ID")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+	syncedAt := info.HubNow()
+
+	// Only the recipient may fetch, since fetching records the messages as delivered
+	params, err := c.signedParams(info, "messages")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if q.UnreadOnly {
+		params.Set("unread", "true")
+	}
+	if q.Search != "" {
+		params.Set("search", q.Search)
+	}
+	if !q.Since.IsZero() {
+		params.Set("since", fmt.Sprintf("%d", q.Since.Unix()))
+	}
+
+	envelopes, err := fetchPagedAs(ctx, c, c.timeout(info), "/messages", params, q.Limit, c.acceptEnvelopes(), decodeEnvelopes)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to get messages: %v", err)
+	}
+	// The hub deletes messages at their sender's expiry, but only on its next cleanup
+	live := envelopes[:0]
+	for _, env := range envelopes {
+		if !env.Expired(syncedAt) {
+			live = append(live, env)
+		}
+	}
+	return live, syncedAt, nil
+}
+
+// FetchMessages retrieves and decrypts received messages, newest first. Messages that
+// fail to decrypt are skipped and reported together in the returned error, alongside
+// the messages that did decrypt.
+func (c *Client) FetchMessages(ctx context.Context, q MessageQuery) ([]Message, error) {
+	if c.Key == nil {
+		return nil, fmt.Errorf("client has no key")
+	}
+	envelopes, _, err := c.FetchEnvelopes(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	var failed []string
+	for i := range envelopes {
+		msg, err := c.Decrypt(&envelopes[i])
+		if err != nil {
+			failed = append(failed, envelopes[i].ID)
+			continue
+		}
+		messages = append(messages, *msg)
+	}
+	if len(failed) > 0 {
+		return messages, fmt.Errorf("failed to decrypt messages: %s", strings.Join(failed, ", "))
+	}
+	return messages, nil
+}
+
+// Decrypt decrypts a received envelope with the client's key and prekeys
+func (c *Client) Decrypt(env *Envelope) (*Message, error) {
+	if c.Key == nil {
+		return nil, fmt.Errorf("client has no key")
+	}
+	content, err := crypto.DecryptMessage(&crypto.Keyring{Identity: c.Key, Prekeys: c.Prekeys}, env)
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt time.Time
+	if env.ExpiresAt != 0 {
+		expiresAt = time.Unix(env.ExpiresAt, 0)
+	}
+	return &Message{
+		ID:         env.ID,
+		Sender:     env.Sender,
+		Recipient:  env.Recipient,
+		Time:       time.Unix(env.Timestamp, 0),
+		Status:     env.Status,
+		Content:    content,
+		Attachment: env.Attachment,
+		Part:       env.Part,
+		Escrowed:   len(env.EscrowedKey) > 0,
+		InReplyTo:  env.InReplyTo,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// DeliveryNoReceipts is the State of a message whose recipient does not let the
+// sender see when it is delivered and read
+const DeliveryNoReceipts = "receipts_disabled"
+
+// DeliveryRequest is the State of a message held as a message request, which the
+// recipient cannot fetch until they accept the sender
+const DeliveryRequest = "request"
+
+// DeliveryStatus is the delivery state of a sent message
+type DeliveryStatus struct {
+	ID            string     `json:"id"`
+	RecipientID   string     `json:"recipient_id"`
+	RecipientName string     `json:"recipient_name"`
+	State         string     `json:"state"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	ReadAt        *time.Time `json:"read_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	// QuietHours is set when the message arrived during the recipient's quiet hours,
+	// so the hub did not notify them
+	QuietHours bool `json:"quiet_hours"`
+	// InReplyTo is the ID of the message this one answers, if any
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	// Replies counts the replies to this message still stored on the hub
+	Replies int `json:"replies,omitempty"`
+}
+
+// ErrMessageNotFound is returned by MessageStatus for unknown, expired or foreign messages
+var ErrMessageNotFound = fmt.Errorf("message not found")
+
+// MessageStatus returns the delivery status of a message the client sent. Only the
+// sender may see it, proven by signing the query.
+func (c *Client) MessageStatus(ctx context.Context, messageID string) (*DeliveryStatus, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	params, err := c.signedParams(info, "message-status", messageID)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("id", messageID)
+
+	resp, err := c.get(ctx, c.timeout(info), "/message/status", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrMessageNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var status DeliveryStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode message status: %v", err)
+	}
+	return &status, nil
+}
+
+// ErrTooLateToUnsend is returned by Unsend when the recipient already fetched the
+// message and the hub's unsend window has passed
+var ErrTooLateToUnsend = errors.New("message already fetched and past the hub's unsend window")
+
+// UnsendResult reports a message deleted from the hub by its sender
+type UnsendResult struct {
+	ID string `json:"id"`
+	// Delivered is set when the recipient had already fetched the message, so a copy
+	// may remain on their devices
+	Delivered bool `json:"delivered"`
+}
+
+// Unsend deletes a message the client sent from the hub. Messages the recipient has
+// not fetched can be deleted until they expire, fetched ones only within the hub's
+// unsend window. It returns ErrMessageNotFound for unknown, expired or foreign
+// messages and ErrTooLateToUnsend once the window has passed.
+func (c *Client) Unsend(ctx context.Context, messageID string) (*UnsendResult, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	params, err := c.signedParams(info, "message-unsend", messageID)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := c.endpoint(ctx, "/message/"+url.PathEscape(messageID))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient(ctx, c.timeout(info)).Do(req)
+	if err != nil {
+		c.forgetHealth()
+		return nil, fmt.Errorf("failed to unsend message: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrMessageNotFound
+	case http.StatusConflict:
+		return nil, ErrTooLateToUnsend
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result UnsendResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode unsend result: %v", err)
+	}
+	return &result, nil
+}
+
+// maxReadBatch is the largest number of IDs the hub accepts in one /message/read request
+const maxReadBatch = 1000
+
+// MarkRead tells the hub that the client's user read the given received messages,
+// which their senders then see as read in MessageStatus. Fetching never does this.
+// It returns how many were newly marked; unknown, expired and already read messages
+// are skipped.
+func (c *Client) MarkRead(ctx context.Context, messageIDs []string) (int, error) {
+	if c.Key == nil || c.UserID == "" {
+		return 0, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	marked := 0
+	for len(messageIDs) > 0 {
+		batch := messageIDs
+		if len(batch) > maxReadBatch {
+			batch = batch[:maxReadBatch]
+		}
+		messageIDs = messageIDs[len(batch):]
+
+		n, err := c.markRead(ctx, info, batch)
+		marked += n
+		if err != nil {
+			return marked, err
+		}
+	}
+	return marked, nil
+}
+
+// markRead sends one /message/read request, signed over the SHA-256 of the body
+func (c *Client) markRead(ctx context.Context, info *HubInfo, messageIDs []string) (int, error) {
+	body, err := json.Marshal(struct {
+		IDs []string `json:"ids"`
+	}{messageIDs})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal message IDs: %v", err)
+	}
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "message-read", hex.EncodeToString(sum[:]))
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.post(ctx, c.timeout(info), "/message/read?"+params.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark messages read: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var result struct {
+		Marked int `json:"marked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode read result: %v", err)
+	}
+	return result.Marked, nil
+}
+
+// splitContent breaks s into pieces of at most limit bytes, cutting on rune boundaries
+// and preferring a line break in the second half of each piece. A non-positive limit
+// or content that already fits returns s unchanged.
+func splitContent(s string, limit int) []string {
+	if limit <= 0 || len(s) <= limit {
+		return []string{s}
+	}
+	if limit < utf8.UTFMax {
+		limit = utf8.UTFMax
+	}
+
+	var chunks []string
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if nl := strings.LastIndexByte(s[:cut], '\n'); nl >= cut/2 {
+			cut = nl + 1
+		}
+		chunks = append(chunks, s[:cut])
+		s = s[cut:]
+	}
+	if s != "" {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
@@ -0,0 +1,87 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// QuietHours is a daily window, in the user's time zone, during which the hub stores
+// messages without notifying the user
+type QuietHours struct {
+	// Start and End are times of day as HH:MM; a window that ends before it starts
+	// runs past midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA zone name such as "Europe/Berlin"; empty means UTC
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// NotificationSettings are how the hub tells a user about new messages
+type NotificationSettings struct {
+	// WebhookURL receives a POST for each message stored for the user (empty for
+	// none); only hubs that advertise UserWebhooks accept one
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// QuietHours, if set, suppresses notifications during a daily window
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// Notifications returns the client's notification settings on the hub
+func (c *Client) Notifications(ctx context.Context) (*NotificationSettings, error) {
+	return c.notifications(ctx, http.MethodGet, nil)
+}
+
+// SetNotifications replaces the client's notification settings on the hub
+func (c *Client) SetNotifications(ctx context.Context, settings NotificationSettings) (*NotificationSettings, error) {
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification settings: %v", err)
+	}
+	return c.notifications(ctx, http.MethodPost, body)
+}
+
+// notifications sends a request to /notifications signed over the method and body
+func (c *Client) notifications(ctx context.Context, method string, body []byte) (*NotificationSettings, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "notifications", method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	if method == http.MethodPost {
+		resp, err = c.post(ctx, c.timeout(info), "/notifications?"+params.Encode(), "application/json", bytes.NewReader(body))
+	} else {
+		resp, err = c.get(ctx, c.timeout(info), "/notifications", params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var settings NotificationSettings
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return nil, fmt.Errorf("failed to decode notification settings: %v", err)
+	}
+	return &settings, nil
+}
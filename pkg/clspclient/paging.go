@@ -0,0 +1,73 @@
+package clspclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pageSize is the number of items requested per page from paginated hub listings
+const pageSize = 200
+
+// nextCursorHeader carries the cursor for the next page of a hub listing
+const nextCursorHeader = "X-Next-Cursor"
+
+// fetchPaged retrieves a hub listing page by page until it is exhausted or max items
+// (zero for no cap) have been collected. Hubs that predate pagination return
+// everything in the first response, which ends the loop.
+func fetchPaged[T any](ctx context.Context, c *Client, timeout time.Duration, path string, params url.Values, max int) ([]T, error) {
+	return fetchPagedAs(ctx, c, timeout, path, params, max, "", decodeJSONPage[T])
+}
+
+// decodeJSONPage reads a page of a hub listing encoded as a JSON array
+func decodeJSONPage[T any](resp *http.Response) ([]T, error) {
+	var page []T
+	err := json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+// fetchPagedAs retrieves a hub listing like fetchPaged, asking for its pages in the
+// media types accept lists and reading each with decode
+func fetchPagedAs[T any](ctx context.Context, c *Client, timeout time.Duration, path string, params url.Values, max int, accept string, decode func(*http.Response) ([]T, error)) ([]T, error) {
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+
+	var items []T
+	for {
+		size := pageSize
+		if max > 0 && max-len(items) < size {
+			size = max - len(items)
+		}
+		q.Set("limit", fmt.Sprintf("%d", size))
+
+		resp, err := c.getAccepting(ctx, timeout, path, q, accept)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		page, err := decode(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %v", err)
+		}
+		items = append(items, page...)
+
+		cursor := resp.Header.Get(nextCursorHeader)
+		if cursor == "" || len(page) == 0 || (max > 0 && len(items) >= max) {
+			return items, nil
+		}
+		q.Set("cursor", cursor)
+	}
+}
@@ -0,0 +1,119 @@
+package clspclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Hubs serve their API under /v<n> for each protocol version n they speak. The
+// client lists the versions it speaks at /health, the hub picks one, and every later
+// request goes under that version's prefix; hubs that predate versioning answer
+// without choosing and are spoken to at the bare paths.
+
+// ProtocolVersions are the versions of the hub API this package speaks, oldest first
+var ProtocolVersions = []int{1}
+
+// protocolHeader carries the versions offered at /health and the one chosen
+const protocolHeader = "X-CLSP-Protocol"
+
+// IncompatibleHubError is returned when the hub and this package share no protocol
+// version, so one of them has to be upgraded
+type IncompatibleHubError struct {
+	// HubVersions are the versions the hub speaks and ClientVersions those this
+	// package speaks
+	HubVersions    []int
+	ClientVersions []int
+}
+
+func (e *IncompatibleHubError) Error() string {
+	hubNewest := newestVersion(e.HubVersions)
+	clientNewest := newestVersion(e.ClientVersions)
+	if hubNewest > clientNewest {
+		return fmt.Sprintf("the hub requires protocol version %d and this client only speaks up to version %d; upgrade the client", hubNewest, clientNewest)
+	}
+	return fmt.Sprintf("the hub only speaks protocol up to version %d and this client needs version %d or later; the hub operator has to upgrade the hub", hubNewest, e.ClientVersions[0])
+}
+
+// offerProtocols lists the versions this package speaks on a /health request
+func offerProtocols(req *http.Request) {
+	versions := make([]string, len(ProtocolVersions))
+	for i, v := range ProtocolVersions {
+		versions[i] = strconv.Itoa(v)
+	}
+	req.Header.Set(protocolHeader, strings.Join(versions, ", "))
+}
+
+// negotiatedProtocol reads the version the hub chose from a /health response: zero
+// for hubs that predate versioning, or an IncompatibleHubError when it chose none
+// this package speaks
+func negotiatedProtocol(resp *http.Response) (int, error) {
+	header := resp.Header.Get(protocolHeader)
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return 0, &IncompatibleHubError{HubVersions: parseVersions(header), ClientVersions: ProtocolVersions}
+	}
+	if header == "" {
+		return 0, nil
+	}
+	chosen, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil {
+		return 0, fmt.Errorf("hub chose an invalid protocol version %q", header)
+	}
+	for _, v := range ProtocolVersions {
+		if v == chosen {
+			return chosen, nil
+		}
+	}
+	return 0, &IncompatibleHubError{HubVersions: []int{chosen}, ClientVersions: ProtocolVersions}
+}
+
+// parseVersions reads a comma-separated list of versions, skipping invalid ones
+func parseVersions(header string) []int {
+	var versions []int
+	for _, field := range strings.Split(header, ",") {
+		if v, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// newestVersion returns the highest of versions, or zero for none
+func newestVersion(versions []int) int {
+	newest := 0
+	for _, v := range versions {
+		if v > newest {
+			newest = v
+		}
+	}
+	return newest
+}
+
+// endpoint returns the URL of path on the hub, under the prefix of the protocol
+// version negotiated with it. The version is the one this client last negotiated,
+// or else the cached health check's; with neither, the hub is asked first.
+func (c *Client) endpoint(ctx context.Context, path string) (string, error) {
+	c.protocolMu.Lock()
+	version, known := c.protocol, c.negotiated
+	c.protocolMu.Unlock()
+	if !known {
+		info, err := c.CachedHealth(ctx)
+		if err != nil {
+			return "", err
+		}
+		version = info.Protocol
+	}
+	if version == 0 {
+		return c.HubURL + path, nil
+	}
+	return c.HubURL + "/v" + strconv.Itoa(version) + path, nil
+}
+
+// setProtocol records the version negotiated by a health check
+func (c *Client) setProtocol(version int) {
+	c.protocolMu.Lock()
+	c.protocol, c.negotiated = version, true
+	c.protocolMu.Unlock()
+}
@@ -0,0 +1,84 @@
+package clspclient
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers in which the hub reports the sender's remaining outbound quota
+const (
+	quotaHourlyMessagesHeader = "X-Quota-Hourly-Messages-Remaining"
+	quotaDailyMessagesHeader  = "X-Quota-Daily-Messages-Remaining"
+	quotaHourlyBytesHeader    = "X-Quota-Hourly-Bytes-Remaining"
+	quotaDailyBytesHeader     = "X-Quota-Daily-Bytes-Remaining"
+	quotaBurstHeader          = "X-Quota-Burst-Remaining"
+	quotaHourlyResetHeader    = "X-Quota-Hourly-Reset"
+	quotaDailyResetHeader     = "X-Quota-Daily-Reset"
+)
+
+// QuotaStatus is what remains of the sender's outbound quota after a send, as reported
+// by the hub. Limits the hub does not apply to the sender are -1, so bots can slow
+// down before the hub refuses their messages.
+type QuotaStatus struct {
+	HourlyMessages int64
+	DailyMessages  int64
+	HourlyBytes    int64
+	DailyBytes     int64
+	// Burst is the number of messages that can still be sent at once
+	Burst int64
+	// HourlyReset and DailyReset are the time until the hourly and daily limits start
+	// over (zero when no such limit applies)
+	HourlyReset time.Duration
+	DailyReset  time.Duration
+}
+
+// Limited reports whether any outbound limit applies to the sender
+func (q *QuotaStatus) Limited() bool {
+	return q.HourlyMessages >= 0 || q.DailyMessages >= 0 || q.HourlyBytes >= 0 || q.DailyBytes >= 0 || q.Burst >= 0
+}
+
+// parseQuotaStatus reads the quota headers of a /message response, returning nil for
+// hubs that send none
+func parseQuotaStatus(h http.Header) *QuotaStatus {
+	q := &QuotaStatus{}
+	found := false
+	for header, field := range map[string]*int64{
+		quotaHourlyMessagesHeader: &q.HourlyMessages,
+		quotaDailyMessagesHeader:  &q.DailyMessages,
+		quotaHourlyBytesHeader:    &q.HourlyBytes,
+		quotaDailyBytesHeader:     &q.DailyBytes,
+		quotaBurstHeader:          &q.Burst,
+	} {
+		*field = -1
+		if n, err := strconv.ParseInt(h.Get(header), 10, 64); err == nil {
+			*field, found = n, true
+		}
+	}
+	for header, field := range map[string]*time.Duration{
+		quotaHourlyResetHeader: &q.HourlyReset,
+		quotaDailyResetHeader:  &q.DailyReset,
+	} {
+		if n, err := strconv.ParseInt(h.Get(header), 10, 64); err == nil {
+			*field = time.Duration(n) * time.Second
+		}
+	}
+	if !found {
+		return nil
+	}
+	return q
+}
+
+// QuotaExceededError is returned when the hub refuses a message because the sender
+// used up their outbound quota
+type QuotaExceededError struct {
+	// RetryAfter is how long until the hub accepts another message
+	RetryAfter time.Duration
+	// Message is the hub's explanation
+	Message string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("hub refused the message: %s", e.Message)
+}
@@ -0,0 +1,81 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Receipt policies, which decide the senders who see when the user fetched and read
+// their messages
+const (
+	ReceiptsEveryone = "everyone"
+	ReceiptsContacts = "contacts" // only users the user has sent a message to
+	ReceiptsNone     = "none"
+)
+
+// receiptSettings is the body of /receipts
+type receiptSettings struct {
+	Receipts string `json:"receipts"`
+}
+
+// Receipts returns the client's receipt policy on the hub
+func (c *Client) Receipts(ctx context.Context) (string, error) {
+	return c.receipts(ctx, http.MethodGet, nil)
+}
+
+// SetReceipts sets the client's receipt policy on the hub, which applies to messages
+// already stored as well
+func (c *Client) SetReceipts(ctx context.Context, policy string) (string, error) {
+	body, err := json.Marshal(receiptSettings{Receipts: policy})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal receipt settings: %v", err)
+	}
+	return c.receipts(ctx, http.MethodPost, body)
+}
+
+// receipts sends a request to /receipts signed over the method and body
+func (c *Client) receipts(ctx context.Context, method string, body []byte) (string, error) {
+	if c.Key == nil || c.UserID == "" {
+		return "", fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "receipts", method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+
+	var resp *http.Response
+	if method == http.MethodPost {
+		resp, err = c.post(ctx, c.timeout(info), "/receipts?"+params.Encode(), "application/json", bytes.NewReader(body))
+	} else {
+		resp, err = c.get(ctx, c.timeout(info), "/receipts", params)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var settings receiptSettings
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return "", fmt.Errorf("failed to decode receipt settings: %v", err)
+	}
+	return settings.Receipts, nil
+}
@@ -0,0 +1,108 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrNoRecoveryKit is returned by FetchRecovery when the hub holds no kit for a
+// recovery ID
+var ErrNoRecoveryKit = errors.New("hub has no recovery kit for this phrase")
+
+// RecoveryKit is an identity encrypted with a key derived from a recovery phrase, and
+// stored on the hub under an ID derived from the same phrase
+type RecoveryKit struct {
+	RecoveryID string `json:"recovery_id"`
+	Kit        []byte `json:"kit"`
+	// UserID is the identity the kit belongs to, set by FetchRecovery
+	UserID string `json:"user_id,omitempty"`
+}
+
+// SetRecovery stores the client's recovery kit on the hub, replacing any earlier one
+func (c *Client) SetRecovery(ctx context.Context, recoveryID string, kit []byte) error {
+	body, err := json.Marshal(RecoveryKit{RecoveryID: recoveryID, Kit: kit})
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovery kit: %v", err)
+	}
+	return c.recovery(ctx, http.MethodPost, body)
+}
+
+// DeleteRecovery removes the client's recovery kit from the hub
+func (c *Client) DeleteRecovery(ctx context.Context) error {
+	return c.recovery(ctx, http.MethodDelete, nil)
+}
+
+// recovery sends a request to /recovery signed over the method and body
+func (c *Client) recovery(ctx context.Context, method string, body []byte) error {
+	if c.Key == nil || c.UserID == "" {
+		return fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "recovery", method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := c.endpoint(ctx, "/recovery")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+"?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient(ctx, c.timeout(info)).Do(req)
+	if err != nil {
+		c.forgetHealth()
+		return fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// FetchRecovery returns the recovery kit stored under recoveryID. It needs no
+// identity, since it is how a lost identity is recovered.
+func (c *Client) FetchRecovery(ctx context.Context, recoveryID string) (*RecoveryKit, error) {
+	params := url.Values{}
+	params.Set("id", recoveryID)
+	resp, err := c.get(ctx, c.Timeout, "/recovery", params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoRecoveryKit
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var kit RecoveryKit
+	if err := json.NewDecoder(resp.Body).Decode(&kit); err != nil {
+		return nil, fmt.Errorf("failed to decode recovery kit: %v", err)
+	}
+	return &kit, nil
+}
@@ -0,0 +1,117 @@
+package clspclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MessageRequest summarizes the messages a first-time sender sent while the user
+// holds such messages as requests. The hub keeps them out of FetchEnvelopes until
+// the user accepts the sender.
+type MessageRequest struct {
+	SenderID string `json:"sender_id"`
+	// SenderName and PublicKey are the sender's directory entry, empty for users of
+	// other hubs
+	SenderName string    `json:"sender_name,omitempty"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	Messages   int       `json:"messages"`
+	FirstAt    time.Time `json:"first_at"`
+	LastAt     time.Time `json:"last_at"`
+}
+
+// MessageRequests are the user's message request setting and pending requests
+type MessageRequests struct {
+	// Enabled is set when messages from first-time senders are held as requests
+	Enabled  bool             `json:"enabled"`
+	Requests []MessageRequest `json:"requests"`
+}
+
+// requestsAction is the body of POST /requests
+type requestsAction struct {
+	Action   string `json:"action"`
+	SenderID string `json:"sender_id,omitempty"`
+}
+
+// MessageRequests returns the client's pending message requests, oldest first
+func (c *Client) MessageRequests(ctx context.Context) (*MessageRequests, error) {
+	return c.requests(ctx, http.MethodGet, nil)
+}
+
+// AcceptRequest moves the messages senderID sent as requests into the client's inbox,
+// where the next fetch returns them, and lets the sender's later messages through
+func (c *Client) AcceptRequest(ctx context.Context, senderID string) (*MessageRequests, error) {
+	return c.postRequestsAction(ctx, requestsAction{Action: "accept", SenderID: senderID})
+}
+
+// DeclineRequest deletes the messages senderID sent as requests. The sender's next
+// message arrives as a new request.
+func (c *Client) DeclineRequest(ctx context.Context, senderID string) (*MessageRequests, error) {
+	return c.postRequestsAction(ctx, requestsAction{Action: "decline", SenderID: senderID})
+}
+
+// SetMessageRequests turns holding messages from first-time senders as requests on or
+// off. Turning it off leaves pending requests to be accepted or declined.
+func (c *Client) SetMessageRequests(ctx context.Context, enabled bool) (*MessageRequests, error) {
+	action := requestsAction{Action: "off"}
+	if enabled {
+		action.Action = "on"
+	}
+	return c.postRequestsAction(ctx, action)
+}
+
+// postRequestsAction posts an action to /requests
+func (c *Client) postRequestsAction(ctx context.Context, action requestsAction) (*MessageRequests, error) {
+	body, err := json.Marshal(action)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request action: %v", err)
+	}
+	return c.requests(ctx, http.MethodPost, body)
+}
+
+// requests sends a request to /requests signed over the method and body
+func (c *Client) requests(ctx context.Context, method string, body []byte) (*MessageRequests, error) {
+	if c.Key == nil || c.UserID == "" {
+		return nil, fmt.Errorf("client has no identity")
+	}
+
+	info, err := c.CachedHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hub configuration: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	params, err := c.signedParams(info, "requests", method, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	if method == http.MethodPost {
+		resp, err = c.post(ctx, c.timeout(info), "/requests?"+params.Encode(), "application/json", bytes.NewReader(body))
+	} else {
+		resp, err = c.get(ctx, c.timeout(info), "/requests", params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach hub: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("hub returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var requests MessageRequests
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return nil, fmt.Errorf("failed to decode message requests: %v", err)
+	}
+	return &requests, nil
+}
@@ -0,0 +1,135 @@
+package clspclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SchemaVersion is the hub API schema version this package was written against
+const SchemaVersion = 1
+
+// ErrNoSchema is returned by Schema for hubs that predate the /schema endpoint
+var ErrNoSchema = errors.New("hub does not publish a schema")
+
+// Schema is the hub's machine-readable API description
+type Schema struct {
+	Version int `json:"version"`
+	// BasePath prefixes every endpoint path (empty for hubs that predate it)
+	BasePath        string            `json:"base_path"`
+	MessageVersions []int             `json:"message_versions"`
+	Limits          SchemaLimits      `json:"limits"`
+	Auth            map[string]string `json:"auth"`
+	Endpoints       []Endpoint        `json:"endpoints"`
+	// Types maps each named JSON shape to its fields and their types
+	Types map[string]map[string]string `json:"types"`
+}
+
+// SchemaLimits are the hub's current limits (zero means unlimited)
+type SchemaLimits struct {
+	MaxMessageSize     int   `json:"max_message_size"`
+	RateLimit          int   `json:"rate_limit"`
+	MaxStorageBytes    int64 `json:"max_storage_bytes"`
+	MaxUsers           int   `json:"max_users"`
+	MaxAttachmentSize  int64 `json:"max_attachment_size"`
+	MessageExpiry      int64 `json:"message_expiry_seconds"`
+	ClockSkewTolerance int64 `json:"clock_skew_tolerance_seconds"`
+}
+
+// Endpoint describes one method of one hub endpoint
+type Endpoint struct {
+	Method      string  `json:"method"`
+	Path        string  `json:"path"`
+	Description string  `json:"description"`
+	Auth        string  `json:"auth"`
+	Query       []Param `json:"query,omitempty"`
+	Request     string  `json:"request,omitempty"`
+	Response    string  `json:"response,omitempty"`
+	// RequestMedia and ResponseMedia are the content types of bodies that are not
+	// JSON
+	RequestMedia  string `json:"request_media,omitempty"`
+	ResponseMedia string `json:"response_media,omitempty"`
+	Status        int    `json:"status"`
+	Paginated     bool   `json:"paginated,omitempty"`
+	// Protobuf endpoints also take or serve envelopes as protobuf
+	Protobuf bool `json:"protobuf,omitempty"`
+}
+
+// Param describes a query parameter
+type Param struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Endpoint returns the description of method on path, or nil if the hub lacks it
+func (s *Schema) Endpoint(method, path string) *Endpoint {
+	for i := range s.Endpoints {
+		if s.Endpoints[i].Path == path && strings.EqualFold(s.Endpoints[i].Method, method) {
+			return &s.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// Schema fetches the hub's API description
+func (c *Client) Schema(ctx context.Context) (*Schema, error) {
+	resp, err := c.get(ctx, c.Timeout, "/schema", nil)
+	if err != nil {
+		return nil, fmt.Errorf("hub not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoSchema
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hub returned status %d", resp.StatusCode)
+	}
+
+	var schema Schema
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %v", err)
+	}
+	return &schema, nil
+}
+
+// requiredEndpoints are the endpoints this package cannot work without
+var requiredEndpoints = [][2]string{
+	{"GET", "/health"},
+	{"POST", "/register"},
+	{"GET", "/users"},
+	{"POST", "/message"},
+	{"GET", "/messages"},
+}
+
+// CheckCompatibility verifies that the hub speaks the API version this package
+// expects and serves the endpoints it relies on. Hubs without a schema are assumed
+// compatible, since they predate any incompatible change.
+func (c *Client) CheckCompatibility(ctx context.Context) error {
+	schema, err := c.Schema(ctx)
+	if errors.Is(err, ErrNoSchema) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if schema.Version != SchemaVersion {
+		return fmt.Errorf("hub API schema version %d is not supported (expected %d)", schema.Version, SchemaVersion)
+	}
+	var missing []string
+	for _, e := range requiredEndpoints {
+		if schema.Endpoint(e[0], e[1]) == nil {
+			missing = append(missing, e[0]+" "+e[1])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("hub lacks required endpoints: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
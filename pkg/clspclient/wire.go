@@ -0,0 +1,68 @@
+package clspclient
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/mattd/clsp/internal/crypto"
+	"github.com/mattd/clsp/pkg/clsppb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Envelopes travel as JSON, or as protobuf with hubs that list it among their
+// envelope formats. Protobuf carries the ciphertext as it is instead of in base64.
+
+// encodeEnvelope returns msg encoded for the hub described by info, and the content
+// type to send it with
+func (c *Client) encodeEnvelope(info *HubInfo, msg *Envelope) ([]byte, string, error) {
+	if c.protobufEnvelopes(info) {
+		data, err := crypto.EncodeMessageProto(msg)
+		return data, crypto.ContentTypeProtobuf, err
+	}
+	data, err := crypto.EncodeMessage(msg)
+	return data, "application/json", err
+}
+
+// protobufEnvelopes reports whether envelopes are sent to the hub as protobuf
+func (c *Client) protobufEnvelopes(info *HubInfo) bool {
+	if c.JSONEnvelopes || info == nil {
+		return false
+	}
+	for _, format := range info.EnvelopeFormats {
+		if format == crypto.ContentTypeProtobuf {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEnvelopes returns the Accept header of envelope listings. Hubs that serve
+// only JSON ignore it, and decodeEnvelopes reads whichever format they answer in.
+func (c *Client) acceptEnvelopes() string {
+	if c.JSONEnvelopes {
+		return ""
+	}
+	return crypto.ContentTypeProtobuf + ", application/json;q=0.9"
+}
+
+// decodeEnvelopes reads a page of envelopes in the format named by its Content-Type
+func decodeEnvelopes(resp *http.Response) ([]Envelope, error) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != crypto.ContentTypeProtobuf {
+		return decodeJSONPage[Envelope](resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var list clsppb.FetchMessagesResponse
+	if err := proto.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	page := make([]Envelope, len(list.Messages))
+	for i, m := range list.Messages {
+		page[i] = *crypto.MessageFromProto(m)
+	}
+	return page, nil
+}
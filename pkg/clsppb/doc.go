@@ -0,0 +1,10 @@
+// Package clsppb holds the protobuf messages and gRPC stubs of the hub's gRPC
+// interface, which hubs serve alongside HTTP when started with --grpc-port. The
+// definitions in hub.proto are the contract; clients in other languages generate
+// their stubs from it.
+//
+// hub.pb.go and hub_grpc.pb.go are regenerated with 'go generate' (which needs
+// protoc, protoc-gen-go and protoc-gen-go-grpc) whenever hub.proto changes.
+package clsppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative hub.proto
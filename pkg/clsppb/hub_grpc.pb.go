@@ -0,0 +1,289 @@
+// The hub's gRPC interface: the core of the HTTP API, for clients that prefer a
+// binary transport or generated stubs, and a bidirectional stream for watch mode.
+// Every call is served by the same handler as its HTTP endpoint, so the two agree
+// on validation, quotas and errors; the HTTP statuses map to the usual codes.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: hub.proto
+
+package clsppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Hub_Health_FullMethodName        = "/clsp.v1.Hub/Health"
+	Hub_ListUsers_FullMethodName     = "/clsp.v1.Hub/ListUsers"
+	Hub_SendMessage_FullMethodName   = "/clsp.v1.Hub/SendMessage"
+	Hub_FetchMessages_FullMethodName = "/clsp.v1.Hub/FetchMessages"
+	Hub_Watch_FullMethodName         = "/clsp.v1.Hub/Watch"
+)
+
+// HubClient is the client API for Hub service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type HubClient interface {
+	// Health reports the hub's status and configuration, as GET /health does
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error)
+	// ListUsers lists active users, as GET /users does
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
+	// SendMessage stores an encrypted message for its recipient, as POST /message does
+	SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendResult, error)
+	// FetchMessages returns a user's messages, newest first, as GET /messages does
+	FetchMessages(ctx context.Context, in *FetchMessagesRequest, opts ...grpc.CallOption) (*FetchMessagesResponse, error)
+	// Watch delivers a user's messages live. The first request subscribes; the hub
+	// answers with the unread messages, then with each new one as it is stored, and
+	// with a ReadResult for every MarkRead sent on the stream. A MarkRead that fails
+	// ends the stream with its error.
+	Watch(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WatchRequest, WatchEvent], error)
+}
+
+type hubClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHubClient(cc grpc.ClientConnInterface) HubClient {
+	return &hubClient{cc}
+}
+
+func (c *hubClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HealthResponse)
+	err := c.cc.Invoke(ctx, Hub_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListUsersResponse)
+	err := c.cc.Invoke(ctx, Hub_ListUsers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResult)
+	err := c.cc.Invoke(ctx, Hub_SendMessage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) FetchMessages(ctx context.Context, in *FetchMessagesRequest, opts ...grpc.CallOption) (*FetchMessagesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FetchMessagesResponse)
+	err := c.cc.Invoke(ctx, Hub_FetchMessages_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hubClient) Watch(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[WatchRequest, WatchEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Hub_ServiceDesc.Streams[0], Hub_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchEvent]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Hub_WatchClient = grpc.BidiStreamingClient[WatchRequest, WatchEvent]
+
+// HubServer is the server API for Hub service.
+// All implementations must embed UnimplementedHubServer
+// for forward compatibility.
+type HubServer interface {
+	// Health reports the hub's status and configuration, as GET /health does
+	Health(context.Context, *HealthRequest) (*HealthResponse, error)
+	// ListUsers lists active users, as GET /users does
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	// SendMessage stores an encrypted message for its recipient, as POST /message does
+	SendMessage(context.Context, *SendMessageRequest) (*SendResult, error)
+	// FetchMessages returns a user's messages, newest first, as GET /messages does
+	FetchMessages(context.Context, *FetchMessagesRequest) (*FetchMessagesResponse, error)
+	// Watch delivers a user's messages live. The first request subscribes; the hub
+	// answers with the unread messages, then with each new one as it is stored, and
+	// with a ReadResult for every MarkRead sent on the stream. A MarkRead that fails
+	// ends the stream with its error.
+	Watch(grpc.BidiStreamingServer[WatchRequest, WatchEvent]) error
+	mustEmbedUnimplementedHubServer()
+}
+
+// UnimplementedHubServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedHubServer struct{}
+
+func (UnimplementedHubServer) Health(context.Context, *HealthRequest) (*HealthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedHubServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedHubServer) SendMessage(context.Context, *SendMessageRequest) (*SendResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMessage not implemented")
+}
+func (UnimplementedHubServer) FetchMessages(context.Context, *FetchMessagesRequest) (*FetchMessagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FetchMessages not implemented")
+}
+func (UnimplementedHubServer) Watch(grpc.BidiStreamingServer[WatchRequest, WatchEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedHubServer) mustEmbedUnimplementedHubServer() {}
+func (UnimplementedHubServer) testEmbeddedByValue()             {}
+
+// UnsafeHubServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HubServer will
+// result in compilation errors.
+type UnsafeHubServer interface {
+	mustEmbedUnimplementedHubServer()
+}
+
+func RegisterHubServer(s grpc.ServiceRegistrar, srv HubServer) {
+	// If the following call pancis, it indicates UnimplementedHubServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Hub_ServiceDesc, srv)
+}
+
+func _Hub_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_ListUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_SendMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).SendMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_SendMessage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).SendMessage(ctx, req.(*SendMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_FetchMessages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchMessagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HubServer).FetchMessages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Hub_FetchMessages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HubServer).FetchMessages(ctx, req.(*FetchMessagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Hub_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(HubServer).Watch(&grpc.GenericServerStream[WatchRequest, WatchEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Hub_WatchServer = grpc.BidiStreamingServer[WatchRequest, WatchEvent]
+
+// Hub_ServiceDesc is the grpc.ServiceDesc for Hub service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Hub_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "clsp.v1.Hub",
+	HandlerType: (*HubServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Health",
+			Handler:    _Hub_Health_Handler,
+		},
+		{
+			MethodName: "ListUsers",
+			Handler:    _Hub_ListUsers_Handler,
+		},
+		{
+			MethodName: "SendMessage",
+			Handler:    _Hub_SendMessage_Handler,
+		},
+		{
+			MethodName: "FetchMessages",
+			Handler:    _Hub_FetchMessages_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Hub_Watch_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "hub.proto",
+}
@@ -0,0 +1,465 @@
+// Package conformance publishes fixed test vectors for the clsp protocol: keys,
+// prekeys, message envelopes, attachment chunks, request signatures and recovery
+// phrases, together with the inputs that produced them. A build that reproduces every
+// vector encrypts, decrypts and signs exactly as the builds that published them, so
+// clients of different versions, and third-party implementations checked against
+// vectors.json, can read each other's messages.
+//
+// The vectors are regenerated with 'go generate' only when the protocol changes on
+// purpose; existing keys and inputs are kept, so the diff shows what changed.
+package conformance
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mattd/clsp/internal/crypto"
+)
+
+//go:embed vectors.json
+var published []byte
+
+// Vectors is the contents of vectors.json. Byte strings are base64 in JSON, as in
+// message envelopes.
+type Vectors struct {
+	// Version increases whenever vectors are added or changed
+	Version      int              `json:"version"`
+	Keys         Keys             `json:"keys"`
+	Fingerprints Fingerprints     `json:"fingerprints"`
+	Prekeys      []PrekeyVector   `json:"prekeys"`
+	Messages     []MessageVector  `json:"messages"`
+	Chunks       []ChunkVector    `json:"chunks"`
+	Requests     []RequestVector  `json:"requests"`
+	Recovery     []RecoveryVector `json:"recovery"`
+}
+
+// Keys are the fixed keys every vector is made with. They are published, so they
+// must never be used for anything else.
+type Keys struct {
+	// Sender and Recipient are PEM-encoded PKCS #1 RSA identity keys
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	// SenderSigning is the seed of the sender's Ed25519 signing key
+	SenderSigning []byte `json:"sender_signing"`
+	// RecipientPrekey is the private half of the recipient's X25519 prekey
+	RecipientPrekey []byte `json:"recipient_prekey"`
+}
+
+// Fingerprints are derived from Keys alone
+type Fingerprints struct {
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	// SigningKey is the sender's signing key as published in the directory, with its
+	// fingerprint and the certificate by the sender's identity key
+	SigningKey         string `json:"signing_key"`
+	SigningFingerprint string `json:"signing_fingerprint"`
+	SigningCertificate []byte `json:"signing_certificate"`
+}
+
+// PrekeyVector is the recipient's prekey published at CreatedAt offering Suites
+type PrekeyVector struct {
+	Name      string   `json:"name"`
+	CreatedAt int64    `json:"created_at"`
+	Suites    []string `json:"suites"`
+	// Prekey is the expected result
+	Prekey *crypto.Prekey `json:"prekey"`
+}
+
+// AttachmentInput is an inline attachment to encrypt
+type AttachmentInput struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+// MessageVector is a message from the sender to the recipient. Random supplies, in
+// order, every random byte the encryption reads: the ephemeral X25519 key (or the
+// message key), the content nonce and the attachment nonce.
+type MessageVector struct {
+	Name string `json:"name"`
+	// Prekey names the PrekeyVector the message is encrypted to; without one the
+	// message key is wrapped to the recipient's RSA key
+	Prekey string `json:"prekey,omitempty"`
+	// Signing is "rsa" or "ed25519"
+	Signing    string              `json:"signing"`
+	Random     []byte              `json:"random,omitempty"`
+	Content    string              `json:"content"`
+	Attachment *AttachmentInput    `json:"attachment,omitempty"`
+	Part       *crypto.MessagePart `json:"part,omitempty"`
+	InReplyTo  string              `json:"in_reply_to,omitempty"`
+	ExpiresAt  int64               `json:"expires_at,omitempty"`
+	// Compression is the algorithm the sender compresses with (see crypto.Compressions)
+	Compression string `json:"compression,omitempty"`
+	// DecryptOnly marks envelopes that cannot be reproduced, such as those with RSA-OAEP
+	// padding; they are only decrypted and verified
+	DecryptOnly bool `json:"decrypt_only,omitempty"`
+	// Envelope is the expected message as EncodeMessage writes it
+	Envelope json.RawMessage `json:"envelope"`
+}
+
+// ChunkVector is one chunk of an uploaded attachment
+type ChunkVector struct {
+	Name       string `json:"name"`
+	Key        []byte `json:"key"`
+	Index      int64  `json:"index"`
+	Last       bool   `json:"last"`
+	Plaintext  string `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// RequestVector is a signed hub request by the sender
+type RequestVector struct {
+	Name      string   `json:"name"`
+	Action    string   `json:"action"`
+	UserID    string   `json:"user_id"`
+	Timestamp int64    `json:"timestamp"`
+	Fields    []string `json:"fields,omitempty"`
+	// Payload and Signature are the expected results
+	Payload   string `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// RecoveryVector is a recovery phrase and the keys derived from it
+type RecoveryVector struct {
+	Name    string `json:"name"`
+	Entropy []byte `json:"entropy"`
+	Phrase  string `json:"phrase"`
+	Key     []byte `json:"key"`
+	ID      string `json:"id"`
+}
+
+// Result is the outcome of one self-test check
+type Result struct {
+	Name string
+	Err  error
+}
+
+// Published returns the vectors built into this package
+func Published() (*Vectors, error) {
+	return Parse(published)
+}
+
+// PublishedJSON returns vectors.json as built into this package
+func PublishedJSON() []byte {
+	return bytes.Clone(published)
+}
+
+// Parse reads vectors in the format of vectors.json
+func Parse(data []byte) (*Vectors, error) {
+	var v Vectors
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid test vectors: %v", err)
+	}
+	return &v, nil
+}
+
+// keyring is Keys parsed
+type keyring struct {
+	sender    *rsa.PrivateKey
+	recipient *rsa.PrivateKey
+	signing   ed25519.PrivateKey
+	prekey    *ecdh.PrivateKey
+}
+
+// parseRSAKey reads a PEM-encoded PKCS #1 private key
+func parseRSAKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// parse reads the keys
+func (k *Keys) parse() (*keyring, error) {
+	var ring keyring
+	var err error
+	if ring.sender, err = parseRSAKey(k.Sender); err != nil {
+		return nil, fmt.Errorf("sender key: %v", err)
+	}
+	if ring.recipient, err = parseRSAKey(k.Recipient); err != nil {
+		return nil, fmt.Errorf("recipient key: %v", err)
+	}
+	if len(k.SenderSigning) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key: seed must be %d bytes", ed25519.SeedSize)
+	}
+	ring.signing = ed25519.NewKeyFromSeed(k.SenderSigning)
+	if ring.prekey, err = ecdh.X25519().NewPrivateKey(k.RecipientPrekey); err != nil {
+		return nil, fmt.Errorf("prekey: %v", err)
+	}
+	return &ring, nil
+}
+
+// Compute returns a copy of v with every expected result recomputed from its keys
+// and inputs by this build. Envelopes marked DecryptOnly are copied unchanged.
+func Compute(v *Vectors) (*Vectors, error) {
+	keys, err := v.Keys.parse()
+	if err != nil {
+		return nil, err
+	}
+	out := *v
+	if out.Fingerprints, err = keys.fingerprints(); err != nil {
+		return nil, err
+	}
+
+	out.Prekeys = make([]PrekeyVector, len(v.Prekeys))
+	for i, pv := range v.Prekeys {
+		if pv.Prekey, err = keys.prekeyFor(pv); err != nil {
+			return nil, fmt.Errorf("prekey %s: %v", pv.Name, err)
+		}
+		out.Prekeys[i] = pv
+	}
+	out.Messages = make([]MessageVector, len(v.Messages))
+	for i, mv := range v.Messages {
+		if !mv.DecryptOnly {
+			msg, err := out.Encrypt(mv, bytes.NewReader(mv.Random))
+			if err != nil {
+				return nil, fmt.Errorf("message %s: %v", mv.Name, err)
+			}
+			if mv.Envelope, err = crypto.EncodeMessage(msg); err != nil {
+				return nil, fmt.Errorf("message %s: %v", mv.Name, err)
+			}
+		}
+		out.Messages[i] = mv
+	}
+	out.Chunks = make([]ChunkVector, len(v.Chunks))
+	for i, cv := range v.Chunks {
+		if cv.Ciphertext, err = crypto.EncryptChunk(cv.Key, cv.Index, cv.Last, []byte(cv.Plaintext)); err != nil {
+			return nil, fmt.Errorf("chunk %s: %v", cv.Name, err)
+		}
+		out.Chunks[i] = cv
+	}
+	out.Requests = make([]RequestVector, len(v.Requests))
+	for i, rv := range v.Requests {
+		payload := crypto.RequestPayload(rv.Action, rv.UserID, rv.Timestamp, rv.Fields...)
+		rv.Payload = string(payload)
+		if rv.Signature, err = crypto.SignData(keys.sender, payload); err != nil {
+			return nil, fmt.Errorf("request %s: %v", rv.Name, err)
+		}
+		out.Requests[i] = rv
+	}
+	out.Recovery = make([]RecoveryVector, len(v.Recovery))
+	for i, rv := range v.Recovery {
+		if rv.Phrase, err = crypto.MnemonicFromEntropy(rv.Entropy); err != nil {
+			return nil, fmt.Errorf("recovery %s: %v", rv.Name, err)
+		}
+		if rv.Key, rv.ID, err = crypto.RecoveryKeys(rv.Entropy); err != nil {
+			return nil, fmt.Errorf("recovery %s: %v", rv.Name, err)
+		}
+		out.Recovery[i] = rv
+	}
+	return &out, nil
+}
+
+// fingerprints derives the fingerprints of the keys
+func (k *keyring) fingerprints() (Fingerprints, error) {
+	var f Fingerprints
+	var err error
+	if f.Sender, err = crypto.Fingerprint(&k.sender.PublicKey); err != nil {
+		return f, err
+	}
+	if f.Recipient, err = crypto.Fingerprint(&k.recipient.PublicKey); err != nil {
+		return f, err
+	}
+	public := k.signing.Public().(ed25519.PublicKey)
+	if f.SigningKey, err = crypto.SigningPublicKeyToPEM(public); err != nil {
+		return f, err
+	}
+	f.SigningFingerprint = crypto.SigningKeyFingerprint(public)
+	if f.SigningCertificate, err = crypto.CertifySigningKey(k.sender, f.SigningKey); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// prekeyFor publishes the recipient's prekey as described by pv
+func (k *keyring) prekeyFor(pv PrekeyVector) (*crypto.Prekey, error) {
+	return crypto.NewPrekey(k.recipient, k.prekey, time.Unix(pv.CreatedAt, 0), pv.Suites)
+}
+
+// Encrypt encrypts the message mv describes, reading its random bytes from random,
+// with the prekeys expected by v
+func (v *Vectors) Encrypt(mv MessageVector, random io.Reader) (*crypto.Message, error) {
+	keys, err := v.Keys.parse()
+	if err != nil {
+		return nil, err
+	}
+	var prekey *crypto.Prekey
+	if mv.Prekey != "" {
+		if prekey = v.prekey(mv.Prekey); prekey == nil {
+			return nil, fmt.Errorf("unknown prekey %q", mv.Prekey)
+		}
+	}
+	var attachment *crypto.Attachment
+	if a := mv.Attachment; a != nil {
+		attachment = &crypto.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        int64(len(a.Content)),
+			Content:     []byte(a.Content),
+		}
+	}
+	msg, err := crypto.EncryptMessageWith(random, keys.sender, &keys.recipient.PublicKey, prekey, []byte(mv.Content), attachment, crypto.EncryptOptions{
+		Part:        mv.Part,
+		InReplyTo:   mv.InReplyTo,
+		ExpiresAt:   mv.ExpiresAt,
+		Compression: mv.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch mv.Signing {
+	case "rsa":
+	case "ed25519":
+		if err := crypto.SignMessageEd25519(keys.signing, msg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown signing key %q", mv.Signing)
+	}
+	return msg, nil
+}
+
+// prekey returns the expected prekey of the named vector
+func (v *Vectors) prekey(name string) *crypto.Prekey {
+	for _, pv := range v.Prekeys {
+		if pv.Name == name {
+			return pv.Prekey
+		}
+	}
+	return nil
+}
+
+// SelfTest checks this build against the published vectors: it recomputes every
+// expected result and compares it byte for byte, and it decrypts and verifies every
+// published envelope.
+func SelfTest() []Result {
+	v, err := Published()
+	if err != nil {
+		return []Result{{Name: "vectors", Err: err}}
+	}
+	return Check(v)
+}
+
+// Check is SelfTest against the vectors v
+func Check(v *Vectors) []Result {
+	got, err := Compute(v)
+	if err != nil {
+		return []Result{{Name: "compute", Err: err}}
+	}
+	keys, err := v.Keys.parse()
+	if err != nil {
+		return []Result{{Name: "keys", Err: err}}
+	}
+
+	var results []Result
+	check := func(name string, err error) {
+		results = append(results, Result{Name: name, Err: err})
+	}
+
+	check("fingerprints", compareJSON(v.Fingerprints, got.Fingerprints))
+	for i, pv := range v.Prekeys {
+		err := compareJSON(pv.Prekey, got.Prekeys[i].Prekey)
+		if err == nil {
+			err = pv.Prekey.Verify(&keys.recipient.PublicKey)
+		}
+		check("prekey/"+pv.Name, err)
+	}
+	for i, mv := range v.Messages {
+		var err error
+		if !mv.DecryptOnly {
+			err = compareJSON(mv.Envelope, got.Messages[i].Envelope)
+		}
+		if err == nil {
+			err = keys.open(mv)
+		}
+		check("message/"+mv.Name, err)
+	}
+	for i, cv := range v.Chunks {
+		err := compareJSON(cv.Ciphertext, got.Chunks[i].Ciphertext)
+		if err == nil {
+			var plaintext []byte
+			plaintext, err = crypto.DecryptChunk(cv.Key, cv.Index, cv.Last, cv.Ciphertext)
+			if err == nil && string(plaintext) != cv.Plaintext {
+				err = fmt.Errorf("decrypted chunk differs")
+			}
+		}
+		check("chunk/"+cv.Name, err)
+	}
+	for i, rv := range v.Requests {
+		err := compareJSON(rv, got.Requests[i])
+		if err == nil {
+			err = crypto.VerifyData(&keys.sender.PublicKey, []byte(rv.Payload), rv.Signature)
+		}
+		check("request/"+rv.Name, err)
+	}
+	for i, rv := range v.Recovery {
+		err := compareJSON(rv, got.Recovery[i])
+		if err == nil {
+			var entropy []byte
+			entropy, err = crypto.MnemonicEntropy(rv.Phrase)
+			if err == nil && !bytes.Equal(entropy, rv.Entropy) {
+				err = fmt.Errorf("phrase reads back as different entropy")
+			}
+		}
+		check("recovery/"+rv.Name, err)
+	}
+	return results
+}
+
+// open decodes, verifies and decrypts a published envelope and compares the result
+// with the inputs
+func (k *keyring) open(mv MessageVector) error {
+	msg, err := crypto.DecodeMessage(mv.Envelope)
+	if err != nil {
+		return err
+	}
+	if err := crypto.VerifyMessageSignature(&k.sender.PublicKey, k.signing.Public().(ed25519.PublicKey), msg); err != nil {
+		return err
+	}
+	ring := &crypto.Keyring{Identity: k.recipient}
+	if msg.PrekeyID != "" {
+		ring.Prekeys = map[string]*ecdh.PrivateKey{msg.PrekeyID: k.prekey}
+	}
+	content, err := crypto.DecryptMessage(ring, msg)
+	if err != nil {
+		return err
+	}
+	if string(content) != mv.Content {
+		return fmt.Errorf("decrypted content differs")
+	}
+	if (msg.Attachment == nil) != (mv.Attachment == nil) {
+		return fmt.Errorf("attachment missing or unexpected")
+	}
+	if msg.Attachment != nil && string(msg.Attachment.Content) != mv.Attachment.Content {
+		return fmt.Errorf("decrypted attachment differs")
+	}
+	return nil
+}
+
+// compareJSON reports whether want and got encode to the same JSON, ignoring layout
+func compareJSON(want, got interface{}) error {
+	w, err := json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	g, err := json.Marshal(got)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(w, g) {
+		return fmt.Errorf("differs from the published vector:\n  published %s\n  computed  %s", w, g)
+	}
+	return nil
+}
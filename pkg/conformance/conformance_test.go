@@ -0,0 +1,106 @@
+package conformance_test
+
+import (
+	"testing"
+
+	"github.com/mattd/clsp/pkg/conformance"
+)
+
+// published parses a fresh copy of vectors.json, so a test can change it freely
+func published(t *testing.T) *conformance.Vectors {
+	t.Helper()
+	v, err := conformance.Parse(conformance.PublishedJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// checkNames returns the name of every check Check makes against v
+func checkNames(v *conformance.Vectors) []string {
+	names := []string{"fingerprints"}
+	for _, pv := range v.Prekeys {
+		names = append(names, "prekey/"+pv.Name)
+	}
+	for _, mv := range v.Messages {
+		names = append(names, "message/"+mv.Name)
+	}
+	for _, cv := range v.Chunks {
+		names = append(names, "chunk/"+cv.Name)
+	}
+	for _, rv := range v.Requests {
+		names = append(names, "request/"+rv.Name)
+	}
+	for _, rv := range v.Recovery {
+		names = append(names, "recovery/"+rv.Name)
+	}
+	return names
+}
+
+// TestPublishedVectors checks that internal/crypto reproduces every published vector
+// and decrypts and verifies every published envelope
+func TestPublishedVectors(t *testing.T) {
+	v := published(t)
+	if len(v.Prekeys) == 0 || len(v.Messages) == 0 || len(v.Chunks) == 0 || len(v.Requests) == 0 || len(v.Recovery) == 0 {
+		t.Fatal("vectors.json lacks a kind of vector")
+	}
+
+	results := conformance.SelfTest()
+	checked := make(map[string]bool)
+	for _, r := range results {
+		r := r
+		checked[r.Name] = true
+		t.Run(r.Name, func(t *testing.T) {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		})
+	}
+	for _, name := range checkNames(v) {
+		if !checked[name] {
+			t.Errorf("vector %s was not checked", name)
+		}
+	}
+	if len(results) != len(checked) {
+		t.Errorf("%d checks for %d distinct vectors", len(results), len(checked))
+	}
+}
+
+// TestCheckDetectsChanges checks that Check fails a vector whose published result no
+// longer matches its inputs, so a passing TestPublishedVectors means something
+func TestCheckDetectsChanges(t *testing.T) {
+	v := published(t)
+	tests := []struct {
+		name   string
+		change func(v *conformance.Vectors)
+	}{
+		{"fingerprints", func(v *conformance.Vectors) { v.Fingerprints.Sender += "0" }},
+		{"prekey/" + v.Prekeys[0].Name, func(v *conformance.Vectors) { v.Prekeys[0].Prekey.CreatedAt++ }},
+		{"chunk/" + v.Chunks[0].Name, func(v *conformance.Vectors) { v.Chunks[0].Ciphertext[0] ^= 1 }},
+		{"request/" + v.Requests[0].Name, func(v *conformance.Vectors) { v.Requests[0].Timestamp++ }},
+		{"recovery/" + v.Recovery[0].Name, func(v *conformance.Vectors) { v.Recovery[0].Entropy[0] ^= 1 }},
+	}
+	for i, mv := range v.Messages {
+		i := i
+		tests = append(tests, struct {
+			name   string
+			change func(v *conformance.Vectors)
+		}{"message/" + mv.Name, func(v *conformance.Vectors) { v.Messages[i].Content += "!" }})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := published(t)
+			tt.change(changed)
+			for _, r := range conformance.Check(changed) {
+				if r.Name == tt.name {
+					if r.Err == nil {
+						t.Fatal("changed vector passed")
+					}
+					return
+				}
+			}
+			t.Fatal("changed vector was not checked")
+		})
+	}
+}